@@ -0,0 +1,436 @@
+// Package asm contains a small two-pass Z80 assembler.
+//
+// The assembler is deliberately simple, it exists so that test-cases and
+// the embedded utilities can be written as readable assembly rather than
+// as hand-assembled arrays of bytes.  It supports the documented Z80
+// instruction set, labels, EQU, ORG, DB/DEFB, DW/DEFW, DS/DEFS, and simple
+// arithmetic expressions.  Macros and conditional assembly are not
+// supported.
+package asm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Program holds the result of assembling some source.
+type Program struct {
+	// Origin holds the address of the first byte of output, as set by
+	// the first ORG statement.  It defaults to 0x0100.
+	Origin uint16
+
+	// Bytes contains the generated machine code.
+	Bytes []byte
+
+	// Symbols contains the labels, and EQU-defined constants, along
+	// with their values.
+	Symbols map[string]uint16
+}
+
+// assembler holds our state while processing source.
+type assembler struct {
+
+	// pass is either 1 or 2.
+	pass int
+
+	// pc holds the current output address.
+	pc uint16
+
+	// origin holds the address of the first output byte.
+	origin uint16
+
+	// originSet is true once we've seen an ORG statement, or emitted a byte.
+	originSet bool
+
+	// out holds our generated output.
+	out []byte
+
+	// symbols holds labels and constants.
+	symbols map[string]uint16
+
+	// line is the line-number we're processing, for error-reporting.
+	line int
+}
+
+// Assemble converts the given source into machine code.
+func Assemble(src string) (Program, error) {
+
+	a := &assembler{symbols: make(map[string]uint16)}
+
+	for _, pass := range []int{1, 2} {
+		a.pass = pass
+		a.pc = 0x0100
+		a.origin = 0x0100
+		a.originSet = false
+		a.out = nil
+
+		for i, line := range strings.Split(src, "\n") {
+			a.line = i + 1
+			done, err := a.processLine(line)
+			if err != nil {
+				return Program{}, fmt.Errorf("line %d: %s", a.line, err)
+			}
+			if done {
+				break
+			}
+		}
+	}
+
+	return Program{Origin: a.origin, Bytes: a.out, Symbols: a.symbols}, nil
+}
+
+// MustAssemble is like Assemble, but panics on error.
+//
+// It exists to simplify test-cases.
+func MustAssemble(src string) []byte {
+	p, err := Assemble(src)
+	if err != nil {
+		panic(err)
+	}
+	return p.Bytes
+}
+
+// stripComment removes any trailing comment from the line, taking care
+// to ignore semi-colons which appear inside quoted strings.
+func stripComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			// Don't treat the prime in "AF'" as a quote.
+			if c == '\'' && i > 0 && strings.HasSuffix(strings.ToUpper(line[:i]), "AF") {
+				continue
+			}
+			quote = c
+		case c == ';':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// splitOperands splits the operands of an instruction upon commas, taking
+// care to ignore commas which appear inside quoted strings.
+func splitOperands(str string) []string {
+	var ret []string
+	var quote rune
+	cur := ""
+	for _, c := range str {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+			cur += string(c)
+		case c == '"' || (c == '\'' && !strings.HasSuffix(strings.ToUpper(cur), "AF")):
+			quote = c
+			cur += string(c)
+		case c == ',':
+			ret = append(ret, strings.TrimSpace(cur))
+			cur = ""
+		default:
+			cur += string(c)
+		}
+	}
+	if strings.TrimSpace(cur) != "" {
+		ret = append(ret, strings.TrimSpace(cur))
+	}
+	return ret
+}
+
+// processLine handles a single line of input.
+//
+// It returns true if the END directive was seen.
+func (a *assembler) processLine(line string) (bool, error) {
+
+	line = stripComment(line)
+	if strings.TrimSpace(line) == "" {
+		return false, nil
+	}
+
+	// A label is either something followed by a colon, or an
+	// identifier starting in the first column.
+	label := ""
+	rest := line
+	if idx := strings.Index(line, ":"); idx > 0 && isIdentifier(strings.TrimSpace(line[:idx])) {
+		label = strings.TrimSpace(line[:idx])
+		rest = line[idx+1:]
+	} else if line[0] != ' ' && line[0] != '\t' {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && !isMnemonic(fields[0]) {
+			label = fields[0]
+			rest = strings.TrimSpace(line[len(fields[0]):])
+		}
+	}
+
+	rest = strings.TrimSpace(rest)
+	mnemonic := ""
+	operands := ""
+	if rest != "" {
+		fields := strings.SplitN(rest, " ", 2)
+		if strings.ContainsAny(fields[0], "\t") {
+			fields = strings.SplitN(rest, "\t", 2)
+		}
+		mnemonic = strings.ToUpper(strings.TrimSpace(fields[0]))
+		if len(fields) > 1 {
+			operands = strings.TrimSpace(fields[1])
+		}
+	}
+
+	// EQU is special, because the label gets the value of the operand
+	// rather than the current address.
+	if mnemonic == "EQU" {
+		if label == "" {
+			return false, fmt.Errorf("EQU without a label")
+		}
+		v, err := a.eval(operands)
+		if err != nil {
+			return false, err
+		}
+		a.symbols[strings.ToUpper(label)] = v
+		return false, nil
+	}
+
+	// ORG updates the current address.
+	if mnemonic == "ORG" {
+		v, err := a.eval(operands)
+		if err != nil {
+			return false, err
+		}
+		if !a.originSet {
+			a.origin = v
+			a.originSet = true
+		} else {
+			// Pad forward, within the output.
+			for a.pc < v {
+				a.emit(0x00)
+			}
+		}
+		a.pc = v
+		if label != "" {
+			a.symbols[strings.ToUpper(label)] = v
+		}
+		return false, nil
+	}
+
+	if label != "" {
+		name := strings.ToUpper(label)
+		if _, ok := a.symbols[name]; ok && a.pass == 1 {
+			return false, fmt.Errorf("duplicate label %s", label)
+		}
+		a.symbols[name] = a.pc
+	}
+
+	switch mnemonic {
+	case "":
+		return false, nil
+	case "END":
+		return true, nil
+	}
+
+	return false, a.instruction(mnemonic, splitOperands(operands))
+}
+
+// emit appends bytes to our output, bumping the current address.
+func (a *assembler) emit(b ...byte) {
+	a.originSet = true
+	a.out = append(a.out, b...)
+	a.pc += uint16(len(b))
+}
+
+// isIdentifier returns true if the string is a valid label/symbol name.
+func isIdentifier(str string) bool {
+	if str == "" {
+		return false
+	}
+	for i, c := range str {
+		if c == '_' || c == '.' || c == '$' || c == '?' || c == '@' ||
+			(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(i > 0 && c >= '0' && c <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// isMnemonic returns true if the given string is a known instruction
+// or directive.
+func isMnemonic(str string) bool {
+	str = strings.ToUpper(str)
+	switch str {
+	case "EQU", "ORG", "END", "DB", "DEFB", "DEFM", "DW", "DEFW", "DS", "DEFS":
+		return true
+	}
+	if _, ok := implied[str]; ok {
+		return true
+	}
+	switch str {
+	case "LD", "PUSH", "POP", "EX", "ADD", "ADC", "SUB", "SBC", "AND", "XOR", "OR", "CP",
+		"INC", "DEC", "JP", "JR", "DJNZ", "CALL", "RET", "RST", "IN", "OUT", "IM",
+		"RLC", "RRC", "RL", "RR", "SLA", "SRA", "SLL", "SRL", "BIT", "RES", "SET":
+		return true
+	}
+	return false
+}
+
+// eval evaluates an expression, which may contain numbers, characters,
+// symbols, "$" for the current address, and the operators +, -, *, and /.
+//
+// During the first pass unknown symbols evaluate to zero.
+func (a *assembler) eval(expr string) (uint16, error) {
+	v, err := a.evalInt(strings.TrimSpace(expr))
+	return uint16(v), err
+}
+
+// evalInt does the real work of evaluating an expression.
+func (a *assembler) evalInt(expr string) (int, error) {
+
+	if expr == "" {
+		return 0, fmt.Errorf("empty expression")
+	}
+
+	// Handle parenthesised sub-expressions.
+	if expr[0] == '(' && expr[len(expr)-1] == ')' && matchingParen(expr) == len(expr)-1 {
+		return a.evalInt(strings.TrimSpace(expr[1 : len(expr)-1]))
+	}
+
+	// Find the lowest-precedence binary operator, outside of
+	// parenthesis or quotes, scanning from the right so that
+	// operators are left-associative.
+	for _, ops := range []string{"+-", "*/"} {
+		depth := 0
+		inQuote := false
+		for i := len(expr) - 1; i > 0; i-- {
+			c := expr[i]
+			switch {
+			case c == '\'' || c == '"':
+				inQuote = !inQuote
+			case inQuote:
+			case c == ')':
+				depth++
+			case c == '(':
+				depth--
+			case depth == 0 && strings.IndexByte(ops, c) >= 0:
+				// Ignore unary operators.
+				prev := strings.TrimSpace(expr[:i])
+				if prev == "" || strings.ContainsAny(prev[len(prev)-1:], "+-*/(") {
+					continue
+				}
+				l, err := a.evalInt(strings.TrimSpace(expr[:i]))
+				if err != nil {
+					return 0, err
+				}
+				r, err := a.evalInt(strings.TrimSpace(expr[i+1:]))
+				if err != nil {
+					return 0, err
+				}
+				switch c {
+				case '+':
+					return l + r, nil
+				case '-':
+					return l - r, nil
+				case '*':
+					return l * r, nil
+				case '/':
+					if r == 0 {
+						return 0, fmt.Errorf("division by zero")
+					}
+					return l / r, nil
+				}
+			}
+		}
+	}
+
+	// Unary operators.
+	if expr[0] == '-' {
+		v, err := a.evalInt(strings.TrimSpace(expr[1:]))
+		return -v, err
+	}
+	if expr[0] == '+' {
+		return a.evalInt(strings.TrimSpace(expr[1:]))
+	}
+
+	// Current address.
+	if expr == "$" {
+		return int(a.pc), nil
+	}
+
+	// Character literals.
+	if len(expr) == 3 && (expr[0] == '\'' || expr[0] == '"') && expr[2] == expr[0] {
+		return int(expr[1]), nil
+	}
+
+	// Numbers.
+	if expr[0] >= '0' && expr[0] <= '9' || expr[0] == '$' || expr[0] == '%' {
+		return parseNumber(expr)
+	}
+
+	// Symbols.
+	if isIdentifier(expr) {
+		v, ok := a.symbols[strings.ToUpper(expr)]
+		if !ok {
+			if a.pass == 1 {
+				return 0, nil
+			}
+			return 0, fmt.Errorf("undefined symbol %s", expr)
+		}
+		return int(v), nil
+	}
+
+	return 0, fmt.Errorf("failed to parse expression '%s'", expr)
+}
+
+// matchingParen returns the offset of the parenthesis which closes the
+// one at the start of the string.
+func matchingParen(str string) int {
+	depth := 0
+	for i, c := range str {
+		if c == '(' {
+			depth++
+		}
+		if c == ')' {
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// parseNumber handles the various number formats in use: 0x1F, $1F,
+// 1FH, %0101, 0101B, and plain decimal.
+func parseNumber(str string) (int, error) {
+	s := strings.ToUpper(str)
+	base := 10
+
+	switch {
+	case strings.HasPrefix(s, "0X"):
+		s = s[2:]
+		base = 16
+	case strings.HasPrefix(s, "$"):
+		s = s[1:]
+		base = 16
+	case strings.HasPrefix(s, "%"):
+		s = s[1:]
+		base = 2
+	case strings.HasSuffix(s, "H"):
+		s = s[:len(s)-1]
+		base = 16
+	case strings.HasSuffix(s, "B") && strings.Trim(s[:len(s)-1], "01") == "":
+		s = s[:len(s)-1]
+		base = 2
+	}
+
+	v, err := strconv.ParseInt(s, base, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number '%s'", str)
+	}
+	return int(v), nil
+}
@@ -0,0 +1,336 @@
+package asm
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestInstructions tests the encoding of a selection of instructions.
+func TestInstructions(t *testing.T) {
+
+	type TestCase struct {
+		src string
+		out []byte
+	}
+
+	tests := []TestCase{
+		{"NOP", []byte{0x00}},
+		{"LD C, 99", []byte{0x0E, 0x63}},
+		{"CALL 0x0005", []byte{0xCD, 0x05, 0x00}},
+		{"LD HL, 0x1234", []byte{0x21, 0x34, 0x12}},
+		{"LD A, (HL)", []byte{0x7E}},
+		{"LD (IX+2), A", []byte{0xDD, 0x77, 0x02}},
+		{"OUT (0xFF), A", []byte{0xD3, 0xFF}},
+		{"JP NZ, 0x0100", []byte{0xC2, 0x00, 0x01}},
+		{"JR $", []byte{0x18, 0xFE}},
+		{"BIT 7, (HL)", []byte{0xCB, 0x7E}},
+		{"LDIR", []byte{0xED, 0xB0}},
+		{"PUSH IY", []byte{0xFD, 0xE5}},
+		{"ADD HL, DE", []byte{0x19}},
+		{"SUB '0'", []byte{0xD6, 0x30}},
+		{"DB \"OK\", 0x0D, '$'", []byte{'O', 'K', 0x0D, '$'}},
+		{"DW 0x1234", []byte{0x34, 0x12}},
+	}
+
+	for _, test := range tests {
+		out, err := Assemble(test.src)
+		if err != nil {
+			t.Fatalf("error assembling '%s': %s", test.src, err)
+		}
+		if !bytes.Equal(out.Bytes, test.out) {
+			t.Fatalf("wrong output for '%s', got % X expected % X", test.src, out.Bytes, test.out)
+		}
+	}
+}
+
+// TestLabels tests forward references, and EQU.
+func TestLabels(t *testing.T) {
+
+	src := `
+BDOS:   EQU 5
+        ORG 100H
+        LD DE, MSG
+        LD C, 9
+        CALL BDOS
+        RET
+MSG:    DB "Hi$"
+`
+	out, err := Assemble(src)
+	if err != nil {
+		t.Fatalf("error assembling: %s", err)
+	}
+	if out.Symbols["MSG"] != 0x0109 {
+		t.Fatalf("wrong address for label, got %04X", out.Symbols["MSG"])
+	}
+	if out.Bytes[1] != 0x09 || out.Bytes[2] != 0x01 {
+		t.Fatalf("forward reference wasn't resolved")
+	}
+}
+
+// TestErrors tests that bogus input is rejected.
+func TestErrors(t *testing.T) {
+
+	tests := []string{
+		"FOO A",
+		"LD A, UNKNOWN",
+		"JR 0x1000",
+	}
+
+	for _, src := range tests {
+		_, err := Assemble(src)
+		if err == nil {
+			t.Fatalf("expected an error assembling '%s'", src)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected MustAssemble to panic")
+		}
+	}()
+	MustAssemble("FOO A")
+}
+
+// TestStatic ensures we produce identical output to the binaries we
+// embed, which were generated with pasmo.
+func TestStatic(t *testing.T) {
+
+	files, err := filepath.Glob(filepath.Join("..", "static", "*.z80"))
+	if err != nil {
+		t.Fatalf("failed to find sources: %s", err)
+	}
+
+	for _, file := range files {
+
+		name := strings.TrimSuffix(filepath.Base(file), ".z80")
+		name = "!" + strings.ToUpper(name) + ".COM"
+		if name == "!COMMENT.COM" {
+			name = "#.COM"
+		}
+
+		expected, err := os.ReadFile(filepath.Join("..", "static", "A", name))
+		if err != nil {
+			continue
+		}
+
+		src, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", file, err)
+		}
+
+		out, err := Assemble(string(src))
+		if err != nil {
+			t.Fatalf("error assembling %s: %s", file, err)
+		}
+		if !bytes.Equal(out.Bytes, expected) {
+			t.Fatalf("output of %s differs from %s", file, name)
+		}
+	}
+}
+
+// TestDisassemble tests the decoding of a selection of instructions.
+func TestDisassemble(t *testing.T) {
+
+	type TestCase struct {
+		in  []byte
+		out string
+		len int
+	}
+
+	tests := []TestCase{
+		{[]byte{0x00}, "NOP", 1},
+		{[]byte{0x0E, 0x63}, "LD C, 0x63", 2},
+		{[]byte{0xCD, 0x05, 0x00}, "CALL 0x0005", 3},
+		{[]byte{0x18, 0xFE}, "JR 0x0100", 2},
+		{[]byte{0xDD, 0x77, 0xFE}, "LD (IX-0x02), A", 3},
+		{[]byte{0xFD, 0x36, 0x03, 0x10}, "LD (IY+0x03), 0x10", 4},
+		{[]byte{0xDD, 0xCB, 0x01, 0x7E}, "BIT 7, (IX+0x01)", 4},
+		{[]byte{0xDD, 0x66, 0x01}, "LD H, (IX+0x01)", 3},
+		{[]byte{0xFD, 0xE9}, "JP (IY)", 2},
+		{[]byte{0xED, 0xB0}, "LDIR", 2},
+		{[]byte{0xED, 0x5B, 0x00, 0x80}, "LD DE, (0x8000)", 4},
+		{[]byte{0xED, 0x00}, "DB 0xED, 0x00", 2},
+
+		// Prefix without effect.
+		{[]byte{0xDD, 0x00}, "NOP", 1},
+
+		// Truncated
+		{[]byte{0xC3}, "JP 0x0000", 3},
+	}
+
+	for _, test := range tests {
+		out, n := Disassemble(test.in, 0x0100)
+		if out != test.out || n != test.len {
+			t.Fatalf("wrong output for % X, got '%s' (%d) expected '%s' (%d)", test.in, out, n, test.out, test.len)
+		}
+	}
+
+	lines := DisassembleRange([]byte{0x0E, 0x09, 0xC9}, 0x0200)
+	if len(lines) != 2 {
+		t.Fatalf("wrong number of lines: %v", lines)
+	}
+	if lines[0] != "0200  0E 09        LD C, 0x09" {
+		t.Fatalf("unexpected output '%s'", lines[0])
+	}
+}
+
+// TestDisassembleAnnotated tests the comments added to calls to the BDOS.
+func TestDisassembleAnnotated(t *testing.T) {
+
+	code := MustAssemble(`
+	ORG 0x0100
+	LD C, 9
+	LD DE, msg
+	CALL 5
+	LD BC, 0x020B
+	CALL 5
+	LD C, 99
+	CALL 5
+	LD C, 2
+	INC C
+	CALL 5
+	LD C, 1
+	CALL sub
+	CALL 5
+	JP 0
+msg:
+	RET
+sub:
+	RET
+`)
+
+	names := map[uint8]string{9: "C_WRITESTRING", 11: "C_STAT"}
+
+	expected := []string{
+		"; BDOS 9 C_WRITESTRING",
+		"; BDOS 11 C_STAT",
+		"; BDOS 99",
+		"; BDOS",
+		"; BDOS",
+		"; warm boot",
+	}
+
+	found := []string{}
+	for _, line := range DisassembleAnnotated(code, 0x0100, names) {
+		if _, comment, ok := strings.Cut(line, "; "); ok {
+			found = append(found, "; "+comment)
+		}
+	}
+
+	if strings.Join(found, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected annotations:\n%s", strings.Join(DisassembleAnnotated(code, 0x0100, names), "\n"))
+	}
+
+	// Without annotations nothing is added.
+	for _, line := range DisassembleRange(code, 0x0100) {
+		if strings.Contains(line, ";") {
+			t.Fatalf("unexpected comment in '%s'", line)
+		}
+	}
+}
+
+// TestDisassembleSymbols ensures that symbols are shown as labels, and in
+// place of the addresses they name.
+func TestDisassembleSymbols(t *testing.T) {
+
+	code := MustAssemble(`
+	ORG 0x0100
+	LD C, 9
+	LD DE, msg
+	CALL 5
+loop:
+	JR loop
+msg:
+	DB "$"
+`)
+
+	symbols := map[uint16]string{0x0100: "START", 0x0108: "LOOP", 0x010A: "MSG"}
+	lines := DisassembleSymbols(code, 0x0100, map[uint8]string{9: "C_WRITESTRING"}, symbols)
+
+	expected := []string{"START:", "LD DE, MSG", "C_WRITESTRING", "LOOP:", "JR LOOP", "MSG:"}
+	out := strings.Join(lines, "\n")
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Fatalf("expected %q in:\n%s", e, out)
+		}
+	}
+
+	// Without symbols we match DisassembleAnnotated.
+	if strings.Join(DisassembleSymbols(code, 0x0100, nil, nil), "\n") != strings.Join(DisassembleAnnotated(code, 0x0100, nil), "\n") {
+		t.Fatalf("unexpected output without symbols")
+	}
+}
+
+// TestFindCalls tests the recognition of calls to the operating system.
+func TestFindCalls(t *testing.T) {
+
+	code := MustAssemble(`
+	ORG 0x0100
+	LD C, 9
+	CALL 5
+	LD HL, (1)
+	LD DE, 9
+	ADD HL, DE
+	JP (HL)
+	LD HL, (1)
+	LD L, 6
+	JP (HL)
+	LD HL, (1)
+	LD DE, 1
+	ADD HL, DE
+	JP (HL)
+	LD HL, 0x1234
+	JP (HL)
+	RST 0x38
+	JP 5
+	JP 0
+`)
+
+	expected := []string{"BDOS 9", "BIOS 4", "BIOS 2", "RST 0x38", "BDOS", "BOOT"}
+
+	found := []string{}
+	for _, call := range FindCalls(code, 0x0100) {
+		found = append(found, call.String())
+	}
+	if strings.Join(found, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected calls %v, expected %v", found, expected)
+	}
+
+	calls := FindCalls(code, 0x0100)
+	if calls[0].Addr != 0x0102 {
+		t.Fatalf("unexpected address %04X", calls[0].Addr)
+	}
+}
+
+// TestDisassembleRoundTrip ensures that disassembling the unprefixed, and
+// CB-prefixed, opcodes and reassembling the result is lossless.
+func TestDisassembleRoundTrip(t *testing.T) {
+
+	for _, prefix := range [][]byte{{}, {0xCB}} {
+		for op := 0; op < 256; op++ {
+
+			code := append(append([]byte{}, prefix...), byte(op), 0x34, 0x12)
+
+			// Skip prefixes, and the undocumented SLL.
+			if len(prefix) == 0 && (op == 0xCB || op == 0xED || op == 0xDD || op == 0xFD) {
+				continue
+			}
+			if len(prefix) > 0 && op >= 0x30 && op <= 0x37 {
+				continue
+			}
+
+			text, n := Disassemble(code, 0x0100)
+
+			out, err := Assemble("ORG 0x0100\n" + text)
+			if err != nil {
+				t.Fatalf("failed to reassemble '%s': %s", text, err)
+			}
+			if !bytes.Equal(out.Bytes, code[:n]) {
+				t.Fatalf("round-trip failed for % X, '%s' became % X", code[:n], text, out.Bytes)
+			}
+		}
+	}
+}
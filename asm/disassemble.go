@@ -0,0 +1,516 @@
+package asm
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The tables below are indexed by the fields of an opcode, following the
+// usual decoding scheme where an opcode is split into the bit-fields
+// x (bits 7-6), y (bits 5-3), and z (bits 2-0), and y is further split
+// into p (bits 5-4) and q (bit 3).
+
+// dReg contains the 8-bit registers.
+var dReg = []string{"B", "C", "D", "E", "H", "L", "(HL)", "A"}
+
+// dPair contains the register pairs used by most instructions.
+var dPair = []string{"BC", "DE", "HL", "SP"}
+
+// dPair2 contains the register pairs used by PUSH and POP.
+var dPair2 = []string{"BC", "DE", "HL", "AF"}
+
+// dCond contains the condition codes.
+var dCond = []string{"NZ", "Z", "NC", "C", "PO", "PE", "P", "M"}
+
+// dALU contains the arithmetic and logical operations.
+var dALU = []string{"ADD A,", "ADC A,", "SUB ", "SBC A,", "AND ", "XOR ", "OR ", "CP "}
+
+// dRot contains the rotation and shift operations.
+var dRot = []string{"RLC", "RRC", "RL", "RR", "SLA", "SRA", "SLL", "SRL"}
+
+// dAcc contains the accumulator and flag operations.
+var dAcc = []string{"RLCA", "RRCA", "RLA", "RRA", "DAA", "CPL", "SCF", "CCF"}
+
+// dBlock contains the block instructions, indexed by y-4 and z.
+var dBlock = [][]string{
+	{"LDI", "CPI", "INI", "OUTI"},
+	{"LDD", "CPD", "IND", "OUTD"},
+	{"LDIR", "CPIR", "INIR", "OTIR"},
+	{"LDDR", "CPDR", "INDR", "OTDR"},
+}
+
+// disassembler holds our state while decoding a single instruction.
+type disassembler struct {
+
+	// code contains the bytes we're decoding.
+	code []byte
+
+	// pos is the offset of the next byte to read.
+	pos int
+
+	// addr is the address of the instruction.
+	addr uint16
+
+	// index is "IX" or "IY" if we've seen an index prefix, otherwise
+	// it is empty.
+	index string
+
+	// indexed is set if the instruction made use of the index register.
+	indexed bool
+}
+
+// next returns the next byte of the instruction, or zero if we've run
+// out of input.
+func (d *disassembler) next() byte {
+	b := byte(0)
+	if d.pos < len(d.code) {
+		b = d.code[d.pos]
+	}
+	d.pos++
+	return b
+}
+
+// imm8 reads an immediate byte.
+func (d *disassembler) imm8() string {
+	return fmt.Sprintf("0x%02X", d.next())
+}
+
+// imm16 reads an immediate word.
+func (d *disassembler) imm16() string {
+	lo := d.next()
+	hi := d.next()
+	return fmt.Sprintf("0x%04X", uint16(hi)<<8|uint16(lo))
+}
+
+// relative reads a relative displacement, returning the destination.
+func (d *disassembler) relative() string {
+	off := int8(d.next())
+	return fmt.Sprintf("0x%04X", uint16(int(d.addr)+d.pos+int(off)))
+}
+
+// displacement reads an index displacement, returning "(IX+n)".
+func (d *disassembler) displacement() string {
+	d.indexed = true
+	off := int8(d.next())
+	if off < 0 {
+		return fmt.Sprintf("(%s-0x%02X)", d.index, -int(off))
+	}
+	return fmt.Sprintf("(%s+0x%02X)", d.index, off)
+}
+
+// hl returns the name of HL, taking into account any index prefix.
+func (d *disassembler) hl() string {
+	if d.index != "" {
+		d.indexed = true
+		return d.index
+	}
+	return "HL"
+}
+
+// pair returns the name of the given register pair.
+func (d *disassembler) pair(table []string, p byte) string {
+	if p == 2 {
+		return d.hl()
+	}
+	return table[p]
+}
+
+// reg returns the name of the given 8-bit register.
+//
+// If plain is true then H and L are not replaced by the halves of the
+// index registers, which is the case when (IX+n) is also used.
+func (d *disassembler) reg(r byte, plain bool) string {
+	if d.index == "" {
+		return dReg[r]
+	}
+	switch r {
+	case 4:
+		if !plain {
+			d.indexed = true
+			return d.index + "H"
+		}
+	case 5:
+		if !plain {
+			d.indexed = true
+			return d.index + "L"
+		}
+	case 6:
+		return d.displacement()
+	}
+	return dReg[r]
+}
+
+// Disassemble decodes the single instruction at the start of the given
+// code, which is located at the given address.
+//
+// The text of the instruction is returned, along with its length in bytes.
+// If the code is truncated the missing bytes are treated as zero.
+func Disassemble(code []byte, addr uint16) (string, int) {
+
+	d := &disassembler{code: code, addr: addr}
+
+	op := d.next()
+
+	// Index prefixes.  Repeated prefixes are treated as a NOP.
+	for op == 0xDD || op == 0xFD {
+		if d.index != "" {
+			return "NOP", 1
+		}
+		d.index = "IX"
+		if op == 0xFD {
+			d.index = "IY"
+		}
+		op = d.next()
+	}
+
+	var text string
+	switch op {
+	case 0xCB:
+		text = d.decodeCB()
+	case 0xED:
+		// An index prefix has no effect on ED instructions.
+		if d.index != "" {
+			return "NOP", 1
+		}
+		text = d.decodeED()
+	default:
+		text = d.decode(op)
+	}
+
+	// An index prefix on an instruction which doesn't use HL has no
+	// effect, so we treat the prefix as a NOP by itself.
+	if d.index != "" && !d.indexed {
+		return "NOP", 1
+	}
+	return text, d.pos
+}
+
+// decode handles the unprefixed, and index-prefixed, instructions.
+func (d *disassembler) decode(op byte) string {
+
+	x, y, z := op>>6, (op>>3)&7, op&7
+	p, q := y>>1, y&1
+
+	switch x {
+	case 0:
+		switch z {
+		case 0:
+			switch y {
+			case 0:
+				return "NOP"
+			case 1:
+				return "EX AF, AF'"
+			case 2:
+				return "DJNZ " + d.relative()
+			case 3:
+				return "JR " + d.relative()
+			default:
+				return "JR " + dCond[y-4] + ", " + d.relative()
+			}
+		case 1:
+			if q == 0 {
+				return "LD " + d.pair(dPair, p) + ", " + d.imm16()
+			}
+			return "ADD " + d.hl() + ", " + d.pair(dPair, p)
+		case 2:
+			switch y {
+			case 0:
+				return "LD (BC), A"
+			case 1:
+				return "LD A, (BC)"
+			case 2:
+				return "LD (DE), A"
+			case 3:
+				return "LD A, (DE)"
+			case 4:
+				return "LD (" + d.imm16() + "), " + d.hl()
+			case 5:
+				return "LD " + d.hl() + ", (" + d.imm16() + ")"
+			case 6:
+				return "LD (" + d.imm16() + "), A"
+			default:
+				return "LD A, (" + d.imm16() + ")"
+			}
+		case 3:
+			if q == 0 {
+				return "INC " + d.pair(dPair, p)
+			}
+			return "DEC " + d.pair(dPair, p)
+		case 4:
+			return "INC " + d.reg(y, false)
+		case 5:
+			return "DEC " + d.reg(y, false)
+		case 6:
+			r := d.reg(y, false)
+			return "LD " + r + ", " + d.imm8()
+		default:
+			return dAcc[y]
+		}
+
+	case 1:
+		if y == 6 && z == 6 {
+			return "HALT"
+		}
+		plain := y == 6 || z == 6
+		dst := d.reg(y, plain)
+		src := d.reg(z, plain)
+		return "LD " + dst + ", " + src
+
+	case 2:
+		return dALU[y] + d.reg(z, false)
+	}
+
+	// x == 3
+	switch z {
+	case 0:
+		return "RET " + dCond[y]
+	case 1:
+		if q == 0 {
+			return "POP " + d.pair(dPair2, p)
+		}
+		switch p {
+		case 0:
+			return "RET"
+		case 1:
+			return "EXX"
+		case 2:
+			return "JP (" + d.hl() + ")"
+		default:
+			return "LD SP, " + d.hl()
+		}
+	case 2:
+		return "JP " + dCond[y] + ", " + d.imm16()
+	case 3:
+		switch y {
+		case 0:
+			return "JP " + d.imm16()
+		case 2:
+			return "OUT (" + d.imm8() + "), A"
+		case 3:
+			return "IN A, (" + d.imm8() + ")"
+		case 4:
+			return "EX (SP), " + d.hl()
+		case 5:
+			return "EX DE, HL"
+		case 6:
+			return "DI"
+		default:
+			return "EI"
+		}
+	case 4:
+		return "CALL " + dCond[y] + ", " + d.imm16()
+	case 5:
+		if q == 0 {
+			return "PUSH " + d.pair(dPair2, p)
+		}
+		return "CALL " + d.imm16()
+	case 6:
+		return dALU[y] + d.imm8()
+	}
+	return fmt.Sprintf("RST 0x%02X", y*8)
+}
+
+// decodeCB handles the CB-prefixed rotate, shift, and bit instructions.
+//
+// With an index prefix the displacement precedes the final opcode byte.
+func (d *disassembler) decodeCB() string {
+
+	operand := ""
+	if d.index != "" {
+		operand = d.displacement()
+	}
+
+	op := d.next()
+	x, y, z := op>>6, (op>>3)&7, op&7
+
+	if operand == "" {
+		operand = dReg[z]
+	}
+
+	switch x {
+	case 0:
+		return dRot[y] + " " + operand
+	case 1:
+		return fmt.Sprintf("BIT %d, %s", y, operand)
+	case 2:
+		return fmt.Sprintf("RES %d, %s", y, operand)
+	}
+	return fmt.Sprintf("SET %d, %s", y, operand)
+}
+
+// decodeED handles the ED-prefixed instructions.
+func (d *disassembler) decodeED() string {
+
+	op := d.next()
+	x, y, z := op>>6, (op>>3)&7, op&7
+	p, q := y>>1, y&1
+
+	if x == 2 && z <= 3 && y >= 4 {
+		return dBlock[y-4][z]
+	}
+
+	if x != 1 {
+		return fmt.Sprintf("DB 0xED, 0x%02X", op)
+	}
+
+	switch z {
+	case 0:
+		if y == 6 {
+			return "IN F, (C)"
+		}
+		return "IN " + dReg[y] + ", (C)"
+	case 1:
+		if y == 6 {
+			return "OUT (C), 0"
+		}
+		return "OUT (C), " + dReg[y]
+	case 2:
+		if q == 0 {
+			return "SBC HL, " + dPair[p]
+		}
+		return "ADC HL, " + dPair[p]
+	case 3:
+		if q == 0 {
+			return "LD (" + d.imm16() + "), " + dPair[p]
+		}
+		return "LD " + dPair[p] + ", (" + d.imm16() + ")"
+	case 4:
+		return "NEG"
+	case 5:
+		if y == 1 {
+			return "RETI"
+		}
+		return "RETN"
+	case 6:
+		return fmt.Sprintf("IM %d", []int{0, 0, 1, 2, 0, 0, 1, 2}[y])
+	}
+	return []string{"LD I, A", "LD R, A", "LD A, I", "LD A, R", "RRD", "RLD", "NOP", "NOP"}[y]
+}
+
+// DisassembleRange decodes the instructions in the given code, which is
+// located at the given address, returning one line per instruction.
+//
+// Each line contains the address, the bytes, and the instruction.
+func DisassembleRange(code []byte, addr uint16) []string {
+	return disassembleLines(code, addr, nil, nil)
+}
+
+// DisassembleAnnotated is like DisassembleRange, but calls to the BDOS, via
+// the entry-point at 0x0005, are followed by a comment naming the function
+// which is invoked, and jumps into the BIOS, and warm boots, are marked too.
+//
+// The BDOS function is found from the value loaded into the C register by
+// the preceding instructions, which is usually a "LD C, n" just before the
+// call.  If it can't be found the comment contains only "BDOS".
+//
+// names maps BDOS function numbers to their names, functions which aren't
+// present are shown by number alone.
+func DisassembleAnnotated(code []byte, addr uint16, names map[uint8]string) []string {
+	return DisassembleSymbols(code, addr, names, nil)
+}
+
+// DisassembleSymbols is like DisassembleAnnotated, but uses the given
+// symbols, which map addresses to the names of labels, such as those
+// loaded from a .SYM file.
+//
+// Instructions at the address of a symbol are preceded by a line holding
+// its name, followed by a colon, and operands which are the address of a
+// symbol are shown by name.
+func DisassembleSymbols(code []byte, addr uint16, names map[uint8]string, symbols map[uint16]string) []string {
+
+	t := newTracker()
+
+	return disassembleLines(code, addr, func(insn []byte, text string) string {
+
+		call, ok := t.step(insn, text)
+		if !ok {
+			return ""
+		}
+
+		switch call.Kind {
+		case CallBDOS:
+			if call.Function < 0 {
+				return "BDOS"
+			}
+			comment := fmt.Sprintf("BDOS %d", call.Function)
+			if name, ok := names[uint8(call.Function)]; ok {
+				comment += " " + name
+			}
+			return comment
+		case CallBoot:
+			return "warm boot"
+		case CallBIOS:
+			return call.String()
+		}
+		return ""
+	}, symbols)
+}
+
+// disassembleLines decodes the instructions in the given code, returning
+// one line per instruction.
+//
+// If annotate is not nil it is called with the bytes, and text, of each
+// instruction, and any comment it returns is appended to the line.  If
+// symbols is not nil labels, and operands, are shown by name.
+func disassembleLines(code []byte, addr uint16, annotate func(insn []byte, text string) string, symbols map[uint16]string) []string {
+
+	var out []string
+
+	for pos := 0; pos < len(code); {
+		text, n := Disassemble(code[pos:], addr+uint16(pos))
+
+		end := pos + n
+		if end > len(code) {
+			end = len(code)
+		}
+
+		hex := []string{}
+		for _, b := range code[pos:end] {
+			hex = append(hex, fmt.Sprintf("%02X", b))
+		}
+
+		// The comment is found before symbols are substituted, as
+		// it depends upon the addresses the instruction uses.
+		comment := ""
+		if annotate != nil {
+			comment = annotate(code[pos:end], text)
+		}
+
+		if symbols != nil {
+			if name, ok := symbols[addr+uint16(pos)]; ok {
+				out = append(out, name+":")
+			}
+			text = symbolOperands(text, symbols)
+		}
+
+		line := fmt.Sprintf("%04X  %-12s %s", addr+uint16(pos), strings.Join(hex, " "), text)
+		if comment != "" {
+			line = fmt.Sprintf("%-40s ; %s", line, comment)
+		}
+
+		out = append(out, line)
+		pos += n
+	}
+	return out
+}
+
+// wordOperand matches the 16-bit operands of a disassembled instruction.
+var wordOperand = regexp.MustCompile(`0x[0-9A-F]{4}\b`)
+
+// symbolOperands replaces the 16-bit operands of the given instruction
+// which are the address of a symbol with its name.
+func symbolOperands(text string, symbols map[uint16]string) string {
+
+	return wordOperand.ReplaceAllStringFunc(text, func(operand string) string {
+		val, err := strconv.ParseUint(operand[2:], 16, 16)
+		if err != nil {
+			return operand
+		}
+		if name, ok := symbols[uint16(val)]; ok {
+			return name
+		}
+		return operand
+	})
+}
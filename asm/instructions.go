@@ -0,0 +1,741 @@
+package asm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// implied contains the instructions which take no operands.
+var implied = map[string][]byte{
+	"NOP":  {0x00},
+	"HALT": {0x76},
+	"DI":   {0xF3},
+	"EI":   {0xFB},
+	"DAA":  {0x27},
+	"CPL":  {0x2F},
+	"SCF":  {0x37},
+	"CCF":  {0x3F},
+	"RLCA": {0x07},
+	"RRCA": {0x0F},
+	"RLA":  {0x17},
+	"RRA":  {0x1F},
+	"EXX":  {0xD9},
+	"NEG":  {0xED, 0x44},
+	"RETI": {0xED, 0x4D},
+	"RETN": {0xED, 0x45},
+	"RLD":  {0xED, 0x6F},
+	"RRD":  {0xED, 0x67},
+	"LDI":  {0xED, 0xA0},
+	"LDIR": {0xED, 0xB0},
+	"LDD":  {0xED, 0xA8},
+	"LDDR": {0xED, 0xB8},
+	"CPI":  {0xED, 0xA1},
+	"CPIR": {0xED, 0xB1},
+	"CPD":  {0xED, 0xA9},
+	"CPDR": {0xED, 0xB9},
+	"INI":  {0xED, 0xA2},
+	"INIR": {0xED, 0xB2},
+	"IND":  {0xED, 0xAA},
+	"INDR": {0xED, 0xBA},
+	"OUTI": {0xED, 0xA3},
+	"OTIR": {0xED, 0xB3},
+	"OUTD": {0xED, 0xAB},
+	"OTDR": {0xED, 0xBB},
+}
+
+// reg8 maps the 8-bit register names to their encoding.
+var reg8 = map[string]byte{
+	"B": 0, "C": 1, "D": 2, "E": 3, "H": 4, "L": 5, "(HL)": 6, "A": 7,
+}
+
+// reg16 maps the 16-bit register-pair names to their encoding, as used
+// by LD/INC/DEC/ADD.
+var reg16 = map[string]byte{
+	"BC": 0, "DE": 1, "HL": 2, "SP": 3,
+}
+
+// conditions maps the condition-codes to their encoding.
+var conditions = map[string]byte{
+	"NZ": 0, "Z": 1, "NC": 2, "C": 3, "PO": 4, "PE": 5, "P": 6, "M": 7,
+}
+
+// alu maps the arithmetic/logic operations to their encoding.
+var alu = map[string]byte{
+	"ADD": 0, "ADC": 1, "SUB": 2, "SBC": 3, "AND": 4, "XOR": 5, "OR": 6, "CP": 7,
+}
+
+// rotates maps the CB-prefixed rotate/shift operations to their encoding.
+var rotates = map[string]byte{
+	"RLC": 0, "RRC": 1, "RL": 2, "RR": 3, "SLA": 4, "SRA": 5, "SLL": 6, "SRL": 7,
+}
+
+// bits maps the CB-prefixed bit operations to their encoding.
+var bits = map[string]byte{
+	"BIT": 0x40, "RES": 0x80, "SET": 0xC0,
+}
+
+// indexed returns the prefix, and displacement-expression, if the
+// operand is of the form (IX+d) or (IY+d).
+func indexed(op string) (byte, string, bool) {
+	u := strings.ToUpper(strings.ReplaceAll(op, " ", ""))
+	if !strings.HasPrefix(u, "(I") || !strings.HasSuffix(u, ")") || len(u) < 4 {
+		return 0, "", false
+	}
+	var prefix byte
+	switch u[1:3] {
+	case "IX":
+		prefix = 0xDD
+	case "IY":
+		prefix = 0xFD
+	default:
+		return 0, "", false
+	}
+	rest := u[3 : len(u)-1]
+	if rest == "" {
+		return prefix, "0", true
+	}
+	if rest[0] != '+' && rest[0] != '-' {
+		return 0, "", false
+	}
+	return prefix, rest, true
+}
+
+// indexPrefix returns the prefix for IX/IY, if the operand names one.
+func indexPrefix(op string) (byte, bool) {
+	switch strings.ToUpper(op) {
+	case "IX":
+		return 0xDD, true
+	case "IY":
+		return 0xFD, true
+	}
+	return 0, false
+}
+
+// isIndirect returns true if the operand is a memory reference, (nn).
+func isIndirect(op string) bool {
+	return strings.HasPrefix(op, "(") && strings.HasSuffix(op, ")") && matchingParen(op) == len(op)-1
+}
+
+// byteValue evaluates an expression which must fit into a byte.
+func (a *assembler) byteValue(expr string) (byte, error) {
+	v, err := a.evalInt(strings.TrimSpace(expr))
+	if err != nil {
+		return 0, err
+	}
+	if a.pass == 2 && (v < -128 || v > 255) {
+		return 0, fmt.Errorf("value %d out of range for a byte", v)
+	}
+	return byte(v), nil
+}
+
+// wordValue evaluates an expression, returning the low and high bytes.
+func (a *assembler) wordValue(expr string) (byte, byte, error) {
+	v, err := a.eval(expr)
+	return byte(v & 0xFF), byte(v >> 8), err
+}
+
+// displacement evaluates an index displacement.
+func (a *assembler) displacement(expr string) (byte, error) {
+	v, err := a.evalInt(expr)
+	if err != nil {
+		return 0, err
+	}
+	if a.pass == 2 && (v < -128 || v > 127) {
+		return 0, fmt.Errorf("index displacement %d out of range", v)
+	}
+	return byte(v), nil
+}
+
+// relative evaluates a relative jump target.
+func (a *assembler) relative(expr string) (byte, error) {
+	target, err := a.eval(expr)
+	if err != nil {
+		return 0, err
+	}
+	offset := int(target) - int(a.pc+2)
+	if a.pass == 2 && (offset < -128 || offset > 127) {
+		return 0, fmt.Errorf("relative jump out of range (%d)", offset)
+	}
+	return byte(offset), nil
+}
+
+// instruction assembles a single instruction, or data directive.
+func (a *assembler) instruction(mnemonic string, ops []string) error {
+
+	if b, ok := implied[mnemonic]; ok {
+		if len(ops) != 0 {
+			return fmt.Errorf("%s takes no operands", mnemonic)
+		}
+		a.emit(b...)
+		return nil
+	}
+
+	upper := make([]string, len(ops))
+	for i, o := range ops {
+		upper[i] = strings.ToUpper(strings.ReplaceAll(o, " ", ""))
+	}
+
+	switch mnemonic {
+	case "DB", "DEFB", "DEFM":
+		return a.data(ops)
+
+	case "DW", "DEFW":
+		for _, o := range ops {
+			l, h, err := a.wordValue(o)
+			if err != nil {
+				return err
+			}
+			a.emit(l, h)
+		}
+		return nil
+
+	case "DS", "DEFS":
+		if len(ops) < 1 {
+			return fmt.Errorf("DS requires a size")
+		}
+		n, err := a.eval(ops[0])
+		if err != nil {
+			return err
+		}
+		fill := byte(0)
+		if len(ops) > 1 {
+			fill, err = a.byteValue(ops[1])
+			if err != nil {
+				return err
+			}
+		}
+		for i := 0; i < int(n); i++ {
+			a.emit(fill)
+		}
+		return nil
+
+	case "LD":
+		if len(ops) != 2 {
+			return fmt.Errorf("LD requires two operands")
+		}
+		return a.ld(ops, upper)
+
+	case "PUSH", "POP":
+		if len(ops) != 1 {
+			return fmt.Errorf("%s requires one operand", mnemonic)
+		}
+		base := byte(0xC5)
+		if mnemonic == "POP" {
+			base = 0xC1
+		}
+		if p, ok := indexPrefix(upper[0]); ok {
+			a.emit(p, base+0x20)
+			return nil
+		}
+		codes := map[string]byte{"BC": 0, "DE": 1, "HL": 2, "AF": 3}
+		r, ok := codes[upper[0]]
+		if !ok {
+			return fmt.Errorf("invalid register for %s: %s", mnemonic, ops[0])
+		}
+		a.emit(base | r<<4)
+		return nil
+
+	case "EX":
+		if len(ops) != 2 {
+			return fmt.Errorf("EX requires two operands")
+		}
+		switch upper[0] + "," + upper[1] {
+		case "DE,HL":
+			a.emit(0xEB)
+		case "AF,AF'":
+			a.emit(0x08)
+		case "(SP),HL":
+			a.emit(0xE3)
+		case "(SP),IX":
+			a.emit(0xDD, 0xE3)
+		case "(SP),IY":
+			a.emit(0xFD, 0xE3)
+		default:
+			return fmt.Errorf("invalid operands for EX")
+		}
+		return nil
+
+	case "ADD", "ADC", "SUB", "SBC", "AND", "XOR", "OR", "CP":
+		return a.arithmetic(mnemonic, ops, upper)
+
+	case "INC", "DEC":
+		if len(ops) != 1 {
+			return fmt.Errorf("%s requires one operand", mnemonic)
+		}
+		var off byte
+		if mnemonic == "DEC" {
+			off = 1
+		}
+		if r, ok := reg8[upper[0]]; ok {
+			a.emit(0x04 | r<<3 + off)
+			return nil
+		}
+		if rp, ok := reg16[upper[0]]; ok {
+			a.emit(0x03 | rp<<4 + off*8)
+			return nil
+		}
+		if p, ok := indexPrefix(upper[0]); ok {
+			a.emit(p, 0x23+off*8)
+			return nil
+		}
+		if p, d, ok := indexed(ops[0]); ok {
+			disp, err := a.displacement(d)
+			if err != nil {
+				return err
+			}
+			a.emit(p, 0x34+off, disp)
+			return nil
+		}
+		return fmt.Errorf("invalid operand for %s: %s", mnemonic, ops[0])
+
+	case "JP":
+		if len(ops) == 1 {
+			switch upper[0] {
+			case "(HL)":
+				a.emit(0xE9)
+				return nil
+			case "(IX)":
+				a.emit(0xDD, 0xE9)
+				return nil
+			case "(IY)":
+				a.emit(0xFD, 0xE9)
+				return nil
+			}
+			l, h, err := a.wordValue(ops[0])
+			if err != nil {
+				return err
+			}
+			a.emit(0xC3, l, h)
+			return nil
+		}
+		if len(ops) == 2 {
+			cc, ok := conditions[upper[0]]
+			if !ok {
+				return fmt.Errorf("invalid condition %s", ops[0])
+			}
+			l, h, err := a.wordValue(ops[1])
+			if err != nil {
+				return err
+			}
+			a.emit(0xC2|cc<<3, l, h)
+			return nil
+		}
+		return fmt.Errorf("invalid operands for JP")
+
+	case "CALL":
+		if len(ops) == 1 {
+			l, h, err := a.wordValue(ops[0])
+			if err != nil {
+				return err
+			}
+			a.emit(0xCD, l, h)
+			return nil
+		}
+		if len(ops) == 2 {
+			cc, ok := conditions[upper[0]]
+			if !ok {
+				return fmt.Errorf("invalid condition %s", ops[0])
+			}
+			l, h, err := a.wordValue(ops[1])
+			if err != nil {
+				return err
+			}
+			a.emit(0xC4|cc<<3, l, h)
+			return nil
+		}
+		return fmt.Errorf("invalid operands for CALL")
+
+	case "JR", "DJNZ":
+		target := ""
+		opcode := byte(0x18)
+		if mnemonic == "DJNZ" {
+			opcode = 0x10
+		}
+		switch len(ops) {
+		case 1:
+			target = ops[0]
+		case 2:
+			if mnemonic == "DJNZ" {
+				return fmt.Errorf("DJNZ takes one operand")
+			}
+			cc, ok := conditions[upper[0]]
+			if !ok || cc > 3 {
+				return fmt.Errorf("invalid condition for JR: %s", ops[0])
+			}
+			opcode = 0x20 | cc<<3
+			target = ops[1]
+		default:
+			return fmt.Errorf("invalid operands for %s", mnemonic)
+		}
+		off, err := a.relative(target)
+		if err != nil {
+			return err
+		}
+		a.emit(opcode, off)
+		return nil
+
+	case "RET":
+		if len(ops) == 0 {
+			a.emit(0xC9)
+			return nil
+		}
+		cc, ok := conditions[upper[0]]
+		if !ok {
+			return fmt.Errorf("invalid condition %s", ops[0])
+		}
+		a.emit(0xC0 | cc<<3)
+		return nil
+
+	case "RST":
+		if len(ops) != 1 {
+			return fmt.Errorf("RST requires one operand")
+		}
+		v, err := a.eval(ops[0])
+		if err != nil {
+			return err
+		}
+		if v&0x38 != v {
+			return fmt.Errorf("invalid RST target %s", ops[0])
+		}
+		a.emit(0xC7 | byte(v))
+		return nil
+
+	case "IM":
+		if len(ops) != 1 {
+			return fmt.Errorf("IM requires one operand")
+		}
+		codes := map[string]byte{"0": 0x46, "1": 0x56, "2": 0x5E}
+		c, ok := codes[upper[0]]
+		if !ok {
+			return fmt.Errorf("invalid interrupt mode %s", ops[0])
+		}
+		a.emit(0xED, c)
+		return nil
+
+	case "OUT":
+		if len(ops) != 2 {
+			return fmt.Errorf("OUT requires two operands")
+		}
+		if upper[0] == "(C)" {
+			r, ok := reg8[upper[1]]
+			if !ok || r == 6 {
+				return fmt.Errorf("invalid register for OUT (C): %s", ops[1])
+			}
+			a.emit(0xED, 0x41|r<<3)
+			return nil
+		}
+		if upper[1] != "A" || !isIndirect(ops[0]) {
+			return fmt.Errorf("invalid operands for OUT")
+		}
+		port, err := a.byteValue(ops[0][1 : len(ops[0])-1])
+		if err != nil {
+			return err
+		}
+		a.emit(0xD3, port)
+		return nil
+
+	case "IN":
+		if len(ops) != 2 {
+			return fmt.Errorf("IN requires two operands")
+		}
+		if upper[1] == "(C)" {
+			r, ok := reg8[upper[0]]
+			if !ok || r == 6 {
+				return fmt.Errorf("invalid register for IN (C): %s", ops[0])
+			}
+			a.emit(0xED, 0x40|r<<3)
+			return nil
+		}
+		if upper[0] != "A" || !isIndirect(ops[1]) {
+			return fmt.Errorf("invalid operands for IN")
+		}
+		port, err := a.byteValue(ops[1][1 : len(ops[1])-1])
+		if err != nil {
+			return err
+		}
+		a.emit(0xDB, port)
+		return nil
+	}
+
+	if op, ok := rotates[mnemonic]; ok {
+		if len(ops) != 1 {
+			return fmt.Errorf("%s requires one operand", mnemonic)
+		}
+		return a.cb(op<<3, ops[0], upper[0])
+	}
+
+	if op, ok := bits[mnemonic]; ok {
+		if len(ops) != 2 {
+			return fmt.Errorf("%s requires two operands", mnemonic)
+		}
+		b, err := a.eval(ops[0])
+		if err != nil {
+			return err
+		}
+		if b > 7 {
+			return fmt.Errorf("invalid bit number %d", b)
+		}
+		return a.cb(op|byte(b)<<3, ops[1], upper[1])
+	}
+
+	return fmt.Errorf("unknown instruction %s", mnemonic)
+}
+
+// cb emits a CB-prefixed instruction, handling the indexed forms.
+func (a *assembler) cb(op byte, operand string, upper string) error {
+	if r, ok := reg8[upper]; ok {
+		a.emit(0xCB, op|r)
+		return nil
+	}
+	if p, d, ok := indexed(operand); ok {
+		disp, err := a.displacement(d)
+		if err != nil {
+			return err
+		}
+		a.emit(p, 0xCB, disp, op|6)
+		return nil
+	}
+	return fmt.Errorf("invalid operand %s", operand)
+}
+
+// data handles the DB directive, which may contain strings.
+func (a *assembler) data(ops []string) error {
+	for _, o := range ops {
+		if len(o) >= 2 && (o[0] == '"' || o[0] == '\'') && o[len(o)-1] == o[0] && len(o) != 3 {
+			a.emit([]byte(o[1 : len(o)-1])...)
+			continue
+		}
+		b, err := a.byteValue(o)
+		if err != nil {
+			return err
+		}
+		a.emit(b)
+	}
+	return nil
+}
+
+// arithmetic handles the 8-bit ALU operations, and the 16-bit ADD/ADC/SBC.
+func (a *assembler) arithmetic(mnemonic string, ops []string, upper []string) error {
+
+	// 16-bit forms
+	if len(ops) == 2 {
+		if p, ok := indexPrefix(upper[0]); ok && mnemonic == "ADD" {
+			rp, ok := reg16[upper[1]]
+			if upper[1] == upper[0] {
+				rp, ok = 2, true
+			}
+			if !ok || upper[1] == "HL" {
+				return fmt.Errorf("invalid operand for ADD %s: %s", ops[0], ops[1])
+			}
+			a.emit(p, 0x09|rp<<4)
+			return nil
+		}
+		if upper[0] == "HL" {
+			rp, ok := reg16[upper[1]]
+			if !ok {
+				return fmt.Errorf("invalid operand for %s HL: %s", mnemonic, ops[1])
+			}
+			switch mnemonic {
+			case "ADD":
+				a.emit(0x09 | rp<<4)
+			case "ADC":
+				a.emit(0xED, 0x4A|rp<<4)
+			case "SBC":
+				a.emit(0xED, 0x42|rp<<4)
+			default:
+				return fmt.Errorf("invalid operands for %s", mnemonic)
+			}
+			return nil
+		}
+		if upper[0] != "A" {
+			return fmt.Errorf("invalid operands for %s", mnemonic)
+		}
+		ops = ops[1:]
+		upper = upper[1:]
+	}
+
+	if len(ops) != 1 {
+		return fmt.Errorf("invalid operands for %s", mnemonic)
+	}
+
+	op := alu[mnemonic]
+	if r, ok := reg8[upper[0]]; ok {
+		a.emit(0x80 | op<<3 | r)
+		return nil
+	}
+	if p, d, ok := indexed(ops[0]); ok {
+		disp, err := a.displacement(d)
+		if err != nil {
+			return err
+		}
+		a.emit(p, 0x86|op<<3, disp)
+		return nil
+	}
+	n, err := a.byteValue(ops[0])
+	if err != nil {
+		return err
+	}
+	a.emit(0xC6|op<<3, n)
+	return nil
+}
+
+// ld handles the many forms of the LD instruction.
+func (a *assembler) ld(ops []string, upper []string) error {
+	dst, src := upper[0], upper[1]
+
+	// Special registers.
+	switch dst + "," + src {
+	case "A,I":
+		a.emit(0xED, 0x57)
+		return nil
+	case "A,R":
+		a.emit(0xED, 0x5F)
+		return nil
+	case "I,A":
+		a.emit(0xED, 0x47)
+		return nil
+	case "R,A":
+		a.emit(0xED, 0x4F)
+		return nil
+	case "A,(BC)":
+		a.emit(0x0A)
+		return nil
+	case "A,(DE)":
+		a.emit(0x1A)
+		return nil
+	case "(BC),A":
+		a.emit(0x02)
+		return nil
+	case "(DE),A":
+		a.emit(0x12)
+		return nil
+	case "SP,HL":
+		a.emit(0xF9)
+		return nil
+	case "SP,IX":
+		a.emit(0xDD, 0xF9)
+		return nil
+	case "SP,IY":
+		a.emit(0xFD, 0xF9)
+		return nil
+	}
+
+	// 8-bit register destination.
+	if d, ok := reg8[dst]; ok {
+		if s, ok := reg8[src]; ok {
+			if d == 6 && s == 6 {
+				return fmt.Errorf("LD (HL),(HL) is invalid")
+			}
+			a.emit(0x40 | d<<3 | s)
+			return nil
+		}
+		if p, disp, ok := indexed(ops[1]); ok && d != 6 {
+			v, err := a.displacement(disp)
+			if err != nil {
+				return err
+			}
+			a.emit(p, 0x46|d<<3, v)
+			return nil
+		}
+		if isIndirect(ops[1]) {
+			if d != 7 {
+				return fmt.Errorf("only A may be loaded from an address")
+			}
+			l, h, err := a.wordValue(ops[1][1 : len(ops[1])-1])
+			if err != nil {
+				return err
+			}
+			a.emit(0x3A, l, h)
+			return nil
+		}
+		n, err := a.byteValue(ops[1])
+		if err != nil {
+			return err
+		}
+		a.emit(0x06|d<<3, n)
+		return nil
+	}
+
+	// Indexed destination.
+	if p, disp, ok := indexed(ops[0]); ok {
+		v, err := a.displacement(disp)
+		if err != nil {
+			return err
+		}
+		if s, ok := reg8[src]; ok && s != 6 {
+			a.emit(p, 0x70|s, v)
+			return nil
+		}
+		n, err := a.byteValue(ops[1])
+		if err != nil {
+			return err
+		}
+		a.emit(p, 0x36, v, n)
+		return nil
+	}
+
+	// 16-bit register destination.
+	if rp, ok := reg16[dst]; ok {
+		if isIndirect(ops[1]) {
+			l, h, err := a.wordValue(ops[1][1 : len(ops[1])-1])
+			if err != nil {
+				return err
+			}
+			if dst == "HL" {
+				a.emit(0x2A, l, h)
+			} else {
+				a.emit(0xED, 0x4B|rp<<4, l, h)
+			}
+			return nil
+		}
+		l, h, err := a.wordValue(ops[1])
+		if err != nil {
+			return err
+		}
+		a.emit(0x01|rp<<4, l, h)
+		return nil
+	}
+	if p, ok := indexPrefix(dst); ok {
+		if isIndirect(ops[1]) {
+			l, h, err := a.wordValue(ops[1][1 : len(ops[1])-1])
+			if err != nil {
+				return err
+			}
+			a.emit(p, 0x2A, l, h)
+			return nil
+		}
+		l, h, err := a.wordValue(ops[1])
+		if err != nil {
+			return err
+		}
+		a.emit(p, 0x21, l, h)
+		return nil
+	}
+
+	// Memory destination.
+	if isIndirect(ops[0]) {
+		l, h, err := a.wordValue(ops[0][1 : len(ops[0])-1])
+		if err != nil {
+			return err
+		}
+		switch src {
+		case "A":
+			a.emit(0x32, l, h)
+		case "HL":
+			a.emit(0x22, l, h)
+		case "IX":
+			a.emit(0xDD, 0x22, l, h)
+		case "IY":
+			a.emit(0xFD, 0x22, l, h)
+		default:
+			rp, ok := reg16[src]
+			if !ok {
+				return fmt.Errorf("invalid source for LD (nn): %s", ops[1])
+			}
+			a.emit(0xED, 0x43|rp<<4, l, h)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("invalid operands for LD: %s, %s", ops[0], ops[1])
+}
@@ -0,0 +1,230 @@
+package asm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The kinds of call which we recognize in CP/M binaries.
+const (
+	// CallBDOS is a call to the BDOS entry-point at 0x0005.
+	CallBDOS = "BDOS"
+
+	// CallBIOS is a jump into the BIOS, via the address of the warm
+	// boot vector which is stored at 0x0001.
+	CallBIOS = "BIOS"
+
+	// CallBoot is a warm boot, via a call, or jump, to 0x0000.
+	CallBoot = "BOOT"
+
+	// CallRST is any RST instruction, other than RST 0x00.
+	CallRST = "RST"
+)
+
+// Call describes a call to the operating system, which was found in a
+// binary.
+type Call struct {
+
+	// Kind is the kind of call, such as CallBDOS.
+	Kind string
+
+	// Function is the number of the BDOS, or BIOS, function, or the
+	// address of an RST.  It is -1 if the BDOS function couldn't be
+	// determined.
+	Function int
+
+	// Addr is the address of the instruction which made the call.
+	Addr uint16
+}
+
+// FindCalls scans the given code, which is located at the given address,
+// and returns the calls to the operating system which it appears to make.
+//
+// This is a simple linear scan, so data which is mixed with the code may
+// produce bogus results, and calls which are made indirectly, other than
+// the usual idioms, will be missed.
+func FindCalls(code []byte, addr uint16) []Call {
+
+	var calls []Call
+
+	t := newTracker()
+	for pos := 0; pos < len(code); {
+		text, n := Disassemble(code[pos:], addr+uint16(pos))
+		end := min(pos+n, len(code))
+
+		if call, ok := t.step(code[pos:end], text); ok {
+			call.Addr = addr + uint16(pos)
+			calls = append(calls, call)
+		}
+		pos += n
+	}
+	return calls
+}
+
+// tracker follows the values of the registers which are used to make
+// calls to the operating system, across a sequence of instructions.
+//
+// Values are -1 when they are unknown.
+type tracker struct {
+
+	// c is the value of the C register, which selects BDOS functions.
+	c int
+
+	// de and bc are the values of the register pairs, which may be
+	// added to HL to find a BIOS entry-point.
+	de int
+	bc int
+
+	// bios is the offset into the BIOS held in HL, which is the usual
+	// way to find a BIOS entry-point, after "LD HL, (0x0001)".
+	bios int
+}
+
+// newTracker returns a tracker which knows nothing.
+func newTracker() *tracker {
+	return &tracker{c: -1, de: -1, bc: -1, bios: -1}
+}
+
+// step updates our state for the given instruction, returning the call
+// it makes, if any.
+func (t *tracker) step(insn []byte, text string) (Call, bool) {
+
+	if len(insn) == 0 {
+		return Call{}, false
+	}
+
+	switch {
+	case text == "CALL 0x0005" || text == "JP 0x0005":
+		call := Call{Kind: CallBDOS, Function: t.c}
+		t.forget()
+		return call, true
+
+	case text == "CALL 0x0000" || text == "JP 0x0000" || text == "RST 0x00":
+		t.forget()
+		return Call{Kind: CallBoot}, true
+
+	case strings.HasPrefix(text, "RST "):
+		t.forget()
+		return Call{Kind: CallRST, Function: int(insn[0] & 0x38)}, true
+
+	case text == "JP (HL)" && t.bios >= 0 && t.bios%3 == 0:
+		call := Call{Kind: CallBIOS, Function: t.bios / 3}
+		t.forget()
+		return call, true
+
+	case len(insn) == 2 && insn[0] == 0x0E:
+		t.c = int(insn[1])
+		return Call{}, false
+
+	case len(insn) == 3 && insn[0] == 0x01:
+		t.bc = int(insn[1]) | int(insn[2])<<8
+		t.c = int(insn[1])
+		return Call{}, false
+
+	case len(insn) == 3 && insn[0] == 0x11:
+		t.de = int(insn[1]) | int(insn[2])<<8
+		return Call{}, false
+
+	case text == "LD HL, (0x0001)":
+		// This is the address of the warm boot entry-point, which
+		// is the second of the BIOS.
+		t.bios = 3
+		return Call{}, false
+
+	case len(insn) == 2 && insn[0] == 0x2E && t.bios >= 0:
+		// "LD L, n" selects an entry-point within the BIOS page.
+		t.bios = int(insn[1])
+		return Call{}, false
+
+	case text == "ADD HL, DE" && t.bios >= 0 && t.de >= 0:
+		t.bios = (t.bios + t.de) & 0xFF
+		return Call{}, false
+
+	case text == "ADD HL, BC" && t.bios >= 0 && t.bc >= 0:
+		t.bios = (t.bios + t.bc) & 0xFF
+		return Call{}, false
+	}
+
+	if clobbersC(text) {
+		t.c = -1
+	}
+	if writes(text, "BC", "B", "C") {
+		t.bc = -1
+	}
+	if writes(text, "DE", "D", "E") {
+		t.de = -1
+	}
+	if writes(text, "HL", "H", "L") {
+		t.bios = -1
+	}
+	if strings.HasPrefix(text, "EX ") {
+		t.de = -1
+		t.bios = -1
+	}
+	return Call{}, false
+}
+
+// forget discards everything we know, as is required after a call, or a
+// transfer of control.
+func (t *tracker) forget() {
+	*t = *newTracker()
+}
+
+// clobbersC returns true if the given instruction might change the value
+// of the C register, or transfers control, after which the value we've
+// seen can't be trusted.
+func clobbersC(text string) bool {
+	return writes(text, "C", "BC")
+}
+
+// writes returns true if the given instruction might change the value of
+// one of the given registers, or transfers control, after which the values
+// we've seen can't be trusted.
+func writes(text string, regs ...string) bool {
+
+	mnemonic, operands, _ := strings.Cut(text, " ")
+
+	switch mnemonic {
+	case "CALL", "RET", "RETI", "RETN", "JP", "JR", "DJNZ", "RST", "EXX":
+		return true
+	}
+	for _, row := range dBlock {
+		for _, block := range row {
+			if mnemonic == block {
+				return true
+			}
+		}
+	}
+
+	// The destination is the first operand, except for RES and SET.
+	args := strings.Split(operands, ", ")
+	dest := args[0]
+	switch mnemonic {
+	case "RES", "SET":
+		dest = args[len(args)-1]
+	case "LD", "INC", "DEC", "POP", "IN", "ADD", "ADC", "SBC", "RLC", "RRC", "RL", "RR", "SLA", "SRA", "SLL", "SRL":
+	default:
+		return false
+	}
+
+	for _, reg := range regs {
+		if dest == reg {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns a description of the call.
+func (c Call) String() string {
+	switch c.Kind {
+	case CallBDOS, CallBIOS:
+		if c.Function < 0 {
+			return c.Kind
+		}
+		return fmt.Sprintf("%s %d", c.Kind, c.Function)
+	case CallRST:
+		return fmt.Sprintf("RST 0x%02X", c.Function)
+	}
+	return c.Kind
+}
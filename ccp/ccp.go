@@ -1,18 +1,27 @@
 // Package ccp contains a pair of embedded CCP binaries, which can
-// be used by the emulator as shells.
+// be used by the emulator as shells, one of which may also be run within
+// a Z-System environment.
 //
 // At build-time we include "*.BIN" from the ccp/ directory, which
 // means it's easy to add a new CCP driver - however we must also
 // ensure there is a matching name-entry added to the code, so it isn't
 // 100% automatic.
+//
+// A CCP may also be loaded from disk, via LoadExternal, which allows
+// users to test their own builds without recompiling the emulator.
 package ccp
 
 import (
 	"embed"
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
 )
 
+// External is the name given to the CCP loaded via LoadExternal.
+const External = "external"
+
 // Flavour contains details about a possible CCP the user might run.
 type Flavour struct {
 	// Name contains the public-facing name of the CCP.
@@ -31,6 +40,10 @@ type Flavour struct {
 	//
 	// (i.e. This must match the ORG specified in the CCP source code.)
 	Start uint16
+
+	// ZSystem is true if the CCP should be given a Z-System environment,
+	// which the emulator sets up in high memory.
+	ZSystem bool
 }
 
 var (
@@ -41,7 +54,7 @@ var (
 	ccpFiles embed.FS
 )
 
-// init sets up our global ccp array, by adding the two embedded CCPs to
+// init sets up our global ccp array, by adding the embedded CCPs to
 // the array, with suitable names/offsets.
 func init() {
 
@@ -62,6 +75,68 @@ func init() {
 		Start:       0xDE00,
 		Bytes:       ccpz,
 	})
+
+	// The same CCP, running within a Z-System environment, for the
+	// utilities which expect one.  This isn't ZCPR3 itself, only the
+	// environment its utilities look for.
+	ccps = append(ccps, Flavour{
+		Name:        "ccpz-z3env",
+		Description: "CCPZ v4.1skx, with a Z3 environment",
+		Start:       0xDE00,
+		Bytes:       ccpz,
+		ZSystem:     true,
+	})
+}
+
+// LoadExternal loads a CCP from the file specified as "path@addr", where
+// addr is the hexadecimal address the binary was assembled to run at,
+// such as "ccp.bin@DE00".
+//
+// The CCP is added to our list with the name "external", replacing any
+// CCP previously loaded this way, and returned.
+func LoadExternal(spec string) (Flavour, error) {
+
+	i := strings.LastIndex(spec, "@")
+	if i < 0 {
+		return Flavour{}, fmt.Errorf("external CCP %s has no address, expected path@addr", spec)
+	}
+	path := spec[:i]
+	addr := strings.TrimPrefix(strings.ToLower(spec[i+1:]), "0x")
+	addr = strings.TrimSuffix(addr, "h")
+
+	start, err := strconv.ParseUint(addr, 16, 16)
+	if err != nil {
+		return Flavour{}, fmt.Errorf("invalid address for external CCP %s: %s", spec, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Flavour{}, fmt.Errorf("failed to read external CCP: %s", err)
+	}
+
+	if len(data) == 0 {
+		return Flavour{}, fmt.Errorf("external CCP %s is empty", path)
+	}
+	if start < 0x0100 || int(start)+len(data) > 0x10000 {
+		return Flavour{}, fmt.Errorf("external CCP %s, of %d bytes, doesn't fit at %04X", path, len(data), start)
+	}
+
+	ent := Flavour{
+		Name:        External,
+		Description: path,
+		Start:       uint16(start),
+		Bytes:       data,
+	}
+
+	// Replace any previous external CCP.
+	for i, x := range ccps {
+		if x.Name == External {
+			ccps[i] = ent
+			return ent, nil
+		}
+	}
+	ccps = append(ccps, ent)
+	return ent, nil
 }
 
 // GetAll returns the details of all known CCPs we have embedded.
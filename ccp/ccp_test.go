@@ -1,6 +1,8 @@
 package ccp
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -8,9 +10,9 @@ import (
 // TestCCPTrivial is a trivial test that we have contents
 func TestCCPTrivial(t *testing.T) {
 
-	// Test that we have two CCPs
-	if len(ccps) != 2 {
-		t.Fatalf("we should have two CCPs")
+	// Test that we have three CCPs
+	if len(ccps) != 3 {
+		t.Fatalf("we should have three CCPs")
 	}
 
 	// Get each one
@@ -46,6 +48,9 @@ func TestInvalidCCP(t *testing.T) {
 	if !strings.Contains(err.Error(), "ccpz") {
 		t.Fatalf("error message didn't include valid ccp: ccpz")
 	}
+	if !strings.Contains(err.Error(), "ccpz-z3env") {
+		t.Fatalf("error message didn't include valid ccp: ccpz-z3env")
+	}
 
 }
 
@@ -62,3 +67,51 @@ func TestRetrieveAll(t *testing.T) {
 		}
 	}
 }
+
+// TestLoadExternal tests loading a CCP from disk.
+func TestLoadExternal(t *testing.T) {
+
+	// Restore the embedded CCPs when we're done.
+	orig := append([]Flavour{}, ccps...)
+	defer func() { ccps = orig }()
+
+	path := filepath.Join(t.TempDir(), "MY.BIN")
+	err := os.WriteFile(path, []byte{0xC3, 0x00, 0x00}, 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	bogus := []string{
+		path,
+		path + "@",
+		path + "@steve",
+		path + "@0080",
+		path + "@FFFE",
+		path + ".missing@DE00",
+	}
+	for _, spec := range bogus {
+		_, err = LoadExternal(spec)
+		if err == nil {
+			t.Fatalf("expected error loading %s", spec)
+		}
+	}
+
+	for _, spec := range []string{path + "@DE00", path + "@0xD000", path + "@C000h"} {
+		_, err = LoadExternal(spec)
+		if err != nil {
+			t.Fatalf("failed to load %s: %s", spec, err)
+		}
+	}
+
+	// Only one external CCP is present, the last loaded.
+	if len(GetAll()) != 4 {
+		t.Fatalf("expected four CCPs, got %d", len(GetAll()))
+	}
+	obj, err := Get("EXTERNAL")
+	if err != nil {
+		t.Fatalf("failed to get external CCP: %s", err)
+	}
+	if obj.Start != 0xC000 || len(obj.Bytes) != 3 || obj.Description != path {
+		t.Fatalf("wrong external CCP %v", obj)
+	}
+}
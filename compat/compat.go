@@ -0,0 +1,127 @@
+// Package compat contains a simple harness for running real-world CP/M
+// binaries, driven by scripted input, and capturing their output.
+//
+// The intention is that known-good programs are executed as part of our
+// test-suite, so that regressions in the emulator are noticed rather than
+// being discovered by users.  Currently only the game we ship is run by
+// default, the tests of other binaries are opt-in, see compat_test.go.
+package compat
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/skx/cpmulator/consoleout"
+	"github.com/skx/cpmulator/cpm"
+)
+
+// Case describes a single program to be tested.
+type Case struct {
+
+	// Name is a human-readable name for the test.
+	Name string
+
+	// Binary is the path to the CP/M binary to run.
+	//
+	// The directory containing the binary will be used as the A: drive,
+	// so that any data-files it needs will be found.
+	Binary string
+
+	// Input is the text which will be typed at the CCP prompt.
+	//
+	// Newlines are converted to carriage-returns, as they would be by
+	// the file input driver.  Execution terminates once all the input
+	// has been consumed.
+	Input string
+
+	// Expect contains strings which must all be present in the output.
+	Expect []string
+}
+
+// maxBoots is the number of times the CCP may be restarted before we give
+// up, to avoid looping forever if a program misbehaves.
+const maxBoots = 32
+
+// Run executes the given test-case, returning the output which was produced.
+//
+// The CCP is loaded, and the input is fed to it via the "file" console input
+// driver, so the input should typically begin with the name of the binary
+// to launch.
+func Run(c Case) (string, error) {
+
+	// Write the input to a file, for the input driver to read.
+	tmp, err := os.CreateTemp("", "compat-*.in")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(c.Input)
+	if err != nil {
+		tmp.Close()
+		return "", err
+	}
+	tmp.Close()
+
+	obj, err := cpm.New(
+		cpm.WithInputDriver("file:path="+tmp.Name()),
+		cpm.WithOutputDriver("logger"),
+		cpm.WithTerminalSize(80, 24),
+		cpm.WithPrinterPath(os.DevNull))
+	if err != nil {
+		return "", fmt.Errorf("failed to create emulator: %s", err)
+	}
+	obj.IOSetup()
+	defer obj.IOTearDown()
+
+	obj.SetDrives(false)
+	obj.SetDrivePath("A", filepath.Dir(c.Binary))
+
+	// Get our output handle
+	l, ok := obj.GetOutputDriver().(*consoleout.OutputLoggingDriver)
+	if !ok {
+		return "", fmt.Errorf("failed to cast output driver")
+	}
+
+	// Run the CCP, restarting it whenever a program exits, until our
+	// input has been consumed.
+	for boots := 0; boots < maxBoots; boots++ {
+
+		err = obj.LoadCCP()
+		if err != nil {
+			return l.GetOutput(), fmt.Errorf("failed to load CCP: %s", err)
+		}
+
+		err = obj.Execute([]string{})
+
+		if errors.Is(err, cpm.ErrBoot) {
+			continue
+		}
+		if err == nil || errors.Is(err, cpm.ErrHalt) {
+			return l.GetOutput(), nil
+		}
+		return l.GetOutput(), err
+	}
+
+	return l.GetOutput(), fmt.Errorf("too many reboots")
+}
+
+// Check runs the given test-case, and returns an error if any of the
+// expected strings were not present in the output.
+func Check(c Case) error {
+
+	out, err := Run(c)
+	if err != nil {
+		return err
+	}
+
+	for _, str := range c.Expect {
+		if !strings.Contains(out, str) {
+			return fmt.Errorf("output did not contain %q, output was:\n%s", str, out)
+		}
+	}
+	return nil
+}
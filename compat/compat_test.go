@@ -0,0 +1,98 @@
+package compat
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// distCases are opt-in tests which use the binaries from the cpm-dist
+// repository, and are only run when the CPM_DIST environmental variable
+// points at a checkout of it.
+//
+// Our CI doesn't set it, so these cases, and the output they expect, are
+// unverified, and they aren't part of our compatibility suite.  The paths
+// are relative to the root of the checkout.
+var distCases = []Case{
+	{
+		Name:   "MBASIC",
+		Binary: "B/MBASIC.COM",
+		Input:  "MBASIC\nPRINT 6*7\nSYSTEM\n",
+		Expect: []string{"BASIC-80", " 42"},
+	},
+	{
+		Name:   "Zork I",
+		Binary: "G/ZORK1.COM",
+		Input:  "ZORK1\nQUIT\nY\n",
+		Expect: []string{"ZORK I", "West of House"},
+	},
+	{
+		Name:   "Turbo Pascal",
+		Binary: "P/TURBO.COM",
+		Input:  "TURBO\nN\nQ\n",
+		Expect: []string{"TURBO Pascal"},
+	},
+	{
+		Name:   "WordStar",
+		Binary: "W/WS.COM",
+		Input:  "WS\nX",
+		Expect: []string{"WordStar"},
+	},
+}
+
+// TestLighthouse runs the game we ship in our dist/ directory.
+func TestLighthouse(t *testing.T) {
+
+	c := Case{
+		Name:   "Lighthouse of Doom",
+		Binary: filepath.Join("..", "dist", "LIHOUSE.COM"),
+		Input:  "LIHOUSE\nAAAA\ndown\nEXAMINE DESK\nTAKE METEOR\nUP\n\nn\nQUIT\n",
+		Expect: []string{"Congratulations", "You won"},
+	}
+
+	err := Check(c)
+	if err != nil {
+		t.Fatalf("%s failed: %s", c.Name, err)
+	}
+}
+
+// TestDistOptIn runs the opt-in tests of the binaries from the cpm-dist
+// repository, if CPM_DIST is set.
+func TestDistOptIn(t *testing.T) {
+
+	dir := os.Getenv("CPM_DIST")
+	if dir == "" {
+		t.Skip("CPM_DIST is not set, skipping the opt-in tests")
+	}
+
+	for _, c := range distCases {
+		t.Run(c.Name, func(t *testing.T) {
+
+			c.Binary = filepath.Join(dir, c.Binary)
+			if _, err := os.Stat(c.Binary); err != nil {
+				t.Skipf("%s is not present", c.Binary)
+			}
+
+			err := Check(c)
+			if err != nil {
+				t.Fatalf("%s failed: %s", c.Name, err)
+			}
+		})
+	}
+}
+
+// TestMissing ensures that we receive output, but not an error, when
+// a binary is missing - as the CCP will report that.
+func TestMissing(t *testing.T) {
+
+	out, err := Run(Case{
+		Binary: filepath.Join(t.TempDir(), "MISSING.COM"),
+		Input:  "MISSING\n",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if out == "" {
+		t.Fatalf("expected output, got none")
+	}
+}
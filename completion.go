@@ -0,0 +1,231 @@
+// completion.go contains the implementation of "cpmulator completion",
+// which generates scripts to complete our subcommands, and flags, in the
+// popular shells.
+//
+// The scripts are generated from our flags, and subcommands, so they never
+// become out of date.  They may be loaded via, for example:
+//
+//	source <(cpmulator completion bash)
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	cpmccp "github.com/skx/cpmulator/ccp"
+	"github.com/skx/cpmulator/cpm"
+)
+
+// completionFlag describes a single flag, for completion.
+type completionFlag struct {
+
+	// name is the name of the flag, without the leading "-".
+	name string
+
+	// desc is the first sentence of the usage of the flag.
+	desc string
+
+	// boolean is true if the flag doesn't take a value.
+	boolean bool
+
+	// values holds the valid values of the flag, if they're known.
+	values []string
+}
+
+// completionCommand writes a completion script for the given shell.
+func completionCommand(args []string) error {
+
+	if len(args) != 1 {
+		return fmt.Errorf("no shell specified")
+	}
+	return writeCompletion(os.Stdout, args[0], flag.CommandLine)
+}
+
+// completionValues returns the valid values of the flags which accept a
+// fixed set of choices.
+func completionValues() map[string][]string {
+
+	ccps := []string{}
+	for _, x := range cpmccp.GetAll() {
+		ccps = append(ccps, x.Name)
+	}
+
+	return map[string][]string{
+		"ccp":              ccps,
+		"input":            inputDrivers(),
+		"output":           outputDrivers(),
+		"case-policy":      {cpm.CaseExact, cpm.CaseFold, cpm.CaseStrict},
+		"wildcard-protect": {cpm.ProtectNone, cpm.ProtectLog, cpm.ProtectDryRun, cpm.ProtectConfirm, cpm.ProtectSession},
+	}
+}
+
+// completionFlags returns the flags in the given set, sorted by name.
+func completionFlags(fs *flag.FlagSet) []completionFlag {
+
+	values := completionValues()
+
+	var flags []completionFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		desc, _, _ := strings.Cut(f.Usage, ".  ")
+		desc = strings.TrimSuffix(desc, ".")
+
+		boolean := false
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok {
+			boolean = b.IsBoolFlag()
+		}
+
+		flags = append(flags, completionFlag{name: f.Name, desc: desc, boolean: boolean, values: values[f.Name]})
+	})
+
+	sort.Slice(flags, func(i, j int) bool {
+		return flags[i].name < flags[j].name
+	})
+	return flags
+}
+
+// completionCommands returns the names of our subcommands, sorted.
+func completionCommands() []string {
+	names := []string{}
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// completionArguments holds the fixed arguments of our subcommands.
+var completionArguments = map[string][]string{
+	"completion": {"bash", "zsh", "fish"},
+	"list":       {"ccps", "input", "output", "syscalls"},
+}
+
+// writeCompletion writes a completion script for the given shell, which
+// completes our subcommands, and the flags in the given set.
+func writeCompletion(out io.Writer, shell string, fs *flag.FlagSet) error {
+
+	switch shell {
+	case "bash":
+		writeBashCompletion(out, fs)
+	case "zsh":
+		writeZshCompletion(out, fs)
+	case "fish":
+		writeFishCompletion(out, fs)
+	default:
+		return fmt.Errorf("unknown shell '%s', valid choices are bash, zsh, and fish", shell)
+	}
+	return nil
+}
+
+// writeBashCompletion writes a completion script for bash.
+func writeBashCompletion(out io.Writer, fs *flag.FlagSet) {
+
+	flags := completionFlags(fs)
+
+	names := []string{}
+	for _, f := range flags {
+		names = append(names, "-"+f.name)
+	}
+
+	fmt.Fprintf(out, "# bash completion for cpmulator\n")
+	fmt.Fprintf(out, "_cpmulator() {\n")
+	fmt.Fprintf(out, "    local cur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	fmt.Fprintf(out, "    local prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n\n")
+
+	fmt.Fprintf(out, "    case \"$prev\" in\n")
+	for _, f := range flags {
+		if len(f.values) > 0 {
+			fmt.Fprintf(out, "        -%s) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")); return ;;\n", f.name, strings.Join(f.values, " "))
+		}
+	}
+	for _, cmd := range completionCommands() {
+		if args, ok := completionArguments[cmd]; ok {
+			fmt.Fprintf(out, "        %s) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")); return ;;\n", cmd, strings.Join(args, " "))
+		}
+	}
+	fmt.Fprintf(out, "    esac\n\n")
+
+	fmt.Fprintf(out, "    if [[ \"$cur\" == -* ]]; then\n")
+	fmt.Fprintf(out, "        COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(names, " "))
+	fmt.Fprintf(out, "    elif [[ $COMP_CWORD -eq 1 ]]; then\n")
+	fmt.Fprintf(out, "        COMPREPLY=($(compgen -W \"%s\" -- \"$cur\") $(compgen -f -- \"$cur\"))\n", strings.Join(completionCommands(), " "))
+	fmt.Fprintf(out, "    else\n")
+	fmt.Fprintf(out, "        COMPREPLY=($(compgen -f -- \"$cur\"))\n")
+	fmt.Fprintf(out, "    fi\n")
+	fmt.Fprintf(out, "}\n")
+	fmt.Fprintf(out, "complete -o filenames -F _cpmulator cpmulator\n")
+}
+
+// writeZshCompletion writes a completion script for zsh.
+func writeZshCompletion(out io.Writer, fs *flag.FlagSet) {
+
+	// escape makes a description safe within a quoted _arguments spec,
+	// and quote within single quotes.
+	escape := strings.NewReplacer("'", "'\\''", "[", "\\[", "]", "\\]", ":", "\\:")
+	quote := strings.NewReplacer("'", "'\\''")
+
+	fmt.Fprintf(out, "#compdef cpmulator\n\n")
+	fmt.Fprintf(out, "_cpmulator() {\n")
+	fmt.Fprintf(out, "    local -a commands\n")
+	fmt.Fprintf(out, "    commands=(\n")
+	for _, cmd := range completionCommands() {
+		fmt.Fprintf(out, "        '%s:%s'\n", cmd, quote.Replace(subcommands[cmd].desc))
+	}
+	fmt.Fprintf(out, "    )\n\n")
+
+	fmt.Fprintf(out, "    _arguments \\\n")
+	for _, f := range completionFlags(fs) {
+		spec := fmt.Sprintf("-%s[%s]", f.name, escape.Replace(f.desc))
+		switch {
+		case f.boolean:
+		case len(f.values) > 0:
+			spec += fmt.Sprintf(":%s:(%s)", f.name, strings.Join(f.values, " "))
+		default:
+			spec += fmt.Sprintf(":%s:_files", f.name)
+		}
+		fmt.Fprintf(out, "        '%s' \\\n", spec)
+	}
+	fmt.Fprintf(out, "        '1: :->first' \\\n")
+	fmt.Fprintf(out, "        '*:file:_files'\n\n")
+
+	fmt.Fprintf(out, "    case $state in\n")
+	fmt.Fprintf(out, "        first)\n")
+	fmt.Fprintf(out, "            _describe -t commands 'command' commands\n")
+	fmt.Fprintf(out, "            _files\n")
+	fmt.Fprintf(out, "            ;;\n")
+	fmt.Fprintf(out, "    esac\n")
+	fmt.Fprintf(out, "}\n\n")
+	fmt.Fprintf(out, "compdef _cpmulator cpmulator\n")
+}
+
+// writeFishCompletion writes a completion script for fish.
+func writeFishCompletion(out io.Writer, fs *flag.FlagSet) {
+
+	// escape makes a description safe within single quotes.
+	escape := strings.NewReplacer("\\", "\\\\", "'", "\\'")
+
+	fmt.Fprintf(out, "# fish completion for cpmulator\n")
+	for _, cmd := range completionCommands() {
+		fmt.Fprintf(out, "complete -c cpmulator -n '__fish_use_subcommand' -a '%s' -d '%s'\n", cmd, escape.Replace(subcommands[cmd].desc))
+	}
+	for _, cmd := range completionCommands() {
+		if args, ok := completionArguments[cmd]; ok {
+			fmt.Fprintf(out, "complete -c cpmulator -n '__fish_seen_subcommand_from %s' -f -a '%s'\n", cmd, strings.Join(args, " "))
+		}
+	}
+	for _, f := range completionFlags(fs) {
+		line := fmt.Sprintf("complete -c cpmulator -o '%s' -d '%s'", f.name, escape.Replace(f.desc))
+		switch {
+		case f.boolean:
+		case len(f.values) > 0:
+			line += fmt.Sprintf(" -x -a '%s'", strings.Join(f.values, " "))
+		default:
+			line += " -r"
+		}
+		fmt.Fprintf(out, "%s\n", line)
+	}
+}
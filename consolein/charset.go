@@ -0,0 +1,304 @@
+// charset.go contains the conversion of multi-byte input, such as accented
+// characters typed upon a modern keyboard, or UTF-8 text which has been
+// pasted, into something CP/M programs understand.
+//
+// CP/M programs expect a single byte for each key which is pressed, and
+// are confused by the multi-byte sequences which represent non-ASCII
+// characters in UTF-8.  So before any input from our driver is returned
+// the sequences are decoded, and replaced according to our character set:
+//
+//   - "ascii" replaces characters with their closest 7-bit equivalents,
+//     such as "e" for "é", or '"' for a curly-quote.  This is the default.
+//   - "cp437" uses the IBM PC character set, for the characters it
+//     contains, and the 7-bit equivalents for others.
+//   - "latin1" uses the ISO-8859-1 character set, for the characters it
+//     contains, and the 7-bit equivalents for others.
+//   - "strip" removes all non-ASCII characters.
+//   - "raw" returns the bytes unchanged.
+//
+// Characters which can't be replaced are removed, and the bell is rung so
+// the user knows their input was discarded.
+
+package consolein
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultCharset is the character set we use unless another is selected.
+const DefaultCharset = "ascii"
+
+// cp437 contains the Unicode characters for the bytes 0x80-0xFF of the
+// IBM PC character set, code page 437.
+var cp437 = []rune("" +
+	"ÇüéâäàåçêëèïîìÄÅ" +
+	"ÉæÆôöòûùÿÖÜ¢£¥₧ƒ" +
+	"áíóúñÑªº¿⌐¬½¼¡«»" +
+	"░▒▓│┤╡╢╖╕╣║╗╝╜╛┐" +
+	"└┴┬├─┼╞╟╚╔╩╦╠═╬╧" +
+	"╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀" +
+	"αßΓπΣσµτΦΘΩδ∞φε∩" +
+	"≡±≥≤⌠⌡÷≈°∙·√ⁿ²■ ")
+
+// asciiGroups lists characters, and the 7-bit text which replaces each of
+// them.  It is expanded into asciiFold when we're loaded.
+var asciiGroups = map[string]string{
+	"ÀÁÂÃÄÅĀĂĄ":                      "A",
+	"àáâãäåāăą":                      "a",
+	"ÇĆĈĊČ":                          "C",
+	"çćĉċč":                          "c",
+	"ĎĐÐ":                            "D",
+	"ďđð":                            "d",
+	"ÈÉÊËĒĔĖĘĚ":                      "E",
+	"èéêëēĕėęě":                      "e",
+	"ĜĞĠĢ":                           "G",
+	"ĝğġģ":                           "g",
+	"ĤĦ":                             "H",
+	"ĥħ":                             "h",
+	"ÌÍÎÏĨĪĬĮİ":                      "I",
+	"ìíîïĩīĭįı":                      "i",
+	"Ĵ":                              "J",
+	"ĵ":                              "j",
+	"Ķ":                              "K",
+	"ķ":                              "k",
+	"ĹĻĽĿŁ":                          "L",
+	"ĺļľŀł":                          "l",
+	"ÑŃŅŇ":                           "N",
+	"ñńņň":                           "n",
+	"ÒÓÔÕÖØŌŎŐ":                      "O",
+	"òóôõöøōŏő":                      "o",
+	"ŔŖŘ":                            "R",
+	"ŕŗř":                            "r",
+	"ŚŜŞŠ":                           "S",
+	"śŝşš":                           "s",
+	"ŢŤŦ":                            "T",
+	"ţťŧ":                            "t",
+	"ÙÚÛÜŨŪŬŮŰŲ":                     "U",
+	"ùúûüũūŭůűų":                     "u",
+	"Ŵ":                              "W",
+	"ŵ":                              "w",
+	"ÝŶŸ":                            "Y",
+	"ýÿŷ":                            "y",
+	"ŹŻŽ":                            "Z",
+	"źżž":                            "z",
+	"Æ":                              "AE",
+	"æ":                              "ae",
+	"Œ":                              "OE",
+	"œ":                              "oe",
+	"ß":                              "ss",
+	"Þ":                              "TH",
+	"þ":                              "th",
+	"‘’‚‛′":                          "'",
+	"“”„‟″":                          "\"",
+	"‐‑‒–—―−":                        "-",
+	"«":                              "<<",
+	"»":                              ">>",
+	"‹":                              "<",
+	"›":                              ">",
+	"…":                              "...",
+	"•·∙":                            "*",
+	"\u00a0\u2002\u2003\u2009\u202f": " ",
+	"×":                              "x",
+	"÷":                              "/",
+	"±":                              "+-",
+	"¡":                              "!",
+	"¿":                              "?",
+	"©":                              "(C)",
+	"®":                              "(R)",
+	"™":                              "TM",
+	"°":                              "o",
+	"€":                              "EUR",
+	"£":                              "GBP",
+	"¥":                              "JPY",
+	"¢":                              "c",
+	"¼":                              "1/4",
+	"½":                              "1/2",
+	"¾":                              "3/4",
+	"¹":                              "1",
+	"²":                              "2",
+	"³":                              "3",
+}
+
+// asciiFold maps characters to the 7-bit text which replaces them.
+var asciiFold = map[rune]string{}
+
+// charsets contains the names of the character sets we support, and for
+// each the function which converts a character to the bytes to return.
+// If a character can't be converted nil is returned.
+//
+// "raw" has no function, since no conversion takes place.
+var charsets = map[string]func(r rune) []byte{
+	"ascii": func(r rune) []byte {
+		return foldASCII(r)
+	},
+	"cp437": func(r rune) []byte {
+		for i, c := range cp437 {
+			if c == r {
+				return []byte{byte(0x80 + i)}
+			}
+		}
+		return foldASCII(r)
+	},
+	"latin1": func(r rune) []byte {
+		if r >= 0xA0 && r <= 0xFF {
+			return []byte{byte(r)}
+		}
+		return foldASCII(r)
+	},
+	"strip": func(r rune) []byte {
+		return nil
+	},
+	"raw": nil,
+}
+
+// init expands asciiGroups into asciiFold.
+func init() {
+	for chars, text := range asciiGroups {
+		for _, r := range chars {
+			asciiFold[r] = text
+		}
+	}
+}
+
+// foldASCII returns the 7-bit equivalent of the given character, if there
+// is one.
+func foldASCII(r rune) []byte {
+	text, ok := asciiFold[r]
+	if !ok {
+		return nil
+	}
+	return []byte(text)
+}
+
+// SetCharset changes the character set non-ASCII input is converted to.
+func (co *ConsoleIn) SetCharset(name string) error {
+
+	name = strings.ToLower(name)
+
+	if _, ok := charsets[name]; !ok {
+		valid := []string{}
+		for k := range charsets {
+			valid = append(valid, k)
+		}
+		sort.Strings(valid)
+		return fmt.Errorf("unknown charset '%s', valid charsets are %s", name, strings.Join(valid, ","))
+	}
+
+	co.charset = name
+	return nil
+}
+
+// GetCharset returns the name of the character set non-ASCII input is
+// converted to.
+func (co *ConsoleIn) GetCharset() string {
+	if co.charset == "" {
+		return DefaultCharset
+	}
+	return co.charset
+}
+
+// convert returns the bytes which replace the given UTF-8 sequence, ringing
+// the bell if it can't be converted, or isn't valid.
+func (co *ConsoleIn) convert(seq []byte) []byte {
+
+	fn := charsets[co.GetCharset()]
+	if fn == nil {
+		return seq
+	}
+
+	var out []byte
+	r, size := utf8.DecodeRune(seq)
+	if !(r == utf8.RuneError && size <= 1) {
+		out = fn(r)
+	}
+	if out == nil {
+		fmt.Printf("\a")
+	}
+	return out
+}
+
+// ConvertText converts any non-ASCII characters in the given text according
+// to our character set, as if it had been typed.
+func (co *ConsoleIn) ConvertText(text string) string {
+
+	if co.GetCharset() == "raw" {
+		return text
+	}
+
+	var out []byte
+	for len(text) > 0 {
+		_, size := utf8.DecodeRuneInString(text)
+		if text[0] < utf8.RuneSelf {
+			out = append(out, text[0])
+		} else {
+			out = append(out, co.convert([]byte(text[:size]))...)
+		}
+		text = text[size:]
+	}
+	return string(out)
+}
+
+// readConverted reads a character from our driver, converting any UTF-8
+// sequence according to our character set.
+//
+// If block is false, and no input is available, false is returned rather
+// than waiting for some.  The remainder of a sequence is only read if it
+// is already available, so a single byte which isn't valid UTF-8 doesn't
+// leave us waiting for more.
+func (co *ConsoleIn) readConverted(block bool) (byte, bool, error) {
+
+	for {
+		if len(co.converted) > 0 {
+			c := co.converted[0]
+			co.converted = co.converted[1:]
+			return c, true, nil
+		}
+
+		if !block && !co.rawPending() {
+			return 0x00, false, nil
+		}
+
+		c, err := co.readRaw()
+		if err != nil || c < utf8.RuneSelf || co.GetCharset() == "raw" {
+			return c, true, err
+		}
+
+		seq := []byte{c}
+		for !utf8.FullRune(seq) && co.rawPending() {
+			next, err := co.readRaw()
+			if err != nil {
+				break
+			}
+
+			// A byte which isn't part of the sequence is
+			// returned after it.
+			if !utf8.RuneStart(next) {
+				seq = append(seq, next)
+				continue
+			}
+			co.raw = append([]byte{next}, co.raw...)
+			break
+		}
+
+		co.converted = co.convert(seq)
+	}
+}
+
+// readRaw reads a byte from our driver, or one which readConverted found
+// was not part of a UTF-8 sequence.
+func (co *ConsoleIn) readRaw() (byte, error) {
+	if len(co.raw) > 0 {
+		c := co.raw[0]
+		co.raw = co.raw[1:]
+		return c, nil
+	}
+	return co.readDriverRaw()
+}
+
+// rawPending returns true if readRaw won't block.
+func (co *ConsoleIn) rawPending() bool {
+	return len(co.raw) > 0 || co.driverPending()
+}
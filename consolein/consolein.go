@@ -2,21 +2,36 @@
 //
 // We support two methods of getting input, whilst selectively
 // disabling/enabling echo - the use of `termbox' and the use of
-// the `stty` binary.
+// the `stty` binary.  We also support reading input from STDIN when
+// it is a file or pipe, rather than a terminal.
 package consolein
 
 import (
-	"bytes"
 	"fmt"
-	"os"
-	"os/exec"
+	"io"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
+
+	"github.com/skx/cpmulator/options"
 )
 
 // ErrInterrupted is returned if the user presses Ctrl-C when in our ReadLine function.
 var ErrInterrupted error = fmt.Errorf("INTERRUPTED")
 
+// ErrEOF is returned by drivers which read from a file, or pipe, when
+// all of their input has been consumed.
+var ErrEOF error = fmt.Errorf("END OF INPUT")
+
+// ErrKilled is returned when the kill key, configured via SetKillKey, is
+// read from our driver.
+var ErrKilled error = fmt.Errorf("KILLED")
+
+// InterruptPassThrough may be given to SetInterruptCount to deliver Ctrl-C
+// to the guest, as input, rather than using it to trigger a reboot.
+const InterruptPassThrough = -1
+
 // ConsoleInput is the interface that must be implemented by anything
 // that wishes to be used as an input driver.
 //
@@ -61,7 +76,10 @@ var history []string
 
 // Constructor is the signature of a constructor-function
 // which is used to instantiate an instance of a driver.
-type Constructor func() ConsoleInput
+//
+// The constructor receives any options which were specified for the
+// driver, and should return an error if any of them are invalid.
+type Constructor func(opts options.Options) (ConsoleInput, error)
 
 // Register makes a console driver available, by name.
 //
@@ -84,14 +102,175 @@ type ConsoleIn struct {
 	// systemPrefix is the prefix to use to trigger the execution
 	// of system commands, on the host,  in the ReadLine function
 	systemPrefix string
+
+	// systemOutput is the destination for the output of system
+	// commands, if nil then STDOUT is used.
+	systemOutput io.Writer
+
+	// escapeKey is the character which will invoke escapeHandler,
+	// rather than being returned to the caller.
+	escapeKey byte
+
+	// escapeHandler is invoked when escapeKey is read.
+	escapeHandler func() error
+
+	// escaped is true while escapeHandler is running, so that the
+	// handler may itself read input.
+	escaped bool
+
+	// killKey is the character which terminates the emulator, by
+	// causing reads to return ErrKilled.  Zero disables it.
+	killKey byte
+
+	// readHook, if set, is invoked before input is read, or polled.
+	readHook func()
+
+	// hasPending is true if a character has been read from our driver,
+	// by PendingInput, which has not yet been returned.  This ensures a
+	// status poll which finds a key pressed is followed by a read of the
+	// very same key, even if our driver is changed in between.
+	hasPending bool
+
+	// pending holds the character read by PendingInput.
+	pending byte
+
+	// pendingErr holds the error, if any, from reading pending.
+	pendingErr error
+
+	// unread counts the characters at the start of our stuffed input
+	// which were pushed back by UnreadCharacter, and so have already
+	// been delivered, and logged.
+	unread int
+
+	// quietPolls counts the status polls which found no input since
+	// the guest last produced output, see waiting.go.
+	quietPolls int
+
+	// legacyEditing is true if ReadLine should use the editing keys
+	// documented by Digital Research, see readline_dri.go.
+	legacyEditing bool
+
+	// injecting is true if input may be injected by other goroutines,
+	// see EnableInjection.
+	injecting bool
+
+	// injectMutex protects injected, pasted, and pasteNext.
+	injectMutex sync.Mutex
+
+	// injected holds input which has been injected, but not yet read.
+	injected []byte
+
+	// pasted holds text which has been pasted, but not yet read, see
+	// paste.go.
+	pasted []byte
+
+	// pasteNext is the time at which the next line of pasted text
+	// may be read.
+	pasteNext time.Time
+
+	// pasteDelay is the time we wait between lines of pasted text,
+	// if pasteDelaySet is true.
+	pasteDelay    time.Duration
+	pasteDelaySet bool
+
+	// lastPasted is true if the last character we returned came from
+	// pasted text.
+	lastPasted bool
+
+	// stuffPacing configures the pacing of stuffed input, see
+	// pacing.go.
+	stuffPacing StuffPacing
+
+	// stuffBudget is the number of characters of stuffed input which
+	// may be read before stuffTick is over.
+	stuffBudget int
+
+	// stuffTick is the start of the current pacing period.
+	stuffTick time.Time
+
+	// stuffHeld is true if stuffed input is hidden from status polls
+	// until the next blocking read.
+	stuffHeld bool
+
+	// charset is the character set non-ASCII input is converted to,
+	// see charset.go.
+	charset string
+
+	// converted holds the remainder of a converted character, which
+	// is yet to be read.
+	converted []byte
+
+	// stop, if not nil, is closed to abandon blocking reads, and reading
+	// receives the result of such a read, made upon another goroutine,
+	// until it is received into ready, see stop.go.
+	stop    <-chan struct{}
+	reading chan driverRead
+	ready   *driverRead
+
+	// raw holds the bytes read from our driver which are yet to be
+	// returned, such as one which wasn't part of the UTF-8 sequence
+	// before it, or those read by CheckEscape.
+	raw []byte
 }
 
+// injectPollInterval is the time we wait between checking for injected
+// input, and input from our driver, when injection is enabled.
+const injectPollInterval = 5 * time.Millisecond
+
 // New is our constructore, it creates an input device which uses
 // the specified driver.
+//
+// The name may be followed by a colon, and options, which will be
+// passed to the driver, for example "file:path=input.txt".
 func New(name string) (*ConsoleIn, error) {
 
-	// Downcase for consistency.
-	name = strings.ToLower(name)
+	driver, err := newDriver(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// OK we have a driver, return ourselves with that driver.
+	return &ConsoleIn{
+		driver: driver,
+	}, nil
+}
+
+// NewFromReader creates an input device which reads its input from the
+// given reader, as the "file" driver does, rather than from the console.
+//
+// Once all the input has been consumed reads will return ErrEOF.
+func NewFromReader(r io.Reader) *ConsoleIn {
+	return &ConsoleIn{
+		driver: &FileInput{reader: r},
+	}
+}
+
+// NewFromDriver creates an input device which uses the given driver, for
+// callers which implement their own.
+func NewFromDriver(driver ConsoleInput) *ConsoleIn {
+	return &ConsoleIn{
+		driver: driver,
+	}
+}
+
+// newDriver creates an instance of the driver with the given name,
+// passing any options to it.
+//
+// This is used by New, and also by drivers which wrap others.
+func newDriver(spec string) (ConsoleInput, error) {
+
+	// Split off any options.
+	name, opts, err := options.Split(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDriverWithOptions(name, opts)
+}
+
+// newDriverWithOptions creates an instance of the driver with the given
+// name, and options.
+func newDriverWithOptions(name string, opts options.Options) (ConsoleInput, error) {
 
 	// Do we have a constructor with the given name?
 	ctor, ok := handlers.m[name]
@@ -99,10 +278,12 @@ func New(name string) (*ConsoleIn, error) {
 		return nil, fmt.Errorf("failed to lookup driver by name '%s'", name)
 	}
 
-	// OK we do, return ourselves with that driver.
-	return &ConsoleIn{
-		driver: ctor(),
-	}, nil
+	driver, err := ctor(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create driver '%s': %s", name, err)
+	}
+
+	return driver, nil
 }
 
 // SetSystemCommandPrefix enables the use of system-commands in our readline
@@ -116,6 +297,45 @@ func (co *ConsoleIn) GetSystemCommandPrefix() string {
 	return co.systemPrefix
 }
 
+// SetSystemCommandOutput sets the destination for the output of system
+// commands, executed via the system-command prefix.
+func (co *ConsoleIn) SetSystemCommandOutput(out io.Writer) {
+	co.systemOutput = out
+}
+
+// GetSystemCommandOutput returns the destination for the output of system
+// commands, which defaults to STDOUT.
+func (co *ConsoleIn) GetSystemCommandOutput() io.Writer {
+	if co.systemOutput == nil {
+		return stdoutWriter{}
+	}
+	return co.systemOutput
+}
+
+// SetEscapeHandler configures a function which will be invoked, instead of
+// returning the character, whenever the given key is read from our driver.
+//
+// If the handler returns an error it is returned to the caller which was
+// reading input, otherwise we continue to wait for a character.  A key of
+// zero, or a nil handler, disables the escape.
+func (co *ConsoleIn) SetEscapeHandler(key byte, handler func() error) {
+	co.escapeKey = key
+	co.escapeHandler = handler
+}
+
+// SetReadHook configures a function which is invoked before input is read,
+// or polled for, such as flushing buffered output so that any prompt is
+// visible.  Passing nil removes any existing hook.
+func (co *ConsoleIn) SetReadHook(fn func()) {
+	co.readHook = fn
+}
+
+// GetEscapeHandler returns the key, and handler, configured by
+// SetEscapeHandler.
+func (co *ConsoleIn) GetEscapeHandler() (byte, func() error) {
+	return co.escapeKey, co.escapeHandler
+}
+
 // GetDriver allows getting our driver at runtime.
 func (co *ConsoleIn) GetDriver() ConsoleInput {
 	return co.driver
@@ -136,6 +356,23 @@ func (co *ConsoleIn) GetDrivers() []string {
 	return valid
 }
 
+// SetDriver replaces our console-input driver, at runtime, with the named
+// one.  The old driver is torn down, and the new one setup.
+//
+// Our other settings, such as the escape handler, are unchanged.
+func (co *ConsoleIn) SetDriver(name string) error {
+
+	driver, err := newDriver(name)
+	if err != nil {
+		return err
+	}
+
+	co.driver.TearDown()
+	driver.Setup()
+	co.driver = driver
+	return nil
+}
+
 // Setup proxies into our registered console-input driver.
 func (co *ConsoleIn) Setup() {
 	co.driver.Setup()
@@ -149,10 +386,33 @@ func (co *ConsoleIn) TearDown() {
 // StuffInput proxies into our registered console-input driver.
 func (co *ConsoleIn) StuffInput(input string) {
 	stuffed = input
+	co.unread = 0
+}
+
+// UnreadCharacter pushes a character back into our input, so that it will
+// be returned by the next read.
+//
+// This function DOES NOT proxy to our registered console-input driver.
+func (co *ConsoleIn) UnreadCharacter(c byte) {
+	stuffed = string([]byte{c}) + stuffed
+	co.unread++
+}
+
+// SetKillKey configures a key which terminates the emulator, whenever it
+// is read from our driver, by causing the read to return ErrKilled.  Zero
+// disables the kill key.
+func (co *ConsoleIn) SetKillKey(key byte) {
+	co.killKey = key
+}
+
+// GetKillKey returns the key configured by SetKillKey.
+func (co *ConsoleIn) GetKillKey() byte {
+	return co.killKey
 }
 
 // SetInterruptCount sets the number of consecutive Ctrl-C characters
-// are required to trigger a reboot.
+// are required to trigger a reboot.  Zero means Ctrl-C is ignored, and
+// InterruptPassThrough means it is returned as input.
 //
 // This function DOES NOT proxy to our registered console-input driver.
 func (co *ConsoleIn) SetInterruptCount(val int) {
@@ -166,28 +426,265 @@ func (co *ConsoleIn) GetInterruptCount() int {
 	return interruptCount
 }
 
+// EnableInjection allows input to be injected, via Inject, by other
+// goroutines while the emulator is running.
+//
+// Once enabled reads no longer block within our driver, instead they
+// wait for either injected input, or input from the driver, to become
+// available.
+func (co *ConsoleIn) EnableInjection() {
+	co.injecting = true
+}
+
+// Inject queues the given input to be read, before any further input from
+// our driver.  This may be called from any goroutine, but the input will
+// only be read if EnableInjection has been called.
+func (co *ConsoleIn) Inject(input string) {
+	co.injectMutex.Lock()
+	co.injected = append(co.injected, input...)
+	co.injectMutex.Unlock()
+}
+
+// takeInjected returns the next character of injected input, if there is
+// one.
+func (co *ConsoleIn) takeInjected() (byte, bool) {
+	co.injectMutex.Lock()
+	defer co.injectMutex.Unlock()
+
+	if !co.injecting || len(co.injected) == 0 {
+		return 0x00, false
+	}
+	c := co.injected[0]
+	co.injected = co.injected[1:]
+	return c, true
+}
+
 // PendingInput proxies into our registered console-input driver.
+//
+// If our driver has input available the first character is read, and
+// held until the next call to BlockForCharacterNoEcho returns it.
 func (co *ConsoleIn) PendingInput() bool {
 
-	// if there is stuffed input we have something ready to read
+	if co.readHook != nil {
+		co.readHook()
+	}
+
+	// if there is stuffed input we have something ready to read,
+	// unless it is being paced.
+	ready, _ := co.stuffedReady(true)
+	if ready {
+		return true
+	}
 	if len(stuffed) > 0 {
+		return false
+	}
+
+	// as is injected input.
+	co.injectMutex.Lock()
+	injected := co.injecting && len(co.injected) > 0
+	co.injectMutex.Unlock()
+	if injected {
+		return true
+	}
+
+	// Pasted text is only pending once the guest has had time to
+	// process the previous line.
+	ready, waiting := co.pasteWaiting()
+	if ready {
 		return true
 	}
+	if waiting {
+		return false
+	}
 
-	return co.driver.PendingInput()
+	if co.fillPending() {
+		return true
+	}
+	co.notePoll()
+	return false
+}
+
+// fillPending reads a character from our driver, if one is available and
+// we don't already hold one, returning true if there is input ready.
+func (co *ConsoleIn) fillPending() bool {
+
+	if co.hasPending {
+		return true
+	}
+
+	c, ok, err := co.readConverted(false)
+	if !ok {
+		return false
+	}
+	if err == nil && co.killKey != 0 && c == co.killKey {
+		err = ErrKilled
+	}
+	if err == nil && co.isEscape(c) {
+		err = co.runEscape()
+		if err == nil {
+			// The handler might have stuffed some input.
+			return len(stuffed) > 0
+		}
+	}
+
+	co.pending = c
+	co.pendingErr = err
+	co.hasPending = true
+	return true
 }
 
 // BlockForCharacterNoEcho proxies into our registered console-input driver.
+//
+// This is where input is delivered to the guest, so if our driver logs
+// input it is given each character we return, whether it came from our
+// driver, or was stuffed, pasted, or injected.
 func (co *ConsoleIn) BlockForCharacterNoEcho() (byte, error) {
 
-	// Do we have faked/stuffed input to process?
-	if len(stuffed) > 0 {
-		c := stuffed[0]
-		stuffed = stuffed[1:]
-		return c, nil
+	c, redelivered, err := co.blockForCharacter()
+	if err == nil && !redelivered {
+		if l, ok := co.driver.(InputLogger); ok {
+			l.LogInput(c)
+		}
 	}
+	return c, err
+}
+
+// blockForCharacter returns the next character of input, and true if it
+// was pushed back by UnreadCharacter, having already been delivered.
+func (co *ConsoleIn) blockForCharacter() (byte, bool, error) {
+
+	if co.readHook != nil {
+		co.readHook()
+	}
+
+	co.lastPasted = false
+
+	// A blocking read releases stuffed input held from status polls.
+	co.stuffHeld = false
+	co.quietPolls = 0
 
-	return co.driver.BlockForCharacterNoEcho()
+	for {
+		// Return the character found by PendingInput, if any.
+		if co.hasPending {
+			co.hasPending = false
+			return co.pending, false, co.pendingErr
+		}
+
+		// Do we have faked/stuffed input to process?
+		ready, wait := co.stuffedReady(false)
+		if ready {
+			redelivered := co.unread > 0
+			if redelivered {
+				co.unread--
+			}
+			return co.takeStuffed(), redelivered, nil
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+			continue
+		}
+
+		// Pasted text, which might need us to wait for it.
+		c, ok, wait := co.takePasted()
+		if ok {
+			co.lastPasted = true
+			return c, false, nil
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+			continue
+		}
+
+		if !co.injecting {
+			c, err := co.readDriver()
+			return c, false, err
+		}
+
+		// If input may be injected we can't block within our
+		// driver, so wait for input from either source, telling
+		// our driver we're waiting as we're polling it.
+		if co.stopped() {
+			return 0x00, false, ErrKilled
+		}
+		if c, ok := co.takeInjected(); ok {
+			return c, false, nil
+		}
+		co.waiting()
+		if !co.fillPending() {
+			time.Sleep(injectPollInterval)
+		}
+	}
+}
+
+// readDriver reads a character from our driver, invoking our escape
+// handler, rather than returning it, if it is the escape key.
+func (co *ConsoleIn) readDriver() (byte, error) {
+
+	for {
+		c, _, err := co.readConverted(true)
+		if err == nil && co.killKey != 0 && c == co.killKey {
+			return 0x00, ErrKilled
+		}
+		if err != nil || !co.isEscape(c) {
+			return c, err
+		}
+
+		err = co.runEscape()
+		if err != nil {
+			return 0x00, err
+		}
+
+		// The handler might have stuffed some input.
+		if len(stuffed) > 0 {
+			c := stuffed[0]
+			stuffed = stuffed[1:]
+			return c, nil
+		}
+	}
+}
+
+// isEscape returns true if the given character should invoke our escape
+// handler.
+func (co *ConsoleIn) isEscape(c byte) bool {
+	return !co.escaped && co.escapeHandler != nil && co.escapeKey != 0 && c == co.escapeKey
+}
+
+// runEscape invokes our escape handler.
+func (co *ConsoleIn) runEscape() error {
+	co.escaped = true
+	err := co.escapeHandler()
+	co.escaped = false
+	return err
+}
+
+// CheckEscape looks for our escape key having been pressed while the guest
+// isn't reading from the console, such as when it is busy computing, and
+// invokes our escape handler if it was, returning any error the handler
+// returns.
+//
+// The keys pressed before it are held until the guest reads them, unless
+// one is our kill key, in which case ErrKilled is returned.  If our driver
+// fails we stop looking, and leave the guest's next read to find the error.
+func (co *ConsoleIn) CheckEscape() error {
+
+	if co.escaped || co.escapeHandler == nil || co.escapeKey == 0 {
+		return nil
+	}
+
+	for co.driverPending() {
+		c, err := co.readDriverRaw()
+		if err != nil {
+			return nil
+		}
+		if co.killKey != 0 && c == co.killKey {
+			return ErrKilled
+		}
+		if co.isEscape(c) {
+			return co.runEscape()
+		}
+		co.raw = append(co.raw, c)
+	}
+	return nil
 }
 
 // BlockForCharacterWithEcho blocks for input and shows that input before it
@@ -196,15 +693,9 @@ func (co *ConsoleIn) BlockForCharacterNoEcho() (byte, error) {
 // This function DOES NOT proxy to our registered console-input driver.
 func (co *ConsoleIn) BlockForCharacterWithEcho() (byte, error) {
 
-	// Do we have faked/stuffed input to process?
-	if len(stuffed) > 0 {
-		c := stuffed[0]
-		stuffed = stuffed[1:]
-		fmt.Printf("%c", c)
-		return c, nil
-	}
-
-	c, err := co.driver.BlockForCharacterNoEcho()
+	// Reading via BlockForCharacterNoEcho ensures that stuffed,
+	// pending, pasted, and injected input are all honoured.
+	c, err := co.BlockForCharacterNoEcho()
 	if err == nil {
 		fmt.Printf("%c", c)
 	}
@@ -215,6 +706,19 @@ func (co *ConsoleIn) BlockForCharacterWithEcho() (byte, error) {
 //
 // This function DOES NOT proxy to our registered console-input driver.
 func (co *ConsoleIn) ReadLine(max uint8) (string, error) {
+
+	if co.readHook != nil {
+		co.readHook()
+	}
+
+	if co.legacyEditing {
+		text, err := co.readLineDRI(max)
+		if err != nil {
+			return "", err
+		}
+		return co.finishLine(text, max)
+	}
+
 	// Text the user entered
 	text := ""
 
@@ -246,6 +750,13 @@ func (co *ConsoleIn) ReadLine(max uint8) (string, error) {
 		// Get a character, with no echo.
 		x, err := co.BlockForCharacterNoEcho()
 		if err != nil {
+
+			// If our input ended part-way through a line
+			// then return what we have, the next read will
+			// receive the error.
+			if err == ErrEOF && text != "" {
+				break
+			}
 			return "", err
 		}
 
@@ -290,6 +801,15 @@ func (co *ConsoleIn) ReadLine(max uint8) (string, error) {
 			continue
 		}
 
+		// Ctrl-C, being passed through to the guest?
+		if x == 0x03 && interruptCount == InterruptPassThrough {
+			if len(text) < int(max) {
+				fmt.Printf("^C")
+				text += string(x)
+			}
+			continue
+		}
+
 		// Ctrl-C ?
 		if x == 0x03 {
 
@@ -344,6 +864,7 @@ func (co *ConsoleIn) ReadLine(max uint8) (string, error) {
 		// If the user has entered the maximum then we'll say their
 		// input-time is over now.
 		if len(text) >= int(max) {
+			co.discardPastedLine()
 			break
 		}
 
@@ -354,6 +875,13 @@ func (co *ConsoleIn) ReadLine(max uint8) (string, error) {
 		}
 	}
 
+	return co.finishLine(text, max)
+}
+
+// finishLine handles a line of text which has been read by ReadLine,
+// executing it upon the host if it starts with our system-command prefix.
+func (co *ConsoleIn) finishLine(text string, max uint8) (string, error) {
+
 	// remove any trailing newline
 	text = strings.TrimSuffix(text, "\n")
 
@@ -367,55 +895,9 @@ func (co *ConsoleIn) ReadLine(max uint8) (string, error) {
 	//
 	if co.systemPrefix != "" && strings.HasPrefix(text, co.systemPrefix) {
 
-		// Strip the prefix, and any spaces.
-		text = text[len(co.systemPrefix):]
-		text = strings.TrimSpace(text)
-
-		// cd is a special command.
-		if strings.HasPrefix(text, "cd ") {
-			bits := strings.Split(text, " ")
-			if len(bits) >= 2 {
-				dir := bits[1]
-				err := os.Chdir(dir)
-				if err != nil {
-					fmt.Printf("\r\nError changing to directory %s: %s\r\n", dir, err)
-				}
-			}
-			return co.ReadLine(max)
-		}
-
-		// Split the command, naively.
-		var bits []string
-		bits = strings.Split(text, " ")
-
-		// Of course we might be using the shell.
-		useShell := false
-		if strings.Contains(text, ">") || strings.Contains(text, "&") || strings.Contains(text, "|") || strings.Contains(text, "<") {
-			useShell = true
-		}
-
-		// If we are we wrap the command.
-		if useShell {
-			bits = []string{"bash", "-c", text}
-		}
-
-		// Prepare to run the command, capturing STDOUT & STDERR
-		cmd := exec.Command(bits[0], bits[1:]...)
-		var execOut bytes.Buffer
-		var execErr bytes.Buffer
-		cmd.Stdout = &execOut
-		cmd.Stderr = &execErr
-
-		// Actually run the command
-		err := cmd.Run()
-		if err != nil {
-			fmt.Printf("\r\nerror running command '%s' %s%s\r\n", text, err.Error(), execErr.Bytes())
-		} else {
-			out := execOut.String()
-			out += execErr.String()
-			out = strings.ReplaceAll(out, "\n", "\n\r")
-			fmt.Printf("\r\n%s\r\n", out)
-		}
+		// Strip the prefix, and run the command.
+		fmt.Printf("\r\n")
+		RunSystemCommand(text[len(co.systemPrefix):], co.GetSystemCommandOutput())
 
 		// Read the input again, since we "stole" it via the exec handling.
 		return co.ReadLine(max)
@@ -1,8 +1,15 @@
 package consolein
 
 import (
+	"bytes"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/nsf/termbox-go"
 )
 
 func TestReadlineSTTY(t *testing.T) {
@@ -178,7 +185,7 @@ func TestPending(t *testing.T) {
 // TestDriverRegistration performs some sanity-check on our driver-registration.
 func TestDriverRegistration(t *testing.T) {
 
-	if len(handlers.m) != 2 {
+	if len(handlers.m) != 4 {
 		t.Fatalf("wrong number of handlers")
 	}
 
@@ -220,7 +227,7 @@ func TestDriverRegistration(t *testing.T) {
 	if obj.GetName() != "stty" {
 		t.Fatalf("naming mismatch on driver!")
 	}
-	if len(obj.GetDrivers()) != 2 {
+	if len(obj.GetDrivers()) != 4 {
 		t.Fatalf("driver count is wrong")
 	}
 
@@ -275,3 +282,886 @@ func TestSimpleExec(t *testing.T) {
 		t.Fatalf("failed to change directory")
 	}
 }
+
+// TestFileInput ensures our file-based input driver reads until EOF.
+func TestFileInput(t *testing.T) {
+
+	x := FileInput{reader: strings.NewReader("DIR\nTYPE FOO")}
+
+	ch := ConsoleIn{}
+	ch.driver = &x
+
+	out, err := ch.ReadLine(20)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if out != "DIR" {
+		t.Fatalf("Unexpected output '%s'", out)
+	}
+
+	// The final line has no newline, but should still be returned.
+	out, err = ch.ReadLine(20)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if out != "TYPE FOO" {
+		t.Fatalf("Unexpected output '%s'", out)
+	}
+
+	// Now we're at the end of our input, which isn't reported as a
+	// pending key, but is returned by blocking reads.
+	if ch.PendingInput() {
+		t.Fatalf("unexpected pending input at EOF")
+	}
+	_, err = ch.ReadLine(20)
+	if err != ErrEOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	_, err = ch.BlockForCharacterNoEcho()
+	if err != ErrEOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	if x.GetName() != "file" {
+		t.Fatalf("naming mismatch on driver!")
+	}
+}
+
+// TestFileInputPolling ensures our file-based input driver only offers
+// its lines to status polls once the guest is waiting for input.
+func TestFileInputPolling(t *testing.T) {
+
+	x := FileInput{reader: strings.NewReader("AB\nC")}
+
+	ch := ConsoleIn{}
+	ch.driver = &x
+
+	// A program which produces output between its polls is working,
+	// so never sees our input, however often it polls.
+	for i := 0; i < WaitingPolls*4; i++ {
+		if ch.PendingInput() {
+			t.Fatalf("input was offered to a working program")
+		}
+		ch.NoteOutput()
+		time.Sleep(time.Millisecond)
+	}
+
+	// A program which polls without output is waiting for input.
+	pending := false
+	for i := 0; i < WaitingPolls*4 && !pending; i++ {
+		pending = ch.PendingInput()
+		time.Sleep(time.Millisecond)
+	}
+	if !pending {
+		t.Fatalf("input was never offered to a waiting program")
+	}
+	c, err := ch.BlockForCharacterNoEcho()
+	if err != nil || c != 'A' {
+		t.Fatalf("unexpected read %c %v", c, err)
+	}
+
+	// The remainder of a line is pending once it has been started.
+	if !ch.PendingInput() {
+		t.Fatalf("the rest of the line wasn't pending")
+	}
+	for _, expected := range []byte{'B', '\r'} {
+		c, err = ch.BlockForCharacterNoEcho()
+		if err != nil || c != expected {
+			t.Fatalf("unexpected read %c %v", c, err)
+		}
+	}
+	ch.NoteOutput()
+	if ch.PendingInput() {
+		t.Fatalf("the next line was pending")
+	}
+
+	// A blocking read starts the final line.
+	c, err = ch.BlockForCharacterNoEcho()
+	if err != nil || c != 'C' {
+		t.Fatalf("unexpected read %c %v", c, err)
+	}
+
+	// The end of our input is only reported to a waiting program.
+	ch.NoteOutput()
+	if ch.PendingInput() {
+		t.Fatalf("the end of input was reported to a working program")
+	}
+	pending = false
+	for i := 0; i < WaitingPolls*4 && !pending; i++ {
+		pending = ch.PendingInput()
+		time.Sleep(time.Millisecond)
+	}
+	if !pending {
+		t.Fatalf("the end of input was never reported")
+	}
+	_, err = ch.BlockForCharacterNoEcho()
+	if err != ErrEOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+// TestCheckEscape ensures our escape key is found while the guest isn't
+// reading from the console, and that the keys before it are held.
+func TestCheckEscape(t *testing.T) {
+
+	x := FileInput{reader: strings.NewReader("ab\x1Dcd\x1C")}
+	x.Waiting()
+
+	ch := ConsoleIn{}
+	ch.driver = &x
+
+	// Without an escape handler nothing is read.
+	if ch.CheckEscape() != nil || len(ch.raw) != 0 {
+		t.Fatalf("input was read without an escape handler")
+	}
+
+	count := 0
+	ch.SetEscapeHandler(0x1D, func() error {
+		count++
+		return nil
+	})
+	ch.SetKillKey(0x1C)
+
+	for i := 0; i < 500 && count == 0; i++ {
+		err := ch.CheckEscape()
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if count != 1 {
+		t.Fatalf("escape handler wasn't invoked")
+	}
+
+	// The kill key is found too.
+	if ch.CheckEscape() != ErrKilled {
+		t.Fatalf("expected the kill key to be found")
+	}
+
+	// The other keys are still read, in order.
+	for _, expected := range []byte{'a', 'b', 'c', 'd'} {
+		c, err := ch.BlockForCharacterNoEcho()
+		if err != nil || c != expected {
+			t.Fatalf("unexpected read %c %v", c, err)
+		}
+	}
+}
+
+// TestEscapeHandler ensures our escape handler is invoked.
+// TestSetStop ensures a blocking read is abandoned when our stop channel
+// is closed, and that the key it was waiting for isn't lost.
+func TestSetStop(t *testing.T) {
+
+	r, w := io.Pipe()
+	x := FileInput{reader: r}
+
+	ch := ConsoleIn{}
+	ch.driver = &x
+
+	stop := make(chan struct{})
+	ch.SetStop(stop)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(stop)
+	}()
+	_, err := ch.BlockForCharacterNoEcho()
+	if err != ErrKilled {
+		t.Fatalf("expected a stopped read, got %v", err)
+	}
+
+	// Once stopped every read is stopped.
+	_, err = ch.BlockForCharacterNoEcho()
+	if err != ErrKilled {
+		t.Fatalf("expected a stopped read, got %v", err)
+	}
+
+	// The abandoned read still receives the next key.
+	ch.SetStop(nil)
+	go w.Write([]byte("x"))
+	c, err := ch.BlockForCharacterNoEcho()
+	if err != nil || c != 'x' {
+		t.Fatalf("unexpected read %c %v", c, err)
+	}
+}
+
+func TestEscapeHandler(t *testing.T) {
+
+	x := FileInput{reader: strings.NewReader("A\x1DB\x1DC")}
+
+	ch := ConsoleIn{}
+	ch.driver = &x
+
+	count := 0
+	ch.SetEscapeHandler(0x1D, func() error {
+		count++
+
+		// The first time we'll stuff some input, reading
+		// a character ourselves, which won't recurse.
+		if count == 1 {
+			c, err := ch.BlockForCharacterNoEcho()
+			if err != nil || c != 'B' {
+				t.Fatalf("unexpected read in handler %c %v", c, err)
+			}
+			ch.StuffInput("Z")
+			return nil
+		}
+		return ErrInterrupted
+	})
+
+	key, handler := ch.GetEscapeHandler()
+	if key != 0x1D || handler == nil {
+		t.Fatalf("failed to get escape handler")
+	}
+
+	c, err := ch.BlockForCharacterNoEcho()
+	if err != nil || c != 'A' {
+		t.Fatalf("unexpected read %c %v", c, err)
+	}
+
+	// The escape handler stuffed "Z"
+	c, err = ch.BlockForCharacterNoEcho()
+	if err != nil || c != 'Z' {
+		t.Fatalf("unexpected read %c %v", c, err)
+	}
+
+	// The second escape returns an error
+	_, err = ch.BlockForCharacterNoEcho()
+	if err != ErrInterrupted {
+		t.Fatalf("expected error from escape handler, got %v", err)
+	}
+	if count != 2 {
+		t.Fatalf("escape handler called %d times", count)
+	}
+
+	c, err = ch.BlockForCharacterNoEcho()
+	if err != nil || c != 'C' {
+		t.Fatalf("unexpected read %c %v", c, err)
+	}
+}
+
+// TestKeymaps ensures our keymaps send the expected control characters,
+// and escape sequences.
+func TestKeymaps(t *testing.T) {
+
+	// ArrowLeft sends Ctrl-S, which pauses output written via the
+	// BDOS, see TestKeymapPause in the cpm package.
+	if keymaps["wordstar"][termbox.KeyArrowLeft] != "\x13" {
+		t.Fatalf("ArrowLeft isn't Ctrl-S in the wordstar keymap")
+	}
+	if keymaps["wordstar"][termbox.KeyHome] != "\x11\x13" {
+		t.Fatalf("Home isn't Ctrl-Q Ctrl-S in the wordstar keymap")
+	}
+	if keymaps["vt100"][termbox.KeyArrowUp] != "\x1b[A" {
+		t.Fatalf("ArrowUp isn't ESC [ A in the vt100 keymap")
+	}
+	if keymaps["vt100"][termbox.KeyDelete] != "\x7f" {
+		t.Fatalf("Delete isn't DEL in the vt100 keymap")
+	}
+	if len(keymaps["none"]) != 0 {
+		t.Fatalf("the none keymap translates keys")
+	}
+}
+
+// TestDriverArguments ensures that arguments are passed to drivers.
+func TestDriverArguments(t *testing.T) {
+
+	// Drivers which don't take options should reject them.
+	_, err := New("stty:foo=bar")
+	if err == nil {
+		t.Fatalf("expected error passing options to stty")
+	}
+
+	// Bogus/missing options
+	for _, bogus := range []string{"tee:", "tee:stty", "tee:driver=stty", "tee:log=foo",
+		"tee:driver=bogus,log=foo", "tee:driver=tee,log=foo", "tee:driver=stty,log=foo,keymap=none",
+		"term:keymap=bogus", "term:foo=bar", "file:path=/path/not/found", "file:foo=bar"} {
+		_, err = New(bogus)
+		if err == nil {
+			t.Fatalf("expected error creating %s", bogus)
+		}
+	}
+
+	// Valid options
+	for _, valid := range []string{"term:keymap=wordstar", "term:keymap=vt100", "TERM:KEYMAP=none"} {
+		_, err = New(valid)
+		if err != nil {
+			t.Fatalf("unexpected error creating %s: %s", valid, err)
+		}
+	}
+
+	// Options are passed through the tee driver.
+	path := filepath.Join(t.TempDir(), "keys.log")
+	obj, err := New("tee:driver=term,keymap=wordstar,log=" + path)
+	if err != nil {
+		t.Fatalf("unexpected error creating tee driver %s", err)
+	}
+	tee, ok := obj.GetDriver().(*TeeInput)
+	if !ok {
+		t.Fatalf("failed to cast driver")
+	}
+	if tee.driver.GetName() != "term" {
+		t.Fatalf("wrong wrapped driver")
+	}
+	obj.TearDown()
+
+	// Reading from a file
+	input := filepath.Join(t.TempDir(), "input.txt")
+	err = os.WriteFile(input, []byte("DIR\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write input %s", err)
+	}
+	obj, err = New("file:path=" + input)
+	if err != nil {
+		t.Fatalf("unexpected error creating file driver %s", err)
+	}
+	out, err := obj.ReadLine(20)
+	if err != nil || out != "DIR" {
+		t.Fatalf("failed to read from file: '%s' %v", out, err)
+	}
+	obj.TearDown()
+
+	obj, err = New("tee:driver=stty,log=" + path)
+	if err != nil {
+		t.Fatalf("unexpected error creating tee driver %s", err)
+	}
+	if obj.GetName() != "tee" {
+		t.Fatalf("naming mismatch on driver!")
+	}
+	obj.TearDown()
+}
+
+// TestTeeInput ensures that the tee driver logs the input delivered to the
+// guest, whether it came from the wrapped driver, or not.
+func TestTeeInput(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "keys.log")
+	log, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create log %s", err)
+	}
+
+	x := TeeInput{driver: &FileInput{reader: strings.NewReader("A\x03")}, log: log}
+	ch := ConsoleIn{driver: &x}
+	ch.SetPasteDelay(0)
+	ch.EnableInjection()
+
+	read := func(expected byte) {
+		c, err := ch.BlockForCharacterNoEcho()
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if c != expected {
+			t.Fatalf("got wrong character %c", c)
+		}
+	}
+
+	// Stuffed input, which is only logged once if it is pushed back.
+	ch.StuffInput("S")
+	read('S')
+	ch.UnreadCharacter('S')
+	read('S')
+
+	// Injected, and pasted, input.
+	ch.Inject("I")
+	read('I')
+	ch.Paste("P")
+	read('P')
+
+	// Input from the wrapped driver.
+	read('A')
+	read(0x03)
+	_, err = ch.BlockForCharacterNoEcho()
+	if err != ErrEOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	ch.TearDown()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read log %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	expected := []string{" 0x53 S", " 0x49 I", " 0x50 P", " 0x41 A", " 0x03 ."}
+	if len(lines) != len(expected) {
+		t.Fatalf("wrong number of lines logged: %d", len(lines))
+	}
+	for i, suffix := range expected {
+		if !strings.HasSuffix(lines[i], suffix) {
+			t.Fatalf("wrong log entry '%s'", lines[i])
+		}
+	}
+}
+
+// TestSetDriver ensures the driver can be changed at runtime, keeping our
+// other settings.
+func TestSetDriver(t *testing.T) {
+
+	ch, err := New("file")
+	if err != nil {
+		t.Fatalf("failed to create driver")
+	}
+	ch.SetSystemCommandPrefix("!!")
+
+	err = ch.SetDriver("steve")
+	if err == nil {
+		t.Fatalf("expected error with bogus driver")
+	}
+	if ch.GetName() != "file" {
+		t.Fatalf("driver changed after error: %s", ch.GetName())
+	}
+
+	path := filepath.Join(t.TempDir(), "input.txt")
+	err = os.WriteFile(path, []byte("X"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write input: %s", err)
+	}
+
+	err = ch.SetDriver("file:path=" + path)
+	if err != nil {
+		t.Fatalf("failed to change driver: %s", err)
+	}
+	defer ch.TearDown()
+
+	c, err := ch.BlockForCharacterNoEcho()
+	if err != nil || c != 'X' {
+		t.Fatalf("driver wasn't changed, read %c %v", c, err)
+	}
+	if ch.GetSystemCommandPrefix() != "!!" {
+		t.Fatalf("lost our settings")
+	}
+}
+
+// TestRunSystemCommand ensures host commands write their output to the
+// given writer.
+func TestRunSystemCommand(t *testing.T) {
+
+	out := &bytes.Buffer{}
+	RunSystemCommand("echo hello", out)
+	if out.String() != "hello\n" {
+		t.Fatalf("unexpected output '%s'", out.String())
+	}
+
+	out.Reset()
+	RunSystemCommand("echo hello | tr a-z A-Z", out)
+	if out.String() != "HELLO\n" {
+		t.Fatalf("unexpected output via shell '%s'", out.String())
+	}
+
+	out.Reset()
+	RunSystemCommand("/does/not/exist", out)
+	if !strings.Contains(out.String(), "error running command") {
+		t.Fatalf("expected error, got '%s'", out.String())
+	}
+
+	out.Reset()
+	RunSystemCommand("cd /does/not/exist", out)
+	if !strings.Contains(out.String(), "Error changing to directory") {
+		t.Fatalf("expected error, got '%s'", out.String())
+	}
+
+	// The default output is STDOUT.
+	ch := ConsoleIn{}
+	if _, ok := ch.GetSystemCommandOutput().(stdoutWriter); !ok {
+		t.Fatalf("unexpected default output")
+	}
+	ch.SetSystemCommandOutput(out)
+	if ch.GetSystemCommandOutput() != out {
+		t.Fatalf("failed to change output")
+	}
+}
+
+// TestReadlineDRI tests the legacy line-editor.
+func TestReadlineDRI(t *testing.T) {
+
+	ch := ConsoleIn{}
+	ch.driver = &STTYInput{}
+	ch.SetLegacyEditing(true)
+	if !ch.GetLegacyEditing() {
+		t.Fatalf("legacy editing not enabled")
+	}
+
+	type TestCase struct {
+		input  string
+		max    uint8
+		output string
+	}
+
+	tests := []TestCase{
+		// Simple input
+		{"steve\r", 20, "steve"},
+		// Ctrl-H, and rubout, remove a character
+		{"stevx\bE\x7f\x7fve\r", 20, "steve"},
+		// Ctrl-U discards the line
+		{"hello\x15steve\r", 20, "steve"},
+		// Ctrl-X erases the line
+		{"hello\x18steve\r", 20, "steve"},
+		// Ctrl-E, Ctrl-R, and Ctrl-P, don't change the line
+		{"ste\x05ve\x12\x10\r", 20, "steve"},
+		// Other control characters are stored, including Ctrl-C and
+		// Esc which have special meanings to our modern editor.
+		{"a\x03\x1bb\r", 20, "a\x03\x1bb"},
+		// Input ends when the buffer is full
+		{"steve", 3, "ste"},
+	}
+
+	for _, test := range tests {
+		ch.StuffInput(test.input)
+		out, err := ch.ReadLine(test.max)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", test.input, err)
+		}
+		if out != test.output {
+			t.Fatalf("for %q expected %q, got %q", test.input, test.output, out)
+		}
+	}
+
+	// History isn't used.
+	history = []string{"previous"}
+	ch.StuffInput("\x10\r")
+	out, err := ch.ReadLine(20)
+	if err != nil || out != "" {
+		t.Fatalf("unexpected history %q %v", out, err)
+	}
+
+	// Ctrl-C at the start of the line still reboots.
+	ch.SetInterruptCount(2)
+	ch.StuffInput("\x03\x03")
+	_, err = ch.ReadLine(20)
+	if err != ErrInterrupted {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+// TestPendingByte tests that a character found by PendingInput is the one
+// returned by the next read, even if the driver changes in between.
+func TestPendingByte(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "input.txt")
+	err := os.WriteFile(path, []byte("z"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write input: %s", err)
+	}
+
+	ch := NewFromReader(strings.NewReader("ab"))
+
+	// Wait for our input to arrive.
+	for i := 0; i < 500 && !ch.PendingInput(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if !ch.PendingInput() {
+		t.Fatalf("expected pending input")
+	}
+
+	// Polling again doesn't consume anything.
+	if !ch.PendingInput() {
+		t.Fatalf("expected pending input")
+	}
+
+	err = ch.SetDriver("file:path=" + path)
+	if err != nil {
+		t.Fatalf("failed to change driver: %s", err)
+	}
+	defer ch.TearDown()
+
+	for _, expected := range []byte("az") {
+		c, err := ch.BlockForCharacterNoEcho()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if c != expected {
+			t.Fatalf("expected %c, got %c", expected, c)
+		}
+	}
+
+	// A pending end of input is returned as an error, once.
+	for i := 0; i < 500 && !ch.PendingInput(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = ch.BlockForCharacterNoEcho()
+	if err != ErrEOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+// TestInterruptPassThrough tests that Ctrl-C may be delivered as input.
+func TestInterruptPassThrough(t *testing.T) {
+
+	ch := ConsoleIn{}
+	ch.driver = &STTYInput{}
+	defer ch.SetInterruptCount(2)
+
+	ch.SetInterruptCount(InterruptPassThrough)
+	for _, legacy := range []bool{false, true} {
+		ch.SetLegacyEditing(legacy)
+
+		ch.StuffInput("\x03\x03a\x03\n")
+		out, err := ch.ReadLine(20)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if out != "\x03\x03a\x03" {
+			t.Fatalf("unexpected output %q", out)
+		}
+	}
+}
+
+// TestKillKey tests that reading the kill key returns an error, whether
+// it is found by a read, or by a poll.
+func TestKillKey(t *testing.T) {
+
+	ch := NewFromReader(strings.NewReader("a\x1cb\x1c"))
+	ch.SetKillKey(0x1C)
+	if ch.GetKillKey() != 0x1C {
+		t.Fatalf("unexpected kill key")
+	}
+
+	c, err := ch.BlockForCharacterNoEcho()
+	if err != nil || c != 'a' {
+		t.Fatalf("unexpected result %c %v", c, err)
+	}
+	_, err = ch.BlockForCharacterNoEcho()
+	if err != ErrKilled {
+		t.Fatalf("expected ErrKilled, got %v", err)
+	}
+
+	c, err = ch.BlockForCharacterNoEcho()
+	if err != nil || c != 'b' {
+		t.Fatalf("unexpected result %c %v", c, err)
+	}
+
+	for i := 0; i < 500 && !ch.PendingInput(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = ch.BlockForCharacterNoEcho()
+	if err != ErrKilled {
+		t.Fatalf("expected ErrKilled, got %v", err)
+	}
+}
+
+// TestPaste tests that pasted text is delivered a line at a time, and that
+// over-long lines are truncated.
+func TestPaste(t *testing.T) {
+
+	ch := NewFromReader(strings.NewReader(""))
+	ch.SetInterruptCount(2)
+
+	if ch.GetPasteDelay() != DefaultPasteDelay {
+		t.Fatalf("unexpected default paste delay")
+	}
+	ch.SetPasteDelay(50 * time.Millisecond)
+
+	ch.Paste("one\ntoo long\r\nthree\n")
+	if ch.PastePending() != len("one\rtoo long\rthree\r") {
+		t.Fatalf("unexpected pending size %d", ch.PastePending())
+	}
+
+	// The first line is available immediately.
+	if !ch.PendingInput() {
+		t.Fatalf("expected pending input")
+	}
+	text, err := ch.ReadLine(20)
+	if err != nil || text != "one" {
+		t.Fatalf("unexpected result '%s' %v", text, err)
+	}
+
+	// The next isn't, until our delay has passed.
+	if ch.PendingInput() {
+		t.Fatalf("expected the next line to be delayed")
+	}
+
+	// A blocking read waits for it, and truncates it.
+	start := time.Now()
+	text, err = ch.ReadLine(3)
+	if err != nil || text != "too" {
+		t.Fatalf("unexpected result '%s' %v", text, err)
+	}
+	if time.Since(start) < 40*time.Millisecond {
+		t.Fatalf("pasted line wasn't delayed")
+	}
+
+	// The legacy editor truncates too, and a partial last line is
+	// returned once our input ends.
+	ch.SetLegacyEditing(true)
+	ch.Paste("abcdef\rxy")
+	text, err = ch.ReadLine(4)
+	if err != nil || text != "thre" {
+		t.Fatalf("unexpected result '%s' %v", text, err)
+	}
+	text, err = ch.ReadLine(4)
+	if err != nil || text != "abcd" {
+		t.Fatalf("unexpected result '%s' %v", text, err)
+	}
+	text, err = ch.ReadLine(4)
+	if err != nil || text != "xy" {
+		t.Fatalf("unexpected result '%s' %v", text, err)
+	}
+	if ch.PastePending() != 0 {
+		t.Fatalf("expected the paste to be consumed")
+	}
+}
+
+// TestStuffPacing tests the pacing of stuffed input.
+func TestStuffPacing(t *testing.T) {
+
+	// Parsing
+	valid := map[string]StuffPacing{
+		"":           {},
+		"4":          {Chars: 4, Tick: DefaultStuffTick},
+		"2/50ms":     {Chars: 2, Tick: 50 * time.Millisecond},
+		"read":       {WaitForRead: true},
+		"3/1s, READ": {Chars: 3, Tick: time.Second, WaitForRead: true},
+	}
+	for spec, expected := range valid {
+		out, err := ParseStuffPacing(spec)
+		if err != nil {
+			t.Fatalf("unexpected error parsing '%s': %s", spec, err)
+		}
+		if out != expected {
+			t.Fatalf("unexpected result parsing '%s': %v", spec, out)
+		}
+		again, err := ParseStuffPacing(out.String())
+		if err != nil || again != out {
+			t.Fatalf("failed to round-trip '%s'", spec)
+		}
+	}
+	for _, spec := range []string{"0", "x", "2/", "2/-1s", "2/fast"} {
+		_, err := ParseStuffPacing(spec)
+		if err == nil {
+			t.Fatalf("expected error parsing '%s'", spec)
+		}
+	}
+
+	ch := NewFromReader(strings.NewReader(""))
+	ch.SetInterruptCount(2)
+	defer ch.SetStuffPacing(StuffPacing{})
+
+	// Two characters every 50ms.
+	ch.SetStuffPacing(StuffPacing{Chars: 2, Tick: 50 * time.Millisecond})
+	ch.StuffInput("abc")
+	start := time.Now()
+	for _, expected := range []byte("ab") {
+		if !ch.PendingInput() {
+			t.Fatalf("expected pending input")
+		}
+		c, err := ch.BlockForCharacterNoEcho()
+		if err != nil || c != expected {
+			t.Fatalf("expected %c, got %c %v", expected, c, err)
+		}
+	}
+	if ch.PendingInput() {
+		t.Fatalf("expected the third character to be paced")
+	}
+	c, err := ch.BlockForCharacterNoEcho()
+	if err != nil || c != 'c' {
+		t.Fatalf("expected c, got %c %v", c, err)
+	}
+	if time.Since(start) < 40*time.Millisecond {
+		t.Fatalf("stuffed input wasn't paced")
+	}
+
+	// Lines are hidden from polls until a blocking read.
+	ch.SetStuffPacing(StuffPacing{WaitForRead: true})
+	ch.StuffInput("A\rB\r")
+	text, err := ch.ReadLine(20)
+	if err != nil || text != "A" {
+		t.Fatalf("unexpected result '%s' %v", text, err)
+	}
+	if ch.PendingInput() {
+		t.Fatalf("expected the next line to be held")
+	}
+	text, err = ch.ReadLine(20)
+	if err != nil || text != "B" {
+		t.Fatalf("unexpected result '%s' %v", text, err)
+	}
+}
+
+// TestFallback ensures drivers which need a terminal are replaced.
+func TestFallback(t *testing.T) {
+
+	type TestCase struct {
+		Spec     string
+		Expected string
+		Replaced bool
+	}
+
+	tests := []TestCase{
+		{Spec: "term", Expected: FallbackDriver, Replaced: true},
+		{Spec: "TERM:keymap=wordstar", Expected: FallbackDriver, Replaced: true},
+		{Spec: "stty", Expected: FallbackDriver, Replaced: true},
+		{Spec: "file:path=input.txt", Expected: "file:path=input.txt", Replaced: false},
+		{Spec: "tee:driver=file,log=keys.log", Expected: "tee:driver=file,log=keys.log", Replaced: false},
+	}
+
+	for _, test := range tests {
+		got, replaced := Fallback(test.Spec)
+		if got != test.Expected || replaced != test.Replaced {
+			t.Fatalf("%s: got %s/%t, expected %s/%t", test.Spec, got, replaced, test.Expected, test.Replaced)
+		}
+	}
+}
+
+// TestCharset tests the conversion of non-ASCII input.
+func TestCharset(t *testing.T) {
+
+	type TestCase struct {
+		Charset  string
+		Input    string
+		Expected string
+	}
+
+	tests := []TestCase{
+		{Charset: "ascii", Input: "a“é€✓b", Expected: "a\"eEURb"},
+		{Charset: "cp437", Input: "a“é€✓b", Expected: "a\"\x82EURb"},
+		{Charset: "latin1", Input: "a“é€✓b", Expected: "a\"\xe9EURb"},
+		{Charset: "strip", Input: "a“é€✓b", Expected: "ab"},
+		{Charset: "raw", Input: "a“é€✓b", Expected: "a“é€✓b"},
+
+		// A byte which isn't valid UTF-8 is discarded, but not the
+		// character after it.
+		{Charset: "ascii", Input: "\xe9x\xc3", Expected: "x"},
+	}
+
+	for _, test := range tests {
+		ch := NewFromReader(strings.NewReader(test.Input))
+		err := ch.SetCharset(test.Charset)
+		if err != nil {
+			t.Fatalf("failed to set charset %s: %s", test.Charset, err)
+		}
+
+		out := ""
+		for {
+			c, err := ch.BlockForCharacterNoEcho()
+			if err == ErrEOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			out += string([]byte{c})
+		}
+		if out != test.Expected {
+			t.Fatalf("%s: got %q, expected %q", test.Charset, out, test.Expected)
+		}
+
+		if test.Charset != "ascii" && ch.ConvertText(test.Input) != test.Expected {
+			t.Fatalf("%s: converted text was %q", test.Charset, ch.ConvertText(test.Input))
+		}
+	}
+
+	ch := NewFromReader(strings.NewReader(""))
+	if ch.GetCharset() != DefaultCharset {
+		t.Fatalf("unexpected default charset %s", ch.GetCharset())
+	}
+	err := ch.SetCharset("steve")
+	if err == nil || !strings.Contains(err.Error(), "unknown charset") {
+		t.Fatalf("expected an error, got %v", err)
+	}
+
+	// Pasted text is converted too.
+	ch.Paste("naïve\n")
+	text, err := ch.ReadLine(20)
+	if err != nil || text != "naive" {
+		t.Fatalf("unexpected result '%s' %v", text, err)
+	}
+}
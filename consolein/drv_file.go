@@ -0,0 +1,220 @@
+// drv_file creates a console input-driver which reads input from
+// STDIN, without making any attempt to configure the terminal.
+//
+// This is designed for the case where STDIN is a file, or a pipe,
+// rather than an interactive terminal - for example:
+//
+//	echo "DIR" | cpmulator -input file
+//
+// Alternatively input may be read from a named file, via the "path"
+// option:
+//
+//	cpmulator -input file:path=commands.txt
+//
+// A goroutine is launched which reads STDIN, and saves the bytes to a
+// buffer where they can be peeled off on-demand.  Once all input has been
+// consumed every blocking read will return ErrEOF, while polling reports
+// that no input is pending.
+//
+// Our input is a script of lines typed at prompts, rather than keys
+// pressed while a program runs, so a line is only reported as pending
+// once a blocking read has started it, or the guest is waiting for input,
+// as described in waiting.go.  Otherwise programs which poll the console
+// to see whether they should abort, such as DIR and TYPE, would consume
+// the start of the next command.  Similarly the end of our input is only
+// reported to polls once the guest is waiting, so that a program which
+// waits for a key by polling will read ErrEOF, rather than spin forever.
+
+package consolein
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/skx/cpmulator/options"
+)
+
+// FileInput is an input-driver which reads from STDIN, treating it as a
+// plain stream of bytes.
+type FileInput struct {
+
+	// reader is the source of our input.
+	reader io.Reader
+
+	// file is set if we opened a file to read from, rather than
+	// using STDIN, so that we can close it.
+	file *os.File
+
+	// mutex protects our buffer, and EOF-flag.
+	mutex sync.Mutex
+
+	// cond is used to wake readers when input arrives.
+	cond *sync.Cond
+
+	// buffer contains the bytes we've read, but which have not yet been consumed.
+	buffer []byte
+
+	// eof is set when we've reached the end of our input.
+	eof bool
+
+	// inLine is set once a blocking read has returned part of a line,
+	// and cleared when the line ends.
+	inLine bool
+
+	// waiting is set when the guest is waiting for input, and cleared
+	// when it reads some.
+	waiting bool
+
+	// started records whether our reading goroutine has been launched.
+	started bool
+}
+
+// Setup launches our background-reader, if it isn't already running.
+func (fi *FileInput) Setup() {
+	fi.start()
+}
+
+// start launches the goroutine which reads our input.
+//
+// It is called from Setup, and lazily by the reading functions, to
+// ensure the driver works even if Setup is not invoked.
+func (fi *FileInput) start() {
+
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+
+	if fi.started {
+		return
+	}
+	fi.started = true
+
+	if fi.cond == nil {
+		fi.cond = sync.NewCond(&fi.mutex)
+	}
+	if fi.reader == nil {
+		fi.reader = os.Stdin
+	}
+
+	go fi.readInput()
+}
+
+// readInput runs in a goroutine and collects input into a buffer
+// where it will be read from in the future.
+func (fi *FileInput) readInput() {
+
+	reader := bufio.NewReader(fi.reader)
+
+	for {
+		c, err := reader.ReadByte()
+
+		fi.mutex.Lock()
+		if err != nil {
+			fi.eof = true
+		} else {
+			// CP/M expects a carriage-return when the user
+			// presses enter, not a newline.
+			if c == '\n' {
+				c = '\r'
+			}
+			fi.buffer = append(fi.buffer, c)
+		}
+		fi.cond.Broadcast()
+		fi.mutex.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// TearDown closes the file we're reading from, if we opened one.
+func (fi *FileInput) TearDown() {
+	if fi.file != nil {
+		fi.file.Close()
+		fi.file = nil
+	}
+}
+
+// PendingInput returns true if there is pending input from STDIN.
+//
+// Only the remainder of a line which a blocking read has started is
+// reported, unless the guest is waiting for input, as described at the top
+// of this file.  Once all our input has been consumed we return false,
+// unless the guest is waiting, as there is no key to be read.
+func (fi *FileInput) PendingInput() bool {
+
+	fi.start()
+
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+
+	if len(fi.buffer) > 0 && fi.inLine {
+		return true
+	}
+	return fi.waiting && (len(fi.buffer) > 0 || fi.eof)
+}
+
+// Waiting is called when the guest is waiting for input, and offers our
+// next line, or the end of our input, to status polls.
+func (fi *FileInput) Waiting() {
+
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+
+	fi.waiting = true
+}
+
+// BlockForCharacterNoEcho returns the next character from STDIN, blocking until
+// one is available.
+//
+// If there is no more input then ErrEOF is returned.
+func (fi *FileInput) BlockForCharacterNoEcho() (byte, error) {
+
+	fi.start()
+
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+
+	for len(fi.buffer) == 0 && !fi.eof {
+		fi.cond.Wait()
+	}
+
+	if len(fi.buffer) == 0 {
+		return 0x00, ErrEOF
+	}
+
+	c := fi.buffer[0]
+	fi.buffer = fi.buffer[1:]
+	fi.inLine = c != '\r'
+	fi.waiting = false
+	return c, nil
+}
+
+// GetName is part of the module API, and returns the name of this driver.
+func (fi *FileInput) GetName() string {
+	return "file"
+}
+
+// init registers our driver, by name.
+func init() {
+	Register("file", func(opts options.Options) (ConsoleInput, error) {
+		err := opts.Validate("path")
+		if err != nil {
+			return nil, err
+		}
+
+		fi := new(FileInput)
+
+		// Reading from a file, rather than STDIN?
+		if path := opts.Get("path", ""); path != "" {
+			fi.file, err = os.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			fi.reader = fi.file
+		}
+		return fi, nil
+	})
+}
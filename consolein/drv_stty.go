@@ -12,6 +12,7 @@ import (
 	"os"
 	"os/exec"
 
+	"github.com/skx/cpmulator/options"
 	"golang.org/x/sys/unix"
 	"golang.org/x/term"
 )
@@ -152,7 +153,11 @@ func (si *STTYInput) GetName() string {
 
 // init registers our driver, by name.
 func init() {
-	Register("stty", func() ConsoleInput {
-		return new(STTYInput)
+	Register("stty", func(opts options.Options) (ConsoleInput, error) {
+		err := opts.Validate()
+		if err != nil {
+			return nil, err
+		}
+		return new(STTYInput), nil
 	})
 }
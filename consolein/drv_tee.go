@@ -0,0 +1,143 @@
+// drv_tee creates a console input-driver which wraps another driver,
+// recording every byte delivered to the guest into a logfile, with a
+// timestamp.
+//
+// This is designed to help debug input problems, usage looks like:
+//
+//	cpmulator -input tee:driver=term,log=keys.log
+//
+// Here "term" is the driver which is wrapped, and "keys.log" is the
+// file the keystrokes are appended to.  Any other options are passed
+// to the wrapped driver.
+//
+// Input doesn't only come from our driver, it may also be stuffed,
+// pasted, or injected, so the logging is done by ConsoleIn as it returns
+// each byte, via the InputLogger interface.
+
+package consolein
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/skx/cpmulator/options"
+)
+
+// InputLogger is implemented by drivers which record the bytes delivered
+// to the guest, from whichever source they came.
+type InputLogger interface {
+
+	// LogInput is called with each byte delivered to the guest.
+	LogInput(c byte)
+}
+
+// TeeInput is an input-driver which delegates to another driver, logging
+// the bytes which are delivered to the guest.
+type TeeInput struct {
+
+	// driver is the driver we're wrapping.
+	driver ConsoleInput
+
+	// log is the file we write to.
+	log *os.File
+}
+
+// Setup proxies into our wrapped driver.
+func (ti *TeeInput) Setup() {
+	if ti.driver != nil {
+		ti.driver.Setup()
+	}
+}
+
+// TearDown proxies into our wrapped driver, and closes our logfile.
+func (ti *TeeInput) TearDown() {
+	if ti.driver != nil {
+		ti.driver.TearDown()
+	}
+	if ti.log != nil {
+		ti.log.Close()
+		ti.log = nil
+	}
+}
+
+// PendingInput proxies into our wrapped driver.
+func (ti *TeeInput) PendingInput() bool {
+	if ti.driver == nil {
+		return false
+	}
+	return ti.driver.PendingInput()
+}
+
+// Waiting is part of the ScriptedInput interface, and proxies into our
+// wrapped driver, if it cares.
+func (ti *TeeInput) Waiting() {
+	if s, ok := ti.driver.(ScriptedInput); ok {
+		s.Waiting()
+	}
+}
+
+// BlockForCharacterNoEcho proxies into our wrapped driver.
+func (ti *TeeInput) BlockForCharacterNoEcho() (byte, error) {
+
+	if ti.driver == nil {
+		return 0x00, fmt.Errorf("tee driver used without being configured, use tee:driver=NAME,log=PATH")
+	}
+	return ti.driver.BlockForCharacterNoEcho()
+}
+
+// LogInput is part of the InputLogger interface, and logs the given byte,
+// which was delivered to the guest.
+func (ti *TeeInput) LogInput(c byte) {
+
+	if ti.log == nil {
+		return
+	}
+
+	printable := "."
+	if c >= ' ' && c < 0x7F {
+		printable = string(c)
+	}
+	fmt.Fprintf(ti.log, "%s 0x%02X %s\n", time.Now().Format(time.RFC3339Nano), c, printable)
+}
+
+// GetName is part of the module API, and returns the name of this driver.
+func (ti *TeeInput) GetName() string {
+	return "tee"
+}
+
+// init registers our driver, by name.
+func init() {
+	Register("tee", func(opts options.Options) (ConsoleInput, error) {
+
+		name := opts.Get("driver", "")
+		path := opts.Get("log", "")
+		if name == "" || path == "" {
+			return nil, fmt.Errorf("the 'driver' and 'log' options are required")
+		}
+		if name == "tee" {
+			return nil, fmt.Errorf("cannot wrap the tee driver")
+		}
+
+		// Pass all other options to the wrapped driver.
+		wrapped := make(options.Options)
+		for k, v := range opts {
+			if k != "driver" && k != "log" {
+				wrapped[k] = v
+			}
+		}
+
+		driver, err := newDriverWithOptions(name, wrapped)
+		if err != nil {
+			return nil, err
+		}
+
+		log, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			driver.TearDown()
+			return nil, fmt.Errorf("failed to open %s: %s", path, err)
+		}
+
+		return &TeeInput{driver: driver, log: log}, nil
+	})
+}
@@ -5,6 +5,11 @@
 //
 // The portability of this solution is unknown, however this driver
 // _seems_ reasonable and is the default.
+//
+// The "keymap" option may be used to translate the cursor keys, and
+// similar, into the sequences that CP/M programs expect:
+//
+//	cpmulator -input term:keymap=wordstar
 
 package consolein
 
@@ -12,9 +17,12 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/nsf/termbox-go"
+	"github.com/skx/cpmulator/options"
 	"golang.org/x/term"
 )
 
@@ -29,6 +37,49 @@ type TermboxInput struct {
 
 	// keyBuffer builds up keys read "in the background", via termbox
 	keyBuffer []rune
+
+	// keymap contains the translations for special keys, if any.
+	keymap map[termbox.Key]string
+}
+
+// keymaps contains the translations we support for special keys, indexed
+// by the name of the keymap.
+var keymaps = map[string]map[termbox.Key]string{
+
+	// none is the default, and passes keys through unchanged.
+	"none": {},
+
+	// wordstar uses the WordStar "diamond" control keys, which are
+	// understood by many CP/M editors and games.
+	//
+	// Note that ArrowLeft sends Ctrl-S, which pauses any output the
+	// program is writing via the BDOS, until the next key is pressed,
+	// exactly as typing Ctrl-S would, see cpm/cpm_console.go.  Editors
+	// which use these keys disable that, or write their output by other
+	// means.
+	"wordstar": {
+		termbox.KeyArrowUp:    "\x05",     // ^E
+		termbox.KeyArrowDown:  "\x18",     // ^X
+		termbox.KeyArrowLeft:  "\x13",     // ^S
+		termbox.KeyArrowRight: "\x04",     // ^D
+		termbox.KeyPgup:       "\x12",     // ^R
+		termbox.KeyDelete:     "\x07",     // ^G
+		termbox.KeyHome:       "\x11\x13", // ^Q^S
+		termbox.KeyEnd:        "\x11\x04", // ^Q^D
+	},
+
+	// vt100 sends the escape-sequences a VT100 terminal would.
+	"vt100": {
+		termbox.KeyArrowUp:    "\x1b[A",
+		termbox.KeyArrowDown:  "\x1b[B",
+		termbox.KeyArrowRight: "\x1b[C",
+		termbox.KeyArrowLeft:  "\x1b[D",
+		termbox.KeyHome:       "\x1b[H",
+		termbox.KeyEnd:        "\x1b[F",
+		termbox.KeyPgup:       "\x1b[5~",
+		termbox.KeyPgdn:       "\x1b[6~",
+		termbox.KeyDelete:     "\x7f",
+	},
 }
 
 // Setup ensures that the termbox init functions are called, and our
@@ -79,7 +130,13 @@ func (ti *TermboxInput) pollKeyboard(ctx context.Context) {
 		switch ev := termbox.PollEvent(); ev.Type {
 		case termbox.EventKey:
 			if ev.Ch != 0 {
-				ti.keyBuffer = append(ti.keyBuffer, ev.Ch)
+				// Characters are returned as UTF-8, which
+				// is converted by ConsoleIn.
+				for _, b := range []byte(string(ev.Ch)) {
+					ti.keyBuffer = append(ti.keyBuffer, rune(b))
+				}
+			} else if seq, ok := ti.keymap[ev.Key]; ok {
+				ti.keyBuffer = append(ti.keyBuffer, []rune(seq)...)
 			} else {
 				ti.keyBuffer = append(ti.keyBuffer, rune(ev.Key))
 			}
@@ -136,7 +193,34 @@ func (ti *TermboxInput) GetName() string {
 
 // init registers our driver, by name.
 func init() {
-	Register("term", func() ConsoleInput {
-		return new(TermboxInput)
+	Register("term", func(opts options.Options) (ConsoleInput, error) {
+		err := opts.Validate("keymap")
+		if err != nil {
+			return nil, err
+		}
+
+		keymap, err := keymapOption(opts)
+		if err != nil {
+			return nil, err
+		}
+
+		return &TermboxInput{keymap: keymap}, nil
 	})
 }
+
+// keymapOption returns the translations for special keys selected by the
+// "keymap" option, which defaults to "none".
+func keymapOption(opts options.Options) (map[termbox.Key]string, error) {
+
+	name := opts.Get("keymap", "none")
+	keymap, ok := keymaps[name]
+	if !ok {
+		valid := []string{}
+		for k := range keymaps {
+			valid = append(valid, k)
+		}
+		sort.Strings(valid)
+		return nil, fmt.Errorf("unknown keymap '%s', valid keymaps are %s", name, strings.Join(valid, ","))
+	}
+	return keymap, nil
+}
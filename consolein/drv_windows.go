@@ -0,0 +1,248 @@
+//go:build windows
+
+// drv_windows.go contains a console input-driver which uses the native
+// Win32 console API, rather than emulating a Unix terminal.
+//
+// The console is switched out of line-mode, and echoing is disabled,
+// then we read the raw keyboard events the console generates.  Special
+// keys, such as the cursor keys, are identified by their virtual key-code
+// so the "keymap" option may be used to translate them, exactly as with
+// the term driver:
+//
+//	cpmulator -input windows:keymap=wordstar
+//
+// This driver is only available on Windows.
+
+package consolein
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"github.com/nsf/termbox-go"
+	"github.com/skx/cpmulator/options"
+	"golang.org/x/sys/windows"
+)
+
+// The console functions which golang.org/x/sys/windows doesn't wrap.
+var (
+	kernel32                          = windows.NewLazySystemDLL("kernel32.dll")
+	procReadConsoleInputW             = kernel32.NewProc("ReadConsoleInputW")
+	procGetNumberOfConsoleInputEvents = kernel32.NewProc("GetNumberOfConsoleInputEvents")
+)
+
+// keyEvent is the type of an input record which describes a key.
+const keyEvent = 0x0001
+
+// inputRecord is the Win32 INPUT_RECORD structure, with the union it
+// contains expanded as the KEY_EVENT_RECORD, which is the only type of
+// event we care about.
+type inputRecord struct {
+	eventType       uint16
+	_               [2]byte
+	keyDown         int32
+	repeatCount     uint16
+	virtualKeyCode  uint16
+	virtualScanCode uint16
+	unicodeChar     uint16
+	controlKeyState uint32
+}
+
+// virtualKeys maps the virtual key-codes of the special keys we support to
+// the termbox keys which our keymaps are indexed by.
+var virtualKeys = map[uint16]termbox.Key{
+	0x21: termbox.KeyPgup,       // VK_PRIOR
+	0x22: termbox.KeyPgdn,       // VK_NEXT
+	0x23: termbox.KeyEnd,        // VK_END
+	0x24: termbox.KeyHome,       // VK_HOME
+	0x25: termbox.KeyArrowLeft,  // VK_LEFT
+	0x26: termbox.KeyArrowUp,    // VK_UP
+	0x27: termbox.KeyArrowRight, // VK_RIGHT
+	0x28: termbox.KeyArrowDown,  // VK_DOWN
+	0x2E: termbox.KeyDelete,     // VK_DELETE
+}
+
+// WindowsInput is an input-driver which reads keyboard events from the
+// Windows console.
+type WindowsInput struct {
+
+	// handle is the console input handle.
+	handle windows.Handle
+
+	// oldMode holds the mode of the console before we changed it.
+	oldMode uint32
+
+	// console is true if STDIN is a console, and our mode was changed.
+	console bool
+
+	// keyBuffer holds characters which have been read, but not yet
+	// returned.
+	keyBuffer []byte
+
+	// keymap contains the translations for special keys, if any.
+	keymap map[termbox.Key]string
+}
+
+// Setup disables line-mode, echoing, and the processing of Ctrl-C by the
+// console, so that we receive each key as it is pressed.
+//
+// If STDIN isn't a console we leave it alone, and read it byte by byte.
+func (wi *WindowsInput) Setup() {
+
+	wi.handle = windows.Handle(os.Stdin.Fd())
+
+	err := windows.GetConsoleMode(wi.handle, &wi.oldMode)
+	if err != nil {
+		return
+	}
+
+	mode := wi.oldMode &^ (windows.ENABLE_LINE_INPUT |
+		windows.ENABLE_ECHO_INPUT |
+		windows.ENABLE_PROCESSED_INPUT |
+		windows.ENABLE_MOUSE_INPUT |
+		windows.ENABLE_WINDOW_INPUT |
+		windows.ENABLE_VIRTUAL_TERMINAL_INPUT)
+
+	err = windows.SetConsoleMode(wi.handle, mode)
+	if err != nil {
+		return
+	}
+	wi.console = true
+}
+
+// TearDown restores the mode of the console.
+func (wi *WindowsInput) TearDown() {
+	if wi.console {
+		err := windows.SetConsoleMode(wi.handle, wi.oldMode)
+		if err != nil {
+			fmt.Printf("failed to restore console:%s\n", err)
+		}
+		wi.console = false
+	}
+}
+
+// pendingEvents returns the number of events waiting in the console input
+// buffer.
+func (wi *WindowsInput) pendingEvents() (uint32, error) {
+	var count uint32
+	r1, _, err := procGetNumberOfConsoleInputEvents.Call(uintptr(wi.handle), uintptr(unsafe.Pointer(&count)))
+	if r1 == 0 {
+		return 0, err
+	}
+	return count, nil
+}
+
+// readEvents reads the events waiting in the console input buffer, blocking
+// until at least one is available, and appends the characters generated by
+// any key-presses to our buffer.
+func (wi *WindowsInput) readEvents() error {
+
+	records := make([]inputRecord, 16)
+	var count uint32
+
+	r1, _, err := procReadConsoleInputW.Call(uintptr(wi.handle),
+		uintptr(unsafe.Pointer(&records[0])),
+		uintptr(len(records)),
+		uintptr(unsafe.Pointer(&count)))
+	if r1 == 0 {
+		return fmt.Errorf("error reading console input %s", err)
+	}
+
+	for _, rec := range records[:count] {
+
+		// We only care about keys being pressed, not released.
+		if rec.eventType != keyEvent || rec.keyDown == 0 {
+			continue
+		}
+
+		var seq []byte
+		switch {
+		case rec.unicodeChar != 0:
+			// Characters are returned as UTF-8, which is
+			// converted by ConsoleIn.
+			seq = []byte(string(rune(rec.unicodeChar)))
+		case rec.unicodeChar == 0:
+			if key, ok := virtualKeys[rec.virtualKeyCode]; ok {
+				seq = []byte(wi.keymap[key])
+			}
+		}
+
+		for i := 0; i < int(max(rec.repeatCount, 1)); i++ {
+			wi.keyBuffer = append(wi.keyBuffer, seq...)
+		}
+	}
+	return nil
+}
+
+// PendingInput returns true if there is pending input from STDIN.
+func (wi *WindowsInput) PendingInput() bool {
+
+	if len(wi.keyBuffer) > 0 {
+		return true
+	}
+	if !wi.console {
+		return false
+	}
+
+	// Consume any waiting events, which might not be key-presses.
+	for {
+		count, err := wi.pendingEvents()
+		if err != nil || count == 0 {
+			break
+		}
+		if wi.readEvents() != nil {
+			break
+		}
+	}
+	return len(wi.keyBuffer) > 0
+}
+
+// BlockForCharacterNoEcho returns the next character from the console, blocking until
+// one is available.
+//
+// NOTE: This function should not echo keystrokes which are entered.
+func (wi *WindowsInput) BlockForCharacterNoEcho() (byte, error) {
+
+	if !wi.console {
+		b := make([]byte, 1)
+		_, err := os.Stdin.Read(b)
+		if err != nil {
+			return 0x00, fmt.Errorf("error reading a byte from stdin %s", err)
+		}
+		return b[0], nil
+	}
+
+	for len(wi.keyBuffer) == 0 {
+		err := wi.readEvents()
+		if err != nil {
+			return 0x00, err
+		}
+	}
+
+	c := wi.keyBuffer[0]
+	wi.keyBuffer = wi.keyBuffer[1:]
+	return c, nil
+}
+
+// GetName is part of the module API, and returns the name of this driver.
+func (wi *WindowsInput) GetName() string {
+	return "windows"
+}
+
+// init registers our driver, by name.
+func init() {
+	Register("windows", func(opts options.Options) (ConsoleInput, error) {
+		err := opts.Validate("keymap")
+		if err != nil {
+			return nil, err
+		}
+
+		keymap, err := keymapOption(opts)
+		if err != nil {
+			return nil, err
+		}
+
+		return &WindowsInput{keymap: keymap}, nil
+	})
+}
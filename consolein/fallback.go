@@ -0,0 +1,46 @@
+// fallback.go contains the detection of STDIN which isn't a terminal, as
+// happens when we're run under CI, or driven by another program via a
+// pipe.
+//
+// Our term and stty drivers configure the terminal, which fails, or
+// misbehaves, when there isn't one.  Callers may use Fallback to replace
+// them with the file driver, which reads STDIN as a plain stream of bytes.
+
+package consolein
+
+import (
+	"os"
+
+	"github.com/skx/cpmulator/options"
+	"golang.org/x/term"
+)
+
+// FallbackDriver is the name of the driver which replaces those which
+// need a terminal, when STDIN isn't one.
+const FallbackDriver = "file"
+
+// terminalDrivers holds the names of the drivers which require STDIN to
+// be a terminal.
+var terminalDrivers = map[string]bool{
+	"stty": true,
+	"term": true,
+}
+
+// IsTerminal returns true if STDIN is a terminal.
+func IsTerminal() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// Fallback returns the driver which should be used in place of the given
+// one, which may include options, if STDIN is not a terminal.
+//
+// If the driver needs a terminal FallbackDriver is returned, along with
+// true, otherwise the driver is returned unchanged.
+func Fallback(spec string) (string, bool) {
+
+	name, _, err := options.Split(spec)
+	if err != nil || !terminalDrivers[name] {
+		return spec, false
+	}
+	return FallbackDriver, true
+}
@@ -0,0 +1,82 @@
+package consolein
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// RunSystemCommand executes the given command on the host, writing any
+// output, or error, to the given writer.
+//
+// "cd" is handled specially, changing our own working directory, and
+// commands containing redirection or pipes are executed via the shell.
+//
+// This is used by ReadLine, when the system-command prefix is entered, and
+// by the emulator monitor, so that host commands may be executed even
+// when the guest isn't reading a line of input.
+func RunSystemCommand(text string, out io.Writer) {
+
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return
+	}
+
+	// cd is a special command.
+	if strings.HasPrefix(text, "cd ") {
+		bits := strings.Split(text, " ")
+		if len(bits) >= 2 {
+			dir := bits[1]
+			err := os.Chdir(dir)
+			if err != nil {
+				fmt.Fprintf(out, "Error changing to directory %s: %s\n", dir, err)
+			}
+		}
+		return
+	}
+
+	// Split the command, naively.
+	var bits []string
+	bits = strings.Split(text, " ")
+
+	// Of course we might be using the shell.
+	useShell := false
+	if strings.Contains(text, ">") || strings.Contains(text, "&") || strings.Contains(text, "|") || strings.Contains(text, "<") {
+		useShell = true
+	}
+
+	// If we are we wrap the command.
+	if useShell {
+		bits = []string{"bash", "-c", text}
+	}
+
+	// Prepare to run the command, capturing STDOUT & STDERR
+	cmd := exec.Command(bits[0], bits[1:]...)
+	var execOut bytes.Buffer
+	var execErr bytes.Buffer
+	cmd.Stdout = &execOut
+	cmd.Stderr = &execErr
+
+	// Actually run the command
+	err := cmd.Run()
+	if err != nil {
+		fmt.Fprintf(out, "error running command '%s' %s%s\n", text, err.Error(), execErr.Bytes())
+		return
+	}
+
+	fmt.Fprintf(out, "%s%s", execOut.String(), execErr.String())
+}
+
+// stdoutWriter is the default destination for the output of system
+// commands, it writes to STDOUT adding the carriage-returns which a
+// terminal in raw mode requires.
+type stdoutWriter struct{}
+
+// Write implements io.Writer.
+func (stdoutWriter) Write(p []byte) (int, error) {
+	_, err := os.Stdout.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n")))
+	return len(p), err
+}
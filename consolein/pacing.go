@@ -0,0 +1,149 @@
+// pacing.go contains the optional pacing of stuffed input, which is used
+// for the AUTOEXEC.SUB integration, and by our monitor.
+//
+// By default stuffed input is delivered as quickly as the guest reads it,
+// which can confuse programs that poll the console status and read their
+// own input, such as interactive installers.  Pacing may be configured via
+// a specification such as:
+//
+//	4          At most four characters each tick, of 10ms.
+//	4/50ms     At most four characters every 50ms.
+//	read       Once a line has been delivered the next is hidden from
+//	           status polls until the guest makes a blocking read.
+//	4,read     Both of the above.
+//
+// The empty string disables pacing.
+
+package consolein
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultStuffTick is the period over which a number of characters of
+// stuffed input may be delivered, if no period is given.
+const DefaultStuffTick = 10 * time.Millisecond
+
+// StuffPacing describes how stuffed input is paced.
+type StuffPacing struct {
+	// Chars is the number of characters which may be read each Tick.
+	// Zero means there is no limit.
+	Chars int
+
+	// Tick is the period over which Chars characters may be read.
+	Tick time.Duration
+
+	// WaitForRead is true if each line is hidden from status polls
+	// until the guest has made a blocking read.
+	WaitForRead bool
+}
+
+// ParseStuffPacing parses a pacing specification, as described at the top
+// of this file.
+func ParseStuffPacing(spec string) (StuffPacing, error) {
+
+	pacing := StuffPacing{}
+
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		if strings.EqualFold(field, "read") {
+			pacing.WaitForRead = true
+			continue
+		}
+
+		count, tick, found := strings.Cut(field, "/")
+		chars, err := strconv.Atoi(count)
+		if err != nil || chars < 1 {
+			return StuffPacing{}, fmt.Errorf("invalid character count '%s' in pacing '%s'", count, spec)
+		}
+		pacing.Chars = chars
+		pacing.Tick = DefaultStuffTick
+
+		if found {
+			pacing.Tick, err = time.ParseDuration(tick)
+			if err != nil || pacing.Tick <= 0 {
+				return StuffPacing{}, fmt.Errorf("invalid period '%s' in pacing '%s'", tick, spec)
+			}
+		}
+	}
+
+	return pacing, nil
+}
+
+// String returns the specification of the pacing, in the format accepted
+// by ParseStuffPacing.
+func (sp StuffPacing) String() string {
+	fields := []string{}
+	if sp.Chars > 0 {
+		fields = append(fields, fmt.Sprintf("%d/%s", sp.Chars, sp.Tick))
+	}
+	if sp.WaitForRead {
+		fields = append(fields, "read")
+	}
+	return strings.Join(fields, ",")
+}
+
+// SetStuffPacing configures the pacing of stuffed input.
+func (co *ConsoleIn) SetStuffPacing(pacing StuffPacing) {
+	co.stuffPacing = pacing
+	co.stuffBudget = 0
+	co.stuffTick = time.Time{}
+	co.stuffHeld = false
+}
+
+// GetStuffPacing returns the pacing of stuffed input.
+func (co *ConsoleIn) GetStuffPacing() StuffPacing {
+	return co.stuffPacing
+}
+
+// stuffedReady returns true if a character of stuffed input may be read
+// now.  If there is stuffed input which isn't yet ready the time to wait
+// for it is returned instead, which is zero if we're waiting for a
+// blocking read.
+//
+// poll is true if the caller is checking the console status, rather than
+// reading from it.
+func (co *ConsoleIn) stuffedReady(poll bool) (bool, time.Duration) {
+
+	if len(stuffed) == 0 {
+		return false, 0
+	}
+
+	if poll && co.stuffHeld {
+		return false, 0
+	}
+
+	if co.stuffPacing.Chars > 0 {
+		now := time.Now()
+		if now.Sub(co.stuffTick) >= co.stuffPacing.Tick {
+			co.stuffTick = now
+			co.stuffBudget = co.stuffPacing.Chars
+		}
+		if co.stuffBudget <= 0 {
+			return false, co.stuffPacing.Tick - now.Sub(co.stuffTick)
+		}
+	}
+
+	return true, 0
+}
+
+// takeStuffed returns the next character of stuffed input, which the
+// caller must have confirmed is ready via stuffedReady.
+func (co *ConsoleIn) takeStuffed() byte {
+
+	c := stuffed[0]
+	stuffed = stuffed[1:]
+
+	co.stuffBudget--
+	if co.stuffPacing.WaitForRead && (c == '\r' || c == '\n') {
+		co.stuffHeld = true
+	}
+	return c
+}
@@ -0,0 +1,131 @@
+// paste.go contains our paste queue, which allows a large amount of text,
+// such as the contents of a host file, to be delivered to the guest as if
+// it had been typed.
+//
+// Unlike stuffed input pasted text is paced, after each line we wait a
+// short time before releasing the next, so that programs which poll the
+// console have a chance to process each line before the next arrives.
+// Lines which are too long for the buffer passed to ReadLine are
+// truncated, rather than being split across several reads.
+
+package consolein
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// DefaultPasteDelay is the time we wait, after each line of pasted text
+// has been read, before releasing the next.
+const DefaultPasteDelay = 20 * time.Millisecond
+
+// Paste queues the given text to be read, a line at a time, after any
+// stuffed input.  Newlines are converted to carriage-returns, as CP/M
+// expects, and non-ASCII characters according to our character set.
+//
+// This function DOES NOT proxy to our registered console-input driver.
+func (co *ConsoleIn) Paste(text string) {
+
+	text = strings.ReplaceAll(text, "\r\n", "\r")
+	text = strings.ReplaceAll(text, "\n", "\r")
+	text = co.ConvertText(text)
+
+	co.injectMutex.Lock()
+	co.pasted = append(co.pasted, text...)
+	co.injectMutex.Unlock()
+}
+
+// SetPasteDelay sets the time we wait, after each line of pasted text has
+// been read, before releasing the next.
+func (co *ConsoleIn) SetPasteDelay(delay time.Duration) {
+	co.pasteDelay = delay
+	co.pasteDelaySet = true
+}
+
+// GetPasteDelay returns the time we wait between pasted lines.
+func (co *ConsoleIn) GetPasteDelay() time.Duration {
+	if !co.pasteDelaySet {
+		return DefaultPasteDelay
+	}
+	return co.pasteDelay
+}
+
+// PastePending returns the number of characters of pasted text which
+// have not yet been read.
+func (co *ConsoleIn) PastePending() int {
+	co.injectMutex.Lock()
+	defer co.injectMutex.Unlock()
+	return len(co.pasted)
+}
+
+// takePasted returns the next character of pasted text, if there is one
+// which may be read now.  If there is pasted text which isn't yet ready
+// the time to wait for it is returned instead.
+func (co *ConsoleIn) takePasted() (byte, bool, time.Duration) {
+	co.injectMutex.Lock()
+	defer co.injectMutex.Unlock()
+
+	if len(co.pasted) == 0 {
+		return 0x00, false, 0
+	}
+
+	wait := time.Until(co.pasteNext)
+	if wait > 0 {
+		return 0x00, false, wait
+	}
+
+	c := co.pasted[0]
+	co.pasted = co.pasted[1:]
+	if c == '\r' {
+		co.pasteNext = time.Now().Add(co.GetPasteDelay())
+	}
+	return c, true, 0
+}
+
+// pasteWaiting returns true if there is pasted text, which isn't yet
+// ready to be read.
+func (co *ConsoleIn) pasteWaiting() (ready bool, waiting bool) {
+	co.injectMutex.Lock()
+	defer co.injectMutex.Unlock()
+
+	if len(co.pasted) == 0 {
+		return false, false
+	}
+	if time.Now().Before(co.pasteNext) {
+		return false, true
+	}
+	return true, false
+}
+
+// discardPastedLine is called by ReadLine when the buffer it is filling
+// is full.  If the line being read came from pasted text the remainder of
+// it is discarded, so that it isn't returned as the next line.
+func (co *ConsoleIn) discardPastedLine() {
+
+	if !co.lastPasted {
+		return
+	}
+
+	co.injectMutex.Lock()
+	defer co.injectMutex.Unlock()
+
+	// Discard up to, and including, the end of the line.
+	end := strings.IndexByte(string(co.pasted), '\r')
+	if end < 0 {
+		end = len(co.pasted)
+	}
+
+	// A line which exactly fills the buffer only loses its
+	// carriage-return, which isn't worth a warning.
+	if end > 0 {
+		slog.Warn("pasted line too long for the input buffer, truncating",
+			slog.Int("discarded", end))
+	}
+
+	if end < len(co.pasted) {
+		end++
+	}
+	co.pasted = co.pasted[end:]
+	co.pasteNext = time.Now().Add(co.GetPasteDelay())
+}
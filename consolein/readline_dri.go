@@ -0,0 +1,140 @@
+// readline_dri.go contains the legacy line-editor, which implements the
+// editing keys documented for BDOS function 10 (C_READSTRING) in the
+// Digital Research CP/M 2.2 manual.
+//
+// Our default line-editor uses modern conventions, and supports history,
+// but some software, such as the prompts of WordStar or INPUT in MBASIC,
+// expects the original behaviour:
+//
+//	Ctrl-E     Physical end of line, the cursor moves to the next line
+//	           but the line isn't terminated.
+//	Ctrl-H     Backspace, the previous character is removed and erased.
+//	Rubout     The previous character is removed, and echoed again.
+//	Ctrl-R     Retype the current line, after printing "#".
+//	Ctrl-U     Discard the current line, after printing "#".
+//	Ctrl-X     Erase the current line, backspacing to its start.
+//
+// Other control characters are stored in the buffer, and echoed as "^X".
+
+package consolein
+
+import (
+	"fmt"
+)
+
+// SetLegacyEditing enables, or disables, the legacy line-editor in our
+// ReadLine function.
+func (co *ConsoleIn) SetLegacyEditing(enabled bool) {
+	co.legacyEditing = enabled
+}
+
+// GetLegacyEditing returns true if the legacy line-editor is in use.
+func (co *ConsoleIn) GetLegacyEditing() bool {
+	return co.legacyEditing
+}
+
+// echoForm returns the text we echo for the given character, which is
+// "^X" for control characters.
+func echoForm(c byte) string {
+	if c < 0x20 && c != '\t' {
+		return "^" + string(rune(c+0x40))
+	}
+	return string(rune(c))
+}
+
+// readLineDRI reads a line of text, using the legacy editing keys.
+func (co *ConsoleIn) readLineDRI(max uint8) (string, error) {
+
+	// Text the user entered
+	text := []byte{}
+
+	// count of consecutive Ctrl-C
+	ctrlCount := 0
+
+	// Like CP/M we stop as soon as the buffer is full.
+	for len(text) < int(max) {
+
+		x, err := co.BlockForCharacterNoEcho()
+		if err != nil {
+
+			// If our input ended part-way through a line
+			// then return what we have, the next read will
+			// receive the error.
+			if err == ErrEOF && len(text) > 0 {
+				break
+			}
+			return "", err
+		}
+
+		// Ctrl-C only reboots at the start of the line, elsewhere
+		// it is stored like any other control character, as it is
+		// when being passed through to the guest.
+		if x == 0x03 && len(text) == 0 && interruptCount != InterruptPassThrough {
+			ctrlCount += 1
+			if ctrlCount == interruptCount {
+				return "", ErrInterrupted
+			}
+			continue
+		}
+		ctrlCount = 0
+
+		switch x {
+		case '\r', '\n':
+			return string(text), nil
+
+		case 0x05:
+			// Ctrl-E
+			fmt.Printf("\r\n")
+
+		case 0x08:
+			// Ctrl-H
+			if len(text) > 0 {
+				for range echoForm(text[len(text)-1]) {
+					fmt.Printf("\b \b")
+				}
+				text = text[:len(text)-1]
+			}
+
+		case 0x7F:
+			// Rubout
+			if len(text) > 0 {
+				fmt.Printf("%s", echoForm(text[len(text)-1]))
+				text = text[:len(text)-1]
+			}
+
+		case 0x10:
+			// Ctrl-P toggles the printer echo, which we don't
+			// support.
+
+		case 0x12:
+			// Ctrl-R
+			fmt.Printf("#\r\n")
+			for _, c := range text {
+				fmt.Printf("%s", echoForm(c))
+			}
+
+		case 0x15:
+			// Ctrl-U
+			fmt.Printf("#\r\n")
+			text = text[:0]
+
+		case 0x18:
+			// Ctrl-X
+			for len(text) > 0 {
+				for range echoForm(text[len(text)-1]) {
+					fmt.Printf("\b \b")
+				}
+				text = text[:len(text)-1]
+			}
+
+		default:
+			fmt.Printf("%s", echoForm(x))
+			text = append(text, x)
+		}
+	}
+
+	// The buffer is full, so the rest of a pasted line is discarded.
+	co.discardPastedLine()
+
+	return string(text), nil
+}
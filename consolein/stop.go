@@ -0,0 +1,94 @@
+// stop.go allows reads of console input to be abandoned when the emulator
+// is asked to stop, such as when it receives a signal, so that it may
+// finish in an orderly fashion rather than waiting for a key.
+//
+// Our drivers block until a key is pressed, and can't be interrupted, so
+// once SetStop has been given a channel our blocking reads are made upon
+// another goroutine, and abandoned if the channel is closed first.  Those
+// reads return ErrKilled, as if the kill key had been pressed, as do any
+// made after the channel is closed.
+//
+// An abandoned read isn't lost, the next read returns its result, so that
+// our driver is never read by two goroutines at once.
+
+package consolein
+
+// driverRead is the result of reading a character from our driver.
+type driverRead struct {
+	c   byte
+	err error
+}
+
+// SetStop configures a channel which, once closed, causes blocking reads
+// to return ErrKilled, as described at the top of this file.  Passing nil
+// removes any existing channel.
+func (co *ConsoleIn) SetStop(stop <-chan struct{}) {
+	co.stop = stop
+}
+
+// stopped returns true if our stop channel has been closed.
+func (co *ConsoleIn) stopped() bool {
+	select {
+	case <-co.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// driverPending returns true if a character may be read from our driver,
+// via readDriverRaw, without blocking.
+func (co *ConsoleIn) driverPending() bool {
+
+	if co.ready != nil {
+		return true
+	}
+	if co.reading == nil {
+		return co.driver.PendingInput()
+	}
+
+	select {
+	case r := <-co.reading:
+		co.reading = nil
+		co.ready = &r
+		return true
+	default:
+		return false
+	}
+}
+
+// readDriverRaw reads a character from our driver, blocking until one is
+// available, or our stop channel is closed.
+func (co *ConsoleIn) readDriverRaw() (byte, error) {
+
+	if co.ready != nil {
+		r := co.ready
+		co.ready = nil
+		return r.c, r.err
+	}
+
+	if co.reading == nil {
+		if co.stop == nil {
+			return co.driver.BlockForCharacterNoEcho()
+		}
+		if co.stopped() {
+			return 0x00, ErrKilled
+		}
+
+		reading := make(chan driverRead, 1)
+		driver := co.driver
+		go func() {
+			c, err := driver.BlockForCharacterNoEcho()
+			reading <- driverRead{c: c, err: err}
+		}()
+		co.reading = reading
+	}
+
+	select {
+	case r := <-co.reading:
+		co.reading = nil
+		return r.c, r.err
+	case <-co.stop:
+		return 0x00, ErrKilled
+	}
+}
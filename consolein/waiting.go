@@ -0,0 +1,56 @@
+// waiting.go contains the detection of a guest which is waiting for input,
+// for the benefit of drivers whose input is a script of lines typed at
+// prompts, such as our file driver.
+//
+// Many programs poll the console status while they work, to see whether
+// the user wants to abort them, and a scripted line must not be offered to
+// them, or it would be consumed as a keypress.  Other programs wait for a
+// key by polling, rather than reading, so a scripted line must eventually
+// be offered to them, or they'd wait forever.
+//
+// We tell the two apart by counting the polls which found no input.  A
+// program which is working produces output between its polls, so once
+// WaitingPolls polls have been made without any output, or the guest makes
+// a blocking read, the driver is told that the guest is waiting.
+
+package consolein
+
+// WaitingPolls is the number of polls which must find no input, without
+// any output in between, before the guest is considered to be waiting
+// for input.
+const WaitingPolls = 64
+
+// ScriptedInput is implemented by drivers which hide their input from
+// status polls until the guest is waiting for it.
+type ScriptedInput interface {
+
+	// Waiting is called when the guest is waiting for input, so that
+	// the next line may be offered to status polls.
+	Waiting()
+}
+
+// NoteOutput is called when the guest writes to the console, which means
+// it is still working, rather than waiting for input.
+func (co *ConsoleIn) NoteOutput() {
+	co.quietPolls = 0
+}
+
+// notePoll is called when a status poll found no input, and tells our
+// driver the guest is waiting once it has polled enough times without
+// producing output.
+func (co *ConsoleIn) notePoll() {
+
+	co.quietPolls++
+	if co.quietPolls >= WaitingPolls {
+		co.quietPolls = 0
+		co.waiting()
+	}
+}
+
+// waiting tells our driver the guest is waiting for input, if it cares.
+func (co *ConsoleIn) waiting() {
+
+	if s, ok := co.driver.(ScriptedInput); ok {
+		s.Waiting()
+	}
+}
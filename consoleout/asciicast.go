@@ -0,0 +1,161 @@
+// asciicast.go contains our encoder for asciinema (v2) recordings, which
+// is shared by the asciinema output driver, and the session transcripts
+// of the emulator.
+//
+// A recording is a header, which is a JSON object describing the screen,
+// followed by one event per line, each being a JSON array of the time
+// since the recording started, the type of the event, and its data.  We
+// write "o" events for output, and callers may write others, such as "i"
+// for input, or "m" for markers.
+//
+// Output which is written close together is combined into a single event,
+// and the header is only written alongside the first event, or when the
+// recording is flushed, so that the size of the screen may be changed
+// until then.
+//
+// An AsciinemaWriter isn't safe for concurrent use, its callers are
+// expected to serialize access to it.
+
+package consoleout
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// AsciinemaGap is the longest gap between writes of output which are
+// recorded as a single event.
+const AsciinemaGap = 10 * time.Millisecond
+
+// AsciinemaWriter writes an asciinema (v2) recording.
+type AsciinemaWriter struct {
+
+	// w is where the recording is written.
+	w io.Writer
+
+	// title is the title of the recording, and start the time at which
+	// it started.
+	title string
+	start time.Time
+
+	// width and height hold the size of the screen, for our header.
+	width  int
+	height int
+
+	// idle is the longest pause, in seconds, when the recording is
+	// replayed, zero meaning there is no limit.
+	idle float64
+
+	// headerSent is true once we've written our header.
+	headerSent bool
+
+	// pending holds the output which has not yet been recorded, and
+	// since the time it was written.
+	pending []byte
+	since   time.Time
+}
+
+// NewAsciinemaWriter returns a recording, with the given title, which
+// starts now and is written to the given writer.
+//
+// The screen is assumed to be of our default size, unless SetScreenSize is
+// called before the header is written.
+func NewAsciinemaWriter(w io.Writer, title string) *AsciinemaWriter {
+	return &AsciinemaWriter{
+		w:      w,
+		title:  title,
+		start:  time.Now(),
+		width:  DefaultScreenWidth,
+		height: DefaultScreenHeight,
+	}
+}
+
+// SetScreenSize sets the size of the screen, recorded in our header.
+func (aw *AsciinemaWriter) SetScreenSize(width int, height int) {
+	aw.width = width
+	aw.height = height
+}
+
+// SetIdleLimit sets the longest pause, in seconds, when the recording is
+// replayed, zero meaning there is no limit.
+func (aw *AsciinemaWriter) SetIdleLimit(idle float64) {
+	aw.idle = idle
+}
+
+// Output records the given output, which is combined with any output
+// written shortly before it.
+func (aw *AsciinemaWriter) Output(p []byte) {
+
+	now := time.Now()
+	if len(aw.pending) > 0 && now.Sub(aw.since) > AsciinemaGap {
+		aw.flushOutput()
+	}
+	if len(aw.pending) == 0 {
+		aw.since = now
+	}
+	aw.pending = append(aw.pending, p...)
+}
+
+// Event records an event of the given type, after any pending output.
+func (aw *AsciinemaWriter) Event(kind string, data string) {
+	aw.flushOutput()
+	aw.event(time.Now(), kind, data)
+}
+
+// Flush records any pending output, and ensures our header has been
+// written, which should be done before the recording is closed.
+func (aw *AsciinemaWriter) Flush() {
+	aw.flushOutput()
+	aw.header()
+}
+
+// flushOutput records our pending output as an event.
+func (aw *AsciinemaWriter) flushOutput() {
+
+	if len(aw.pending) == 0 {
+		return
+	}
+	aw.event(aw.since, "o", string(aw.pending))
+	aw.pending = aw.pending[:0]
+}
+
+// header writes our header, if we've not already done so.
+func (aw *AsciinemaWriter) header() {
+
+	if aw.headerSent {
+		return
+	}
+	aw.headerSent = true
+
+	header := map[string]any{
+		"version":   2,
+		"width":     aw.width,
+		"height":    aw.height,
+		"timestamp": aw.start.Unix(),
+		"title":     aw.title,
+	}
+	if aw.idle > 0 {
+		header["idle_time_limit"] = aw.idle
+	}
+	aw.encode(header)
+}
+
+// event writes an event which happened at the given time, after our
+// header.
+func (aw *AsciinemaWriter) event(when time.Time, kind string, data string) {
+	aw.header()
+	aw.encode([]any{
+		json.Number(fmt.Sprintf("%.6f", when.Sub(aw.start).Seconds())),
+		kind,
+		data,
+	})
+}
+
+// encode writes the given value, as a line of JSON.
+func (aw *AsciinemaWriter) encode(v any) {
+	enc := json.NewEncoder(aw.w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
@@ -0,0 +1,137 @@
+// buffered.go contains the optional buffering of our console output.
+//
+// Our terminal drivers write each character as it is output, which means
+// one write, and often one system call, per character.  Over a slow
+// terminal, or a remote connection, that makes large amounts of output,
+// such as TYPE-ing a big file, painfully slow.
+//
+// When buffering is enabled output is collected, and written when:
+//
+//   - The buffer is full.
+//   - A short delay has passed since the first unwritten character.
+//   - Flush is called, which our caller does before reading input, so
+//     that prompts are always visible.
+
+package consoleout
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultBufferDelay is the longest time output is held in our buffer,
+// before it is written, when buffering is enabled.
+const DefaultBufferDelay = 10 * time.Millisecond
+
+// WriterDriver is implemented by drivers which can report the writer to
+// which they send their output, which allows it to be buffered.
+type WriterDriver interface {
+
+	// GetWriter returns the writer output is sent to.
+	GetWriter() io.Writer
+}
+
+// bufferedWriter collects output, and writes it to another writer when
+// it is full, after a delay, or when it is flushed.
+type bufferedWriter struct {
+
+	// mutex protects our state, as our timer runs in a goroutine.
+	mutex sync.Mutex
+
+	// out is the buffer, which wraps the real writer.
+	out *bufio.Writer
+
+	// dest is the real writer.
+	dest io.Writer
+
+	// delay is the time after which buffered output is written.
+	delay time.Duration
+
+	// timer is running if we hold output which hasn't been written.
+	timer *time.Timer
+}
+
+// Write adds the given data to our buffer, starting our timer if it isn't
+// already running.
+func (bw *bufferedWriter) Write(p []byte) (int, error) {
+	bw.mutex.Lock()
+	defer bw.mutex.Unlock()
+
+	n, err := bw.out.Write(p)
+	if bw.timer == nil && bw.out.Buffered() > 0 {
+		bw.timer = time.AfterFunc(bw.delay, bw.Flush)
+	}
+	return n, err
+}
+
+// Flush writes any buffered output.
+func (bw *bufferedWriter) Flush() {
+	bw.mutex.Lock()
+	defer bw.mutex.Unlock()
+
+	if bw.timer != nil {
+		bw.timer.Stop()
+		bw.timer = nil
+	}
+	bw.out.Flush()
+}
+
+// SetBufferDelay enables the buffering of our output, if our driver
+// supports it, holding output for no longer than the given delay.
+//
+// A delay of zero disables buffering, which is the default.
+func (co *ConsoleOut) SetBufferDelay(delay time.Duration) {
+	co.unbuffer()
+	co.bufferDelay = delay
+	co.buffer()
+}
+
+// GetBufferDelay returns the longest time output is held in our buffer,
+// zero means output isn't buffered.
+func (co *ConsoleOut) GetBufferDelay() time.Duration {
+	return co.bufferDelay
+}
+
+// Flush writes any output which is held in our buffer.
+func (co *ConsoleOut) Flush() {
+	if co.buffered != nil {
+		co.buffered.Flush()
+	}
+}
+
+// buffer wraps the writer of our driver with a buffer, if buffering has
+// been enabled, and the driver supports it.
+func (co *ConsoleOut) buffer() {
+
+	if co.bufferDelay <= 0 {
+		return
+	}
+
+	wd, ok := co.driver.(WriterDriver)
+	if !ok {
+		return
+	}
+
+	dest := wd.GetWriter()
+	co.buffered = &bufferedWriter{
+		out:   bufio.NewWriterSize(dest, 4096),
+		dest:  dest,
+		delay: co.bufferDelay,
+	}
+	co.driver.SetWriter(co.buffered)
+}
+
+// unbuffer writes any buffered output, and restores the original writer
+// of our driver.
+func (co *ConsoleOut) unbuffer() {
+
+	if co.buffered == nil {
+		return
+	}
+
+	co.buffered.Flush()
+	co.driver.SetWriter(co.buffered.dest)
+	co.buffered = nil
+}
@@ -0,0 +1,106 @@
+package consoleout
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/skx/cpmulator/options"
+)
+
+// cp437 contains the Unicode glyphs for the characters 0x80-0xFF of the
+// IBM PC character set, code page 437, which includes the box-drawing
+// characters used by many programs.
+var cp437 = []rune("" +
+	"ÇüéâäàåçêëèïîìÄÅ" +
+	"ÉæÆôöòûùÿÖÜ¢£¥₧ƒ" +
+	"áíóúñÑªº¿⌐¬½¼¡«»" +
+	"░▒▓│┤╡╢╖╕╣║╗╝╜╛┐" +
+	"└┴┬├─┼╞╟╚╔╩╦╠═╬╧" +
+	"╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀" +
+	"αßΓπΣσµτΦΘΩδ∞φε∩" +
+	"≡±≥≤⌠⌡÷≈°∙·√ⁿ²■ ")
+
+// charsets maps the names of the character sets we support to the table
+// of glyphs for the characters 0x80-0xFF.
+//
+// "latin1" has no table, since the characters map directly to Unicode,
+// and "raw" has no table since we output the bytes unchanged.
+var charsets = map[string][]rune{
+	"cp437":  cp437,
+	"latin1": nil,
+	"raw":    nil,
+}
+
+// CharsetDriver is an interface which is implemented by output drivers
+// which can translate 8-bit characters to their Unicode equivalents.
+type CharsetDriver interface {
+
+	// SetCharset changes the character set in use.
+	SetCharset(name string) error
+
+	// GetCharset returns the name of the character set in use.
+	GetCharset() string
+}
+
+// charset holds the state of our translation, and is embedded in the
+// drivers which support it.
+type charset struct {
+
+	// name is the name of the character set.
+	name string
+
+	// table contains the glyphs for the characters 0x80-0xFF, if any.
+	table []rune
+}
+
+// SetCharset changes the character set in use.
+func (cs *charset) SetCharset(name string) error {
+
+	name = strings.ToLower(name)
+
+	table, ok := charsets[name]
+	if !ok {
+		valid := []string{}
+		for k := range charsets {
+			valid = append(valid, k)
+		}
+		sort.Strings(valid)
+		return fmt.Errorf("unknown charset '%s', valid charsets are %s", name, strings.Join(valid, ","))
+	}
+
+	cs.name = name
+	cs.table = table
+	return nil
+}
+
+// GetCharset returns the name of the character set in use.
+func (cs *charset) GetCharset() string {
+	if cs.name == "" {
+		return "latin1"
+	}
+	return cs.name
+}
+
+// writeChar writes the given character to the writer, translating it
+// according to our character set.
+func (cs *charset) writeChar(w io.Writer, c uint8) {
+
+	switch {
+	case c >= 0x80 && cs.table != nil:
+		fmt.Fprintf(w, "%c", cs.table[c-0x80])
+	case c >= 0x80 && cs.name == "raw":
+		w.Write([]byte{c})
+	default:
+		fmt.Fprintf(w, "%c", c)
+	}
+}
+
+// charsetOption returns a charset configured by the "charset" option, if
+// one was present, defaulting to "latin1".
+func charsetOption(opts options.Options) (charset, error) {
+	var cs charset
+	err := cs.SetCharset(opts.Get("charset", "latin1"))
+	return cs, err
+}
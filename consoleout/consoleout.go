@@ -8,7 +8,11 @@ package consoleout
 import (
 	"fmt"
 	"io"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/skx/cpmulator/options"
 )
 
 // ConsoleOutput is the interface that must be implemented by anything
@@ -36,7 +40,8 @@ type ConsoleOutput interface {
 // ConsoleRecorder is an interface that allows returning the contents that
 // have been previously sent to the console.
 //
-// This is used solely for integration tests.
+// This is used by integration tests, and by Go programs which embed the
+// emulator, via the "buffer" driver.
 type ConsoleRecorder interface {
 
 	// GetOutput returns the contents which have been displayed.
@@ -46,6 +51,14 @@ type ConsoleRecorder interface {
 	Reset()
 }
 
+// TearDownDriver is implemented by drivers which change the state of the
+// terminal, and must restore it once they're no longer used.
+type TearDownDriver interface {
+
+	// TearDown restores the state of the terminal.
+	TearDown()
+}
+
 // This is a map of known-drivers
 var handlers = struct {
 	m map[string]Constructor
@@ -53,7 +66,78 @@ var handlers = struct {
 
 // Constructor is the signature of a constructor-function
 // which is used to instantiate an instance of a driver.
-type Constructor func() ConsoleOutput
+//
+// The constructor receives any options which were specified for the
+// driver, and should return an error if any of them are invalid.
+type Constructor func(opts options.Options) (ConsoleOutput, error)
+
+// colors maps the names of the colours which may be used with the
+// "color" option to the escape-sequence which selects them.
+var colors = map[string]string{
+	"black":   "\033[30m",
+	"red":     "\033[31m",
+	"green":   "\033[32m",
+	"yellow":  "\033[33m",
+	"amber":   "\033[33m",
+	"blue":    "\033[34m",
+	"magenta": "\033[35m",
+	"cyan":    "\033[36m",
+	"white":   "\033[37m",
+}
+
+// colorOption returns the escape-sequence to select the colour specified
+// in the "color" option, if one was present.
+func colorOption(opts options.Options) (string, error) {
+
+	name := opts.Get("color", "")
+	if name == "" {
+		return "", nil
+	}
+
+	seq, ok := colors[strings.ToLower(name)]
+	if !ok {
+		valid := []string{}
+		for k := range colors {
+			valid = append(valid, k)
+		}
+		sort.Strings(valid)
+		return "", fmt.Errorf("unknown color '%s', valid colors are %s", name, strings.Join(valid, ","))
+	}
+	return seq, nil
+}
+
+// newDriver creates an instance of the driver with the given name,
+// passing any options to it.
+//
+// The name may be followed by a colon, and options, for example
+// "adm-3a:color=green".
+func newDriver(spec string) (ConsoleOutput, error) {
+
+	// Split off any options.
+	name, opts, err := options.Split(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDriverWithOptions(name, opts)
+}
+
+// newDriverWithOptions creates an instance of the driver with the given
+// name, and options.
+func newDriverWithOptions(name string, opts options.Options) (ConsoleOutput, error) {
+
+	// Do we have a constructor with the given name?
+	ctor, ok := handlers.m[name]
+	if !ok {
+		return nil, fmt.Errorf("failed to lookup driver by name '%s'", name)
+	}
+
+	driver, err := ctor(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create driver '%s': %s", name, err)
+	}
+	return driver, nil
+}
 
 // Register makes a console driver available, by name.
 //
@@ -72,23 +156,59 @@ type ConsoleOut struct {
 
 	// driver is the thing that actually writes our output.
 	driver ConsoleOutput
+
+	// spec is the name of our driver, along with any options, as it
+	// was given to New, or ChangeDriver.
+	spec string
+
+	// column contains the column the cursor is in, which is used
+	// for expanding TABs.
+	column int
+
+	// observer, if set, is invoked with each character which is output.
+	observer func(c byte)
+
+	// width and height hold the size of the screen, as given to
+	// SetScreenSize, which is passed to new drivers.
+	width  int
+	height int
+
+	// limit is the rate of output above which output is paused, see
+	// throttle.go.
+	limit OutputLimit
+
+	// limitStart is the start of the current period, and limitCount
+	// the number of characters written within it.
+	limitStart time.Time
+	limitCount int
+
+	// paused is true if output has been paused, and discarded holds
+	// the number of characters discarded since.
+	paused    bool
+	discarded int
+
+	// bufferDelay is the longest time output is held in our buffer,
+	// and buffered is the buffer, if enabled, see buffered.go.
+	bufferDelay time.Duration
+	buffered    *bufferedWriter
 }
 
 // New is our constructore, it creates an output device which uses
 // the specified driver.
+//
+// The name may be followed by a colon, and options, which will be
+// passed to the driver, for example "adm-3a:color=green".
 func New(name string) (*ConsoleOut, error) {
-	// Downcase for consistency.
-	name = strings.ToLower(name)
 
-	// Do we have a constructor with the given name?
-	ctor, ok := handlers.m[name]
-	if !ok {
-		return nil, fmt.Errorf("failed to lookup driver by name '%s'", name)
+	driver, err := newDriver(name)
+	if err != nil {
+		return nil, err
 	}
 
-	// OK we do, return ourselves with that driver.
+	// OK we have a driver, return ourselves with that driver.
 	return &ConsoleOut{
-		driver: ctor(),
+		driver: driver,
+		spec:   name,
 	}, nil
 }
 
@@ -100,30 +220,120 @@ func (co *ConsoleOut) GetDriver() ConsoleOutput {
 // ChangeDriver allows changing our driver at runtime.
 func (co *ConsoleOut) ChangeDriver(name string) error {
 
-	// Do we have a constructor with the given name?
-	ctor, ok := handlers.m[name]
-	if !ok {
-		return fmt.Errorf("failed to lookup driver by name '%s'", name)
+	// change the driver by creating a new object
+	driver, err := newDriver(name)
+	if err != nil {
+		return err
 	}
 
-	// change the driver by creating a new object
-	co.driver = ctor()
+	// The new driver continues from where the old one left the
+	// cursor, upon a screen of the same size.
+	if cd, ok := driver.(CursorDriver); ok {
+		if co.width > 0 && co.height > 0 {
+			cd.SetScreenSize(co.width, co.height)
+		}
+		if row, col, ok := co.GetCursor(); ok {
+			cd.SetCursor(row, col)
+		}
+	}
+
+	// Our buffer moves to the new driver.
+	co.unbuffer()
+	co.tearDown()
+	co.driver = driver
+	co.spec = name
+	co.buffer()
 	return nil
 }
 
+// SwapDriver replaces our driver with the given one, returning the old one
+// which isn't torn down, so that it may be restored by a later call.
+//
+// Unlike ChangeDriver this allows output to be sent elsewhere temporarily,
+// without losing the state of the original driver.
+func (co *ConsoleOut) SwapDriver(driver ConsoleOutput) ConsoleOutput {
+	co.unbuffer()
+	old := co.driver
+	co.driver = driver
+	co.buffer()
+	return old
+}
+
+// TearDown writes any buffered output, and allows our driver to restore the
+// state of the terminal, if it changed it.
+func (co *ConsoleOut) TearDown() {
+	co.Flush()
+	co.tearDown()
+}
+
+// tearDown invokes the TearDown method of our driver, if it has one.
+func (co *ConsoleOut) tearDown() {
+	if td, ok := co.driver.(TearDownDriver); ok {
+		td.TearDown()
+	}
+}
+
+// SetScreenSize sets the size of the screen, which is used by drivers that
+// track the position of the cursor.
+func (co *ConsoleOut) SetScreenSize(width int, height int) {
+	co.width = width
+	co.height = height
+
+	if cd, ok := co.driver.(CursorDriver); ok {
+		cd.SetScreenSize(width, height)
+	}
+}
+
+// GetCursor returns the row, and column, of the cursor, starting from zero,
+// if our selected driver tracks it.
+func (co *ConsoleOut) GetCursor() (int, int, bool) {
+	cd, ok := co.driver.(CursorDriver)
+	if !ok {
+		return 0, 0, false
+	}
+	row, col := cd.GetCursor()
+	return row, col, true
+}
+
+// SetCharset changes the character set used to translate 8-bit characters,
+// if our selected driver supports it.
+func (co *ConsoleOut) SetCharset(name string) error {
+	cs, ok := co.driver.(CharsetDriver)
+	if !ok {
+		return fmt.Errorf("driver %s doesn't support character sets", co.driver.GetName())
+	}
+	return cs.SetCharset(name)
+}
+
+// GetCharset returns the character set used by our selected driver, or
+// the empty string if it doesn't support them.
+func (co *ConsoleOut) GetCharset() string {
+	cs, ok := co.driver.(CharsetDriver)
+	if !ok {
+		return ""
+	}
+	return cs.GetCharset()
+}
+
 // GetName returns the name of our selected driver.
 func (co *ConsoleOut) GetName() string {
 	return co.driver.GetName()
 }
 
+// GetSpec returns the name of our selected driver, along with any options
+// it was given, so that it may be recreated via ChangeDriver.
+func (co *ConsoleOut) GetSpec() string {
+	return co.spec
+}
+
 // GetDrivers returns all available driver-names.
 //
-// We hide the internal "null", and "logger" drivers.
+// We hide the internal "null", "logger", and "buffer" drivers.
 func (co *ConsoleOut) GetDrivers() []string {
 	valid := []string{}
 
 	for x := range handlers.m {
-		if x != "null" && x != "logger" {
+		if x != "null" && x != "logger" && x != "buffer" {
 			valid = append(valid, x)
 		}
 	}
@@ -131,6 +341,66 @@ func (co *ConsoleOut) GetDrivers() []string {
 }
 
 // PutCharacter outputs a character, using our selected driver.
+//
+// We track the column of the cursor as characters are written, in the
+// same way that CP/M does - only printable characters, backspace, and
+// carriage-return are taken into account.
+//
+// If output has been paused, because too much was written too quickly,
+// the character is discarded.
 func (co *ConsoleOut) PutCharacter(c byte) {
+	if co.throttled() {
+		return
+	}
 	co.driver.PutCharacter(c)
+
+	if co.observer != nil {
+		co.observer(c)
+	}
+
+	switch {
+	case c == '\r':
+		co.column = 0
+	case c == '\b':
+		if co.column > 0 {
+			co.column--
+		}
+	case c >= ' ' && c < 0x7F:
+		co.column++
+	}
+}
+
+// WriteCharacter outputs a character, using our selected driver, after
+// expanding TAB characters into spaces, with tab-stops every eight columns.
+//
+// The characters which were actually output are returned.
+func (co *ConsoleOut) WriteCharacter(c byte) []byte {
+
+	if c != '\t' {
+		co.PutCharacter(c)
+		return []byte{c}
+	}
+
+	out := []byte{}
+	for {
+		co.PutCharacter(' ')
+		out = append(out, ' ')
+		if co.column%8 == 0 {
+			break
+		}
+	}
+	return out
+}
+
+// SetObserver sets a function which is invoked with each character which
+// is output, regardless of the driver which is in use.  Passing nil removes
+// any existing observer.
+func (co *ConsoleOut) SetObserver(fn func(c byte)) {
+	co.observer = fn
+}
+
+// GetColumn returns the column the cursor is currently within, starting
+// from zero.
+func (co *ConsoleOut) GetColumn() int {
+	return co.column
 }
@@ -2,7 +2,14 @@ package consoleout
 
 import (
 	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 // TestName ensures we can lookup a driver by name
@@ -40,21 +47,28 @@ func TestChangeDriver(t *testing.T) {
 		t.Fatalf("failed to load starting driver %s", err)
 	}
 
+	if ansi.GetSpec() != "ansi" {
+		t.Fatalf("unexpected spec %s", ansi.GetSpec())
+	}
+
 	// Change to another known-good driver
-	err = ansi.ChangeDriver("adm-3a")
+	err = ansi.ChangeDriver("adm-3a:color=green")
 	if err != nil {
 		t.Fatalf("failed to change to new driver %s", err)
 	}
 	if ansi.GetName() != "adm-3a" {
 		t.Fatalf("driver change didnt work?")
 	}
+	if ansi.GetSpec() != "adm-3a:color=green" {
+		t.Fatalf("unexpected spec %s", ansi.GetSpec())
+	}
 
 	// Change to a bogus driver
 	err = ansi.ChangeDriver("fofdsf-fsdfsd-fsdfdsf-")
 	if err == nil {
 		t.Fatalf("expected failure to change to new driver, didn't happen")
 	}
-	if ansi.GetName() != "adm-3a" {
+	if ansi.GetName() != "adm-3a" || ansi.GetSpec() != "adm-3a:color=green" {
 		t.Fatalf("driver changed unexpectedly")
 	}
 }
@@ -177,7 +191,572 @@ func TestList(t *testing.T) {
 
 	valid := x.GetDrivers()
 
-	if len(valid) != 2 {
+	// The windows driver is only available upon Windows.
+	expected := 4
+	if runtime.GOOS == "windows" {
+		expected++
+	}
+	if len(valid) != expected {
 		t.Fatalf("unexpected number of console drivers")
 	}
 }
+
+// TestBuffer ensures the buffer driver stores our output.
+func TestBuffer(t *testing.T) {
+
+	drv, err := New("buffer")
+	if err != nil {
+		t.Fatalf("failed to load driver %s", err)
+	}
+	if drv.GetName() != "buffer" {
+		t.Fatalf("wrong name %s", drv.GetName())
+	}
+
+	rec, ok := drv.GetDriver().(ConsoleRecorder)
+	if !ok {
+		t.Fatalf("buffer driver isn't a ConsoleRecorder")
+	}
+
+	for _, c := range "Steve\r\n" {
+		drv.PutCharacter(byte(c))
+	}
+	if rec.GetOutput() != "Steve\r\n" {
+		t.Fatalf("wrong output %q", rec.GetOutput())
+	}
+
+	rec.Reset()
+	if rec.GetOutput() != "" {
+		t.Fatalf("reset didn't discard the output")
+	}
+
+	_, err = New("buffer:color=red")
+	if err == nil {
+		t.Fatalf("expected an error with an option")
+	}
+}
+
+// TestFileOutput ensures the file driver writes our output to a file.
+func TestFileOutput(t *testing.T) {
+
+	_, err := New("file")
+	if err == nil {
+		t.Fatalf("expected an error without a path")
+	}
+	_, err = New("file:path=x,timestamps=maybe")
+	if err == nil {
+		t.Fatalf("expected an error with a bogus timestamps option")
+	}
+
+	path := filepath.Join(t.TempDir(), "out.txt")
+	drv, err := New("file:path=" + path)
+	if err != nil {
+		t.Fatalf("failed to load driver %s", err)
+	}
+	if drv.GetName() != "file" {
+		t.Fatalf("wrong name %s", drv.GetName())
+	}
+	for _, c := range "Hello\r\nWorld" {
+		drv.PutCharacter(byte(c))
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "Hello\r\nWorld" {
+		t.Fatalf("wrong output %q %v", data, err)
+	}
+
+	// With timestamps each line is prefixed.
+	drv, err = New("file:timestamps=true,path=" + path)
+	if err != nil {
+		t.Fatalf("failed to load driver %s", err)
+	}
+	for _, c := range "One\r\nTwo\r\n" {
+		drv.PutCharacter(byte(c))
+	}
+
+	data, _ = os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\r\n")
+	if len(lines) != 2 {
+		t.Fatalf("wrong output %q", data)
+	}
+	for i, expected := range []string{"One", "Two"} {
+		stamp, text, ok := strings.Cut(lines[i], " ")
+		if !ok || text != expected || !strings.Contains(stamp, "T") {
+			t.Fatalf("wrong line %q", lines[i])
+		}
+	}
+}
+
+// TestColumnTracking ensures we track the cursor column, and expand TABs.
+func TestColumnTracking(t *testing.T) {
+
+	drv, err := New("logger")
+	if err != nil {
+		t.Fatalf("failed to load driver %s", err)
+	}
+
+	for _, c := range "Steve" {
+		drv.WriteCharacter(byte(c))
+	}
+	if drv.GetColumn() != 5 {
+		t.Fatalf("wrong column %d", drv.GetColumn())
+	}
+
+	// backspace moves us back
+	drv.WriteCharacter('\b')
+	if drv.GetColumn() != 4 {
+		t.Fatalf("wrong column %d", drv.GetColumn())
+	}
+
+	// TAB moves to the next multiple of eight
+	out := drv.WriteCharacter('\t')
+	if string(out) != "    " {
+		t.Fatalf("wrong TAB expansion '%s'", out)
+	}
+	if drv.GetColumn() != 8 {
+		t.Fatalf("wrong column %d", drv.GetColumn())
+	}
+
+	// Even when we're already on a tab-stop.
+	drv.WriteCharacter('\t')
+	if drv.GetColumn() != 16 {
+		t.Fatalf("wrong column %d", drv.GetColumn())
+	}
+
+	// Carriage return resets, and newline is ignored.
+	drv.WriteCharacter('\r')
+	drv.WriteCharacter('\n')
+	if drv.GetColumn() != 0 {
+		t.Fatalf("wrong column %d", drv.GetColumn())
+	}
+
+	o, ok := drv.GetDriver().(*OutputLoggingDriver)
+	if !ok {
+		t.Fatalf("failed to cast driver")
+	}
+	if o.GetOutput() != "Steve\b    "+strings.Repeat(" ", 8)+"\r\n" {
+		t.Fatalf("wrong output '%s'", o.GetOutput())
+	}
+}
+
+// TestOptions ensures that driver options are handled.
+func TestOptions(t *testing.T) {
+
+	for _, bogus := range []string{"null:foo=bar", "logger:color=red", "ansi:color=puce", "adm-3a:foo=bar", "adm-3a:color"} {
+		_, err := New(bogus)
+		if err == nil {
+			t.Fatalf("expected error creating %s", bogus)
+		}
+	}
+
+	d, err := New("adm-3a:color=green")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	tmp := new(bytes.Buffer)
+	d.driver.SetWriter(tmp)
+	d.PutCharacter('s')
+	d.PutCharacter('k')
+	d.PutCharacter('x')
+
+	if tmp.String() != "\033[32mskx" {
+		t.Fatalf("unexpected output %q", tmp.String())
+	}
+
+	// The colour should be restored after attributes are reset.
+	tmp.Reset()
+	for _, c := range "\033C1" {
+		d.PutCharacter(byte(c))
+	}
+	if tmp.String() != "\033[m\033[32m" {
+		t.Fatalf("unexpected output %q", tmp.String())
+	}
+
+	// Changing driver supports options too.
+	err = d.ChangeDriver("ansi:color=amber")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	tmp.Reset()
+	d.driver.SetWriter(tmp)
+	d.PutCharacter('s')
+	if tmp.String() != "\033[33ms" {
+		t.Fatalf("unexpected output %q", tmp.String())
+	}
+}
+
+// TestCharset tests the translation of 8-bit characters.
+func TestCharset(t *testing.T) {
+
+	if len(cp437) != 128 {
+		t.Fatalf("cp437 table has %d entries", len(cp437))
+	}
+
+	type TestCase struct {
+		Driver   string
+		Expected string
+	}
+
+	tests := []TestCase{
+		{"ansi", "AÉÿ"},
+		{"ansi:charset=latin1", "AÉÿ"},
+		{"ansi:charset=cp437", "A╔ "},
+		{"adm-3a:charset=cp437", "A╔ "},
+		{"ansi:charset=raw", "A\xc9\xff"},
+	}
+
+	for _, test := range tests {
+		d, err := New(test.Driver)
+		if err != nil {
+			t.Fatalf("failed to create %s: %s", test.Driver, err)
+		}
+
+		tmp := new(bytes.Buffer)
+		d.driver.SetWriter(tmp)
+
+		for _, c := range []byte{'A', 0xC9, 0xFF} {
+			d.PutCharacter(c)
+		}
+		if tmp.String() != test.Expected {
+			t.Fatalf("%s produced %q, expected %q", test.Driver, tmp.String(), test.Expected)
+		}
+	}
+
+	_, err := New("ansi:charset=steve")
+	if err == nil {
+		t.Fatalf("expected error with bogus charset")
+	}
+
+	// Changing at runtime
+	d, err := New("ansi")
+	if err != nil {
+		t.Fatalf("failed to create driver: %s", err)
+	}
+	if d.GetCharset() != "latin1" {
+		t.Fatalf("unexpected default charset %s", d.GetCharset())
+	}
+	err = d.SetCharset("CP437")
+	if err != nil || d.GetCharset() != "cp437" {
+		t.Fatalf("failed to change charset: %v", err)
+	}
+	err = d.SetCharset("steve")
+	if err == nil || d.GetCharset() != "cp437" {
+		t.Fatalf("bogus charset was accepted")
+	}
+
+	// Drivers which don't support it.
+	d, err = New("null")
+	if err != nil {
+		t.Fatalf("failed to create driver: %s", err)
+	}
+	if d.GetCharset() != "" || d.SetCharset("cp437") == nil {
+		t.Fatalf("null driver supports charsets")
+	}
+}
+
+// TestCursor ensures our drivers track the position of the cursor.
+func TestCursor(t *testing.T) {
+
+	type TestCase struct {
+		driver string
+		output string
+		row    int
+		col    int
+	}
+
+	tests := []TestCase{
+		{"adm-3a", "Hello", 0, 5},
+		{"adm-3a", "Hello\r\nWorld", 1, 5},
+		{"adm-3a", "\x1b=" + string([]byte{' ' + 5, ' ' + 10}) + "X", 5, 11},
+		{"adm-3a", "Hello\x1a", 0, 0},
+		{"adm-3a", "\tX\b\b", 0, 7},
+		{"adm-3a", strings.Repeat("x", 85), 1, 5},
+		{"adm-3a", strings.Repeat("\n", 30), 23, 0},
+		{"ansi", "\033[5;10HX", 4, 10},
+		{"ansi", "\033[10;10H\033[2A\033[3D", 7, 6},
+		{"ansi", "\033[31mHi\033[0m", 0, 2},
+		{"ansi", "\033[3;3H\0337\033[H\0338", 2, 2},
+		{"ansi", "\033[99;99H", 23, 79},
+	}
+
+	for _, test := range tests {
+		c, err := New(test.driver)
+		if err != nil {
+			t.Fatalf("failed to create driver %s: %s", test.driver, err)
+		}
+		c.GetDriver().SetWriter(io.Discard)
+
+		for _, ch := range []byte(test.output) {
+			c.PutCharacter(ch)
+		}
+
+		row, col, ok := c.GetCursor()
+		if !ok {
+			t.Fatalf("driver %s doesn't track the cursor", test.driver)
+		}
+		if row != test.row || col != test.col {
+			t.Fatalf("%s: %q left the cursor at %d,%d, not %d,%d", test.driver, test.output, row, col, test.row, test.col)
+		}
+	}
+
+	// The size of the screen is used for wrapping
+	c, _ := New("ansi")
+	c.GetDriver().SetWriter(io.Discard)
+	c.SetScreenSize(40, 10)
+	for _, ch := range []byte(strings.Repeat("x", 45)) {
+		c.PutCharacter(ch)
+	}
+	row, col, _ := c.GetCursor()
+	if row != 1 || col != 5 {
+		t.Fatalf("wrong position after wrapping %d,%d", row, col)
+	}
+
+	// The position survives a change of driver, as does the size
+	err := c.ChangeDriver("adm-3a")
+	if err != nil {
+		t.Fatalf("failed to change driver: %s", err)
+	}
+	c.GetDriver().SetWriter(io.Discard)
+	row, col, _ = c.GetCursor()
+	if row != 1 || col != 5 {
+		t.Fatalf("position lost changing driver %d,%d", row, col)
+	}
+	for _, ch := range []byte(strings.Repeat("x", 35)) {
+		c.PutCharacter(ch)
+	}
+	row, col, _ = c.GetCursor()
+	if row != 2 || col != 0 {
+		t.Fatalf("size lost changing driver %d,%d", row, col)
+	}
+
+	// Drivers which don't track the cursor say so
+	c, _ = New("null")
+	_, _, ok := c.GetCursor()
+	if ok {
+		t.Fatalf("null driver shouldn't track the cursor")
+	}
+}
+
+// TestOutputLimit ensures output is paused if too much is written.
+func TestOutputLimit(t *testing.T) {
+
+	for _, spec := range []string{"x", "0", "10/", "10/-1s", "10/fast"} {
+		_, err := ParseOutputLimit(spec)
+		if err == nil {
+			t.Fatalf("expected an error parsing %s", spec)
+		}
+	}
+
+	limit, err := ParseOutputLimit("100")
+	if err != nil || limit.String() != "100/1s" {
+		t.Fatalf("unexpected result parsing limit %s %v", limit, err)
+	}
+
+	c, err := New("adm-3a")
+	if err != nil {
+		t.Fatalf("failed to create driver %s", err)
+	}
+	out := &bytes.Buffer{}
+	c.GetDriver().SetWriter(out)
+
+	limit, _ = ParseOutputLimit("5/1h")
+	c.SetOutputLimit(limit)
+	for _, ch := range []byte("Hello, World") {
+		c.PutCharacter(ch)
+	}
+	if !c.Paused() {
+		t.Fatalf("expected output to be paused")
+	}
+	if out.String() != "Hello" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+
+	// Notifications are shown while paused
+	c.Notify("!")
+	if out.String() != "Hello!" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+
+	if c.Resume() != 7 {
+		t.Fatalf("wrong count of discarded characters")
+	}
+	c.PutCharacter('.')
+	if c.Paused() || out.String() != "Hello!." {
+		t.Fatalf("output wasn't resumed %q", out.String())
+	}
+}
+
+// TestBuffering ensures output is buffered, when enabled, and written
+// when flushed, or after a delay.
+func TestBuffering(t *testing.T) {
+
+	c, err := New("ansi")
+	if err != nil {
+		t.Fatalf("failed to create driver %s", err)
+	}
+	out := &bytes.Buffer{}
+	c.GetDriver().SetWriter(out)
+
+	c.SetBufferDelay(time.Hour)
+	if c.GetBufferDelay() != time.Hour {
+		t.Fatalf("wrong buffer delay")
+	}
+
+	for _, ch := range []byte("Hello") {
+		c.PutCharacter(ch)
+	}
+	if out.String() != "" {
+		t.Fatalf("output wasn't buffered: %q", out.String())
+	}
+	c.Flush()
+	if out.String() != "Hello" {
+		t.Fatalf("output wasn't flushed: %q", out.String())
+	}
+
+	// Output is written after the delay.
+	c.SetBufferDelay(time.Millisecond)
+	c.PutCharacter('!')
+	time.Sleep(50 * time.Millisecond)
+	c.buffered.mutex.Lock()
+	got := out.String()
+	c.buffered.mutex.Unlock()
+	if got != "Hello!" {
+		t.Fatalf("output wasn't written after the delay: %q", got)
+	}
+
+	// Disabling buffering restores the writer of the driver.
+	c.PutCharacter('?')
+	c.SetBufferDelay(0)
+	if out.String() != "Hello!?" {
+		t.Fatalf("output wasn't flushed when buffering was disabled: %q", out.String())
+	}
+	if c.GetDriver().(WriterDriver).GetWriter() != out {
+		t.Fatalf("writer wasn't restored")
+	}
+
+	// Drivers which don't expose their writer aren't buffered.
+	n, _ := New("null")
+	n.SetBufferDelay(time.Hour)
+	if n.buffered != nil {
+		t.Fatalf("null driver shouldn't be buffered")
+	}
+	n.Flush()
+}
+
+// tearDownDriver is a driver which records whether it was torn down.
+type tearDownDriver struct {
+	NullOutputDriver
+
+	// count is the number of times TearDown was called.
+	count int
+}
+
+// TearDown records the call.
+func (td *tearDownDriver) TearDown() {
+	td.count++
+}
+
+// TestTearDown ensures drivers are torn down when they're changed, and when
+// we are.
+func TestTearDown(t *testing.T) {
+
+	td := &tearDownDriver{}
+	c := &ConsoleOut{driver: td}
+
+	c.TearDown()
+	if td.count != 1 {
+		t.Fatalf("driver wasn't torn down")
+	}
+
+	err := c.ChangeDriver("null")
+	if err != nil {
+		t.Fatalf("failed to change driver: %s", err)
+	}
+	if td.count != 2 {
+		t.Fatalf("driver wasn't torn down when it was changed")
+	}
+
+	// Drivers without a TearDown method are fine.
+	c.TearDown()
+}
+
+// TestAsciinema ensures the asciinema driver records the output of the
+// driver it wraps.
+func TestAsciinema(t *testing.T) {
+
+	for _, bogus := range []string{"asciinema", "asciinema:path=x,driver=asciinema", "asciinema:path=x,driver=null", "asciinema:path=x,idle=-1", "asciinema:path=x,colour=red"} {
+		_, err := New(bogus)
+		if err == nil {
+			t.Fatalf("expected error creating %s", bogus)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "session.cast")
+	drv, err := New("asciinema:driver=ansi,color=green,idle=2,path=" + path)
+	if err != nil {
+		t.Fatalf("failed to load driver %s", err)
+	}
+	if drv.GetName() != "asciinema" {
+		t.Fatalf("wrong name %s", drv.GetName())
+	}
+	if drv.GetCharset() != "latin1" {
+		t.Fatalf("wrong charset %s", drv.GetCharset())
+	}
+
+	// The output still reaches the terminal, with buffering.
+	var out bytes.Buffer
+	drv.GetDriver().SetWriter(&out)
+	drv.SetScreenSize(132, 50)
+	drv.SetBufferDelay(time.Hour)
+
+	for _, c := range "Hello\r\n" {
+		drv.PutCharacter(byte(c))
+	}
+	time.Sleep(50 * time.Millisecond)
+	for _, c := range "World" {
+		drv.PutCharacter(byte(c))
+	}
+	if row, col, ok := drv.GetCursor(); !ok || row != 1 || col != 5 {
+		t.Fatalf("wrong cursor %d,%d", row, col)
+	}
+	drv.TearDown()
+
+	if out.String() != "\033[32mHello\r\nWorld" {
+		t.Fatalf("wrong output %q", out.String())
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read recording: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("wrong recording %q", data)
+	}
+
+	var header map[string]any
+	err = json.Unmarshal([]byte(lines[0]), &header)
+	if err != nil {
+		t.Fatalf("invalid header %s", lines[0])
+	}
+	if header["version"] != float64(2) || header["width"] != float64(132) || header["height"] != float64(50) || header["idle_time_limit"] != float64(2) {
+		t.Fatalf("wrong header %s", lines[0])
+	}
+
+	var last float64
+	for i, expected := range []string{"\033[32mHello\r\n", "World"} {
+		var ev []any
+		err = json.Unmarshal([]byte(lines[i+1]), &ev)
+		if err != nil || len(ev) != 3 {
+			t.Fatalf("invalid event %s", lines[i+1])
+		}
+		when, ok := ev[0].(float64)
+		if !ok || when < last || ev[1] != "o" || ev[2] != expected {
+			t.Fatalf("wrong event %s", lines[i+1])
+		}
+		last = when
+	}
+	if last < 0.04 {
+		t.Fatalf("wrong timing %f", last)
+	}
+}
@@ -0,0 +1,220 @@
+package consoleout
+
+// DefaultScreenWidth is the width of the screen we assume when tracking
+// the position of the cursor, until SetScreenSize is called.
+const DefaultScreenWidth = 80
+
+// DefaultScreenHeight is the height of the screen we assume when tracking
+// the position of the cursor, until SetScreenSize is called.
+const DefaultScreenHeight = 24
+
+// CursorDriver is an interface which is implemented by output drivers
+// which track the logical position of the cursor, by interpreting the
+// control characters, and escape sequences, which they're given.
+//
+// This allows guests to find the cursor position regardless of the host
+// terminal.
+type CursorDriver interface {
+
+	// GetCursor returns the row, and column, of the cursor, starting
+	// from zero.
+	GetCursor() (int, int)
+
+	// SetCursor moves the cursor, without producing any output.  This
+	// is used when the driver is changed at runtime.
+	SetCursor(row int, col int)
+
+	// SetScreenSize sets the size of the screen, which is used to
+	// wrap long lines, and to limit cursor movement.
+	SetScreenSize(width int, height int)
+}
+
+// cursor holds the logical position of the cursor, and is embedded in the
+// drivers which support it.
+type cursor struct {
+
+	// row and col hold the position of the cursor.
+	row int
+	col int
+
+	// savedRow and savedCol hold a position saved by an escape sequence.
+	savedRow int
+	savedCol int
+
+	// width and height hold the size of the screen, if set.
+	width  int
+	height int
+
+	// escape holds the state of our parser for ANSI sequences, see
+	// trackANSI.
+	escape int
+
+	// params holds the parameters of the current ANSI sequence.
+	params []int
+}
+
+// GetCursor returns the row, and column, of the cursor.
+func (cu *cursor) GetCursor() (int, int) {
+	return cu.row, cu.col
+}
+
+// SetCursor moves the cursor.
+func (cu *cursor) SetCursor(row int, col int) {
+	cu.moveTo(row, col)
+}
+
+// SetScreenSize sets the size of the screen.
+func (cu *cursor) SetScreenSize(width int, height int) {
+	cu.width = width
+	cu.height = height
+	cu.moveTo(cu.row, cu.col)
+}
+
+// size returns the size of the screen.
+func (cu *cursor) size() (int, int) {
+	width, height := cu.width, cu.height
+	if width <= 0 {
+		width = DefaultScreenWidth
+	}
+	if height <= 0 {
+		height = DefaultScreenHeight
+	}
+	return width, height
+}
+
+// moveTo moves the cursor to the given position, which is limited to the
+// screen.
+func (cu *cursor) moveTo(row int, col int) {
+	width, height := cu.size()
+
+	cu.row = min(max(row, 0), height-1)
+	cu.col = min(max(col, 0), width-1)
+}
+
+// save records the cursor position, so that it may be restored later.
+func (cu *cursor) save() {
+	cu.savedRow, cu.savedCol = cu.row, cu.col
+}
+
+// restore moves the cursor to the position recorded by save.
+func (cu *cursor) restore() {
+	cu.moveTo(cu.savedRow, cu.savedCol)
+}
+
+// advance updates the cursor for a character which isn't part of an
+// escape sequence.
+//
+// Printable characters move the cursor right, wrapping at the end of the
+// line, and the screen scrolls when the cursor moves below the last line.
+func (cu *cursor) advance(c uint8) {
+	width, height := cu.size()
+
+	switch {
+	case c == '\r':
+		cu.col = 0
+	case c == '\n':
+		cu.row = min(cu.row+1, height-1)
+	case c == '\b':
+		cu.col = max(cu.col-1, 0)
+	case c == '\t':
+		cu.col = min((cu.col/8+1)*8, width-1)
+	case c >= ' ' && c != 0x7F:
+		cu.col++
+		if cu.col >= width {
+			cu.col = 0
+			cu.row = min(cu.row+1, height-1)
+		}
+	}
+}
+
+// The states of our ANSI parser.
+const (
+	ansiText = iota
+	ansiEscape
+	ansiCSI
+)
+
+// trackANSI updates the cursor for a character written to a terminal
+// which understands ANSI escape sequences.
+//
+// Only the sequences which move the cursor are interpreted, others are
+// skipped.
+func (cu *cursor) trackANSI(c uint8) {
+
+	switch cu.escape {
+	case ansiText:
+		if c == 0x1B {
+			cu.escape = ansiEscape
+			return
+		}
+		cu.advance(c)
+
+	case ansiEscape:
+		cu.escape = ansiText
+		switch c {
+		case '[':
+			cu.escape = ansiCSI
+			cu.params = []int{0}
+		case '7':
+			cu.save()
+		case '8':
+			cu.restore()
+		case 'c':
+			cu.moveTo(0, 0)
+		}
+
+	case ansiCSI:
+		switch {
+		case c >= '0' && c <= '9':
+			last := len(cu.params) - 1
+			cu.params[last] = cu.params[last]*10 + int(c-'0')
+			return
+		case c == ';':
+			cu.params = append(cu.params, 0)
+			return
+		case c >= 0x20 && c <= 0x3F:
+			// Private, or intermediate, characters.
+			return
+		}
+
+		cu.escape = ansiText
+		cu.csi(c)
+	}
+}
+
+// csi handles the final character of an ANSI control sequence.
+func (cu *cursor) csi(c uint8) {
+
+	// param returns the given parameter, or the default.
+	param := func(n int, def int) int {
+		if n < len(cu.params) && cu.params[n] != 0 {
+			return cu.params[n]
+		}
+		return def
+	}
+
+	switch c {
+	case 'H', 'f':
+		cu.moveTo(param(0, 1)-1, param(1, 1)-1)
+	case 'A':
+		cu.moveTo(cu.row-param(0, 1), cu.col)
+	case 'B':
+		cu.moveTo(cu.row+param(0, 1), cu.col)
+	case 'C':
+		cu.moveTo(cu.row, cu.col+param(0, 1))
+	case 'D':
+		cu.moveTo(cu.row, cu.col-param(0, 1))
+	case 'E':
+		cu.moveTo(cu.row+param(0, 1), 0)
+	case 'F':
+		cu.moveTo(cu.row-param(0, 1), 0)
+	case 'G':
+		cu.moveTo(cu.row, param(0, 1)-1)
+	case 'd':
+		cu.moveTo(param(0, 1)-1, cu.col)
+	case 's':
+		cu.save()
+	case 'u':
+		cu.restore()
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+
+	"github.com/skx/cpmulator/options"
 )
 
 // Adm3AOutputDriver holds our state.
@@ -20,6 +22,18 @@ type Adm3AOutputDriver struct {
 
 	// writer is where we send our output
 	writer io.Writer
+
+	// color holds the escape-sequence to select our colour, if any.
+	color string
+
+	// colorSent is true once we've sent our colour.
+	colorSent bool
+
+	// charset translates 8-bit characters to Unicode.
+	charset
+
+	// cursor tracks the position of the cursor.
+	cursor
 }
 
 // GetName returns the name of this driver.
@@ -34,6 +48,12 @@ func (a3a *Adm3AOutputDriver) GetName() string {
 // This is part of the OutputDriver interface.
 func (a3a *Adm3AOutputDriver) PutCharacter(c uint8) {
 
+	// Select our colour, before our first output.
+	if !a3a.colorSent {
+		fmt.Fprintf(a3a.writer, "%s", a3a.color)
+		a3a.colorSent = true
+	}
+
 	switch a3a.status {
 	case 0:
 		switch c {
@@ -41,12 +61,16 @@ func (a3a *Adm3AOutputDriver) PutCharacter(c uint8) {
 			fmt.Fprintf(a3a.writer, "\033[?5h\033[?5l")
 		case 0x7F: /* DEL: echo BS, space, BS */
 			fmt.Fprintf(a3a.writer, "\b \b")
+			a3a.advance('\b')
 		case 0x1A: /* adm3a clear screen */
 			fmt.Fprintf(a3a.writer, "\033[H\033[2J")
+			a3a.moveTo(0, 0)
 		case 0x0C: /* vt52 clear screen */
 			fmt.Fprintf(a3a.writer, "\033[H\033[2J")
+			a3a.moveTo(0, 0)
 		case 0x1E: /* adm3a cursor home */
 			fmt.Fprintf(a3a.writer, "\033[H")
+			a3a.moveTo(0, 0)
 		case 0x1B:
 			a3a.status = 1 /* esc-prefix */
 		case 1:
@@ -60,7 +84,8 @@ func (a3a *Adm3AOutputDriver) PutCharacter(c uint8) {
 		case 0x12, 0x13:
 			// nop
 		default:
-			fmt.Fprintf(a3a.writer, "%c", c)
+			a3a.writeChar(a3a.writer, c)
+			a3a.advance(c)
 		}
 	case 1: /* we had an esc-prefix */
 		switch c {
@@ -91,6 +116,7 @@ func (a3a *Adm3AOutputDriver) PutCharacter(c uint8) {
 		a3a.x = c - ' ' + 1
 		a3a.status = 0
 		fmt.Fprintf(a3a.writer, "\033[%d;%dH", a3a.y, a3a.x)
+		a3a.moveTo(int(a3a.y)-1, int(a3a.x)-1)
 	case 4: /* <ESC>+B prefix */
 		a3a.status = 0
 		switch c {
@@ -108,6 +134,7 @@ func (a3a *Adm3AOutputDriver) PutCharacter(c uint8) {
 			// nop
 		case '6': /* remember cursor position */
 			fmt.Fprintf(a3a.writer, "\033[s")
+			a3a.save()
 		case '7': /* preserve status line */
 			// nop
 		default:
@@ -119,7 +146,8 @@ func (a3a *Adm3AOutputDriver) PutCharacter(c uint8) {
 		case '0': /* stop reverse video */
 			fmt.Fprintf(a3a.writer, "\033[27m")
 		case '1': /* stop half intensity */
-			fmt.Fprintf(a3a.writer, "\033[m")
+			// This resets all attributes, including our colour.
+			fmt.Fprintf(a3a.writer, "\033[m%s", a3a.color)
 		case '2': /* stop blinking */
 			fmt.Fprintf(a3a.writer, "\033[25m")
 		case '3': /* stop underlining */
@@ -128,6 +156,7 @@ func (a3a *Adm3AOutputDriver) PutCharacter(c uint8) {
 			fmt.Fprintf(a3a.writer, "\033[?25l")
 		case '6': /* restore cursor position */
 			fmt.Fprintf(a3a.writer, "\033[u")
+			a3a.restore()
 		case '5': /* video mode off */
 			// nop
 		case '7': /* don't preserve status line */
@@ -153,11 +182,30 @@ func (a3a *Adm3AOutputDriver) SetWriter(w io.Writer) {
 	a3a.writer = w
 }
 
+// GetWriter returns the writer.
+func (a3a *Adm3AOutputDriver) GetWriter() io.Writer {
+	return a3a.writer
+}
+
 // init registers our driver, by name.
 func init() {
-	Register("adm-3a", func() ConsoleOutput {
-		return &Adm3AOutputDriver{
-			writer: os.Stdout,
+	Register("adm-3a", func(opts options.Options) (ConsoleOutput, error) {
+		err := opts.Validate("charset", "color")
+		if err != nil {
+			return nil, err
 		}
+		color, err := colorOption(opts)
+		if err != nil {
+			return nil, err
+		}
+		cs, err := charsetOption(opts)
+		if err != nil {
+			return nil, err
+		}
+		return &Adm3AOutputDriver{
+			writer:  os.Stdout,
+			color:   color,
+			charset: cs,
+		}, nil
 	})
 }
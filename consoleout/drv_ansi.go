@@ -4,12 +4,26 @@ import (
 	"fmt"
 	"io"
 	"os"
+
+	"github.com/skx/cpmulator/options"
 )
 
 // AnsiOutputDriver holds our state.
 type AnsiOutputDriver struct {
 	// writer is where we send our output
 	writer io.Writer
+
+	// color holds the escape-sequence to select our colour, if any.
+	color string
+
+	// colorSent is true once we've sent our colour.
+	colorSent bool
+
+	// charset translates 8-bit characters to Unicode.
+	charset
+
+	// cursor tracks the position of the cursor.
+	cursor
 }
 
 // GetName returns the name of this driver.
@@ -23,7 +37,15 @@ func (ad *AnsiOutputDriver) GetName() string {
 //
 // This is part of the OutputDriver interface.
 func (ad *AnsiOutputDriver) PutCharacter(c uint8) {
-	fmt.Fprintf(ad.writer, "%c", c)
+
+	// Select our colour, before our first output.
+	if !ad.colorSent {
+		fmt.Fprintf(ad.writer, "%s", ad.color)
+		ad.colorSent = true
+	}
+
+	ad.writeChar(ad.writer, c)
+	ad.trackANSI(c)
 }
 
 // SetWriter will update the writer.
@@ -31,11 +53,30 @@ func (ad *AnsiOutputDriver) SetWriter(w io.Writer) {
 	ad.writer = w
 }
 
+// GetWriter returns the writer.
+func (ad *AnsiOutputDriver) GetWriter() io.Writer {
+	return ad.writer
+}
+
 // init registers our driver, by name.
 func init() {
-	Register("ansi", func() ConsoleOutput {
-		return &AnsiOutputDriver{
-			writer: os.Stdout,
+	Register("ansi", func(opts options.Options) (ConsoleOutput, error) {
+		err := opts.Validate("charset", "color")
+		if err != nil {
+			return nil, err
 		}
+		color, err := colorOption(opts)
+		if err != nil {
+			return nil, err
+		}
+		cs, err := charsetOption(opts)
+		if err != nil {
+			return nil, err
+		}
+		return &AnsiOutputDriver{
+			writer:  os.Stdout,
+			color:   color,
+			charset: cs,
+		}, nil
 	})
 }
@@ -0,0 +1,223 @@
+// drv_asciinema creates a console output-driver which wraps another driver,
+// recording everything it writes to the terminal as an asciinema (v2)
+// recording, so that sessions may be replayed via "asciinema play", or
+// uploaded to asciinema.org, without any external tools.
+//
+// Usage looks like:
+//
+//	cpmulator -output asciinema:path=session.cast,driver=adm-3a
+//
+// Here "adm-3a" is the driver which is wrapped, which is the default, and
+// "session.cast" is the recording, which is truncated when the driver is
+// created.  Any other options are passed to the wrapped driver.
+//
+// We record the bytes the wrapped driver writes, after its terminal
+// emulation, rather than the characters CP/M output, so the recording
+// replays correctly upon a modern terminal.  Each write is timed when it
+// is made, before any buffering, and writes which happen close together
+// are combined into a single event, by the AsciinemaWriter which the
+// session transcripts of the emulator also use.  The "idle" option limits
+// the length of the pauses when the recording is replayed.
+//
+// Only drivers which write to the terminal may be wrapped.
+
+package consoleout
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/skx/cpmulator/options"
+)
+
+// AsciinemaOutputDriver holds our state.
+type AsciinemaOutputDriver struct {
+
+	// driver is the driver we're wrapping, which writes to our tee.
+	driver ConsoleOutput
+
+	// writer is where the output of the wrapped driver is sent, after
+	// we've recorded it.
+	writer io.Writer
+
+	// mutex serializes our recording, as we might be torn down from a
+	// signal handler.
+	mutex sync.Mutex
+
+	// file is our recording, which cast encodes.
+	file *os.File
+	cast *AsciinemaWriter
+}
+
+// asciinemaTee records the output of our wrapped driver, before passing it
+// to the real writer.
+type asciinemaTee struct {
+	ad *AsciinemaOutputDriver
+}
+
+// Write records the given output, and writes it to the real writer.
+func (at *asciinemaTee) Write(p []byte) (int, error) {
+	at.ad.record(p)
+	return at.ad.writer.Write(p)
+}
+
+// GetName returns the name of this driver.
+//
+// This is part of the OutputDriver interface.
+func (ad *AsciinemaOutputDriver) GetName() string {
+	return "asciinema"
+}
+
+// PutCharacter proxies into our wrapped driver, which writes to our tee.
+//
+// This is part of the OutputDriver interface.
+func (ad *AsciinemaOutputDriver) PutCharacter(c uint8) {
+	ad.driver.PutCharacter(c)
+}
+
+// SetWriter will update the writer.
+func (ad *AsciinemaOutputDriver) SetWriter(w io.Writer) {
+	ad.writer = w
+}
+
+// GetWriter returns the writer.
+func (ad *AsciinemaOutputDriver) GetWriter() io.Writer {
+	return ad.writer
+}
+
+// GetCursor proxies into our wrapped driver.
+func (ad *AsciinemaOutputDriver) GetCursor() (int, int) {
+	if cd, ok := ad.driver.(CursorDriver); ok {
+		return cd.GetCursor()
+	}
+	return 0, 0
+}
+
+// SetCursor proxies into our wrapped driver.
+func (ad *AsciinemaOutputDriver) SetCursor(row int, col int) {
+	if cd, ok := ad.driver.(CursorDriver); ok {
+		cd.SetCursor(row, col)
+	}
+}
+
+// SetScreenSize proxies into our wrapped driver, and records the size of
+// the screen for our header.
+func (ad *AsciinemaOutputDriver) SetScreenSize(width int, height int) {
+
+	ad.mutex.Lock()
+	ad.cast.SetScreenSize(width, height)
+	ad.mutex.Unlock()
+
+	if cd, ok := ad.driver.(CursorDriver); ok {
+		cd.SetScreenSize(width, height)
+	}
+}
+
+// SetCharset proxies into our wrapped driver.
+func (ad *AsciinemaOutputDriver) SetCharset(name string) error {
+	cs, ok := ad.driver.(CharsetDriver)
+	if !ok {
+		return fmt.Errorf("driver %s doesn't support character sets", ad.driver.GetName())
+	}
+	return cs.SetCharset(name)
+}
+
+// GetCharset proxies into our wrapped driver.
+func (ad *AsciinemaOutputDriver) GetCharset() string {
+	cs, ok := ad.driver.(CharsetDriver)
+	if !ok {
+		return ""
+	}
+	return cs.GetCharset()
+}
+
+// TearDown completes, and closes, our recording, then proxies into our
+// wrapped driver.
+func (ad *AsciinemaOutputDriver) TearDown() {
+
+	ad.mutex.Lock()
+	if ad.file != nil {
+		ad.cast.Flush()
+		ad.file.Close()
+		ad.file = nil
+	}
+	ad.mutex.Unlock()
+
+	if td, ok := ad.driver.(TearDownDriver); ok {
+		td.TearDown()
+	}
+}
+
+// record adds the given output to our recording.
+func (ad *AsciinemaOutputDriver) record(p []byte) {
+
+	ad.mutex.Lock()
+	defer ad.mutex.Unlock()
+
+	if ad.file == nil {
+		return
+	}
+
+	ad.cast.Output(p)
+}
+
+// init registers our driver, by name.
+func init() {
+	Register("asciinema", func(opts options.Options) (ConsoleOutput, error) {
+
+		name := opts.Get("driver", "adm-3a")
+		path := opts.Get("path", "")
+		if path == "" {
+			return nil, fmt.Errorf("the 'path' option is required")
+		}
+		if name == "asciinema" {
+			return nil, fmt.Errorf("cannot wrap the asciinema driver")
+		}
+
+		idle, err := strconv.ParseFloat(opts.Get("idle", "0"), 64)
+		if err != nil || idle < 0 {
+			return nil, fmt.Errorf("invalid value for 'idle': %s", opts.Get("idle", ""))
+		}
+
+		// Pass all other options to the wrapped driver.
+		wrapped := make(options.Options)
+		for k, v := range opts {
+			if k != "driver" && k != "path" && k != "idle" {
+				wrapped[k] = v
+			}
+		}
+
+		driver, err := newDriverWithOptions(name, wrapped)
+		if err != nil {
+			return nil, err
+		}
+
+		wd, ok := driver.(WriterDriver)
+		if !ok {
+			return nil, fmt.Errorf("the %s driver doesn't write to the terminal, and cannot be recorded", name)
+		}
+
+		file, err := os.Create(path)
+		if err != nil {
+			if td, ok := driver.(TearDownDriver); ok {
+				td.TearDown()
+			}
+			return nil, fmt.Errorf("failed to open %s: %s", path, err)
+		}
+
+		cast := NewAsciinemaWriter(file, "cpmulator")
+		cast.SetIdleLimit(idle)
+
+		ad := &AsciinemaOutputDriver{
+			driver: driver,
+			writer: wd.GetWriter(),
+			file:   file,
+			cast:   cast,
+		}
+		driver.SetWriter(&asciinemaTee{ad: ad})
+		return ad, nil
+	})
+}
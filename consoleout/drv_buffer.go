@@ -0,0 +1,86 @@
+// drv_buffer creates a console output-driver which stores all output in
+// memory, for use by Go programs which embed the emulator, and by tests.
+//
+// Nothing is written to STDOUT, or to the filesystem, and the output may
+// be retrieved via the ConsoleRecorder interface:
+//
+//	obj, _ := cpm.New(cpm.WithOutputDriver("buffer"))
+//	..
+//	rec := obj.GetOutputDriver().(consoleout.ConsoleRecorder)
+//	fmt.Println(rec.GetOutput())
+//
+// Unlike the internal "logger" driver the output is safe to read while
+// the emulator is running in another goroutine.
+
+package consoleout
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/skx/cpmulator/options"
+)
+
+// BufferOutputDriver holds our state.
+type BufferOutputDriver struct {
+
+	// writer is where we send our output, which is unused.
+	writer io.Writer
+
+	// mutex protects our buffer.
+	mutex sync.Mutex
+
+	// buffer stores our output.
+	buffer bytes.Buffer
+}
+
+// GetName returns the name of this driver.
+//
+// This is part of the OutputDriver interface.
+func (bo *BufferOutputDriver) GetName() string {
+	return "buffer"
+}
+
+// PutCharacter stores the specified character in our buffer.
+//
+// This is part of the OutputDriver interface.
+func (bo *BufferOutputDriver) PutCharacter(c uint8) {
+	bo.mutex.Lock()
+	bo.buffer.WriteByte(c)
+	bo.mutex.Unlock()
+}
+
+// SetWriter will update the writer.
+func (bo *BufferOutputDriver) SetWriter(w io.Writer) {
+	bo.writer = w
+}
+
+// GetOutput returns the output which has been stored.
+//
+// This is part of the ConsoleRecorder interface.
+func (bo *BufferOutputDriver) GetOutput() string {
+	bo.mutex.Lock()
+	defer bo.mutex.Unlock()
+	return bo.buffer.String()
+}
+
+// Reset discards the output which has been stored.
+//
+// This is part of the ConsoleRecorder interface.
+func (bo *BufferOutputDriver) Reset() {
+	bo.mutex.Lock()
+	bo.buffer.Reset()
+	bo.mutex.Unlock()
+}
+
+// init registers our driver, by name.
+func init() {
+	Register("buffer", func(opts options.Options) (ConsoleOutput, error) {
+		err := opts.Validate()
+		if err != nil {
+			return nil, err
+		}
+		return &BufferOutputDriver{}, nil
+	})
+}
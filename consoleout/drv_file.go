@@ -0,0 +1,92 @@
+// drv_file creates a console output-driver which writes all output to a
+// file, rather than to the terminal, which is symmetric with the "file"
+// input-driver.
+//
+// This allows the output of a program to be captured without it being
+// mixed with anything else written to STDOUT, usage looks like:
+//
+//	cpmulator -output file:path=output.txt,timestamps=true
+//
+// The file is truncated when the driver is created.  If the timestamps
+// option is true each line is prefixed with the time it was started.
+
+package consoleout
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/skx/cpmulator/options"
+)
+
+// FileOutputDriver holds our state.
+type FileOutputDriver struct {
+
+	// writer is where we send our output
+	writer io.Writer
+
+	// timestamps is true if each line should be prefixed by the time.
+	timestamps bool
+
+	// midLine is true if we've written characters to the current line.
+	midLine bool
+}
+
+// GetName returns the name of this driver.
+//
+// This is part of the OutputDriver interface.
+func (fo *FileOutputDriver) GetName() string {
+	return "file"
+}
+
+// PutCharacter writes the specified character to our file, unchanged,
+// prefixing a timestamp at the start of each line if that is enabled.
+//
+// This is part of the OutputDriver interface.
+func (fo *FileOutputDriver) PutCharacter(c uint8) {
+
+	if fo.timestamps && !fo.midLine && c != '\r' && c != '\n' {
+		fmt.Fprintf(fo.writer, "%s ", time.Now().Format(time.RFC3339Nano))
+		fo.midLine = true
+	}
+	if c == '\n' {
+		fo.midLine = false
+	}
+
+	fo.writer.Write([]byte{c})
+}
+
+// SetWriter will update the writer.
+func (fo *FileOutputDriver) SetWriter(w io.Writer) {
+	fo.writer = w
+}
+
+// init registers our driver, by name.
+func init() {
+	Register("file", func(opts options.Options) (ConsoleOutput, error) {
+		err := opts.Validate("path", "timestamps")
+		if err != nil {
+			return nil, err
+		}
+
+		path := opts.Get("path", "")
+		if path == "" {
+			return nil, fmt.Errorf("the 'path' option is required")
+		}
+
+		timestamps, err := strconv.ParseBool(opts.Get("timestamps", "false"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for 'timestamps': %s", err)
+		}
+
+		file, err := os.Create(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %s", path, err)
+		}
+
+		return &FileOutputDriver{writer: file, timestamps: timestamps}, nil
+	})
+}
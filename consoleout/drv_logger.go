@@ -3,6 +3,8 @@ package consoleout
 import (
 	"io"
 	"os"
+
+	"github.com/skx/cpmulator/options"
 )
 
 // OutputLoggingDriver holds our state.
@@ -52,9 +54,13 @@ func (ol *OutputLoggingDriver) Reset() {
 
 // init registers our driver, by name.
 func init() {
-	Register("logger", func() ConsoleOutput {
+	Register("logger", func(opts options.Options) (ConsoleOutput, error) {
+		err := opts.Validate()
+		if err != nil {
+			return nil, err
+		}
 		return &OutputLoggingDriver{
 			writer: os.Stdout,
-		}
+		}, nil
 	})
 }
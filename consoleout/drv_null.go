@@ -3,6 +3,8 @@ package consoleout
 import (
 	"io"
 	"os"
+
+	"github.com/skx/cpmulator/options"
 )
 
 // NullOutputDriver holds our state.
@@ -35,9 +37,13 @@ func (no *NullOutputDriver) SetWriter(w io.Writer) {
 
 // init registers our driver, by name.
 func init() {
-	Register("null", func() ConsoleOutput {
+	Register("null", func(opts options.Options) (ConsoleOutput, error) {
+		err := opts.Validate()
+		if err != nil {
+			return nil, err
+		}
 		return &NullOutputDriver{
 			writer: os.Stdout,
-		}
+		}, nil
 	})
 }
@@ -0,0 +1,116 @@
+//go:build windows
+
+// drv_windows.go contains a console output-driver for the Windows console.
+//
+// Older Windows consoles don't interpret escape-sequences unless they're
+// asked to, which means the output of our ADM-3A driver is shown as junk.
+// This driver enables the processing of escape-sequences, and selects the
+// UTF-8 code page, so that our translated characters are displayed, then
+// behaves exactly like the ADM-3A driver.
+//
+// The console is restored when the driver is no longer used.
+//
+// This driver is only available on Windows.
+
+package consoleout
+
+import (
+	"os"
+
+	"github.com/skx/cpmulator/options"
+	"golang.org/x/sys/windows"
+)
+
+// utf8CodePage is the identifier of the UTF-8 code page.
+const utf8CodePage = 65001
+
+// WindowsOutputDriver holds our state.
+type WindowsOutputDriver struct {
+
+	// Adm3AOutputDriver performs our terminal emulation.
+	Adm3AOutputDriver
+
+	// handle is the console output handle.
+	handle windows.Handle
+
+	// oldMode and oldCodePage hold the state of the console before
+	// we changed it.
+	oldMode     uint32
+	oldCodePage uint32
+
+	// console is true if STDOUT is a console, and we changed it.
+	console bool
+}
+
+// GetName returns the name of this driver.
+//
+// This is part of the OutputDriver interface.
+func (wo *WindowsOutputDriver) GetName() string {
+	return "windows"
+}
+
+// setup enables the processing of escape-sequences, and the UTF-8 code
+// page, if STDOUT is a console.
+func (wo *WindowsOutputDriver) setup() {
+
+	wo.handle = windows.Handle(os.Stdout.Fd())
+
+	err := windows.GetConsoleMode(wo.handle, &wo.oldMode)
+	if err != nil {
+		return
+	}
+
+	// Without DISABLE_NEWLINE_AUTO_RETURN a line-feed also moves to
+	// the start of the line, but CP/M programs send both.
+	mode := wo.oldMode | windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING | windows.DISABLE_NEWLINE_AUTO_RETURN
+	err = windows.SetConsoleMode(wo.handle, mode)
+	if err != nil {
+		return
+	}
+
+	wo.oldCodePage, _ = windows.GetConsoleOutputCP()
+	_ = windows.SetConsoleOutputCP(utf8CodePage)
+	wo.console = true
+}
+
+// TearDown restores the state of the console.
+//
+// This is part of the TearDownDriver interface.
+func (wo *WindowsOutputDriver) TearDown() {
+	if !wo.console {
+		return
+	}
+	_ = windows.SetConsoleMode(wo.handle, wo.oldMode)
+	if wo.oldCodePage != 0 {
+		_ = windows.SetConsoleOutputCP(wo.oldCodePage)
+	}
+	wo.console = false
+}
+
+// init registers our driver, by name.
+func init() {
+	Register("windows", func(opts options.Options) (ConsoleOutput, error) {
+		err := opts.Validate("charset", "color")
+		if err != nil {
+			return nil, err
+		}
+		color, err := colorOption(opts)
+		if err != nil {
+			return nil, err
+		}
+		cs, err := charsetOption(opts)
+		if err != nil {
+			return nil, err
+		}
+
+		wo := &WindowsOutputDriver{
+			Adm3AOutputDriver: Adm3AOutputDriver{
+				writer:  os.Stdout,
+				color:   color,
+				charset: cs,
+			},
+		}
+		wo.setup()
+		return wo, nil
+	})
+}
@@ -0,0 +1,139 @@
+// throttle.go contains our detection of runaway output, such as a buggy
+// program printing in a tight loop, which could otherwise flood the
+// terminal and leave the session unusable.
+//
+// A limit is specified as a number of characters, and a period, such as
+// "20000/1s".  If more characters than that are written within a single
+// period output is paused, and any further output is discarded, until
+// Resume is called.
+//
+// The empty string disables the limit, which is the default.
+
+package consoleout
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultLimitPeriod is the period over which output is counted, if a
+// limit doesn't specify one.
+const DefaultLimitPeriod = time.Second
+
+// OutputLimit describes the rate of output above which output is paused.
+type OutputLimit struct {
+	// Chars is the number of characters which may be written each
+	// Period.  Zero means there is no limit.
+	Chars int
+
+	// Period is the period over which characters are counted.
+	Period time.Duration
+}
+
+// ParseOutputLimit parses a limit, such as "20000/1s", as described at the
+// top of this file.
+func ParseOutputLimit(spec string) (OutputLimit, error) {
+
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return OutputLimit{}, nil
+	}
+
+	count, period, found := strings.Cut(spec, "/")
+	chars, err := strconv.Atoi(count)
+	if err != nil || chars < 1 {
+		return OutputLimit{}, fmt.Errorf("invalid character count '%s' in output limit '%s'", count, spec)
+	}
+
+	limit := OutputLimit{Chars: chars, Period: DefaultLimitPeriod}
+	if found {
+		limit.Period, err = time.ParseDuration(period)
+		if err != nil || limit.Period <= 0 {
+			return OutputLimit{}, fmt.Errorf("invalid period '%s' in output limit '%s'", period, spec)
+		}
+	}
+	return limit, nil
+}
+
+// String returns the specification of the limit, in the format accepted
+// by ParseOutputLimit.
+func (ol OutputLimit) String() string {
+	if ol.Chars <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d/%s", ol.Chars, ol.Period)
+}
+
+// SetOutputLimit configures the rate of output above which output is
+// paused.  Any existing pause is cancelled.
+func (co *ConsoleOut) SetOutputLimit(limit OutputLimit) {
+	co.limit = limit
+	co.limitStart = time.Time{}
+	co.limitCount = 0
+	co.paused = false
+	co.discarded = 0
+}
+
+// GetOutputLimit returns the rate of output above which output is paused.
+func (co *ConsoleOut) GetOutputLimit() OutputLimit {
+	return co.limit
+}
+
+// Paused returns true if output has been paused, because our limit was
+// exceeded.
+func (co *ConsoleOut) Paused() bool {
+	return co.paused
+}
+
+// Resume resumes output which was paused, returning the number of
+// characters which were discarded while it was paused.
+func (co *ConsoleOut) Resume() int {
+	discarded := co.discarded
+
+	co.paused = false
+	co.discarded = 0
+	co.limitStart = time.Time{}
+	co.limitCount = 0
+	return discarded
+}
+
+// Notify writes the given text via our driver, even if output has been
+// paused, so that the user may be told why.
+func (co *ConsoleOut) Notify(text string) {
+	for _, c := range []byte(text) {
+		co.driver.PutCharacter(c)
+		if co.observer != nil {
+			co.observer(c)
+		}
+	}
+}
+
+// throttled is called before each character is written, and returns true
+// if it should be discarded, because output is paused.
+func (co *ConsoleOut) throttled() bool {
+
+	if co.limit.Chars <= 0 {
+		return false
+	}
+
+	if co.paused {
+		co.discarded++
+		return true
+	}
+
+	now := time.Now()
+	if now.Sub(co.limitStart) >= co.limit.Period {
+		co.limitStart = now
+		co.limitCount = 0
+	}
+
+	co.limitCount++
+	if co.limitCount > co.limit.Chars {
+		co.paused = true
+		co.discarded = 1
+		return true
+	}
+	return false
+}
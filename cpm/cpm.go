@@ -9,13 +9,15 @@ package cpm
 import (
 	"context"
 	"embed"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/koron-go/z80"
@@ -23,7 +25,9 @@ import (
 	"github.com/skx/cpmulator/consolein"
 	"github.com/skx/cpmulator/consoleout"
 	"github.com/skx/cpmulator/fcb"
+	"github.com/skx/cpmulator/gsx"
 	"github.com/skx/cpmulator/memory"
+	"github.com/skx/cpmulator/rotate"
 )
 
 var (
@@ -56,6 +60,11 @@ var (
 	DefaultOutputDriver string = "adm-3a"
 )
 
+// bdosSerial contains the serial number we place at the start of our BDOS.
+//
+// The second byte is the CP/M version (2.2), the remainder are zero.
+var bdosSerial = []byte{0x00, 0x22, 0x00, 0x00, 0x00, 0x00}
+
 // CPMHandlerType contains the signature of a function we use to
 // emulate a CP/M BIOS or BDOS function.
 //
@@ -73,6 +82,9 @@ type CPMHandler struct {
 	// Desc contain the human-readable name of the given CP/M syscall.
 	Desc string
 
+	// Summary contains a short description of what the syscall does.
+	Summary string
+
 	// Handler contains the function which should be invoked for
 	// this syscall.
 	Handler CPMHandlerType
@@ -101,8 +113,12 @@ type FileCache struct {
 	// on the host-side.
 	name string
 
+	// drive holds the drive letter the file was opened upon, so that
+	// we can close the handle if that drive is remapped.
+	drive string
+
 	// handle has the file handle of the opened file.
-	handle *os.File
+	handle DriveFile
 }
 
 // CPM is the object that holds our emulator state.
@@ -121,10 +137,20 @@ type CPM struct {
 	// files is the cache we use for File handles.
 	files map[uint16]FileCache
 
+	// stale records the cache-keys of files which were closed because
+	// the drive they were opened upon was remapped, so that we can
+	// return an error to the guest if it tries to use them.
+	stale map[uint16]string
+
 	// virtual contains a reference to a static filesystem which
 	// is embedded within our binary, if any.
 	static embed.FS
 
+	// backends contains the read-only drives, such as ZIP archives, which
+	// have been mounted beneath the host directories of our drives, in
+	// place of the embedded files, indexed by drive letter.
+	backends map[string]Drive
+
 	// input is our interface for reading from the console.
 	//
 	// This needs to take account of echo/no-echo status.
@@ -141,6 +167,124 @@ type CPM struct {
 	// prnPath contains the filename to write all printer-output to.
 	prnPath string
 
+	// prnRotate controls the rotation of the files printer-output is
+	// written to.
+	prnRotate rotate.Limit
+
+	// printer holds the state of our printer output.
+	printer printer
+
+	// listDevices holds the printers assigned to each of the LST:
+	// devices, TTY:, CRT:, LPT:, and UL1:, if they've been configured.
+	listDevices [4]*printer
+
+	// crashPath contains the path to write a crash report to, if a
+	// guest program fails.  "-" means STDERR, and empty disables.
+	crashPath string
+
+	// profilePath contains the path to write a profile of the syscalls
+	// made by guests to.  "-" means STDERR, and empty disables.
+	profilePath string
+
+	// profile holds the statistics for each syscall, if profiling is
+	// enabled, see cpm_profile.go.
+	profile map[string]*syscallStats
+
+	// readOnlyFS is true if changes made by guests are held in memory,
+	// rather than being written to the host.
+	readOnlyFS bool
+
+	// scratch holds the changes made to each drive, keyed by drive
+	// letter, when the filesystem is read-only.
+	scratch map[string]*scratchState
+
+	// ramDrives holds the files of the drives which are held in memory,
+	// keyed by drive letter, see cpm_ramdrive.go.
+	ramDrives map[string]*scratchState
+
+	// hostWrites records when the guest last changed each host file,
+	// indexed by absolute path, see cpm_hostdrive.go.
+	hostWrites map[string]time.Time
+
+	// hostWritesMutex protects hostWrites, which is read by our watch-mode.
+	hostWritesMutex sync.Mutex
+
+	// manifestPath contains the path to write a manifest of the host files
+	// changed by guests to.  "-" means STDERR, and empty disables.
+	manifestPath string
+
+	// manifest holds the changes made to host files, in order, see
+	// cpm_manifest.go.
+	manifest []manifestEntry
+
+	// manifestSeen records the host files which are already recorded as
+	// created, or modified, in our manifest.
+	manifestSeen map[string]bool
+
+	// protect is the protection applied when a guest deletes, or renames,
+	// files using a wildcard, see cpm_protect.go.
+	protect string
+
+	// created records the files created by the guest, keyed by drive and
+	// name, when the ProtectSession protection is in use.
+	created map[string]bool
+
+	// casePolicy controls how CP/M filenames are mapped to the names
+	// of files on the host, see cpm_resolver.go.
+	casePolicy string
+
+	// longNames is true if host files with names which don't fit
+	// the 8.3 format should be visible via aliases.
+	longNames bool
+
+	// killKey is the key which terminates the emulator, see
+	// cpm_interrupt.go.  Zero disables it.
+	killKey byte
+
+	// legacyEditing is true if C_READSTRING should use the editing keys
+	// documented by Digital Research, rather than our modern ones.
+	legacyEditing bool
+
+	// inputCharset is the character set non-ASCII console input is
+	// converted to, see consolein/charset.go.
+	inputCharset string
+
+	// stuffPacing configures the pacing of stuffed input, such as
+	// that used to run AUTOEXEC.SUB.
+	stuffPacing consolein.StuffPacing
+
+	// bufferDelay is the longest time console output is held in a
+	// buffer before it is written, zero disables buffering.
+	bufferDelay time.Duration
+
+	// outputLimit configures the rate of output above which output is
+	// paused, see cpm_throttle.go.
+	outputLimit consoleout.OutputLimit
+
+	// monitorKey is the key which drops the user into our interactive
+	// monitor, zero disables it.
+	monitorKey byte
+
+	// watchpoints holds the ranges of memory we're watching, and
+	// watchHit the access which triggered one, see cpm_watchpoint.go.
+	watchpoints []watchpoint
+	watchHit    *watchHit
+
+	// watchMuted is true while the emulator inspects memory on behalf
+	// of the user, which shouldn't trigger watchpoints.
+	watchMuted bool
+
+	// readingLine is true while a line of console input is being read,
+	// via C_READSTRING.
+	readingLine bool
+
+	// pcHistory holds the addresses of the most recently executed
+	// instructions, and pcCount the number recorded, while stepping
+	// is true.
+	pcHistory [watchHistory]uint16
+	pcCount   int
+	stepping  bool
+
 	// start contains the location to which we load our binaries,
 	// and execute them from.  This is specifically a variable because
 	// while all CP/M binaries are loaded at 0x0100 the CCP we can
@@ -158,6 +302,29 @@ type CPM struct {
 	// This might need to be moved, in rare situations.
 	bdosAddress uint16
 
+	// defaultBIOS and defaultBDOS hold the addresses of the BIOS and
+	// BDOS, before any compatibility quirks were applied.
+	defaultBIOS uint16
+	defaultBDOS uint16
+
+	// compat holds the user's compatibility entries, and quirks holds
+	// the entry for the binary we're running, see cpm_compat.go.
+	compat []compatEntry
+	quirks *compatEntry
+
+	// autoOutput is true if the output driver named by a compatibility
+	// entry should be selected while its binary runs, and autoRestore
+	// holds the driver to restore afterwards, if we changed it.
+	autoOutput  bool
+	autoRestore string
+
+	// defaultCPU8080, and defaultRSX, hold our settings before any
+	// compatibility entry changed them, and compatDrives holds the
+	// drives an entry changed.
+	defaultCPU8080 bool
+	defaultRSX     bool
+	compatDrives   map[string]compatDrive
+
 	// BDOSSyscalls contains details of the BDOS syscalls we
 	// know how to emulate, indexed by their ID.
 	BDOSSyscalls map[uint8]CPMHandler
@@ -177,6 +344,13 @@ type CPM struct {
 	// Drives specifies the local paths for each directory.
 	drives map[string]string
 
+	// drivesMutex protects drives, which are read by our web interface.
+	drivesMutex sync.RWMutex
+
+	// mounts holds the original paths of drives which have been
+	// remapped at runtime, via MountDrive, indexed by drive letter.
+	mounts map[string]string
+
 	// currentDrive contains the currently selected drive.
 	// Valid values are 0-15, where they work in the obvious way:
 	// 0  -> A:
@@ -189,18 +363,33 @@ type CPM struct {
 	// Valid values are 0-15.
 	userNumber uint8
 
-	// findFirstResults is a sneaky cache of files that match a glob.
+	// namedDirs maps the names of ZCPR-style named directories, such as
+	// "WORK", to the drive and user number they refer to.
+	namedDirs map[string]fcb.DU
+
+	// finds holds the state of the searches started by "find first",
+	// keyed by the address of the FCB used to start them.
 	//
 	// For finding files CP/M uses "find first" to find the first result
 	// then allows the programmer to call "find next", to continue the searching.
 	//
 	// This means we need to track state, the way we do this is to store the
-	// results here, and bump the findOffset each time find-next is called.
-	findFirstResults []fcb.FCBFind
+	// results of each search, and bump its offset each time find-next is
+	// called.  Keeping a search per-FCB allows a program to interleave
+	// several searches, see cpm_dircache.go.
+	finds map[uint16]*findState
+
+	// lastFind is the most recent search, which is continued by "find next"
+	// if the FCB it is given didn't start a search of its own.
+	lastFind *findState
+
+	// dirCacheTTL is the length of time for which a snapshot of a drive's
+	// directory may be reused by "find first".  Zero disables caching.
+	dirCacheTTL time.Duration
 
-	// findOffset contains the index into findFirstResults which is
-	// to be read next.
-	findOffset int
+	// dirCache holds the snapshots of the directories of our drives,
+	// keyed by drive letter, see cpm_dircache.go.
+	dirCache map[string]dirSnapshot
 
 	// simpleDebug is used to just output the name of syscalls made.
 	//
@@ -210,6 +399,127 @@ type CPM struct {
 
 	// launchTime is the time at which the application was launched
 	launchTime time.Time
+
+	// deterministic is true if guests see a synthetic clock, and a
+	// fixed terminal size, see cpm_deterministic.go.
+	deterministic bool
+
+	// syscallCount is the number of syscalls which have been made,
+	// which drives our clock in deterministic mode.
+	syscallCount int64
+
+	// termWidth and termHeight contain a fixed terminal size to report
+	// to guests, if non-zero, rather than querying the host terminal.
+	//
+	// This is useful when running in batch-mode, where STDIN is not
+	// a terminal.
+	termWidth  int
+	termHeight int
+
+	// sizeMutex protects the terminal size, which may be updated by
+	// a signal-handler while guests are running.
+	sizeMutex sync.Mutex
+
+	// sizeWidth and sizeHeight contain the most recently seen size
+	// of the host terminal.
+	sizeWidth  int
+	sizeHeight int
+
+	// sizeChanged is set when the host terminal is resized, and cleared
+	// when a guest polls for that.
+	sizeChanged bool
+
+	// stopResize is used to stop watching for terminal resizes.
+	stopResize func()
+
+	// printerEcho is set when console output should also be sent
+	// to the printer, it is toggled by pressing Ctrl-P.
+	printerEcho bool
+
+	// lastBreakCheck holds the time at which we last checked for
+	// pending console input while writing output.
+	lastBreakCheck time.Time
+
+	// returnCode holds the program return code, which may be set
+	// via the SCB, or P_CODE.
+	returnCode uint16
+
+	// keepMemory is true if RAM shouldn't be cleared when a binary is
+	// loaded, see cpm_chain.go.
+	keepMemory bool
+
+	// symbols maps addresses to the labels of the program which is
+	// running, loaded from its .SYM file, see cpm_symbols.go.
+	symbols map[uint16]string
+
+	// consoleMode holds the console mode, as set by C_MODE.
+	consoleMode uint16
+
+	// delimiter terminates the strings written by C_WRITESTRING, it
+	// may be changed via C_DELIMIT.
+	delimiter uint8
+
+	// gsx is our graphics canvas, if GSX has been enabled, see
+	// cpm_graphics.go.
+	gsx *gsx.Canvas
+
+	// serial holds our serial number, which is placed before the BDOS
+	// entry-point, and returned by S_SERIAL.
+	serial []byte
+
+	// errorMode holds the BDOS error mode, as set by F_ERRMODE.
+	errorMode uint8
+
+	// rsx is set if we're running in RSX-compatible mode.
+	//
+	// In this mode the page-zero vectors are real jumps, rather than
+	// being trapped, so that guests may hook them to install resident
+	// extensions.  Any hooks are preserved across warm boots.
+	rsx bool
+
+	// cpu8080 is true if programs should be stopped when they execute
+	// Z80-only instructions, see cpm_cpu8080.go.
+	cpu8080 bool
+
+	// kbdInterrupt is the interrupt raised when console input is
+	// pending, if any, see cpm_keyinterrupt.go.
+	kbdInterrupt *z80.Interrupt
+
+	// kbdPoll counts the instructions executed, so that we only poll
+	// for input periodically.
+	kbdPoll int
+
+	// maxInstructions is the number of instructions we'll execute
+	// before terminating, zero for no limit, and instructions the
+	// number executed so far, see cpm_maxinstructions.go.
+	maxInstructions int64
+	instructions    int64
+
+	// idleSleep is the longest time we sleep when a program polls the
+	// console status in a loop, zero to disable, see cpm_idlepoll.go.
+	idleSleep time.Duration
+
+	// idlePolls counts consecutive polls which found no input, idleDelay
+	// is the time we last slept, and idleLast the time of the last poll.
+	idlePolls int
+	idleDelay time.Duration
+	idleLast  time.Time
+
+	// tailCase is set if the case of the command tail is preserved,
+	// see cpm_cmdtail.go.
+	tailCase bool
+
+	// events is our event bus, if enabled, see cpm_events.go.
+	events *eventBus
+
+	// transcript records our session, if enabled, see cpm_transcript.go.
+	transcript *transcript
+
+	// exit tracks how programs end, see cpm_exitreason.go.
+	exit exitState
+
+	// httpServer serves our web interface, if enabled, see cpm_webui.go.
+	httpServer *http.Server
 }
 
 // ccpoption defines a config-setting option for our constructor.
@@ -234,6 +544,37 @@ func WithPrinterPath(path string) cpmoption {
 	}
 }
 
+// WithPrinterRotation rotates the files printer-output is written to, once
+// they would exceed the given limit, rather than letting them grow forever.
+func WithPrinterRotation(limit rotate.Limit) cpmoption {
+	return func(c *CPM) error {
+		c.prnRotate = limit
+		return nil
+	}
+}
+
+// WithSerialNumber sets the serial number which is placed before the BDOS
+// entry-point, and returned by S_SERIAL, which some installers examine.
+//
+// The serial number is six bytes, given as twelve hex digits, which may
+// be separated by "-" or ":", for example "00-22-00-01-23-45".  The empty
+// string uses our default.
+func WithSerialNumber(spec string) cpmoption {
+	return func(c *CPM) error {
+		if spec == "" {
+			return nil
+		}
+
+		digits := strings.NewReplacer("-", "", ":", "").Replace(spec)
+		serial, err := hex.DecodeString(digits)
+		if err != nil || len(serial) != len(bdosSerial) {
+			return fmt.Errorf("invalid serial number '%s', expected %d hex bytes", spec, len(bdosSerial))
+		}
+		c.serial = serial
+		return nil
+	}
+}
+
 // WithOutputDriver allows the default console output driver to be changed in our constructor.
 func WithOutputDriver(name string) cpmoption {
 
@@ -273,6 +614,136 @@ func WithHostExec(prefix string) cpmoption {
 	}
 }
 
+// WithLegacyLineEditing configures whether the line-editor used by
+// C_READSTRING implements the editing keys documented by Digital Research,
+// such as Ctrl-R to retype the line, and Ctrl-U to discard it, rather than
+// our modern ones, which support history.
+func WithLegacyLineEditing(enabled bool) cpmoption {
+	return func(c *CPM) error {
+		c.legacyEditing = enabled
+		return nil
+	}
+}
+
+// WithInputCharset configures the character set which non-ASCII console
+// input, such as accented characters, is converted to before programs see
+// it.  The names are described in consolein/charset.go, for example "ascii"
+// or "raw".
+//
+// The empty string selects the default, consolein.DefaultCharset.
+func WithInputCharset(name string) cpmoption {
+	return func(c *CPM) error {
+		c.inputCharset = name
+		return nil
+	}
+}
+
+// WithOutputBuffer enables the buffering of console output, which makes
+// large amounts of output much faster over slow terminals.  Output is held
+// for no longer than the given delay, and is always written before input
+// is read.
+//
+// A delay of zero disables buffering, which is the default.
+func WithOutputBuffer(delay time.Duration) cpmoption {
+	return func(c *CPM) error {
+		if delay < 0 {
+			return fmt.Errorf("invalid output buffer delay %s", delay)
+		}
+		c.bufferDelay = delay
+		return nil
+	}
+}
+
+// WithStuffPacing configures the pacing of stuffed input, such as that used
+// to run AUTOEXEC.SUB, so that it doesn't arrive faster than the guest can
+// handle it.  The specification is described in consolein/pacing.go, for
+// example "4/10ms" or "read".
+//
+// The empty string disables pacing, which is the default.
+func WithStuffPacing(spec string) cpmoption {
+	return func(c *CPM) error {
+		pacing, err := consolein.ParseStuffPacing(spec)
+		if err != nil {
+			return err
+		}
+		c.stuffPacing = pacing
+		return nil
+	}
+}
+
+// WithTerminalSize sets a fixed size to report when guests query the size
+// of the terminal, instead of querying the host.
+//
+// A size of zero, in both dimensions, means the host terminal is queried.
+func WithTerminalSize(width, height int) cpmoption {
+	return func(c *CPM) error {
+		if width == 0 && height == 0 {
+			return nil
+		}
+		if width < 1 || width > 255 || height < 1 || height > 255 {
+			return fmt.Errorf("invalid terminal size %dx%d", width, height)
+		}
+		c.termWidth = width
+		c.termHeight = height
+		return nil
+	}
+}
+
+// WithRSX enables, or disables, RSX-compatible mode.
+//
+// In RSX-compatible mode guests may hook the BDOS, and warm boot, vectors
+// in page zero and those hooks will survive warm boots.
+func WithRSX(enabled bool) cpmoption {
+	return func(c *CPM) error {
+		c.rsx = enabled
+		return nil
+	}
+}
+
+// WithCommands causes the given commands to be used as our console input,
+// rather than reading from the console, so that they're run by the CCP.
+//
+// The commands are separated by ";", or newlines, and each is given to
+// the CCP as it reads a line.  Once they've been consumed the next attempt
+// to read console input terminates the emulation, which allows cpmulator
+// to be used from scripts and Makefiles, and CommandFailed reports whether
+// they all succeeded.
+//
+// Each command may redirect its console input, and output, to host files
+// via "<", ">", and ">>", see cpm_redirect.go.
+//
+// This replaces any input driver which was previously configured.
+func WithCommands(cmds string) cpmoption {
+	return func(c *CPM) error {
+
+		split := func(r rune) bool {
+			return r == ';' || r == '\n' || r == '\r'
+		}
+
+		var lines []commandLine
+		for _, cmd := range strings.FieldsFunc(cmds, split) {
+			cmd = strings.TrimSpace(cmd)
+			if cmd == "" {
+				continue
+			}
+
+			// Commands may redirect their input, and output.
+			line, err := parseRedirection(cmd)
+			if err != nil {
+				return err
+			}
+			lines = append(lines, line)
+		}
+
+		if len(lines) == 0 {
+			return nil
+		}
+
+		c.input = consolein.NewFromDriver(&commandInput{cpm: c, lines: lines})
+		return nil
+	}
+}
+
 // New returns a new emulation object.  We support default options,
 // and new defaults may be specified via WithOutputDriver, etc, etc.
 func New(options ...cpmoption) (*CPM, error) {
@@ -283,173 +754,218 @@ func New(options ...cpmoption) (*CPM, error) {
 	bdos := make(map[uint8]CPMHandler)
 	bdos[0] = CPMHandler{
 		Desc:    "P_TERMCPM",
+		Summary: "Terminate the running program",
 		Handler: BdosSysCallExit,
 	}
 	bdos[1] = CPMHandler{
 		Desc:    "C_READ",
+		Summary: "Read a character from the console, with echo",
 		Handler: BdosSysCallReadChar,
 		Noisy:   true,
 	}
 	bdos[2] = CPMHandler{
 		Desc:    "C_WRITE",
+		Summary: "Write a character to the console",
 		Handler: BdosSysCallWriteChar,
 		Noisy:   true,
 	}
 	bdos[3] = CPMHandler{
 		Desc:    "A_READ",
+		Summary: "Read a character from the auxiliary device",
 		Handler: BdosSysCallAuxRead,
 		Noisy:   true,
 	}
 	bdos[4] = CPMHandler{
 		Desc:    "A_WRITE",
+		Summary: "Write a character to the auxiliary device",
 		Handler: BdosSysCallAuxWrite,
 		Noisy:   true,
 	}
 	bdos[5] = CPMHandler{
 		Desc:    "L_WRITE",
+		Summary: "Write a character to the printer",
 		Handler: BdosSysCallPrinterWrite,
 		Fake:    true,
 		Noisy:   true,
 	}
 	bdos[6] = CPMHandler{
 		Desc:    "C_RAWIO",
+		Summary: "Direct console input and output",
 		Handler: BdosSysCallRawIO,
 		Noisy:   true,
 	}
 	bdos[7] = CPMHandler{
 		Desc:    "GET_IOBYTE",
+		Summary: "Get the I/O byte",
 		Handler: BdosSysCallGetIOByte,
 	}
 	bdos[8] = CPMHandler{
 		Desc:    "SET_IOBYTE",
+		Summary: "Set the I/O byte",
 		Handler: BdosSysCallSetIOByte,
 	}
 	bdos[9] = CPMHandler{
 		Desc:    "C_WRITESTRING",
+		Summary: "Write a $-terminated string to the console",
 		Handler: BdosSysCallWriteString,
 	}
 	bdos[10] = CPMHandler{
 		Desc:    "C_READSTRING",
+		Summary: "Read a line of input from the console",
 		Handler: BdosSysCallReadString,
 	}
 	bdos[11] = CPMHandler{
 		Desc:    "C_STAT",
+		Summary: "Report whether console input is pending",
 		Handler: BdosSysCallConsoleStatus,
 		Noisy:   true,
 	}
 	bdos[12] = CPMHandler{
 		Desc:    "S_BDOSVER",
+		Summary: "Return the BDOS version number",
 		Handler: BdosSysCallBDOSVersion,
 	}
 	bdos[13] = CPMHandler{
 		Desc:    "DRV_ALLRESET",
+		Summary: "Reset the disk system, selecting A:",
 		Handler: BdosSysCallDriveAllReset,
 	}
 	bdos[14] = CPMHandler{
 		Desc:    "DRV_SET",
+		Summary: "Select the current drive",
 		Handler: BdosSysCallDriveSet,
 	}
 	bdos[15] = CPMHandler{
 		Desc:    "F_OPEN",
+		Summary: "Open a file",
 		Handler: BdosSysCallFileOpen,
 	}
 	bdos[16] = CPMHandler{
 		Desc:    "F_CLOSE",
+		Summary: "Close a file",
 		Handler: BdosSysCallFileClose,
 	}
 	bdos[17] = CPMHandler{
 		Desc:    "F_SFIRST",
+		Summary: "Find the first file matching a pattern",
 		Handler: BdosSysCallFindFirst,
 	}
 	bdos[18] = CPMHandler{
 		Desc:    "F_SNEXT",
+		Summary: "Find the next file matching a pattern",
 		Handler: BdosSysCallFindNext,
 	}
 	bdos[19] = CPMHandler{
 		Desc:    "F_DELETE",
+		Summary: "Delete files matching a pattern",
 		Handler: BdosSysCallDeleteFile,
 	}
 	bdos[20] = CPMHandler{
 		Desc:    "F_READ",
+		Summary: "Read the next record of a file",
 		Handler: BdosSysCallRead,
 	}
 	bdos[21] = CPMHandler{
 		Desc:    "F_WRITE",
+		Summary: "Write the next record of a file",
 		Handler: BdosSysCallWrite,
 	}
 	bdos[22] = CPMHandler{
 		Desc:    "F_MAKE",
+		Summary: "Create a file",
 		Handler: BdosSysCallMakeFile,
 	}
 	bdos[23] = CPMHandler{
 		Desc:    "F_RENAME",
+		Summary: "Rename a file",
 		Handler: BdosSysCallRenameFile,
 	}
 	bdos[24] = CPMHandler{
 		Desc:    "DRV_LOGINVEC",
+		Summary: "Return the bitmap of logged-in drives",
 		Handler: BdosSysCallLoginVec,
 		Fake:    true,
 	}
 	bdos[25] = CPMHandler{
 		Desc:    "DRV_GET",
+		Summary: "Return the current drive",
 		Handler: BdosSysCallDriveGet,
 	}
 	bdos[26] = CPMHandler{
 		Desc:    "F_DMAOFF",
+		Summary: "Set the DMA address",
 		Handler: BdosSysCallSetDMA,
 	}
 	bdos[27] = CPMHandler{
 		Desc:    "DRV_ALLOCVEC",
+		Summary: "Return the address of the allocation vector",
 		Handler: BdosSysCallDriveAlloc,
 		Fake:    true,
 	}
 	bdos[28] = CPMHandler{
 		Desc:    "DRV_SETRO",
+		Summary: "Mark the current drive as read-only",
 		Handler: BdosSysCallDriveSetRO,
 		Fake:    true,
 	}
 	bdos[29] = CPMHandler{
 		Desc:    "DRV_ROVEC",
+		Summary: "Return the bitmap of read-only drives",
 		Handler: BdosSysCallDriveROVec,
 		Fake:    true,
 	}
 	bdos[30] = CPMHandler{
 		Desc:    "F_ATTRIB",
+		Summary: "Set file attributes",
 		Handler: BdosSysCallSetFileAttributes,
 		Fake:    true,
 	}
 	bdos[31] = CPMHandler{
 		Desc:    "DRV_DPB",
+		Summary: "Return the address of the disk parameter block",
 		Handler: BdosSysCallGetDriveDPB,
 		Fake:    true,
 	}
 	bdos[32] = CPMHandler{
 		Desc:    "F_USERNUM",
+		Summary: "Get or set the user number",
 		Handler: BdosSysCallUserNumber,
 	}
 	bdos[33] = CPMHandler{
 		Desc:    "F_READRAND",
+		Summary: "Read a record at a random position",
 		Handler: BdosSysCallReadRand,
 	}
 	bdos[34] = CPMHandler{
 		Desc:    "F_WRITERAND",
+		Summary: "Write a record at a random position",
 		Handler: BdosSysCallWriteRand,
 	}
 	bdos[35] = CPMHandler{
 		Desc:    "F_SIZE",
+		Summary: "Compute the size of a file, in records",
 		Handler: BdosSysCallFileSize,
 	}
 	bdos[36] = CPMHandler{
 		Desc:    "F_RANDREC",
+		Summary: "Set the random record from the sequential position",
 		Handler: BdosSysCallRandRecord,
 	}
 	bdos[37] = CPMHandler{
 		Desc:    "DRV_RESET",
+		Summary: "Reset the given drives",
 		Handler: BdosSysCallDriveReset,
 		Fake:    true,
 	}
+	bdos[39] = CPMHandler{
+		Desc:    "DRV_FREE",
+		Summary: "Release the given drives (MP/M)",
+		Handler: BdosSysCallDriveFree,
+		Fake:    true,
+	}
 	bdos[40] = CPMHandler{
 		Desc:    "F_WRITEZF",
+		Summary: "Write a record at a random position, zero-filling",
 		Handler: BdosSysCallWriteRand,
 
 		// We don't zero-pad
@@ -457,21 +973,70 @@ func New(options ...cpmoption) (*CPM, error) {
 	}
 	bdos[45] = CPMHandler{
 		Desc:    "F_ERRMODE",
+		Summary: "Set the BDOS error mode",
 		Handler: BdosSysCallErrorMode,
+	}
+	bdos[48] = CPMHandler{
+		Desc:    "DRV_FLUSH",
+		Summary: "Write buffered data to the host",
+		Handler: BdosSysCallDriveFlush,
+	}
+	bdos[49] = CPMHandler{
+		Desc:    "S_SCB",
+		Summary: "Get or set a System Control Block value",
+		Handler: BdosSysCallSCB,
 		Fake:    true,
 	}
 	bdos[105] = CPMHandler{
 		Desc:    "T_GET",
+		Summary: "Get the date and time",
 		Handler: BdosSysCallTime,
 		Fake:    true,
 	}
+	bdos[107] = CPMHandler{
+		Desc:    "S_SERIAL",
+		Summary: "Get the serial number",
+		Handler: BdosSysCallSerialNumber,
+	}
+	bdos[108] = CPMHandler{
+		Desc:    "P_CODE",
+		Summary: "Get or set the program return code",
+		Handler: BdosSysCallReturnCode,
+	}
+	bdos[109] = CPMHandler{
+		Desc:    "C_MODE",
+		Summary: "Get or set the console mode",
+		Handler: BdosSysCallConsoleMode,
+	}
+	bdos[110] = CPMHandler{
+		Desc:    "C_DELIMIT",
+		Summary: "Get or set the C_WRITESTRING delimiter",
+		Handler: BdosSysCallDelimiter,
+	}
+	bdos[111] = CPMHandler{
+		Desc:    "C_WRITEBLOCK",
+		Summary: "Write a block of characters to the console",
+		Handler: BdosSysCallWriteBlock,
+	}
+	bdos[112] = CPMHandler{
+		Desc:    "L_WRITEBLOCK",
+		Summary: "Write a block of characters to the printer",
+		Handler: BdosSysCallPrinterWriteBlock,
+	}
 	bdos[113] = CPMHandler{ // used by Turbo Pascal
 		Desc:    "DirectScreenFunctions",
+		Summary: "Turbo Pascal screen functions",
 		Handler: BdosSysCallDirectScreenFunctions,
 		Fake:    true,
 	}
+	bdos[115] = CPMHandler{
+		Desc:    "GSX",
+		Summary: "Invoke the GSX graphics extension",
+		Handler: BdosSysCallGSX,
+	}
 	bdos[248] = CPMHandler{ // used by BBC BASIC v5
 		Desc:    "F_UPTIME",
+		Summary: "Return the ticks since boot (RunCPM)",
 		Handler: BdosSysCallUptime,
 		Fake:    true,
 	}
@@ -482,55 +1047,73 @@ func New(options ...cpmoption) (*CPM, error) {
 	bios := make(map[uint8]CPMHandler)
 	bios[0] = CPMHandler{
 		Desc:    "BOOT",
+		Summary: "Cold boot",
 		Handler: BiosSysCallColdBoot,
 	}
 	bios[1] = CPMHandler{
 		Desc:    "WBOOT",
+		Summary: "Warm boot",
 		Handler: BiosSysCallWarmBoot,
 	}
 	bios[2] = CPMHandler{
 		Desc:    "CONST",
+		Summary: "Report whether console input is pending",
 		Handler: BiosSysCallConsoleStatus,
 		Noisy:   true,
 	}
 	bios[3] = CPMHandler{
 		Desc:    "CONIN",
+		Summary: "Read a character from the console",
 		Handler: BiosSysCallConsoleInput,
 		Noisy:   true,
 	}
 	bios[4] = CPMHandler{
 		Desc:    "CONOUT",
+		Summary: "Write a character to the console",
 		Handler: BiosSysCallConsoleOutput,
 		Noisy:   true,
 	}
 	bios[5] = CPMHandler{
 		Desc:    "LIST",
+		Summary: "Write a character to the printer",
 		Handler: BiosSysCallPrintChar,
 		Fake:    true,
 	}
 	bios[15] = CPMHandler{
 		Desc:    "LISTST",
+		Summary: "Report whether the printer is ready",
 		Handler: BiosSysCallPrinterStatus,
-		Fake:    true,
 	}
 	bios[17] = CPMHandler{
 		Desc:    "CONOST",
+		Summary: "Report whether the console is ready for output",
 		Handler: BiosSysCallScreenOutputStatus,
-		Fake:    true,
 		Noisy:   true,
 	}
 	bios[18] = CPMHandler{
 		Desc:    "AUXIST",
+		Summary: "Report whether auxiliary input is pending",
 		Handler: BiosSysCallAuxInputStatus,
-		Fake:    true,
 	}
 	bios[19] = CPMHandler{
 		Desc:    "AUXOST",
+		Summary: "Report whether the auxiliary device is ready for output",
 		Handler: BiosSysCallAuxOutputStatus,
+	}
+	bios[20] = CPMHandler{
+		Desc:    "DEVTBL",
+		Summary: "Return the address of the character device table",
+		Handler: BiosSysCallDeviceTable,
+	}
+	bios[21] = CPMHandler{
+		Desc:    "DEVINI",
+		Summary: "Initialize a character device",
+		Handler: BiosSysCallDeviceInit,
 		Fake:    true,
 	}
 	bios[31] = CPMHandler{
 		Desc:    "RESERVE1",
+		Summary: "cpmulator extensions, used by our embedded binaries",
 		Handler: BiosSysCallReserved1,
 		Fake:    true,
 	}
@@ -570,16 +1153,25 @@ func New(options ...cpmoption) (*CPM, error) {
 		BDOSSyscalls: bdos,
 		BIOSSyscalls: bios,
 		ccp:          "ccp", // default
+		idleSleep:    DefaultIdleSleep,
 		dma:          0x0080,
 		drives:       make(map[string]string),
+		mounts:       make(map[string]string),
+		backends:     make(map[string]Drive),
+		compatDrives: make(map[string]compatDrive),
 		files:        make(map[uint16]FileCache),
+		stale:        make(map[uint16]string),
+		finds:        make(map[uint16]*findState),
 		input:        iDriver,       // default
 		output:       oDriver,       // default
 		prnPath:      "printer.log", // default
 		start:        0x0100,
 		launchTime:   time.Now(),
+		casePolicy:   CaseExact,
 		biosAddress:  envNumber("BIOS_ADDRESS", 0xCE00),
 		bdosAddress:  envNumber("BDOS_ADDRESS", 0xC000),
+		delimiter:    '$',
+		serial:       bdosSerial,
 	}
 
 	// Allow options to override our defaults
@@ -590,17 +1182,90 @@ func New(options ...cpmoption) (*CPM, error) {
 		}
 	}
 
+	// Remember where our BIOS and BDOS live, so that we can restore
+	// them after running a binary which relocated them.
+	tmp.defaultBIOS = tmp.biosAddress
+	tmp.defaultBDOS = tmp.bdosAddress
+	tmp.defaultCPU8080 = tmp.cpu8080
+	tmp.defaultRSX = tmp.rsx
+
+	// Allow the user to reach our monitor.
+	tmp.input.SetEscapeHandler(tmp.monitorKey, tmp.monitor)
+
+	// Allow the user to terminate the emulator.
+	tmp.input.SetKillKey(tmp.killKey)
+
+	// Select the line-editor.
+	tmp.input.SetLegacyEditing(tmp.legacyEditing)
+
+	// Convert non-ASCII input.
+	if tmp.inputCharset != "" {
+		err := tmp.input.SetCharset(tmp.inputCharset)
+		if err != nil {
+			return tmp, err
+		}
+	}
+
+	// Pace stuffed input.
+	tmp.input.SetStuffPacing(tmp.stuffPacing)
+
+	// Pause runaway output.
+	tmp.output.SetOutputLimit(tmp.outputLimit)
+
+	// Buffer our output, flushing it before input is read so that
+	// prompts are visible.
+	tmp.output.SetBufferDelay(tmp.bufferDelay)
+	tmp.input.SetReadHook(tmp.output.Flush)
+
+	// Output from host commands goes via our output driver.
+	tmp.input.SetSystemCommandOutput(&consoleWriter{cpm: tmp})
+
+	// Tell our output driver the size of the screen, so that it can
+	// track the cursor.
+	tmp.syncScreenSize()
+
+	// Observe our console output, so that our input knows when the
+	// guest is working, and for the event bus and our transcript.
+	tmp.output.SetObserver(tmp.observeOutput)
+
+	// Connect our console to the event bus, and our transcript, if
+	// they're enabled.
+	tmp.connectEvents()
+	tmp.connectTranscript()
+
 	return tmp, nil
 }
 
 // IOSetup ensures that our I/O is ready.
+//
+// Unless we've been configured with a fixed terminal size we also
+// start watching for the host terminal being resized.
 func (cpm *CPM) IOSetup() {
 	cpm.input.Setup()
+
+	if cpm.termWidth == 0 && cpm.stopResize == nil {
+
+		// Record the size first, so that the first resize is
+		// noticed, even if the guest hasn't asked for the size.
+		cpm.updateTerminalSize()
+		cpm.stopResize = cpm.watchTerminalSize()
+	}
 }
 
 // IOTearDown cleans up the state of the terminal, if necessary.
 func (cpm *CPM) IOTearDown() {
+	cpm.output.TearDown()
 	cpm.input.TearDown()
+	cpm.closePrinter()
+	cpm.flushFiles()
+
+	if cpm.stopResize != nil {
+		cpm.stopResize()
+		cpm.stopResize = nil
+	}
+	cpm.closeHTTP()
+	cpm.closeEvents()
+	cpm.closeTranscript()
 }
 
 // GetInputDriver returns the configured input driver.
@@ -632,6 +1297,44 @@ func (cpm *CPM) GetBDOSAddress() uint16 {
 	return cpm.bdosAddress
 }
 
+// logEnabled returns true if log messages at the given level will be
+// written.
+//
+// Building a log record is expensive, relative to many of our syscalls,
+// so this allows us to skip that work entirely when it isn't needed.
+func logEnabled(level slog.Level) bool {
+	return slog.Default().Enabled(context.Background(), level)
+}
+
+// logSyscall logs the invocation of the given syscall, unless it is a
+// noisy one, and shows it if simple debugging is enabled.
+func (cpm *CPM) logSyscall(kind string, num uint8, handler CPMHandler) {
+
+	if handler.Noisy {
+		return
+	}
+
+	// show the function being invoked, after any buffered output.
+	if cpm.simpleDebug {
+		cpm.output.Flush()
+		fmt.Printf("%03d %s\n", num, handler.Desc)
+	}
+
+	if !logEnabled(slog.LevelInfo) {
+		return
+	}
+
+	slog.LogAttrs(context.Background(), slog.LevelInfo, kind,
+		slog.String("name", handler.Desc),
+		slog.Int("syscall", int(num)),
+		slog.String("syscallHex", fmt.Sprintf("0x%02X", num)),
+		slog.Group("registers",
+			slog.String("AF", fmt.Sprintf("%04X", cpm.CPU.States.AF.U16())),
+			slog.String("BC", fmt.Sprintf("%04X", cpm.CPU.States.BC.U16())),
+			slog.String("DE", fmt.Sprintf("%04X", cpm.CPU.States.DE.U16())),
+			slog.String("HL", fmt.Sprintf("%04X", cpm.CPU.States.HL.U16()))))
+}
+
 // LogNoisy enables logging support for each of the functions which
 // would otherwise be disabled
 func (cpm *CPM) LogNoisy() {
@@ -655,12 +1358,32 @@ func (cpm *CPM) LoadBinary(filename string) error {
 		cpm.Memory = new(memory.Memory)
 	}
 
-	// Load our binary into the memory
-	err := cpm.Memory.LoadFile(cpm.start, filename)
+	prog, err := os.ReadFile(filename)
 	if err != nil {
 		return (fmt.Errorf("failed to load %s: %s", filename, err))
 	}
 
+	// Apply any quirks the binary needs.
+	cpm.applyCompat(cpm.findCompat(filename, prog))
+
+	// Name the binary, should we need to report how it ended.
+	cpm.programBinary(filename)
+
+	// Load any symbols for the binary.
+	cpm.loadSymbols(filename)
+
+	// Each program starts with a successful return code, and the
+	// default console mode.
+	cpm.returnCode = 0
+	cpm.consoleMode = 0
+
+	// Clear the memory, unless the binary doesn't want that, and
+	// load our binary into it.
+	if cpm.zeroFill() && !cpm.keepMemory {
+		cpm.Memory.FillRange(0x0000, 0x10000, 0x00)
+	}
+	cpm.Memory.SetRange(cpm.start, prog...)
+
 	//
 	// Any command-line arguments need to be copied to the DMA area,
 	// which defaults to 0x0080, as a pascal-prefixed string.
@@ -710,7 +1433,7 @@ func (cpm *CPM) fixupRAM() {
 	BIOS := int(cpm.biosAddress)
 	BDOS := int(cpm.bdosAddress)
 
-	NENTRY := 30
+	NENTRY := biosEntries
 
 	SETMEM := func(a int, v int) {
 		cpm.Memory.Set(uint16(a), uint8(v))
@@ -725,19 +1448,43 @@ func (cpm *CPM) fixupRAM() {
 	// turbo pascal, and other programs presumably, look at
 	// the following address to see how much free RAM is available.
 	//
-	SETMEM(0x0000, 0x76)                /* HALT */
-	SETMEM(0x0001, ((BIOS + 3) & 0xFF)) /* Fake address of entry-point */
-	SETMEM(0x0002, ((BIOS + 3) >> 8))
+	// In RSX-compatible mode we use real jumps instead, and if a
+	// guest has changed the destinations we leave them alone.
+	//
+	BOOT := BIOS + 3
+	ENTRY := BDOS + 6
+	OPCODE := 0x76 /* HALT */
+	if cpm.rsx {
+		OPCODE = 0xC3 /* JP */
+
+		if cpm.Memory.Get(0x0000) == 0xC3 {
+			BOOT = int(cpm.Memory.GetU16(0x0001))
+		}
+		if cpm.Memory.Get(0x0005) == 0xC3 {
+			ENTRY = int(cpm.Memory.GetU16(0x0006))
+		}
+	}
+
+	SETMEM(0x0000, OPCODE)
+	SETMEM(0x0001, (BOOT & 0xFF)) /* Fake address of entry-point */
+	SETMEM(0x0002, (BOOT >> 8))
 
 	// We setup a fake jump here, because 0x0006 is sometimes
 	// used to find the free RAM and we pretend our BDOS is at 0xDC00
-	SETMEM(0x0005, 0x76)                /* HALT */
-	SETMEM(0x0006, ((BDOS + 6) & 0xFF)) /* Fake Address of entry point */
-	SETMEM(0x0007, ((BDOS + 6) >> 8))
+	SETMEM(0x0005, OPCODE)
+	SETMEM(0x0006, (ENTRY & 0xFF)) /* Fake Address of entry point */
+	SETMEM(0x0007, (ENTRY >> 8))
 
 	// Now we setup the initial values of the I/O byte
 	SETMEM(0x0003, 0x00)
 
+	// The six bytes preceding the BDOS entry-point are the serial
+	// number.  Some programs, and debuggers, examine these so we
+	// make sure something sane is present.
+	for n, b := range cpm.serial {
+		SETMEM(BDOS+n, int(b))
+	}
+
 	// fake BIOS entry points for 30 syscalls.
 	//
 	// These are setup so that the RST instructions magically
@@ -749,7 +1496,7 @@ func (cpm *CPM) fixupRAM() {
 	//
 	//     func (cpm *CPM) Out(addr uint8, val uint8)
 	//
-	for i < 30 {
+	for i < NENTRY {
 		/* JP <bios-entry> */
 		SETMEM(BIOS+3*i, 0xC3)
 		SETMEM(BIOS+3*i+1, (BIOS+NENTRY*3+i*5)&0xFF)
@@ -768,6 +1515,11 @@ func (cpm *CPM) fixupRAM() {
 		i++
 	}
 
+	// The character device table, for DEVTBL, follows.
+	cpm.writeDeviceTable()
+
+	// The Z-System environment, if our CCP wants one.
+	cpm.setupZSystem()
 }
 
 // LoadCCP loads the CCP into RAM, to be executed instead of an external binary.
@@ -793,6 +1545,9 @@ func (cpm *CPM) LoadCCP() error {
 	// Load it into memory
 	cpm.Memory.SetRange(helper.Start, helper.Bytes...)
 
+	// The console mode set by the previous program is forgotten.
+	cpm.consoleMode = 0
+
 	// DMA area / CLI Args are going to be unset.
 	cpm.Memory.Set(0x0080, 0x00)
 	cpm.Memory.FillRange(0x0081, 31, 0x00)
@@ -808,10 +1563,17 @@ func (cpm *CPM) LoadCCP() error {
 	// Ensure our starting point is what we expect
 	cpm.start = helper.Start
 
+	// The CCP needs no quirks.
+	cpm.applyCompat(nil)
+
 	// patch low-memory so that RST instructions will
 	// ultimately invoke our CP/M syscalls, via our "Out"
 	// function.
+	//
+	// The IOByte survives the reload, as it would a warm boot.
+	iobyte := cpm.Memory.Get(0x0003)
 	cpm.fixupRAM()
+	cpm.Memory.Set(0x0003, iobyte)
 
 	return nil
 }
@@ -821,6 +1583,19 @@ func (cpm *CPM) LoadCCP() error {
 // The function will not return until the process being executed terminates,
 // and any error will be returned.
 func (cpm *CPM) Execute(args []string) error {
+	return cpm.ExecuteContext(context.Background(), args)
+}
+
+// ExecuteContext is like Execute, but allows the caller to terminate the
+// execution by canceling the given context.
+//
+// If the context is canceled the context's error will be returned.
+// Cancellation is noticed between instructions, and a binary which is
+// blocked waiting for console input has that read abandoned.
+func (cpm *CPM) ExecuteContext(ctx context.Context, args []string) error {
+
+	// Ensure all the output of the binary is visible when we return.
+	defer cpm.output.Flush()
 
 	// Reset any cached filehandles.
 	//
@@ -832,6 +1607,25 @@ func (cpm *CPM) Execute(args []string) error {
 		obj.handle.Close()
 	}
 	cpm.files = make(map[uint16]FileCache)
+	cpm.stale = make(map[uint16]string)
+
+	// Forget any in-progress searches, and directory snapshots, as
+	// the previous binary might have changed the contents of our drives.
+	cpm.finds = make(map[uint16]*findState)
+	cpm.lastFind = nil
+	cpm.invalidateDirCache()
+
+	// Ensure anything the binary wrote, but didn't close, reaches the
+	// host when it terminates.
+	defer cpm.flushFiles()
+
+	// A command whose input, or output, was redirected has finished
+	// when the binary terminates.
+	defer cpm.endRedirection()
+
+	// Abandon any read of console input when we're canceled.
+	cpm.input.SetStop(ctx.Done())
+	defer cpm.input.SetStop(nil)
 
 	// Create the CPU, pointing to our memory, and setting the initial program counter
 	// to point to our expected entry-point.
@@ -875,40 +1669,45 @@ func (cpm *CPM) Execute(args []string) error {
 	cpm.CPU.BreakPoints[BIOS+3] = struct{}{}
 	cpm.CPU.BreakPoints[BDOS] = struct{}{}
 	cpm.CPU.BreakPoints[BDOS+6] = struct{}{}
-	cpm.CPU.BreakPoints[0x0005] = struct{}{}
-
-	// Convert our array of CLI arguments to a string.
-	cli := strings.Join(args, " ")
-	cli = strings.TrimSpace(strings.ToUpper(cli))
 
-	// Setup FCB1 if we have a first argument
-	if len(args) > 0 {
-		x := fcb.FromString(args[0])
-		cpm.Memory.SetRange(0x005C, x.AsBytes()...)
+	// In RSX-compatible mode calls to 0x0005 jump to the address
+	// stored at 0x0006, which will be BDOS+6, unless a guest has
+	// hooked it, so we don't trap them here.
+	if !cpm.rsx {
+		cpm.CPU.BreakPoints[0x0005] = struct{}{}
 	}
 
-	// Setup FCB2 if we have a second argument
-	if len(args) > 1 {
-		x := fcb.FromString(args[1])
-		cpm.Memory.SetRange(0x006C, x.AsBytes()...)
+	// Setup the command tail, and the default FCBs, from our arguments.
+	err := cpm.setCommandTail(args)
+	if err != nil {
+		return err
 	}
 
-	// Poke in the CLI argument as a Pascal string.
-	// (i.e. length prefixed)
-	if len(cli) > 0 {
+	// Watch memory, if we've been asked to.
+	cpm.watchHit = nil
+	cpm.watchMemory()
 
-		// Setup the CLI arguments - these are set as a pascal string
-		// (i.e. first byte is the length, then the data follows).
-		cpm.Memory.Set(0x0080, uint8(len(cli)))
-		for i, c := range cli {
-			cpm.Memory.SetRange(0x0081+uint16(i), uint8(c))
-		}
+	// Note programs starting, so we can report how they end.
+	//
+	// A binary launched directly starts now, and we give it a stack
+	// which returns to 0x0000, as the CCP would, rather than into
+	// whatever is found at the top of RAM.  Programs the CCP launches
+	// start when execution reaches 0x0100.
+	cpm.exit.running = false
+	if cpm.start == 0x0100 {
+		cpm.CPU.States.SP = 0xFFFE
+		cpm.Memory.Set(0xFFFE, 0x00)
+		cpm.Memory.Set(0xFFFF, 0x00)
+		cpm.zsystemProgram()
+		cpm.programStarted()
+	} else {
+		cpm.CPU.BreakPoints[0x0100] = struct{}{}
 	}
 
 	// Run forever :)
 	for {
 		// Run until we hit an error
-		err := cpm.CPU.Run(context.Background())
+		err := cpm.runCPU(ctx)
 
 		// If we ended up here because the I/O handler received
 		// an error, and then HALTed the emulator we'll process it
@@ -918,23 +1717,95 @@ func (cpm *CPM) Execute(args []string) error {
 			cpm.biosErr = nil
 		}
 
+		// Did the guest trigger a watchpoint?  If so report it,
+		// and then continue.
+		if err == nil && cpm.watchHit != nil {
+			err = cpm.watchpointHit()
+			if err != nil {
+				return ErrHalt
+			}
+			continue
+		}
+
+		// Has the CCP launched a program?  A program which HALTs
+		// immediately also stops here, and is handled below.
+		if err == z80.ErrBreakPoint && cpm.CPU.PC == 0x0100 && cpm.start != 0x0100 {
+			if !cpm.exit.running {
+				cpm.loadCommandSymbols(cpm.exit.command)
+				cpm.zsystemProgram()
+				cpm.programStarted()
+			}
+			if !cpm.CPU.HALT {
+				continue
+			}
+			err = nil
+		}
+
+		// Were we canceled by our caller?  This is tested first as
+		// a read which was waiting for input is abandoned, which
+		// reports ErrKilled.
+		if ctx.Err() != nil {
+			cpm.programEnded("canceled", true)
+			return ctx.Err()
+		}
+
+		// If our console input has been exhausted, or the user
+		// quit via the monitor, or the kill key, then there is
+		// nothing more to do.
+		if errors.Is(err, consolein.ErrEOF) || errors.Is(err, consolein.ErrKilled) || errors.Is(err, ErrHalt) {
+			cpm.programEnded("terminated by the user", true)
+			return ErrHalt
+		}
+
 		// Reboot?
 		if cpm.CPU.PC == 0x0000 {
+			running := cpm.exit.running
+			reason := cpm.bootReason()
+			cpm.programEnded(reason, false)
+
+			// A binary launched directly which returned from
+			// its entry-point has finished, just as if it had
+			// returned to the CCP.
+			if cpm.start == 0x0100 && running && reason == exitRet {
+				return nil
+			}
+			return ErrBoot
+		}
+
+		// In RSX-compatible mode a warm boot jumps through the
+		// vector at 0x0000, which ultimately reaches the BIOS.
+		if cpm.rsx && err == z80.ErrBreakPoint && cpm.CPU.PC == BIOS+3 {
+			cpm.programEnded(cpm.bootReason(), false)
 			return ErrBoot
 		}
 
 		// No error?  Then end - the CPU hit a HALT.
 		if err == nil {
+			cpm.programEnded(fmt.Sprintf("HALT at %04XH", cpm.CPU.PC), false)
+			cpm.crashReport(ErrHalt)
 			return ErrHalt
 		}
 
 		// Are we being asked to terminate CP/M?  If so return
 		if err == ErrExit {
+			cpm.programEnded(exitTerm, true)
 			return nil
 		}
 
+		// Did the program use an instruction the 8080 lacks, or
+		// run for too long?
+		if errors.Is(err, ErrZ80Instruction) || errors.Is(err, ErrInstructionLimit) {
+			cpm.programEnded(err.Error(), false)
+			cpm.crashReport(err)
+			return err
+		}
+
 		// An error which wasn't a breakpoint?  Give up
 		if err != z80.ErrBreakPoint {
+			cpm.programEnded(err.Error(), false)
+			if errors.Is(err, ErrUnimplemented) {
+				cpm.crashReport(err)
+			}
 			return fmt.Errorf("unexpected error running CPU %s", err)
 		}
 
@@ -959,47 +1830,75 @@ func (cpm *CPM) Execute(args []string) error {
 				slog.String("syscallHex",
 					fmt.Sprintf("0x%02X", syscall)),
 			)
+			cpm.programEnded(fmt.Sprintf("unimplemented BDOS function %d", syscall), false)
+			cpm.crashReport(ErrUnimplemented)
 			return ErrUnimplemented
 		}
 
+		// Is the CCP running again, because the program returned
+		// to it?
+		if cpm.exit.running && cpm.calledByCCP() {
+			cpm.programEnded("RET to the CCP", false)
+		}
+
 		// Log the call we're going to make
-		if !handler.Noisy {
+		cpm.logSyscall("BDOS", syscall, handler)
 
-			// show the function being invoked.
-			if cpm.simpleDebug {
-				fmt.Printf("%03d %s\n", syscall, handler.Desc)
-			}
+		cpm.publishSyscall("BDOS", syscall, handler.Desc)
 
-			slog.Info("BDOS",
-				slog.String("name", handler.Desc),
-				slog.Int("syscall", int(syscall)),
-				slog.String("syscallHex", fmt.Sprintf("0x%02X", syscall)),
-				slog.Group("registers",
-					slog.String("AF", fmt.Sprintf("%04X", cpm.CPU.States.AF.U16())),
-					slog.String("BC", fmt.Sprintf("%04X", cpm.CPU.States.BC.U16())),
-					slog.String("DE", fmt.Sprintf("%04X", cpm.CPU.States.DE.U16())),
-					slog.String("HL", fmt.Sprintf("%04X", cpm.CPU.States.HL.U16()))))
+		// Invoke the handler, timing it if we're profiling.
+		cpm.syscallCount++
+		start := time.Now()
+		err = handler.Handler(cpm)
+		cpm.profileSyscall("BDOS", syscall, handler.Desc, time.Since(start))
+
+		// Did the handler write too much output?
+		if err == nil {
+			err = cpm.outputThrottle()
 		}
 
-		// Invoke the handler
-		err = handler.Handler(cpm)
+		// Did the handler, or the guest, trigger a watchpoint?
+		if err == nil {
+			err = cpm.watchpointHit()
+		}
+
+		// Were we canceled while the handler was waiting for
+		// input?
+		if ctx.Err() != nil {
+			cpm.programEnded("canceled", true)
+			return ctx.Err()
+		}
+
+		// Has our console input been exhausted, or did the user
+		// quit via the monitor, or the kill key?
+		if errors.Is(err, consolein.ErrEOF) || errors.Is(err, consolein.ErrKilled) || errors.Is(err, ErrHalt) {
+			cpm.programEnded("terminated by the user", true)
+			return ErrHalt
+		}
 
 		// Are we being asked to terminate CP/M?  If so return
 		if err == ErrExit {
+			cpm.programEnded(exitTerm, true)
 			return nil
 		}
 
-		// Are we to reboot?
+		// Are we to reboot?  That happens when the program is
+		// aborted, via Ctrl-C, or after a disk error.
 		if err == ErrBoot {
+			cpm.programEnded("aborted", true)
 			cpm.CPU.PC = 0x0000
 			continue
 		}
 
 		// Any other error is fatal.
 		if err != nil {
+			cpm.programEnded(err.Error(), false)
 			return err
 		}
 
+		// Does the binary need different results?
+		cpm.overrideResults(handler.Desc)
+
 		// If A == 0x00 then we set the zero flag
 		if cpm.CPU.States.AF.Hi == 0x00 {
 			cpm.CPU.SetFlag(z80.FlagZ)
@@ -1027,26 +1926,20 @@ func (cpm *CPM) RunAutoExec() {
 	// These files must be present
 	files := []string{"SUBMIT.COM", "AUTOEXEC.SUB"}
 
+	// Upon the current drive.
+	drive := cpm.getDrive(string(cpm.currentDrive + 'A'))
+
 	// If one of the files is missing we return
 	// without doing anything.
 	for _, name := range files {
 
-		// Get the local prefix.
-		prefix := cpm.drives[string(cpm.currentDrive+'A')]
-
-		// Add the name
-		dst := filepath.Join(prefix, name)
-
-		// Open it to see if it exists.
-		handle, err := os.OpenFile(dst, os.O_RDONLY, 0644)
+		_, err := drive.Stat(name)
 		if err != nil {
 
 			// We're assuming "file not found",
 			// or similar, here.
 			return
 		}
-
-		handle.Close()
 	}
 
 	// OK we have both files
@@ -1067,16 +1960,75 @@ func (cpm *CPM) SetDrives(enabled bool) {
 
 	for _, c := range []string{"A", "B", "C", "D", "E", "F", "G", "H", "I", "J", "K", "L", "M", "N", "O", "P"} {
 		if enabled {
-			cpm.drives[c] = c
+			cpm.setDrive(c, c)
 		} else {
-			cpm.drives[c] = "."
+			cpm.setDrive(c, ".")
 		}
 	}
 }
 
 // SetDrivePath allows a caller to setup a custom path for a given drive.
+//
+// If the drive was already in-use then any files open upon it are closed,
+// rather than being left pointing at the previous location.
 func (cpm *CPM) SetDrivePath(drive string, path string) {
+	if old, ok := cpm.drives[drive]; ok && old != path {
+		cpm.invalidateDrive(drive)
+	}
+	delete(cpm.backends, drive)
+	cpm.setDrive(drive, path)
+}
+
+// setDrive records the host path used for the given drive.
+func (cpm *CPM) setDrive(drive string, path string) {
+	cpm.drivesMutex.Lock()
 	cpm.drives[drive] = path
+	cpm.drivesMutex.Unlock()
+}
+
+// GetDrivePaths returns a copy of the drive to host-path mappings which
+// are in-use, indexed by drive letter.
+func (cpm *CPM) GetDrivePaths() map[string]string {
+	cpm.drivesMutex.RLock()
+	defer cpm.drivesMutex.RUnlock()
+
+	ret := make(map[string]string)
+	for drive, path := range cpm.drives {
+		ret[drive] = path
+	}
+	return ret
+}
+
+// SetDriveUser selects the current drive, and user number, such as "C" and
+// 3, so that the CCP starts logged into them, showing a "C3>" prompt,
+// rather than "A>".
+//
+// The drive must exist, so this should be called after the drives have
+// been configured.
+func (cpm *CPM) SetDriveUser(drive string, user int) error {
+
+	drive = strings.ToUpper(strings.TrimSuffix(drive, ":"))
+	if len(drive) != 1 || drive[0] < 'A' || drive[0] > 'P' {
+		return fmt.Errorf("invalid drive '%s', expected A-P", drive)
+	}
+	if user < 0 || user > 15 {
+		return fmt.Errorf("invalid user number %d, expected 0-15", user)
+	}
+
+	drv := drive[0] - 'A'
+	if !cpm.driveExists(drv) {
+		return fmt.Errorf("drive %s: doesn't exist", drive)
+	}
+
+	cpm.currentDrive = drv
+	cpm.userNumber = uint8(user)
+
+	// Execute places these in the C register, for the CCP, and in RAM,
+	// but update RAM now if it has been loaded already.
+	if cpm.Memory != nil {
+		cpm.Memory.Set(0x0004, cpm.userNumber<<4|cpm.currentDrive)
+	}
+	return nil
 }
 
 // In is called to handle the I/O reading of a Z80 port.
@@ -1115,13 +2067,3 @@ func (cpm *CPM) Out(addr uint8, val uint8) {
 	//
 	cpm.BiosHandler(val)
 }
-
-// StuffText inserts text into the read-buffer of the console
-// input-driver.
-//
-// This is used for two purposes; to drive the "SUBMIT AUTOEXEC"
-// integration at run-time, and to support integration tests to be
-// written.
-func (cpm *CPM) StuffText(input string) {
-	cpm.input.StuffInput(input)
-}
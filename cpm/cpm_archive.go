@@ -0,0 +1,178 @@
+// cpm_archive.go contains the implementation of the Drive interface which
+// allows a ZIP archive to be used as a CP/M drive.
+//
+// The contents of the archive are read-only, and are used in place of the
+// files embedded within our binary, beneath the drive's host directory to
+// which new files are written.
+
+package cpm
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// archive is a read-only drive holding the contents of a ZIP archive.
+type archive struct {
+
+	// path is the host path of the archive.
+	path string
+
+	// files maps the CP/M name of each file to its entry in the archive.
+	files map[string]*zip.File
+}
+
+// isArchive returns true if the given host path refers to a ZIP archive,
+// rather than a directory.
+func isArchive(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".zip")
+}
+
+// archiveOverlay returns the host directory which is used for writes to a
+// drive backed by the given archive, which is the archive's path without
+// the suffix.  i.e. "stuff.zip" uses "stuff/".
+func archiveOverlay(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path))
+}
+
+// loadArchive reads the ZIP archive at the given path.
+//
+// The directory structure of the archive is flattened, and files are
+// upper-cased, with those whose names don't fit within the CP/M 8.3 format
+// being given aliases in the same way as long host filenames.
+func loadArchive(file string) (*archive, error) {
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive %s: %s", file, err)
+	}
+
+	a := &archive{path: file, files: make(map[string]*zip.File)}
+
+	used := make(map[string]bool)
+	var long []*zip.File
+
+	for _, f := range reader.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		name := strings.ToUpper(path.Base(filepath.ToSlash(f.Name)))
+		if !isShortName(name) {
+			long = append(long, f)
+			continue
+		}
+		if used[name] {
+			slog.Warn("ignoring duplicate file in archive",
+				slog.String("archive", file),
+				slog.String("name", f.Name))
+			continue
+		}
+		used[name] = true
+		a.files[name] = f
+	}
+
+	// Aliases are generated after the short names are known, so that
+	// they cannot collide.
+	for _, f := range long {
+		alias := makeAlias(path.Base(filepath.ToSlash(f.Name)), used)
+		used[alias] = true
+		a.files[alias] = f
+	}
+
+	return a, nil
+}
+
+// mountArchive loads the archive at the given path, ready to be mounted,
+// returning it along with the overlay directory which should be used as
+// the drive's host path.  The overlay directory is created if it is missing.
+func mountArchive(path string) (*archive, string, error) {
+
+	a, err := loadArchive(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	overlay := archiveOverlay(path)
+	err = os.MkdirAll(overlay, 0755)
+	if err != nil {
+		return nil, "", err
+	}
+
+	slog.Debug("Loaded archive",
+		slog.String("archive", path),
+		slog.String("overlay", overlay),
+		slog.Int("files", len(a.files)))
+
+	return a, overlay, nil
+}
+
+// Open reads the file into memory.
+func (a *archive) Open(name string) (DriveFile, error) {
+
+	f, ok := a.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	r, err := f.Open()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+
+	return &memFile{name: a.path + ":" + f.Name, data: data, info: driveInfo{FileInfo: f.FileInfo(), name: name}}, nil
+}
+
+// Create fails, since archives are read-only.
+func (a *archive) Create(name string) (DriveFile, error) {
+	return nil, ErrReadOnly
+}
+
+// ReadDir returns the files within the archive.
+func (a *archive) ReadDir() ([]fs.FileInfo, error) {
+
+	var res []fs.FileInfo
+	for name, f := range a.files {
+		res = append(res, driveInfo{FileInfo: f.FileInfo(), name: name})
+	}
+	return res, nil
+}
+
+// Delete fails, since archives are read-only.
+func (a *archive) Delete(name string) error {
+	return readOnlyError(a, name)
+}
+
+// Rename fails, since archives are read-only.
+func (a *archive) Rename(from string, to string) error {
+	return readOnlyError(a, from)
+}
+
+// Stat returns the details of the given file.
+func (a *archive) Stat(name string) (fs.FileInfo, error) {
+
+	f, ok := a.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return driveInfo{FileInfo: f.FileInfo(), name: name}, nil
+}
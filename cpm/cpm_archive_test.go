@@ -0,0 +1,198 @@
+package cpm
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/skx/cpmulator/fcb"
+	"github.com/skx/cpmulator/memory"
+)
+
+// makeArchive creates a ZIP archive, in the given directory, containing
+// the given files.
+func makeArchive(t *testing.T, dir string, files map[string]string) string {
+
+	path := filepath.Join(dir, "stuff.zip")
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create archive: %s", err)
+	}
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	for name, content := range files {
+		out, err := w.Create(name)
+		if err != nil {
+			t.Fatalf("failed to add %s to archive: %s", name, err)
+		}
+		_, err = out.Write([]byte(content))
+		if err != nil {
+			t.Fatalf("failed to write %s to archive: %s", name, err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("failed to close archive: %s", err)
+	}
+	return path
+}
+
+// TestLoadArchive ensures the contents of an archive are given CP/M names.
+func TestLoadArchive(t *testing.T) {
+
+	path := makeArchive(t, t.TempDir(), map[string]string{
+		"foo.com":        "foo",
+		"sub/readme.txt": "readme",
+		"long-name.text": "long",
+	})
+
+	a, err := loadArchive(path)
+	if err != nil {
+		t.Fatalf("failed to load archive: %s", err)
+	}
+
+	for _, name := range []string{"FOO.COM", "README.TXT", "LONG-N~1.TEX"} {
+		if _, ok := a.files[name]; !ok {
+			t.Fatalf("%s missing from archive, got %v", name, a.files)
+		}
+	}
+	if len(a.files) != 3 {
+		t.Fatalf("wrong number of files %d", len(a.files))
+	}
+
+	_, err = loadArchive(filepath.Join(t.TempDir(), "missing.zip"))
+	if err == nil {
+		t.Fatalf("expected error loading missing archive")
+	}
+
+	bogus := filepath.Join(t.TempDir(), "bogus.zip")
+	err = os.WriteFile(bogus, []byte("not a zip"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	_, err = loadArchive(bogus)
+	if err == nil {
+		t.Fatalf("expected error loading bogus archive")
+	}
+}
+
+// TestMountArchive tests reading, and writing, to a drive backed by an
+// archive.
+func TestMountArchive(t *testing.T) {
+
+	dir := t.TempDir()
+	path := makeArchive(t, dir, map[string]string{
+		"foo.com": "archived",
+		"bar.txt": "bar",
+	})
+
+	c, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.Memory = new(memory.Memory)
+	c.fixupRAM()
+	c.SetDrives(false)
+	defer c.IOTearDown()
+
+	err = c.MountDrive("B", path)
+	if err != nil {
+		t.Fatalf("failed to mount archive: %s", err)
+	}
+
+	overlay := filepath.Join(dir, "stuff")
+	if c.drives["B"] != overlay {
+		t.Fatalf("wrong overlay directory %s", c.drives["B"])
+	}
+	if fi, err := os.Stat(overlay); err != nil || !fi.IsDir() {
+		t.Fatalf("overlay directory wasn't created")
+	}
+
+	// open the given file upon B:, and read the first record.
+	read := func(name string) string {
+		f := fcb.FromString(name)
+		f.Drive = 2
+		c.Memory.SetRange(0x0200, f.AsBytes()...)
+
+		c.CPU.States.DE.SetU16(0x0200)
+		err = BdosSysCallFileOpen(c)
+		if err != nil || c.CPU.States.AF.Hi != 0x00 {
+			t.Fatalf("failed to open %s", name)
+		}
+
+		c.CPU.States.DE.SetU16(0x0200)
+		err = BdosSysCallRead(c)
+		if err != nil {
+			t.Fatalf("failed to read %s", name)
+		}
+
+		out := ""
+		for _, b := range c.Memory.GetRange(c.dma, blkSize) {
+			if b == 0x1A {
+				break
+			}
+			out += string(rune(b))
+		}
+		return out
+	}
+
+	if read("FOO.COM") != "archived" {
+		t.Fatalf("wrong content read from archive")
+	}
+
+	// Writing is a read-only error, which we ask to be returned.
+	c.errorMode = 0xFF
+	c.CPU.States.DE.SetU16(0x0200)
+	err = BdosSysCallWrite(c)
+	if err != nil {
+		t.Fatalf("unexpected error writing: %s", err)
+	}
+	if c.CPU.States.AF.Hi != 0xFF || c.CPU.States.HL.Hi != 0x03 {
+		t.Fatalf("expected read-only error, got A=%02X H=%02X", c.CPU.States.AF.Hi, c.CPU.States.HL.Hi)
+	}
+
+	// A file in the overlay hides the archived one.
+	err = os.WriteFile(filepath.Join(overlay, "FOO.COM"), []byte("overlay"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	if read("FOO.COM") != "overlay" {
+		t.Fatalf("overlay didn't hide the archived file")
+	}
+
+	// And only appears once in a directory listing.
+	c.currentDrive = 1
+	f := fcb.FromString("*.*")
+	c.Memory.SetRange(0x0200, f.AsBytes()...)
+	c.CPU.States.DE.SetU16(0x0200)
+	err = BdosSysCallFindFirst(c)
+	if err != nil || c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("failed to find files")
+	}
+	found := 1
+	for {
+		err = BdosSysCallFindNext(c)
+		if err != nil {
+			t.Fatalf("error finding files: %s", err)
+		}
+		if c.CPU.States.AF.Hi != 0x00 {
+			break
+		}
+		found++
+	}
+	if found != 2 {
+		t.Fatalf("expected two files, found %d", found)
+	}
+
+	// Unmounting removes the archive.
+	err = c.UnmountDrive("B")
+	if err != nil {
+		t.Fatalf("failed to unmount: %s", err)
+	}
+	if len(c.backends) != 0 {
+		t.Fatalf("archive is still mounted")
+	}
+}
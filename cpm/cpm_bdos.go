@@ -7,15 +7,13 @@
 package cpm
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
 	"os"
-	"path/filepath"
-	"sort"
 	"strings"
-	"time"
 
 	"github.com/skx/cpmulator/consolein"
 	"github.com/skx/cpmulator/fcb"
@@ -24,8 +22,11 @@ import (
 // blkSize is the size of block-based I/O operations
 const blkSize = 128
 
-// maxRC is the maximum read count
-const maxRC = 128
+// submitFile is the file in which SUBMIT.COM records a pending job.
+const submitFile = "$$$.SUB"
+
+// submitDrive is the drive upon which the CCP looks for submitFile.
+const submitDrive = "A"
 
 // BdosSysCallExit implements the Exit syscall
 func BdosSysCallExit(cpm *CPM) error {
@@ -38,7 +39,11 @@ func BdosSysCallReadChar(cpm *CPM) error {
 	// Block for input
 	c, err := cpm.input.BlockForCharacterWithEcho()
 	if err != nil {
-		return fmt.Errorf("error in call to BlockForCharacter: %s", err)
+		return fmt.Errorf("error in call to BlockForCharacter: %w", err)
+	}
+
+	if cpm.transcript != nil {
+		cpm.transcript.character(c)
 	}
 
 	// Return values:
@@ -52,11 +57,12 @@ func BdosSysCallReadChar(cpm *CPM) error {
 }
 
 // BdosSysCallWriteChar writes the single character in the E register to STDOUT.
+//
+// TABs are expanded, and the output is echoed to the printer if Ctrl-P
+// has been pressed.
 func BdosSysCallWriteChar(cpm *CPM) error {
 
-	cpm.output.PutCharacter(cpm.CPU.States.DE.Lo)
-
-	return nil
+	return cpm.conOut(cpm.CPU.States.DE.Lo)
 }
 
 // BdosSysCallAuxRead reads a single character from the auxiliary input.
@@ -67,7 +73,7 @@ func BdosSysCallAuxRead(cpm *CPM) error {
 	// Block for input
 	c, err := cpm.input.BlockForCharacterNoEcho()
 	if err != nil {
-		return fmt.Errorf("error in call to BlockForCharacterNoEcho: %s", err)
+		return fmt.Errorf("error in call to BlockForCharacterNoEcho: %w", err)
 	}
 
 	// Return values:
@@ -117,7 +123,9 @@ func BdosSysCallRawIO(cpm *CPM) error {
 		cpm.CPU.States.HL.Lo = 0x00
 
 		// Return a character without echoing if one is waiting; zero if none is available.
-		if cpm.input.PendingInput() {
+		pending := cpm.input.PendingInput()
+		cpm.idlePoll(pending)
+		if pending {
 			out, err := cpm.input.BlockForCharacterNoEcho()
 			if err != nil {
 				return err
@@ -136,7 +144,9 @@ func BdosSysCallRawIO(cpm *CPM) error {
 		cpm.CPU.States.HL.Lo = 0x00
 
 		// Return console input status. Zero if no character is waiting, nonzero otherwise.
-		if cpm.input.PendingInput() {
+		pending := cpm.input.PendingInput()
+		cpm.idlePoll(pending)
+		if pending {
 			cpm.CPU.States.AF.Hi = 0xFF
 			cpm.CPU.States.AF.Lo = 0x00
 			cpm.CPU.States.HL.Hi = 0x00
@@ -196,12 +206,17 @@ func BdosSysCallSetIOByte(cpm *CPM) error {
 }
 
 // BdosSysCallWriteString writes the $-terminated string pointed to by DE to STDOUT
+//
+// The terminator may be changed via C_DELIMIT.
 func BdosSysCallWriteString(cpm *CPM) error {
 	addr := cpm.CPU.States.DE.U16()
 
 	c := cpm.Memory.Get(addr)
-	for c != '$' {
-		cpm.output.PutCharacter(c)
+	for c != cpm.delimiter {
+		err := cpm.conOut(c)
+		if err != nil {
+			return err
+		}
 		addr++
 		c = cpm.Memory.Get(addr)
 	}
@@ -230,8 +245,23 @@ func BdosSysCallReadString(cpm *CPM) error {
 	// First byte is the max len
 	max := cpm.Memory.Get(addr)
 
-	// read the input
+	// Is the CCP reading a command?  That's noted in our transcript,
+	// and names the program it launches.
+	command := cpm.calledByCCP()
+
+	// Ctrl-C is ignored, rather than rebooting, if the console mode
+	// says so.
+	if cpm.consoleModeSet(consoleModeNoCtrlC) && cpm.input.GetInterruptCount() > 0 {
+		count := cpm.input.GetInterruptCount()
+		cpm.input.SetInterruptCount(0)
+		defer cpm.input.SetInterruptCount(count)
+	}
+
+	// read the input, noting that a line is being read, as that is
+	// when the commands given via WithCommands are delivered.
+	cpm.readingLine = true
 	text, err := cpm.input.ReadLine(max)
+	cpm.readingLine = false
 
 	if err != nil {
 
@@ -244,6 +274,13 @@ func BdosSysCallReadString(cpm *CPM) error {
 		return err
 	}
 
+	if command {
+		cpm.programCommand(text)
+	}
+	if cpm.transcript != nil {
+		cpm.transcript.input(text, command)
+	}
+
 	// addr[0] is the size of the input buffer
 	// addr[1] should be the size of input read, set it:
 	cpm.Memory.Set(addr+1, uint8(len(text)))
@@ -266,6 +303,8 @@ func BdosSysCallReadString(cpm *CPM) error {
 }
 
 // BdosSysCallConsoleStatus tests if we have pending console (character) input.
+//
+// If the console mode asks for it only a pending Ctrl-C is reported.
 func BdosSysCallConsoleStatus(cpm *CPM) error {
 
 	// Default to assuming nothing is pending
@@ -274,7 +313,17 @@ func BdosSysCallConsoleStatus(cpm *CPM) error {
 	cpm.CPU.States.HL.Hi = 0x00
 	cpm.CPU.States.HL.Lo = 0x00
 
-	if cpm.input.PendingInput() {
+	pending := cpm.input.PendingInput()
+	cpm.idlePoll(pending)
+	if pending && cpm.consoleModeSet(consoleModeCtrlCStatus) {
+		c, err := cpm.input.BlockForCharacterNoEcho()
+		if err != nil {
+			return err
+		}
+		cpm.input.UnreadCharacter(c)
+		pending = c == 0x03
+	}
+	if pending {
 		cpm.CPU.States.AF.Hi = 0xFF
 		cpm.CPU.States.AF.Lo = 0x00
 		cpm.CPU.States.HL.Hi = 0x00
@@ -304,6 +353,8 @@ func BdosSysCallBDOSVersion(cpm *CPM) error {
 // which will be read by the CCP - as created by SUBMIT.COM
 func BdosSysCallDriveAllReset(cpm *CPM) error {
 
+	cpm.invalidateDirCache()
+
 	// Reset disk - but leave the user-number alone
 	cpm.currentDrive = 0
 
@@ -313,17 +364,16 @@ func BdosSysCallDriveAllReset(cpm *CPM) error {
 	// Default return value
 	var ret uint8 = 0
 
-	// drive will default to our current drive, if the FCB drive field is 0
-	drive := string(cpm.currentDrive + 'A')
-
-	// Remap to the place we're supposed to use.
-	path := cpm.drives[drive]
-
-	// Look for a file with $ in its name
-	files, err := os.ReadDir(path)
+	// A pending SUBMIT job is recorded in $$$.SUB, and the CCP looks for
+	// it on A:, whichever drive the job, or the CCP, is running from.  If
+	// it exists we return 0xFF so the CCP runs the next command from it.
+	//
+	// Real CP/M only considers the file in the current user area, but our
+	// user areas share their files, so any user sees the job.
+	files, err := cpm.getDrive(submitDrive).ReadDir()
 	if err == nil {
 		for _, n := range files {
-			if strings.Contains(n.Name(), "$") {
+			if strings.EqualFold(n.Name(), submitFile) {
 				ret = 0xFF
 			}
 		}
@@ -353,6 +403,11 @@ func BdosSysCallDriveSet(cpm *CPM) error {
 		drv = 15
 	}
 
+	// Drives whose directory doesn't exist can't be selected.
+	if !cpm.driveExists(drv) {
+		return cpm.bdosError('A'+drv, bdosErrSelect)
+	}
+
 	// set the drive
 	cpm.currentDrive = drv
 
@@ -381,6 +436,10 @@ func BdosSysCallFileOpen(cpm *CPM) error {
 	// Create a structure with the contents
 	fcbPtr := fcb.FromBytes(xxx)
 
+	// The CCP failing to open a program means a command wasn't
+	// found, which is noted once we've tried.
+	defer cpm.noteCommandOpen(fcbPtr)
+
 	// Get the actual name
 	fileName := fcbPtr.GetFileName()
 
@@ -394,84 +453,41 @@ func BdosSysCallFileOpen(cpm *CPM) error {
 	}
 
 	// drive will default to our current drive, if the FCB drive field is 0
-	drive := cpm.currentDrive + 'A'
-	if fcbPtr.Drive != 0 {
-		drive = fcbPtr.Drive + 'A' - 1
-	}
-
-	// Remap to the place we're supposed to use.
-	path := cpm.drives[string(drive)]
-
-	//
-	// Ok we have a filename, but we probably have an upper-case
-	// filename.
-	//
-	// Run a glob, and if there's an existing file with the same
-	// name then replace with the mixed/lower cased version.
-	//
-	files, err2 := os.ReadDir(path)
-	if err2 == nil {
-		for _, n := range files {
-			if strings.ToUpper(n.Name()) == fileName {
-				fileName = n.Name()
-			}
-		}
-	}
+	drive := string(cpm.fcbDrive(fcbPtr))
 
 	// child logger with more details.
 	l := slog.With(
 		slog.String("function", "SysCallFileOpen"),
 		slog.String("name", fileName),
-		slog.String("drive", string(cpm.currentDrive+'A')),
-		slog.String("result", fileName))
-
-	// Ensure the filename is qualified
-	fileName = filepath.Join(path, fileName)
+		slog.String("drive", drive))
 
-	// Remapped file
-	x := filepath.Base(fileName)
-	x = filepath.Join(string(cpm.currentDrive+'A'), x)
+	// As with DRI's BDOS a name containing "?" opens the first file
+	// which matches it, and the FCB is updated to hold that name, so
+	// later calls refer to the same file.
+	if fcbPtr.HasWildcards() {
+		res, err := findFiles(cpm.getDrive(drive), fcbPtr)
+		if err != nil || len(res) == 0 {
+			l.Debug("failed to open, no file matches")
 
-	// Can we open this file from our embedded filesystem?
-	virt, er := cpm.static.ReadFile(x)
-	if er == nil {
-
-		// Yes we can!
-		// Save the file handle in our cache.
-		cpm.files[ptr] = FileCache{name: fileName, handle: nil}
-
-		// Get file size, in blocks
-		fLen := uint8(len(virt) / blkSize)
-
-		// Set record-count
-		if fLen > maxRC {
-			fcbPtr.RC = maxRC
-		} else {
-			fcbPtr.RC = fLen
+			cpm.CPU.States.AF.Hi = 0xFF
+			return nil
 		}
 
-		// Write our cache-key in the FCB
-		fcbPtr.Al[0] = uint8(ptr & 0xFF)
-		fcbPtr.Al[1] = uint8(ptr >> 8)
-
-		// Update the FCB in memory.
-		cpm.Memory.SetRange(ptr, fcbPtr.AsBytes()...)
-
-		// Return success
-		cpm.CPU.States.AF.Hi = 0x00
-		return nil
+		match := fcb.FromString(fcbPtr.ExpandWildcards(res[0].Name()))
+		fcbPtr.Name = match.Name
+		fcbPtr.Type = match.Type
+		fileName = fcbPtr.GetFileName()
 	}
 
-	// Now we open from the filesystem
-	file, err := os.OpenFile(fileName, os.O_RDWR, 0644)
+	// Open the file, from wherever the drive holds it.
+	file, err := cpm.getDrive(drive).Open(fileName)
 	if err != nil {
 
 		// We might fail to open a file because it doesn't
-		// exist.
-		if os.IsNotExist(err) {
+		// exist, or because its name is ambiguous.
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrAmbiguous) {
 
-			l.Debug("failed to open, file does not exist",
-				slog.String("path", fileName),
+			l.Debug("failed to open",
 				slog.String("error", err.Error()))
 
 			cpm.CPU.States.AF.Hi = 0xFF
@@ -480,36 +496,52 @@ func BdosSysCallFileOpen(cpm *CPM) error {
 
 		// Ok a different error
 		l.Debug("failed to open",
-			slog.String("path", fileName),
 			slog.String("error", err.Error()))
 		return err
 	}
 
-	// Save the file handle in our cache.
-	cpm.files[ptr] = FileCache{name: fileName, handle: file}
-
 	// Get file size, in bytes
 	fi, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to get file size of %s: %s", fileName, err)
+		file.Close()
+		return fmt.Errorf("failed to get file size of %s: %s", file.Name(), err)
 	}
 
 	// Get file size, in bytes
 	fileSize := fi.Size()
 
-	// Get file size, in blocks
-	fLen := uint8(fileSize / blkSize)
+	// The FCB may refer to any extent of the file, as programs which
+	// skip through large files set Ex, and S2, before opening them.
+	//
+	// The record-count is that of the extent, and extents beyond the
+	// end of the file don't exist.
+	extent := fcbPtr.GetExtent()
+	fcbPtr.RC = fcb.RecordsInExtent(fileSize, extent)
+	if extent > 0 && fcbPtr.RC == 0 {
+		l.Debug("failed to open, extent doesn't exist",
+			slog.Int("extent", extent),
+			slog.Int64("file_size", fileSize))
+
+		file.Close()
+		cpm.CPU.States.AF.Hi = 0xFF
+		return nil
+	}
+	fcbPtr.S2 |= fcb.S2Unmodified
 
-	// Set record-count
-	if fLen > maxRC {
-		fcbPtr.RC = maxRC
-	} else {
-		fcbPtr.RC = fLen
+	// Save the file handle in our cache, closing any handle the FCB
+	// already had, as it is reopened to select a different extent.
+	if prev, ok := cpm.files[ptr]; ok && prev.handle != nil {
+		prev.handle.Close()
 	}
+	cpm.files[ptr] = FileCache{name: file.Name(), drive: drive, handle: cpm.openBuffered(drive, file)}
+	delete(cpm.stale, ptr)
+	cpm.publish(Event{Type: "file", Action: "opened", Path: file.Name()})
 
 	l.Debug("result:OK",
 		slog.Int("fcb", int(ptr)),
-		slog.Int("handle", int(file.Fd())),
+		slog.String("path", file.Name()),
+		slog.Bool("read_only", file.ReadOnly()),
+		slog.Int("extent", extent),
 		slog.Int("record_count", int(fcbPtr.RC)),
 		slog.Int64("file_size", fileSize))
 
@@ -537,6 +569,8 @@ func BdosSysCallFileOpen(cpm *CPM) error {
 // files with "$" in their name.
 func BdosSysCallFileClose(cpm *CPM) error {
 
+	cpm.invalidateDirCache()
+
 	// The pointer to the FCB
 	ptr := cpm.CPU.States.DE.U16()
 
@@ -554,25 +588,23 @@ func BdosSysCallFileClose(cpm *CPM) error {
 	if !ok {
 		slog.Debug("SysCallFileClose tried to close a file that wasn't open",
 			slog.Int("fcb", int(ptr)))
+		delete(cpm.stale, key)
 		cpm.CPU.States.AF.Hi = 0x00
 		return nil
 	}
 
-	// Close of a virtual file.
-	if obj.handle == nil {
-		// Record success
-		cpm.CPU.States.AF.Hi = 0x00
-		return nil
-	}
-
-	// Is this a $-file?
-	if strings.Contains(obj.name, "$") {
+	// Is this a $-file, which we can write to?
+	if strings.Contains(obj.name, "$") && !obj.handle.ReadOnly() {
 
 		// Get the file size, in records
-		hostSize, _ := obj.handle.Seek(0, 2)
+		fi, err := obj.handle.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to get file size of %s: %s", obj.name, err)
+		}
+		hostSize := fi.Size()
 		hostExtent := int((hostSize) / 16384)
 
-		seqEXT := int(fcbPtr.Ex)*32 + int(0x3F&fcbPtr.S2)
+		seqEXT := fcbPtr.GetExtent()
 		seqCR := func(n int64) int {
 			return int(((n) % 16384) / 128)
 		}
@@ -584,6 +616,7 @@ func BdosSysCallFileClose(cpm *CPM) error {
 				if err != nil {
 					return fmt.Errorf("error truncating file %s: %s", obj.name, err)
 				}
+				cpm.recordChange("modified", obj.name, "")
 			}
 		}
 	}
@@ -617,93 +650,38 @@ func BdosSysCallFindFirst(cpm *CPM) error {
 	xxx := cpm.Memory.GetRange(ptr, fcb.SIZE)
 
 	// Previous results are now invalidated
-	cpm.findFirstResults = []fcb.FCBFind{}
-	cpm.findOffset = 0
+	delete(cpm.finds, ptr)
+	cpm.lastFind = nil
 
 	// Create a structure with the contents
 	fcbPtr := fcb.FromBytes(xxx)
 
-	// Look in the correct location.
-	dir := cpm.drives[string(cpm.currentDrive+'A')]
+	// drive will default to our current drive, if the FCB drive field is 0
+	drive := string(cpm.fcbDrive(fcbPtr))
 
 	// Find files in the FCB.
-	res, err := fcbPtr.GetMatches(dir)
+	res, err := findFiles(cpm.findDrive(drive), fcbPtr)
 	if err != nil {
-		slog.Debug("fcbPtr.GetMatches returned error",
-			slog.String("path", dir),
+		slog.Debug("findFiles returned error",
+			slog.String("drive", drive),
 			slog.String("error", err.Error()))
 
 		cpm.CPU.States.AF.Hi = 0xFF
 		return nil
 	}
 
-	// Add on any virtual files, by merging the drive.
-	_ = fs.WalkDir(cpm.static, string(cpm.currentDrive+'A'),
-		func(path string, d fs.DirEntry, err error) error {
-			if err != nil {
-				return nil
-			}
-			if d.IsDir() {
-				return nil
-			}
-
-			// Does the entry match the glob?
-			if fcbPtr.DoesMatch(filepath.Base(path)) {
-
-				// If so append
-				res = append(res, fcb.FCBFind{
-					Host: path,
-					Name: filepath.Base(path)})
-			}
-
-			return nil
-		})
-
 	// No matches?  Return an error
 	if len(res) < 1 {
 		cpm.CPU.States.AF.Hi = 0xFF
 		return nil
 	}
 
-	// Sort the list, since we've added the embedded files
-	// onto the end and that will look weird.
-	sort.Slice(res, func(i, j int) bool {
-		return res[i].Name < res[j].Name
-	})
-
 	// Here we save the results in our cache,
 	// dropping the first
-	cpm.findFirstResults = res[1:]
-	cpm.findOffset = 0
-
-	// Create a new FCB and store it in the DMA entry
-	x := fcb.FromString(res[0].Name)
-
-	// Get the file-size in records, and add to the FCB
-	tmp, err := os.OpenFile(res[0].Host, os.O_RDONLY, 0644)
-	if err == nil {
-		defer tmp.Close()
+	cpm.startSearch(ptr, &findState{drive: drive, results: res[1:]})
 
-		fi, err := tmp.Stat()
-		if err == nil {
-
-			fileSize := fi.Size()
-
-			// Get file size, in blocks
-			x.RC = uint8(fileSize / blkSize)
-
-		}
-	}
-
-	// Update the results
-	data := x.AsBytes()
-	cpm.Memory.SetRange(cpm.dma, data...)
-
-	// Return 0x00 to point to the first entry in the DMA area.
-	cpm.CPU.States.HL.Hi = 0x00
-	cpm.CPU.States.HL.Lo = 0x00
-	cpm.CPU.States.BC.Hi = 0x00
-	cpm.CPU.States.AF.Hi = 0x00
+	// Store the first result in the DMA area.
+	cpm.findResult(res[0])
 
 	return nil
 }
@@ -711,35 +689,34 @@ func BdosSysCallFindFirst(cpm *CPM) error {
 // BdosSysCallFindNext finds the next filename that matches the glob set in the FCB in DE.
 func BdosSysCallFindNext(cpm *CPM) error {
 	//
-	// Assume we've been called with findFirst before
+	// Assume we've been called with findFirst before, ideally with
+	// the same FCB, so that interleaved searches work.
 	//
-	if (len(cpm.findFirstResults) == 0) || cpm.findOffset >= len(cpm.findFirstResults) {
+	state := cpm.findSearch(cpm.CPU.States.DE.U16())
+	if state == nil || state.offset >= len(state.results) {
 		// Return 0xFF to signal an error
 		cpm.CPU.States.AF.Hi = 0xFF
 		return nil
 	}
 
-	res := cpm.findFirstResults[cpm.findOffset]
-	cpm.findOffset++
+	res := state.results[state.offset]
+	state.offset++
 
-	// Create a new FCB and store it in the DMA entry
-	x := fcb.FromString(res.Name)
+	// Store the result in the DMA area.
+	cpm.findResult(res)
 
-	// Get the file-size in records, and add to the FCB
-	tmp, err := os.OpenFile(res.Host, os.O_RDONLY, 0644)
-	if err == nil {
-		defer tmp.Close()
-
-		fi, err := tmp.Stat()
-		if err == nil {
+	return nil
+}
 
-			fileSize := fi.Size()
+// findResult stores an FCB for the given file, found by FindFirst or
+// FindNext, in the DMA area, and returns success.
+func (cpm *CPM) findResult(fi fs.FileInfo) {
 
-			// Get file size, in blocks
-			x.RC = uint8(fileSize / blkSize)
+	// Create a new FCB and store it in the DMA entry
+	x := fcb.FromString(fi.Name())
 
-		}
-	}
+	// Get file size, in blocks
+	x.RC = uint8(fi.Size() / blkSize)
 
 	data := x.AsBytes()
 	cpm.Memory.SetRange(cpm.dma, data...)
@@ -749,12 +726,13 @@ func BdosSysCallFindNext(cpm *CPM) error {
 	cpm.CPU.States.HL.Lo = 0x00
 	cpm.CPU.States.BC.Hi = 0x00
 	cpm.CPU.States.AF.Hi = 0x00
-
-	return nil
 }
 
 // BdosSysCallDeleteFile deletes the filename(s) matching the pattern specified by the FCB in DE.
 func BdosSysCallDeleteFile(cpm *CPM) error {
+
+	cpm.invalidateDirCache()
+
 	// The pointer to the FCB
 	ptr := cpm.CPU.States.DE.U16()
 
@@ -769,44 +747,81 @@ func BdosSysCallDeleteFile(cpm *CPM) error {
 		slog.String("pattern", fcbPtr.GetFileName()))
 
 	// drive will default to our current drive, if the FCB drive field is 0
-	drive := cpm.currentDrive + 'A'
-	if fcbPtr.Drive != 0 {
-		drive = fcbPtr.Drive + 'A' - 1
-	}
-
-	// Remap to the place we're supposed to use.
-	path := cpm.drives[string(drive)]
+	drive := string(cpm.fcbDrive(fcbPtr))
+	d := cpm.getDrive(drive)
 
 	// Find files in the FCB.
-	res, err := fcbPtr.GetMatches(path)
+	res, err := findFiles(d, fcbPtr)
 	if err != nil {
-		slog.Debug("SysCallDeleteFile - fcbPtr.GetMatches returned error",
-			slog.String("path", path),
+		slog.Debug("SysCallDeleteFile - findFiles returned error",
+			slog.String("drive", drive),
 			slog.String("error", err.Error()))
 
 		cpm.CPU.States.AF.Hi = 0xFF
+		cpm.CPU.States.HL.Hi = 0x00
 		return nil
 	}
 
-	// For each result, if any
-	for _, entry := range res {
+	// No matches?  Then the file wasn't found.
+	if len(res) == 0 {
+		cpm.CPU.States.AF.Hi = 0xFF
+		cpm.CPU.States.HL.Hi = 0x00
+		return nil
+	}
 
-		// Host path
-		path := entry.Host
+	// The extended error code we'll return in H, if we fail to
+	// delete any of the matching files.
+	//
+	// 0x01 is a disk I/O error, 0x03 is a read-only file.
+	var failed uint8
+
+	// Apply any protection against wildcard deletes, files which
+	// are refused are reported as read-only.
+	res, refused := cpm.protectWildcard("Delete", drive, fcbPtr, res)
+	if refused > 0 {
+		failed = 0x03
+	}
+
+	// For each result remove it.
+	//
+	// We continue after a failure, so that we remove as many files
+	// as we can, but report the failure to the caller.  Files which
+	// are read-only, such as those embedded in our binary, are
+	// reported as such.
+	for _, entry := range res {
 
 		slog.Debug("SysCallDeleteFile: deleting file",
-			slog.String("path", path))
+			slog.String("name", entry.Name()))
 
-		err = os.Remove(path)
+		err = d.Delete(entry.Name())
 		if err != nil {
 
 			slog.Debug("SysCallDeleteFile: failed to delete file",
-				slog.String("path", path),
+				slog.String("name", entry.Name()),
 				slog.String("error", err.Error()))
 
-			cpm.CPU.States.AF.Hi = 0xFF
-			return nil
+			if failed == 0x00 {
+				failed = 0x01
+				if errors.Is(err, ErrReadOnly) || os.IsPermission(err) {
+					failed = 0x03
+				}
+			}
+			continue
 		}
+
+		delete(cpm.created, createdKey(drive, entry.Name()))
+	}
+
+	// Read-only files are reported via our error mode, unless they
+	// were refused by our protection.
+	if failed == 0x03 && refused == 0 {
+		return cpm.bdosError(drive[0], bdosErrFileRO)
+	}
+
+	if failed != 0x00 {
+		cpm.CPU.States.AF.Hi = 0xFF
+		cpm.CPU.States.HL.Hi = failed
+		return nil
 	}
 
 	// Return values:
@@ -815,7 +830,7 @@ func BdosSysCallDeleteFile(cpm *CPM) error {
 	cpm.CPU.States.HL.Lo = 0x00
 	cpm.CPU.States.BC.Hi = 0x00
 	cpm.CPU.States.AF.Hi = 0x00
-	return err
+	return nil
 }
 
 // BdosSysCallRead reads a record from the file named in the FCB given in DE
@@ -838,6 +853,11 @@ func BdosSysCallRead(cpm *CPM) error {
 	if !ok {
 		slog.Error("SysCallRead: Attempting to read from a file that isn't open")
 		cpm.CPU.States.AF.Hi = 0xFF
+
+		// Closed because its drive was remapped?
+		if cpm.staleFile(key) {
+			cpm.CPU.States.AF.Hi = 0x09
+		}
 		return nil
 	}
 
@@ -849,88 +869,78 @@ func BdosSysCallRead(cpm *CPM) error {
 		data[i] = 0x1A
 	}
 
-	// Get the next read position
-	offset := fcbPtr.GetSequentialOffset()
-
-	// Are we reading from a virtual file?
-	if obj.handle == nil {
-
-		// Remap
-		p := filepath.Join(string(cpm.currentDrive+'A'), filepath.Base(obj.name))
-
-		// open
-		file, err := fs.ReadFile(cpm.static, p)
-		if err != nil {
-			fmt.Printf("error on readfile for virtual path (%s):%s\n", p, err)
-		}
-		i := 0
-
-		// default to being successful
-		cpm.CPU.States.AF.Hi = 0x00
-
-		// copy each appropriate byte into the data-area
-		for i < blkSize {
-			if int(offset)+i < len(file) {
-				data[i] = file[int(offset)+i]
-			} else {
-				cpm.CPU.States.AF.Hi = 0x01
-			}
-			i++
-		}
-
-		// Copy the data to the DMA area
-		cpm.Memory.SetRange(cpm.dma, data...)
-
-		// Update the next read position
-		fcbPtr.IncreaseSequentialOffset()
-
-		// Update the FCB in memory
-		cpm.Memory.SetRange(ptr, fcbPtr.AsBytes()...)
-
-		// All done
-		return nil
-	}
-
-	_, err := obj.handle.Seek(int64(offset), io.SeekStart)
+	// Move to the next extent if we've read the last record of this one.
+	err := cpm.nextExtent(obj, &fcbPtr)
 	if err != nil {
-		return fmt.Errorf("cannot seek to position %d: %s", offset, err)
+		return err
 	}
 
-	// Read from the file, now we're in the right place
-	_, err = obj.handle.Read(data)
+	// Get the next read position
+	offset := fcbPtr.GetSequentialOffset()
+
+	// Read from the file, at the right place
+	n, err := obj.handle.ReadAt(data, offset)
 	if err != nil && err != io.EOF {
 		return fmt.Errorf("error reading file %s", err)
 	}
 
 	// Add logging of the result and details.
-	slog.Debug("SysCallRead",
-		slog.Int("dma", int(cpm.dma)),
-		slog.Int("fcb", int(ptr)),
-		slog.Int("handle", int(obj.handle.Fd())),
-		slog.Int("offset", int(offset)))
+	if logEnabled(slog.LevelDebug) {
+		slog.Debug("SysCallRead",
+			slog.Int("dma", int(cpm.dma)),
+			slog.Int("fcb", int(ptr)),
+			slog.String("path", obj.name),
+			slog.Int("offset", int(offset)))
+	}
 
 	// Copy the data to the DMA area
 	cpm.Memory.SetRange(cpm.dma, data...)
 
+	// If we read nothing we're at the end of the file, and the
+	// position is left alone, so a subsequent write appends.
+	if n == 0 {
+		cpm.Memory.SetRange(ptr, fcbPtr.AsBytes()...)
+		cpm.CPU.States.AF.Hi = 0x01
+		return nil
+	}
+
 	// Update the next read position
 	fcbPtr.IncreaseSequentialOffset()
 
 	// Update the FCB in memory
 	cpm.Memory.SetRange(ptr, fcbPtr.AsBytes()...)
 
-	// All done
-	if err == io.EOF {
-		cpm.CPU.States.AF.Hi = 0x01
-	} else {
-		cpm.CPU.States.AF.Hi = 0x00
+	cpm.CPU.States.AF.Hi = 0x00
+	return nil
+}
+
+// nextExtent moves the given FCB, used for sequential I/O, to the first
+// record of the following extent if the last record of its current extent
+// has been read or written, as CP/M does.
+//
+// The record-count is updated to that of the new extent.
+func (cpm *CPM) nextExtent(obj FileCache, fcbPtr *fcb.FCB) error {
+
+	if fcbPtr.Cr < fcb.ExtentRecords {
+		return nil
 	}
 
+	fcbPtr.SetExtent(fcbPtr.GetExtent() + 1)
+	fcbPtr.Cr = 0
+
+	rc, err := extentRecords(obj.handle, fcbPtr.GetExtent())
+	if err != nil {
+		return fmt.Errorf("failed to get file size of %s: %s", obj.name, err)
+	}
+	fcbPtr.RC = rc
 	return nil
 }
 
 // BdosSysCallWrite writes a record to the file named in the FCB given in DE
 func BdosSysCallWrite(cpm *CPM) error {
 
+	cpm.invalidateDirCache()
+
 	// The pointer to the FCB
 	ptr := cpm.CPU.States.DE.U16()
 	// Get the bytes which make up the FCB entry.
@@ -947,44 +957,65 @@ func BdosSysCallWrite(cpm *CPM) error {
 	if !ok {
 		slog.Error("SysCallWrite: Attempting to write to a file that isn't open")
 		cpm.CPU.States.AF.Hi = 0xFF
+
+		// Closed because its drive was remapped?
+		if cpm.staleFile(key) {
+			cpm.CPU.States.AF.Hi = 0x09
+		}
 		return nil
 	}
 
-	// A virtual handle, from our embedded resources.
-	if obj.handle == nil {
-		return fmt.Errorf("fatal error SysCallWrite against an embedded resource %v", obj)
+	// A file from our embedded resources, or a mounted archive, or
+	// one which could only be opened for reading.
+	//
+	// Return the "read-only file" extended error in H.
+	if obj.handle.ReadOnly() {
+		slog.Debug("SysCallWrite: Attempting to write to a read-only file",
+			slog.String("name", obj.name))
+		return cpm.bdosError(obj.drive[0], bdosErrFileRO)
+	}
+
+	// Move to the next extent if we've written the last record of this one.
+	err := cpm.nextExtent(obj, &fcbPtr)
+	if err != nil {
+		return err
 	}
 
 	// Get the next write position
 	offset := fcbPtr.GetSequentialOffset()
 
 	// Add logging of the result and details.
-	slog.Debug("SysCallWrite",
-		slog.Int("dma", int(cpm.dma)),
-		slog.Int("fcb", int(ptr)),
-		slog.Int("handle", int(obj.handle.Fd())),
-		slog.Int("offset", int(offset)))
+	if logEnabled(slog.LevelDebug) {
+		slog.Debug("SysCallWrite",
+			slog.Int("dma", int(cpm.dma)),
+			slog.Int("fcb", int(ptr)),
+			slog.String("path", obj.name),
+			slog.Int("offset", int(offset)))
+	}
 
 	// Get the data range from the DMA area
 	data := cpm.Memory.GetRange(cpm.dma, 128)
 
-	// Move to the correct place
-	_, err := obj.handle.Seek(int64(offset), io.SeekStart)
-	if err != nil {
-		return fmt.Errorf("cannot seek to position %d: %s", offset, err)
-	}
-
-	// Write to the open file
-	_, err = obj.handle.Write(data)
+	// Write to the open file, at the correct place
+	_, err = obj.handle.WriteAt(data, offset)
 	if err != nil {
-		return fmt.Errorf("error writing to file %s", err)
+		slog.Error("SysCallWrite: failed to write to file",
+			slog.String("name", obj.name),
+			slog.String("error", err.Error()))
+		return cpm.bdosError(obj.drive[0], bdosErrBadSector)
 	}
+	cpm.recordChange("modified", obj.name, "")
 
 	// Update the next write position
+	fcbPtr.S2 &^= fcb.S2Unmodified
 	fcbPtr.IncreaseSequentialOffset()
 
-	// Sigh.
-	fcbPtr.RC++
+	// The record-count is the end of the extent we wrote to, which
+	// doesn't change if we rewrote a record before it.
+	fcbPtr.RC, err = extentRecords(obj.handle, fcbPtr.GetExtent())
+	if err != nil {
+		return fmt.Errorf("failed to get file size of %s: %s", obj.name, err)
+	}
 
 	// Update the FCB in memory
 	cpm.Memory.SetRange(ptr, fcbPtr.AsBytes()...)
@@ -997,6 +1028,8 @@ func BdosSysCallWrite(cpm *CPM) error {
 // BdosSysCallMakeFile creates the file named in the FCB given in DE
 func BdosSysCallMakeFile(cpm *CPM) error {
 
+	cpm.invalidateDirCache()
+
 	// The pointer to the FCB
 	ptr := cpm.CPU.States.DE.U16()
 	// Get the bytes which make up the FCB entry.
@@ -1018,79 +1051,58 @@ func BdosSysCallMakeFile(cpm *CPM) error {
 	}
 
 	// drive will default to our current drive, if the FCB drive field is 0
-	drive := cpm.currentDrive + 'A'
-	if fcbPtr.Drive != 0 {
-		drive = fcbPtr.Drive + 'A' - 1
-	}
-
-	// Remap to the place we're supposed to use.
-	path := cpm.drives[string(drive)]
-
-	//
-	// Ok we have a filename, but we probably have an upper-case
-	// filename.
-	//
-	// Run a glob, and if there's an existing file with the same
-	// name then replace with the mixed/lower cased version.
-	//
-	files, err2 := os.ReadDir(path)
-	if err2 == nil {
-		for _, n := range files {
-			if strings.ToUpper(n.Name()) == fileName {
-				fileName = n.Name()
-			}
-		}
-	}
+	drive := string(cpm.fcbDrive(fcbPtr))
 
 	// child logger with more details.
 	l := slog.With(
 		slog.String("function", "SysCallMakeFile"),
 		slog.String("name", fileName),
-		slog.String("drive", string(cpm.currentDrive+'A')),
-		slog.String("result", fileName))
-
-	// Qualify the path
-	fileName = filepath.Join(path, fileName)
+		slog.String("drive", drive))
 
 	// Create the file
-	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0644)
+	file, err := cpm.getDrive(drive).Create(fileName)
 	if err != nil {
 
-		l.Debug("failed to open",
-			slog.String("path", fileName),
+		l.Debug("failed to create",
 			slog.String("error", err.Error()))
+
+		// An ambiguous name, or a read-only drive, is reported
+		// to the guest.
+		if errors.Is(err, ErrAmbiguous) {
+			cpm.CPU.States.AF.Hi = 0xFF
+			return nil
+		}
+		if errors.Is(err, ErrReadOnly) {
+			return cpm.bdosError(drive[0], bdosErrFileRO)
+		}
 		return err
 	}
 
 	// Get file size, in bytes
 	fi, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to get file size of %s: %s", fileName, err)
+		return fmt.Errorf("failed to get file size of %s: %s", file.Name(), err)
 	}
 
 	// Get file size, in bytes
 	fileSize := fi.Size()
 
-	// Get file size, in blocks
-	fLen := uint8(fileSize / blkSize)
-
 	// Set record-count
-	if fLen > maxRC {
-		fcbPtr.RC = maxRC
-	} else {
-		fcbPtr.RC = fLen
-	}
+	fcbPtr.RC = fcb.RecordsInExtent(fileSize, fcbPtr.GetExtent())
+	fcbPtr.S2 |= fcb.S2Unmodified
 
 	// Write our cache-key in the FCB
 	fcbPtr.Al[0] = uint8(ptr & 0xFF)
 	fcbPtr.Al[1] = uint8(ptr >> 8)
 
 	// Save the file-handle
-	cpm.files[ptr] = FileCache{name: fileName, handle: file}
+	cpm.files[ptr] = FileCache{name: file.Name(), drive: drive, handle: cpm.openBuffered(drive, file)}
+	delete(cpm.stale, ptr)
+	cpm.fileCreated(drive, fileName)
 
 	l.Debug("result:OK",
 		slog.Int("fcb", int(ptr)),
-		slog.Int("handle", int(file.Fd())),
+		slog.String("path", file.Name()),
 		slog.Int("record_count", int(fcbPtr.RC)),
 		slog.Int64("file_size", fileSize))
 
@@ -1106,9 +1118,16 @@ func BdosSysCallMakeFile(cpm *CPM) error {
 }
 
 // BdosSysCallRenameFile will handle a rename operation.
-// Note that this will not handle cross-directory renames (i.e. file moving).
+//
+// The source FCB may contain wildcards, in which case every matching file
+// is renamed, with wildcards in the destination being replaced by the
+// corresponding characters of each source name.
+//
+// Note that this will not handle cross-drive renames (i.e. file moving).
 func BdosSysCallRenameFile(cpm *CPM) error {
 
+	cpm.invalidateDirCache()
+
 	// 1. SRC
 
 	// The pointer to the FCB
@@ -1119,30 +1138,8 @@ func BdosSysCallRenameFile(cpm *CPM) error {
 	// Create a structure with the contents
 	fcbPtr := fcb.FromBytes(xxx)
 
-	// Get the actual name
-	fileName := fcbPtr.GetFileName()
-
-	// Point to the directory
-	path := cpm.drives[string(cpm.currentDrive+'A')]
-
-	//
-	// Ok we have a filename, but we probably have an upper-case
-	// filename.
-	//
-	// Run a glob, and if there's an existing file with the same
-	// name then replace with the mixed/lower cased version.
-	//
-	files, err2 := os.ReadDir(path)
-	if err2 == nil {
-		for _, n := range files {
-			if strings.ToUpper(n.Name()) == fileName {
-				fileName = n.Name()
-			}
-		}
-	}
-
-	// Ensure the filename is qualified
-	fileName = filepath.Join(path, fileName)
+	// drive will default to our current drive, if the FCB drive field is 0
+	drive := cpm.fcbDrive(fcbPtr)
 
 	// 2. DEST
 	// The pointer to the FCB
@@ -1151,22 +1148,73 @@ func BdosSysCallRenameFile(cpm *CPM) error {
 	// Create a structure with the contents
 	dstPtr := fcb.FromBytes(xxx2)
 
-	// Get the name
-	dstName := dstPtr.GetFileName()
+	// The destination drive must be the same as the source, if it
+	// is specified.  We can't move files between drives, so return
+	// the "select error" code in H.
+	if dstPtr.Drive != 0 && dstPtr.Drive+'A'-1 != drive {
+		slog.Debug("Renaming file failed, cross-drive rename",
+			slog.String("src", string(drive)),
+			slog.String("dst", string(dstPtr.Drive+'A'-1)))
 
-	// ensure the name is qualified
-	dstName = filepath.Join(path, dstName)
+		cpm.CPU.States.AF.Hi = 0xFF
+		cpm.CPU.States.HL.Hi = 0x04
+		return nil
+	}
 
-	slog.Debug("Renaming file",
-		slog.String("src", fileName),
-		slog.String("dst", dstName))
+	d := cpm.getDrive(string(drive))
+
+	// Find the matching files.
+	res, err := findFiles(d, fcbPtr)
+	if err != nil || len(res) == 0 {
+		slog.Debug("Renaming file failed, no matching files",
+			slog.String("pattern", fcbPtr.GetFileName()),
+			slog.String("drive", string(drive)))
 
-	err := os.Rename(fileName, dstName)
-	if err != nil {
-		slog.Debug("Renaming file failed",
-			slog.String("error", err.Error()))
 		cpm.CPU.States.AF.Hi = 0xFF
+		cpm.CPU.States.HL.Hi = 0x00
+		return nil
+	}
+
+	// Apply any protection against wildcard renames.
+	res, refused := cpm.protectWildcard("Rename", string(drive), fcbPtr, res)
 
+	// For each file we found, rename it.
+	//
+	// If the destination contains wildcards these are replaced by
+	// the corresponding characters of the source name, which allows
+	// "REN *.BAK=*.TXT" style renames.
+	for _, entry := range res {
+
+		newName := dstPtr.ExpandWildcards(entry.Name())
+
+		err = d.Rename(entry.Name(), newName)
+		if err != nil {
+			slog.Debug("Renaming file failed",
+				slog.String("src", entry.Name()),
+				slog.String("dst", newName),
+				slog.String("error", err.Error()))
+			// Files embedded in our binary can't be renamed.
+			if errors.Is(err, ErrReadOnly) || os.IsPermission(err) {
+				return cpm.bdosError(drive, bdosErrFileRO)
+			}
+
+			cpm.CPU.States.AF.Hi = 0xFF
+			cpm.CPU.States.HL.Hi = 0x00
+			return nil
+		}
+
+		// Files created by the guest keep that status.
+		key := createdKey(string(drive), entry.Name())
+		if cpm.created[key] {
+			delete(cpm.created, key)
+			cpm.fileCreated(string(drive), newName)
+		}
+	}
+
+	// Files which were refused are reported as read-only.
+	if refused > 0 {
+		cpm.CPU.States.AF.Hi = 0xFF
+		cpm.CPU.States.HL.Hi = 0x03
 		return nil
 	}
 
@@ -1180,9 +1228,14 @@ func BdosSysCallRenameFile(cpm *CPM) error {
 }
 
 // BdosSysCallLoginVec returns the list of logged in drives.
+//
+// HL contains a bitmap of the drives which exist, with bit 0 being A:,
+// which is always present.  Drives whose host directory doesn't exist are
+// not reported, so programs don't show empty drives.
 func BdosSysCallLoginVec(cpm *CPM) error {
-	cpm.CPU.States.HL.Hi = 0xFF
-	cpm.CPU.States.HL.Lo = 0xFF
+	vec := cpm.loginVector()
+	cpm.CPU.States.HL.SetU16(vec)
+	cpm.CPU.States.AF.Hi = uint8(vec & 0xFF)
 	return nil
 }
 
@@ -1238,10 +1291,42 @@ func BdosSysCallDriveROVec(cpm *CPM) error {
 	return nil
 }
 
-// BdosSysCallSetFileAttributes should update the attributes of the given
-// file, but it fakes it.
+// BdosSysCallSetFileAttributes should update the attributes of the files
+// matching the FCB given in DE, which may contain "?" wildcards, but it
+// fakes it.
+//
+// As with DRI's BDOS we do report an error if no file matches.
 func BdosSysCallSetFileAttributes(cpm *CPM) error {
+
+	// The pointer to the FCB
+	ptr := cpm.CPU.States.DE.U16()
+
+	// Get the bytes which make up the FCB entry, ignoring the
+	// attributes held in the high bits of the name.
+	fcbPtr := fcb.FromBytes(cpm.Memory.GetRange(ptr, fcb.SIZE))
+	for i := range fcbPtr.Name {
+		fcbPtr.Name[i] &= 0x7F
+	}
+	for i := range fcbPtr.Type {
+		fcbPtr.Type[i] &= 0x7F
+	}
+
+	// drive will default to our current drive, if the FCB drive field is 0
+	drive := string(cpm.fcbDrive(fcbPtr))
+
+	res, err := findFiles(cpm.getDrive(drive), fcbPtr)
+	if err != nil || len(res) == 0 {
+		slog.Debug("SysCallSetFileAttributes: no file matches",
+			slog.String("drive", drive),
+			slog.String("pattern", fcbPtr.GetFileName()))
+
+		cpm.CPU.States.AF.Hi = 0xFF
+		cpm.CPU.States.HL.Hi = 0x00
+		return nil
+	}
+
 	cpm.CPU.States.AF.Hi = 0x00
+	cpm.CPU.States.HL.Hi = 0x00
 	return nil
 }
 
@@ -1279,42 +1364,47 @@ func BdosSysCallUserNumber(cpm *CPM) error {
 }
 
 // BdosSysCallReadRand reads a random block from the FCB pointed to by DE into the DMA area.
+//
+// Once the record has been read the extent, and current record, of the FCB
+// refer to it, so that sequential reads continue from there.
 func BdosSysCallReadRand(cpm *CPM) error {
 	// Temporary area to read into
 	data := make([]byte, blkSize)
 
+	// fileSize holds the size of the file, once it has been read.
+	var fileSize int64
+
 	// sysRead reads from the given offset
 	//
 	// Return:
 	//  0 : read something successfully
-	//  1 : read nothing - error really
+	//  1 : reading unwritten data, within an extent which exists
+	//  4 : reading an extent which doesn't exist
 	//
-	sysRead := func(f *os.File, offset int64) int {
+	sysRead := func(f DriveFile, offset int64) int {
 
 		// Get file size, in bytes
 		fi, err := f.Stat()
 		if err != nil {
 			fmt.Printf("ReadRand:failed to get file size of: %s", err)
+			return 0xFF
 		}
-		fileSize := fi.Size()
-
-		// If the offset we're reading from is bigger than the file size then
-		// pad it up
-		if offset > fileSize {
-			return 06
-		}
+		fileSize = fi.Size()
 
-		_, err = f.Seek(offset, io.SeekStart)
-		if err != nil {
-			fmt.Printf("cannot seek to position %d: %s", offset, err)
-			return 0xFF
+		// Reading beyond the end of the file?
+		if offset >= fileSize {
+			extent := int(offset / blkSize / fcb.ExtentRecords)
+			if extent > 0 && fcb.RecordsInExtent(fileSize, extent) == 0 {
+				return 04
+			}
+			return 01
 		}
 
 		for i := range data {
 			data[i] = 0x1A
 		}
 
-		_, err = f.Read(data)
+		_, err = f.ReadAt(data, offset)
 		if err != nil {
 			if err != io.EOF {
 				fmt.Printf("failed to read offset %d: %s", offset, err)
@@ -1343,47 +1433,11 @@ func BdosSysCallReadRand(cpm *CPM) error {
 	if !ok {
 		slog.Error("SysCallReadRand: Attempting to read from a file that isn't open")
 		cpm.CPU.States.AF.Hi = 0xFF
-		return nil
-	}
-
-	// A virtual handle, from our embedded resources.
-	if obj.handle == nil {
 
-		// Remap
-		p := filepath.Join(string(cpm.currentDrive+'A'), filepath.Base(obj.name))
-
-		// open
-		file, err := fs.ReadFile(cpm.static, p)
-		if err != nil {
-			fmt.Printf("error on SysCallReadRand for virtual path (%s):%s\n", p, err)
+		// Closed because its drive was remapped?
+		if cpm.staleFile(key) {
+			cpm.CPU.States.AF.Hi = 0x09
 		}
-
-		// Get the record to read
-		record := int(int(fcbPtr.R2)<<16) | int(int(fcbPtr.R1)<<8) | int(fcbPtr.R0)
-
-		// Translate the record to a byte-offset
-		offset := int64(record) * blkSize
-
-		// copy each appropriate byte into the data-area
-		i := 0
-		var res uint8
-		for i < blkSize {
-			if int(offset)+i < len(file) {
-				data[i] = file[int(offset)+i]
-			} else {
-				res = 0x01
-			}
-			i++
-		}
-
-		// Copy the data to the DMA area
-		cpm.Memory.SetRange(cpm.dma, data...)
-
-		cpm.CPU.States.HL.Hi = 0x00
-		cpm.CPU.States.HL.Lo = 0x00
-		cpm.CPU.States.BC.Hi = 0x00
-		cpm.CPU.States.AF.Hi = uint8(res)
-
 		return nil
 	}
 
@@ -1396,15 +1450,23 @@ func BdosSysCallReadRand(cpm *CPM) error {
 	// Read the data
 	res := sysRead(obj.handle, fpos)
 
+	// Sequential I/O continues from the record we read.
+	if res == 0 {
+		fcbPtr.SetRecord(record)
+		fcbPtr.RC = fcb.RecordsInExtent(fileSize, fcbPtr.GetExtent())
+	}
+
 	// Add logging of the result and details.
-	slog.Debug("SysCallReadRand",
-		slog.Int("dma", int(cpm.dma)),
-		slog.Int("fcb", int(ptr)),
-		slog.Int("handle", int(obj.handle.Fd())),
-		slog.Int("record_count", int(fcbPtr.RC)),
-		slog.Int("record", record),
-		slog.Int64("fpos", fpos),
-		slog.Int("result", res))
+	if logEnabled(slog.LevelDebug) {
+		slog.Debug("SysCallReadRand",
+			slog.Int("dma", int(cpm.dma)),
+			slog.Int("fcb", int(ptr)),
+			slog.String("path", obj.name),
+			slog.Int("record_count", int(fcbPtr.RC)),
+			slog.Int("record", record),
+			slog.Int64("fpos", fpos),
+			slog.Int("result", res))
+	}
 
 	// Update the FCB in memory
 	cpm.Memory.SetRange(ptr, fcbPtr.AsBytes()...)
@@ -1417,8 +1479,13 @@ func BdosSysCallReadRand(cpm *CPM) error {
 }
 
 // BdosSysCallWriteRand writes a random block from DMA area to the FCB pointed to by DE.
+//
+// Once the record has been written the extent, and current record, of the
+// FCB refer to it, so that sequential writes continue from there.
 func BdosSysCallWriteRand(cpm *CPM) error {
 
+	cpm.invalidateDirCache()
+
 	// The pointer to the FCB
 	ptr := cpm.CPU.States.DE.U16()
 
@@ -1436,12 +1503,22 @@ func BdosSysCallWriteRand(cpm *CPM) error {
 	if !ok {
 		slog.Error("SysCallWriteRand: Attempting to write to a file that isn't open")
 		cpm.CPU.States.AF.Hi = 0xFF
+
+		// Closed because its drive was remapped?
+		if cpm.staleFile(key) {
+			cpm.CPU.States.AF.Hi = 0x09
+		}
 		return nil
 	}
 
-	// A virtual handle, from our embedded resources.
-	if obj.handle == nil {
-		return fmt.Errorf("fatal error SysCallWriteRand against an embedded resource %v", obj)
+	// A file from our embedded resources, or a mounted archive, or
+	// one which could only be opened for reading.
+	//
+	// Return the "read-only file" extended error in H.
+	if obj.handle.ReadOnly() {
+		slog.Debug("SysCallWriteRand: Attempting to write to a read-only file",
+			slog.String("name", obj.name))
+		return cpm.bdosError(obj.drive[0], bdosErrFileRO)
 	}
 
 	// Get the data range from the DMA area
@@ -1453,47 +1530,38 @@ func BdosSysCallWriteRand(cpm *CPM) error {
 	// Get the file position that translates to
 	fpos := int64(record) * blkSize
 
-	// Get file size, in bytes
-	fi, err := obj.handle.Stat()
-	if err != nil {
-		return fmt.Errorf("failed to get file size of: %s", err)
-	}
-	fileSize := fi.Size()
-
-	// If the offset we're writing to is bigger than the file size then
-	// we need to add an appropriate amount of padding.
-	padding := fpos - fileSize
-
 	// Add logging of the result and details.
-	slog.Debug("SysCallWriteRand",
-		slog.Int("dma", int(cpm.dma)),
-		slog.Int("fcb", int(ptr)),
-		slog.Int("padding", int(padding)),
-		slog.Int("handle", int(obj.handle.Fd())),
-		slog.Int("record_count", int(fcbPtr.RC)),
-		slog.Int("record", record),
-		slog.Int64("fpos", fpos))
-
-	for padding > 0 {
-		_, er := obj.handle.Write([]byte{0x00})
-		if er != nil {
-			return fmt.Errorf("error adding padding: %s", er)
-		}
-		padding--
+	if logEnabled(slog.LevelDebug) {
+		slog.Debug("SysCallWriteRand",
+			slog.Int("dma", int(cpm.dma)),
+			slog.Int("fcb", int(ptr)),
+			slog.String("path", obj.name),
+			slog.Int("record_count", int(fcbPtr.RC)),
+			slog.Int("record", record),
+			slog.Int64("fpos", fpos))
 	}
 
-	_, err = obj.handle.Seek(fpos, io.SeekStart)
+	// If the offset we're writing to is bigger than the file size then
+	// the gap is filled with zeros.
+	_, err := obj.handle.WriteAt(data, fpos)
 	if err != nil {
-		return fmt.Errorf("cannot seek to position %d: %s", fpos, err)
+		slog.Error("SysCallWriteRand: failed to write to file",
+			slog.String("name", obj.name),
+			slog.Int64("offset", fpos),
+			slog.String("error", err.Error()))
+		return cpm.bdosError(obj.drive[0], bdosErrBadSector)
 	}
+	cpm.recordChange("modified", obj.name, "")
 
-	_, err = obj.handle.Write(data)
+	// Sequential I/O continues from the record we wrote.
+	fcbPtr.S2 &^= fcb.S2Unmodified
+	fcbPtr.SetRecord(record)
+
+	fcbPtr.RC, err = extentRecords(obj.handle, fcbPtr.GetExtent())
 	if err != nil {
-		return fmt.Errorf("failed to write to offset %d: %s", fpos, err)
+		return fmt.Errorf("failed to get file size of %s: %s", obj.name, err)
 	}
 
-	fcbPtr.IncreaseSequentialOffset()
-
 	// Update the FCB in memory
 	cpm.Memory.SetRange(ptr, fcbPtr.AsBytes()...)
 
@@ -1527,60 +1595,27 @@ func BdosSysCallFileSize(cpm *CPM) error {
 	// Get the actual name
 	fileName := fcbPtr.GetFileName()
 
-	// Should we remap drives?
-	path := cpm.drives[string(cpm.currentDrive+'A')]
-
-	//
-	// Ok we have a filename, but we probably have an upper-case
-	// filename.
-	//
-	// Run a glob, and if there's an existing file with the same
-	// name then replace with the mixed/lower cased version.
-	//
-	files, err2 := os.ReadDir(path)
-	if err2 == nil {
-		for _, n := range files {
-			if strings.ToUpper(n.Name()) == fileName {
-				fileName = n.Name()
-			}
-		}
-	}
-
-	// ensure the path is qualified
-	fileName = filepath.Join(path, fileName)
-
-	// Remapped file
-	x := filepath.Base(fileName)
-	x = filepath.Join(string(cpm.currentDrive+'A'), x)
-
-	// fileSize we'll determine
-	var fileSize int64
-
-	// Can we open this file from our embedded filesystem?
-	virt, er := cpm.static.ReadFile(x)
-	if er == nil {
-
-		fileSize = int64(len(virt))
-	} else {
-
-		file, err := os.OpenFile(fileName, os.O_RDONLY, 0644)
-		if err != nil {
-			return fmt.Errorf("failed to open file for FileSize %s:%s", fileName, err)
-		}
+	// drive will default to our current drive, if the FCB drive field is 0
+	drive := string(cpm.fcbDrive(fcbPtr))
 
-		// ensure we close
-		defer file.Close()
+	// Get the details of the file.
+	fi, err := cpm.getDrive(drive).Stat(fileName)
+	if err != nil {
+		slog.Debug("SysCallFileSize: failed to find file",
+			slog.String("name", fileName),
+			slog.String("drive", drive),
+			slog.String("error", err.Error()))
 
-		// Get file size, in bytes
-		fi, err := file.Stat()
-		if err != nil {
-			return fmt.Errorf("failed to get file size of %s: %s", fileName, err)
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrAmbiguous) {
+			cpm.CPU.States.AF.Hi = 0xFF
+			return nil
 		}
-
-		fileSize = fi.Size()
-
+		return fmt.Errorf("failed to get file size of %s: %s", fileName, err)
 	}
 
+	// Get file size, in bytes
+	fileSize := fi.Size()
+
 	// Now we have the size we need to turn it into the number
 	// of records
 	records := int(fileSize / 128)
@@ -1626,8 +1661,8 @@ func BdosSysCallRandRecord(cpm *CPM) error {
 	// Create a structure with the contents
 	fcbPtr := fcb.FromBytes(xxx)
 
-	// So the sequential offset is found here
-	offset := int(fcbPtr.GetSequentialOffset())
+	// So the sequential offset is found here, as a record number
+	offset := int(fcbPtr.GetSequentialOffset() / blkSize)
 
 	// Now we set the "random record" which is R0,R1,R2
 	fcbPtr.R0 = uint8(offset & 0xFF)
@@ -1655,13 +1690,181 @@ func BdosSysCallRandRecord(cpm *CPM) error {
 // Resetting a drive removes its software read-only status.
 func BdosSysCallDriveReset(cpm *CPM) error {
 
+	cpm.invalidateDirCache()
+
 	// Fake success
 	cpm.CPU.States.AF.Hi = 0x00
 	return nil
 }
 
-// BdosSysCallErrorMode implements a NOP version of F_ERRMODE.
+// BdosSysCallDriveFree allows releasing specific drives, via the bits in DE,
+// in the same format as BdosSysCallDriveReset.
+//
+// This comes from MP/M, but debuggers such as SID and ZSID invoke it, so
+// we pretend it succeeded.
+func BdosSysCallDriveFree(cpm *CPM) error {
+
+	// Fake success
+	cpm.CPU.States.AF.Hi = 0x00
+	cpm.CPU.States.HL.SetU16(0x0000)
+	return nil
+}
+
+// BdosSysCallDriveFlush writes any buffered data for the open files to the
+// host, and commits it to storage, so that careful programs which flush
+// before they finish can rely upon their output surviving.
+//
+// This comes from CP/M 3, where E=0xFF additionally purges the buffers;
+// we don't keep data which could become stale, so that is ignored.
+//
+// On failure A is set to 0xFF, and H to 0x01 ("I/O error").
+func BdosSysCallDriveFlush(cpm *CPM) error {
+
+	err := cpm.syncFiles()
+	if err != nil {
+		cpm.CPU.States.AF.Hi = 0xFF
+		cpm.CPU.States.HL.Hi = 0x01
+		return nil
+	}
+
+	cpm.CPU.States.AF.Hi = 0x00
+	cpm.CPU.States.HL.SetU16(0x0000)
+	return nil
+}
+
+// BdosSysCallSCB gets, or sets, a value in the System Control Block.
+//
+// DE points to a parameter block, which contains:
+//
+//	DB offset   ; the offset within the SCB
+//	DB set      ; 0x00 to get, 0xFF to set a byte, 0xFE to set a word
+//	DW value    ; the value to set
+//
+// When getting a value the word is returned in HL, with the low byte
+// also in A.
+func BdosSysCallSCB(cpm *CPM) error {
+
+	addr := cpm.CPU.States.DE.U16()
+
+	offset := uint16(cpm.Memory.Get(addr))
+	op := cpm.Memory.Get(addr + 1)
+	value := cpm.Memory.GetU16(addr + 2)
+
+	// Default return value.
+	cpm.CPU.States.HL.SetU16(0x0000)
+	cpm.CPU.States.AF.Hi = 0x00
+
+	// Out of bounds offsets are ignored.
+	if offset >= scbSize {
+		return nil
+	}
+
+	// Ensure the SCB is up to date.
+	cpm.scbSync()
+
+	base := cpm.scbAddress()
+
+	switch op {
+	case 0xFF:
+		cpm.Memory.Set(base+offset, uint8(value&0xFF))
+		cpm.scbApply(offset)
+	case 0xFE:
+		cpm.Memory.Set(base+offset, uint8(value&0xFF))
+		if offset+1 < scbSize {
+			cpm.Memory.Set(base+offset+1, uint8(value>>8))
+		}
+		cpm.scbApply(offset)
+	default:
+		val := uint16(cpm.Memory.Get(base + offset))
+		if offset+1 < scbSize {
+			val |= uint16(cpm.Memory.Get(base+offset+1)) << 8
+		}
+		cpm.CPU.States.HL.SetU16(val)
+		cpm.CPU.States.AF.Hi = uint8(val & 0xFF)
+	}
+
+	return nil
+}
+
+// BdosSysCallErrorMode implements F_ERRMODE.
+//
+// We record the mode, so that it can be seen in the SCB, and consult it
+// when reporting errors, see bdosError.
 func BdosSysCallErrorMode(cpm *CPM) error {
+	cpm.errorMode = cpm.CPU.States.DE.Lo
+	return nil
+}
+
+// The BDOS error codes, which are returned in H when a program has asked
+// for errors to be returned via F_ERRMODE.
+const (
+	bdosErrBadSector = 0x01
+	bdosErrReadOnly  = 0x02
+	bdosErrFileRO    = 0x03
+	bdosErrSelect    = 0x04
+)
+
+// bdosErrMessages holds the traditional descriptions of our errors.
+var bdosErrMessages = map[uint8]string{
+	bdosErrBadSector: "Bad Sector",
+	bdosErrReadOnly:  "R/O",
+	bdosErrFileRO:    "File R/O",
+	bdosErrSelect:    "Select",
+}
+
+// bdosError reports an error with the given drive, 'A' to 'P', as
+// configured by the F_ERRMODE syscall.
+//
+// By default the error is shown, in the traditional format, and we wait
+// for a key to be pressed before we warm boot.  For a bad sector any key
+// other than Ctrl-C ignores the error, returning it to the caller.
+//
+// Mode 0xFE shows the error and then returns it to the caller, and mode
+// 0xFF returns it silently.  Errors are returned with A set to 0xFF and
+// H holding the error code.
+func (cpm *CPM) bdosError(drive byte, code uint8) error {
+
+	slog.Debug("BDOS error",
+		slog.String("drive", string(drive)),
+		slog.String("error", bdosErrMessages[code]),
+		slog.Int("mode", int(cpm.errorMode)))
+
+	if cpm.errorMode != 0xFF {
+		msg := fmt.Sprintf("\r\nBdos Err On %c: %s", drive, bdosErrMessages[code])
+		if cpm.errorMode == 0xFE {
+			msg += "\r\n"
+		}
+		for _, c := range []byte(msg) {
+			err := cpm.conOut(c)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if cpm.errorMode != 0xFE && cpm.errorMode != 0xFF {
+
+		// Wait for the user to acknowledge the error.
+		c, err := cpm.input.BlockForCharacterNoEcho()
+		if err != nil {
+			return err
+		}
+		err = cpm.conOut('\r')
+		if err == nil {
+			err = cpm.conOut('\n')
+		}
+		if err != nil {
+			return err
+		}
+
+		if code != bdosErrBadSector || c == 0x03 {
+			return ErrBoot
+		}
+	}
+
+	cpm.CPU.States.AF.Hi = 0xFF
+	cpm.CPU.States.HL.Hi = code
+	cpm.CPU.States.HL.Lo = 0xFF
 	return nil
 }
 
@@ -1670,6 +1873,130 @@ func BdosSysCallTime(cpm *CPM) error {
 	return nil
 }
 
+// BdosSysCallSerialNumber copies our six-byte serial number to the
+// address in DE.
+func BdosSysCallSerialNumber(cpm *CPM) error {
+
+	addr := cpm.CPU.States.DE.U16()
+	cpm.Memory.SetRange(addr, cpm.serial...)
+	return nil
+}
+
+// BdosSysCallReturnCode gets, or sets, the program return code, which
+// allows programs to tell those chained after them whether they were
+// successful.
+//
+// If DE is 0xFFFF the code is returned in HL, otherwise it is set to DE.
+func BdosSysCallReturnCode(cpm *CPM) error {
+
+	if cpm.CPU.States.DE.U16() == 0xFFFF {
+		cpm.CPU.States.HL.SetU16(cpm.returnCode)
+		cpm.CPU.States.AF.Hi = uint8(cpm.returnCode & 0xFF)
+		return nil
+	}
+
+	cpm.returnCode = cpm.CPU.States.DE.U16()
+	return nil
+}
+
+// BdosSysCallConsoleMode gets, or sets, the console mode, which controls
+// things like the handling of Ctrl-C and Ctrl-S under CP/M 3.
+//
+// If DE is 0xFFFF the mode is returned in HL, otherwise it is set to DE.
+// The bits we honour are described in cpm_console.go.
+func BdosSysCallConsoleMode(cpm *CPM) error {
+
+	if cpm.CPU.States.DE.U16() == 0xFFFF {
+		cpm.CPU.States.HL.SetU16(cpm.consoleMode)
+		cpm.CPU.States.AF.Hi = uint8(cpm.consoleMode & 0xFF)
+		return nil
+	}
+
+	cpm.consoleMode = cpm.CPU.States.DE.U16()
+	return nil
+}
+
+// BdosSysCallDelimiter gets, or sets, the character which terminates the
+// strings written by C_WRITESTRING.
+//
+// If DE is 0xFFFF the delimiter is returned in A, otherwise it is set to
+// the character in E.
+func BdosSysCallDelimiter(cpm *CPM) error {
+
+	if cpm.CPU.States.DE.U16() == 0xFFFF {
+		cpm.CPU.States.AF.Hi = cpm.delimiter
+		return nil
+	}
+
+	cpm.delimiter = cpm.CPU.States.DE.Lo
+	return nil
+}
+
+// BdosSysCallWriteBlock writes a block of characters to the console, as
+// C_WRITESTRING does, but with the length given rather than the string
+// being terminated.
+//
+// DE points to a character control block, which holds the address of the
+// characters, followed by their count, as words.
+func BdosSysCallWriteBlock(cpm *CPM) error {
+
+	ccb := cpm.CPU.States.DE.U16()
+	addr := cpm.Memory.GetU16(ccb)
+	count := cpm.Memory.GetU16(ccb + 2)
+
+	for i := uint16(0); i < count; i++ {
+		err := cpm.conOut(cpm.Memory.Get(addr + i))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BdosSysCallPrinterWriteBlock writes a block of characters to the
+// printer, as L_WRITE does.
+//
+// DE points to a character control block, as for C_WRITEBLOCK.
+func BdosSysCallPrinterWriteBlock(cpm *CPM) error {
+
+	ccb := cpm.CPU.States.DE.U16()
+	addr := cpm.Memory.GetU16(ccb)
+	count := cpm.Memory.GetU16(ccb + 2)
+
+	for i := uint16(0); i < count; i++ {
+		err := cpm.prnC(cpm.Memory.Get(addr + i))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BdosSysCallGSX passes the GSX request described by the parameter block
+// at DE to our graphics canvas, see cpm_graphics.go.
+//
+// If GSX isn't enabled we return 0xFFFF in HL, and 0xFF in A, as a BDOS
+// does for functions it doesn't support, and leave the parameter block
+// untouched, so that programs see GSX is not loaded.
+func BdosSysCallGSX(cpm *CPM) error {
+
+	if cpm.gsx == nil {
+		cpm.CPU.States.HL.SetU16(0xFFFF)
+		cpm.CPU.States.AF.Hi = 0xFF
+		return nil
+	}
+
+	cpm.CPU.States.HL.SetU16(0x0000)
+	cpm.CPU.States.AF.Hi = 0x00
+
+	err := cpm.gsxCall(cpm.CPU.States.DE.U16())
+	if err != nil {
+		slog.Error("failed to save GSX canvas",
+			slog.String("error", err.Error()))
+	}
+	return nil
+}
+
 // BdosSysCallDirectScreenFunctions receives a pointer in DE to a parameter block,
 // which specifies which function to run.  I've only seen this invoked in
 // TurboPascal when choosing the "Execute" or "Run" options.
@@ -1684,7 +2011,7 @@ func BdosSysCallDirectScreenFunctions(cpm *CPM) error {
 func BdosSysCallUptime(cpm *CPM) error {
 
 	// Get elapsed time, since startup
-	elapsed := time.Since(cpm.launchTime)
+	elapsed := cpm.now().Sub(cpm.launchTime)
 
 	// In nanoseconds
 	timer := elapsed.Nanoseconds()
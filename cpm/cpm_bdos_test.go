@@ -1,12 +1,17 @@
 package cpm
 
 import (
+	"bytes"
 	"errors"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/skx/cpmulator/asm"
 	"github.com/skx/cpmulator/consolein"
+	"github.com/skx/cpmulator/consoleout"
 	"github.com/skx/cpmulator/fcb"
 	"github.com/skx/cpmulator/memory"
 	"github.com/skx/cpmulator/static"
@@ -92,6 +97,88 @@ func TestConsoleInput(t *testing.T) {
 	}
 }
 
+// TestRawIOPending tests the ways in which programs poll for input via
+// C_RAWIO, all of which must see each key exactly once.
+//
+// Infocom games, such as Zork, poll with 0xFE and then read with 0xFD,
+// while other programs poll and read at once with 0xFF, and some mix the
+// two, or check the console status first.
+func TestRawIOPending(t *testing.T) {
+
+	c, err := New(WithPrinterPath("rawio.log"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.Memory = new(memory.Memory)
+	c.fixupRAM()
+	defer c.IOTearDown()
+
+	// rawIO invokes C_RAWIO with the given subfunction.
+	rawIO := func(sub uint8) uint8 {
+		c.CPU.States.DE.Lo = sub
+		err := BdosSysCallRawIO(c)
+		if err != nil {
+			t.Fatalf("failed to call C_RAWIO %02X: %s", sub, err)
+		}
+		return c.CPU.States.AF.Hi
+	}
+
+	// waitFor polls until input is ready.
+	waitFor := func(poll func() bool) {
+		for i := 0; i < 500; i++ {
+			if poll() {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("input never became ready")
+	}
+
+	c.input = consolein.NewFromReader(strings.NewReader("abcdef"))
+	c.StuffText("")
+
+	// Poll with 0xFE, read with 0xFD.
+	waitFor(func() bool { return rawIO(0xFE) == 0xFF })
+	if rawIO(0xFE) != 0xFF {
+		t.Fatalf("second poll lost the key")
+	}
+	if got := rawIO(0xFD); got != 'a' {
+		t.Fatalf("expected 'a', got %c", got)
+	}
+
+	// Poll and read with 0xFF.
+	got := uint8(0)
+	waitFor(func() bool { got = rawIO(0xFF); return got != 0x00 })
+	if got != 'b' {
+		t.Fatalf("expected 'b', got %c", got)
+	}
+
+	// Poll with 0xFE, then read with 0xFF.
+	waitFor(func() bool { return rawIO(0xFE) == 0xFF })
+	if got := rawIO(0xFF); got != 'c' {
+		t.Fatalf("expected 'c', got %c", got)
+	}
+
+	// Check the console status, then read with 0xFD.
+	waitFor(func() bool {
+		err := BdosSysCallConsoleStatus(c)
+		return err == nil && c.CPU.States.AF.Hi != 0x00
+	})
+	if got := rawIO(0xFD); got != 'd' {
+		t.Fatalf("expected 'd', got %c", got)
+	}
+
+	// Poll with 0xFE, then change the input driver, before reading.
+	waitFor(func() bool { return rawIO(0xFE) == 0xFF })
+	err = c.input.SetDriver("stty")
+	if err != nil {
+		t.Fatalf("failed to change driver: %s", err)
+	}
+	if got := rawIO(0xFD); got != 'e' {
+		t.Fatalf("expected 'e', got %c", got)
+	}
+}
+
 func TestUnimplemented(t *testing.T) {
 	// Create a new helper
 	c, err := New(WithPrinterPath("12.log"))
@@ -111,7 +198,10 @@ func TestUnimplemented(t *testing.T) {
 	defer os.Remove(file.Name())
 
 	// Make a call to BDOS function 99 - unimplemented
-	_, err = file.Write([]byte{0x0E, 0x63, 0xCD, 0x05, 0x00})
+	_, err = file.Write(asm.MustAssemble(`
+		LD C, 99
+		CALL 0x0005
+	`))
 
 	if err != nil {
 		t.Fatalf("failed to write program to temporary file")
@@ -159,8 +249,9 @@ func TestBoot(t *testing.T) {
 	}
 	defer os.Remove(file.Name())
 
-	// CALL 0x0000
-	_, err = file.Write([]byte{0xCD, 0x00, 0x00})
+	_, err = file.Write(asm.MustAssemble(`
+		CALL 0x0000
+	`))
 
 	if err != nil {
 		t.Fatalf("failed to write program to temporary file")
@@ -282,7 +373,7 @@ func TestFind(t *testing.T) {
 
 	}
 
-	if found != 7 {
+	if found != 14 {
 		t.Fatalf("found wrong number of embedded files, got %d", found)
 	}
 
@@ -495,12 +586,15 @@ func TestUserNumber(t *testing.T) {
 	}
 }
 
-// TestDriveReset tests that when a $-file is present the
+// TestDriveReset tests that when a $$$.SUB file is present on A: the
 // drive reset returns a different result, such that SUBMIT.COM
 // works - well more specifically so the CCP recognizes the file
 // that submit.com created.
 func TestDriveReset(t *testing.T) {
 
+	a := t.TempDir()
+	b := t.TempDir()
+
 	getState := func() uint8 {
 		// Create a new helper
 		c, err := New(WithPrinterPath("19.log"))
@@ -509,7 +603,13 @@ func TestDriveReset(t *testing.T) {
 		}
 		c.Memory = new(memory.Memory)
 
-		c.SetDrives(false)
+		c.SetDrives(true)
+		c.SetDrivePath("A", a)
+		c.SetDrivePath("B", b)
+
+		// The current drive, and user, don't matter.
+		c.currentDrive = 1
+		c.userNumber = 3
 
 		err = BdosSysCallDriveAllReset(c)
 		if err != nil {
@@ -518,25 +618,140 @@ func TestDriveReset(t *testing.T) {
 		return c.CPU.States.AF.Hi
 	}
 
+	create := func(dir string, name string) {
+		err := os.WriteFile(filepath.Join(dir, name), []byte{}, 0644)
+		if err != nil {
+			t.Fatalf("failed to create %s: %s", name, err)
+		}
+	}
+
 	if getState() != 0x00 {
 		t.Fatalf("getState != 0")
 	}
 
-	// Create a file with "$" in it
-	name := "NA$E.$$$"
-	_, err := os.Create(name)
-	if err != nil {
-		t.Fatalf("failed to create $-file")
+	// Other files with "$" in their names are ignored.
+	create(a, "NA$E.$$$")
+	if getState() != 0x00 {
+		t.Fatalf("getState != 0 with a $-file")
+	}
+
+	// As is a submit file on another drive.
+	create(b, "$$$.SUB")
+	if getState() != 0x00 {
+		t.Fatalf("getState != 0 with $$$.SUB on B:")
 	}
-	defer os.Remove(name)
 
-	// Now reset again and we should see 0xFF to trigger
+	// Now create it on A: and we should see 0xFF to trigger
 	// the submit.com behaviour
+	create(a, "$$$.sub")
 	if getState() != 0xFF {
 		t.Fatalf("getState != 0xFF")
 	}
 }
 
+// TestSubmitChain runs a SUBMIT job, via the CCP, which changes drives,
+// ensuring each of its commands is executed upon the right drive.
+func TestSubmitChain(t *testing.T) {
+
+	for _, ccp := range []string{"ccp", "ccpz"} {
+
+		a := t.TempDir()
+		b := t.TempDir()
+
+		// A job, written as SUBMIT.COM would, with the first command
+		// in the last record.
+		job := []string{"B:", "ERA OLD.TXT", "A:", "ERA GONE.TXT"}
+		sub := []byte{}
+		for i := len(job) - 1; i >= 0; i-- {
+			rec := make([]byte, blkSize)
+			rec[0] = byte(len(job[i]))
+			copy(rec[1:], job[i])
+			sub = append(sub, rec...)
+		}
+
+		files := map[string][]byte{
+			filepath.Join(a, "$$$.SUB"):  sub,
+			filepath.Join(a, "GONE.TXT"): {},
+			filepath.Join(a, "OLD.TXT"):  {},
+			filepath.Join(b, "OLD.TXT"):  {},
+			filepath.Join(b, "GONE.TXT"): {},
+			filepath.Join(b, "X$Y.TXT"):  {},
+		}
+		for path, data := range files {
+			err := os.WriteFile(path, data, 0644)
+			if err != nil {
+				t.Fatalf("failed to write %s: %s", path, err)
+			}
+		}
+
+		// Once the job is complete the CCP reads the console, which
+		// is empty.
+		//
+		// The "file" driver can't be used, as it reports pending
+		// input once it reaches the end of its input, which would
+		// abort the job if that happens while it is running.
+		obj, err := New(WithCCP(ccp), WithOutputDriver("buffer"))
+		if err != nil {
+			t.Fatalf("failed to create CPM: %s", err)
+		}
+		obj.input = consolein.NewFromDriver(emptyInput{})
+		obj.SetDrives(true)
+		obj.SetDrivePath("A", a)
+		obj.SetDrivePath("B", b)
+
+		err = obj.LoadCCP()
+		if err != nil {
+			t.Fatalf("failed to load CCP: %s", err)
+		}
+		_ = obj.Execute([]string{})
+
+		out, _ := obj.ReadOutput()
+
+		// The job ran to completion, upon the right drives.
+		gone := []string{
+			filepath.Join(a, "$$$.SUB"),
+			filepath.Join(a, "GONE.TXT"),
+			filepath.Join(b, "OLD.TXT"),
+		}
+		for _, path := range gone {
+			if _, err := os.Stat(path); err == nil {
+				t.Fatalf("%s: %s still exists, output:\n%s", ccp, path, out)
+			}
+		}
+		present := []string{
+			filepath.Join(a, "OLD.TXT"),
+			filepath.Join(b, "GONE.TXT"),
+			filepath.Join(b, "X$Y.TXT"),
+		}
+		for _, path := range present {
+			if _, err := os.Stat(path); err != nil {
+				t.Fatalf("%s: %s is missing, output:\n%s", ccp, path, out)
+			}
+		}
+	}
+}
+
+// emptyInput is a console input driver which never has input available,
+// and reports the end of its input when it is read.
+type emptyInput struct{}
+
+// Setup is part of the ConsoleInput interface, and does nothing.
+func (emptyInput) Setup() {}
+
+// TearDown is part of the ConsoleInput interface, and does nothing.
+func (emptyInput) TearDown() {}
+
+// PendingInput returns false, as we have no input.
+func (emptyInput) PendingInput() bool { return false }
+
+// BlockForCharacterNoEcho returns ErrEOF, as we have no input.
+func (emptyInput) BlockForCharacterNoEcho() (byte, error) {
+	return 0x00, consolein.ErrEOF
+}
+
+// GetName returns the name of this driver.
+func (emptyInput) GetName() string { return "empty" }
+
 // TestFileSize is incomplete because it doesn't handle
 // virtual files - TODO
 func TestFileSize(t *testing.T) {
@@ -689,6 +904,13 @@ func TestBDOSCoverage(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to call CPM")
 	}
+	err = BdosSysCallDriveFree(c)
+	if err != nil {
+		t.Fatalf("failed to call CPM")
+	}
+	if c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("unexpected result freeing drives")
+	}
 	err = BdosSysCallDriveSetRO(c)
 	if err != nil {
 		t.Fatalf("failed to call CPM")
@@ -921,6 +1143,63 @@ func TestDelete(t *testing.T) {
 
 }
 
+// TestDeleteEmbedded tests that embedded files can't be deleted, and that
+// the FCB drive is honoured.
+func TestDeleteEmbedded(t *testing.T) {
+
+	c, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.Memory = new(memory.Memory)
+	c.SetStaticFilesystem(static.GetContent())
+
+	dir := t.TempDir()
+	c.SetDrives(false)
+	c.SetDrivePath("A", dir)
+
+	err = os.WriteFile(filepath.Join(dir, "FOO.COM"), []byte("data"), 0644)
+	if err != nil {
+		t.Fatalf("failed to create file %s", err)
+	}
+
+	// We're on B:, but we'll delete from A:
+	c.currentDrive = 1
+
+	// The embedded files can't be deleted, but the host file can.
+	//
+	// We ask for the error to be returned, rather than prompting.
+	c.errorMode = 0xFF
+	fcbPtr := fcb.FromString("*.COM")
+	fcbPtr.Drive = 1
+	c.Memory.SetRange(0x0200, fcbPtr.AsBytes()...)
+
+	c.CPU.States.DE.SetU16(0x0200)
+	err = BdosSysCallDeleteFile(c)
+	if err != nil {
+		t.Fatalf("error calling CP/M")
+	}
+	if c.CPU.States.AF.Hi != 0xFF || c.CPU.States.HL.Hi != 0x03 {
+		t.Fatalf("expected read-only error, got A:%02X H:%02X", c.CPU.States.AF.Hi, c.CPU.States.HL.Hi)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "FOO.COM")); err == nil {
+		t.Fatalf("host file wasn't deleted")
+	}
+
+	// Deleting a missing file fails, with no extended error.
+	fcbPtr = fcb.FromString("MISSING.TXT")
+	fcbPtr.Drive = 1
+	c.Memory.SetRange(0x0200, fcbPtr.AsBytes()...)
+
+	err = BdosSysCallDeleteFile(c)
+	if err != nil {
+		t.Fatalf("error calling CP/M")
+	}
+	if c.CPU.States.AF.Hi != 0xFF || c.CPU.States.HL.Hi != 0x00 {
+		t.Fatalf("expected not-found, got A:%02X H:%02X", c.CPU.States.AF.Hi, c.CPU.States.HL.Hi)
+	}
+}
+
 // TestRename tests we can perform a simple rename.
 func TestRename(t *testing.T) {
 
@@ -953,11 +1232,28 @@ func TestRename(t *testing.T) {
 	fcbPtr.Drive = 3
 	c.Memory.SetRange(0x0200, fcbPtr.AsBytes()...)
 
-	// Dst
+	// Dst, on a different drive
 	dstPtr := fcb.FromString("AFTER")
 	dstPtr.Drive = 6
 	c.Memory.SetRange(0x0200+16, dstPtr.AsBytes()...)
 
+	// Call the rename function, which should fail
+	c.CPU.States.DE.SetU16(0x0200)
+	err = BdosSysCallRenameFile(c)
+	if err != nil {
+		t.Fatalf("error calling CP/M")
+	}
+	if c.CPU.States.AF.Hi != 0xFF || c.CPU.States.HL.Hi != 0x04 {
+		t.Fatalf("cross-drive rename succeeded")
+	}
+	if !fileExists("BEFORE") {
+		t.Fatalf("file was renamed")
+	}
+
+	// Dst, on the same drive
+	dstPtr.Drive = 3
+	c.Memory.SetRange(0x0200+16, dstPtr.AsBytes()...)
+
 	// Call the rename function
 	c.CPU.States.DE.SetU16(0x0200)
 	err = BdosSysCallRenameFile(c)
@@ -980,8 +1276,14 @@ func TestRename(t *testing.T) {
 	os.Remove("AFTER")
 
 	// Try to rename to a file that can't work
+	_, err = os.Create(name)
+	if err != nil {
+		t.Fatalf("failed to create file")
+	}
+	defer os.Remove(name)
+
 	dstPtr = fcb.FromString("/.>/>dsd:")
-	dstPtr.Drive = 6
+	dstPtr.Drive = 3
 	c.Memory.SetRange(0x0200+16, dstPtr.AsBytes()...)
 
 	// Call the rename function
@@ -994,6 +1296,64 @@ func TestRename(t *testing.T) {
 		t.Fatalf("renaming to an impossible name succeeded")
 	}
 
+	// Renaming a file which doesn't exist fails
+	fcbPtr = fcb.FromString("MISSING")
+	c.Memory.SetRange(0x0200, fcbPtr.AsBytes()...)
+	err = BdosSysCallRenameFile(c)
+	if err != nil {
+		t.Fatalf("error calling CP/M")
+	}
+	if c.CPU.States.AF.Hi != 0xFF {
+		t.Fatalf("renaming a missing file succeeded")
+	}
+}
+
+// TestRenameWildcard tests renaming files with wildcards.
+func TestRenameWildcard(t *testing.T) {
+
+	c, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.Memory = new(memory.Memory)
+
+	dir := t.TempDir()
+	c.SetDrives(false)
+	c.SetDrivePath("A", dir)
+
+	for _, name := range []string{"one.txt", "TWO.TXT", "three.com"} {
+		err = os.WriteFile(filepath.Join(dir, name), []byte("data"), 0644)
+		if err != nil {
+			t.Fatalf("failed to create file %s", err)
+		}
+	}
+
+	// REN *.BAK=*.TXT
+	src := fcb.FromString("*.TXT")
+	dst := fcb.FromString("*.BAK")
+	c.Memory.SetRange(0x0200, src.AsBytes()...)
+	c.Memory.SetRange(0x0200+16, dst.AsBytes()...)
+
+	c.CPU.States.DE.SetU16(0x0200)
+	err = BdosSysCallRenameFile(c)
+	if err != nil {
+		t.Fatalf("error calling CP/M")
+	}
+	if c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("wildcard rename failed")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read directory %s", err)
+	}
+	names := []string{}
+	for _, ent := range entries {
+		names = append(names, ent.Name())
+	}
+	if strings.Join(names, ",") != "ONE.BAK,TWO.BAK,three.com" {
+		t.Fatalf("unexpected files after rename: %v", names)
+	}
 }
 
 // TestWriteFile tests writing a sequential record to an open file.
@@ -1147,6 +1507,77 @@ func TestReadFile(t *testing.T) {
 
 }
 
+// TestReadOnlyFile tests that files which are read-only on the host may be
+// opened, and read, but not written.
+func TestReadOnlyFile(t *testing.T) {
+
+	c, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.Memory = new(memory.Memory)
+
+	dir := t.TempDir()
+	c.SetDrives(false)
+	c.SetDrivePath("A", dir)
+
+	path := filepath.Join(dir, "RO.TXT")
+	err = os.WriteFile(path, bytes.Repeat([]byte{'X'}, 128), 0444)
+	if err != nil {
+		t.Fatalf("failed to create file %s", err)
+	}
+
+	fcbPtr := fcb.FromString("RO.TXT")
+	c.Memory.SetRange(0x0200, fcbPtr.AsBytes()...)
+
+	c.CPU.States.DE.SetU16(0x0200)
+	err = BdosSysCallFileOpen(c)
+	if err != nil {
+		t.Fatalf("failed to open file: %s", err)
+	}
+	if c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("failed to open file: A=%02X", c.CPU.States.AF.Hi)
+	}
+	defer c.files[0x0200].handle.Close()
+
+	// root can open read-only files for writing, so we'll fake the
+	// fallback in that case.
+	obj, ok := c.files[0x0200].handle.(*bufferedFile).DriveFile.(*hostFile)
+	if !ok {
+		t.Fatalf("file wasn't opened from the host")
+	}
+	if !obj.readOnly {
+		if os.Geteuid() != 0 {
+			t.Fatalf("file wasn't opened read-only")
+		}
+		obj.readOnly = true
+	}
+
+	// Reading works
+	c.dma = 0x0080
+	err = BdosSysCallRead(c)
+	if err != nil {
+		t.Fatalf("failed to read file: %s", err)
+	}
+	if c.CPU.States.AF.Hi != 0x00 || c.Memory.Get(0x0080) != 'X' {
+		t.Fatalf("failed to read file: A=%02X", c.CPU.States.AF.Hi)
+	}
+
+	// Writing fails, with the read-only error, which we ask to be
+	// returned.
+	c.errorMode = 0xFF
+	for _, fn := range []func(*CPM) error{BdosSysCallWrite, BdosSysCallWriteRand} {
+		c.CPU.States.DE.SetU16(0x0200)
+		err = fn(c)
+		if err != nil {
+			t.Fatalf("unexpected error writing: %s", err)
+		}
+		if c.CPU.States.AF.Hi != 0xFF || c.CPU.States.HL.Hi != 0x03 {
+			t.Fatalf("write to read-only file gave A:%02X H:%02X", c.CPU.States.AF.Hi, c.CPU.States.HL.Hi)
+		}
+	}
+}
+
 // TestFileOpen ensures we can open files.
 func TestFileOpen(t *testing.T) {
 	// Create a new helper
@@ -1237,6 +1668,83 @@ func TestFileOpen(t *testing.T) {
 
 }
 
+// TestFileOpenWildcard tests that names containing "?" open the first
+// matching file, and that the FCB is updated to hold its name.
+func TestFileOpenWildcard(t *testing.T) {
+
+	c, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.Memory = new(memory.Memory)
+	c.fixupRAM()
+	defer c.IOTearDown()
+
+	dir := t.TempDir()
+	c.SetDrives(false)
+	c.SetDrivePath("A", dir)
+
+	for _, name := range []string{"REPORT.TXT", "README.DOC", "READ.ME"} {
+		err = os.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatalf("failed to create %s: %s", name, err)
+		}
+	}
+
+	open := func(pattern string) (uint8, fcb.FCB) {
+		f := fcb.FromString(pattern)
+		c.Memory.SetRange(0x0200, f.AsBytes()...)
+		c.CPU.States.DE.SetU16(0x0200)
+		err := BdosSysCallFileOpen(c)
+		if err != nil {
+			t.Fatalf("failed to open %s: %s", pattern, err)
+		}
+		return c.CPU.States.AF.Hi, fcb.FromBytes(c.Memory.GetRange(0x0200, fcb.SIZE))
+	}
+
+	// The first match, in directory order, is opened.
+	res, f := open("READ????.???")
+	if res != 0x00 || f.GetFileName() != "READ.ME" {
+		t.Fatalf("unexpected result %02X %s", res, f.GetFileName())
+	}
+	res, f = open("RE????.?X?")
+	if res != 0x00 || f.GetFileName() != "REPORT.TXT" {
+		t.Fatalf("unexpected result %02X %s", res, f.GetFileName())
+	}
+	if f.RC != 1 {
+		t.Fatalf("unexpected record count %d", f.RC)
+	}
+
+	// No match is an error.
+	res, _ = open("*.COM")
+	if res != 0xFF {
+		t.Fatalf("expected failure opening *.COM, got %02X", res)
+	}
+
+	// Attributes may be set upon matching files, but not upon files
+	// which don't exist.
+	for _, test := range []struct {
+		pattern string
+		result  uint8
+	}{
+		{"READ.ME", 0x00},
+		{"*.TXT", 0x00},
+		{"*.COM", 0xFF},
+	} {
+		f := fcb.FromString(test.pattern)
+		f.Type[0] |= 0x80
+		c.Memory.SetRange(0x0200, f.AsBytes()...)
+		c.CPU.States.DE.SetU16(0x0200)
+		err = BdosSysCallSetFileAttributes(c)
+		if err != nil {
+			t.Fatalf("failed to set attributes: %s", err)
+		}
+		if c.CPU.States.AF.Hi != test.result {
+			t.Fatalf("unexpected result for %s: %02X", test.pattern, c.CPU.States.AF.Hi)
+		}
+	}
+}
+
 func TestRead(t *testing.T) {
 
 	// Create a new helper
@@ -1371,26 +1879,270 @@ func TestRead(t *testing.T) {
 
 }
 
-func TestTicks(t *testing.T) {
+// TestExtents ensures that files larger than a single extent may be read
+// by switching extents manually, as well as sequentially and randomly.
+func TestExtents(t *testing.T) {
 
-	// Create a new helper
 	c, err := New()
 	if err != nil {
 		t.Fatalf("failed to create CPM")
 	}
+	c.Memory = new(memory.Memory)
+	c.SetDrives(false)
+	c.SetDrivePath("A", t.TempDir())
 
-	// Ensure we have a launch time that was in the past.
-	if !c.launchTime.Before(time.Now()) {
-		t.Fatalf("time travel isn't possible")
+	// A file of 321 records, the last of which is partial, in which
+	// each record is filled with its number.
+	var data []byte
+	for i := 0; i < 320; i++ {
+		data = append(data, bytes.Repeat([]byte{byte(i)}, 128)...)
 	}
-
-	// Call the function
-	err = BdosSysCallUptime(c)
+	data = append(data, bytes.Repeat([]byte{0xAA}, 100)...)
+	err = os.WriteFile(filepath.Join(c.drives["A"], "BIG.DAT"), data, 0644)
 	if err != nil {
-		t.Fatalf("unexpected error getting ticks")
+		t.Fatalf("failed to write file: %s", err)
 	}
 
-	// Get the before time.
+	ptr := uint16(0x0200)
+	get := func() fcb.FCB {
+		return fcb.FromBytes(c.Memory.GetRange(ptr, fcb.SIZE))
+	}
+	call := func(fn func(*CPM) error) uint8 {
+		c.CPU.States.DE.SetU16(ptr)
+		err := fn(c)
+		if err != nil {
+			t.Fatalf("syscall failed: %s", err)
+		}
+		return c.CPU.States.AF.Hi
+	}
+	open := func(extent int) uint8 {
+		f := fcb.FromString("A:BIG.DAT")
+		f.SetExtent(extent)
+		c.Memory.SetRange(ptr, f.AsBytes()...)
+		return call(BdosSysCallFileOpen)
+	}
+	read := func(expected byte) {
+		if call(BdosSysCallRead) != 0x00 {
+			t.Fatalf("failed to read record %d", expected)
+		}
+		if c.Memory.Get(c.dma) != expected {
+			t.Fatalf("read record %d, expected %d", c.Memory.Get(c.dma), expected)
+		}
+	}
+
+	// Opening each extent gives its record count.
+	for extent, rc := range []uint8{128, 128, 65} {
+		if open(extent) != 0x00 {
+			t.Fatalf("failed to open extent %d", extent)
+		}
+		f := get()
+		if f.RC != rc || f.Ex != uint8(extent) || f.S2 != fcb.S2Unmodified {
+			t.Fatalf("extent %d has Ex:%d S2:%02X RC:%d", extent, f.Ex, f.S2, f.RC)
+		}
+		read(byte(extent * 128))
+	}
+	if open(3) != 0xFF {
+		t.Fatalf("opened an extent beyond the end of the file")
+	}
+
+	// Reading sequentially moves to the next extent.
+	open(0)
+	for i := 0; i < 128; i++ {
+		read(byte(i))
+	}
+	if f := get(); f.Ex != 0 || f.Cr != 128 {
+		t.Fatalf("unexpected position Ex:%d Cr:%d", f.Ex, f.Cr)
+	}
+	read(128)
+	if f := get(); f.Ex != 1 || f.Cr != 1 || f.RC != 128 {
+		t.Fatalf("unexpected position Ex:%d Cr:%d RC:%d", f.Ex, f.Cr, f.RC)
+	}
+
+	// A random read sets the position, so the record is re-read.
+	setRecord := func(record int) {
+		f := get()
+		f.R0 = uint8(record & 0xFF)
+		f.R1 = uint8(record >> 8)
+		c.Memory.SetRange(ptr, f.AsBytes()...)
+	}
+	setRecord(300)
+	if call(BdosSysCallReadRand) != 0x00 || c.Memory.Get(c.dma) != byte(300&0xFF) {
+		t.Fatalf("failed to read record 300")
+	}
+	if f := get(); f.Ex != 2 || f.Cr != 44 || f.RC != 65 {
+		t.Fatalf("unexpected position Ex:%d Cr:%d RC:%d", f.Ex, f.Cr, f.RC)
+	}
+	read(byte(300 & 0xFF))
+
+	// The random record is that of the next sequential read.
+	call(BdosSysCallRandRecord)
+	if f := get(); f.R0 != byte(301&0xFF) || f.R1 != 1 || f.R2 != 0 {
+		t.Fatalf("unexpected random record %d", int(f.R1)<<8|int(f.R0))
+	}
+
+	// Reading beyond the end of the file.
+	setRecord(321)
+	if res := call(BdosSysCallReadRand); res != 0x01 {
+		t.Fatalf("unexpected result reading unwritten data %02X", res)
+	}
+	setRecord(400)
+	if res := call(BdosSysCallReadRand); res != 0x04 {
+		t.Fatalf("unexpected result reading unwritten extent %02X", res)
+	}
+
+	// Reading the end of the file leaves the position alone.
+	open(2)
+	f := get()
+	f.Cr = 64
+	c.Memory.SetRange(ptr, f.AsBytes()...)
+	read(0xAA)
+	if call(BdosSysCallRead) != 0x01 {
+		t.Fatalf("expected end of file")
+	}
+	if f := get(); f.Ex != 2 || f.Cr != 65 {
+		t.Fatalf("unexpected position at end of file Ex:%d Cr:%d", f.Ex, f.Cr)
+	}
+
+	// Writing sequentially moves to the next extent, too.
+	f = fcb.FromString("A:NEW.DAT")
+	c.Memory.SetRange(ptr, f.AsBytes()...)
+	if call(BdosSysCallMakeFile) != 0x00 {
+		t.Fatalf("failed to create file")
+	}
+	for i := 0; i < 129; i++ {
+		if call(BdosSysCallWrite) != 0x00 {
+			t.Fatalf("failed to write record %d", i)
+		}
+	}
+	if f := get(); f.Ex != 1 || f.Cr != 1 || f.RC != 1 || f.S2 != 0 {
+		t.Fatalf("unexpected position Ex:%d Cr:%d RC:%d S2:%02X", f.Ex, f.Cr, f.RC, f.S2)
+	}
+	call(BdosSysCallFileClose)
+}
+
+// TestWriteRecordCount ensures the record-count is correct after writes
+// which rewrite earlier records, as well as those which append.
+func TestWriteRecordCount(t *testing.T) {
+
+	c, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.Memory = new(memory.Memory)
+	c.SetDrives(false)
+	c.SetDrivePath("A", t.TempDir())
+
+	ptr := uint16(0x0200)
+	call := func(fn func(*CPM) error) {
+		c.CPU.States.DE.SetU16(ptr)
+		err := fn(c)
+		if err != nil {
+			t.Fatalf("syscall failed: %s", err)
+		}
+		if c.CPU.States.AF.Hi != 0x00 {
+			t.Fatalf("syscall returned %02X", c.CPU.States.AF.Hi)
+		}
+	}
+	get := func() fcb.FCB {
+		return fcb.FromBytes(c.Memory.GetRange(ptr, fcb.SIZE))
+	}
+	seek := func(record int) {
+		f := get()
+		f.SetRecord(record)
+		c.Memory.SetRange(ptr, f.AsBytes()...)
+	}
+	write := func(count int) {
+		for i := 0; i < count; i++ {
+			call(BdosSysCallWrite)
+		}
+	}
+	expect := func(ex uint8, cr uint8, rc uint8) {
+		f := get()
+		if f.Ex != ex || f.Cr != cr || f.RC != rc {
+			t.Fatalf("expected Ex:%d Cr:%d RC:%d, got Ex:%d Cr:%d RC:%d", ex, cr, rc, f.Ex, f.Cr, f.RC)
+		}
+	}
+
+	f := fcb.FromString("A:REWRITE.DAT")
+	c.Memory.SetRange(ptr, f.AsBytes()...)
+	call(BdosSysCallMakeFile)
+
+	// Append ten records.
+	write(10)
+	expect(0, 10, 10)
+
+	// Seek back, and rewrite two records.
+	seek(3)
+	write(2)
+	expect(0, 5, 10)
+
+	// Seek to the end, and append again.
+	seek(10)
+	write(1)
+	expect(0, 11, 11)
+
+	// Fill the extent, and rewrite its start.
+	write(117)
+	expect(0, 128, 128)
+	seek(0)
+	write(1)
+	expect(0, 1, 128)
+
+	// Append into the next extent, then rewrite within the first.
+	seek(128)
+	write(3)
+	expect(1, 3, 3)
+	seek(126)
+	write(3)
+	expect(1, 1, 3)
+
+	// A random write sets the position, and the count of the extent.
+	f = get()
+	f.R0 = 200
+	c.Memory.SetRange(ptr, f.AsBytes()...)
+	call(BdosSysCallWriteRand)
+	expect(1, 72, 73)
+
+	call(BdosSysCallFileClose)
+
+	fi, err := os.Stat(filepath.Join(c.drives["A"], "REWRITE.DAT"))
+	if err != nil {
+		t.Fatalf("failed to stat file: %s", err)
+	}
+	if fi.Size() != 201*128 {
+		t.Fatalf("unexpected file size %d", fi.Size())
+	}
+
+	// Reopening the file, and rewriting, doesn't change the count.
+	f = fcb.FromString("A:REWRITE.DAT")
+	c.Memory.SetRange(ptr, f.AsBytes()...)
+	call(BdosSysCallFileOpen)
+	expect(0, 0, 128)
+	write(1)
+	expect(0, 1, 128)
+	call(BdosSysCallFileClose)
+}
+
+func TestTicks(t *testing.T) {
+
+	// Create a new helper
+	c, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+
+	// Ensure we have a launch time that was in the past.
+	if !c.launchTime.Before(time.Now()) {
+		t.Fatalf("time travel isn't possible")
+	}
+
+	// Call the function
+	err = BdosSysCallUptime(c)
+	if err != nil {
+		t.Fatalf("unexpected error getting ticks")
+	}
+
+	// Get the before time.
 	a := c.CPU.States.HL.U16()
 
 	// Call the function
@@ -1406,3 +2158,782 @@ func TestTicks(t *testing.T) {
 		t.Fatalf("no time has passed %d %d", a, b)
 	}
 }
+
+// TestKeymapPause tests how the Ctrl-S sent by ArrowLeft, in the wordstar
+// keymap of our input drivers, interacts with the pausing of output.
+func TestKeymapPause(t *testing.T) {
+
+	c, err := New(WithOutputDriver("logger"), WithInputDriver("stty"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.Memory = new(memory.Memory)
+	c.fixupRAM()
+
+	// ArrowLeft, then ArrowRight.
+	keys := "\x13\x04"
+
+	// Output via the BDOS pauses at ArrowLeft, and the ArrowRight
+	// which resumes it is consumed, just as typed keys would be.
+	c.lastBreakCheck = time.Time{}
+	c.StuffText(keys)
+	c.CPU.States.DE.Lo = 'A'
+	err = BdosSysCallWriteChar(c)
+	if err != nil {
+		t.Fatalf("failed to call CP/M")
+	}
+	if c.input.PendingInput() {
+		t.Fatalf("the cursor keys weren't consumed")
+	}
+
+	// Raw output doesn't pause, so the program reads both keys.
+	c.lastBreakCheck = time.Time{}
+	c.StuffText(keys)
+	c.CPU.States.DE.Lo = 'B'
+	err = BdosSysCallRawIO(c)
+	if err != nil {
+		t.Fatalf("failed to call CP/M")
+	}
+	for _, expected := range []byte(keys) {
+		out, _ := c.input.BlockForCharacterNoEcho()
+		if out != expected {
+			t.Fatalf("expected %02X, got %02X", expected, out)
+		}
+	}
+
+	// As does output via the BDOS, once the console mode disables
+	// pausing.
+	c.consoleMode = consoleModeNoStop
+	c.lastBreakCheck = time.Time{}
+	c.StuffText(keys)
+	c.CPU.States.DE.Lo = 'C'
+	err = BdosSysCallWriteChar(c)
+	if err != nil {
+		t.Fatalf("failed to call CP/M")
+	}
+	for _, expected := range []byte(keys) {
+		out, _ := c.input.BlockForCharacterNoEcho()
+		if out != expected {
+			t.Fatalf("expected %02X, got %02X", expected, out)
+		}
+	}
+
+	l, ok := c.GetOutputDriver().(*consoleout.OutputLoggingDriver)
+	if !ok {
+		t.Fatalf("failed to cast output driver")
+	}
+	if l.GetOutput() != "ABC" {
+		t.Fatalf("wrong output %q", l.GetOutput())
+	}
+}
+
+// TestConsoleOutput tests the console conventions of TAB expansion, and
+// Ctrl-S/Ctrl-P handling.
+func TestConsoleOutput(t *testing.T) {
+
+	prn := filepath.Join(t.TempDir(), "print.log")
+
+	c, err := New(WithPrinterPath(prn), WithOutputDriver("logger"), WithInputDriver("stty"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.Memory = new(memory.Memory)
+	c.fixupRAM()
+
+	// Ctrl-P enables printer-echo, the key is consumed
+	c.StuffText("\x10")
+	c.CPU.States.DE.Lo = 'A'
+	err = BdosSysCallWriteChar(c)
+	if err != nil {
+		t.Fatalf("failed to call CP/M")
+	}
+	if !c.printerEcho {
+		t.Fatalf("Ctrl-P didn't enable printer echo")
+	}
+	if c.input.PendingInput() {
+		t.Fatalf("Ctrl-P should have been consumed")
+	}
+
+	// TABs are expanded
+	c.Memory.SetRange(0x0200, []byte("B\tC$")...)
+	c.CPU.States.DE.SetU16(0x0200)
+	err = BdosSysCallWriteString(c)
+	if err != nil {
+		t.Fatalf("failed to call CP/M")
+	}
+
+	// Ctrl-S pauses, until a key, and other keys are preserved.
+	c.lastBreakCheck = time.Time{}
+	c.StuffText("\x13 x")
+	c.CPU.States.DE.Lo = 'D'
+	err = BdosSysCallWriteChar(c)
+	if err != nil {
+		t.Fatalf("failed to call CP/M")
+	}
+	c.lastBreakCheck = time.Time{}
+	err = BdosSysCallWriteChar(c)
+	if err != nil {
+		t.Fatalf("failed to call CP/M")
+	}
+	out, _ := c.input.BlockForCharacterNoEcho()
+	if out != 'x' {
+		t.Fatalf("pending input was lost, got %c", out)
+	}
+
+	// Ctrl-C while paused aborts.
+	c.lastBreakCheck = time.Time{}
+	c.StuffText("\x13\x03")
+	err = BdosSysCallWriteString(c)
+	if err != ErrBoot {
+		t.Fatalf("expected boot, got %v", err)
+	}
+
+	// Unless Ctrl-C handling is disabled.
+	c.lastBreakCheck = time.Time{}
+	c.input.SetInterruptCount(0)
+	c.StuffText("\x13\x03")
+	c.CPU.States.DE.Lo = 'D'
+	err = BdosSysCallWriteChar(c)
+	if err != nil {
+		t.Fatalf("failed to call CP/M")
+	}
+	c.input.SetInterruptCount(2)
+
+	// Ctrl-P disables printer-echo
+	c.lastBreakCheck = time.Time{}
+	c.StuffText("\x10")
+	c.CPU.States.DE.Lo = 'E'
+	err = BdosSysCallWriteChar(c)
+	if err != nil {
+		t.Fatalf("failed to call CP/M")
+	}
+	if c.printerEcho {
+		t.Fatalf("Ctrl-P didn't disable printer echo")
+	}
+
+	l, ok := c.GetOutputDriver().(*consoleout.OutputLoggingDriver)
+	if !ok {
+		t.Fatalf("failed to cast output driver")
+	}
+	if l.GetOutput() != "AB      CDDDE" {
+		t.Fatalf("wrong console output '%s'", l.GetOutput())
+	}
+
+	// Printer output is buffered until it is flushed.
+	c.flushPrinter()
+
+	data, err := os.ReadFile(prn)
+	if err != nil {
+		t.Fatalf("failed to read printer output %s", err)
+	}
+	if string(data) != "AB      CDDD" {
+		t.Fatalf("wrong printer output '%s'", data)
+	}
+}
+
+// TestConsoleMode tests that the CP/M 3 console mode, set via C_MODE, is
+// honoured, and the block output functions.
+func TestConsoleMode(t *testing.T) {
+
+	prn := filepath.Join(t.TempDir(), "print.log")
+
+	c, err := New(WithPrinterPath(prn), WithOutputDriver("logger"), WithInputDriver("stty"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.Memory = new(memory.Memory)
+	c.fixupRAM()
+	c.StuffText("")
+
+	mode := func(m uint16) {
+		c.CPU.States.DE.SetU16(m)
+		err = BdosSysCallConsoleMode(c)
+		if err != nil {
+			t.Fatalf("failed to set the console mode")
+		}
+	}
+
+	// Raw output doesn't expand TABs, or echo to the printer.
+	mode(consoleModeRaw)
+	c.printerEcho = true
+	c.Memory.SetRange(0x0200, []byte("A\tB$")...)
+	c.CPU.States.DE.SetU16(0x0200)
+	err = BdosSysCallWriteString(c)
+	if err != nil {
+		t.Fatalf("failed to call CP/M")
+	}
+	c.printerEcho = false
+
+	// Ctrl-S, and Ctrl-P, are left as input when disabled.
+	mode(consoleModeNoStop | consoleModeRaw)
+	c.lastBreakCheck = time.Time{}
+	c.StuffText("\x13")
+	c.CPU.States.DE.Lo = 'C'
+	err = BdosSysCallWriteChar(c)
+	if err != nil {
+		t.Fatalf("failed to call CP/M")
+	}
+	out, _ := c.input.BlockForCharacterNoEcho()
+	if out != 0x13 {
+		t.Fatalf("Ctrl-S was consumed, got %02X", out)
+	}
+	c.lastBreakCheck = time.Time{}
+	c.StuffText("\x10")
+	err = BdosSysCallWriteChar(c)
+	if err != nil || c.printerEcho {
+		t.Fatalf("Ctrl-P changed the printer echo")
+	}
+	out, _ = c.input.BlockForCharacterNoEcho()
+	if out != 0x10 {
+		t.Fatalf("Ctrl-P was consumed, got %02X", out)
+	}
+
+	// C_STAT may only report Ctrl-C.
+	mode(consoleModeCtrlCStatus)
+	c.StuffText("x")
+	err = BdosSysCallConsoleStatus(c)
+	if err != nil || c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("C_STAT reported a key other than Ctrl-C")
+	}
+	out, _ = c.input.BlockForCharacterNoEcho()
+	if out != 'x' {
+		t.Fatalf("pending input was lost, got %c", out)
+	}
+	c.StuffText("\x03")
+	err = BdosSysCallConsoleStatus(c)
+	if err != nil || c.CPU.States.AF.Hi != 0xFF {
+		t.Fatalf("C_STAT didn't report Ctrl-C")
+	}
+	c.input.BlockForCharacterNoEcho()
+
+	// Ctrl-C may be prevented from rebooting.
+	mode(consoleModeNoCtrlC)
+	c.Memory.Set(0x0300, 20)
+	c.CPU.States.DE.SetU16(0x0300)
+	c.StuffText("\x03\x03foo\n")
+	err = BdosSysCallReadString(c)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if c.Memory.Get(0x0301) != 3 || c.input.GetInterruptCount() != 2 {
+		t.Fatalf("unexpected input, or interrupt count")
+	}
+
+	// Blocks are written to the console, and the printer.
+	mode(0)
+	c.Memory.SetRange(0x0400, []byte("HELLO, WORLD")...)
+	c.Memory.SetRange(0x0410, 0x00, 0x04, 0x05, 0x00)
+	c.CPU.States.DE.SetU16(0x0410)
+	err = BdosSysCallWriteBlock(c)
+	if err != nil {
+		t.Fatalf("failed to call C_WRITEBLOCK")
+	}
+	err = BdosSysCallPrinterWriteBlock(c)
+	if err != nil {
+		t.Fatalf("failed to call L_WRITEBLOCK")
+	}
+
+	l, ok := c.GetOutputDriver().(*consoleout.OutputLoggingDriver)
+	if !ok {
+		t.Fatalf("failed to cast output driver")
+	}
+	if l.GetOutput() != "A\tBCCHELLO" {
+		t.Fatalf("wrong console output %q", l.GetOutput())
+	}
+
+	c.flushPrinter()
+	data, err := os.ReadFile(prn)
+	if err != nil || string(data) != "HELLO" {
+		t.Fatalf("wrong printer output %q %v", data, err)
+	}
+
+	// The mode is reset when the CCP is loaded.
+	mode(consoleModeRaw)
+	err = c.LoadCCP()
+	if err != nil || c.consoleMode != 0 {
+		t.Fatalf("the console mode wasn't reset")
+	}
+}
+
+// TestSCB tests getting and setting values in the System Control Block.
+func TestSCB(t *testing.T) {
+
+	c, err := New(WithPrinterPath("15.log"), WithTerminalSize(80, 25))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.Memory = new(memory.Memory)
+	c.fixupRAM()
+
+	// call invokes S_SCB with the given parameters.
+	call := func(offset uint8, op uint8, value uint16) uint16 {
+		c.Memory.Set(0x0200, offset)
+		c.Memory.Set(0x0201, op)
+		c.Memory.Set(0x0202, uint8(value&0xFF))
+		c.Memory.Set(0x0203, uint8(value>>8))
+		c.CPU.States.DE.SetU16(0x0200)
+		err := BdosSysCallSCB(c)
+		if err != nil {
+			t.Fatalf("failed to call S_SCB")
+		}
+		return c.CPU.States.HL.U16()
+	}
+
+	// Console width is reported as "columns - 1".
+	if call(scbConsoleWidth, 0x00, 0)&0xFF != 79 {
+		t.Fatalf("wrong console width")
+	}
+	if call(scbConsolePage, 0x00, 0)&0xFF != 25 {
+		t.Fatalf("wrong page length")
+	}
+	if c.CPU.States.AF.Hi != 25 {
+		t.Fatalf("A should match L")
+	}
+
+	// The base address points to the SCB itself.
+	if call(scbBaseAddress, 0x00, 0) != c.scbAddress() {
+		t.Fatalf("wrong SCB base address")
+	}
+
+	// Current drive and user number track our state.
+	c.currentDrive = 2
+	c.userNumber = 3
+	if call(scbCurrentDisk, 0x00, 0)&0xFF != 2 {
+		t.Fatalf("wrong current disk")
+	}
+	if call(scbUserNumber, 0x00, 0)&0xFF != 3 {
+		t.Fatalf("wrong user number")
+	}
+
+	// Setting them updates our state.
+	call(scbCurrentDisk, 0xFF, 4)
+	if c.currentDrive != 4 {
+		t.Fatalf("setting current disk failed")
+	}
+	call(scbUserNumber, 0xFF, 5)
+	if c.userNumber != 5 {
+		t.Fatalf("setting user number failed")
+	}
+
+	// Set a word.
+	call(scbReturnCode, 0xFE, 0xFF00)
+	if c.returnCode != 0xFF00 {
+		t.Fatalf("setting the return code failed")
+	}
+	if call(scbReturnCode, 0x00, 0) != 0xFF00 {
+		t.Fatalf("wrong return code")
+	}
+	call(scbDMA, 0xFE, 0x1234)
+	if c.dma != 0x1234 {
+		t.Fatalf("setting the DMA address failed")
+	}
+
+	// Error mode is tracked.
+	c.CPU.States.DE.Lo = 0xFF
+	err = BdosSysCallErrorMode(c)
+	if err != nil {
+		t.Fatalf("failed to set error mode")
+	}
+	if call(scbErrorMode, 0x00, 0)&0xFF != 0xFF {
+		t.Fatalf("wrong error mode")
+	}
+
+	// Bogus offsets return zero.
+	if call(0xF0, 0x00, 0) != 0x0000 {
+		t.Fatalf("out of bounds offset returned a value")
+	}
+}
+
+// syncFailure is a file which cannot be synced.
+type syncFailure struct {
+	DriveFile
+}
+
+// Sync always fails.
+func (s syncFailure) Sync() error {
+	return errors.New("sync failed")
+}
+
+// TestDriveFlush ensures DRV_FLUSH writes buffered data to the host, and
+// reports failures.
+func TestDriveFlush(t *testing.T) {
+
+	c, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.Memory = new(memory.Memory)
+	c.fixupRAM()
+
+	dir := t.TempDir()
+	c.drives["A"] = dir
+
+	// Create a file, and write a record to it.
+	fcbPtr := fcb.FromString("FLUSH.TXT")
+	c.Memory.SetRange(0x0200, fcbPtr.AsBytes()...)
+	c.CPU.States.DE.SetU16(0x0200)
+	err = BdosSysCallMakeFile(c)
+	if err != nil || c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("failed to create file")
+	}
+	defer c.files[0x0200].handle.Close()
+
+	c.Memory.FillRange(c.dma, 128, 'X')
+	c.CPU.States.DE.SetU16(0x0200)
+	err = BdosSysCallWrite(c)
+	if err != nil || c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("failed to write file")
+	}
+
+	// The write is buffered.
+	path := filepath.Join(dir, "FLUSH.TXT")
+	data, err := os.ReadFile(path)
+	if err != nil || len(data) != 0 {
+		t.Fatalf("write wasn't buffered: %d %v", len(data), err)
+	}
+
+	// Until it is flushed.
+	err = BdosSysCallDriveFlush(c)
+	if err != nil || c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("failed to flush")
+	}
+	data, err = os.ReadFile(path)
+	if err != nil || len(data) != 128 || data[0] != 'X' {
+		t.Fatalf("write wasn't flushed: %d %v", len(data), err)
+	}
+
+	// A failure is reported as an I/O error.
+	obj := c.files[0x0200]
+	obj.handle = syncFailure{DriveFile: obj.handle}
+	c.files[0x0200] = obj
+
+	err = BdosSysCallDriveFlush(c)
+	if err != nil {
+		t.Fatalf("unexpected error flushing: %s", err)
+	}
+	if c.CPU.States.AF.Hi != 0xFF || c.CPU.States.HL.Hi != 0x01 {
+		t.Fatalf("expected I/O error, got A=%02X H=%02X", c.CPU.States.AF.Hi, c.CPU.States.HL.Hi)
+	}
+}
+
+// TestLoginVec tests that only the drives which exist are reported as
+// logged in.
+func TestLoginVec(t *testing.T) {
+
+	c, err := New(WithPrinterPath("loginvec.log"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	defer os.Remove("loginvec.log")
+
+	// By default every drive uses the current directory.
+	c.SetDrives(false)
+	err = BdosSysCallLoginVec(c)
+	if err != nil {
+		t.Fatalf("failed to call CPM")
+	}
+	if c.CPU.States.HL.U16() != 0xFFFF {
+		t.Fatalf("expected all drives, got %04X", c.CPU.States.HL.U16())
+	}
+
+	// Drives whose directory is missing aren't present, except A:.
+	dir := t.TempDir()
+	for i := 0; i < 16; i++ {
+		c.SetDrivePath(string(rune('A'+i)), filepath.Join(dir, "missing"))
+	}
+	c.SetDrivePath("C", dir)
+	err = c.MountDrive("P", dir)
+	if err != nil {
+		t.Fatalf("failed to mount drive: %s", err)
+	}
+
+	err = BdosSysCallLoginVec(c)
+	if err != nil {
+		t.Fatalf("failed to call CPM")
+	}
+	if c.CPU.States.HL.U16() != 0x8005 {
+		t.Fatalf("unexpected login vector %04X", c.CPU.States.HL.U16())
+	}
+	if c.CPU.States.AF.Hi != 0x05 {
+		t.Fatalf("unexpected A %02X", c.CPU.States.AF.Hi)
+	}
+}
+
+// TestDriveSelectError tests that selecting a drive which doesn't exist
+// fails, as configured by the BDOS error mode.
+func TestDriveSelectError(t *testing.T) {
+
+	c, err := New(WithOutputDriver("logger"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.Memory = new(memory.Memory)
+	c.SetDrives(false)
+	c.SetDrivePath("E", filepath.Join(t.TempDir(), "missing"))
+
+	l := c.GetOutputDriver().(*consoleout.OutputLoggingDriver)
+
+	// By default the error is shown, and we reboot once a key is
+	// pressed.
+	c.StuffText(" ")
+	c.CPU.States.AF.Hi = 4
+	err = BdosSysCallDriveSet(c)
+	if err != ErrBoot {
+		t.Fatalf("expected a reboot, got %v", err)
+	}
+	if l.GetOutput() != "\r\nBdos Err On E: Select\r\n" {
+		t.Fatalf("unexpected output %q", l.GetOutput())
+	}
+	if c.currentDrive != 0 {
+		t.Fatalf("drive was changed")
+	}
+
+	// Mode 0xFF returns the error silently.
+	l.Reset()
+	c.CPU.States.DE.Lo = 0xFF
+	BdosSysCallErrorMode(c)
+	c.CPU.States.AF.Hi = 4
+	err = BdosSysCallDriveSet(c)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if c.CPU.States.AF.Hi != 0xFF || c.CPU.States.HL.Hi != 0x04 {
+		t.Fatalf("unexpected result A:%02X H:%02X", c.CPU.States.AF.Hi, c.CPU.States.HL.Hi)
+	}
+	if l.GetOutput() != "" {
+		t.Fatalf("unexpected output %q", l.GetOutput())
+	}
+
+	// Mode 0xFE shows it, and returns it.
+	c.CPU.States.DE.Lo = 0xFE
+	BdosSysCallErrorMode(c)
+	c.CPU.States.AF.Hi = 4
+	err = BdosSysCallDriveSet(c)
+	if err != nil || c.CPU.States.AF.Hi != 0xFF {
+		t.Fatalf("expected an error to be returned")
+	}
+	if !strings.Contains(l.GetOutput(), "Bdos Err On E: Select") {
+		t.Fatalf("unexpected output %q", l.GetOutput())
+	}
+
+	// Drives which exist may be selected.
+	c.CPU.States.AF.Hi = 2
+	err = BdosSysCallDriveSet(c)
+	if err != nil || c.CPU.States.AF.Hi != 0x00 || c.currentDrive != 2 {
+		t.Fatalf("failed to select C:")
+	}
+}
+
+// TestBdosErrorModes tests the handling of errors in each of the modes
+// which may be configured via F_ERRMODE.
+func TestBdosErrorModes(t *testing.T) {
+
+	c, err := New(WithOutputDriver("logger"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	l := c.GetOutputDriver().(*consoleout.OutputLoggingDriver)
+
+	// A bad sector may be ignored by pressing any key but Ctrl-C.
+	c.StuffText("x")
+	err = c.bdosError('B', bdosErrBadSector)
+	if err != nil {
+		t.Fatalf("expected the error to be ignored, got %v", err)
+	}
+	if c.CPU.States.AF.Hi != 0xFF || c.CPU.States.HL.Hi != bdosErrBadSector {
+		t.Fatalf("unexpected result A:%02X H:%02X", c.CPU.States.AF.Hi, c.CPU.States.HL.Hi)
+	}
+	if l.GetOutput() != "\r\nBdos Err On B: Bad Sector\r\n" {
+		t.Fatalf("unexpected output %q", l.GetOutput())
+	}
+
+	// Ctrl-C reboots.
+	c.StuffText("\x03")
+	err = c.bdosError('B', bdosErrBadSector)
+	if err != ErrBoot {
+		t.Fatalf("expected a reboot, got %v", err)
+	}
+
+	// Other errors always reboot.
+	c.StuffText("x")
+	err = c.bdosError('C', bdosErrFileRO)
+	if err != ErrBoot {
+		t.Fatalf("expected a reboot, got %v", err)
+	}
+	if !strings.HasSuffix(l.GetOutput(), "Bdos Err On C: File R/O\r\n") {
+		t.Fatalf("unexpected output %q", l.GetOutput())
+	}
+
+	// Running out of input while waiting is reported.
+	c.input = consolein.NewFromReader(strings.NewReader(""))
+	err = c.bdosError('C', bdosErrReadOnly)
+	if err != consolein.ErrEOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	// The other modes return the error without waiting.
+	for _, mode := range []uint8{0xFE, 0xFF} {
+		l.Reset()
+		c.errorMode = mode
+		err = c.bdosError('D', bdosErrReadOnly)
+		if err != nil || c.CPU.States.AF.Hi != 0xFF || c.CPU.States.HL.Hi != bdosErrReadOnly {
+			t.Fatalf("mode %02X didn't return the error", mode)
+		}
+		shown := l.GetOutput() == "\r\nBdos Err On D: R/O\r\n"
+		if shown != (mode == 0xFE) {
+			t.Fatalf("mode %02X gave output %q", mode, l.GetOutput())
+		}
+	}
+}
+
+// TestSystemVariables tests the CP/M 3 functions which installers use to
+// query, and set, system variables.
+func TestSystemVariables(t *testing.T) {
+
+	_, err := New(WithSerialNumber("12-34"))
+	if err == nil {
+		t.Fatalf("expected an error with a short serial number")
+	}
+
+	c, err := New(WithOutputDriver("logger"), WithSerialNumber("00-22-00-01-23-45"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.Memory = new(memory.Memory)
+	c.fixupRAM()
+
+	// The serial number is copied to DE.
+	c.CPU.States.DE.SetU16(0x0200)
+	err = BdosSysCallSerialNumber(c)
+	if err != nil {
+		t.Fatalf("failed to call S_SERIAL")
+	}
+	for i, b := range []byte{0x00, 0x22, 0x00, 0x01, 0x23, 0x45} {
+		if c.Memory.Get(0x0200+uint16(i)) != b {
+			t.Fatalf("wrong serial byte %d", i)
+		}
+	}
+
+	// The return code, and console mode, may be set and queried.
+	for _, handler := range []CPMHandlerType{BdosSysCallReturnCode, BdosSysCallConsoleMode} {
+		c.CPU.States.DE.SetU16(0xFF02)
+		err = handler(c)
+		if err != nil {
+			t.Fatalf("failed to set value")
+		}
+		c.CPU.States.DE.SetU16(0xFFFF)
+		err = handler(c)
+		if err != nil {
+			t.Fatalf("failed to get value")
+		}
+		if c.CPU.States.HL.U16() != 0xFF02 || c.CPU.States.AF.Hi != 0x02 {
+			t.Fatalf("wrong value %04X", c.CPU.States.HL.U16())
+		}
+	}
+	if c.returnCode != 0xFF02 || c.consoleMode != 0xFF02 {
+		t.Fatalf("values weren't stored")
+	}
+
+	// The delimiter may be changed, and is used by C_WRITESTRING.
+	c.CPU.States.DE.SetU16(0x0000 | '#')
+	err = BdosSysCallDelimiter(c)
+	if err != nil {
+		t.Fatalf("failed to set delimiter")
+	}
+	c.CPU.States.DE.SetU16(0xFFFF)
+	err = BdosSysCallDelimiter(c)
+	if err != nil || c.CPU.States.AF.Hi != '#' {
+		t.Fatalf("wrong delimiter")
+	}
+
+	c.Memory.SetRange(0x0300, []byte("$5#")...)
+	c.CPU.States.DE.SetU16(0x0300)
+	err = BdosSysCallWriteString(c)
+	if err != nil {
+		t.Fatalf("failed to write string")
+	}
+	l := c.GetOutputDriver().(*consoleout.OutputLoggingDriver)
+	if l.GetOutput() != "$5" {
+		t.Fatalf("wrong output '%s'", l.GetOutput())
+	}
+}
+
+// TestGSX tests that GSX requests are refused unless GSX is enabled, and
+// that the parameter block is processed when it is.
+func TestGSX(t *testing.T) {
+
+	// setup creates a parameter block, and the arrays it points to,
+	// for opening the workstation.
+	setup := func(c *CPM) {
+		c.Memory = new(memory.Memory)
+		c.fixupRAM()
+
+		// The addresses of CONTRL, INTIN, PTSIN, INTOUT, PTSOUT.
+		for i, addr := range []uint16{0x1000, 0x1100, 0x1200, 0x1300, 0x1400} {
+			c.Memory.Set(0x0200+uint16(2*i), uint8(addr&0xFF))
+			c.Memory.Set(0x0201+uint16(2*i), uint8(addr>>8))
+		}
+
+		// Open workstation, with 10 integer inputs.
+		c.Memory.Set(0x1000, 1)
+		c.Memory.Set(0x1006, 10)
+		c.CPU.States.DE.SetU16(0x0200)
+	}
+
+	// By default GSX isn't loaded.
+	c, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	setup(c)
+	err = BdosSysCallGSX(c)
+	if err != nil {
+		t.Fatalf("failed to call GSX")
+	}
+	if c.CPU.States.HL.U16() != 0xFFFF || c.CPU.States.AF.Hi != 0xFF {
+		t.Fatalf("GSX should not be present")
+	}
+	if c.Memory.GetU16(0x1008) != 0 {
+		t.Fatalf("parameter block was changed")
+	}
+
+	_, err = New(WithGSX("out.png@big"))
+	if err == nil {
+		t.Fatalf("expected an error with an invalid canvas")
+	}
+
+	path := filepath.Join(t.TempDir(), "out.png")
+	c, err = New(WithGSX(path + "@320x200"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	setup(c)
+	err = BdosSysCallGSX(c)
+	if err != nil {
+		t.Fatalf("failed to call GSX")
+	}
+	if c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("GSX should be present")
+	}
+
+	// The sizes of the output arrays are returned in CONTRL.
+	if c.Memory.GetU16(0x1004) != 6 || c.Memory.GetU16(0x1008) != 45 {
+		t.Fatalf("wrong output sizes %d %d", c.Memory.GetU16(0x1004), c.Memory.GetU16(0x1008))
+	}
+
+	// The first two integer outputs are the size of the canvas.
+	if c.Memory.GetU16(0x1300) != 319 || c.Memory.GetU16(0x1302) != 199 {
+		t.Fatalf("wrong canvas size")
+	}
+
+	// Closing the workstation saves the canvas.
+	c.Memory.Set(0x1000, 2)
+	err = BdosSysCallGSX(c)
+	if err != nil {
+		t.Fatalf("failed to call GSX")
+	}
+	_, err = os.Stat(path)
+	if err != nil {
+		t.Fatalf("canvas wasn't saved: %s", err)
+	}
+}
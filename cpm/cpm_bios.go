@@ -7,17 +7,17 @@
 package cpm
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"log/slog"
-	"os"
 	"strings"
-
-	"golang.org/x/term"
+	"time"
 
 	"github.com/koron-go/z80"
 	"github.com/skx/cpmulator/ccp"
 	"github.com/skx/cpmulator/consolein"
-	"github.com/skx/cpmulator/consoleout"
+	"github.com/skx/cpmulator/fcb"
+	"github.com/skx/cpmulator/static"
 	"github.com/skx/cpmulator/version"
 )
 
@@ -27,6 +27,7 @@ func BiosSysCallColdBoot(cpm *CPM) error {
 	// Set entry-point to 0x0000 which will result in
 	// a boot-trap.
 	cpm.CPU.States.PC = 0x0000
+	cpm.exit.warmBoot = true
 	return nil
 }
 
@@ -36,6 +37,7 @@ func BiosSysCallWarmBoot(cpm *CPM) error {
 	// Set entry-point to 0x0000 which will result in
 	// a boot-trap.
 	cpm.CPU.States.PC = 0x0000
+	cpm.exit.warmBoot = true
 	return nil
 }
 
@@ -43,7 +45,9 @@ func BiosSysCallWarmBoot(cpm *CPM) error {
 // pending, otherwise 0xFF.
 func BiosSysCallConsoleStatus(cpm *CPM) error {
 
-	if cpm.input.PendingInput() {
+	pending := cpm.input.PendingInput()
+	cpm.idlePoll(pending)
+	if pending {
 		cpm.CPU.States.AF.Hi = 0xFF
 	} else {
 		cpm.CPU.States.AF.Hi = 0x00
@@ -86,41 +90,121 @@ func BiosSysCallPrintChar(cpm *CPM) error {
 
 // BiosSysCallPrinterStatus returns status of current printer device.
 //
-// This is fake, and always returns "ready".
+// The printer is "not ready" if output couldn't be written to the printer
+// file, and hasn't been written since.
 func BiosSysCallPrinterStatus(cpm *CPM) error {
 
-	// Ready
-	cpm.CPU.States.AF.Hi = 0xFF
+	if cpm.printerReady() {
+		cpm.CPU.States.AF.Hi = 0xFF
+	} else {
+		cpm.CPU.States.AF.Hi = 0x00
+	}
 	return nil
 }
 
 // BiosSysCallScreenOutputStatus returns status of current screen output device.
 //
-// This is fake, and always returns "ready".
+// The console isn't ready while its output is paused, because too much
+// was written too quickly, see WithOutputLimit.
 func BiosSysCallScreenOutputStatus(cpm *CPM) error {
 
-	// Ready
-	cpm.CPU.States.AF.Hi = 0xFF
+	if cpm.output.Paused() {
+		cpm.CPU.States.AF.Hi = 0x00
+	} else {
+		cpm.CPU.States.AF.Hi = 0xFF
+	}
 	return nil
 }
 
 // BiosSysCallAuxInputStatus returns status of current auxiliary input device.
 //
-// This is fake, and always returns "ready".
+// Our auxiliary input is the console, so this reports whether console
+// input is pending, in the same way as CONST.
 func BiosSysCallAuxInputStatus(cpm *CPM) error {
 
-	// Ready
-	cpm.CPU.States.AF.Hi = 0xFF
+	if cpm.input.PendingInput() {
+		cpm.CPU.States.AF.Hi = 0xFF
+	} else {
+		cpm.CPU.States.AF.Hi = 0x00
+	}
 	return nil
 }
 
 // BiosSysCallAuxOutputStatus returns status of current auxiliary output device.
 //
-// This is fake, and always returns "ready".
+// Our auxiliary output is the console, so this is the same as CONOST.
 func BiosSysCallAuxOutputStatus(cpm *CPM) error {
+	return BiosSysCallScreenOutputStatus(cpm)
+}
+
+// biosEntries is the number of entries in our BIOS jump table.
+const biosEntries = 30
 
-	// Ready
-	cpm.CPU.States.AF.Hi = 0xFF
+// devTable describes our physical character devices, as returned by DEVTBL,
+// in order.  The console is the first, and the printer the second.
+//
+// Each entry is a name, of up to six characters, and the CP/M 3 mode bits,
+// 1 for input, and 2 for output.  None of our devices have a baud rate.
+var devTable = []struct {
+	name string
+	mode uint8
+}{
+	{"CRT", 0x03},
+	{"LPT", 0x02},
+}
+
+// deviceTableAddress returns the address of our character device table,
+// which follows the BIOS jump table, and the code it jumps to.
+func (cpm *CPM) deviceTableAddress() uint16 {
+	return cpm.biosAddress + biosEntries*8
+}
+
+// writeDeviceTable writes our character device table into RAM, in the
+// format used by CP/M 3.
+//
+// Each entry is eight bytes, the name padded with spaces, the mode, and
+// the baud rate, with a zero byte marking the end of the table.
+func (cpm *CPM) writeDeviceTable() {
+
+	// There's no room if the BIOS is at the very top of RAM.
+	addr := cpm.deviceTableAddress()
+	if int(addr)+len(devTable)*8+1 > 0x10000 {
+		return
+	}
+
+	for _, dev := range devTable {
+		name := fmt.Sprintf("%-6s", dev.name)
+		for i := 0; i < 6; i++ {
+			cpm.Memory.Set(addr+uint16(i), name[i])
+		}
+		cpm.Memory.Set(addr+6, dev.mode)
+		cpm.Memory.Set(addr+7, 0x00)
+		addr += 8
+	}
+	cpm.Memory.Set(addr, 0x00)
+}
+
+// BiosSysCallDeviceTable returns the address of the character device table
+// in HL, as CP/M 3 does.
+//
+// The table describes our physical devices, see devTable, and is placed
+// after the BIOS jump table each time a binary is launched.
+func BiosSysCallDeviceTable(cpm *CPM) error {
+
+	addr := cpm.deviceTableAddress()
+	cpm.CPU.States.HL.Hi = uint8(addr >> 8)
+	cpm.CPU.States.HL.Lo = uint8(addr & 0xFF)
+	return nil
+}
+
+// BiosSysCallDeviceInit initializes the physical device in C, which we
+// accept, since our devices have no baud rate, or other settings.
+func BiosSysCallDeviceInit(cpm *CPM) error {
+
+	if int(cpm.CPU.States.BC.Lo) >= len(devTable) {
+		slog.Debug("DEVINI called for an unknown device",
+			slog.Int("device", int(cpm.CPU.States.BC.Lo)))
+	}
 	return nil
 }
 
@@ -134,7 +218,8 @@ func BiosSysCallReserved1(cpm *CPM) error {
 	//    Are we running under cpmulator?  We always say yes!
 	//
 	// HL == 1
-	//    C == 0xff to get the ctrl-c count
+	//    C == 0xff to get the ctrl-c count, 0xfe means pass-through
+	//    C == 0xfe to pass ctrl-c through to the guest
 	//    C != 0xff to set the ctrl-c count
 	// ...
 	//
@@ -193,9 +278,16 @@ func BiosSysCallReserved1(cpm *CPM) error {
 
 	// Get/Set the ctrl-c flag
 	case 0x0001:
-		if c == 0xFF {
-			cpm.CPU.States.AF.Hi = uint8(cpm.input.GetInterruptCount())
-		} else {
+		switch c {
+		case 0xFF:
+			count := cpm.input.GetInterruptCount()
+			if count == consolein.InterruptPassThrough {
+				count = 0xFE
+			}
+			cpm.CPU.States.AF.Hi = uint8(count)
+		case 0xFE:
+			cpm.input.SetInterruptCount(consolein.InterruptPassThrough)
+		default:
 			cpm.input.SetInterruptCount(int(c))
 		}
 
@@ -223,8 +315,10 @@ func BiosSysCallReserved1(cpm *CPM) error {
 		// Get the string pointed to by DE
 		str := getStringFromMemory(de)
 
-		// Output driver needs to be created
-		driver, err := consoleout.New(str)
+		// Change the driver in place, so that the cursor, the
+		// buffering, and any observer are kept.
+		old := cpm.output.GetName()
+		err := cpm.output.ChangeDriver(str)
 
 		// If it failed we're not going to terminate the syscall, or
 		// the emulator, just ignore the attempt.
@@ -233,11 +327,8 @@ func BiosSysCallReserved1(cpm *CPM) error {
 			return nil
 		}
 
-		old := cpm.output.GetName()
-		cpm.output = driver
-
 		if old != str {
-			fmt.Printf("Input driver changed from %s to %s.\n", old, driver.GetName())
+			fmt.Printf("Input driver changed from %s to %s.\n", old, cpm.output.GetName())
 		}
 
 	// Get/Set the CCP
@@ -287,7 +378,7 @@ func BiosSysCallReserved1(cpm *CPM) error {
 
 	// Get terminal size in HL
 	case 0x0005:
-		width, height, err := term.GetSize(int(os.Stdin.Fd()))
+		width, height, err := cpm.getTerminalSize()
 
 		// This will fail on tests, and Windows probably.
 		cpm.CPU.States.HL.Hi = uint8(height)
@@ -347,25 +438,20 @@ func BiosSysCallReserved1(cpm *CPM) error {
 		// Get the string pointed to by DE
 		str := getStringFromMemory(de)
 
-		// Output driver needs to be created
-		driver, err := consolein.New(str)
+		oldName := cpm.input.GetName()
 
+		// Input driver needs to be created.
+		//
 		// If it failed we're not going to terminate the syscall, or
 		// the emulator, just ignore the attempt.
+		err := cpm.input.SetDriver(str)
 		if err != nil {
 			fmt.Printf("%s", err)
 			return nil
 		}
 
-		old := cpm.input
-		oldName := old.GetName()
-		old.TearDown()
-
-		driver.Setup()
-		cpm.input = driver
-
 		if oldName != str {
-			fmt.Printf("Input driver from %s to %s.\n", oldName, driver.GetName())
+			fmt.Printf("Input driver from %s to %s.\n", oldName, cpm.input.GetName())
 		}
 
 	// Set the host prefix
@@ -395,6 +481,233 @@ func BiosSysCallReserved1(cpm *CPM) error {
 		// set it
 		cpm.input.SetSystemCommandPrefix(str)
 
+	// Has the terminal been resized?
+	case 0x0009:
+
+		// A is 0xFF if the size changed since the last poll,
+		// and the (new) size is returned in HL, as per 0x0005.
+		cpm.CPU.States.AF.Hi = 0x00
+		if cpm.terminalSizeChanged() {
+			cpm.CPU.States.AF.Hi = 0xFF
+		}
+
+		width, height, err := cpm.getTerminalSize()
+		cpm.CPU.States.HL.Hi = uint8(height)
+		cpm.CPU.States.HL.Lo = uint8(width)
+
+		if err != nil {
+			return err
+		}
+
+	// Get/Set the path used for a drive.
+	case 0x000A:
+
+		if de == 0x0000 {
+			// Fill the DMA area with NULL bytes
+			addr := cpm.dma
+
+			end := addr + uint16(127)
+			for end > addr {
+				cpm.Memory.Set(end, 0x00)
+				end--
+			}
+			cpm.Memory.Set(addr, 0x00)
+
+			// C contains the drive number, 0-15.
+			if c > 15 {
+				cpm.CPU.States.AF.Hi = 0xFF
+				return nil
+			}
+
+			// now populate with our current value
+			str := cpm.drives[string(rune('A'+c))]
+			for i, c := range str {
+				if i >= 127 {
+					break
+				}
+				cpm.Memory.Set(addr+uint16(i), uint8(c))
+			}
+			cpm.CPU.States.AF.Hi = 0x00
+			return nil
+		}
+
+		// Read the string pointed to by DE, which will be
+		// "DRIVE: PATH", terminated by NULL or a newline.
+		str := ""
+		x := cpm.Memory.Get(de)
+		for x != 0x00 && x != '\r' && x != '\n' && len(str) < 128 {
+			str += string(rune(x))
+			de++
+			x = cpm.Memory.Get(de)
+		}
+
+		cpm.CPU.States.AF.Hi = 0x00
+		err := cpm.mountFromString(str)
+		if err != nil {
+			slog.Debug("failed to mount drive",
+				slog.String("request", str),
+				slog.String("error", err.Error()))
+			cpm.CPU.States.AF.Hi = 0xFF
+		}
+
+	// Restore the original path used for a drive.
+	case 0x000B:
+
+		// C contains the drive number, 0-15.
+		cpm.CPU.States.AF.Hi = 0x00
+		err := cpm.UnmountDrive(string(rune('A' + c)))
+		if err != nil {
+			cpm.CPU.States.AF.Hi = 0xFF
+		}
+
+	// Paste the contents of a host file into the console.
+	case 0x000C:
+
+		// Read the path pointed to by DE, terminated by NULL or
+		// a newline.
+		str := ""
+		x := cpm.Memory.Get(de)
+		for x != 0x00 && x != '\r' && x != '\n' && len(str) < 128 {
+			str += string(rune(x))
+			de++
+			x = cpm.Memory.Get(de)
+		}
+
+		cpm.CPU.States.AF.Hi = 0x00
+		err := cpm.PasteFile(str)
+		if err != nil {
+			slog.Debug("failed to paste file",
+				slog.String("request", str),
+				slog.String("error", err.Error()))
+			cpm.CPU.States.AF.Hi = 0xFF
+		}
+
+	// Get the position of the cursor.
+	case 0x000D:
+
+		// H is the row, and L the column, starting from zero.
+		// A is 0xFF if our output driver doesn't track the cursor,
+		// in which case only the column is known.
+		row, col, ok := cpm.GetCursorPosition()
+		cpm.CPU.States.HL.Hi = uint8(row)
+		cpm.CPU.States.HL.Lo = uint8(col)
+		cpm.CPU.States.AF.Hi = 0x00
+		if !ok {
+			cpm.CPU.States.AF.Hi = 0xFF
+		}
+
+	// Get the state of the drive mappings.
+	case 0x000E:
+
+		// HL is a bitmap of the drives which have a path, and DE a
+		// bitmap of those which were changed via function 0x000A,
+		// with bit 0 being A:.  The paths may be read via 0x000A.
+		var mapped, changed uint16
+		for i := 0; i < 16; i++ {
+			drive := string(rune('A' + i))
+			if cpm.drives[drive] != "" {
+				mapped |= 1 << i
+			}
+			if _, ok := cpm.mounts[drive]; ok {
+				changed |= 1 << i
+			}
+		}
+		cpm.CPU.States.HL.SetU16(mapped)
+		cpm.CPU.States.DE.SetU16(changed)
+
+	// Get the checksum of a file.
+	case 0x000F:
+
+		// DE points to an FCB naming the file, whose SHA-256 sum
+		// is written to the DMA area.  A reports whether it is
+		// the copy embedded within our binary.
+		f := fcb.FromBytes(cpm.Memory.GetRange(de, fcb.SIZE))
+		drive := string(cpm.fcbDrive(f))
+		name := f.GetFileName()
+
+		data, err := cpm.readDriveFile(drive, name)
+		if err != nil {
+			slog.Debug("failed to checksum file",
+				slog.String("drive", drive),
+				slog.String("name", name),
+				slog.String("error", err.Error()))
+			cpm.CPU.States.AF.Hi = 0xFF
+			return nil
+		}
+
+		sum := sha256.Sum256(data)
+		cpm.Memory.SetRange(cpm.dma, sum[:]...)
+
+		ent, ok := static.FindManifestEntry(drive + "/" + name)
+		switch {
+		case !ok:
+			cpm.CPU.States.AF.Hi = 0x02
+		case ent.Matches(data):
+			cpm.CPU.States.AF.Hi = 0x00
+		default:
+			cpm.CPU.States.AF.Hi = 0x01
+		}
+
+	// Copy a text file to the host clipboard.
+	case 0x0010:
+
+		// DE points to an FCB naming the file.
+		f := fcb.FromBytes(cpm.Memory.GetRange(de, fcb.SIZE))
+		drive := string(cpm.fcbDrive(f))
+
+		cpm.CPU.States.AF.Hi = 0x00
+		err := cpm.copyToClipboard(drive, f.GetFileName())
+		if err != nil {
+			slog.Debug("failed to copy file to the clipboard",
+				slog.String("drive", drive),
+				slog.String("name", f.GetFileName()),
+				slog.String("error", err.Error()))
+			cpm.CPU.States.AF.Hi = 0xFF
+		}
+
+	// Paste the host clipboard into the console, or a text file.
+	case 0x0011:
+
+		// DE points to an FCB naming the file, or is zero to
+		// paste into the console.
+		var err error
+		if de == 0x0000 {
+			err = cpm.PasteClipboard()
+		} else {
+			f := fcb.FromBytes(cpm.Memory.GetRange(de, fcb.SIZE))
+			err = cpm.pasteToFile(string(cpm.fcbDrive(f)), f.GetFileName())
+		}
+
+		cpm.CPU.States.AF.Hi = 0x00
+		if err != nil {
+			slog.Debug("failed to paste the clipboard",
+				slog.String("error", err.Error()))
+			cpm.CPU.States.AF.Hi = 0xFF
+		}
+
+	// Get a line of our help text.
+	case 0x0012:
+
+		// DE is the number of the line, which is written to the DMA
+		// area, NULL-terminated.  A is 0xFF past the final line.
+		lines := cpm.helpText()
+		if int(de) >= len(lines) {
+			cpm.CPU.States.AF.Hi = 0xFF
+			return nil
+		}
+
+		line := lines[de]
+		if len(line) > 127 {
+			line = line[:127]
+		}
+
+		addr := cpm.dma
+		for i := 0; i < len(line); i++ {
+			cpm.Memory.Set(addr+uint16(i), line[i])
+		}
+		cpm.Memory.Set(addr+uint16(len(line)), 0x00)
+		cpm.CPU.States.AF.Hi = 0x00
+
 	default:
 		fmt.Printf("Unknown custom BIOS function HL:%04X, ignoring", hl)
 	}
@@ -426,27 +739,22 @@ func (cpm *CPM) BiosHandler(val uint8) {
 		return
 	}
 
-	if !handler.Noisy {
+	// Log the call we're going to make
+	cpm.logSyscall("BIOS", val, handler)
 
-		// show the function being invoked.
-		if cpm.simpleDebug {
-			fmt.Printf("%03d %s\n", val, handler.Desc)
-		}
+	cpm.publishSyscall("BIOS", val, handler.Desc)
 
-		// Log the call we're going to make
-		slog.Info("BIOS",
-			slog.String("name", handler.Desc),
-			slog.Int("syscall", int(val)),
-			slog.String("syscallHex", fmt.Sprintf("0x%02X", val)),
-			slog.Group("registers",
-				slog.String("AF", fmt.Sprintf("%04X", cpm.CPU.States.AF.U16())),
-				slog.String("BC", fmt.Sprintf("%04X", cpm.CPU.States.BC.U16())),
-				slog.String("DE", fmt.Sprintf("%04X", cpm.CPU.States.DE.U16())),
-				slog.String("HL", fmt.Sprintf("%04X", cpm.CPU.States.HL.U16()))))
-	}
-
-	// Otherwise invoke it, and look for any error
+	// Otherwise invoke it, timing it if we're profiling, and look for
+	// any error
+	cpm.syscallCount++
+	start := time.Now()
 	err := handler.Handler(cpm)
+	cpm.profileSyscall("BIOS", val, handler.Desc, time.Since(start))
+
+	// Did the handler write too much output?
+	if err == nil {
+		err = cpm.outputThrottle()
+	}
 
 	// If there was an error then record it for later notice.
 	if err != nil {
@@ -1,9 +1,15 @@
 package cpm
 
 import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/skx/cpmulator/fcb"
 	"github.com/skx/cpmulator/memory"
 )
 
@@ -241,6 +247,48 @@ func TestCustom(t *testing.T) {
 	c.CPU.States.HL.SetU16(0x0005)
 	_ = BiosSysCallReserved1(c)
 
+	// With a fixed size we get that back, and no error.
+	c.termWidth = 80
+	c.termHeight = 24
+	c.CPU.States.HL.SetU16(0x0005)
+	err = BiosSysCallReserved1(c)
+	if err != nil {
+		t.Fatalf("error calling reserved function")
+	}
+	if c.CPU.States.HL.Hi != 24 || c.CPU.States.HL.Lo != 80 {
+		t.Fatalf("wrong terminal size %dx%d", c.CPU.States.HL.Lo, c.CPU.States.HL.Hi)
+	}
+
+	// 0x0009
+	// Terminal resized?
+	c.CPU.States.HL.SetU16(0x0009)
+	err = BiosSysCallReserved1(c)
+	if err != nil {
+		t.Fatalf("error calling reserved function")
+	}
+	if c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("terminal size changed unexpectedly")
+	}
+	c.sizeChanged = true
+	c.CPU.States.HL.SetU16(0x0009)
+	err = BiosSysCallReserved1(c)
+	if err != nil {
+		t.Fatalf("error calling reserved function")
+	}
+	if c.CPU.States.AF.Hi != 0xFF {
+		t.Fatalf("terminal size change was not reported")
+	}
+	if c.CPU.States.HL.Hi != 24 || c.CPU.States.HL.Lo != 80 {
+		t.Fatalf("wrong terminal size %dx%d", c.CPU.States.HL.Lo, c.CPU.States.HL.Hi)
+	}
+	// The flag is reset once read
+	if c.sizeChanged {
+		t.Fatalf("terminal size change flag was not reset")
+	}
+
+	c.termWidth = 0
+	c.termHeight = 0
+
 	// 0x0006
 	// Debug Flag
 	c.CPU.States.HL.SetU16(0x0006)
@@ -367,6 +415,134 @@ func TestCustom(t *testing.T) {
 
 }
 
+// TestMountDrive tests that drives may be remapped, and restored, via
+// our custom BIOS functions.
+func TestMountDrive(t *testing.T) {
+
+	c, err := New(WithPrinterPath("mount.log"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.Memory = new(memory.Memory)
+	c.SetDrives(false)
+
+	// Open a file, so we can confirm it is closed when the drive changes
+	dir := t.TempDir()
+	handle, err := os.CreateTemp(".", "mount-*.txt")
+	if err != nil {
+		t.Fatalf("failed to create temporary file")
+	}
+	defer os.Remove(handle.Name())
+	c.files[0x0300] = FileCache{name: handle.Name(), drive: "E", handle: &hostFile{File: handle}}
+
+	// Mount E: to our temporary directory
+	c.Memory.SetRange(0x0200, []byte("E: "+dir)...)
+	c.Memory.Set(0x0200+uint16(len("E: "+dir)), 0x00)
+	c.CPU.States.HL.SetU16(0x000A)
+	c.CPU.States.DE.SetU16(0x0200)
+	err = BiosSysCallReserved1(c)
+	if err != nil {
+		t.Fatalf("error calling reserved function")
+	}
+	if c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("failed to mount drive")
+	}
+	if c.drives["E"] != dir {
+		t.Fatalf("drive path wasn't changed, got %s", c.drives["E"])
+	}
+	if len(c.files) != 0 {
+		t.Fatalf("open files weren't closed")
+	}
+
+	// Reading from the closed file reports an error
+	f := fcb.FromString("E:FOO")
+	f.Al[0] = 0x00
+	f.Al[1] = 0x03
+	c.Memory.SetRange(0x0300, f.AsBytes()...)
+	c.CPU.States.DE.SetU16(0x0300)
+	err = BdosSysCallRead(c)
+	if err != nil {
+		t.Fatalf("error reading file")
+	}
+	if c.CPU.States.AF.Hi != 0x09 {
+		t.Fatalf("expected an error reading a closed file, got %02X", c.CPU.States.AF.Hi)
+	}
+
+	// Read it back, via the DMA area
+	c.CPU.States.HL.SetU16(0x000A)
+	c.CPU.States.DE.SetU16(0x0000)
+	c.CPU.States.BC.Lo = 4
+	err = BiosSysCallReserved1(c)
+	if err != nil {
+		t.Fatalf("error calling reserved function")
+	}
+	str := ""
+	for addr := c.dma; c.Memory.Get(addr) != 0x00; addr++ {
+		str += string(rune(c.Memory.Get(addr)))
+	}
+	if str != dir {
+		t.Fatalf("unexpected drive path '%s'", str)
+	}
+
+	// E: is reported as changed.
+	c.CPU.States.HL.SetU16(0x000E)
+	err = BiosSysCallReserved1(c)
+	if err != nil {
+		t.Fatalf("error calling reserved function")
+	}
+	if c.CPU.States.HL.U16()&0x0010 == 0 || c.CPU.States.DE.U16() != 0x0010 {
+		t.Fatalf("unexpected drive state %04X %04X", c.CPU.States.HL.U16(), c.CPU.States.DE.U16())
+	}
+
+	// Mounting a missing directory fails
+	c.Memory.SetRange(0x0200, []byte("F: /this/does/not/exist")...)
+	c.Memory.Set(0x0200+uint16(len("F: /this/does/not/exist")), 0x00)
+	c.CPU.States.HL.SetU16(0x000A)
+	c.CPU.States.DE.SetU16(0x0200)
+	err = BiosSysCallReserved1(c)
+	if err != nil {
+		t.Fatalf("error calling reserved function")
+	}
+	if c.CPU.States.AF.Hi != 0xFF {
+		t.Fatalf("expected failure mounting missing directory")
+	}
+
+	// Unmount E:, which restores the original path
+	c.CPU.States.HL.SetU16(0x000B)
+	c.CPU.States.BC.Lo = 4
+	err = BiosSysCallReserved1(c)
+	if err != nil {
+		t.Fatalf("error calling reserved function")
+	}
+	if c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("failed to unmount drive")
+	}
+	if c.drives["E"] != "." {
+		t.Fatalf("drive path wasn't restored, got %s", c.drives["E"])
+	}
+
+	// No drives are reported as changed.
+	c.CPU.States.HL.SetU16(0x000E)
+	err = BiosSysCallReserved1(c)
+	if err != nil {
+		t.Fatalf("error calling reserved function")
+	}
+	if c.CPU.States.DE.U16() != 0x0000 {
+		t.Fatalf("unexpected drive state %04X", c.CPU.States.DE.U16())
+	}
+
+	// A second unmount fails
+	c.CPU.States.HL.SetU16(0x000B)
+	c.CPU.States.BC.Lo = 4
+	err = BiosSysCallReserved1(c)
+	if err != nil {
+		t.Fatalf("error calling reserved function")
+	}
+	if c.CPU.States.AF.Hi != 0xFF {
+		t.Fatalf("expected failure unmounting drive")
+	}
+}
+
 func TestBIOSConsoleInput(t *testing.T) {
 	// Create a new helper
 	c, err := New(WithPrinterPath("3.log"))
@@ -388,11 +564,15 @@ func TestBIOSConsoleInput(t *testing.T) {
 
 }
 
-// Test that an error comes by setting an impossible filename for the printer
-func TestBIOSError(t *testing.T) {
+// Test that the printer reports "not ready" when output cannot be written,
+// and recovers once it can.
+func TestBIOSPrinterNotReady(t *testing.T) {
 
-	// Create a new helper
-	c, err := New(WithPrinterPath("C:/fdf/fdsfd/fdsf·\\332\fdsf/fsdf.invlaid"))
+	dir := t.TempDir()
+	path := filepath.Join(dir, "missing", "print.log")
+
+	// Create a new helper, with a printer file in a missing directory.
+	c, err := New(WithPrinterPath(path))
 	if err != nil {
 		t.Fatalf("failed to create CPM")
 	}
@@ -402,26 +582,338 @@ func TestBIOSError(t *testing.T) {
 
 	c.simpleDebug = true
 
-	// Ensure we get an error when printing
-	err = c.prnC('s')
-	if err == nil {
-		t.Fatalf("expected error writing to impossible file")
+	// 15 == LISTST == BiosSysCallPrinterStatus
+	c.BiosHandler(15)
+	if c.CPU.States.AF.Hi != 0xFF {
+		t.Fatalf("printer should be ready before anything is written")
 	}
 
-	// 5 == LIST / BiosSysCallPrintChar
+	// 5 == LIST / BiosSysCallPrintChar, this will fail to be written
+	// when the line is complete, but it isn't a fatal error.
+	for _, ch := range "hi\n" {
+		c.CPU.States.BC.Lo = uint8(ch)
+		c.BiosHandler(5)
+	}
 	if c.biosErr != nil {
-		t.Fatalf("found an error we didn't expect")
+		t.Fatalf("found an error we didn't expect: %s", c.biosErr)
 	}
 
-	// This will fail
-	c.BiosHandler(5)
+	c.BiosHandler(15)
+	if c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("printer should not be ready")
+	}
 
-	// So the error should be set
-	if c.biosErr == nil {
-		t.Fatalf("found no error, but we should have done")
+	// Create the directory, and the printer should recover.
+	err = os.Mkdir(filepath.Join(dir, "missing"), 0755)
+	if err != nil {
+		t.Fatalf("failed to create directory: %s", err)
 	}
 
-	// 15 == LISTST == BiosSysCallPrinterStatus
 	c.BiosHandler(15)
+	if c.CPU.States.AF.Hi != 0xFF {
+		t.Fatalf("printer should be ready again")
+	}
+
+	// And nothing was lost.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read printer output: %s", err)
+	}
+	if string(data) != "hi\n" {
+		t.Fatalf("printer output had the wrong content: %q", data)
+	}
+}
+
+// TestInterruptPolicy tests the configuration of Ctrl-C handling, both
+// via our options and at runtime.
+func TestInterruptPolicy(t *testing.T) {
+
+	for _, invalid := range []string{"steve", "-1", "10"} {
+		_, err := New(WithInterruptPolicy(invalid))
+		if err == nil {
+			t.Fatalf("expected an error for %s", invalid)
+		}
+	}
+
+	c, err := New(WithInterruptPolicy("pass"), WithKillKey(0x1C))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	c.Memory = new(memory.Memory)
+	c.fixupRAM()
+	defer c.IOTearDown()
+	defer c.input.SetInterruptCount(2)
+
+	if c.input.GetKillKey() != 0x1C {
+		t.Fatalf("kill key wasn't set")
+	}
+
+	// get returns 0xFE in pass-through mode.
+	get := func() uint8 {
+		c.CPU.States.HL.SetU16(0x0001)
+		c.CPU.States.BC.Lo = 0xFF
+		BiosSysCallReserved1(c)
+		return c.CPU.States.AF.Hi
+	}
+	if get() != 0xFE {
+		t.Fatalf("expected pass-through")
+	}
+
+	c.CPU.States.HL.SetU16(0x0001)
+	c.CPU.States.BC.Lo = 3
+	BiosSysCallReserved1(c)
+	if get() != 3 {
+		t.Fatalf("expected a count of 3")
+	}
+
+	c.CPU.States.HL.SetU16(0x0001)
+	c.CPU.States.BC.Lo = 0xFE
+	BiosSysCallReserved1(c)
+	if get() != 0xFE {
+		t.Fatalf("expected pass-through")
+	}
+}
+
+// TestPasteFile tests that a host file may be pasted into the console via
+// our custom BIOS function.
+func TestPasteFile(t *testing.T) {
+
+	c, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	c.Memory = new(memory.Memory)
+	c.StuffText("")
+
+	path := filepath.Join(t.TempDir(), "paste.txt")
+	err = os.WriteFile(path, []byte("DIR\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	c.Memory.SetRange(0x0200, []byte(" "+path+"\r")...)
+	c.CPU.States.HL.SetU16(0x000C)
+	c.CPU.States.DE.SetU16(0x0200)
+	err = BiosSysCallReserved1(c)
+	if err != nil {
+		t.Fatalf("error calling reserved function")
+	}
+	if c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("failed to paste file")
+	}
+
+	for _, expected := range []byte("DIR\r") {
+		x, err := c.input.BlockForCharacterNoEcho()
+		if err != nil || x != expected {
+			t.Fatalf("expected %c, got %c %v", expected, x, err)
+		}
+	}
+
+	// A missing file fails
+	c.Memory.SetRange(0x0200, []byte("/this/does/not/exist\x00")...)
+	err = BiosSysCallReserved1(c)
+	if err != nil {
+		t.Fatalf("error calling reserved function")
+	}
+	if c.CPU.States.AF.Hi != 0xFF {
+		t.Fatalf("expected failure pasting a missing file")
+	}
+}
+
+// TestCursorPosition ensures the cursor position may be queried.
+func TestCursorPosition(t *testing.T) {
+
+	c, err := New(WithOutputDriver("adm-3a"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	c.output.GetDriver().SetWriter(io.Discard)
+
+	for _, ch := range []byte("\x1b=" + string([]byte{' ' + 3, ' ' + 7}) + "Hi") {
+		c.output.PutCharacter(ch)
+	}
+
+	c.CPU.States.HL.SetU16(0x000D)
+	err = BiosSysCallReserved1(c)
+	if err != nil {
+		t.Fatalf("error calling reserved function")
+	}
+	if c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("cursor position unknown")
+	}
+	if c.CPU.States.HL.Hi != 3 || c.CPU.States.HL.Lo != 9 {
+		t.Fatalf("wrong cursor position %04X", c.CPU.States.HL.U16())
+	}
+
+	// A driver which doesn't track the cursor only knows the column
+	c, err = New(WithOutputDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	c.CPU.States.HL.SetU16(0x000D)
+	err = BiosSysCallReserved1(c)
+	if err != nil {
+		t.Fatalf("error calling reserved function")
+	}
+	if c.CPU.States.AF.Hi != 0xFF {
+		t.Fatalf("expected the cursor position to be unknown")
+	}
+}
+
+// TestBIOSPrinterStalled ensures a printer whose command has stopped reading
+// doesn't stall the emulator, but reports "not ready" once its buffer is
+// full.
+func TestBIOSPrinterStalled(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
 
+	// The command never reads its input.
+	c, err := New(WithListDevice("LPT", "pipe:exec sleep 30"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	c.Memory = new(memory.Memory)
+	c.fixupRAM()
+
+	// Select LPT: for LST:, via the IOByte.
+	c.Memory.Set(0x0003, 0x80)
+
+	// We call the handlers directly, as LIST is logged.
+	err = BiosSysCallPrinterStatus(c)
+	if err != nil || c.CPU.States.AF.Hi != 0xFF {
+		t.Fatalf("printer should be ready before anything is written")
+	}
+
+	// Write until the pipe, and then our buffer, are full.
+	line := strings.Repeat("x", 79) + "\n"
+	ready := true
+	for i := 0; i < 10000 && ready; i++ {
+		for _, ch := range []byte(line) {
+			c.CPU.States.BC.Lo = ch
+			err = BiosSysCallPrintChar(c)
+			if err != nil {
+				t.Fatalf("failed to print: %s", err)
+			}
+		}
+		err = BiosSysCallPrinterStatus(c)
+		if err != nil {
+			t.Fatalf("failed to get status: %s", err)
+		}
+		ready = c.CPU.States.AF.Hi == 0xFF
+
+		// Give our writer a chance to fill the pipe.
+		if i%100 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if ready {
+		t.Fatalf("printer never reported that it wasn't ready")
+	}
+
+	// The stalled command is killed when we terminate.
+	start := time.Now()
+	c.IOTearDown()
+	if time.Since(start) > 10*time.Second {
+		t.Fatalf("tearing down took too long")
+	}
+}
+
+// TestBIOSDeviceStatus ensures the auxiliary, and console, status functions
+// reflect the state of the console.
+func TestBIOSDeviceStatus(t *testing.T) {
+
+	c, err := New(WithOutputDriver("null"), WithOutputLimit("2/1h"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	c.Memory = new(memory.Memory)
+	c.fixupRAM()
+	c.StuffText("")
+
+	// 18 == AUXIST
+	c.BiosHandler(18)
+	if c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("aux input shouldn't be pending")
+	}
+	c.input.StuffInput("A")
+	c.BiosHandler(18)
+	if c.CPU.States.AF.Hi != 0xFF {
+		t.Fatalf("aux input should be pending")
+	}
+	c.StuffText("")
+
+	// 17 == CONOST, 19 == AUXOST
+	for _, call := range []uint8{17, 19} {
+		c.BiosHandler(call)
+		if c.CPU.States.AF.Hi != 0xFF {
+			t.Fatalf("output should be ready")
+		}
+	}
+
+	// Exceed our output limit, so output is paused.  We call the
+	// handlers directly, as BiosHandler would wait for output to
+	// resume.
+	for _, ch := range "abc" {
+		c.output.PutCharacter(byte(ch))
+	}
+	for _, handler := range []func(*CPM) error{BiosSysCallScreenOutputStatus, BiosSysCallAuxOutputStatus} {
+		err = handler(c)
+		if err != nil || c.CPU.States.AF.Hi != 0x00 {
+			t.Fatalf("output shouldn't be ready while paused")
+		}
+	}
+	c.output.Resume()
+
+	// 20 == DEVTBL
+	c.BiosHandler(20)
+	addr := c.CPU.States.HL.U16()
+	expected := []byte("CRT   \x03\x00LPT   \x02\x00\x00")
+	for i, b := range expected {
+		if c.Memory.Get(addr+uint16(i)) != b {
+			t.Fatalf("device table is wrong at offset %d", i)
+		}
+	}
+
+	// 21 == DEVINI
+	c.CPU.States.BC.Lo = 1
+	c.BiosHandler(21)
+	if c.biosErr != nil {
+		t.Fatalf("found an error we didn't expect: %s", c.biosErr)
+	}
+}
+
+// TestBIOSChangeOutputDriver tests that changing the output driver, via
+// our custom BIOS function, keeps the observer and the buffering.
+func TestBIOSChangeOutputDriver(t *testing.T) {
+
+	c, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.Memory = new(memory.Memory)
+
+	seen := []byte{}
+	c.output.SetObserver(func(ch byte) { seen = append(seen, ch) })
+	c.output.SetBufferDelay(time.Second)
+
+	c.CPU.States.HL.SetU16(0x0002)
+	c.CPU.States.DE.SetU16(0xFE00)
+	c.Memory.SetRange(0xFE00, []byte{'l', 'o', 'g', 'g', 'e', 'r', ' '}...)
+	err = BiosSysCallReserved1(c)
+	if err != nil {
+		t.Fatalf("error calling reserved function")
+	}
+
+	if c.GetOutputDriver().GetName() != "logger" {
+		t.Fatalf("output driver wasn't changed")
+	}
+	c.output.PutCharacter('!')
+	if string(seen) != "!" {
+		t.Fatalf("the observer was lost when changing driver: %q", seen)
+	}
+	if c.output.GetBufferDelay() != time.Second {
+		t.Fatalf("the buffering was lost when changing driver")
+	}
 }
@@ -0,0 +1,302 @@
+// cpm_buffered.go contains the buffering which is applied to open files,
+// so that sequential reads and writes of 128-byte records don't each
+// require a separate operation upon the host.
+
+package cpm
+
+import (
+	"io"
+	"io/fs"
+	"log/slog"
+
+	"github.com/skx/cpmulator/fcb"
+)
+
+// fileBufferSize is the size of the buffer used for each open file, which
+// is a multiple of the CP/M record size, so records never straddle it.
+//
+// It is also the size of an extent, so the window holds the whole of the
+// extent being read or written.
+const fileBufferSize = fcb.ExtentRecords * blkSize
+
+// bufferedFile wraps a DriveFile with a buffer which holds a window of the
+// file's contents.
+//
+// Reads are satisfied from the window, which is loaded when a read falls
+// outside it, and writes update the window and are recorded as dirty.  The
+// dirty part of the window is written back to the file when the window
+// moves, or when the file is flushed, closed, truncated, or examined.
+//
+// FCBs which have the same file open share a single bufferedFile, so that
+// writes made via one are seen by reads made via another, as they would be
+// without our buffering.
+type bufferedFile struct {
+	DriveFile
+
+	// data holds the window of the file.
+	data []byte
+
+	// base is the offset of the window within the file.
+	base int64
+
+	// valid is the number of bytes in the window which contain data
+	// from the file, or which have been written.
+	valid int
+
+	// loaded is true if the window has been loaded.
+	loaded bool
+
+	// dirtyLo and dirtyHi are the range of the window which has been
+	// written, but not yet written back.  They're equal if there is
+	// nothing to write.
+	dirtyLo int
+	dirtyHi int
+
+	// refs is the number of FCBs which have the file open, the file
+	// is only closed when the last of them closes it.
+	refs int
+}
+
+// newBufferedFile returns a buffered version of the given file.
+func newBufferedFile(file DriveFile) *bufferedFile {
+	return &bufferedFile{DriveFile: file, data: make([]byte, fileBufferSize), refs: 1}
+}
+
+// openBuffered returns a buffered version of the given file, which was
+// opened upon the given drive.
+//
+// If another FCB already has the file open its buffer is shared, and the
+// given handle is closed.
+func (cpm *CPM) openBuffered(drive string, file DriveFile) *bufferedFile {
+
+	for _, obj := range cpm.files {
+		b, ok := obj.handle.(*bufferedFile)
+		if ok && b.refs > 0 && obj.drive == drive && obj.name == file.Name() {
+			file.Close()
+			b.refs++
+			return b
+		}
+	}
+	return newBufferedFile(file)
+}
+
+// load ensures the window holds the given offset, writing back any dirty
+// data if the window has to move.
+func (b *bufferedFile) load(offset int64) error {
+
+	if b.loaded && offset >= b.base && offset < b.base+fileBufferSize {
+		return nil
+	}
+
+	err := b.Flush()
+	if err != nil {
+		return err
+	}
+
+	b.base = offset - offset%fileBufferSize
+	b.valid = 0
+	b.loaded = false
+
+	n, err := b.DriveFile.ReadAt(b.data, b.base)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	b.valid = n
+	b.loaded = true
+	return nil
+}
+
+// ReadAt reads from the file at the given offset, via our window.
+func (b *bufferedFile) ReadAt(p []byte, off int64) (int, error) {
+
+	n := 0
+	for n < len(p) {
+
+		pos := off + int64(n)
+		err := b.load(pos)
+		if err != nil {
+			return n, err
+		}
+
+		i := int(pos - b.base)
+		if i >= b.valid {
+			return n, io.EOF
+		}
+		n += copy(p[n:], b.data[i:b.valid])
+	}
+	return n, nil
+}
+
+// WriteAt writes to the file at the given offset, via our window.
+//
+// If the offset is beyond the end of the file the gap is filled with
+// zeros, as it would be by the host.
+func (b *bufferedFile) WriteAt(p []byte, off int64) (int, error) {
+
+	if b.ReadOnly() {
+		return b.DriveFile.WriteAt(p, off)
+	}
+
+	n := 0
+	for n < len(p) {
+
+		pos := off + int64(n)
+		err := b.load(pos)
+		if err != nil {
+			return n, err
+		}
+
+		i := int(pos - b.base)
+
+		// Fill any gap between the end of the data and the
+		// offset we're writing to.
+		lo := i
+		if i > b.valid {
+			for j := b.valid; j < i; j++ {
+				b.data[j] = 0x00
+			}
+			lo = b.valid
+		}
+
+		c := copy(b.data[i:], p[n:])
+		n += c
+
+		if i+c > b.valid {
+			b.valid = i + c
+		}
+
+		// Record the dirty range.
+		if b.dirtyLo == b.dirtyHi {
+			b.dirtyLo, b.dirtyHi = lo, i+c
+		} else {
+			b.dirtyLo = min(b.dirtyLo, lo)
+			b.dirtyHi = max(b.dirtyHi, i+c)
+		}
+	}
+	return n, nil
+}
+
+// Flush writes any dirty data back to the file.
+func (b *bufferedFile) Flush() error {
+
+	if b.dirtyLo == b.dirtyHi {
+		return nil
+	}
+
+	_, err := b.DriveFile.WriteAt(b.data[b.dirtyLo:b.dirtyHi], b.base+int64(b.dirtyLo))
+	if err != nil {
+		return err
+	}
+
+	b.dirtyLo, b.dirtyHi = 0, 0
+	return nil
+}
+
+// Stat returns the details of the file, after writing back any dirty
+// data so that the size is correct.
+func (b *bufferedFile) Stat() (fs.FileInfo, error) {
+	err := b.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return b.DriveFile.Stat()
+}
+
+// Truncate changes the size of the file, after writing back any dirty
+// data, and discards our window.
+func (b *bufferedFile) Truncate(size int64) error {
+	err := b.Flush()
+	if err != nil {
+		return err
+	}
+	b.loaded = false
+	return b.DriveFile.Truncate(size)
+}
+
+// Sync writes back any dirty data, and commits it to storage.
+func (b *bufferedFile) Sync() error {
+	err := b.Flush()
+	if err != nil {
+		return err
+	}
+	return b.DriveFile.Sync()
+}
+
+// Close writes back any dirty data, and closes the file if no other FCB
+// has it open.
+func (b *bufferedFile) Close() error {
+	err := b.Flush()
+	b.refs--
+	if b.refs > 0 {
+		return err
+	}
+	cerr := b.DriveFile.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// extentRecords returns the number of records the given file has within
+// the given extent, which is the record-count of an FCB referring to it.
+//
+// After a write our window holds the extent, so the answer comes from the
+// window, rather than writing back the dirty data to find the size of the
+// file.
+func extentRecords(file DriveFile, extent int) (uint8, error) {
+
+	start := int64(extent) * fileBufferSize
+	if b, ok := file.(*bufferedFile); ok && b.loaded && b.base == start {
+		return uint8((b.valid + blkSize - 1) / blkSize), nil
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fcb.RecordsInExtent(fi.Size(), extent), nil
+}
+
+// flushFiles writes back any buffered data for all our open files, so
+// that the host sees the same contents as the guest.
+func (cpm *CPM) flushFiles() {
+
+	for key, obj := range cpm.files {
+		b, ok := obj.handle.(*bufferedFile)
+		if !ok {
+			continue
+		}
+
+		err := b.Flush()
+		if err != nil {
+			slog.Error("failed to flush file",
+				slog.String("path", obj.name),
+				slog.Int("fcb", int(key)),
+				slog.String("error", err.Error()))
+		}
+	}
+}
+
+// syncFiles writes back any buffered data for all our open files, and
+// commits them to the host's storage.
+//
+// All files are synced even if some fail, and the first error is
+// returned.
+func (cpm *CPM) syncFiles() error {
+
+	var res error
+	for key, obj := range cpm.files {
+		err := obj.handle.Sync()
+		if err != nil {
+			slog.Error("failed to sync file",
+				slog.String("path", obj.name),
+				slog.Int("fcb", int(key)),
+				slog.String("error", err.Error()))
+			if res == nil {
+				res = err
+			}
+		}
+	}
+	return res
+}
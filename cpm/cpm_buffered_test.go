@@ -0,0 +1,266 @@
+package cpm
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/skx/cpmulator/fcb"
+)
+
+// openHostFile creates a file in a temporary directory, with the given
+// contents, and opens it for reading and writing.
+func openHostFile(t testing.TB, content []byte) *hostFile {
+
+	path := filepath.Join(t.TempDir(), "TEST.DAT")
+	err := os.WriteFile(path, content, 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("failed to open file: %s", err)
+	}
+	return &hostFile{File: f}
+}
+
+// TestBufferedFile tests reads and writes are passed through our buffer
+// correctly.
+func TestBufferedFile(t *testing.T) {
+
+	// A file which spans several buffers.
+	content := make([]byte, fileBufferSize*2+300)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	host := openHostFile(t, content)
+	b := newBufferedFile(host)
+	defer b.Close()
+
+	// Read across the boundary of a buffer.
+	buf := make([]byte, 256)
+	n, err := b.ReadAt(buf, fileBufferSize-128)
+	if err != nil || n != len(buf) {
+		t.Fatalf("failed to read: %d %v", n, err)
+	}
+	if !bytes.Equal(buf, content[fileBufferSize-128:fileBufferSize+128]) {
+		t.Fatalf("wrong data read across buffers")
+	}
+
+	// Reading at the end of the file returns a short read.
+	n, err = b.ReadAt(buf, int64(len(content)-100))
+	if err != io.EOF || n != 100 {
+		t.Fatalf("expected short read, got %d %v", n, err)
+	}
+
+	// Writes aren't visible on the host until they're flushed.
+	_, err = b.WriteAt([]byte("STEVE"), 10)
+	if err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	out := make([]byte, 5)
+	host.ReadAt(out, 10)
+	if bytes.Equal(out, []byte("STEVE")) {
+		t.Fatalf("write wasn't buffered")
+	}
+
+	// But are visible to reads via the buffer.
+	b.ReadAt(out, 10)
+	if !bytes.Equal(out, []byte("STEVE")) {
+		t.Fatalf("buffered write wasn't read back")
+	}
+
+	// Moving to a different part of the file writes them back.
+	b.ReadAt(buf, fileBufferSize*2)
+	host.ReadAt(out, 10)
+	if !bytes.Equal(out, []byte("STEVE")) {
+		t.Fatalf("write wasn't flushed when the buffer moved")
+	}
+
+	// Writing beyond the end of the file fills the gap with zeros,
+	// and the size is correct.
+	end := int64(len(content))
+	_, err = b.WriteAt([]byte("END"), end+10)
+	if err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	fi, err := b.Stat()
+	if err != nil {
+		t.Fatalf("failed to stat: %s", err)
+	}
+	if fi.Size() != end+13 {
+		t.Fatalf("wrong size %d", fi.Size())
+	}
+	gap := make([]byte, 13)
+	host.ReadAt(gap, end)
+	if !bytes.Equal(gap, append(make([]byte, 10), []byte("END")...)) {
+		t.Fatalf("wrong data at the end of the file: %v", gap)
+	}
+
+	// Truncation discards the buffer.
+	err = b.Truncate(100)
+	if err != nil {
+		t.Fatalf("failed to truncate: %s", err)
+	}
+	n, err = b.ReadAt(buf, 0)
+	if err != io.EOF || n != 100 {
+		t.Fatalf("expected short read after truncation, got %d %v", n, err)
+	}
+}
+
+// TestBufferedClose ensures pending writes are written back when a file
+// is closed, and when the emulator flushes all files.
+func TestBufferedClose(t *testing.T) {
+
+	host := openHostFile(t, nil)
+	path := host.Name()
+
+	b := newBufferedFile(host)
+	_, err := b.WriteAt([]byte("Hello"), 0)
+	if err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	err = b.Close()
+	if err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "Hello" {
+		t.Fatalf("write lost on close: %q %v", data, err)
+	}
+
+	c, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+
+	host = openHostFile(t, nil)
+	path = host.Name()
+	b = newBufferedFile(host)
+	defer b.Close()
+	c.files[0x0200] = FileCache{name: path, drive: "A", handle: b}
+
+	_, err = b.WriteAt([]byte("World"), 0)
+	if err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	c.flushFiles()
+
+	data, err = os.ReadFile(path)
+	if err != nil || string(data) != "World" {
+		t.Fatalf("write lost on flush: %q %v", data, err)
+	}
+}
+
+// TestBufferedShared tests that two FCBs with the same file open see the
+// writes made via each other.
+func TestBufferedShared(t *testing.T) {
+
+	c, dir := newFindTest(t, nil, "SHARED.DAT")
+	defer c.IOTearDown()
+
+	// call invokes the given syscall with the FCB at the given address.
+	call := func(handler CPMHandlerType, ptr uint16) {
+		c.CPU.States.DE.SetU16(ptr)
+		err := handler(c)
+		if err != nil || c.CPU.States.AF.Hi != 0x00 {
+			t.Fatalf("syscall failed for FCB %04X: %v %02X", ptr, err, c.CPU.States.AF.Hi)
+		}
+	}
+
+	f := fcb.FromString("SHARED.DAT")
+	c.Memory.SetRange(0x0200, f.AsBytes()...)
+	c.Memory.SetRange(0x0300, f.AsBytes()...)
+	call(BdosSysCallFileOpen, 0x0200)
+	call(BdosSysCallFileOpen, 0x0300)
+
+	// Each FCB reads what the other wrote.
+	for i, pair := range [][2]uint16{{0x0200, 0x0300}, {0x0300, 0x0200}} {
+
+		c.Memory.FillRange(c.dma, blkSize, byte('A'+i))
+		call(BdosSysCallWriteRand, pair[0])
+
+		c.Memory.FillRange(c.dma, blkSize, 0x00)
+		call(BdosSysCallReadRand, pair[1])
+		if !bytes.Equal(c.Memory.GetRange(c.dma, blkSize), bytes.Repeat([]byte{byte('A' + i)}, blkSize)) {
+			t.Fatalf("FCB %04X didn't see the write via FCB %04X", pair[1], pair[0])
+		}
+	}
+
+	// Closing one FCB leaves the other usable.
+	call(BdosSysCallFileClose, 0x0200)
+	c.Memory.FillRange(c.dma, blkSize, 'C')
+	call(BdosSysCallWriteRand, 0x0300)
+	call(BdosSysCallFileClose, 0x0300)
+
+	data, err := os.ReadFile(filepath.Join(dir, "SHARED.DAT"))
+	if err != nil || !bytes.Equal(data, bytes.Repeat([]byte{'C'}, blkSize)) {
+		t.Fatalf("unexpected contents %q %v", data, err)
+	}
+}
+
+// benchmarkWrite writes a file of 1Mb, a record at a time, as a CP/M
+// binary would.
+func benchmarkWrite(b *testing.B, buffered bool) {
+
+	record := make([]byte, blkSize)
+	b.SetBytes(1024 * 1024)
+
+	for i := 0; i < b.N; i++ {
+		var f DriveFile = openHostFile(b, nil)
+		if buffered {
+			f = newBufferedFile(f)
+		}
+		for off := int64(0); off < 1024*1024; off += blkSize {
+			f.WriteAt(record, off)
+		}
+		f.Close()
+	}
+}
+
+// benchmarkRead reads a file of 1Mb, a record at a time, as a CP/M
+// binary would.
+func benchmarkRead(b *testing.B, buffered bool) {
+
+	var f DriveFile = openHostFile(b, make([]byte, 1024*1024))
+	defer f.Close()
+
+	record := make([]byte, blkSize)
+	b.SetBytes(1024 * 1024)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r := f
+		if buffered {
+			r = newBufferedFile(f)
+		}
+		for off := int64(0); off < 1024*1024; off += blkSize {
+			r.ReadAt(record, off)
+		}
+	}
+}
+
+// BenchmarkWriteUnbuffered writes records directly to the host.
+func BenchmarkWriteUnbuffered(b *testing.B) {
+	benchmarkWrite(b, false)
+}
+
+// BenchmarkWriteBuffered writes records via our buffer.
+func BenchmarkWriteBuffered(b *testing.B) {
+	benchmarkWrite(b, true)
+}
+
+// BenchmarkReadUnbuffered reads records directly from the host.
+func BenchmarkReadUnbuffered(b *testing.B) {
+	benchmarkRead(b, false)
+}
+
+// BenchmarkReadBuffered reads records via our buffer.
+func BenchmarkReadBuffered(b *testing.B) {
+	benchmarkRead(b, true)
+}
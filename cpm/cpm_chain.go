@@ -0,0 +1,38 @@
+// cpm_chain.go contains the support for running several programs in
+// sequence, within the same emulator instance, such as an assembler
+// followed by a linker.
+//
+// Each program is loaded via LoadBinary, and run to completion, in turn,
+// so that the drives, the current drive and user, and any files they
+// write are shared.  By default RAM is cleared as each program is loaded,
+// but it may be kept, for programs which pass data to each other in
+// memory.
+//
+// Programs may report failure via P_CODE, as under CP/M 3, which allows
+// the remaining programs to be skipped.
+
+package cpm
+
+// WithKeepMemory configures whether RAM is kept when a binary is loaded,
+// rather than being cleared, so that programs run in sequence may pass
+// data to each other in memory.
+//
+// RAM is cleared by default.
+func WithKeepMemory(enabled bool) cpmoption {
+	return func(c *CPM) error {
+		c.keepMemory = enabled
+		return nil
+	}
+}
+
+// ReturnCode returns the program return code, which programs may set via
+// P_CODE, or the SCB.  It is reset to zero when a binary is loaded.
+func (cpm *CPM) ReturnCode() uint16 {
+	return cpm.returnCode
+}
+
+// ProgramFailed returns true if the last program set a return code which
+// indicates failure, which under CP/M 3 is any value from 0xFF00 upwards.
+func (cpm *CPM) ProgramFailed() bool {
+	return cpm.returnCode >= 0xFF00
+}
@@ -0,0 +1,93 @@
+// cpm_checksum.go contains the checking of the files we embed, as the guest
+// sees them, against the manifest recorded when they were built.
+//
+// Files embedded within our binary are read-only, but a guest may create a
+// file with the same name upon the host, or in memory when the filesystem
+// is read-only, which hides the embedded copy.  Comparing the checksum of
+// the file the guest sees with that in the manifest shows whether that has
+// happened, which helps when a tool misbehaves.
+
+package cpm
+
+import (
+	"io"
+	"path"
+
+	"github.com/skx/cpmulator/static"
+)
+
+// StaticStatus is the result of checking an embedded file.
+type StaticStatus string
+
+const (
+	// StaticOK means the guest sees the file we embedded.
+	StaticOK StaticStatus = "ok"
+
+	// StaticModified means the guest sees a different file, which
+	// hides the one we embedded.
+	StaticModified StaticStatus = "modified"
+
+	// StaticMissing means the guest can't see the file at all.
+	StaticMissing StaticStatus = "missing"
+)
+
+// StaticCheck holds the result of checking a single embedded file.
+type StaticCheck struct {
+
+	// Name is the name of the file, including the drive, such as
+	// "A:!CCP.COM".
+	Name string
+
+	// Status is the result of the check.
+	Status StaticStatus
+
+	// SHA256 is the hex-encoded SHA-256 sum of the file the guest
+	// sees, if it is present.
+	SHA256 string
+}
+
+// VerifyStatic checks each of the files in our manifest, returning whether
+// the guest sees the file we embedded.
+func (cpm *CPM) VerifyStatic() ([]StaticCheck, error) {
+
+	manifest, err := static.GetManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	var checks []StaticCheck
+	for _, ent := range manifest {
+		drive, name := path.Split(ent.Name)
+		drive = path.Clean(drive)
+
+		check := StaticCheck{Name: drive + ":" + name, Status: StaticMissing}
+
+		data, err := cpm.readDriveFile(drive, name)
+		if err == nil {
+			check.SHA256 = static.Checksum(data)
+			check.Status = StaticModified
+			if ent.Matches(data) {
+				check.Status = StaticOK
+			}
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
+// readDriveFile returns the contents of the named file, upon the given
+// drive, as the guest sees them.
+func (cpm *CPM) readDriveFile(drive string, name string) ([]byte, error) {
+
+	f, err := cpm.getDrive(drive).Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.NewSectionReader(f, 0, fi.Size()))
+}
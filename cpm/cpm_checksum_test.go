@@ -0,0 +1,123 @@
+package cpm
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/skx/cpmulator/fcb"
+	"github.com/skx/cpmulator/memory"
+	"github.com/skx/cpmulator/static"
+)
+
+// TestVerifyStatic ensures that embedded files which are hidden by host
+// files are reported.
+func TestVerifyStatic(t *testing.T) {
+
+	dir := t.TempDir()
+
+	obj, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	obj.SetStaticFilesystem(static.GetContent())
+	obj.SetDrives(false)
+	obj.SetDrivePath("A", dir)
+
+	status := func() map[string]StaticStatus {
+		checks, err := obj.VerifyStatic()
+		if err != nil {
+			t.Fatalf("failed to verify: %s", err)
+		}
+		res := make(map[string]StaticStatus)
+		for _, c := range checks {
+			res[c.Name] = c.Status
+		}
+		return res
+	}
+
+	for name, s := range status() {
+		if s != StaticOK {
+			t.Fatalf("%s has status %s", name, s)
+		}
+	}
+
+	// Hide one of the embedded files.
+	err = os.WriteFile(filepath.Join(dir, "!CCP.COM"), []byte("steve"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	res := status()
+	if res["A:!CCP.COM"] != StaticModified || res["A:!DEBUG.COM"] != StaticOK {
+		t.Fatalf("unexpected status %v", res)
+	}
+
+	// Without the embedded files they're all missing, except the
+	// one upon the host.
+	obj.SetStaticFilesystem(static.GetEmptyContent())
+	res = status()
+	if res["A:!CCP.COM"] != StaticModified || res["A:!DEBUG.COM"] != StaticMissing {
+		t.Fatalf("unexpected status %v", res)
+	}
+}
+
+// TestChecksumBIOS tests our custom BIOS function which returns the
+// checksum of a file.
+func TestChecksumBIOS(t *testing.T) {
+
+	dir := t.TempDir()
+
+	obj, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	obj.Memory = new(memory.Memory)
+	obj.SetStaticFilesystem(static.GetContent())
+	obj.SetDrives(false)
+	obj.SetDrivePath("A", dir)
+
+	err = os.WriteFile(filepath.Join(dir, "FOO.TXT"), []byte("steve"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	// checksum returns the result of the call, and the sum.
+	checksum := func(name string) (uint8, string) {
+		f := fcb.FromString(name)
+		obj.Memory.SetRange(0x005C, f.AsBytes()...)
+		obj.CPU.States.DE.SetU16(0x005C)
+		obj.CPU.States.HL.SetU16(0x000F)
+		err := BiosSysCallReserved1(obj)
+		if err != nil {
+			t.Fatalf("failed to call BIOS: %s", err)
+		}
+		return obj.CPU.States.AF.Hi, hex.EncodeToString(obj.Memory.GetRange(obj.dma, 32))
+	}
+
+	ent, _ := static.FindManifestEntry("A/!CCP.COM")
+	ret, sum := checksum("!CCP.COM")
+	if ret != 0x00 || sum != ent.SHA256 {
+		t.Fatalf("unexpected result %02X %s", ret, sum)
+	}
+
+	ret, sum = checksum("FOO.TXT")
+	if ret != 0x02 || sum != static.Checksum([]byte("steve")) {
+		t.Fatalf("unexpected result %02X %s", ret, sum)
+	}
+
+	ret, _ = checksum("MISSING.TXT")
+	if ret != 0xFF {
+		t.Fatalf("unexpected result %02X for a missing file", ret)
+	}
+
+	// Hide the embedded file.
+	err = os.WriteFile(filepath.Join(dir, "!CCP.COM"), []byte("steve"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	ret, sum = checksum("!CCP.COM")
+	if ret != 0x01 || sum != static.Checksum([]byte("steve")) {
+		t.Fatalf("unexpected result %02X %s", ret, sum)
+	}
+}
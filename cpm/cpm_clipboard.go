@@ -0,0 +1,183 @@
+// cpm_clipboard.go contains the code which moves text between the host
+// clipboard and the guest, which is great for transferring small source
+// files, and program listings.
+//
+// The clipboard is accessed via the usual host tools, pbcopy/pbpaste upon
+// MacOS, PowerShell and clip upon Windows, and wl-copy/wl-paste, xclip, or
+// xsel elsewhere, so nothing is available if they're not installed.
+//
+// Text is converted as it moves, CP/M files have CRLF line-endings, and
+// end at the first Ctrl-Z, while the host expects newlines alone.
+//
+// This is available via the "clip" command of our monitor, and via custom
+// BIOS functions, which A:!COPY.COM and A:!PASTECB.COM use.
+
+package cpm
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// clipboardTool holds the commands which read from, and write to, the host
+// clipboard.
+type clipboardTool struct {
+	read  []string
+	write []string
+}
+
+// clipboardTools returns the tools which might access the host clipboard,
+// in order of preference.
+//
+// This is a variable so that it may be replaced by our tests.
+var clipboardTools = func() []clipboardTool {
+
+	switch runtime.GOOS {
+	case "darwin":
+		return []clipboardTool{
+			{read: []string{"pbpaste"}, write: []string{"pbcopy"}},
+		}
+	case "windows":
+		return []clipboardTool{
+			{read: []string{"powershell", "-NoProfile", "-Command", "Get-Clipboard -Raw"}, write: []string{"clip"}},
+		}
+	}
+
+	tools := []clipboardTool{
+		{read: []string{"xclip", "-selection", "clipboard", "-o"}, write: []string{"xclip", "-selection", "clipboard", "-i"}},
+		{read: []string{"xsel", "--clipboard", "--output"}, write: []string{"xsel", "--clipboard", "--input"}},
+	}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		wayland := clipboardTool{read: []string{"wl-paste", "--no-newline"}, write: []string{"wl-copy"}}
+		tools = append([]clipboardTool{wayland}, tools...)
+	}
+	return tools
+}
+
+// findClipboardTool returns the first of our clipboard tools which is
+// installed.
+func findClipboardTool() (clipboardTool, error) {
+
+	for _, tool := range clipboardTools() {
+		if _, err := exec.LookPath(tool.read[0]); err != nil {
+			continue
+		}
+		if _, err := exec.LookPath(tool.write[0]); err != nil {
+			continue
+		}
+		return tool, nil
+	}
+	return clipboardTool{}, fmt.Errorf("no clipboard tool found, upon %s", runtime.GOOS)
+}
+
+// ReadClipboard returns the text held in the host clipboard.
+func (cpm *CPM) ReadClipboard() (string, error) {
+
+	tool, err := findClipboardTool()
+	if err != nil {
+		return "", err
+	}
+
+	out, err := exec.Command(tool.read[0], tool.read[1:]...).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to read the clipboard via %s: %s", tool.read[0], err)
+	}
+	return string(out), nil
+}
+
+// WriteClipboard replaces the contents of the host clipboard with the given
+// text.
+func (cpm *CPM) WriteClipboard(text string) error {
+
+	tool, err := findClipboardTool()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(tool.write[0], tool.write[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("failed to write the clipboard via %s: %s", tool.write[0], err)
+	}
+	return nil
+}
+
+// PasteClipboard queues the contents of the host clipboard as console
+// input, which will be read a line at a time.
+func (cpm *CPM) PasteClipboard() error {
+
+	text, err := cpm.ReadClipboard()
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("Pasting the clipboard into the console",
+		slog.Int("size", len(text)))
+
+	cpm.input.Paste(text)
+	return nil
+}
+
+// copyToClipboard copies the named text file, upon the given drive, to the
+// host clipboard.
+func (cpm *CPM) copyToClipboard(drive string, name string) error {
+
+	data, err := cpm.readDriveFile(drive, name)
+	if err != nil {
+		return err
+	}
+
+	// The text ends at the first Ctrl-Z.
+	if i := bytes.IndexByte(data, 0x1A); i >= 0 {
+		data = data[:i]
+	}
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+
+	slog.Debug("Copying file to the clipboard",
+		slog.String("drive", drive),
+		slog.String("name", name),
+		slog.Int("size", len(text)))
+
+	return cpm.WriteClipboard(text)
+}
+
+// pasteToFile writes the contents of the host clipboard to the named text
+// file, upon the given drive, replacing any existing contents.
+func (cpm *CPM) pasteToFile(drive string, name string) error {
+
+	text, err := cpm.ReadClipboard()
+	if err != nil {
+		return err
+	}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\n", "\r\n")
+
+	cpm.invalidateDirCache()
+
+	f, err := cpm.getDrive(drive).Create(name)
+	if err != nil {
+		return err
+	}
+
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt([]byte(text), 0)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	slog.Debug("Pasting the clipboard to a file",
+		slog.String("drive", drive),
+		slog.String("name", name),
+		slog.Int("size", len(text)))
+
+	return f.Close()
+}
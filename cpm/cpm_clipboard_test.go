@@ -0,0 +1,108 @@
+package cpm
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/skx/cpmulator/fcb"
+	"github.com/skx/cpmulator/memory"
+)
+
+// TestClipboard ensures that text files may be copied to, and pasted from,
+// the host clipboard, via our custom BIOS functions.
+func TestClipboard(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake clipboard is a shell script")
+	}
+
+	dir := t.TempDir()
+	clip := filepath.Join(dir, "clipboard")
+
+	// Our clipboard is a file.
+	orig := clipboardTools
+	defer func() {
+		clipboardTools = orig
+	}()
+	clipboardTools = func() []clipboardTool {
+		return []clipboardTool{
+			{read: []string{"missing-clipboard-tool"}, write: []string{"missing-clipboard-tool"}},
+			{read: []string{"cat", clip}, write: []string{"sh", "-c", "cat > " + clip}},
+		}
+	}
+
+	c, err := New(WithOutputDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	defer c.IOTearDown()
+	c.StuffText("")
+
+	c.Memory = new(memory.Memory)
+	c.SetDrives(false)
+	c.SetDrivePath("A", dir)
+
+	call := func(fn uint16, name string) uint8 {
+		c.CPU.States.HL.SetU16(fn)
+		c.CPU.States.DE.SetU16(0x0000)
+		if name != "" {
+			f := fcb.FromString(name)
+			c.Memory.SetRange(0x0200, f.AsBytes()...)
+			c.CPU.States.DE.SetU16(0x0200)
+		}
+		err := BiosSysCallReserved1(c)
+		if err != nil {
+			t.Fatalf("failed to call BIOS: %s", err)
+		}
+		return c.CPU.States.AF.Hi
+	}
+
+	// Copying stops at Ctrl-Z, and converts line-endings.
+	err = os.WriteFile(filepath.Join(dir, "HELLO.TXT"), []byte("10 PRINT\r\n20 END\r\n\x1a\x1a"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	if call(0x0010, "HELLO.TXT") != 0x00 {
+		t.Fatalf("failed to copy file to the clipboard")
+	}
+	data, err := os.ReadFile(clip)
+	if err != nil || string(data) != "10 PRINT\n20 END\n" {
+		t.Fatalf("unexpected clipboard %q %v", data, err)
+	}
+
+	// Missing files fail.
+	if call(0x0010, "MISSING.TXT") != 0xFF {
+		t.Fatalf("expected failure copying a missing file")
+	}
+
+	// Pasting to a file replaces its contents.
+	err = os.WriteFile(clip, []byte("one\ntwo\r\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write clipboard: %s", err)
+	}
+	if call(0x0011, "HELLO.TXT") != 0x00 {
+		t.Fatalf("failed to paste the clipboard to a file")
+	}
+	data, err = os.ReadFile(filepath.Join(dir, "HELLO.TXT"))
+	if err != nil || string(data) != "one\r\ntwo\r\n" {
+		t.Fatalf("unexpected file contents %q %v", data, err)
+	}
+
+	// Pasting to the console queues the text as input.
+	if call(0x0011, "") != 0x00 {
+		t.Fatalf("failed to paste the clipboard to the console")
+	}
+	if !c.input.PendingInput() {
+		t.Fatalf("the clipboard wasn't pasted")
+	}
+
+	// Without a clipboard tool everything fails.
+	clipboardTools = func() []clipboardTool {
+		return nil
+	}
+	if call(0x0010, "HELLO.TXT") != 0xFF || call(0x0011, "") != 0xFF {
+		t.Fatalf("expected failure without a clipboard")
+	}
+}
@@ -0,0 +1,97 @@
+// cpm_cmdtail.go contains the parsing of the arguments we're given into the
+// command tail, at 0x0080, and the two default FCBs, at 0x005C and 0x006C,
+// as the CCP would do for a command typed at its prompt.
+//
+// The arguments are joined with spaces, so an argument which was quoted
+// upon the host, and contains spaces, is seen as several words, just as it
+// would be if it were typed.  The tail is upper-cased, as the CCP does,
+// unless WithCaseSensitiveTail is used, which helps programs given the
+// paths of host files, or text, whose case matters.
+//
+// The FCBs are populated from the first two words of the tail which could
+// be filenames, so options such as "-X" don't take the place of the files
+// which follow them.  The names within the FCBs are always upper-case.
+//
+// The tail must fit in the 127 bytes which follow its length, otherwise it
+// would overwrite the program, so longer tails are an error.
+
+package cpm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/skx/cpmulator/fcb"
+)
+
+// maxTail is the longest command tail we can store.
+const maxTail = 127
+
+// ErrTailTooLong is returned when the arguments given to a program won't
+// fit in the command tail.
+var ErrTailTooLong = errors.New("command tail too long")
+
+// WithCaseSensitiveTail preserves the case of the command tail given to
+// programs, rather than upper-casing it as the CCP does.
+func WithCaseSensitiveTail(enabled bool) cpmoption {
+	return func(c *CPM) error {
+		c.tailCase = enabled
+		return nil
+	}
+}
+
+// commandTail converts our arguments into a command tail, returning
+// ErrTailTooLong if it won't fit.
+func (cpm *CPM) commandTail(args []string) (string, error) {
+
+	tail := strings.Join(strings.Fields(strings.Join(args, " ")), " ")
+	if !cpm.tailCase {
+		tail = strings.ToUpper(tail)
+	}
+
+	if len(tail) > maxTail {
+		return "", fmt.Errorf("%w, %d bytes given, the limit is %d", ErrTailTooLong, len(tail), maxTail)
+	}
+	return tail, nil
+}
+
+// tailFilenames returns the words of the command tail which are used to
+// populate the default FCBs, skipping options.
+func tailFilenames(tail string) []string {
+
+	names := []string{}
+	for _, word := range strings.Fields(tail) {
+		if strings.HasPrefix(word, "-") {
+			continue
+		}
+		names = append(names, strings.ToUpper(word))
+	}
+	return names
+}
+
+// setCommandTail stores the command tail, and populates the default FCBs,
+// from the given arguments.
+func (cpm *CPM) setCommandTail(args []string) error {
+
+	tail, err := cpm.commandTail(args)
+	if err != nil {
+		return err
+	}
+
+	// Both FCBs are always populated, unused ones being blank.
+	names := tailFilenames(tail)
+	for i, addr := range []uint16{0x005C, 0x006C} {
+		x := fcb.FromString("")
+		if i < len(names) {
+			x = cpm.argumentFCB(names[i])
+		}
+		cpm.Memory.SetRange(addr, x.AsBytes()...)
+	}
+
+	// The tail is stored as a pascal string, the first byte being
+	// the length, followed by the data.
+	cpm.Memory.Set(0x0080, uint8(len(tail)))
+	cpm.Memory.SetRange(0x0081, []byte(tail)...)
+	return nil
+}
@@ -0,0 +1,87 @@
+package cpm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/skx/cpmulator/fcb"
+	"github.com/skx/cpmulator/memory"
+)
+
+// TestCommandTail tests the command tail, and default FCBs, we setup
+// from the arguments given to a program.
+func TestCommandTail(t *testing.T) {
+
+	type TestCase struct {
+		Args []string
+		Case bool
+		Tail string
+		FCB1 string
+		FCB2 string
+	}
+
+	tests := []TestCase{
+		{Args: []string{}, Tail: "", FCB1: "", FCB2: ""},
+		{Args: []string{"foo.txt"}, Tail: "FOO.TXT", FCB1: "FOO.TXT", FCB2: ""},
+		{Args: []string{"foo.txt", "bar.com"}, Tail: "FOO.TXT BAR.COM", FCB1: "FOO.TXT", FCB2: "BAR.COM"},
+		{Args: []string{"-x", "foo.txt", "-y", "bar.com"}, Tail: "-X FOO.TXT -Y BAR.COM", FCB1: "FOO.TXT", FCB2: "BAR.COM"},
+		{Args: []string{"first second", "third"}, Tail: "FIRST SECOND THIRD", FCB1: "FIRST", FCB2: "SECOND"},
+		{Args: []string{"/Home/Steve", "Foo.Txt"}, Case: true, Tail: "/Home/Steve Foo.Txt", FCB1: "/HOME/ST", FCB2: "FOO.TXT"},
+	}
+
+	for _, test := range tests {
+
+		obj, err := New(WithCaseSensitiveTail(test.Case))
+		if err != nil {
+			t.Fatalf("failed to create CPM")
+		}
+		obj.Memory = new(memory.Memory)
+
+		// Fill the FCBs with junk, which must be replaced.
+		for i := uint16(0x005C); i < 0x0100; i++ {
+			obj.Memory.Set(i, 'X')
+		}
+
+		err = obj.setCommandTail(test.Args)
+		if err != nil {
+			t.Fatalf("%v: unexpected error %s", test.Args, err)
+		}
+
+		n := obj.Memory.Get(0x0080)
+		tail := string(obj.Memory.GetRange(0x0081, int(n)))
+		if tail != test.Tail {
+			t.Fatalf("%v: unexpected tail '%s', expected '%s'", test.Args, tail, test.Tail)
+		}
+
+		f1 := fcb.FromBytes(obj.Memory.GetRange(0x005C, fcb.SIZE))
+		if f1.GetFileName() != test.FCB1 {
+			t.Fatalf("%v: unexpected FCB1 '%s', expected '%s'", test.Args, f1.GetFileName(), test.FCB1)
+		}
+		f2 := fcb.FromBytes(obj.Memory.GetRange(0x006C, fcb.SIZE))
+		if f2.GetFileName() != test.FCB2 {
+			t.Fatalf("%v: unexpected FCB2 '%s', expected '%s'", test.Args, f2.GetFileName(), test.FCB2)
+		}
+	}
+}
+
+// TestCommandTailTooLong ensures that a tail which won't fit is an error,
+// rather than being truncated.
+func TestCommandTailTooLong(t *testing.T) {
+
+	obj, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	obj.Memory = new(memory.Memory)
+
+	err = obj.setCommandTail([]string{strings.Repeat("A", maxTail)})
+	if err != nil {
+		t.Fatalf("unexpected error with a full tail: %s", err)
+	}
+
+	err = obj.Execute([]string{strings.Repeat("A", 100), strings.Repeat("B", 27)})
+	if !errors.Is(err, ErrTailTooLong) {
+		t.Fatalf("expected ErrTailTooLong, got %v", err)
+	}
+}
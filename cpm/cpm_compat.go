@@ -0,0 +1,421 @@
+// cpm_compat.go contains our compatibility database, which allows small
+// deviations from our normal behaviour to be applied to specific binaries.
+//
+// Entries are matched against binaries when they're loaded via LoadBinary,
+// either by the SHA256 hash of their contents, or by their filename, and
+// each may:
+//
+//   - Disable the zero-filling of the TPA beyond the end of the binary.
+//   - Relocate the BDOS, and BIOS.
+//   - Override the registers returned by specific BDOS syscalls.
+//   - Select the console output driver which suits the binary, such as
+//     "adm-3a" for a program installed for that terminal, if enabled via
+//     WithAutoOutput.  The previous driver is restored when the CCP is
+//     reloaded.
+//   - Select the CPU to emulate, and enable or disable RSX-compatible mode.
+//   - Map drives to host directories, or archives, such as the directory
+//     holding the data-files of the binary.
+//
+// Together these act as launch profiles, so users don't need to remember
+// the right invocation for each program.  Everything an entry changes is
+// restored when the next binary, or the CCP, is loaded.
+//
+// A few entries are built in, see cpm_compat.json, and users may supply
+// their own, which take precedence, in the same format:
+//
+//	[
+//	  {
+//	    "name": "STAT.COM",
+//	    "comment": "Only report A: as logged in",
+//	    "results": { "DRV_LOGINVEC": { "HL": "0x0001" } }
+//	  },
+//	  {
+//	    "name": "ZORK1.COM",
+//	    "cpu": "8080",
+//	    "drives": { "B": "~/games/zork" }
+//	  }
+//	]
+//
+// Relative drive paths are relative to the directory which contains the
+// database, and a leading "~" is the home directory of the current user.
+
+package cpm
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// builtinCompat holds the compatibility entries we ship.
+//
+//go:embed cpm_compat.json
+var builtinCompat []byte
+
+// compatNumber is a 16-bit value which may be given in JSON as either a
+// number, or a string such as "0xC000".
+type compatNumber uint16
+
+// UnmarshalJSON parses a compatNumber.
+func (n *compatNumber) UnmarshalJSON(data []byte) error {
+
+	str := strings.Trim(string(data), "\"")
+	val, err := strconv.ParseUint(str, 0, 16)
+	if err != nil {
+		return fmt.Errorf("invalid value %s: %s", string(data), err)
+	}
+	*n = compatNumber(val)
+	return nil
+}
+
+// compatEntry holds the quirks for a single binary.
+type compatEntry struct {
+	// Name is the filename of the binary, such as "STAT.COM".
+	Name string `json:"name,omitempty"`
+
+	// SHA256 is the hash of the contents of the binary, in hex.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Comment describes why the entry is needed.
+	Comment string `json:"comment,omitempty"`
+
+	// ZeroFill may be set to false to leave the TPA beyond the end of
+	// the binary untouched, rather than zero-filling it.
+	ZeroFill *bool `json:"zero-fill,omitempty"`
+
+	// BDOSAddress relocates the BDOS.
+	BDOSAddress *compatNumber `json:"bdos-address,omitempty"`
+
+	// BIOSAddress relocates the BIOS.
+	BIOSAddress *compatNumber `json:"bios-address,omitempty"`
+
+	// Results overrides the registers returned by the named BDOS
+	// syscalls, such as "DRV_DPB", indexed by register name.
+	Results map[string]map[string]compatNumber `json:"results,omitempty"`
+
+	// Output is the console output driver which suits the binary,
+	// along with any options, such as "adm-3a".
+	Output string `json:"output,omitempty"`
+
+	// CPU is the CPU to emulate while the binary runs, "z80" or "8080".
+	CPU string `json:"cpu,omitempty"`
+
+	// RSX enables, or disables, RSX-compatible mode for the binary.
+	RSX *bool `json:"rsx,omitempty"`
+
+	// Drives maps drive letters to the host directories, or archives,
+	// which back them while the binary runs.
+	Drives map[string]string `json:"drives,omitempty"`
+}
+
+// compatDrive holds the state of a drive before a compatibility entry
+// changed it, so that it may be restored.
+type compatDrive struct {
+	path    string
+	backend Drive
+}
+
+// compatRegisters are the names of the registers which may be overridden.
+var compatRegisters = map[string]bool{
+	"A": true, "B": true, "C": true, "D": true, "E": true, "H": true, "L": true,
+	"BC": true, "DE": true, "HL": true,
+}
+
+// parseCompat parses, and validates, a list of compatibility entries.
+func parseCompat(data []byte) ([]compatEntry, error) {
+
+	var entries []compatEntry
+	err := json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, e := range entries {
+		if e.Name == "" && e.SHA256 == "" {
+			return nil, fmt.Errorf("entry %d has neither a name, nor a hash", i+1)
+		}
+		for syscall, regs := range e.Results {
+			for reg := range regs {
+				if !compatRegisters[strings.ToUpper(reg)] {
+					return nil, fmt.Errorf("entry %d has an invalid register %s for %s", i+1, reg, syscall)
+				}
+			}
+		}
+		switch strings.ToLower(e.CPU) {
+		case "", DefaultCPU, "8080":
+		default:
+			return nil, fmt.Errorf("entry %d has an unknown CPU %s", i+1, e.CPU)
+		}
+		for drive := range e.Drives {
+			if _, err := driveName(drive); err != nil {
+				return nil, fmt.Errorf("entry %d has an %s", i+1, err)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// WithCompatDatabase loads the compatibility entries from the given JSON
+// file, which are consulted before those we ship.
+//
+// The empty string means only the entries we ship are used, which is the
+// default.
+func WithCompatDatabase(path string) cpmoption {
+	return func(c *CPM) error {
+		if path == "" {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read compatibility database %s: %s", path, err)
+		}
+
+		entries, err := parseCompat(data)
+		if err != nil {
+			return fmt.Errorf("failed to parse compatibility database %s: %s", path, err)
+		}
+
+		// Drive paths are relative to the database.
+		home, _ := os.UserHomeDir()
+		for _, e := range entries {
+			for drive, dir := range e.Drives {
+				if home != "" && (dir == "~" || strings.HasPrefix(dir, "~/")) {
+					dir = filepath.Join(home, dir[1:])
+				}
+				if !filepath.IsAbs(dir) {
+					dir = filepath.Join(filepath.Dir(path), dir)
+				}
+				e.Drives[drive] = dir
+			}
+		}
+
+		c.compat = entries
+		return nil
+	}
+}
+
+// WithAutoOutput enables, or disables, the selection of the console output
+// driver named by the compatibility entry of each binary we run.
+//
+// This is disabled by default, so that the driver the caller selected is
+// always used.
+func WithAutoOutput(enabled bool) cpmoption {
+	return func(c *CPM) error {
+		c.autoOutput = enabled
+		return nil
+	}
+}
+
+// findCompat returns the compatibility entry for the given binary, if
+// there is one.  A match by hash is preferred to a match by name.
+func (cpm *CPM) findCompat(filename string, data []byte) *compatEntry {
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	name := strings.ToUpper(filepath.Base(filename))
+
+	builtin, err := parseCompat(builtinCompat)
+	if err != nil {
+		slog.Error("failed to parse built-in compatibility database",
+			slog.String("error", err.Error()))
+	}
+	entries := append(append([]compatEntry{}, cpm.compat...), builtin...)
+
+	for i, e := range entries {
+		if e.SHA256 != "" && strings.EqualFold(e.SHA256, hash) {
+			return &entries[i]
+		}
+	}
+	for i, e := range entries {
+		if e.SHA256 == "" && strings.ToUpper(e.Name) == name {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+// applyCompat makes the given entry active, restoring our defaults first.
+// A nil entry just restores our defaults.
+func (cpm *CPM) applyCompat(entry *compatEntry) {
+
+	cpm.quirks = entry
+	cpm.bdosAddress = cpm.defaultBDOS
+	cpm.biosAddress = cpm.defaultBIOS
+	cpm.cpu8080 = cpm.defaultCPU8080
+	cpm.rsx = cpm.defaultRSX
+	cpm.restoreOutput()
+	cpm.restoreDrives()
+
+	if entry == nil {
+		return
+	}
+
+	slog.Debug("Applying compatibility quirks",
+		slog.String("name", entry.Name),
+		slog.String("sha256", entry.SHA256),
+		slog.String("comment", entry.Comment))
+
+	if entry.BDOSAddress != nil {
+		cpm.bdosAddress = uint16(*entry.BDOSAddress)
+	}
+	if entry.BIOSAddress != nil {
+		cpm.biosAddress = uint16(*entry.BIOSAddress)
+	}
+	if entry.Output != "" && cpm.autoOutput {
+		cpm.selectOutput(entry.Output)
+	}
+	if entry.CPU != "" {
+		cpm.cpu8080 = entry.CPU == "8080"
+	}
+	if entry.RSX != nil {
+		cpm.rsx = *entry.RSX
+	}
+	for drive, path := range entry.Drives {
+		cpm.selectDrive(drive, path)
+	}
+}
+
+// selectDrive changes the host path which backs the given drive,
+// remembering its previous state so that it may be restored by
+// restoreDrives.
+func (cpm *CPM) selectDrive(drive string, path string) {
+
+	drive, err := driveName(drive)
+	if err == nil {
+		var backend Drive
+		backend, path, err = openDrive(path)
+		if err == nil {
+			cpm.invalidateDrive(drive)
+
+			if _, ok := cpm.compatDrives[drive]; !ok {
+				cpm.compatDrives[drive] = compatDrive{
+					path:    cpm.drives[drive],
+					backend: cpm.backends[drive],
+				}
+			}
+			delete(cpm.backends, drive)
+			if backend != nil {
+				cpm.backends[drive] = backend
+			}
+			cpm.setDrive(drive, path)
+
+			slog.Debug("Selected drive for binary",
+				slog.String("drive", drive),
+				slog.String("path", path))
+			return
+		}
+	}
+
+	slog.Warn("failed to select drive for binary",
+		slog.String("drive", drive),
+		slog.String("path", path),
+		slog.String("error", err.Error()))
+}
+
+// restoreDrives restores the drives which selectDrive changed.
+func (cpm *CPM) restoreDrives() {
+
+	for drive, old := range cpm.compatDrives {
+		cpm.invalidateDrive(drive)
+
+		delete(cpm.backends, drive)
+		if old.backend != nil {
+			cpm.backends[drive] = old.backend
+		}
+		cpm.setDrive(drive, old.path)
+		delete(cpm.compatDrives, drive)
+	}
+}
+
+// selectOutput changes to the given output driver, remembering the current
+// one so that it may be restored by restoreOutput.
+func (cpm *CPM) selectOutput(spec string) {
+
+	old := cpm.output.GetSpec()
+	if strings.EqualFold(old, spec) {
+		return
+	}
+
+	err := cpm.output.ChangeDriver(spec)
+	if err != nil {
+		slog.Warn("failed to select output driver for binary",
+			slog.String("driver", spec),
+			slog.String("error", err.Error()))
+		return
+	}
+
+	slog.Debug("Selected output driver for binary",
+		slog.String("driver", spec),
+		slog.String("previous", old))
+	cpm.autoRestore = old
+}
+
+// restoreOutput restores the output driver which was in use before
+// selectOutput changed it, if it did.
+func (cpm *CPM) restoreOutput() {
+
+	if cpm.autoRestore == "" {
+		return
+	}
+
+	err := cpm.output.ChangeDriver(cpm.autoRestore)
+	if err != nil {
+		slog.Warn("failed to restore output driver",
+			slog.String("driver", cpm.autoRestore),
+			slog.String("error", err.Error()))
+	}
+	cpm.autoRestore = ""
+}
+
+// zeroFill returns true if the TPA should be zero-filled when a binary is
+// loaded.
+func (cpm *CPM) zeroFill() bool {
+	return cpm.quirks == nil || cpm.quirks.ZeroFill == nil || *cpm.quirks.ZeroFill
+}
+
+// overrideResults replaces the registers returned by the given syscall,
+// if the active compatibility entry says we should.
+func (cpm *CPM) overrideResults(name string) {
+
+	if cpm.quirks == nil {
+		return
+	}
+
+	for syscall, regs := range cpm.quirks.Results {
+		if !strings.EqualFold(syscall, name) {
+			continue
+		}
+		for reg, val := range regs {
+			switch strings.ToUpper(reg) {
+			case "A":
+				cpm.CPU.States.AF.Hi = uint8(val)
+			case "B":
+				cpm.CPU.States.BC.Hi = uint8(val)
+			case "C":
+				cpm.CPU.States.BC.Lo = uint8(val)
+			case "D":
+				cpm.CPU.States.DE.Hi = uint8(val)
+			case "E":
+				cpm.CPU.States.DE.Lo = uint8(val)
+			case "H":
+				cpm.CPU.States.HL.Hi = uint8(val)
+			case "L":
+				cpm.CPU.States.HL.Lo = uint8(val)
+			case "BC":
+				cpm.CPU.States.BC.SetU16(uint16(val))
+			case "DE":
+				cpm.CPU.States.DE.SetU16(uint16(val))
+			case "HL":
+				cpm.CPU.States.HL.SetU16(uint16(val))
+			}
+		}
+	}
+}
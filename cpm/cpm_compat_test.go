@@ -0,0 +1,253 @@
+package cpm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/skx/cpmulator/memory"
+)
+
+// TestCompatParse tests that compatibility databases are validated.
+func TestCompatParse(t *testing.T) {
+
+	_, err := parseCompat(builtinCompat)
+	if err != nil {
+		t.Fatalf("built-in database is invalid: %s", err)
+	}
+
+	for _, invalid := range []string{
+		`{}`,
+		`[{"comment": "no name"}]`,
+		`[{"name": "FOO.COM", "bdos-address": "steve"}]`,
+		`[{"name": "FOO.COM", "bdos-address": 65536}]`,
+		`[{"name": "FOO.COM", "results": {"DRV_DPB": {"IX": 1}}}]`,
+		`[{"name": "FOO.COM", "cpu": "6502"}]`,
+		`[{"name": "FOO.COM", "drives": {"Q": "."}}]`,
+	} {
+		_, err := parseCompat([]byte(invalid))
+		if err == nil {
+			t.Fatalf("expected an error parsing %s", invalid)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "compat.json")
+	os.WriteFile(path, []byte(`[{"comment": "no name"}]`), 0644)
+	_, err = New(WithCompatDatabase(path))
+	if err == nil {
+		t.Fatalf("expected an error loading an invalid database")
+	}
+}
+
+// TestCompatQuirks tests that quirks are applied to the matching binary.
+func TestCompatQuirks(t *testing.T) {
+
+	dir := t.TempDir()
+
+	prog := []byte{0xC9}
+	binary := filepath.Join(dir, "test.com")
+	os.WriteFile(binary, prog, 0644)
+
+	sum := sha256.Sum256(prog)
+
+	// The entry with the matching hash wins over the one with the
+	// matching name.
+	db := filepath.Join(dir, "compat.json")
+	os.WriteFile(db, []byte(`[
+  { "name": "TEST.COM", "bdos-address": "0xA000" },
+  { "sha256": "`+hex.EncodeToString(sum[:])+`",
+    "zero-fill": false,
+    "bdos-address": "0xB000",
+    "bios-address": 48896,
+    "results": { "drv_loginvec": { "HL": "0x0003", "a": 7 } } }
+]`), 0644)
+
+	c, err := New(WithCompatDatabase(db))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	defer c.IOTearDown()
+
+	defBDOS := c.GetBDOSAddress()
+	defBIOS := c.GetBIOSAddress()
+
+	c.Memory = new(memory.Memory)
+	c.Memory.Set(0x8000, 0x42)
+
+	err = c.LoadBinary(binary)
+	if err != nil {
+		t.Fatalf("failed to load binary: %s", err)
+	}
+	if c.GetBDOSAddress() != 0xB000 || c.GetBIOSAddress() != 0xBF00 {
+		t.Fatalf("BDOS/BIOS not relocated %04X %04X", c.GetBDOSAddress(), c.GetBIOSAddress())
+	}
+	if c.Memory.Get(0x8000) != 0x42 {
+		t.Fatalf("memory was zero-filled")
+	}
+
+	BdosSysCallLoginVec(c)
+	c.overrideResults("DRV_LOGINVEC")
+	if c.CPU.States.HL.U16() != 0x0003 || c.CPU.States.AF.Hi != 7 {
+		t.Fatalf("results weren't overridden %04X %02X", c.CPU.States.HL.U16(), c.CPU.States.AF.Hi)
+	}
+
+	// Other syscalls are unchanged.
+	BdosSysCallGetDriveDPB(c)
+	c.overrideResults("DRV_DPB")
+	if c.CPU.States.HL.U16() != 0xCDCD {
+		t.Fatalf("DRV_DPB was overridden")
+	}
+
+	// Loading the CCP restores our defaults.
+	err = c.LoadCCP()
+	if err != nil {
+		t.Fatalf("failed to load CCP: %s", err)
+	}
+	if c.GetBDOSAddress() != defBDOS || c.GetBIOSAddress() != defBIOS {
+		t.Fatalf("BDOS/BIOS not restored")
+	}
+
+	// Binaries which don't match have no quirks, and memory is cleared.
+	other := filepath.Join(dir, "other.com")
+	os.WriteFile(other, []byte{0x00, 0xC9}, 0644)
+	c.Memory.Set(0x8000, 0x42)
+	err = c.LoadBinary(other)
+	if err != nil {
+		t.Fatalf("failed to load binary: %s", err)
+	}
+	if c.quirks != nil || c.Memory.Get(0x8000) != 0x00 {
+		t.Fatalf("unexpected quirks applied")
+	}
+
+	// The built-in entries are used too.
+	stat := filepath.Join(dir, "STAT.COM")
+	os.WriteFile(stat, []byte{0xC9, 0xC9}, 0644)
+	err = c.LoadBinary(stat)
+	if err != nil {
+		t.Fatalf("failed to load binary: %s", err)
+	}
+	BdosSysCallLoginVec(c)
+	c.overrideResults("DRV_LOGINVEC")
+	if c.CPU.States.HL.U16() != 0x0001 {
+		t.Fatalf("built-in entry wasn't applied")
+	}
+}
+
+// TestCompatOutput tests that binaries may select an output driver.
+func TestCompatOutput(t *testing.T) {
+
+	dir := t.TempDir()
+
+	binary := filepath.Join(dir, "EDIT.COM")
+	os.WriteFile(binary, []byte{0xC9}, 0644)
+
+	db := filepath.Join(dir, "compat.json")
+	os.WriteFile(db, []byte(`[
+  { "name": "EDIT.COM", "output": "ansi:color=green" },
+  { "name": "BOGUS.COM", "output": "steve" }
+]`), 0644)
+
+	// Without auto-output the entry is ignored.
+	c, err := New(WithCompatDatabase(db), WithOutputDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	err = c.LoadBinary(binary)
+	if err != nil {
+		t.Fatalf("failed to load binary: %s", err)
+	}
+	if c.output.GetName() != "null" {
+		t.Fatalf("output driver changed unexpectedly")
+	}
+
+	// With it the driver is changed, and restored with the CCP.
+	c, err = New(WithCompatDatabase(db), WithOutputDriver("null"), WithAutoOutput(true))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	err = c.LoadBinary(binary)
+	if err != nil {
+		t.Fatalf("failed to load binary: %s", err)
+	}
+	if c.output.GetSpec() != "ansi:color=green" {
+		t.Fatalf("output driver wasn't selected: %s", c.output.GetSpec())
+	}
+	err = c.LoadCCP()
+	if err != nil {
+		t.Fatalf("failed to load CCP: %s", err)
+	}
+	if c.output.GetSpec() != "null" {
+		t.Fatalf("output driver wasn't restored: %s", c.output.GetSpec())
+	}
+
+	// Unknown drivers are ignored.
+	bogus := filepath.Join(dir, "BOGUS.COM")
+	os.WriteFile(bogus, []byte{0xC9}, 0644)
+	err = c.LoadBinary(bogus)
+	if err != nil {
+		t.Fatalf("failed to load binary: %s", err)
+	}
+	if c.output.GetSpec() != "null" {
+		t.Fatalf("output driver changed unexpectedly: %s", c.output.GetSpec())
+	}
+}
+
+// TestCompatProfile tests that binaries may select the CPU, RSX mode, and
+// drives, which are restored afterwards.
+func TestCompatProfile(t *testing.T) {
+
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "data"), 0755)
+
+	binary := filepath.Join(dir, "GAME.COM")
+	os.WriteFile(binary, []byte{0xC9}, 0644)
+
+	db := filepath.Join(dir, "compat.json")
+	os.WriteFile(db, []byte(`[
+  { "name": "GAME.COM", "cpu": "8080", "rsx": true, "drives": { "b:": "data" } },
+  { "name": "BOGUS.COM", "drives": { "C": "missing" } }
+]`), 0644)
+
+	c, err := New(WithCompatDatabase(db), WithOutputDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	defer c.IOTearDown()
+	c.SetDrives(false)
+
+	err = c.LoadBinary(binary)
+	if err != nil {
+		t.Fatalf("failed to load binary: %s", err)
+	}
+	if c.GetCPU() != "8080" || !c.rsx {
+		t.Fatalf("CPU, or RSX mode, wasn't selected")
+	}
+	if c.GetDrivePaths()["B"] != filepath.Join(dir, "data") {
+		t.Fatalf("drive wasn't selected: %s", c.GetDrivePaths()["B"])
+	}
+
+	// Loading the CCP restores them.
+	err = c.LoadCCP()
+	if err != nil {
+		t.Fatalf("failed to load CCP: %s", err)
+	}
+	if c.GetCPU() != DefaultCPU || c.rsx {
+		t.Fatalf("CPU, or RSX mode, wasn't restored")
+	}
+	if c.GetDrivePaths()["B"] != "." {
+		t.Fatalf("drive wasn't restored: %s", c.GetDrivePaths()["B"])
+	}
+
+	// Missing directories are ignored.
+	bogus := filepath.Join(dir, "BOGUS.COM")
+	os.WriteFile(bogus, []byte{0xC9}, 0644)
+	err = c.LoadBinary(bogus)
+	if err != nil {
+		t.Fatalf("failed to load binary: %s", err)
+	}
+	if c.GetDrivePaths()["C"] != "." {
+		t.Fatalf("drive changed unexpectedly: %s", c.GetDrivePaths()["C"])
+	}
+}
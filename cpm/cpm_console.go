@@ -0,0 +1,149 @@
+// cpm_console.go contains the helpers used by the BDOS console-output
+// functions, which implement the traditional CP/M console conventions:
+//
+//  1. TAB characters are expanded to spaces, with stops every 8 columns.
+//
+//  2. Ctrl-S pauses output, until another key is pressed.  If that key
+//     is Ctrl-C then the running program is aborted.
+//
+//  3. Ctrl-P toggles the echoing of console output to the printer.
+//
+// CP/M 3 programs may change these conventions via the console mode, set
+// by C_MODE, whose bits we honour:
+//
+//   - consoleModeCtrlCStatus makes C_STAT report only pending Ctrl-Cs.
+//   - consoleModeNoStop disables the pausing of output via Ctrl-S.
+//   - consoleModeRaw disables the expansion of TABs, and the echoing of
+//     output to the printer.
+//   - consoleModeNoCtrlC stops Ctrl-C from terminating the program.
+//
+// The mode is reset to zero when the CCP, or a binary, is loaded.
+
+package cpm
+
+import (
+	"errors"
+	"time"
+
+	"github.com/skx/cpmulator/consolein"
+)
+
+// The bits of the console mode, as set by C_MODE, which we honour.
+const (
+	consoleModeCtrlCStatus = 0x0001
+	consoleModeNoStop      = 0x0002
+	consoleModeRaw         = 0x0004
+	consoleModeNoCtrlC     = 0x0008
+)
+
+// consoleModeSet returns true if the given bit of the console mode is set.
+func (cpm *CPM) consoleModeSet(bit uint16) bool {
+	return cpm.consoleMode&bit != 0
+}
+
+// consoleBreakInterval is the minimum time between checks for pending
+// console input, while output is being written.
+//
+// Checking for input can be expensive, depending upon the driver, so we
+// don't want to do it for every single character we output.
+const consoleBreakInterval = 20 * time.Millisecond
+
+// consoleBreak checks to see if the user has pressed a key while output
+// is being written, and handles the special keys Ctrl-S and Ctrl-P.
+//
+// Any other key is pushed back into the input so that it will be read
+// normally.
+func (cpm *CPM) consoleBreak() error {
+
+	// Don't check too frequently.
+	now := cpm.now()
+	if now.Sub(cpm.lastBreakCheck) < consoleBreakInterval {
+		return nil
+	}
+	cpm.lastBreakCheck = now
+
+	if !cpm.input.PendingInput() {
+		return nil
+	}
+
+	c, err := cpm.input.BlockForCharacterNoEcho()
+	if err != nil {
+		// The kill key terminates the emulator.
+		if errors.Is(err, consolein.ErrKilled) {
+			return err
+		}
+
+		// If our input has run out there's nothing for us
+		// to do, the next read will handle it.
+		return nil
+	}
+
+	switch c {
+
+	// Ctrl-S pauses output until a key is pressed, unless the
+	// console mode disables that.
+	case 0x13:
+		if cpm.consoleModeSet(consoleModeNoStop) {
+			cpm.input.UnreadCharacter(c)
+			break
+		}
+
+		k, err := cpm.input.BlockForCharacterNoEcho()
+		if err != nil {
+			if errors.Is(err, consolein.ErrKilled) {
+				return err
+			}
+			return nil
+		}
+
+		// Ctrl-C aborts the running program, unless the
+		// user, or the program, has disabled Ctrl-C handling.
+		if k == 0x03 && cpm.input.GetInterruptCount() > 0 && !cpm.consoleModeSet(consoleModeNoCtrlC) {
+			return ErrBoot
+		}
+
+	// Ctrl-P toggles the printer-echo, unless the console is in
+	// raw mode.
+	case 0x10:
+		if cpm.consoleModeSet(consoleModeRaw) {
+			cpm.input.UnreadCharacter(c)
+			break
+		}
+		cpm.printerEcho = !cpm.printerEcho
+
+	// Anything else is saved for the next read.
+	default:
+		cpm.input.UnreadCharacter(c)
+	}
+
+	return nil
+}
+
+// conOut writes a character to the console, as the BDOS console-output
+// functions do, expanding TABs and echoing to the printer if that has
+// been enabled - unless the console is in raw mode.
+func (cpm *CPM) conOut(c uint8) error {
+
+	err := cpm.consoleBreak()
+	if err != nil {
+		return err
+	}
+
+	if cpm.consoleModeSet(consoleModeRaw) {
+		cpm.output.PutCharacter(c)
+		return nil
+	}
+
+	out := cpm.output.WriteCharacter(c)
+
+	if cpm.printerEcho {
+		for _, x := range out {
+			err = cpm.prnC(x)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+// cpm_cpu8080.go contains our 8080 mode, which helps developers ensure that
+// their programs will run upon an 8080, or 8085, rather than only a Z80.
+//
+// The Z80 runs 8080 code unchanged, but adds many instructions of its own,
+// reached via the CB, DD, ED, and FD prefixes, along with relative jumps,
+// and the alternate register set.  In 8080 mode we check each instruction
+// before it is executed, and if it is one of those we stop, reporting the
+// instruction, and its address.
+//
+// Only the program is checked, the CCP we load is written for the Z80, so
+// instructions at, or above, the address of the BDOS, or the CCP, are
+// allowed.
+//
+// Instructions are checked one at a time, as with watchpoints, so this
+// mode is slower than usual.
+
+package cpm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/skx/cpmulator/asm"
+)
+
+// ErrZ80Instruction is returned when a program executes an instruction
+// which is only present upon the Z80, in 8080 mode.
+var ErrZ80Instruction = errors.New("Z80-only instruction")
+
+// DefaultCPU is the CPU we emulate, unless another is selected.
+const DefaultCPU = "z80"
+
+// z80Opcodes contains the opcodes which are only present upon the Z80.
+//
+// On the 8080 some of these are undocumented aliases of other
+// instructions, while the rest do nothing at all.
+var z80Opcodes = map[byte]bool{
+	0x08: true, // EX AF, AF'
+	0x10: true, // DJNZ
+	0x18: true, // JR
+	0x20: true, // JR NZ
+	0x28: true, // JR Z
+	0x30: true, // JR NC
+	0x38: true, // JR C
+	0xCB: true, // Bit operations
+	0xD9: true, // EXX
+	0xDD: true, // IX operations
+	0xED: true, // Extended operations
+	0xFD: true, // IY operations
+}
+
+// WithCPU selects the CPU we emulate, "z80", the default, or "8080" which
+// stops programs which use Z80-only instructions.
+func WithCPU(name string) cpmoption {
+	return func(c *CPM) error {
+		switch strings.ToLower(name) {
+		case "", DefaultCPU:
+			c.cpu8080 = false
+		case "8080":
+			c.cpu8080 = true
+		default:
+			return fmt.Errorf("unknown CPU '%s', valid CPUs are 8080,z80", name)
+		}
+		return nil
+	}
+}
+
+// GetCPU returns the name of the CPU we emulate.
+func (cpm *CPM) GetCPU() string {
+	if cpm.cpu8080 {
+		return "8080"
+	}
+	return DefaultCPU
+}
+
+// check8080 returns ErrZ80Instruction if we're in 8080 mode, and the
+// program is about to execute a Z80-only instruction.
+func (cpm *CPM) check8080() error {
+
+	if !cpm.cpu8080 {
+		return nil
+	}
+
+	// The system, and the CCP, live above the program.
+	pc := cpm.CPU.PC
+	top := cpm.bdosAddress
+	if cpm.start > 0x0100 {
+		top = min(top, cpm.start)
+	}
+	if pc >= top {
+		return nil
+	}
+
+	// Inspecting memory mustn't trigger our watchpoints.
+	muted := cpm.watchMuted
+	cpm.watchMuted = true
+	defer func() {
+		cpm.watchMuted = muted
+	}()
+
+	if !z80Opcodes[cpm.Memory.Get(pc)] {
+		return nil
+	}
+
+	text, _ := asm.Disassemble(cpm.Memory.GetRange(pc, 4), pc)
+	return fmt.Errorf("%w %s at %04X", ErrZ80Instruction, text, pc)
+}
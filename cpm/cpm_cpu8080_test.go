@@ -0,0 +1,99 @@
+package cpm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/skx/cpmulator/asm"
+)
+
+// TestCPU8080 ensures that programs which use Z80-only instructions are
+// stopped in 8080 mode, and only then.
+func TestCPU8080(t *testing.T) {
+
+	_, err := New(WithCPU("6502"))
+	if err == nil || !strings.Contains(err.Error(), "unknown CPU") {
+		t.Fatalf("expected an error, got %v", err)
+	}
+
+	dir := t.TempDir()
+	programs := map[string]string{
+		"I8080.COM": `
+        ORG 100H
+        LD C, 9
+        LD DE, MSG
+        CALL 5
+        JP DONE
+DONE:
+        LD C, 0
+        CALL 5
+MSG:
+        DB "OK$"
+`,
+		"Z80.COM": `
+        ORG 100H
+        LD C, 9
+        LD DE, MSG
+        CALL 5
+        JR DONE
+DONE:
+        LD C, 0
+        CALL 5
+MSG:
+        DB "OK$"
+`,
+	}
+	for name, src := range programs {
+		err = os.WriteFile(filepath.Join(dir, name), asm.MustAssemble(src), 0644)
+		if err != nil {
+			t.Fatalf("failed to write program: %s", err)
+		}
+	}
+
+	type TestCase struct {
+		CPU      string
+		Program  string
+		Expected string
+	}
+
+	tests := []TestCase{
+		{CPU: "z80", Program: "I8080.COM", Expected: ""},
+		{CPU: "z80", Program: "Z80.COM", Expected: ""},
+		{CPU: "8080", Program: "I8080.COM", Expected: ""},
+		{CPU: "8080", Program: "Z80.COM", Expected: "Z80-only instruction JR 0x010A at 0108"},
+	}
+
+	for _, test := range tests {
+		obj, err := New(WithOutputDriver("buffer"), WithCPU(test.CPU))
+		if err != nil {
+			t.Fatalf("failed to create CPM: %s", err)
+		}
+		if obj.GetCPU() != test.CPU {
+			t.Fatalf("unexpected CPU %s", obj.GetCPU())
+		}
+
+		err = obj.LoadBinary(filepath.Join(dir, test.Program))
+		if err != nil {
+			t.Fatalf("failed to load program: %s", err)
+		}
+
+		err = obj.Execute([]string{})
+		out, _ := obj.ReadOutput()
+		if out != "OK" {
+			t.Fatalf("%s/%s: unexpected output '%s'", test.CPU, test.Program, out)
+		}
+
+		if test.Expected == "" {
+			if err != nil {
+				t.Fatalf("%s/%s: unexpected error %s", test.CPU, test.Program, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrZ80Instruction) || err.Error() != test.Expected {
+			t.Fatalf("%s/%s: unexpected error %v", test.CPU, test.Program, err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// cpm_crashdump.go contains the code which writes a crash report, when a
+// guest program dies unexpectedly, to help diagnose the problem.
+
+package cpm
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/koron-go/z80"
+	"github.com/skx/cpmulator/asm"
+	"github.com/skx/cpmulator/fcb"
+)
+
+// crashWindow is the number of bytes of memory, around the program counter,
+// which are included in a crash report.
+const crashWindow = 64
+
+// crashStack is the number of words from the top of the stack which are
+// included in a crash report.
+const crashStack = 8
+
+// WithCrashReport configures the path to which a crash report will be
+// written, if a guest program executes an unimplemented syscall, or HALTs.
+//
+// The special path "-" means the report is written to STDERR, and the empty
+// string disables crash reports, which is the default.
+func WithCrashReport(path string) cpmoption {
+	return func(c *CPM) error {
+		c.crashPath = path
+		return nil
+	}
+}
+
+// crashReport writes a crash report, if enabled, describing the state of
+// the guest at the point it failed.
+func (cpm *CPM) crashReport(reason error) {
+
+	if cpm.crashPath == "" {
+		return
+	}
+
+	// Inspecting memory mustn't trigger our watchpoints.
+	cpm.watchMuted = true
+	defer func() {
+		cpm.watchMuted = false
+	}()
+
+	var out io.Writer = os.Stderr
+
+	if cpm.crashPath != "-" {
+		file, err := os.Create(cpm.crashPath)
+		if err != nil {
+			slog.Error("failed to create crash report",
+				slog.String("path", cpm.crashPath),
+				slog.String("error", err.Error()))
+			return
+		}
+		defer file.Close()
+		out = file
+	}
+
+	cpm.writeCrashReport(out, reason)
+}
+
+// writeCrashReport writes the details of the guest state to the given writer.
+func (cpm *CPM) writeCrashReport(out io.Writer, reason error) {
+
+	s := cpm.CPU.States
+
+	fmt.Fprintf(out, "cpmulator crash report\n")
+	fmt.Fprintf(out, "Reason: %s\n", reason)
+	fmt.Fprintf(out, "Syscall (C): %d (0x%02X)\n", s.BC.Lo, s.BC.Lo)
+
+	// Registers
+	fmt.Fprintf(out, "\nRegisters:\n")
+	cpm.writeRegisters(out, "  ")
+
+	// Memory around PC, as hex
+	fmt.Fprintf(out, "\nMemory around PC:\n")
+	cpm.writeHexDump(out, "  ", s.PC-crashWindow/2, crashWindow)
+
+	// Disassembly from PC, we can't reliably disassemble backwards.
+	fmt.Fprintf(out, "\nDisassembly from PC:\n")
+	code := cpm.Memory.GetRange(s.PC, crashWindow/2)
+	lines := asm.DisassembleRange(code, s.PC)
+	if cpm.symbols != nil {
+		lines = asm.DisassembleSymbols(code, s.PC, cpm.bdosNames(), cpm.symbols)
+	}
+	for _, line := range lines {
+		fmt.Fprintf(out, "  %s\n", line)
+	}
+
+	// Stack
+	fmt.Fprintf(out, "\nStack:\n")
+	for i := uint16(0); i < crashStack; i++ {
+		addr := s.SP + i*2
+		val := cpm.Memory.GetU16(addr)
+		if sym := cpm.symbolFor(val); sym != "" {
+			fmt.Fprintf(out, "  %04X  %04X  %s\n", addr, val, sym)
+			continue
+		}
+		fmt.Fprintf(out, "  %04X  %04X\n", addr, val)
+	}
+
+	// Open files
+	fmt.Fprintf(out, "\nOpen files:\n")
+	if len(cpm.files) == 0 {
+		fmt.Fprintf(out, "  None\n")
+	}
+	keys := []int{}
+	for key := range cpm.files {
+		keys = append(keys, int(key))
+	}
+	sort.Ints(keys)
+	for _, key := range keys {
+		obj := cpm.files[uint16(key)]
+		f := fcb.FromBytes(cpm.Memory.GetRange(uint16(key), fcb.SIZE))
+		fmt.Fprintf(out, "  FCB %04X  %c:%-12s offset:%d host:%s\n", key, cpm.fcbDrive(f), f.GetFileName(), f.GetSequentialOffset(), obj.name)
+	}
+}
+
+// writeRegisters writes the Z80 registers, and flags, to the given writer,
+// with each line having the given prefix.
+func (cpm *CPM) writeRegisters(out io.Writer, prefix string) {
+
+	s := cpm.CPU.States
+
+	fmt.Fprintf(out, "%sAF=%04X BC=%04X DE=%04X HL=%04X\n", prefix, s.AF.U16(), s.BC.U16(), s.DE.U16(), s.HL.U16())
+	fmt.Fprintf(out, "%sAF'=%04X BC'=%04X DE'=%04X HL'=%04X\n", prefix, s.Alternate.AF.U16(), s.Alternate.BC.U16(), s.Alternate.DE.U16(), s.Alternate.HL.U16())
+	fmt.Fprintf(out, "%sIX=%04X IY=%04X SP=%04X PC=%04X\n", prefix, s.IX, s.IY, s.SP, s.PC)
+
+	flags := ""
+	for _, f := range []struct {
+		name string
+		flag z80.Flag
+	}{{"S", z80.FlagS}, {"Z", z80.FlagZ}, {"H", z80.FlagH}, {"P", z80.FlagPV}, {"N", z80.FlagN}, {"C", z80.FlagC}} {
+		if s.AF.Lo&uint8(f.flag) != 0 {
+			flags += f.name
+		} else {
+			flags += "-"
+		}
+	}
+	fmt.Fprintf(out, "%sFlags=%s\n", prefix, flags)
+
+	if sym := cpm.symbolFor(s.PC); sym != "" {
+		fmt.Fprintf(out, "%sPC is at %s\n", prefix, sym)
+	}
+}
+
+// writeHexDump writes a hex-dump of the given region of memory to the
+// given writer, sixteen bytes to a line, with each line having the given
+// prefix.
+func (cpm *CPM) writeHexDump(out io.Writer, prefix string, start uint16, size int) {
+
+	mem := cpm.Memory.GetRange(start, size)
+
+	for i := 0; i < size; i += 16 {
+		end := i + 16
+		if end > size {
+			end = size
+		}
+
+		hex := []string{}
+		txt := ""
+		for _, b := range mem[i:end] {
+			hex = append(hex, fmt.Sprintf("%02X", b))
+			if b >= 0x20 && b < 0x7F {
+				txt += string(rune(b))
+			} else {
+				txt += "."
+			}
+		}
+		fmt.Fprintf(out, "%s%04X  %-47s  %s\n", prefix, start+uint16(i), strings.Join(hex, " "), txt)
+	}
+}
@@ -0,0 +1,66 @@
+// cpm_deterministic.go contains our deterministic mode, which ensures that
+// two runs of a program, given the same input, produce identical output.
+//
+// Normally guests can observe the clock of the host, via F_UPTIME and the
+// date stored in the SCB, along with the size of the host terminal, which
+// makes the output of tests vary from run to run.  In deterministic mode:
+//
+//   - The emulator is launched at a fixed time, DeterministicTime.
+//   - Time advances by deterministicTick for each syscall, rather than
+//     following the clock of the host.
+//   - The terminal is reported as being 80x24, unless a size has been
+//     configured via WithTerminalSize.
+//
+// Our own clock is also used to decide when to check for Ctrl-S, and
+// Ctrl-P, while output is written, so that input is consumed at the same
+// point of each run.
+
+package cpm
+
+import (
+	"time"
+)
+
+// DeterministicTime is the time at which the emulator is launched, when
+// deterministic mode is enabled.
+var DeterministicTime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// deterministicTick is the time which passes for each syscall, when
+// deterministic mode is enabled.
+const deterministicTick = time.Millisecond
+
+// The size of the terminal reported in deterministic mode, unless one is
+// configured.
+const (
+	deterministicWidth  = 80
+	deterministicHeight = 24
+)
+
+// WithDeterministic enables, or disables, deterministic mode, as described
+// at the top of this file.
+func WithDeterministic(enabled bool) cpmoption {
+	return func(c *CPM) error {
+		c.deterministic = enabled
+		if !enabled {
+			return nil
+		}
+
+		c.launchTime = DeterministicTime
+		if c.termWidth == 0 && c.termHeight == 0 {
+			c.termWidth = deterministicWidth
+			c.termHeight = deterministicHeight
+		}
+		return nil
+	}
+}
+
+// now returns the current time, as seen by guests.
+//
+// In deterministic mode this is derived from the number of syscalls which
+// have been made, otherwise it is the time of the host.
+func (cpm *CPM) now() time.Time {
+	if !cpm.deterministic {
+		return time.Now()
+	}
+	return cpm.launchTime.Add(time.Duration(cpm.syscallCount) * deterministicTick)
+}
@@ -0,0 +1,65 @@
+package cpm
+
+import (
+	"testing"
+
+	"github.com/skx/cpmulator/memory"
+)
+
+// TestDeterministic ensures that guests see a synthetic clock, and a fixed
+// terminal size, in deterministic mode.
+func TestDeterministic(t *testing.T) {
+
+	obj, err := New(WithOutputDriver("null"), WithDeterministic(true))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	obj.Memory = new(memory.Memory)
+
+	// Five syscalls is five milliseconds, or 5,000,000 nanoseconds.
+	obj.syscallCount = 5
+	err = BdosSysCallUptime(obj)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if obj.CPU.States.HL.U16() != 0x4B40 || obj.CPU.States.DE.U16() != 0x004C {
+		t.Fatalf("unexpected uptime %04X%04X", obj.CPU.States.DE.U16(), obj.CPU.States.HL.U16())
+	}
+
+	// The date is that of our launch, 2000-01-01, which is day 8036.
+	obj.scbSync()
+	days := obj.Memory.GetU16(obj.scbAddress() + scbDateDays)
+	if days != 8036 {
+		t.Fatalf("unexpected date %d", days)
+	}
+
+	width, height, err := obj.getTerminalSize()
+	if err != nil || width != 80 || height != 24 {
+		t.Fatalf("unexpected terminal size %dx%d %v", width, height, err)
+	}
+
+	// A configured terminal size wins, regardless of the order of the
+	// options.
+	for _, opts := range [][]cpmoption{
+		{WithTerminalSize(132, 43), WithDeterministic(true)},
+		{WithDeterministic(true), WithTerminalSize(132, 43)},
+	} {
+		obj, err = New(opts...)
+		if err != nil {
+			t.Fatalf("failed to create CPM: %s", err)
+		}
+		width, height, _ = obj.getTerminalSize()
+		if width != 132 || height != 43 {
+			t.Fatalf("unexpected terminal size %dx%d", width, height)
+		}
+	}
+
+	// Without deterministic mode we see the time of the host.
+	obj, err = New(WithOutputDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	if obj.now().Before(DeterministicTime) || obj.launchTime.Equal(DeterministicTime) {
+		t.Fatalf("unexpected clock in normal mode")
+	}
+}
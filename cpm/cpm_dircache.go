@@ -0,0 +1,130 @@
+// cpm_dircache.go contains the state which is kept for searches started
+// by "find first", and the optional cache of directory listings which
+// those searches use.
+//
+// Some directory tools call "find first" repeatedly, and reading a large
+// host directory each time is slow, so a snapshot of the directory can
+// be reused for a short time.  The snapshots are discarded whenever the
+// guest makes a syscall which might change the contents of a drive.
+
+package cpm
+
+import (
+	"io/fs"
+	"time"
+)
+
+// WithDirectoryCache configures the length of time for which a snapshot
+// of a drive's directory may be reused by "find first".
+//
+// Changes made by the guest discard the snapshots, but changes made upon
+// the host will not be seen until the snapshot expires.  Zero disables
+// the cache, which is the default.
+func WithDirectoryCache(ttl time.Duration) cpmoption {
+	return func(c *CPM) error {
+		c.dirCacheTTL = ttl
+		return nil
+	}
+}
+
+// findState holds the results of a search started by "find first", which
+// are returned, one at a time, by "find next".
+type findState struct {
+	// drive is the drive which was searched.
+	drive string
+
+	// results holds the files which have yet to be returned.
+	results []fs.FileInfo
+
+	// offset contains the index into results which is to be read next.
+	offset int
+}
+
+// startSearch records a search, started by "find first" with the FCB at
+// the given address, which will be continued by "find next".
+//
+// As with opened files the address is also stored in the allocation map
+// of the FCB, which is private to the BDOS, so that the search can be
+// found if the program copies the FCB elsewhere.
+func (cpm *CPM) startSearch(ptr uint16, state *findState) {
+
+	cpm.Memory.Set(ptr+16, uint8(ptr&0xFF))
+	cpm.Memory.Set(ptr+17, uint8(ptr>>8))
+
+	cpm.finds[ptr] = state
+	cpm.lastFind = state
+}
+
+// findSearch returns the search which "find next" should continue, given
+// the address of the FCB it was called with.
+//
+// We look for a search started with that FCB, then for the one whose
+// address is stored within it, and finally fall back to the most recent
+// search, as CP/M doesn't require "find next" to be given an FCB at all.
+func (cpm *CPM) findSearch(ptr uint16) *findState {
+
+	if state, ok := cpm.finds[ptr]; ok {
+		return state
+	}
+
+	if state, ok := cpm.finds[cpm.Memory.GetU16(ptr+16)]; ok {
+		return state
+	}
+
+	return cpm.lastFind
+}
+
+// dirSnapshot holds the contents of a drive's directory, and when they
+// were read.
+type dirSnapshot struct {
+	files []fs.FileInfo
+	taken time.Time
+}
+
+// cachedDrive wraps a Drive so that its directory listing is read from,
+// and stored in, our cache.
+type cachedDrive struct {
+	Drive
+	cpm   *CPM
+	drive string
+}
+
+// ReadDir returns the files upon the drive, from our cache if we have a
+// recent enough snapshot.
+func (c cachedDrive) ReadDir() ([]fs.FileInfo, error) {
+
+	snap, ok := c.cpm.dirCache[c.drive]
+	if ok && time.Since(snap.taken) < c.cpm.dirCacheTTL {
+		return snap.files, nil
+	}
+
+	files, err := c.Drive.ReadDir()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.cpm.dirCache == nil {
+		c.cpm.dirCache = make(map[string]dirSnapshot)
+	}
+	c.cpm.dirCache[c.drive] = dirSnapshot{files: files, taken: time.Now()}
+	return files, nil
+}
+
+// findDrive returns the given drive, for use by "find first", which will
+// use our directory cache if it is enabled.
+func (cpm *CPM) findDrive(drive string) Drive {
+
+	d := cpm.getDrive(drive)
+	if cpm.dirCacheTTL <= 0 {
+		return d
+	}
+	return cachedDrive{Drive: d, cpm: cpm, drive: drive}
+}
+
+// invalidateDirCache discards all our directory snapshots, and must be
+// called by any syscall which might change the contents of a drive, such
+// as by creating, deleting, renaming, or writing to a file, as any snapshot
+// of the drive's directory might now be out of date.
+func (cpm *CPM) invalidateDirCache() {
+	cpm.dirCache = nil
+}
@@ -0,0 +1,163 @@
+package cpm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/skx/cpmulator/fcb"
+	"github.com/skx/cpmulator/memory"
+)
+
+// newFindTest creates an emulator with the A: drive pointing to a temporary
+// directory, which contains the given files.
+func newFindTest(t *testing.T, options []cpmoption, names ...string) (*CPM, string) {
+
+	c, err := New(options...)
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.Memory = new(memory.Memory)
+
+	dir := t.TempDir()
+	c.SetDrives(false)
+	c.SetDrivePath("A", dir)
+
+	for _, name := range names {
+		err = os.WriteFile(filepath.Join(dir, name), []byte("data"), 0644)
+		if err != nil {
+			t.Fatalf("failed to create file %s", err)
+		}
+	}
+	return c, dir
+}
+
+// findCall invokes FindFirst, or FindNext, with the given FCB address, and
+// returns the name of the file found, or "" if there was none.
+func findCall(t *testing.T, c *CPM, first bool, ptr uint16) string {
+
+	c.CPU.States.DE.SetU16(ptr)
+
+	var err error
+	if first {
+		err = BdosSysCallFindFirst(c)
+	} else {
+		err = BdosSysCallFindNext(c)
+	}
+	if err != nil {
+		t.Fatalf("error searching: %s", err)
+	}
+	if c.CPU.States.AF.Hi != 0x00 {
+		return ""
+	}
+
+	x := fcb.FromBytes(c.Memory.GetRange(c.dma, fcb.SIZE))
+	return x.GetFileName()
+}
+
+// TestInterleavedFind ensures that two searches, using different FCBs,
+// can be in progress at the same time, as they are when PIP copies
+// between patterns.
+func TestInterleavedFind(t *testing.T) {
+
+	c, _ := newFindTest(t, nil, "A.TXT", "B.TXT", "C.COM", "D.COM")
+	defer c.IOTearDown()
+
+	txt := fcb.FromString("*.TXT")
+	c.Memory.SetRange(0x0200, txt.AsBytes()...)
+	com := fcb.FromString("*.COM")
+	c.Memory.SetRange(0x0300, com.AsBytes()...)
+
+	steps := []struct {
+		first  bool
+		ptr    uint16
+		result string
+	}{
+		{true, 0x0200, "A.TXT"},
+		{true, 0x0300, "C.COM"},
+		{false, 0x0200, "B.TXT"},
+		{false, 0x0300, "D.COM"},
+		{false, 0x0200, ""},
+		{false, 0x0300, ""},
+
+		// An FCB which didn't start a search continues the
+		// most recent one.
+		{true, 0x0200, "A.TXT"},
+		{false, 0x0000, "B.TXT"},
+		{false, 0x0000, ""},
+	}
+
+	for i, s := range steps {
+		got := findCall(t, c, s.first, s.ptr)
+		if got != s.result {
+			t.Fatalf("step %d: expected %q, got %q", i, s.result, got)
+		}
+	}
+
+	// A copy of an FCB continues the search it started, rather
+	// than the most recent one.
+	findCall(t, c, true, 0x0200)
+	findCall(t, c, true, 0x0300)
+	c.Memory.SetRange(0x0400, c.Memory.GetRange(0x0200, fcb.SIZE)...)
+	if got := findCall(t, c, false, 0x0400); got != "B.TXT" {
+		t.Fatalf("copied FCB found %q", got)
+	}
+}
+
+// TestDirectoryCache ensures directory snapshots are reused, and are
+// discarded when they expire or the guest changes the drive.
+func TestDirectoryCache(t *testing.T) {
+
+	c, dir := newFindTest(t, []cpmoption{WithDirectoryCache(time.Hour)}, "A.TXT")
+	defer c.IOTearDown()
+
+	all := fcb.FromString("*.*")
+	c.Memory.SetRange(0x0200, all.AsBytes()...)
+
+	if got := findCall(t, c, true, 0x0200); got != "A.TXT" {
+		t.Fatalf("wrong first result %q", got)
+	}
+
+	// A file created upon the host isn't seen, as we have a snapshot.
+	err := os.WriteFile(filepath.Join(dir, "B.TXT"), []byte("data"), 0644)
+	if err != nil {
+		t.Fatalf("failed to create file %s", err)
+	}
+	findCall(t, c, true, 0x0200)
+	if got := findCall(t, c, false, 0x0200); got != "" {
+		t.Fatalf("snapshot wasn't used, found %q", got)
+	}
+
+	// Until the guest creates a file.
+	newFile := fcb.FromString("C.TXT")
+	c.Memory.SetRange(0x0300, newFile.AsBytes()...)
+	c.CPU.States.DE.SetU16(0x0300)
+	err = BdosSysCallMakeFile(c)
+	if err != nil || c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("failed to create file %v", err)
+	}
+
+	found := []string{findCall(t, c, true, 0x0200)}
+	for {
+		name := findCall(t, c, false, 0x0200)
+		if name == "" {
+			break
+		}
+		found = append(found, name)
+	}
+	if len(found) != 3 {
+		t.Fatalf("snapshot wasn't discarded, found %v", found)
+	}
+
+	// Snapshots expire.
+	c.dirCacheTTL = time.Millisecond
+	err = os.Remove(filepath.Join(dir, "A.TXT"))
+	if err != nil {
+		t.Fatalf("failed to remove file %s", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if got := findCall(t, c, true, 0x0200); got != "B.TXT" {
+		t.Fatalf("snapshot didn't expire, found %q", got)
+	}
+}
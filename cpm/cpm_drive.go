@@ -0,0 +1,414 @@
+// cpm_drive.go contains the Drive interface, which is used by all the
+// file-based BDOS syscalls to access the files upon a CP/M drive, along
+// with the generic implementations.
+//
+// Each CP/M drive is made up of a host directory, to which files are
+// written, overlaid upon a read-only backend.  By default the backend is
+// the set of files embedded within our binary, but a mounted archive
+// replaces that.
+
+package cpm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/skx/cpmulator/fcb"
+)
+
+// ErrReadOnly is returned when an attempt is made to modify a file which
+// is read-only, such as one embedded within our binary.
+var ErrReadOnly = errors.New("READ-ONLY FILE")
+
+// Drive is the interface which is implemented by the backends which hold
+// the files upon a CP/M drive.
+//
+// Names are always CP/M names, that is upper-case 8.3 names without any
+// drive prefix.  Mapping them to the names the backend uses is the job of
+// the implementation.
+//
+// Errors for missing files satisfy errors.Is(err, fs.ErrNotExist), and
+// attempts to modify read-only files return ErrReadOnly.
+type Drive interface {
+
+	// Open opens an existing file, for writing as well as reading if
+	// that is possible.
+	Open(name string) (DriveFile, error)
+
+	// Create creates a new file, or opens the existing file with the
+	// same name, for reading and writing.
+	Create(name string) (DriveFile, error)
+
+	// ReadDir returns the details of all the files upon the drive.
+	ReadDir() ([]fs.FileInfo, error)
+
+	// Delete removes the given file.
+	Delete(name string) error
+
+	// Rename changes the name of the given file.
+	Rename(from string, to string) error
+
+	// Stat returns the details of the given file.
+	Stat(name string) (fs.FileInfo, error)
+}
+
+// DriveFile is a file which has been opened upon a Drive.
+type DriveFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+
+	// Name returns the name of the file, for diagnostics.
+	Name() string
+
+	// Stat returns the details of the file.
+	Stat() (fs.FileInfo, error)
+
+	// Truncate changes the size of the file.
+	Truncate(size int64) error
+
+	// Sync ensures anything written to the file is stored durably.
+	Sync() error
+
+	// ReadOnly returns true if the file cannot be written.
+	ReadOnly() bool
+}
+
+// getDrive returns the Drive which holds the files for the given drive
+// letter.
+//
+// Buffered data for open files is written back first, so that the drive
+// sees the same contents as the guest.  If the filesystem is read-only the
+// drive is layered beneath one held in memory, see cpm_scratchdrive.go.
+//
+// Drives which are held entirely in memory are described in
+// cpm_ramdrive.go.
+func (cpm *CPM) getDrive(drive string) Drive {
+
+	cpm.flushFiles()
+
+	if cpm.drives[drive] == MemoryDrive {
+		return cpm.ramDrive(drive)
+	}
+
+	host := hostDrive{cpm: cpm, dir: cpm.drives[drive]}
+
+	var d Drive = overlayDrive{upper: host, lower: fsDrive{fsys: cpm.static, dir: drive}}
+	if backend, ok := cpm.backends[drive]; ok {
+		d = overlayDrive{upper: host, lower: backend}
+	}
+
+	// If the filesystem is read-only changes are held in memory.
+	if cpm.readOnlyFS {
+		d = scratchDrive{state: cpm.scratchFor(drive), drive: drive, lower: d}
+	}
+	return d
+}
+
+// loginVector returns a bitmap of the drives which exist, with bit 0 being
+// A:, as returned by DRV_LOGINVEC.
+func (cpm *CPM) loginVector() uint16 {
+
+	vec := uint16(0)
+	for i := uint8(0); i < 16; i++ {
+		if cpm.driveExists(i) {
+			vec |= 1 << i
+		}
+	}
+	return vec
+}
+
+// driveExists returns true if the given drive, 0 for A: to 15 for P:,
+// exists.
+//
+// A: always exists, as it holds our embedded binaries, and other drives
+// exist if they're held in memory, have a mounted archive, or their host
+// directory exists.
+// Like hostDrive we treat a drive without a path as using the current
+// directory.
+func (cpm *CPM) driveExists(drv uint8) bool {
+
+	if drv == 0 {
+		return true
+	}
+	if drv > 15 {
+		return false
+	}
+
+	drive := string(rune('A' + drv))
+	if _, ok := cpm.backends[drive]; ok {
+		return true
+	}
+
+	path := cpm.drives[drive]
+	if path == MemoryDrive {
+		return true
+	}
+	if path == "" {
+		path = "."
+	}
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// findFiles returns the details of the files upon the given drive which
+// match the pattern in the given FCB, sorted by name.
+func findFiles(d Drive, f fcb.FCB) ([]fs.FileInfo, error) {
+
+	files, err := d.ReadDir()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []fs.FileInfo
+	for _, fi := range files {
+		if !f.DoesMatch(fi.Name()) {
+			continue
+		}
+		if di, ok := fi.(driveInfo); ok && di.err != nil {
+			return nil, di.err
+		}
+		res = append(res, fi)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name() < res[j].Name()
+	})
+	return res, nil
+}
+
+// fcbDrive returns the drive letter an FCB refers to.
+func (cpm *CPM) fcbDrive(f fcb.FCB) byte {
+	if f.Drive != 0 {
+		return f.Drive + 'A' - 1
+	}
+	return cpm.currentDrive + 'A'
+}
+
+// overlayDrive combines a writable drive with a read-only one beneath it.
+//
+// Files upon the upper drive hide those with the same name upon the lower
+// drive, and all new files are written to the upper drive.
+type overlayDrive struct {
+	upper Drive
+	lower Drive
+}
+
+// Open opens the file from the upper drive, if it is present there, and
+// from the lower drive otherwise.
+func (o overlayDrive) Open(name string) (DriveFile, error) {
+	f, err := o.upper.Open(name)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+	return o.lower.Open(name)
+}
+
+// Create creates the file upon the upper drive.
+func (o overlayDrive) Create(name string) (DriveFile, error) {
+	return o.upper.Create(name)
+}
+
+// ReadDir returns the files from both drives, those upon the lower drive
+// being ignored if they're hidden.
+func (o overlayDrive) ReadDir() ([]fs.FileInfo, error) {
+
+	res, err := o.upper.ReadDir()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, fi := range res {
+		seen[fi.Name()] = true
+	}
+
+	lower, err := o.lower.ReadDir()
+	if err == nil {
+		for _, fi := range lower {
+			if !seen[fi.Name()] {
+				res = append(res, fi)
+			}
+		}
+	}
+	return res, nil
+}
+
+// Delete removes the file from the upper drive.  If it is present upon
+// the lower drive that copy can't be removed, so ErrReadOnly is returned.
+func (o overlayDrive) Delete(name string) error {
+	err := o.upper.Delete(name)
+	if _, lerr := o.lower.Stat(name); lerr == nil {
+		return ErrReadOnly
+	}
+	return err
+}
+
+// Rename renames the file upon the upper drive.  Files upon the lower
+// drive can't be renamed, so ErrReadOnly is returned for those.
+func (o overlayDrive) Rename(from string, to string) error {
+	err := o.upper.Rename(from, to)
+	if errors.Is(err, fs.ErrNotExist) {
+		if _, lerr := o.lower.Stat(from); lerr == nil {
+			return ErrReadOnly
+		}
+	}
+	return err
+}
+
+// Stat returns the details of the file from the upper drive, if it is
+// present there, and from the lower drive otherwise.
+func (o overlayDrive) Stat(name string) (fs.FileInfo, error) {
+	fi, err := o.upper.Stat(name)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return fi, err
+	}
+	return o.lower.Stat(name)
+}
+
+// fsDrive is a read-only drive whose files are held in a directory of an
+// fs.FS, which is how the files embedded within our binary are accessed.
+type fsDrive struct {
+	fsys fs.FS
+	dir  string
+}
+
+// Open reads the file into memory.
+func (d fsDrive) Open(name string) (DriveFile, error) {
+	fi, err := d.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := fs.ReadFile(d.fsys, path.Join(d.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	return &memFile{name: path.Join(d.dir, name), data: data, info: fi}, nil
+}
+
+// Create fails, since the drive is read-only.
+func (d fsDrive) Create(name string) (DriveFile, error) {
+	return nil, ErrReadOnly
+}
+
+// ReadDir returns the files in our directory.
+func (d fsDrive) ReadDir() ([]fs.FileInfo, error) {
+
+	entries, err := fs.ReadDir(d.fsys, d.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []fs.FileInfo
+	for _, ent := range entries {
+		if ent.IsDir() {
+			continue
+		}
+		fi, err := ent.Info()
+		if err == nil {
+			res = append(res, fi)
+		}
+	}
+	return res, nil
+}
+
+// Delete fails, since the drive is read-only.
+func (d fsDrive) Delete(name string) error {
+	return readOnlyError(d, name)
+}
+
+// Rename fails, since the drive is read-only.
+func (d fsDrive) Rename(from string, to string) error {
+	return readOnlyError(d, from)
+}
+
+// Stat returns the details of the given file.
+func (d fsDrive) Stat(name string) (fs.FileInfo, error) {
+	fi, err := fs.Stat(d.fsys, path.Join(d.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return fi, nil
+}
+
+// readOnlyError returns the error for an attempt to modify the given file
+// upon a read-only drive; ErrReadOnly if it exists, and the reason it
+// can't be found otherwise.
+func readOnlyError(d Drive, name string) error {
+	if _, err := d.Stat(name); err != nil {
+		return err
+	}
+	return ErrReadOnly
+}
+
+// driveInfo holds the details of a file, using its CP/M name rather than
+// the name the backend uses.
+type driveInfo struct {
+	fs.FileInfo
+	name string
+
+	// err is set if the file can't be used, because its name is
+	// ambiguous, and is reported if it matches a search.
+	err error
+}
+
+// Name returns the CP/M name of the file.
+func (d driveInfo) Name() string {
+	return d.name
+}
+
+// memFile is a read-only file whose contents are held in memory.
+type memFile struct {
+	name string
+	data []byte
+	info fs.FileInfo
+}
+
+// ReadAt reads from the file at the given offset.
+func (m *memFile) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(m.data).ReadAt(p, off)
+}
+
+// WriteAt fails, since the file is read-only.
+func (m *memFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, ErrReadOnly
+}
+
+// Close does nothing, since there is no underlying resource.
+func (m *memFile) Close() error {
+	return nil
+}
+
+// Name returns the name of the file.
+func (m *memFile) Name() string {
+	return m.name
+}
+
+// Stat returns the details of the file.
+func (m *memFile) Stat() (fs.FileInfo, error) {
+	return m.info, nil
+}
+
+// Truncate fails, since the file is read-only.
+func (m *memFile) Truncate(size int64) error {
+	return fmt.Errorf("truncate %s: %w", m.name, ErrReadOnly)
+}
+
+// Sync does nothing, since the file cannot be written.
+func (m *memFile) Sync() error {
+	return nil
+}
+
+// ReadOnly returns true, since the file cannot be written.
+func (m *memFile) ReadOnly() bool {
+	return true
+}
@@ -0,0 +1,121 @@
+package cpm
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// TestOverlayDrive tests the combination of a host directory with a
+// read-only drive beneath it.
+func TestOverlayDrive(t *testing.T) {
+
+	c, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+
+	dir := t.TempDir()
+	err = os.WriteFile(filepath.Join(dir, "HOST.TXT"), []byte("host"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "BOTH.TXT"), []byte("upper"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	lower := fsDrive{fsys: fstest.MapFS{
+		"A/BOTH.TXT":  {Data: []byte("lower")},
+		"A/LOWER.TXT": {Data: []byte("lower")},
+		"B/OTHER.TXT": {Data: []byte("other")},
+	}, dir: "A"}
+
+	d := overlayDrive{upper: hostDrive{cpm: c, dir: dir}, lower: lower}
+
+	// read the contents of the given file.
+	read := func(name string) string {
+		f, err := d.Open(name)
+		if err != nil {
+			t.Fatalf("failed to open %s: %s", name, err)
+		}
+		defer f.Close()
+
+		buf := make([]byte, 16)
+		n, _ := f.ReadAt(buf, 0)
+		return string(buf[:n])
+	}
+
+	if read("HOST.TXT") != "host" || read("LOWER.TXT") != "lower" || read("BOTH.TXT") != "upper" {
+		t.Fatalf("wrong contents read")
+	}
+
+	_, err = d.Open("OTHER.TXT")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected missing file, got %v", err)
+	}
+
+	// Files upon the lower drive are read-only.
+	f, err := d.Open("LOWER.TXT")
+	if err != nil {
+		t.Fatalf("failed to open: %s", err)
+	}
+	if !f.ReadOnly() {
+		t.Fatalf("lower file isn't read-only")
+	}
+	_, err = f.WriteAt([]byte("x"), 0)
+	if !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected read-only error, got %v", err)
+	}
+
+	// The listing has each name once.
+	files, err := d.ReadDir()
+	if err != nil {
+		t.Fatalf("failed to read directory: %s", err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("expected three files, got %d", len(files))
+	}
+
+	// Deleting, or renaming, a file upon the lower drive fails.
+	if err = d.Delete("LOWER.TXT"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected read-only error, got %v", err)
+	}
+	if err = d.Rename("LOWER.TXT", "NEW.TXT"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected read-only error, got %v", err)
+	}
+
+	// Deleting a file on both removes the upper copy, but fails.
+	if err = d.Delete("BOTH.TXT"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected read-only error, got %v", err)
+	}
+	if read("BOTH.TXT") != "lower" {
+		t.Fatalf("upper file wasn't removed")
+	}
+
+	// Missing files are reported as such.
+	if err = d.Delete("MISSING.TXT"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected missing file, got %v", err)
+	}
+
+	// New files are created on the host.
+	f, err = d.Create("NEW.TXT")
+	if err != nil {
+		t.Fatalf("failed to create file: %s", err)
+	}
+	f.Close()
+	if _, err = os.Stat(filepath.Join(dir, "NEW.TXT")); err != nil {
+		t.Fatalf("file wasn't created on the host")
+	}
+
+	// And may be renamed.
+	if err = d.Rename("NEW.TXT", "RENAMED.TXT"); err != nil {
+		t.Fatalf("failed to rename: %s", err)
+	}
+	if _, err = d.Stat("RENAMED.TXT"); err != nil {
+		t.Fatalf("renamed file is missing: %s", err)
+	}
+}
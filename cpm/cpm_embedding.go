@@ -0,0 +1,111 @@
+// cpm_embedding.go contains the parts of our public API which allow Go
+// programs, and their tests, to drive the emulator without reaching into
+// its internals.
+//
+// A typical test selects the "buffer" output driver, stuffs some input,
+// runs a program, and then examines the output, memory, or registers:
+//
+//	obj, _ := cpm.New(cpm.WithOutputDriver("buffer"))
+//	obj.StuffInput("DIR\rEXIT\r")
+//	err := obj.Execute(nil)
+//	out, _ := obj.ReadOutput()
+
+package cpm
+
+import (
+	"fmt"
+
+	"github.com/skx/cpmulator/consoleout"
+)
+
+// Registers holds the values of the Z80 registers, as register pairs.
+type Registers struct {
+	AF uint16
+	BC uint16
+	DE uint16
+	HL uint16
+	IX uint16
+	IY uint16
+	SP uint16
+	PC uint16
+}
+
+// StuffInput inserts text into the read-buffer of the console
+// input-driver, so that it is read before any input the driver
+// provides.
+//
+// This is used for two purposes; to drive the "SUBMIT AUTOEXEC"
+// integration at run-time, and to allow integration tests to be
+// written.
+func (cpm *CPM) StuffInput(input string) {
+	cpm.input.StuffInput(input)
+}
+
+// StuffText is the original name of StuffInput, which is retained for
+// compatibility.
+func (cpm *CPM) StuffText(input string) {
+	cpm.StuffInput(input)
+}
+
+// ReadOutput returns the console output which has been written since it
+// was last read, and discards it.
+//
+// This requires an output driver which records what it was given, such as
+// the "buffer" driver, otherwise an error is returned.
+func (cpm *CPM) ReadOutput() (string, error) {
+
+	rec, ok := cpm.output.GetDriver().(consoleout.ConsoleRecorder)
+	if !ok {
+		return "", fmt.Errorf("output driver '%s' doesn't record output, use 'buffer'", cpm.output.GetName())
+	}
+
+	cpm.output.Flush()
+	out := rec.GetOutput()
+	rec.Reset()
+	return out, nil
+}
+
+// GetMemorySnapshot returns a copy of the whole of the 64K of RAM the
+// emulated programs run within.
+//
+// Changing the copy has no effect upon the emulator, and taking it doesn't
+// trigger any watchpoints.
+func (cpm *CPM) GetMemorySnapshot() []byte {
+	return cpm.Memory.Snapshot()
+}
+
+// GetRegisters returns the current values of the CPU registers.
+func (cpm *CPM) GetRegisters() Registers {
+	return Registers{
+		AF: cpm.CPU.AF.U16(),
+		BC: cpm.CPU.BC.U16(),
+		DE: cpm.CPU.DE.U16(),
+		HL: cpm.CPU.HL.U16(),
+		IX: cpm.CPU.IX,
+		IY: cpm.CPU.IY,
+		SP: cpm.CPU.SP,
+		PC: cpm.CPU.PC,
+	}
+}
+
+// SetRegisters updates the CPU registers.
+//
+// Note that Execute resets the registers before it runs a program, so this
+// is most useful from within syscall handlers, such as those added to
+// BDOSSyscalls.
+func (cpm *CPM) SetRegisters(regs Registers) {
+	cpm.CPU.AF.SetU16(regs.AF)
+	cpm.CPU.BC.SetU16(regs.BC)
+	cpm.CPU.DE.SetU16(regs.DE)
+	cpm.CPU.HL.SetU16(regs.HL)
+	cpm.CPU.IX = regs.IX
+	cpm.CPU.IY = regs.IY
+	cpm.CPU.SP = regs.SP
+	cpm.CPU.PC = regs.PC
+}
+
+// GetDMAAddress returns the address of the DMA area, which programs may
+// change via BDOS function 26.
+func (cpm *CPM) GetDMAAddress() uint16 {
+	return cpm.dma
+}
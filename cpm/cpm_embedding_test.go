@@ -0,0 +1,74 @@
+package cpm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestEmbedding tests the API which allows the emulator to be driven by
+// other Go programs.
+func TestEmbedding(t *testing.T) {
+
+	// LD C, 9 ; LD DE, 0x010B ; CALL 0x0005 ; RST 0 ; "Hi$"
+	prog := []byte{0x0E, 0x09, 0x11, 0x0B, 0x01, 0xCD, 0x05, 0x00, 0xC7, 0x00, 0x00, 'H', 'i', '$'}
+	path := filepath.Join(t.TempDir(), "HI.COM")
+	err := os.WriteFile(path, prog, 0644)
+	if err != nil {
+		t.Fatalf("failed to write program: %s", err)
+	}
+
+	obj, err := New(WithOutputDriver("buffer"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+
+	err = obj.LoadBinary(path)
+	if err != nil {
+		t.Fatalf("failed to load program: %s", err)
+	}
+	err = obj.Execute([]string{})
+	if err != nil && err != ErrBoot {
+		t.Fatalf("unexpected error running program: %v", err)
+	}
+
+	// Output is returned once.
+	out, err := obj.ReadOutput()
+	if err != nil || out != "Hi" {
+		t.Fatalf("unexpected output '%s' %v", out, err)
+	}
+	out, err = obj.ReadOutput()
+	if err != nil || out != "" {
+		t.Fatalf("output wasn't discarded '%s' %v", out, err)
+	}
+
+	// The program is present in memory, and the snapshot is a copy.
+	snap := obj.GetMemorySnapshot()
+	if len(snap) != 0x10000 || snap[0x10B] != 'H' {
+		t.Fatalf("unexpected memory snapshot")
+	}
+	snap[0x10B] = 'X'
+	if obj.Memory.Get(0x10B) != 'H' {
+		t.Fatalf("changing the snapshot changed memory")
+	}
+
+	if obj.GetDMAAddress() != 0x0080 {
+		t.Fatalf("unexpected DMA address %04X", obj.GetDMAAddress())
+	}
+
+	regs := Registers{AF: 0x1234, BC: 0x5678, DE: 0x9ABC, HL: 0xDEF0, IX: 1, IY: 2, SP: 3, PC: 4}
+	obj.SetRegisters(regs)
+	if obj.GetRegisters() != regs {
+		t.Fatalf("unexpected registers %v", obj.GetRegisters())
+	}
+
+	// Drivers which don't record their output can't be read.
+	obj, err = New(WithOutputDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	_, err = obj.ReadOutput()
+	if err == nil {
+		t.Fatalf("expected an error reading output of the null driver")
+	}
+}
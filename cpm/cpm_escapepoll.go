@@ -0,0 +1,68 @@
+// cpm_escapepoll.go contains the polling for the escape key of our monitor
+// while the guest runs, so that a program which is busy computing, and
+// never reads from the console, may still be interrupted.
+//
+// When the CPU runs freely we stop it every escapePollInterval to check
+// for the key, and when we're executing one instruction at a time, such as
+// for watchpoints, we check every escapePollSteps instructions.  The check
+// is made upon the emulator's goroutine, between instructions, so the
+// monitor sees the machine in a consistent state.
+//
+// Any other key which was pressed is held until the guest reads it.
+
+package cpm
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// escapePollInterval is the time the CPU runs freely between checks for
+// the escape key.
+const escapePollInterval = 50 * time.Millisecond
+
+// escapePollSteps is the number of instructions executed one at a time
+// between checks for the escape key.
+const escapePollSteps = 65536
+
+// escapeEnabled returns true if we have an escape key to poll for.
+func (cpm *CPM) escapeEnabled() bool {
+	key, handler := cpm.input.GetEscapeHandler()
+	return key != 0 && handler != nil
+}
+
+// runFreely runs the CPU until it reaches a breakpoint, HALTs, or our
+// context is canceled, checking for the escape key periodically if we
+// have one.
+func (cpm *CPM) runFreely(ctx context.Context) error {
+
+	if !cpm.escapeEnabled() {
+		return cpm.CPU.Run(ctx)
+	}
+
+	for {
+		slice, cancel := context.WithTimeout(ctx, escapePollInterval)
+		err := cpm.CPU.Run(slice)
+		cancel()
+
+		if !errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+			return err
+		}
+
+		err = cpm.input.CheckEscape()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// stepEscape is called before each instruction is executed one at a time,
+// and checks for the escape key every escapePollSteps instructions.
+func (cpm *CPM) stepEscape() error {
+
+	if cpm.pcCount%escapePollSteps != 0 || !cpm.escapeEnabled() {
+		return nil
+	}
+	return cpm.input.CheckEscape()
+}
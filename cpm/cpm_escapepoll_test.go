@@ -0,0 +1,91 @@
+package cpm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/skx/cpmulator/consolein"
+)
+
+// keyInput is a console input driver whose keys are pressed at once.
+type keyInput struct {
+	keys []byte
+}
+
+// Setup is part of the ConsoleInput interface, and does nothing.
+func (k *keyInput) Setup() {}
+
+// TearDown is part of the ConsoleInput interface, and does nothing.
+func (k *keyInput) TearDown() {}
+
+// PendingInput returns true if we have keys left.
+func (k *keyInput) PendingInput() bool { return len(k.keys) > 0 }
+
+// BlockForCharacterNoEcho returns our next key, or ErrEOF once they've
+// all been read.
+func (k *keyInput) BlockForCharacterNoEcho() (byte, error) {
+	if len(k.keys) == 0 {
+		return 0x00, consolein.ErrEOF
+	}
+	c := k.keys[0]
+	k.keys = k.keys[1:]
+	return c, nil
+}
+
+// GetName returns the name of this driver.
+func (k *keyInput) GetName() string { return "keys" }
+
+// TestEscapePoll ensures our escape key interrupts a program which never
+// reads from the console, whether the CPU runs freely, or one instruction
+// at a time.
+func TestEscapePoll(t *testing.T) {
+
+	// JP 0x0100, forever.
+	dir := t.TempDir()
+	loop := filepath.Join(dir, "LOOP.COM")
+	err := os.WriteFile(loop, []byte{0xC3, 0x00, 0x01}, 0644)
+	if err != nil {
+		t.Fatalf("failed to write program: %s", err)
+	}
+
+	for _, stepping := range []bool{false, true} {
+
+		opts := []cpmoption{WithOutputDriver("null")}
+		if stepping {
+			opts = append(opts, WithMaxInstructions(1<<40))
+		}
+		obj, err := New(opts...)
+		if err != nil {
+			t.Fatalf("failed to create CPM: %s", err)
+		}
+
+		// The escape handler terminates the program.
+		obj.input = consolein.NewFromDriver(&keyInput{keys: []byte("a\x1D")})
+		count := 0
+		obj.input.SetEscapeHandler(0x1D, func() error {
+			count++
+			return ErrHalt
+		})
+
+		err = obj.LoadBinary(loop)
+		if err != nil {
+			t.Fatalf("failed to load program: %s", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = obj.ExecuteContext(ctx, []string{})
+		cancel()
+		if err != ErrHalt || count != 1 {
+			t.Fatalf("stepping %t: expected the escape key to halt, got %v", stepping, err)
+		}
+
+		// The key pressed before the escape key is still there.
+		c, err := obj.input.BlockForCharacterNoEcho()
+		if err != nil || c != 'a' {
+			t.Fatalf("stepping %t: unexpected read %c %v", stepping, c, err)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+// cpm_events.go contains our event bus, which publishes a stream of
+// machine-readable events to clients connected to a Unix domain socket,
+// and to our web interface, so that external tools, such as
+// user-interfaces, tracers, and fuzzers, can observe a running session.
+//
+// Each event is written as a single line of JSON.  Clients may also send
+// lines of JSON to inject console input:
+//
+//	{"type":"input","text":"DIR\r"}
+//
+// Events are never allowed to slow the emulator down, so if a client
+// doesn't read them quickly enough they're discarded.
+
+package cpm
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// eventQueueSize is the number of events which may be queued for each
+// client, before further events are discarded.
+const eventQueueSize = 1024
+
+// WithEventSocket configures the path of a Unix domain socket upon which
+// events will be published, and from which console input may be injected.
+//
+// Any existing socket at the path is replaced.  The empty string disables
+// the socket, which is the default.
+func WithEventSocket(path string) cpmoption {
+	return func(c *CPM) error {
+		if path == "" {
+			return nil
+		}
+		return c.eventBus().listen(path, c)
+	}
+}
+
+// connectEvents connects our console to the event bus, if it is enabled,
+// so that input may be injected.  Output is published by observeOutput.
+//
+// This is called once all our options have been applied, as they might
+// replace our console.
+func (cpm *CPM) connectEvents() {
+
+	if cpm.events == nil {
+		return
+	}
+
+	cpm.input.EnableInjection()
+}
+
+// observeOutput is invoked with each character of our console output.  It
+// tells our console input the guest is still working, rather than waiting
+// for input, and publishes the character upon the event bus, and records
+// it in our transcript, if they're enabled.
+func (cpm *CPM) observeOutput(c byte) {
+
+	cpm.input.NoteOutput()
+
+	if cpm.events != nil {
+		cpm.publish(Event{Type: "output", Text: string([]byte{c})})
+	}
+	if cpm.transcript != nil {
+		cpm.transcript.output(c)
+	}
+}
+
+// Event is a single event published upon our event bus.
+//
+// Only the fields which are relevant to the type of the event are set.
+type Event struct {
+	// Type is "syscall", "output", or "file".
+	Type string `json:"type"`
+
+	// Time is the time at which the event occurred.
+	Time time.Time `json:"time"`
+
+	// Kind is either "BDOS" or "BIOS", for syscall events.
+	Kind string `json:"kind,omitempty"`
+
+	// Number is the number of the syscall, for syscall events.
+	Number *int `json:"number,omitempty"`
+
+	// Name is the name of the syscall, for syscall events.
+	Name string `json:"name,omitempty"`
+
+	// Registers holds the values of the registers, in hex, when a
+	// syscall is invoked.
+	Registers map[string]string `json:"registers,omitempty"`
+
+	// Text holds the characters written, for output events, or the
+	// input to inject for input requests.
+	Text string `json:"text,omitempty"`
+
+	// Action is "opened", "created", "modified", "renamed", or
+	// "deleted", for file events.
+	Action string `json:"action,omitempty"`
+
+	// Path is the path of the file, for file events.
+	Path string `json:"path,omitempty"`
+
+	// From is the previous path of a renamed file.
+	From string `json:"from,omitempty"`
+}
+
+// eventBus holds the subscribers to our events, along with the state of
+// our socket, if it is enabled.
+type eventBus struct {
+	path     string
+	listener net.Listener
+
+	// mutex protects queues and conns.
+	mutex sync.Mutex
+
+	// queues holds the queue of pending events for each subscriber.
+	queues map[chan []byte]bool
+
+	// conns holds the clients connected to our socket.
+	conns map[net.Conn]bool
+}
+
+// eventBus returns our event bus, creating it if it doesn't yet exist.
+func (cpm *CPM) eventBus() *eventBus {
+	if cpm.events == nil {
+		cpm.events = &eventBus{queues: make(map[chan []byte]bool), conns: make(map[net.Conn]bool)}
+	}
+	return cpm.events
+}
+
+// subscribe returns a queue upon which future events will be received.
+func (bus *eventBus) subscribe() chan []byte {
+	queue := make(chan []byte, eventQueueSize)
+
+	bus.mutex.Lock()
+	bus.queues[queue] = true
+	bus.mutex.Unlock()
+	return queue
+}
+
+// unsubscribe stops events being sent to the given queue, and closes it.
+func (bus *eventBus) unsubscribe(queue chan []byte) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	if bus.queues[queue] {
+		close(queue)
+		delete(bus.queues, queue)
+	}
+}
+
+// listen creates our socket at the given path, and starts accepting
+// connections to it.
+func (bus *eventBus) listen(path string, cpm *CPM) error {
+
+	// Remove any stale socket.
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to create event socket %s: %s", path, err)
+	}
+
+	bus.path = path
+	bus.listener = listener
+	go bus.accept(cpm)
+	return nil
+}
+
+// accept handles new connections to our socket.
+func (bus *eventBus) accept(cpm *CPM) {
+	for {
+		conn, err := bus.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("failed to accept event client",
+					slog.String("error", err.Error()))
+			}
+			return
+		}
+
+		queue := bus.subscribe()
+
+		bus.mutex.Lock()
+		bus.conns[conn] = true
+		bus.mutex.Unlock()
+
+		go bus.write(conn, queue)
+		go bus.read(conn, queue, cpm)
+	}
+}
+
+// write sends queued events to the given client.
+func (bus *eventBus) write(conn net.Conn, queue chan []byte) {
+	for data := range queue {
+		_, err := conn.Write(data)
+		if err != nil {
+			// Closing the connection causes read to drop the client.
+			conn.Close()
+			return
+		}
+	}
+}
+
+// read handles requests from the given client, which allow console input
+// to be injected.
+func (bus *eventBus) read(conn net.Conn, queue chan []byte, cpm *CPM) {
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+
+		var req Event
+		err := json.Unmarshal(scanner.Bytes(), &req)
+		if err != nil || req.Type != "input" {
+			slog.Debug("ignoring invalid event request",
+				slog.String("request", scanner.Text()))
+			continue
+		}
+		cpm.input.Inject(req.Text)
+	}
+
+	bus.unsubscribe(queue)
+
+	bus.mutex.Lock()
+	delete(bus.conns, conn)
+	bus.mutex.Unlock()
+	conn.Close()
+}
+
+// send queues the given event for each of our subscribers, discarding it
+// for those whose queue is full.
+func (bus *eventBus) send(data []byte) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	for queue := range bus.queues {
+		select {
+		case queue <- data:
+		default:
+		}
+	}
+}
+
+// close stops accepting connections, disconnects all subscribers, and
+// removes our socket.
+func (bus *eventBus) close() {
+
+	if bus.listener != nil {
+		bus.listener.Close()
+		os.Remove(bus.path)
+	}
+
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	for conn := range bus.conns {
+		conn.Close()
+	}
+	for queue := range bus.queues {
+		close(queue)
+		delete(bus.queues, queue)
+	}
+}
+
+// publish sends the given event to any clients of our event bus.  It does
+// nothing unless the event bus is enabled.
+func (cpm *CPM) publish(ev Event) {
+
+	if cpm.events == nil {
+		return
+	}
+
+	ev.Time = time.Now()
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	cpm.events.send(append(data, '\n'))
+}
+
+// publishSyscall publishes an event for the given syscall, which is about
+// to be invoked.
+func (cpm *CPM) publishSyscall(kind string, num uint8, name string) {
+
+	if cpm.events == nil {
+		return
+	}
+
+	number := int(num)
+	cpm.publish(Event{
+		Type:   "syscall",
+		Kind:   kind,
+		Number: &number,
+		Name:   name,
+		Registers: map[string]string{
+			"AF": fmt.Sprintf("%04X", cpm.CPU.States.AF.U16()),
+			"BC": fmt.Sprintf("%04X", cpm.CPU.States.BC.U16()),
+			"DE": fmt.Sprintf("%04X", cpm.CPU.States.DE.U16()),
+			"HL": fmt.Sprintf("%04X", cpm.CPU.States.HL.U16()),
+		},
+	})
+}
+
+// closeEvents shuts down our event bus, if it is enabled.
+func (cpm *CPM) closeEvents() {
+	if cpm.events != nil {
+		cpm.events.close()
+		cpm.events = nil
+	}
+}
@@ -0,0 +1,97 @@
+package cpm
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestEventSocket tests that events are published to clients of our
+// socket, and that they may inject input.
+func TestEventSocket(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "events.sock")
+
+	c, err := New(WithEventSocket(path), WithOutputDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect to event socket: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Wait until our client has been accepted, so it sees events.
+	for i := 0; i < 500; i++ {
+		c.events.mutex.Lock()
+		n := len(c.events.conns)
+		c.events.mutex.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	c.CPU.States.DE.SetU16(0x1234)
+	c.publishSyscall("BDOS", 0x00, "P_TERMCPM")
+	c.output.PutCharacter('X')
+
+	reader := bufio.NewReader(conn)
+	read := func() Event {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("failed to read event: %s", err)
+		}
+		var ev Event
+		err = json.Unmarshal(line, &ev)
+		if err != nil {
+			t.Fatalf("failed to decode event %q: %s", line, err)
+		}
+		return ev
+	}
+
+	ev := read()
+	if ev.Type != "syscall" || ev.Kind != "BDOS" || ev.Number == nil || *ev.Number != 0 || ev.Name != "P_TERMCPM" {
+		t.Fatalf("unexpected syscall event %v", ev)
+	}
+	if ev.Registers["DE"] != "1234" {
+		t.Fatalf("unexpected registers %v", ev.Registers)
+	}
+
+	ev = read()
+	if ev.Type != "output" || ev.Text != "X" {
+		t.Fatalf("unexpected output event %v", ev)
+	}
+
+	// Inject some input.
+	_, err = conn.Write([]byte("{\"type\":\"input\",\"text\":\"hi\"}\n"))
+	if err != nil {
+		t.Fatalf("failed to write request: %s", err)
+	}
+
+	for i := 0; i < 500 && !c.input.PendingInput(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	for _, expected := range []byte("hi") {
+		got, err := c.input.BlockForCharacterNoEcho()
+		if err != nil {
+			t.Fatalf("failed to read input: %s", err)
+		}
+		if got != expected {
+			t.Fatalf("expected %c, got %c", expected, got)
+		}
+	}
+
+	// Tearing down removes the socket.
+	c.IOTearDown()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket wasn't removed: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+// cpm_exitreason.go contains the tracking of how programs end.
+//
+// Well-behaved programs end by calling P_TERMCPM, but many end by returning
+// to the CCP, jumping to 0x0000, or calling the BIOS warm boot, which are
+// all legitimate, while others crash by HALTing, or by calling a function
+// we don't implement.  Without help users can't tell these apart, so we
+// note how each program ended, log it, and optionally show a one-line
+// summary upon the console when it wasn't via P_TERMCPM.
+//
+// Programs are noted as starting when execution reaches 0x0100, which in
+// CCP-mode we trap via a breakpoint.
+
+package cpm
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+// exitTerm is the reason recorded for programs which called P_TERMCPM, and
+// exitRet for those which returned from their entry-point to 0x0000.
+const (
+	exitTerm = "P_TERMCPM"
+	exitRet  = "RET to 0000H"
+)
+
+// WithExitReport configures whether a one-line summary is shown upon the
+// console when a program ends without calling P_TERMCPM, for example by
+// returning to the CCP, or HALTing.
+//
+// The way programs end is always logged, the summary is disabled by
+// default.
+func WithExitReport(enabled bool) cpmoption {
+	return func(c *CPM) error {
+		c.exit.report = enabled
+		return nil
+	}
+}
+
+// exitState holds the details of the program which is running, so that
+// we can report how it ended.
+type exitState struct {
+
+	// report is true if we show a summary upon the console.
+	report bool
+
+	// running is true if a program is running, and name is its name.
+	running bool
+	name    string
+
+	// entrySP is the stack pointer when the program started, which lets
+	// us spot a program returning to 0x0000.
+	entrySP uint16
+
+	// warmBoot is true if the program called the BIOS to boot.
+	warmBoot bool
+
+	// command is the most recent command-line the CCP read, or the name
+	// of the binary we loaded, which names the next program.
+	command string
+}
+
+// programStarted notes that a program has started running, at 0x0100.
+func (cpm *CPM) programStarted() {
+
+	name := cpm.exit.command
+	if name == "" {
+		name = "The program"
+	}
+
+	// Each program starts with a successful return code.
+	cpm.returnCode = 0
+
+	cpm.exit.running = true
+	cpm.exit.name = name
+	cpm.exit.entrySP = cpm.CPU.States.SP
+	cpm.exit.warmBoot = false
+	cpm.exit.command = ""
+}
+
+// programCommand records the command-line the CCP read, so that the next
+// program which is started can be named.
+func (cpm *CPM) programCommand(text string) {
+
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		cpm.exit.command = ""
+		return
+	}
+	cpm.exit.command = strings.ToUpper(fields[0])
+}
+
+// programBinary records the name of a binary which has been loaded, to be
+// launched directly.
+func (cpm *CPM) programBinary(filename string) {
+	cpm.exit.command = strings.ToUpper(filepath.Base(filename))
+}
+
+// bootReason describes how a program reached 0x0000.
+func (cpm *CPM) bootReason() string {
+
+	switch {
+	case cpm.exit.warmBoot:
+		return "BIOS warm boot"
+	case cpm.CPU.States.SP == cpm.exit.entrySP+2:
+		return exitRet
+	default:
+		return "jump to 0000H"
+	}
+}
+
+// programEnded notes that the running program, if any, has ended for the
+// given reason, logging it, and showing our summary if the reason was
+// unexpected.
+func (cpm *CPM) programEnded(reason string, expected bool) {
+
+	if !cpm.exit.running {
+		return
+	}
+	cpm.exit.running = false
+
+	slog.Info("program exited",
+		slog.String("name", cpm.exit.name),
+		slog.String("reason", reason))
+
+	if expected || !cpm.exit.report || cpm.output == nil {
+		return
+	}
+
+	cpm.output.Notify(fmt.Sprintf("\r\n*** %s exited without calling P_TERMCPM: %s.\r\n", cpm.exit.name, reason))
+}
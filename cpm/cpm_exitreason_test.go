@@ -0,0 +1,109 @@
+package cpm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/skx/cpmulator/consoleout"
+)
+
+// TestExitReason ensures that we report how programs ended, unless they
+// called P_TERMCPM.
+func TestExitReason(t *testing.T) {
+
+	type TestCase struct {
+		name    string
+		program []byte
+		err     error
+		output  string
+	}
+
+	tests := []TestCase{
+		{"EXIT.COM", []byte{0x0E, 0x00, 0xCD, 0x05, 0x00}, nil, ""},
+		{"RET.COM", []byte{0xC9}, nil, "\r\n*** RET.COM exited without calling P_TERMCPM: RET to 0000H.\r\n"},
+		{"JUMP.COM", []byte{0xC3, 0x00, 0x00}, ErrBoot, "\r\n*** JUMP.COM exited without calling P_TERMCPM: jump to 0000H.\r\n"},
+		{"HALT.COM", []byte{0x00, 0x76}, ErrHalt, "\r\n*** HALT.COM exited without calling P_TERMCPM: HALT at 0101H.\r\n"},
+		{"BOGUS.COM", []byte{0x0E, 0xFE, 0xCD, 0x05, 0x00}, ErrUnimplemented, "\r\n*** BOGUS.COM exited without calling P_TERMCPM: unimplemented BDOS function 254.\r\n"},
+	}
+
+	obj, err := New(WithOutputDriver("logger"), WithExitReport(true))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	defer obj.IOTearDown()
+
+	l, ok := obj.GetOutputDriver().(*consoleout.OutputLoggingDriver)
+	if !ok {
+		t.Fatalf("failed to cast output driver")
+	}
+
+	dir := t.TempDir()
+	for _, test := range tests {
+
+		path := filepath.Join(dir, test.name)
+		err = os.WriteFile(path, test.program, 0644)
+		if err != nil {
+			t.Fatalf("failed to write program: %s", err)
+		}
+
+		err = obj.LoadBinary(path)
+		if err != nil {
+			t.Fatalf("failed to load program: %s", err)
+		}
+
+		l.Reset()
+		err = obj.Execute([]string{})
+		if !errors.Is(err, test.err) {
+			t.Fatalf("%s: unexpected error %v, expected %v", test.name, err, test.err)
+		}
+		if l.GetOutput() != test.output {
+			t.Fatalf("%s: unexpected output %q", test.name, l.GetOutput())
+		}
+		if obj.exit.running {
+			t.Fatalf("%s: program is still running", test.name)
+		}
+	}
+
+	// Without the report nothing is shown.
+	obj.exit.report = false
+	err = obj.LoadBinary(filepath.Join(dir, "RET.COM"))
+	if err != nil {
+		t.Fatalf("failed to load program: %s", err)
+	}
+	l.Reset()
+	err = obj.Execute([]string{})
+	if err != nil || l.GetOutput() != "" {
+		t.Fatalf("unexpected result %v %q", err, l.GetOutput())
+	}
+}
+
+// TestExitReasonNames ensures that programs launched by the CCP are named
+// after the command which launched them.
+func TestExitReasonNames(t *testing.T) {
+
+	obj, err := New(WithOutputDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	defer obj.IOTearDown()
+
+	obj.programCommand("  b:dump foo.com")
+	obj.programStarted()
+	if obj.exit.name != "B:DUMP" || !obj.exit.running {
+		t.Fatalf("unexpected state %v", obj.exit)
+	}
+
+	// Programs started via SUBMIT have no command.
+	obj.programEnded(exitTerm, true)
+	obj.programStarted()
+	if obj.exit.name != "The program" {
+		t.Fatalf("unexpected name %s", obj.exit.name)
+	}
+
+	obj.exit.warmBoot = true
+	if obj.bootReason() != "BIOS warm boot" {
+		t.Fatalf("unexpected reason %s", obj.bootReason())
+	}
+}
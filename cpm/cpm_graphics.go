@@ -0,0 +1,90 @@
+// cpm_graphics.go contains our support for GSX, the graphics extension
+// which Digital Research shipped for CP/M, and which programs reach via
+// BDOS function 115.
+//
+// By default GSX isn't loaded, and we answer requests in the way that a
+// BDOS without it does, so that programs which probe for it fall back to
+// text.  If a canvas is configured we implement the basic drawing
+// primitives, see the gsx package, and save the results as a PNG image.
+
+package cpm
+
+import (
+	"github.com/skx/cpmulator/gsx"
+)
+
+// WithGSX enables our GSX emulation, which draws upon a canvas that is
+// saved to the given PNG file whenever a program updates, or closes, its
+// workstation.
+//
+// The path may be followed by "@", and a size, for example
+// "graphics.png@800x600".  The empty string leaves GSX disabled, which is
+// the default.
+func WithGSX(spec string) cpmoption {
+	return func(c *CPM) error {
+		if spec == "" {
+			return nil
+		}
+
+		canvas, err := gsx.New(spec)
+		if err != nil {
+			return err
+		}
+		c.gsx = canvas
+		return nil
+	}
+}
+
+// gsxCall carries out the GSX request described by the parameter block at
+// the given address, which holds the addresses of five arrays of words:
+//
+//	CONTRL  The opcode, and the sizes of the other arrays.
+//	INTIN   Integer inputs.
+//	PTSIN   Point inputs, as x,y pairs.
+//	INTOUT  Integer outputs.
+//	PTSOUT  Point outputs, as x,y pairs.
+func (cpm *CPM) gsxCall(pb uint16) error {
+
+	contrl := cpm.Memory.GetU16(pb)
+	intinAddr := cpm.Memory.GetU16(pb + 2)
+	ptsinAddr := cpm.Memory.GetU16(pb + 4)
+	intoutAddr := cpm.Memory.GetU16(pb + 6)
+	ptsoutAddr := cpm.Memory.GetU16(pb + 8)
+
+	// word returns the signed word at the given index of an array.
+	word := func(addr uint16, index int) int {
+		return int(int16(cpm.Memory.GetU16(addr + uint16(2*index))))
+	}
+
+	// read returns the given number of words from an array.
+	read := func(addr uint16, count int) []int {
+		out := make([]int, max(count, 0))
+		for i := range out {
+			out[i] = word(addr, i)
+		}
+		return out
+	}
+
+	// set stores a word at the given index of an array.
+	set := func(addr uint16, index int, value int) {
+		addr += uint16(2 * index)
+		cpm.Memory.Set(addr, uint8(value&0xFF))
+		cpm.Memory.Set(addr+1, uint8((value>>8)&0xFF))
+	}
+
+	opcode := word(contrl, 0)
+	ptsin := read(ptsinAddr, 2*word(contrl, 1))
+	intin := read(intinAddr, word(contrl, 3))
+
+	intout, ptsout, err := cpm.gsx.Call(opcode, word(contrl, 5), intin, ptsin)
+
+	for i, v := range intout {
+		set(intoutAddr, i, v)
+	}
+	for i, v := range ptsout {
+		set(ptsoutAddr, i, v)
+	}
+	set(contrl, 2, len(ptsout)/2)
+	set(contrl, 4, len(intout))
+	return err
+}
@@ -0,0 +1,121 @@
+// cpm_helptext.go contains the help text which describes our extensions from
+// inside the guest, shown by A:!HELP.COM.
+//
+// The text lists the custom BIOS functions we've added, the console drivers
+// which are available, the drives which are mapped to host directories,
+// and our current settings, so that users don't need to leave the emulator
+// to find out what they can change.
+//
+// The guest reads the text a line at a time, via a custom BIOS function,
+// as the DMA area is too small to hold it all at once.
+
+package cpm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/skx/cpmulator/consolein"
+	"github.com/skx/cpmulator/version"
+)
+
+// biosExtension describes one of our custom BIOS functions.
+type biosExtension struct {
+	fn   uint16
+	desc string
+}
+
+// biosExtensions lists our custom BIOS functions, along with the utility
+// upon A: which uses them, where there is one.
+//
+// This must be updated when functions are added to BiosSysCallReserved1.
+var biosExtensions = []biosExtension{
+	{0x0000, "Is this cpmulator?  (!VERSION)"},
+	{0x0001, "Get/Set the Ctrl-C count  (!CTRLC)"},
+	{0x0002, "Get/Set the output driver  (!OUTPUT)"},
+	{0x0003, "Get/Set the CCP  (!CCP)"},
+	{0x0004, "Retired, formerly the quiet flag"},
+	{0x0005, "Get the terminal size"},
+	{0x0006, "Get/Set the debug flag  (!DEBUG)"},
+	{0x0007, "Get/Set the input driver  (!INPUT)"},
+	{0x0008, "Set the host command prefix  (!HOSTCMD)"},
+	{0x0009, "Poll for a terminal resize"},
+	{0x000A, "Get/Set the path of a drive  (!MOUNT)"},
+	{0x000B, "Restore the path of a drive  (!UMOUNT)"},
+	{0x000C, "Paste a host file into the console  (!PASTE)"},
+	{0x000D, "Get the cursor position"},
+	{0x000E, "Get the drive mappings  (!DRIVES)"},
+	{0x000F, "Get the checksum of a file"},
+	{0x0010, "Copy a file to the clipboard  (!COPY)"},
+	{0x0011, "Paste the clipboard  (!PASTECB)"},
+	{0x0012, "Get a line of this help  (!HELP)"},
+}
+
+// helpText returns the lines of our help text, without line-endings.
+func (cpm *CPM) helpText() []string {
+
+	lines := strings.Split(strings.TrimSpace(version.GetVersionBanner()), "\n")
+	lines = append(lines, "")
+
+	lines = append(lines, "Custom BIOS functions, HL=function, A=31, OUT (0FFH),A:")
+	for _, ext := range biosExtensions {
+		lines = append(lines, fmt.Sprintf("  %04XH  %s", ext.fn, ext.desc))
+	}
+	lines = append(lines, "")
+
+	inputs := cpm.input.GetDrivers()
+	sort.Strings(inputs)
+	outputs := cpm.output.GetDrivers()
+	sort.Strings(outputs)
+
+	lines = append(lines, "Input drivers:")
+	lines = append(lines, "  "+strings.Join(inputs, " "))
+	lines = append(lines, "Output drivers:")
+	lines = append(lines, "  "+strings.Join(outputs, " "))
+	lines = append(lines, "")
+
+	lines = append(lines, "Drives:")
+	paths := cpm.GetDrivePaths()
+	for i := 0; i < 16; i++ {
+		drive := string(rune('A' + i))
+		path := paths[drive]
+		if path == "" {
+			continue
+		}
+		suffix := ""
+		if _, ok := cpm.mounts[drive]; ok {
+			suffix = "  (mounted)"
+		}
+		lines = append(lines, fmt.Sprintf("  %s: %s%s", drive, path, suffix))
+	}
+	lines = append(lines, "")
+
+	cpu := "z80"
+	if cpm.cpu8080 {
+		cpu = "8080"
+	}
+	ctrlc := fmt.Sprintf("%d", cpm.input.GetInterruptCount())
+	if cpm.input.GetInterruptCount() == consolein.InterruptPassThrough {
+		ctrlc = "passed to programs"
+	}
+
+	lines = append(lines, "Settings:")
+	lines = append(lines, fmt.Sprintf("  CCP:          %s", cpm.ccp))
+	lines = append(lines, fmt.Sprintf("  CPU:          %s", cpu))
+	lines = append(lines, fmt.Sprintf("  Ctrl-C count: %s", ctrlc))
+	lines = append(lines, fmt.Sprintf("  Debug:        %s", onOff(cpm.simpleDebug)))
+	lines = append(lines, fmt.Sprintf("  Input:        %s", cpm.input.GetName()))
+	lines = append(lines, fmt.Sprintf("  Output:       %s", cpm.output.GetName()))
+	lines = append(lines, fmt.Sprintf("  RSX mode:     %s", onOff(cpm.rsx)))
+
+	return lines
+}
+
+// onOff describes the given flag.
+func onOff(flag bool) string {
+	if flag {
+		return "on"
+	}
+	return "off"
+}
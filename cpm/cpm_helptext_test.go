@@ -0,0 +1,57 @@
+package cpm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/skx/cpmulator/memory"
+)
+
+// TestHelp ensures that our help text may be read, a line at a time, via
+// our custom BIOS function.
+func TestHelp(t *testing.T) {
+
+	c, err := New(WithOutputDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	defer c.IOTearDown()
+
+	c.Memory = new(memory.Memory)
+	c.SetDrives(false)
+	c.SetDrivePath("C", "/tmp/help")
+
+	// Every function is described.
+	if biosExtensions[len(biosExtensions)-1].fn != 0x0012 {
+		t.Fatalf("the newest BIOS function isn't described")
+	}
+
+	var text []string
+	for line := uint16(0); ; line++ {
+		c.CPU.States.HL.SetU16(0x0012)
+		c.CPU.States.DE.SetU16(line)
+		err = BiosSysCallReserved1(c)
+		if err != nil {
+			t.Fatalf("failed to call BIOS: %s", err)
+		}
+		if c.CPU.States.AF.Hi == 0xFF {
+			break
+		}
+		if line > 200 {
+			t.Fatalf("the help text doesn't end")
+		}
+
+		str := ""
+		for addr := c.dma; c.Memory.Get(addr) != 0x00; addr++ {
+			str += string(rune(c.Memory.Get(addr)))
+		}
+		text = append(text, str)
+	}
+
+	all := strings.Join(text, "\n")
+	for _, expected := range []string{"0012H", "!PASTECB", "C: /tmp/help", "Output:       null", "adm-3a", "CPU:          z80"} {
+		if !strings.Contains(all, expected) {
+			t.Fatalf("help text doesn't contain %q\n%s", expected, all)
+		}
+	}
+}
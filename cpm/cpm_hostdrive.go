@@ -0,0 +1,271 @@
+// cpm_hostdrive.go contains the implementation of the Drive interface which
+// stores files in a directory upon the host.
+
+package cpm
+
+import (
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/skx/cpmulator/fcb"
+)
+
+// hostDrive is a drive whose files are held in a directory upon the host.
+//
+// CP/M names are mapped to the names of host files according to our case
+// policy, and long filenames are handled if that is enabled.
+type hostDrive struct {
+	cpm *CPM
+	dir string
+}
+
+// Open opens the file for reading and writing.
+//
+// CP/M has no notion of opening a file for reading, or writing, so we try
+// to open for both.  If that fails, perhaps because the file is read-only
+// on the host, we fallback to opening it for reading, and writes will fail
+// later.
+func (h hostDrive) Open(name string) (DriveFile, error) {
+
+	path, err := h.cpm.resolveName(h.dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err == nil {
+		return &hostFile{File: file, cpm: h.cpm}, nil
+	}
+	if os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, er := os.OpenFile(path, os.O_RDONLY, 0644)
+	if er != nil {
+		return nil, err
+	}
+
+	slog.Debug("opened read-only",
+		slog.String("path", path),
+		slog.String("error", err.Error()))
+
+	return &hostFile{File: file, cpm: h.cpm, readOnly: true}, nil
+}
+
+// Create creates the file, or opens the existing one, for reading and
+// writing.
+func (h hostDrive) Create(name string) (DriveFile, error) {
+
+	path, err := h.cpm.resolveName(h.dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	_, existed := os.Stat(path)
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	h.cpm.noteHostWrite(path)
+	if existed != nil {
+		h.cpm.recordChange("created", path, "")
+	}
+	return &hostFile{File: file, cpm: h.cpm}, nil
+}
+
+// ReadDir returns the files in our directory.
+//
+// Where several host files have the same CP/M name only one is returned,
+// chosen according to our policy, unless our policy is to treat that as
+// an error, in which case the error is reported if the name is used.
+func (h hostDrive) ReadDir() ([]fs.FileInfo, error) {
+
+	files, err := h.cpm.hostFiles(fcb.FromString("*.*"), h.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Group the host names by the name the guest sees.
+	names := make(map[string][]string)
+	for _, ent := range files {
+		names[ent.Name] = append(names[ent.Name], filepath.Base(ent.Host))
+	}
+
+	var res []fs.FileInfo
+	for name, matches := range names {
+
+		found, err := h.cpm.chooseName(name, matches)
+		if err != nil {
+			found = matches[0]
+		}
+
+		fi, er := os.Stat(filepath.Join(h.dir, found))
+		if er != nil {
+			continue
+		}
+		res = append(res, driveInfo{FileInfo: fi, name: name, err: err})
+	}
+
+	// Keep the results in a predictable order.
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name() < res[j].Name()
+	})
+	return res, nil
+}
+
+// Delete removes the file.
+func (h hostDrive) Delete(name string) error {
+
+	path, err := h.cpm.resolveName(h.dir, name)
+	if err != nil {
+		return err
+	}
+	h.cpm.noteHostWrite(path)
+	err = os.Remove(path)
+	if err != nil {
+		return err
+	}
+
+	h.cpm.recordChange("deleted", path, "")
+	return nil
+}
+
+// Rename renames the file.
+//
+// If there's an existing file with the new name, differing only in case,
+// then we'll replace it rather than creating a second file which the guest
+// couldn't distinguish.
+func (h hostDrive) Rename(from string, to string) error {
+
+	src, err := h.cpm.resolveName(h.dir, from)
+	if err != nil {
+		return err
+	}
+
+	dst, err := h.cpm.resolveName(h.dir, to)
+	if err != nil {
+		return err
+	}
+
+	// Unless that file is the source, in which case we're changing
+	// the case of the name.
+	if dst == src {
+		dst = filepath.Join(h.dir, h.cpm.hostName(to))
+	}
+
+	slog.Debug("Renaming file",
+		slog.String("src", src),
+		slog.String("dst", dst))
+
+	h.cpm.noteHostWrite(src)
+	h.cpm.noteHostWrite(dst)
+	err = os.Rename(src, dst)
+	if err != nil {
+		return err
+	}
+
+	h.cpm.recordChange("renamed", dst, src)
+	return nil
+}
+
+// Stat returns the details of the file.
+func (h hostDrive) Stat(name string) (fs.FileInfo, error) {
+
+	path, err := h.cpm.resolveName(h.dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+	}
+	return driveInfo{FileInfo: fi, name: name}, nil
+}
+
+// hostFile is a file upon the host which has been opened.
+type hostFile struct {
+	*os.File
+
+	// cpm is the emulator which opened the file, if any, which is told
+	// about writes.
+	cpm *CPM
+
+	// readOnly is true if the file could only be opened for reading,
+	// in which case writes will fail.
+	readOnly bool
+}
+
+// ReadOnly returns true if the file cannot be written.
+func (h *hostFile) ReadOnly() bool {
+	return h.readOnly
+}
+
+// Sync commits the contents of the file to the host's storage.  Files
+// which were opened read-only have nothing to commit, and some systems
+// refuse to sync them, so they're skipped.
+func (h *hostFile) Sync() error {
+	if h.readOnly {
+		return nil
+	}
+	return h.File.Sync()
+}
+
+// WriteAt writes to the file, noting the change.
+func (h *hostFile) WriteAt(p []byte, off int64) (int, error) {
+	h.cpm.noteHostWrite(h.Name())
+	return h.File.WriteAt(p, off)
+}
+
+// Truncate changes the size of the file, noting the change.
+func (h *hostFile) Truncate(size int64) error {
+	h.cpm.noteHostWrite(h.Name())
+	return h.File.Truncate(size)
+}
+
+// noteHostWrite records that the guest is about to change the given host
+// file, so that GuestChanged can recognize the change.
+func (cpm *CPM) noteHostWrite(path string) {
+
+	if cpm == nil {
+		return
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	cpm.hostWritesMutex.Lock()
+	defer cpm.hostWritesMutex.Unlock()
+
+	if cpm.hostWrites == nil {
+		cpm.hostWrites = make(map[string]time.Time)
+	}
+	cpm.hostWrites[path] = time.Now()
+}
+
+// GuestChanged returns true if the guest changed the given host file within
+// the given duration.
+//
+// This allows our watch-mode to ignore the files a program writes itself,
+// such as the output of a compiler, rather than restarting it.
+func (cpm *CPM) GuestChanged(path string, within time.Duration) bool {
+
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	cpm.hostWritesMutex.Lock()
+	defer cpm.hostWritesMutex.Unlock()
+
+	when, ok := cpm.hostWrites[path]
+	return ok && time.Since(when) < within
+}
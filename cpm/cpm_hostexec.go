@@ -0,0 +1,33 @@
+// cpm_hostexec.go contains the glue which routes the output of commands
+// executed on the host through our console output driver.
+
+package cpm
+
+import (
+	"github.com/skx/cpmulator/consolein"
+)
+
+// consoleWriter is an io.Writer which writes to our console output driver,
+// such that the output of host commands is treated in the same way as
+// the output of the guest.
+type consoleWriter struct {
+	cpm *CPM
+}
+
+// Write implements io.Writer, adding the carriage-returns which CP/M
+// expects before each newline.
+func (cw *consoleWriter) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if c == '\n' {
+			cw.cpm.output.PutCharacter('\r')
+		}
+		cw.cpm.output.PutCharacter(c)
+	}
+	return len(p), nil
+}
+
+// hostExec runs the given command on the host, writing the output via our
+// console output driver.
+func (cpm *CPM) hostExec(command string) {
+	consolein.RunSystemCommand(command, &consoleWriter{cpm: cpm})
+}
@@ -0,0 +1,78 @@
+// cpm_idlepoll.go contains the detection of programs which wait for input by
+// polling the console status in a tight loop, which would otherwise keep a
+// core of the host busy.
+//
+// Each time the console status is polled, via the BDOS or the BIOS, and no
+// input is pending, we count the poll.  Once idleThreshold polls have been
+// made in quick succession we start to sleep before returning, doubling the
+// time we sleep on each poll, up to the limit given to WithIdleSleep.
+//
+// As soon as input is pending, or the program spends longer than idleGap
+// between polls, which means it is doing some real work, we stop sleeping.
+// This is done centrally so it benefits every input driver.
+
+package cpm
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultIdleSleep is the longest time we sleep when a program polls the
+// console status in a tight loop, unless another is configured.
+const DefaultIdleSleep = 10 * time.Millisecond
+
+// idleThreshold is the number of consecutive polls, which found no input,
+// before we start to sleep.
+const idleThreshold = 64
+
+// idleGap is the longest time between polls which we consider consecutive.
+const idleGap = 5 * time.Millisecond
+
+// idleMinDelay is the time we sleep upon the first poll past our threshold.
+const idleMinDelay = 250 * time.Microsecond
+
+// WithIdleSleep configures the longest time we sleep when a program polls
+// the console status in a tight loop, as described at the top of this file.
+//
+// Zero disables sleeping.
+func WithIdleSleep(max time.Duration) cpmoption {
+	return func(c *CPM) error {
+		if max < 0 {
+			return fmt.Errorf("invalid idle sleep %s", max)
+		}
+		c.idleSleep = max
+		return nil
+	}
+}
+
+// idlePoll is called whenever the console status is polled, with the
+// result, and sleeps if the program appears to be waiting in a loop.
+func (cpm *CPM) idlePoll(pending bool) {
+
+	if cpm.idleSleep == 0 {
+		return
+	}
+
+	now := time.Now()
+	if pending || now.Sub(cpm.idleLast) > idleGap {
+		cpm.idlePolls = 0
+		cpm.idleDelay = 0
+	}
+
+	cpm.idlePolls++
+	if !pending && cpm.idlePolls > idleThreshold {
+		if cpm.idleDelay == 0 {
+			cpm.idleDelay = idleMinDelay
+		} else {
+			cpm.idleDelay *= 2
+		}
+		cpm.idleDelay = min(cpm.idleDelay, cpm.idleSleep)
+
+		time.Sleep(cpm.idleDelay)
+
+		// The time we slept doesn't count towards the gap.
+		now = time.Now()
+	}
+	cpm.idleLast = now
+}
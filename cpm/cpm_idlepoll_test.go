@@ -0,0 +1,75 @@
+package cpm
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/skx/cpmulator/consolein"
+)
+
+// TestIdlePoll ensures that we sleep when the console status is polled in
+// a tight loop, and stop once input is pending.
+func TestIdlePoll(t *testing.T) {
+
+	_, err := New(WithIdleSleep(-1))
+	if err == nil {
+		t.Fatalf("expected an error with a negative sleep")
+	}
+
+	// Input which never arrives.
+	r, w := io.Pipe()
+	defer w.Close()
+
+	obj, err := New(WithOutputDriver("null"), WithIdleSleep(2*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	obj.input = consolein.NewFromReader(r)
+
+	// Our first polls don't sleep, but the rest do, up to our limit.
+	for i := 0; i < idleThreshold; i++ {
+		err = BdosSysCallConsoleStatus(obj)
+		if err != nil || obj.CPU.States.AF.Hi != 0x00 {
+			t.Fatalf("unexpected status %02X %v", obj.CPU.States.AF.Hi, err)
+		}
+	}
+	if obj.idleDelay != 0 {
+		t.Fatalf("slept too soon")
+	}
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		err = BiosSysCallConsoleStatus(obj)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	if obj.idleDelay != 2*time.Millisecond {
+		t.Fatalf("unexpected delay %s", obj.idleDelay)
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Fatalf("we didn't sleep, %s", time.Since(start))
+	}
+
+	// Pending input stops us sleeping.
+	obj.StuffInput("x")
+	err = BdosSysCallConsoleStatus(obj)
+	if err != nil || obj.CPU.States.AF.Hi != 0xFF {
+		t.Fatalf("unexpected status %02X %v", obj.CPU.States.AF.Hi, err)
+	}
+	if obj.idleDelay != 0 || obj.idlePolls != 1 {
+		t.Fatalf("unexpected state after input %s %d", obj.idleDelay, obj.idlePolls)
+	}
+	obj.StuffInput("")
+
+	// As does disabling the sleep.
+	obj.idleSleep = 0
+	start = time.Now()
+	for i := 0; i < idleThreshold*4; i++ {
+		_ = BdosSysCallConsoleStatus(obj)
+	}
+	if time.Since(start) > 5*time.Millisecond {
+		t.Fatalf("we slept, when disabled, for %s", time.Since(start))
+	}
+}
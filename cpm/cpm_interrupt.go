@@ -0,0 +1,57 @@
+// cpm_interrupt.go contains the options which control how Ctrl-C, and
+// our kill key, are handled.
+//
+// By default two consecutive Ctrl-C keystrokes, at the start of a line of
+// input, reboot the CCP.  Programs which use Ctrl-C as input, such as
+// editors, may prefer it to be passed through to them, while users who
+// want to abandon a session entirely may configure a kill key which
+// terminates the emulator whenever it is read.
+
+package cpm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/skx/cpmulator/consolein"
+)
+
+// WithInterruptPolicy configures how Ctrl-C is handled when a line of
+// input is being read.
+//
+// The policy may be a number from 0-9, which is the count of consecutive
+// Ctrl-C keystrokes which trigger a reboot, with zero meaning Ctrl-C is
+// ignored, or "pass" to deliver Ctrl-C to the guest as input.  The empty
+// string leaves the default, which is two, unchanged.
+func WithInterruptPolicy(policy string) cpmoption {
+	return func(c *CPM) error {
+
+		switch strings.ToLower(policy) {
+		case "":
+			return nil
+		case "pass":
+			c.input.SetInterruptCount(consolein.InterruptPassThrough)
+			return nil
+		}
+
+		n, err := strconv.Atoi(policy)
+		if err != nil || n < 0 || n > 9 {
+			return fmt.Errorf("invalid interrupt policy '%s', expected a count from 0-9, or 'pass'", policy)
+		}
+		c.input.SetInterruptCount(n)
+		return nil
+	}
+}
+
+// WithKillKey configures a key which terminates the emulator whenever it
+// is read from the console, regardless of what the guest is doing with
+// its input.
+//
+// The default is zero, which disables the kill key.
+func WithKillKey(key byte) cpmoption {
+	return func(c *CPM) error {
+		c.killKey = key
+		return nil
+	}
+}
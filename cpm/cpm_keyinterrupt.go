@@ -0,0 +1,143 @@
+// cpm_keyinterrupt.go contains our interrupt-driven keyboard, which some
+// programs, written for machines with an interrupting serial port, expect.
+//
+// Normally programs poll for input, via the BDOS or BIOS, and interrupts
+// are never raised.  When the keyboard interrupt is enabled, and the
+// program has enabled interrupts via "EI", an interrupt is raised whenever
+// console input is pending.  The specification selects the interrupt:
+//
+//   - "im0[:OPCODE]" supplies the instruction executed in interrupt mode 0,
+//     which defaults to 0xFF, "RST 38H".
+//   - "im1" is for interrupt mode 1, which always calls 0x0038.
+//   - "im2:VECTOR" supplies the low byte of the vector table address used
+//     in interrupt mode 2, the high byte being taken from the I register.
+//
+// The interrupt is level-triggered, as with real hardware, so the handler
+// must read the pending character, via the BDOS or BIOS, before it enables
+// interrupts again or it will be interrupted once more.
+//
+// A program which executes "HALT", with interrupts enabled, waits for the
+// next key to be pressed, rather than terminating.
+//
+// The program is executed one instruction at a time, as with watchpoints,
+// and input is polled every kbdPollInterval instructions.
+
+package cpm
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/koron-go/z80"
+)
+
+// kbdPollInterval is the number of instructions executed between checks
+// for pending input, when interrupts are enabled.
+const kbdPollInterval = 1024
+
+// kbdWait is the time we wait between checks for pending input, while a
+// program is HALTed waiting for an interrupt.
+const kbdWait = time.Millisecond
+
+// WithKeyboardInterrupt enables the raising of interrupts when console
+// input is pending, as described at the top of this file.
+//
+// The empty string disables them, which is the default.
+func WithKeyboardInterrupt(spec string) cpmoption {
+	return func(c *CPM) error {
+		interrupt, err := parseKeyboardInterrupt(spec)
+		if err != nil {
+			return err
+		}
+		c.kbdInterrupt = interrupt
+		return nil
+	}
+}
+
+// parseKeyboardInterrupt parses the specification of our keyboard
+// interrupt, returning nil if it is disabled.
+func parseKeyboardInterrupt(spec string) (*z80.Interrupt, error) {
+
+	if spec == "" {
+		return nil, nil
+	}
+
+	mode, arg, found := strings.Cut(strings.ToLower(spec), ":")
+
+	var val uint8
+	if found {
+		n, err := strconv.ParseUint(arg, 0, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keyboard interrupt '%s': %s", spec, err)
+		}
+		val = uint8(n)
+	}
+
+	switch {
+	case mode == "im0" && !found:
+		return z80.IM0Interrupt(0xFF), nil
+	case mode == "im0":
+		return z80.IM0Interrupt(val), nil
+	case mode == "im1" && !found:
+		return z80.IM1Interrupt(), nil
+	case mode == "im2" && found:
+		return z80.IM2Interrupt(val), nil
+	}
+	return nil, fmt.Errorf("invalid keyboard interrupt '%s', expected im0[:OPCODE], im1, or im2:VECTOR", spec)
+}
+
+// raiseKeyboardInterrupt raises our keyboard interrupt, if it is enabled,
+// the program has enabled interrupts, and input is pending.
+func (cpm *CPM) raiseKeyboardInterrupt() {
+
+	if cpm.kbdInterrupt == nil || !cpm.CPU.IFF1 || cpm.CPU.Interrupt != nil {
+		return
+	}
+
+	cpm.kbdPoll++
+	if cpm.kbdPoll%kbdPollInterval != 0 {
+		return
+	}
+
+	if cpm.input.PendingInput() {
+		cpm.CPU.Interrupt = cpm.keyboardInterrupt()
+	}
+}
+
+// awaitKeyboardInterrupt is called when the program executes HALT, and if
+// it is waiting for our keyboard interrupt waits for input, raising the
+// interrupt when there is some.
+//
+// It returns false if the program wasn't waiting, and should terminate.
+func (cpm *CPM) awaitKeyboardInterrupt(ctx context.Context) bool {
+
+	// The HALTs in page zero are how we trap warm boots.
+	if cpm.kbdInterrupt == nil || !cpm.CPU.IFF1 || cpm.CPU.PC < 0x0100 {
+		return false
+	}
+
+	for !cpm.input.PendingInput() {
+		if ctx.Err() != nil {
+			return false
+		}
+		time.Sleep(kbdWait)
+	}
+
+	// The interrupt returns to the instruction after the HALT.
+	cpm.CPU.PC++
+	cpm.CPU.HALT = false
+	cpm.CPU.Interrupt = cpm.keyboardInterrupt()
+	return true
+}
+
+// keyboardInterrupt returns a copy of our keyboard interrupt, since the
+// CPU discards it once it has been processed.
+func (cpm *CPM) keyboardInterrupt() *z80.Interrupt {
+	return &z80.Interrupt{
+		Type: cpm.kbdInterrupt.Type,
+		Data: append([]uint8{}, cpm.kbdInterrupt.Data...),
+	}
+}
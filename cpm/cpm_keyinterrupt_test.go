@@ -0,0 +1,132 @@
+package cpm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/skx/cpmulator/asm"
+)
+
+// TestKeyboardInterruptSpec tests the parsing of our keyboard interrupt
+// specifications.
+func TestKeyboardInterruptSpec(t *testing.T) {
+
+	valid := []string{"", "im0", "IM0:0xF7", "im1", "im2:0x10", "im2:16"}
+	for _, spec := range valid {
+		_, err := parseKeyboardInterrupt(spec)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s: %s", spec, err)
+		}
+	}
+
+	invalid := []string{"im2", "im1:3", "im0:steve", "im2:0x100", "nmi"}
+	for _, spec := range invalid {
+		_, err := New(WithKeyboardInterrupt(spec))
+		if err == nil || !strings.Contains(err.Error(), "invalid keyboard interrupt") {
+			t.Fatalf("expected an error parsing %s, got %v", spec, err)
+		}
+	}
+}
+
+// TestKeyboardInterrupt ensures that a program which reads the keyboard
+// from an interrupt handler sees each key which is pressed.
+func TestKeyboardInterrupt(t *testing.T) {
+
+	// The program waits for three keys, via HALT, and the handler
+	// echoes each of them.
+	program := func(setup string) []byte {
+		return asm.MustAssemble(`
+        ORG 100H
+        DI
+` + setup + `
+        EI
+WAIT:
+        HALT
+        LD A, (COUNT)
+        CP 3
+        JP NZ, WAIT
+        LD C, 0
+        CALL 5
+HANDLER:
+        LD C, 6
+        LD E, 0xFF
+        CALL 5
+        LD E, A
+        LD C, 2
+        CALL 5
+        LD HL, COUNT
+        INC (HL)
+        EI
+        RETI
+COUNT:
+        DB 0
+`)
+	}
+
+	type TestCase struct {
+		Spec  string
+		Setup string
+	}
+
+	tests := []TestCase{
+		{Spec: "im1", Setup: `
+        LD A, 0xC3
+        LD (0x0038), A
+        LD HL, HANDLER
+        LD (0x0039), HL
+        IM 1
+`},
+		{Spec: "im2:0x10", Setup: `
+        LD A, 0x03
+        LD I, A
+        LD HL, HANDLER
+        LD (0x0310), HL
+        IM 2
+`},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "KEYS.COM")
+		err := os.WriteFile(path, program(test.Setup), 0644)
+		if err != nil {
+			t.Fatalf("failed to write program: %s", err)
+		}
+
+		obj, err := New(WithOutputDriver("buffer"), WithKeyboardInterrupt(test.Spec))
+		if err != nil {
+			t.Fatalf("failed to create CPM: %s", err)
+		}
+		err = obj.LoadBinary(path)
+		if err != nil {
+			t.Fatalf("failed to load program: %s", err)
+		}
+
+		obj.StuffInput("abc")
+		err = obj.Execute([]string{})
+		if err != nil {
+			t.Fatalf("%s: unexpected error %s", test.Spec, err)
+		}
+		out, _ := obj.ReadOutput()
+		if out != "abc" {
+			t.Fatalf("%s: unexpected output '%s'", test.Spec, out)
+		}
+
+		// Without the interrupt the HALT terminates the program.
+		obj, err = New(WithOutputDriver("buffer"))
+		if err != nil {
+			t.Fatalf("failed to create CPM: %s", err)
+		}
+		err = obj.LoadBinary(path)
+		if err != nil {
+			t.Fatalf("failed to load program: %s", err)
+		}
+		obj.StuffInput("abc")
+		err = obj.Execute([]string{})
+		if err != ErrHalt {
+			t.Fatalf("%s: expected ErrHalt, got %v", test.Spec, err)
+		}
+		obj.StuffInput("")
+	}
+}
@@ -0,0 +1,219 @@
+// cpm_longnames.go contains the optional mapping layer which allows host
+// files whose names don't fit the CP/M 8.3 format to be seen, and used,
+// by the guest via generated aliases such as "FILENA~1.TXT".
+//
+// The aliases are saved to a table in each directory, so that they remain
+// the same between runs even as other files come and go.
+
+package cpm
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// longNameTable is the name of the file, within each directory, which
+// holds the aliases we've generated.
+const longNameTable = ".cpmulator-names"
+
+// shortNameChars contains the characters, other than letters and digits,
+// which may be used in a CP/M filename.
+const shortNameChars = "!#$%&'()-@^_`{}~"
+
+// WithLongNames enables the mapping of host files with long names to
+// 8.3 aliases.  It is disabled by default.
+func WithLongNames(enabled bool) cpmoption {
+	return func(c *CPM) error {
+		c.longNames = enabled
+		return nil
+	}
+}
+
+// isShortName returns true if the given host filename can be used by CP/M
+// as-is, ignoring case.
+func isShortName(name string) bool {
+
+	base, ext, _ := strings.Cut(name, ".")
+	if base == "" || len(base) > 8 || len(ext) > 3 || strings.Contains(ext, ".") {
+		return false
+	}
+
+	for _, c := range base + ext {
+		if !isShortChar(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// isShortChar returns true if the given character may be used in a CP/M
+// filename.
+func isShortChar(c rune) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || strings.ContainsRune(shortNameChars, c)
+}
+
+// shortPart upper-cases the given part of a filename, removing spaces and
+// dots, and replacing any other invalid characters with "_".
+func shortPart(str string) string {
+	out := ""
+	for _, c := range strings.ToUpper(str) {
+		switch {
+		case c == ' ' || c == '.':
+			continue
+		case isShortChar(c):
+			out += string(c)
+		default:
+			out += "_"
+		}
+	}
+	return out
+}
+
+// makeAlias generates an alias for the given host filename, which isn't
+// present in the given set of names already in use.
+func makeAlias(name string, used map[string]bool) string {
+
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+
+	base = shortPart(base)
+	ext = shortPart(ext)
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	if base == "" {
+		base = "_"
+	}
+
+	for n := 1; ; n++ {
+		tail := fmt.Sprintf("~%d", n)
+
+		prefix := base
+		if len(prefix) > 8-len(tail) {
+			prefix = prefix[:8-len(tail)]
+		}
+
+		alias := prefix + tail
+		if ext != "" {
+			alias += "." + ext
+		}
+
+		if !used[alias] {
+			return alias
+		}
+	}
+}
+
+// getAliases returns the aliases for the files in the given directory
+// which have long names, as a map of alias to host filename.
+//
+// The aliases are loaded from the table in the directory, with entries
+// for files which no longer exist being removed, and new aliases being
+// generated for new files.  The table is saved if it was changed.
+func (cpm *CPM) getAliases(dir string) map[string]string {
+
+	aliases := make(map[string]string)
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return aliases
+	}
+
+	// The names in use, and the long names which need aliases.
+	used := make(map[string]bool)
+	long := make(map[string]bool)
+	for _, n := range files {
+		if n.IsDir() || strings.HasPrefix(n.Name(), ".") {
+			continue
+		}
+		if isShortName(n.Name()) {
+			used[strings.ToUpper(n.Name())] = true
+		} else {
+			long[n.Name()] = true
+		}
+	}
+
+	// Load the existing table, keeping the entries which are valid.
+	changed := false
+	path := filepath.Join(dir, longNameTable)
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		scanner := bufio.NewScanner(strings.NewReader(string(data)))
+		for scanner.Scan() {
+			alias, host, ok := strings.Cut(scanner.Text(), "\t")
+			if !ok || !long[host] || used[alias] {
+				changed = true
+				continue
+			}
+			aliases[alias] = host
+			used[alias] = true
+			delete(long, host)
+		}
+	}
+
+	// Generate aliases for any new files, sorting them so that
+	// the results are predictable.
+	names := []string{}
+	for host := range long {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+
+	for _, host := range names {
+		alias := makeAlias(host, used)
+		aliases[alias] = host
+		used[alias] = true
+		changed = true
+	}
+
+	if changed {
+		cpm.saveAliases(path, aliases)
+	}
+	return aliases
+}
+
+// saveAliases writes the given aliases to the named table.
+//
+// Failure isn't fatal, the aliases will work for this run, but they might
+// not be the same the next time, as is the case when the filesystem is
+// read-only.
+func (cpm *CPM) saveAliases(path string, aliases map[string]string) {
+
+	// Nothing is written to the host if the filesystem is read-only.
+	if cpm.readOnlyFS {
+		return
+	}
+
+	keys := []string{}
+	for alias := range aliases {
+		keys = append(keys, alias)
+	}
+	sort.Strings(keys)
+
+	out := ""
+	for _, alias := range keys {
+		out += alias + "\t" + aliases[alias] + "\n"
+	}
+
+	// Don't create an empty table.
+	if out == "" {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return
+		}
+	}
+
+	err := os.WriteFile(path, []byte(out), 0644)
+	if err != nil {
+		slog.Debug("failed to save long filename aliases",
+			slog.String("path", path),
+			slog.String("error", err.Error()))
+	}
+}
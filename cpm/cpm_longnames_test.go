@@ -0,0 +1,142 @@
+package cpm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/skx/cpmulator/fcb"
+	"github.com/skx/cpmulator/memory"
+)
+
+// TestShortNames tests the detection of names which fit in 8.3 format.
+func TestShortNames(t *testing.T) {
+
+	valid := []string{"FOO", "foo.txt", "README", "Makefile", "A-B_C.$$$", "!CCP.COM"}
+	invalid := []string{"", ".txt", "filename1.txt", "foo.text", "foo.tar.gz", "my file.txt", "a+b.txt"}
+
+	for _, name := range valid {
+		if !isShortName(name) {
+			t.Fatalf("%s should be a valid short name", name)
+		}
+	}
+	for _, name := range invalid {
+		if isShortName(name) {
+			t.Fatalf("%s should not be a valid short name", name)
+		}
+	}
+}
+
+// TestMakeAlias tests the generation of aliases.
+func TestMakeAlias(t *testing.T) {
+
+	used := map[string]bool{"LONGFI~1.TXT": true}
+
+	type TestCase struct {
+		Name     string
+		Expected string
+	}
+
+	tests := []TestCase{
+		{"filename.text", "FILENA~1.TEX"},
+		{"longfilename.txt", "LONGFI~2.TXT"},
+		{"foo.tar.gz", "FOOTAR~1.GZ"},
+		{"my+file.c", "MY_FIL~1.C"},
+		{"...", "_~1"},
+	}
+
+	for _, test := range tests {
+		out := makeAlias(test.Name, used)
+		if out != test.Expected {
+			t.Fatalf("alias for %s was %s, expected %s", test.Name, out, test.Expected)
+		}
+	}
+}
+
+// TestLongNames tests that long names are visible via their aliases, and
+// that the aliases are persistent.
+func TestLongNames(t *testing.T) {
+
+	dir := t.TempDir()
+	for _, name := range []string{"short.txt", "a long name.txt", "another-long.txt"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatalf("failed to create %s: %s", name, err)
+		}
+	}
+
+	c, err := New(WithLongNames(true))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.Memory = new(memory.Memory)
+	c.SetDrives(false)
+	c.SetDrivePath("A", dir)
+
+	res, err := c.getMatches(fcb.FromString("*.TXT"), dir)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	names := []string{}
+	for _, ent := range res {
+		names = append(names, ent.Name)
+	}
+	if strings.Join(names, ",") != "ALONGN~1.TXT,ANOTHE~1.TXT,SHORT.TXT" {
+		t.Fatalf("unexpected matches %v", names)
+	}
+
+	// A new file which sorts earlier doesn't change the existing aliases,
+	// because they're saved.
+	err = os.WriteFile(filepath.Join(dir, "a long first.txt"), []byte("data"), 0644)
+	if err != nil {
+		t.Fatalf("failed to create file: %s", err)
+	}
+	aliases := c.getAliases(dir)
+	if aliases["ALONGN~1.TXT"] != "a long name.txt" || aliases["ALONGF~1.TXT"] != "a long first.txt" {
+		t.Fatalf("unexpected aliases %v", aliases)
+	}
+
+	// Removed files are removed from the table.
+	os.Remove(filepath.Join(dir, "another-long.txt"))
+	c.getAliases(dir)
+	data, err := os.ReadFile(filepath.Join(dir, longNameTable))
+	if err != nil || strings.Contains(string(data), "another-long.txt") {
+		t.Fatalf("unexpected table %s %v", data, err)
+	}
+
+	// Opening, and writing, an alias uses the original file.
+	f := fcb.FromString("ALONGN~1.TXT")
+	c.Memory.SetRange(0x0200, f.AsBytes()...)
+	c.CPU.States.DE.SetU16(0x0200)
+	err = BdosSysCallFileOpen(c)
+	if err != nil || c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("failed to open alias: %v %02X", err, c.CPU.States.AF.Hi)
+	}
+
+	c.Memory.SetRange(0x0080, []byte(strings.Repeat("X", 128))...)
+	err = BdosSysCallWrite(c)
+	if err != nil || c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("failed to write alias: %v %02X", err, c.CPU.States.AF.Hi)
+	}
+	err = BdosSysCallFileClose(c)
+	if err != nil {
+		t.Fatalf("failed to close alias: %v", err)
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, "a long name.txt"))
+	if err != nil || string(data) != strings.Repeat("X", 128) {
+		t.Fatalf("write didn't reach the host file: %s %v", data, err)
+	}
+
+	// Without the option the long names are not visible.
+	c.longNames = false
+	out, err := c.resolveName(dir, "ALONGN~1.TXT")
+	if err != nil || out != filepath.Join(dir, "ALONGN~1.TXT") {
+		t.Fatalf("unexpected resolution %s %v", out, err)
+	}
+	res, err = c.getMatches(fcb.FromString("ALONGN~1.TXT"), dir)
+	if err != nil || len(res) != 0 {
+		t.Fatalf("unexpected matches %v %v", res, err)
+	}
+}
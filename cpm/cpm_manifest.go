@@ -0,0 +1,126 @@
+// cpm_manifest.go contains the code which records the host files that
+// the guest created, modified, renamed, or deleted, so that a manifest
+// of them can be written when the emulator exits.
+//
+// This is useful for build pipelines which need to collect the output of
+// a compiler, and for auditing what an unknown program did.
+
+package cpm
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// WithManifest configures the path to which a manifest of the host files
+// changed by guests will be written, as JSON, when WriteManifest is called.
+//
+// The special path "-" means the manifest is written to STDERR, and the
+// empty string disables the manifest, which is the default.
+func WithManifest(path string) cpmoption {
+	return func(c *CPM) error {
+		c.manifestPath = path
+		return nil
+	}
+}
+
+// manifestEntry records a single change made to a host file.
+type manifestEntry struct {
+	// Action is one of "created", "modified", "renamed", or "deleted".
+	Action string `json:"action"`
+
+	// Path is the absolute path of the file on the host, which is the
+	// new name of the file for a rename.
+	Path string `json:"path"`
+
+	// From is the previous path of a renamed file.
+	From string `json:"from,omitempty"`
+}
+
+// recordChange adds an entry to our manifest, if it is enabled, and
+// publishes it upon our event bus.
+//
+// A file is only reported as modified the first time it is written, and
+// not at all if the guest created it, so that a program writing a file a
+// record at a time doesn't produce thousands of entries.
+func (cpm *CPM) recordChange(action string, path string, from string) {
+
+	if (cpm.manifestPath == "" && cpm.events == nil) || cpm.readOnlyFS {
+		return
+	}
+
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if from != "" {
+		if abs, err := filepath.Abs(from); err == nil {
+			from = abs
+		}
+	}
+
+	if cpm.manifestSeen == nil {
+		cpm.manifestSeen = make(map[string]bool)
+	}
+
+	switch action {
+	case "modified":
+		if cpm.manifestSeen[path] {
+			return
+		}
+		cpm.manifestSeen[path] = true
+	case "created":
+		cpm.manifestSeen[path] = true
+	case "renamed":
+		cpm.manifestSeen[path] = cpm.manifestSeen[from]
+		delete(cpm.manifestSeen, from)
+	case "deleted":
+		delete(cpm.manifestSeen, path)
+	}
+
+	cpm.publish(Event{Type: "file", Action: action, Path: path, From: from})
+
+	if cpm.manifestPath != "" {
+		cpm.manifest = append(cpm.manifest, manifestEntry{Action: action, Path: path, From: from})
+	}
+}
+
+// WriteManifest writes the manifest of the host files changed by guests,
+// if it is enabled, to the configured destination.
+func (cpm *CPM) WriteManifest() error {
+
+	if cpm.manifestPath == "" {
+		return nil
+	}
+
+	var out io.Writer = os.Stderr
+
+	if cpm.manifestPath != "-" {
+		file, err := os.Create(cpm.manifestPath)
+		if err != nil {
+			slog.Error("failed to create manifest",
+				slog.String("path", cpm.manifestPath),
+				slog.String("error", err.Error()))
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	return cpm.writeManifest(out)
+}
+
+// writeManifest writes the manifest, as JSON, to the given writer.
+func (cpm *CPM) writeManifest(out io.Writer) error {
+
+	entries := cpm.manifest
+	if entries == nil {
+		entries = []manifestEntry{}
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
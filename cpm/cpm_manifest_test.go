@@ -0,0 +1,81 @@
+package cpm
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/skx/cpmulator/fcb"
+)
+
+// TestManifest tests that changes made to host files are recorded.
+func TestManifest(t *testing.T) {
+
+	c, dir := newFindTest(t, []cpmoption{WithManifest("-")}, "OLD.TXT")
+	defer c.IOTearDown()
+
+	// call invokes the given syscall with an FCB for the given name.
+	call := func(handler CPMHandlerType, name string) {
+		f := fcb.FromString(name)
+		c.Memory.SetRange(0x0200, f.AsBytes()...)
+		c.CPU.States.DE.SetU16(0x0200)
+		err := handler(c)
+		if err != nil || c.CPU.States.AF.Hi != 0x00 {
+			t.Fatalf("syscall failed for %s: %v %02X", name, err, c.CPU.States.AF.Hi)
+		}
+	}
+
+	// Create a file, and write to it, which is a single change.
+	call(BdosSysCallMakeFile, "NEW.TXT")
+	BdosSysCallWrite(c)
+	BdosSysCallWrite(c)
+	BdosSysCallFileClose(c)
+
+	// Modify an existing file, twice.
+	call(BdosSysCallFileOpen, "OLD.TXT")
+	BdosSysCallWrite(c)
+	BdosSysCallWrite(c)
+	BdosSysCallFileClose(c)
+
+	// Rename the new file, and delete the old one.
+	src := fcb.FromString("NEW.TXT")
+	dst := fcb.FromString("REN.TXT")
+	c.Memory.SetRange(0x0200, src.AsBytes()...)
+	c.Memory.SetRange(0x0210, dst.AsBytes()[:16]...)
+	c.CPU.States.DE.SetU16(0x0200)
+	err := BdosSysCallRenameFile(c)
+	if err != nil || c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("failed to rename")
+	}
+	call(BdosSysCallDeleteFile, "OLD.TXT")
+
+	var out bytes.Buffer
+	err = c.writeManifest(&out)
+	if err != nil {
+		t.Fatalf("failed to write manifest: %s", err)
+	}
+
+	var entries []manifestEntry
+	err = json.Unmarshal(out.Bytes(), &entries)
+	if err != nil {
+		t.Fatalf("invalid JSON: %s", err)
+	}
+
+	abs, _ := filepath.Abs(dir)
+	expected := []manifestEntry{
+		{Action: "created", Path: filepath.Join(abs, "NEW.TXT")},
+		{Action: "modified", Path: filepath.Join(abs, "OLD.TXT")},
+		{Action: "renamed", Path: filepath.Join(abs, "REN.TXT"), From: filepath.Join(abs, "NEW.TXT")},
+		{Action: "deleted", Path: filepath.Join(abs, "OLD.TXT")},
+	}
+
+	if len(entries) != len(expected) {
+		t.Fatalf("wrong number of entries: %v", entries)
+	}
+	for i, e := range expected {
+		if entries[i] != e {
+			t.Fatalf("entry %d: expected %v, got %v", i, e, entries[i])
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// cpm_maxinstructions.go contains our instruction limit, which terminates
+// the emulator once a given number of instructions have been executed.
+//
+// A deadline, given to ExecuteContext, measures the time of the host, so it
+// fires even when a program is waiting, legitimately, for input.  The count
+// of instructions only grows while programs are running, which makes it the
+// better way to detect a program stuck in a loop, such as in CI.
+//
+// The count covers the whole of our session, including the CCP, and every
+// program launched from it.  The program is executed one instruction at a
+// time, as with watchpoints, so this is a little slower than usual.
+
+package cpm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInstructionLimit is returned when the number of instructions given
+// to WithMaxInstructions have been executed.
+var ErrInstructionLimit = errors.New("instruction limit exceeded")
+
+// WithMaxInstructions terminates the emulator, with ErrInstructionLimit,
+// once the given number of instructions have been executed.
+//
+// Zero means there is no limit, which is the default.
+func WithMaxInstructions(max int64) cpmoption {
+	return func(c *CPM) error {
+		if max < 0 {
+			return fmt.Errorf("invalid instruction limit %d", max)
+		}
+		c.maxInstructions = max
+		return nil
+	}
+}
+
+// countInstruction records the execution of an instruction, returning
+// ErrInstructionLimit if we've executed too many.
+func (cpm *CPM) countInstruction() error {
+
+	if cpm.maxInstructions == 0 {
+		return nil
+	}
+
+	cpm.instructions++
+	if cpm.instructions > cpm.maxInstructions {
+		return fmt.Errorf("%w, %d instructions executed", ErrInstructionLimit, cpm.maxInstructions)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package cpm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMaxInstructions ensures that programs are terminated once they've
+// executed too many instructions.
+func TestMaxInstructions(t *testing.T) {
+
+	_, err := New(WithMaxInstructions(-1))
+	if err == nil {
+		t.Fatalf("expected an error with a negative limit")
+	}
+
+	// JP 0x0100, forever.
+	dir := t.TempDir()
+	loop := filepath.Join(dir, "LOOP.COM")
+	err = os.WriteFile(loop, []byte{0xC3, 0x00, 0x01}, 0644)
+	if err != nil {
+		t.Fatalf("failed to write program: %s", err)
+	}
+
+	// LD C, 0 ; CALL 0x0005
+	exit := filepath.Join(dir, "EXIT.COM")
+	err = os.WriteFile(exit, []byte{0x0E, 0x00, 0xCD, 0x05, 0x00}, 0644)
+	if err != nil {
+		t.Fatalf("failed to write program: %s", err)
+	}
+
+	obj, err := New(WithOutputDriver("null"), WithMaxInstructions(1000))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+
+	// A program which exits is fine.
+	err = obj.LoadBinary(exit)
+	if err != nil {
+		t.Fatalf("failed to load program: %s", err)
+	}
+	err = obj.Execute([]string{})
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if obj.instructions != 2 {
+		t.Fatalf("unexpected instruction count %d", obj.instructions)
+	}
+
+	// One which loops is terminated, when it attempts to execute more
+	// than the limit.
+	err = obj.LoadBinary(loop)
+	if err != nil {
+		t.Fatalf("failed to load program: %s", err)
+	}
+	err = obj.Execute([]string{})
+	if !errors.Is(err, ErrInstructionLimit) {
+		t.Fatalf("expected the instruction limit, got %v", err)
+	}
+	if obj.instructions != 1001 {
+		t.Fatalf("unexpected instruction count %d", obj.instructions)
+	}
+}
@@ -0,0 +1,360 @@
+// cpm_monitor.go contains the interactive monitor, which allows the user
+// to press an escape key and interact with the emulator itself, rather
+// than the guest program.
+
+package cpm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/skx/cpmulator/asm"
+	"github.com/skx/cpmulator/consolein"
+)
+
+// monitorHelp is shown in response to the "help" command.
+var monitorHelp = `Commands:
+  continue             Resume the guest (also "c").
+  quit                 Terminate the emulator (also "q").
+  regs                 Show the Z80 registers.
+  dump ADDR [LEN]      Show a hex-dump of memory.
+  disasm [ADDR] [LEN]  Disassemble memory, defaulting to PC.
+  watch [ADDR [LEN] [r|w|rw]]
+                       List, or add, memory watchpoints.
+  unwatch ADDR|all     Remove the watchpoints covering ADDR, or all of them.
+  syms [TEXT]          List the symbols loaded from the program's .SYM file,
+                       or those containing TEXT.  Symbols may be given as
+                       addresses.
+  drives               Show the host paths of our drives.
+  mount X: PATH        Mount the host directory PATH as drive X.
+  umount X:            Remove a mount.
+  input DRIVER         Change the console input driver.
+  output DRIVER        Change the console output driver.
+  charset [NAME]       Show, or change, the output character set.
+  input-charset [NAME] Show, or change, the character set input is converted to.
+  resume               Resume output paused by -output-limit.
+  stuff TEXT           Queue TEXT as input, "\r" is a carriage-return.
+  paste PATH           Queue the contents of the host file PATH as input.
+  clip                 Queue the contents of the host clipboard as input.
+  exec COMMAND         Run COMMAND on the host (also "!COMMAND").
+`
+
+// WithMonitorKey configures the key which will drop the user into our
+// interactive monitor, when it is read from the console.
+//
+// The default is zero, which disables the monitor.
+func WithMonitorKey(key byte) cpmoption {
+	return func(c *CPM) error {
+		c.monitorKey = key
+		return nil
+	}
+}
+
+// monitor is invoked by our console input driver when the monitor key is
+// pressed.  It reads, and runs, commands until the user asks to continue.
+//
+// Returning ErrHalt will terminate the emulator.
+func (cpm *CPM) monitor() error {
+
+	// Our terminal is in raw mode, so newlines need a carriage-return.
+	show := func(str string) {
+		fmt.Print(strings.ReplaceAll(str, "\n", "\r\n"))
+	}
+
+	// Inspecting memory mustn't trigger our watchpoints.
+	muted := cpm.watchMuted
+	cpm.watchMuted = true
+	defer func() {
+		cpm.watchMuted = muted
+	}()
+
+	show("\ncpmulator monitor - type \"help\" for commands\n")
+	if cpm.output.Paused() {
+		show("Output is paused - type \"resume\" to resume it\n")
+	}
+
+	for {
+		show("monitor> ")
+
+		line, err := cpm.input.ReadLine(255)
+		show("\n")
+
+		if err == consolein.ErrInterrupted {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var out bytes.Buffer
+		resume, err := cpm.monitorCommand(&out, line)
+		show(out.String())
+
+		if err != nil {
+			return err
+		}
+		if resume {
+			return nil
+		}
+	}
+}
+
+// monitorCommand runs a single monitor command, writing any output to the
+// given writer.
+//
+// resume is true if the guest should be resumed.
+func (cpm *CPM) monitorCommand(out io.Writer, line string) (bool, error) {
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false, nil
+	}
+
+	// "!command" is a synonym for "exec command".
+	if strings.HasPrefix(fields[0], "!") {
+		cpm.hostExec(strings.TrimPrefix(strings.TrimSpace(line), "!"))
+		return false, nil
+	}
+
+	// Parse the numeric argument at the given offset, if present, which
+	// may also be the name of a symbol.
+	number := func(i int, def uint64) (uint64, error) {
+		if len(fields) <= i {
+			return def, nil
+		}
+		if addr, ok := cpm.symbolAddress(fields[i]); ok {
+			return uint64(addr), nil
+		}
+		return strconv.ParseUint(fields[i], 0, 16)
+	}
+
+	switch strings.ToLower(fields[0]) {
+
+	case "help", "?":
+		fmt.Fprint(out, monitorHelp)
+
+	case "continue", "c":
+		return true, nil
+
+	case "quit", "q":
+		return false, ErrHalt
+
+	case "resume":
+		if !cpm.output.Paused() {
+			fmt.Fprintf(out, "Output is not paused\n")
+			break
+		}
+		discarded := cpm.output.Resume()
+		fmt.Fprintf(out, "Output resumed, %d characters were discarded\n", discarded)
+		return true, nil
+
+	case "regs":
+		cpm.writeRegisters(out, "")
+
+	case "dump":
+		if len(fields) < 2 {
+			fmt.Fprintf(out, "Usage: dump ADDR [LEN]\n")
+			break
+		}
+		addr, err := number(1, 0)
+		if err != nil {
+			fmt.Fprintf(out, "invalid address: %s\n", fields[1])
+			break
+		}
+		size, err := number(2, 128)
+		if err != nil {
+			fmt.Fprintf(out, "invalid length: %s\n", fields[2])
+			break
+		}
+		cpm.writeHexDump(out, "", uint16(addr), int(size))
+
+	case "disasm":
+		addr, err := number(1, uint64(cpm.CPU.States.PC))
+		if err != nil {
+			fmt.Fprintf(out, "invalid address: %s\n", fields[1])
+			break
+		}
+		size, err := number(2, 32)
+		if err != nil {
+			fmt.Fprintf(out, "invalid length: %s\n", fields[2])
+			break
+		}
+		for _, l := range asm.DisassembleSymbols(cpm.Memory.GetRange(uint16(addr), int(size)), uint16(addr), cpm.bdosNames(), cpm.symbols) {
+			fmt.Fprintf(out, "%s\n", l)
+		}
+
+	case "watch":
+		if len(fields) == 1 {
+			if len(cpm.watchpoints) == 0 {
+				fmt.Fprintf(out, "No watchpoints are set\n")
+			}
+			for _, wp := range cpm.watchpoints {
+				fmt.Fprintf(out, "%s\n", wp)
+			}
+			break
+		}
+		spec := fields[1]
+		if addr, ok := cpm.symbolAddress(spec); ok {
+			spec = fmt.Sprintf("0x%04X", addr)
+		}
+		if len(fields) > 2 {
+			spec += "+" + fields[2]
+		}
+		if len(fields) > 3 {
+			spec += ":" + fields[3]
+		}
+		wp, err := parseWatchpoint(spec)
+		if err != nil {
+			fmt.Fprintf(out, "%s\n", err)
+			break
+		}
+		cpm.addWatchpoint(wp)
+
+	case "unwatch":
+		if len(fields) != 2 {
+			fmt.Fprintf(out, "Usage: unwatch ADDR|all\n")
+			break
+		}
+		if strings.ToLower(fields[1]) == "all" {
+			cpm.watchpoints = nil
+			cpm.watchMemory()
+			break
+		}
+		addr, err := number(1, 0)
+		if err != nil {
+			fmt.Fprintf(out, "invalid address: %s\n", fields[1])
+			break
+		}
+		if cpm.removeWatchpoints(uint16(addr)) == 0 {
+			fmt.Fprintf(out, "No watchpoint covers %04X\n", addr)
+		}
+
+	case "syms":
+		if len(cpm.symbols) == 0 {
+			fmt.Fprintf(out, "No symbols are loaded\n")
+			break
+		}
+		for _, addr := range cpm.sortedSymbols() {
+			name := cpm.symbols[addr]
+			if len(fields) > 1 && !strings.Contains(strings.ToUpper(name), strings.ToUpper(fields[1])) {
+				continue
+			}
+			fmt.Fprintf(out, "%04X  %s\n", addr, name)
+		}
+
+	case "drives":
+		paths := cpm.GetDrivePaths()
+		keys := []string{}
+		for drive := range paths {
+			keys = append(keys, drive)
+		}
+		sort.Strings(keys)
+		for _, drive := range keys {
+			fmt.Fprintf(out, "%s: %s\n", drive, paths[drive])
+		}
+
+	case "mount":
+		err := cpm.mountFromString(strings.Join(fields[1:], " "))
+		if err != nil {
+			fmt.Fprintf(out, "mount failed: %s\n", err)
+		}
+
+	case "umount":
+		if len(fields) != 2 {
+			fmt.Fprintf(out, "Usage: umount X:\n")
+			break
+		}
+		err := cpm.UnmountDrive(fields[1])
+		if err != nil {
+			fmt.Fprintf(out, "umount failed: %s\n", err)
+		}
+
+	case "input":
+		if len(fields) != 2 {
+			fmt.Fprintf(out, "Usage: input DRIVER\n")
+			break
+		}
+		err := cpm.input.SetDriver(fields[1])
+		if err != nil {
+			fmt.Fprintf(out, "%s\n", err)
+		}
+
+	case "output":
+		if len(fields) != 2 {
+			fmt.Fprintf(out, "Usage: output DRIVER\n")
+			break
+		}
+		err := cpm.output.ChangeDriver(fields[1])
+		if err != nil {
+			fmt.Fprintf(out, "%s\n", err)
+		}
+
+	case "charset":
+		if len(fields) == 1 {
+			fmt.Fprintf(out, "%s\n", cpm.output.GetCharset())
+			break
+		}
+		err := cpm.output.SetCharset(fields[1])
+		if err != nil {
+			fmt.Fprintf(out, "%s\n", err)
+		}
+
+	case "input-charset":
+		if len(fields) == 1 {
+			fmt.Fprintf(out, "%s\n", cpm.input.GetCharset())
+			break
+		}
+		err := cpm.input.SetCharset(fields[1])
+		if err != nil {
+			fmt.Fprintf(out, "%s\n", err)
+		}
+
+	case "stuff":
+		text := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), fields[0]))
+		text = strings.ReplaceAll(text, "\\r", "\r")
+		text = strings.ReplaceAll(text, "\\n", "\r")
+		cpm.StuffText(text)
+
+	case "paste":
+		if len(fields) < 2 {
+			fmt.Fprintf(out, "Usage: paste PATH\n")
+			break
+		}
+		err := cpm.PasteFile(strings.TrimPrefix(strings.TrimSpace(line), fields[0]))
+		if err != nil {
+			fmt.Fprintf(out, "%s\n", err)
+		}
+
+	case "clip":
+		err := cpm.PasteClipboard()
+		if err != nil {
+			fmt.Fprintf(out, "%s\n", err)
+		}
+
+	case "exec":
+		if len(fields) < 2 {
+			fmt.Fprintf(out, "Usage: exec COMMAND\n")
+			break
+		}
+		cpm.hostExec(strings.TrimPrefix(strings.TrimSpace(line), fields[0]))
+
+	default:
+		fmt.Fprintf(out, "unknown command: %s\n", fields[0])
+	}
+
+	return false, nil
+}
+
+// bdosNames returns the names of our BDOS functions, indexed by number,
+// which are used to annotate disassembly.
+func (cpm *CPM) bdosNames() map[uint8]string {
+	names := make(map[uint8]string)
+	for num, handler := range cpm.BDOSSyscalls {
+		names[num] = handler.Desc
+	}
+	return names
+}
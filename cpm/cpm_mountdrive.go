@@ -0,0 +1,194 @@
+// cpm_mountdrive.go contains the code which allows drives to be remapped
+// to different host directories while the emulator is running.
+
+package cpm
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// driveName converts the given drive letter, or number, into the upper-case
+// letter we use to index our drive-map.
+//
+// An error is returned if the drive is not in the range A-P.
+func driveName(drive string) (string, error) {
+	drive = strings.ToUpper(strings.TrimSuffix(drive, ":"))
+
+	if len(drive) != 1 || drive[0] < 'A' || drive[0] > 'P' {
+		return "", fmt.Errorf("invalid drive '%s'", drive)
+	}
+	return drive, nil
+}
+
+// MountDrive changes the host directory which backs the given drive.
+//
+// Any files which are open upon the drive are closed, so that the guest
+// doesn't continue to read, or write, to files in the old location.  The
+// original path is remembered such that UnmountDrive can restore it.
+//
+// If the path is a ZIP archive then its contents are mounted read-only,
+// and new files are written to an overlay directory beside it.
+func (cpm *CPM) MountDrive(drive string, path string) error {
+
+	drive, err := driveName(drive)
+	if err != nil {
+		return err
+	}
+
+	// Load the archive before we change anything, so a failure
+	// leaves the drive untouched.
+	backend, path, err := openDrive(path)
+	if err != nil {
+		return err
+	}
+
+	// Close any files open upon the drive
+	cpm.invalidateDrive(drive)
+
+	delete(cpm.backends, drive)
+	if backend != nil {
+		cpm.backends[drive] = backend
+	}
+
+	// Remember the original path, the first time we change it.
+	if _, ok := cpm.mounts[drive]; !ok {
+		cpm.mounts[drive] = cpm.drives[drive]
+	}
+
+	slog.Debug("Mounting drive",
+		slog.String("drive", drive),
+		slog.String("path", path))
+
+	cpm.setDrive(drive, path)
+	return nil
+}
+
+// openDrive ensures the given path exists, and is a directory or an
+// archive, returning the backend for an archive, along with the path of
+// its overlay directory.
+//
+// MemoryDrive is accepted as-is, as it doesn't exist upon the host.
+func openDrive(path string) (Drive, string, error) {
+
+	if path == MemoryDrive {
+		return nil, path, nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if fi.IsDir() {
+		return nil, path, nil
+	}
+	if !isArchive(path) {
+		return nil, "", fmt.Errorf("%s is not a directory", path)
+	}
+	backend, overlay, err := mountArchive(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return backend, overlay, nil
+}
+
+// UnmountDrive restores the host directory which was used for the given
+// drive before MountDrive was called.
+//
+// An error is returned if the drive was not mounted.
+func (cpm *CPM) UnmountDrive(drive string) error {
+
+	drive, err := driveName(drive)
+	if err != nil {
+		return err
+	}
+
+	orig, ok := cpm.mounts[drive]
+	if !ok {
+		return fmt.Errorf("drive %s: is not mounted", drive)
+	}
+
+	// Close any files open upon the drive
+	cpm.invalidateDrive(drive)
+	delete(cpm.backends, drive)
+
+	slog.Debug("Unmounting drive",
+		slog.String("drive", drive),
+		slog.String("path", orig))
+
+	cpm.setDrive(drive, orig)
+	delete(cpm.mounts, drive)
+	return nil
+}
+
+// invalidateDrive closes, and forgets, any cached file-handles for files
+// which were opened upon the given drive.
+//
+// The cache-keys are remembered, so that later attempts to read or write
+// via them can be reported to the guest, and the results of any in-progress
+// directory search are also discarded.
+func (cpm *CPM) invalidateDrive(drive string) {
+
+	for key, obj := range cpm.files {
+
+		if obj.drive != drive {
+			continue
+		}
+
+		slog.Debug("Closing handle in FileCache",
+			slog.String("path", obj.name),
+			slog.String("drive", drive),
+			slog.Int("fcb", int(key)))
+
+		// Virtual files have no handle.
+		if obj.handle != nil {
+			obj.handle.Close()
+		}
+		delete(cpm.files, key)
+		cpm.stale[key] = drive
+	}
+
+	for key, state := range cpm.finds {
+		if state.drive == drive {
+			delete(cpm.finds, key)
+		}
+	}
+	if cpm.lastFind != nil && cpm.lastFind.drive == drive {
+		cpm.lastFind = nil
+	}
+	delete(cpm.dirCache, drive)
+}
+
+// staleFile returns true if the given cache-key refers to a file which was
+// closed by invalidateDrive.
+func (cpm *CPM) staleFile(key uint16) bool {
+	drive, ok := cpm.stale[key]
+	if ok {
+		slog.Error("File was closed because its drive was remapped",
+			slog.String("drive", drive),
+			slog.Int("fcb", int(key)))
+	}
+	return ok
+}
+
+// mountFromString handles a mount request made by a guest, which is
+// expected to be of the form "E: /path/to/directory".
+//
+// Because the CCP upper-cases the command-line we'll use the lower-case
+// version of the path, if the path as given doesn't exist.
+func (cpm *CPM) mountFromString(str string) error {
+
+	fields := strings.Fields(str)
+	if len(fields) != 2 {
+		return fmt.Errorf("expected 'DRIVE: PATH', got '%s'", str)
+	}
+
+	path := fields[1]
+	if _, err := os.Stat(path); err != nil {
+		path = strings.ToLower(path)
+	}
+
+	return cpm.MountDrive(fields[0], path)
+}
@@ -0,0 +1,75 @@
+// cpm_namedirs.go contains support for the ZCPR-style "DU:" prefixes, and
+// named directories, in the filenames we place in the default FCBs.
+
+package cpm
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/skx/cpmulator/fcb"
+)
+
+// WithNamedDirectories defines ZCPR-style named directories, which may be
+// used in place of a drive and user number, such as "WORK:FILE.TXT".
+//
+// The definitions are given as a comma-separated list of NAME=DU pairs,
+// for example "ROOT=A0,WORK=B3".
+func WithNamedDirectories(spec string) cpmoption {
+	return func(c *CPM) error {
+
+		c.namedDirs = make(map[string]fcb.DU)
+
+		for _, ent := range strings.Split(spec, ",") {
+			ent = strings.TrimSpace(ent)
+			if ent == "" {
+				continue
+			}
+
+			name, val, ok := strings.Cut(strings.ToUpper(ent), "=")
+			if !ok || name == "" || len(name) > 8 || strings.ContainsAny(name, ":.*? ") {
+				return fmt.Errorf("invalid named directory '%s', expected NAME=DU", ent)
+			}
+
+			du, ok := fcb.ParseDU(val)
+			if !ok || (du.Drive == 0 && du.User < 0) {
+				return fmt.Errorf("invalid drive/user '%s' for named directory %s", val, name)
+			}
+
+			// A name which is also a DU could never be used.
+			if _, ok := fcb.ParseDU(name); ok {
+				return fmt.Errorf("named directory %s would be treated as a drive/user", name)
+			}
+
+			c.namedDirs[name] = du
+		}
+		return nil
+	}
+}
+
+// argumentFCB returns the FCB for a command-line argument, as the CCP
+// would create it in the default FCBs at 0x005C and 0x006C.
+//
+// The argument may have a ZCPR-style prefix: a drive ("B:"), a drive and
+// user number ("B3:"), a user number ("3:"), or a named directory.  The
+// drive is stored with 1 for A:, and the user number is stored in the S1
+// field, defaulting to the current user, as ZCPR does.
+func (cpm *CPM) argumentFCB(arg string) fcb.FCB {
+
+	du, rest, err := fcb.SplitPrefix(arg, cpm.namedDirs)
+	if err != nil {
+		slog.Debug("failed to parse argument prefix",
+			slog.String("argument", arg),
+			slog.String("error", err.Error()))
+		return fcb.FromString(arg)
+	}
+
+	x := fcb.FromString(rest)
+	x.Drive = du.Drive
+	x.S1 = cpm.userNumber
+	if du.User >= 0 {
+		x.S1 = uint8(du.User)
+	}
+	return x
+}
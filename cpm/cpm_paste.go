@@ -0,0 +1,43 @@
+// cpm_paste.go contains the code which allows the contents of a host file
+// to be pasted into the console of a running session, as if it had been
+// typed.
+//
+// This is available via the "paste" command of our monitor, and via a
+// custom BIOS function, which A:!PASTE.COM uses.
+
+package cpm
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// PasteFile queues the contents of the given host file as console input,
+// which will be read a line at a time.
+//
+// If the file doesn't exist we also try the lower-cased version of the
+// path, as the CCP upper-cases the arguments it passes to programs.
+func (cpm *CPM) PasteFile(path string) error {
+
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return fmt.Errorf("no file given")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && os.IsNotExist(err) {
+		data, err = os.ReadFile(strings.ToLower(path))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", path, err)
+	}
+
+	slog.Debug("Pasting file into the console",
+		slog.String("path", path),
+		slog.Int("size", len(data)))
+
+	cpm.input.Paste(string(data))
+	return nil
+}
@@ -0,0 +1,133 @@
+// cpm_profile.go contains the code which records how often each BDOS and
+// BIOS syscall is invoked, and how long they take, to help find out why a
+// program runs slowly.
+
+package cpm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WithSyscallProfile configures the path to which a profile of the syscalls
+// made by guests will be written, when WriteSyscallProfile is called.
+//
+// The special path "-" means the profile is written to STDERR, and the empty
+// string disables profiling, which is the default.  If the path has the
+// suffix ".json" the profile is written as JSON, otherwise it is a table.
+func WithSyscallProfile(path string) cpmoption {
+	return func(c *CPM) error {
+		c.profilePath = path
+		if path != "" {
+			c.profile = make(map[string]*syscallStats)
+		}
+		return nil
+	}
+}
+
+// syscallStats holds the statistics for a single syscall.
+type syscallStats struct {
+	// Type is either "BDOS" or "BIOS".
+	Type string `json:"type"`
+
+	// Number is the number of the syscall.
+	Number int `json:"number"`
+
+	// Name is the name of the syscall.
+	Name string `json:"name"`
+
+	// Calls is the number of times the syscall was invoked.
+	Calls int `json:"calls"`
+
+	// Total is the cumulative time spent in the syscall.
+	Total time.Duration `json:"total_ns"`
+
+	// Average is the average time spent in each call.
+	Average time.Duration `json:"average_ns"`
+}
+
+// profileSyscall records a call to the given syscall, which took the given
+// time to complete.  It does nothing unless profiling is enabled.
+func (cpm *CPM) profileSyscall(kind string, num uint8, name string, elapsed time.Duration) {
+
+	if cpm.profile == nil {
+		return
+	}
+
+	key := fmt.Sprintf("%s/%03d", kind, num)
+	ent, ok := cpm.profile[key]
+	if !ok {
+		ent = &syscallStats{Type: kind, Number: int(num), Name: name}
+		cpm.profile[key] = ent
+	}
+
+	ent.Calls++
+	ent.Total += elapsed
+}
+
+// WriteSyscallProfile writes the profile of the syscalls made by guests,
+// if profiling is enabled, to the configured destination.
+func (cpm *CPM) WriteSyscallProfile() error {
+
+	if cpm.profilePath == "" {
+		return nil
+	}
+
+	var out io.Writer = os.Stderr
+
+	if cpm.profilePath != "-" {
+		file, err := os.Create(cpm.profilePath)
+		if err != nil {
+			slog.Error("failed to create syscall profile",
+				slog.String("path", cpm.profilePath),
+				slog.String("error", err.Error()))
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	return cpm.writeSyscallProfile(out, strings.EqualFold(filepath.Ext(cpm.profilePath), ".json"))
+}
+
+// writeSyscallProfile writes the profile to the given writer, either as
+// a table or JSON.  The syscalls are sorted by the time spent in them,
+// with the most expensive first.
+func (cpm *CPM) writeSyscallProfile(out io.Writer, asJSON bool) error {
+
+	stats := []syscallStats{}
+	for _, ent := range cpm.profile {
+		s := *ent
+		s.Average = s.Total / time.Duration(s.Calls)
+		stats = append(stats, s)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Total != stats[j].Total {
+			return stats[i].Total > stats[j].Total
+		}
+		if stats[i].Type != stats[j].Type {
+			return stats[i].Type < stats[j].Type
+		}
+		return stats[i].Number < stats[j].Number
+	})
+
+	if asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+
+	fmt.Fprintf(out, "%-4s %3s %-22s %10s %14s %12s\n", "Type", "Num", "Name", "Calls", "Total", "Average")
+	for _, s := range stats {
+		fmt.Fprintf(out, "%-4s %03d %-22s %10d %14s %12s\n", s.Type, s.Number, s.Name, s.Calls, s.Total, s.Average)
+	}
+	return nil
+}
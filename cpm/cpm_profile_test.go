@@ -0,0 +1,72 @@
+package cpm
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSyscallProfile tests the recording, and reporting, of syscall
+// statistics.
+func TestSyscallProfile(t *testing.T) {
+
+	// Profiling is disabled by default.
+	c, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.profileSyscall("BDOS", 1, "C_READ", time.Second)
+	if c.profile != nil {
+		t.Fatalf("profile recorded when disabled")
+	}
+	if c.WriteSyscallProfile() != nil {
+		t.Fatalf("unexpected error writing disabled profile")
+	}
+
+	path := filepath.Join(t.TempDir(), "profile.json")
+	c, err = New(WithSyscallProfile(path))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+
+	c.profileSyscall("BDOS", 20, "F_READ", 2*time.Millisecond)
+	c.profileSyscall("BDOS", 20, "F_READ", 4*time.Millisecond)
+	c.profileSyscall("BIOS", 4, "CONOUT", 10*time.Millisecond)
+
+	// The table has the most expensive syscall first.
+	var out bytes.Buffer
+	err = c.writeSyscallProfile(&out, false)
+	if err != nil {
+		t.Fatalf("failed to write profile: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("wrong number of lines in profile: %s", out.String())
+	}
+	if !strings.Contains(lines[1], "CONOUT") || !strings.Contains(lines[2], "F_READ") || !strings.Contains(lines[2], "3ms") {
+		t.Fatalf("wrong profile: %s", out.String())
+	}
+
+	// The JSON is written to the configured path.
+	err = c.WriteSyscallProfile()
+	if err != nil {
+		t.Fatalf("failed to write profile: %s", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read profile: %s", err)
+	}
+
+	var stats []syscallStats
+	err = json.Unmarshal(data, &stats)
+	if err != nil {
+		t.Fatalf("failed to decode profile: %s", err)
+	}
+	if len(stats) != 2 || stats[1].Name != "F_READ" || stats[1].Calls != 2 || stats[1].Average != 3*time.Millisecond {
+		t.Fatalf("wrong profile %v", stats)
+	}
+}
@@ -0,0 +1,127 @@
+// cpm_protect.go contains the protections which may be applied when a
+// guest deletes, or renames, files using a wildcard.
+//
+// A buggy, or untrusted, program which deletes "*.*" would otherwise
+// silently remove everything within the host directory its drive is
+// mapped to.
+
+package cpm
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"strings"
+
+	"github.com/skx/cpmulator/fcb"
+)
+
+const (
+	// ProtectNone applies no protection, which is the default.
+	ProtectNone = "none"
+
+	// ProtectLog logs the name of each file which is deleted, or
+	// renamed, via a wildcard.
+	ProtectLog = "log"
+
+	// ProtectDryRun logs the names of the files which would be deleted,
+	// or renamed, via a wildcard, but leaves them untouched.
+	ProtectDryRun = "dry-run"
+
+	// ProtectConfirm asks, via the console, before deleting or renaming
+	// files via a wildcard.
+	ProtectConfirm = "confirm"
+
+	// ProtectSession only allows files created by the guest, since the
+	// emulator started, to be deleted or renamed via a wildcard.
+	ProtectSession = "session"
+)
+
+// WithWildcardProtection configures the protection which is applied when
+// a guest deletes, or renames, files using a wildcard.  The default is
+// ProtectNone.
+func WithWildcardProtection(mode string) cpmoption {
+	return func(c *CPM) error {
+		switch mode {
+		case ProtectNone, ProtectLog, ProtectDryRun, ProtectConfirm, ProtectSession:
+			c.protect = mode
+			return nil
+		}
+		return fmt.Errorf("unknown wildcard protection '%s', valid choices are %s, %s, %s, %s, and %s", mode, ProtectNone, ProtectLog, ProtectDryRun, ProtectConfirm, ProtectSession)
+	}
+}
+
+// createdKey returns the key used to record a file created by the guest.
+func createdKey(drive string, name string) string {
+	return drive + ":" + strings.ToUpper(name)
+}
+
+// fileCreated records that the guest created the given file, or renamed
+// one it created to the given name.
+func (cpm *CPM) fileCreated(drive string, name string) {
+
+	if cpm.protect != ProtectSession {
+		return
+	}
+	if cpm.created == nil {
+		cpm.created = make(map[string]bool)
+	}
+	cpm.created[createdKey(drive, name)] = true
+}
+
+// protectWildcard applies our protection to the files matched by the
+// given pattern, which the guest is trying to delete or rename.
+//
+// It returns the files which may be changed, and the number which were
+// refused.  If the pattern contains no wildcards all the files may be
+// changed.
+func (cpm *CPM) protectWildcard(action string, drive string, pattern fcb.FCB, files []fs.FileInfo) ([]fs.FileInfo, int) {
+
+	if cpm.protect == "" || cpm.protect == ProtectNone || !pattern.HasWildcards() {
+		return files, 0
+	}
+
+	for _, entry := range files {
+		slog.Warn("Wildcard "+action,
+			slog.String("pattern", pattern.GetFileName()),
+			slog.String("drive", drive),
+			slog.String("name", entry.Name()),
+			slog.String("protection", cpm.protect))
+	}
+
+	switch cpm.protect {
+
+	case ProtectDryRun:
+		return nil, 0
+
+	case ProtectConfirm:
+		prompt := fmt.Sprintf("\r\n%s %d file(s) matching %s:%s (Y/N)? ", action, len(files), drive, pattern.GetFileName())
+		for _, c := range []byte(prompt) {
+			cpm.output.PutCharacter(c)
+		}
+
+		c, err := cpm.input.BlockForCharacterNoEcho()
+		if err != nil {
+			c = 'N'
+		}
+		cpm.output.PutCharacter(c)
+		cpm.output.PutCharacter('\r')
+		cpm.output.PutCharacter('\n')
+
+		if c == 'Y' || c == 'y' {
+			return files, 0
+		}
+		return nil, len(files)
+
+	case ProtectSession:
+		var allowed []fs.FileInfo
+		for _, entry := range files {
+			if cpm.created[createdKey(drive, entry.Name())] {
+				allowed = append(allowed, entry)
+			}
+		}
+		return allowed, len(files) - len(allowed)
+	}
+
+	return files, 0
+}
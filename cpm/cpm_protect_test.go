@@ -0,0 +1,94 @@
+package cpm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/skx/cpmulator/fcb"
+)
+
+// deletePattern invokes F_DELETE with the given pattern, and returns the
+// values of A and H.
+func deletePattern(t *testing.T, c *CPM, pattern string) (uint8, uint8) {
+
+	f := fcb.FromString(pattern)
+	c.Memory.SetRange(0x0200, f.AsBytes()...)
+	c.CPU.States.DE.SetU16(0x0200)
+
+	err := BdosSysCallDeleteFile(c)
+	if err != nil {
+		t.Fatalf("error deleting %s: %s", pattern, err)
+	}
+	return c.CPU.States.AF.Hi, c.CPU.States.HL.Hi
+}
+
+// exists returns true if the given file exists.
+func exists(dir string, name string) bool {
+	_, err := os.Stat(filepath.Join(dir, name))
+	return err == nil
+}
+
+// TestWildcardProtection tests the protection of files from wildcard
+// deletes.
+func TestWildcardProtection(t *testing.T) {
+
+	_, err := New(WithWildcardProtection("bogus"))
+	if err == nil {
+		t.Fatalf("expected an error with a bogus mode")
+	}
+
+	// Dry-run leaves everything alone, but reports success.
+	c, dir := newFindTest(t, []cpmoption{WithWildcardProtection(ProtectDryRun)}, "A.TXT", "B.TXT")
+	a, _ := deletePattern(t, c, "*.TXT")
+	if a != 0x00 || !exists(dir, "A.TXT") || !exists(dir, "B.TXT") {
+		t.Fatalf("dry-run deleted files, or failed")
+	}
+
+	// Deleting a single file isn't affected.
+	a, _ = deletePattern(t, c, "A.TXT")
+	if a != 0x00 || exists(dir, "A.TXT") {
+		t.Fatalf("failed to delete a single file")
+	}
+	c.IOTearDown()
+
+	// Confirmation can be refused.
+	c, dir = newFindTest(t, []cpmoption{WithWildcardProtection(ProtectConfirm), WithOutputDriver("null")}, "A.TXT")
+	c.input.StuffInput("N")
+	a, h := deletePattern(t, c, "*.*")
+	if a != 0xFF || h != 0x03 || !exists(dir, "A.TXT") {
+		t.Fatalf("refusing confirmation deleted files: %02X %02X", a, h)
+	}
+
+	// Or given.
+	c.input.StuffInput("y")
+	a, _ = deletePattern(t, c, "*.*")
+	if a != 0x00 || exists(dir, "A.TXT") {
+		t.Fatalf("confirmation didn't delete files")
+	}
+	c.IOTearDown()
+
+	// Session mode only deletes files the guest created.
+	c, dir = newFindTest(t, []cpmoption{WithWildcardProtection(ProtectSession)}, "OLD.TXT")
+	defer c.IOTearDown()
+
+	f := fcb.FromString("NEW.TXT")
+	c.Memory.SetRange(0x0300, f.AsBytes()...)
+	c.CPU.States.DE.SetU16(0x0300)
+	err = BdosSysCallMakeFile(c)
+	if err != nil || c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("failed to create file %v", err)
+	}
+	err = BdosSysCallFileClose(c)
+	if err != nil {
+		t.Fatalf("failed to close file %v", err)
+	}
+
+	a, h = deletePattern(t, c, "*.TXT")
+	if a != 0xFF || h != 0x03 {
+		t.Fatalf("expected refused files to be reported: %02X %02X", a, h)
+	}
+	if !exists(dir, "OLD.TXT") || exists(dir, "NEW.TXT") {
+		t.Fatalf("session mode deleted the wrong files")
+	}
+}
@@ -0,0 +1,75 @@
+// cpm_ramdrive.go contains the drives which are held entirely in memory,
+// selected by using the path ":memory:" for a drive, such as via
+// "-drive-m :memory:".
+//
+// These act like the RAM disks, usually M:, found upon many CP/M systems.
+// They're fast, never touch the host, and their contents disappear when
+// the emulator exits, which makes them a good home for the temporary files
+// written by compilers, and assemblers.
+//
+// The files are held in the same way as those of our read-only filesystem,
+// see cpm_scratchdrive.go, but with nothing beneath them.  A RAM drive
+// keeps its contents if another path is mounted over it, and restored.
+
+package cpm
+
+import (
+	"io/fs"
+)
+
+// MemoryDrive is the path which selects a drive held in memory, rather
+// than a host directory.
+const MemoryDrive = ":memory:"
+
+// ramDrive returns the drive, held in memory, for the given drive letter.
+//
+// The embedded files are layered beneath it, as they are for drives upon
+// the host.
+func (cpm *CPM) ramDrive(drive string) Drive {
+
+	if cpm.ramDrives == nil {
+		cpm.ramDrives = make(map[string]*scratchState)
+	}
+
+	s, ok := cpm.ramDrives[drive]
+	if !ok {
+		s = &scratchState{files: make(map[string]*scratchFile), deleted: make(map[string]bool)}
+		cpm.ramDrives[drive] = s
+	}
+
+	ram := scratchDrive{state: s, drive: drive, lower: emptyDrive{}}
+	return overlayDrive{upper: ram, lower: fsDrive{fsys: cpm.static, dir: drive}}
+}
+
+// emptyDrive is a drive which holds no files, and can't be written.
+type emptyDrive struct{}
+
+// Open fails, since there are no files.
+func (e emptyDrive) Open(name string) (DriveFile, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// Create fails, since the drive is read-only.
+func (e emptyDrive) Create(name string) (DriveFile, error) {
+	return nil, ErrReadOnly
+}
+
+// ReadDir returns no files.
+func (e emptyDrive) ReadDir() ([]fs.FileInfo, error) {
+	return nil, nil
+}
+
+// Delete fails, since there are no files.
+func (e emptyDrive) Delete(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+}
+
+// Rename fails, since there are no files.
+func (e emptyDrive) Rename(from string, to string) error {
+	return &fs.PathError{Op: "rename", Path: from, Err: fs.ErrNotExist}
+}
+
+// Stat fails, since there are no files.
+func (e emptyDrive) Stat(name string) (fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
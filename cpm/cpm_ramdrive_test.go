@@ -0,0 +1,97 @@
+package cpm
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/skx/cpmulator/fcb"
+)
+
+// TestRAMDrive tests that a drive held in memory may be written, read,
+// and listed, without anything reaching the host.
+func TestRAMDrive(t *testing.T) {
+
+	c, dir := newFindTest(t, nil)
+	defer c.IOTearDown()
+
+	err := c.MountDrive("M", MemoryDrive)
+	if err != nil {
+		t.Fatalf("failed to mount memory drive: %s", err)
+	}
+	if !c.driveExists(12) {
+		t.Fatalf("memory drive doesn't exist")
+	}
+	c.currentDrive = 12
+
+	// call invokes the given syscall with an FCB for the given name.
+	call := func(handler CPMHandlerType, name string) {
+		f := fcb.FromString(name)
+		c.Memory.SetRange(0x0200, f.AsBytes()...)
+		c.CPU.States.DE.SetU16(0x0200)
+		err := handler(c)
+		if err != nil || c.CPU.States.AF.Hi != 0x00 {
+			t.Fatalf("syscall failed for %s: %v %02X", name, err, c.CPU.States.AF.Hi)
+		}
+	}
+
+	// Create a file, and read it back.
+	c.Memory.FillRange(c.dma, 128, 'X')
+	call(BdosSysCallMakeFile, "TEMP.$$$")
+	BdosSysCallWrite(c)
+	BdosSysCallFileClose(c)
+
+	c.Memory.FillRange(c.dma, 128, 0)
+	call(BdosSysCallFileOpen, "TEMP.$$$")
+	BdosSysCallRead(c)
+	if c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("failed to read file")
+	}
+	if !bytes.Equal(c.Memory.GetRange(c.dma, 128), bytes.Repeat([]byte{'X'}, 128)) {
+		t.Fatalf("wrong contents read")
+	}
+	BdosSysCallFileClose(c)
+
+	// Rename it, and find it by its new name.
+	src := fcb.FromString("TEMP.$$$")
+	dst := fcb.FromString("OUT.REL")
+	c.Memory.SetRange(0x0200, src.AsBytes()...)
+	c.Memory.SetRange(0x0210, dst.AsBytes()[:16]...)
+	c.CPU.States.DE.SetU16(0x0200)
+	err = BdosSysCallRenameFile(c)
+	if err != nil || c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("failed to rename")
+	}
+
+	all := fcb.FromString("*.*")
+	c.Memory.SetRange(0x0300, all.AsBytes()...)
+	name := findCall(t, c, true, 0x0300)
+	if name != "OUT.REL" {
+		t.Fatalf("wrong file found: '%s'", name)
+	}
+	if findCall(t, c, false, 0x0300) != "" {
+		t.Fatalf("too many files found")
+	}
+
+	// The contents are kept between uses of the drive.
+	data, err := c.readDriveFile("M", "OUT.REL")
+	if err != nil || len(data) != 128 {
+		t.Fatalf("failed to read file via drive: %v %d", err, len(data))
+	}
+
+	// Nothing reached the host.
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("host directory was changed: %v %d", err, len(entries))
+	}
+	_, err = os.Stat("OUT.REL")
+	if err == nil {
+		t.Fatalf("file created in working directory")
+	}
+
+	// Delete it.
+	call(BdosSysCallDeleteFile, "OUT.REL")
+	if findCall(t, c, true, 0x0300) != "" {
+		t.Fatalf("file wasn't deleted")
+	}
+}
@@ -0,0 +1,399 @@
+// cpm_redirect.go contains the redirection of console input, and output,
+// for individual commands given via WithCommands, which allows usage such
+// as:
+//
+//	cpmulator -command "MBASIC PROG.BAS <in.txt >out.txt"
+//
+// The operators are removed from the command before the CCP sees it, and
+// the redirection is applied once the CCP has read the command:
+//
+//   - "<path" supplies the contents of the host file as console input.
+//   - ">path" writes the console output to the host file, replacing it.
+//   - ">>path" appends the console output to the host file.
+//
+// The newline the CCP writes after reading the command isn't written to the
+// file, so it contains only the output of the command.
+//
+// The redirection ends when the command does, which is noticed when the
+// program terminates, or the CCP reads its next command.  If a program
+// consumes all of its redirected input, and then reads a line, it is
+// given the command which follows, as it would be without redirection.
+// The CCP's built-in commands, such as DIR, don't terminate, so their
+// redirected output is followed by the CCP's next prompt.
+//
+// Commands are only given to the CCP, or a program, when a line is read,
+// via C_READSTRING.  They aren't typed ahead, so they aren't consumed by
+// programs which poll the console to see whether they should stop, such
+// as DIR and TYPE, or which read single keys.  A program which reads a
+// single key, when its input isn't redirected, receives the end of our
+// input, which terminates the emulation.
+//
+// We also note whether each command succeeded, which is reported by
+// CommandFailed.  A command fails if the CCP can't find the program it
+// names, if the program sets a failing return code, via P_CODE, or if the
+// emulation ends before the CCP reads the command which follows it.
+//
+// Paths are relative to the directory the emulator was launched within.
+
+package cpm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/skx/cpmulator/consolein"
+	"github.com/skx/cpmulator/consoleout"
+	"github.com/skx/cpmulator/fcb"
+)
+
+// redirection holds the host files a command's console input, and output,
+// are redirected to.
+type redirection struct {
+
+	// input is the path of the file to read input from, if any.
+	input string
+
+	// output is the path of the file to write output to, if any,
+	// and appendOutput is true if it should be appended to.
+	output       string
+	appendOutput bool
+}
+
+// commandLine is a single command given via WithCommands.
+type commandLine struct {
+
+	// text is the command, without any redirection operators.
+	text string
+
+	// redirect holds the redirection of the command, if any.
+	redirect *redirection
+}
+
+// parseRedirection removes any redirection operators from the given
+// command, returning the command which remains, and the redirection.
+//
+// The filename may follow the operator directly, or after whitespace.
+func parseRedirection(cmd string) (commandLine, error) {
+
+	if !strings.ContainsAny(cmd, "<>") {
+		return commandLine{text: cmd}, nil
+	}
+
+	r := &redirection{}
+	words := []string{}
+
+	fields := strings.Fields(cmd)
+	for i := 0; i < len(fields); i++ {
+		word := fields[i]
+
+		var op string
+		switch {
+		case strings.HasPrefix(word, ">>"):
+			op = ">>"
+		case strings.HasPrefix(word, ">"), strings.HasPrefix(word, "<"):
+			op = word[:1]
+		default:
+			words = append(words, word)
+			continue
+		}
+
+		path := strings.TrimPrefix(word, op)
+		if path == "" && i+1 < len(fields) {
+			i++
+			path = fields[i]
+		}
+		if path == "" || strings.ContainsAny(path, "<>") {
+			return commandLine{}, fmt.Errorf("missing filename after '%s' in command '%s'", op, cmd)
+		}
+
+		if op == "<" {
+			if r.input != "" {
+				return commandLine{}, fmt.Errorf("input redirected twice in command '%s'", cmd)
+			}
+			r.input = path
+			continue
+		}
+		if r.output != "" {
+			return commandLine{}, fmt.Errorf("output redirected twice in command '%s'", cmd)
+		}
+		r.output = path
+		r.appendOutput = (op == ">>")
+	}
+
+	if len(words) == 0 {
+		return commandLine{}, fmt.Errorf("missing command in '%s'", cmd)
+	}
+	return commandLine{text: strings.Join(words, " "), redirect: r}, nil
+}
+
+// redirectOutput is the console output driver used while output is
+// redirected, which writes our output to a host file, unchanged.
+type redirectOutput struct {
+
+	// writer is where we send our output.
+	writer io.Writer
+
+	// skip holds the remainder of the newline the CCP writes after
+	// reading a command, which isn't part of the command's output.
+	skip string
+}
+
+// PutCharacter writes the specified character to our file.
+//
+// This is part of the OutputDriver interface.
+func (ro *redirectOutput) PutCharacter(c uint8) {
+
+	if ro.skip != "" && c == ro.skip[0] {
+		ro.skip = ro.skip[1:]
+		return
+	}
+	ro.skip = ""
+
+	ro.writer.Write([]byte{c})
+}
+
+// GetName returns the name of this driver.
+//
+// This is part of the OutputDriver interface.
+func (ro *redirectOutput) GetName() string {
+	return "file"
+}
+
+// SetWriter will update the writer.
+//
+// This is part of the OutputDriver interface.
+func (ro *redirectOutput) SetWriter(w io.Writer) {
+	ro.writer = w
+}
+
+// commandInput is the console input driver used for the commands given
+// via WithCommands, which applies their redirections.
+type commandInput struct {
+
+	// cpm is the emulator whose output we redirect.
+	cpm *CPM
+
+	// lines holds our commands, line is the index of the one being
+	// read, and pos the offset within it.
+	lines []commandLine
+	line  int
+	pos   int
+
+	// redirected is true while a redirection is in effect.
+	redirected bool
+
+	// notFound is true if the CCP failed to open the program named by
+	// the current command, failed is true once a command has failed,
+	// and finished is true once the CCP has read past our last command.
+	notFound bool
+	failed   bool
+	finished bool
+
+	// input holds the redirected input which has not been read.
+	input []byte
+
+	// output is the output driver we replaced, when output is
+	// redirected, and file and writer are where output is sent.
+	output consoleout.ConsoleOutput
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// Setup is part of the ConsoleInput interface, and does nothing.
+func (ci *commandInput) Setup() {
+}
+
+// TearDown is part of the ConsoleInput interface, and ends any
+// redirection.
+func (ci *commandInput) TearDown() {
+	ci.endRedirection()
+}
+
+// PendingInput returns true if there is redirected input to be read.
+//
+// Our commands are never pending, as they're only given to a line read,
+// as described at the top of this file.
+func (ci *commandInput) PendingInput() bool {
+	return len(ci.input) > 0
+}
+
+// BlockForCharacterNoEcho returns the next character of redirected input,
+// or of our commands, starting any redirection once a command has been
+// read.
+func (ci *commandInput) BlockForCharacterNoEcho() (byte, error) {
+
+	if len(ci.input) > 0 {
+		c := ci.input[0]
+		ci.input = ci.input[1:]
+		return c, nil
+	}
+
+	// Commands are only given to a line read.
+	if ci.pos == 0 && !ci.cpm.readingLine {
+		return 0, consolein.ErrEOF
+	}
+
+	// The CCP reading the next command ends the previous one.
+	if ci.pos == 0 && ci.cpm.calledByCCP() {
+		ci.endRedirection()
+		ci.commandEnded()
+	}
+
+	if ci.line >= len(ci.lines) {
+		return 0, consolein.ErrEOF
+	}
+
+	cmd := ci.lines[ci.line]
+	text := cmd.text + "\r"
+
+	c := text[ci.pos]
+	ci.pos++
+
+	if ci.pos == len(text) {
+		ci.line++
+		ci.pos = 0
+
+		if cmd.redirect != nil {
+			err := ci.startRedirection(cmd.redirect)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return c, nil
+}
+
+// commandEnded notes whether the command the CCP ran before reading its
+// next command succeeded.
+func (ci *commandInput) commandEnded() {
+
+	if ci.line > 0 && (ci.notFound || ci.cpm.ProgramFailed()) {
+		ci.failed = true
+	}
+	ci.notFound = false
+
+	if ci.line >= len(ci.lines) {
+		ci.finished = true
+	}
+}
+
+// GetName returns the name of this driver, which is the same as that of
+// the driver which reads from a file.
+func (ci *commandInput) GetName() string {
+	return "file"
+}
+
+// startRedirection applies the given redirection.
+func (ci *commandInput) startRedirection(r *redirection) error {
+
+	if r.input != "" {
+		data, err := os.ReadFile(r.input)
+		if err != nil {
+			return fmt.Errorf("failed to redirect input: %w", err)
+		}
+
+		// CP/M expects a carriage-return when the user presses
+		// enter, as with the "file" driver.
+		ci.input = []byte(strings.ReplaceAll(string(data), "\n", "\r"))
+	}
+
+	if r.output != "" {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if r.appendOutput {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+
+		file, err := os.OpenFile(r.output, flags, 0644)
+		if err != nil {
+			ci.input = nil
+			return fmt.Errorf("failed to redirect output: %w", err)
+		}
+
+		ci.file = file
+		ci.writer = bufio.NewWriter(file)
+
+		driver := &redirectOutput{writer: ci.writer, skip: "\r\n"}
+		ci.output = ci.cpm.output.SwapDriver(driver)
+	}
+
+	ci.redirected = true
+	return nil
+}
+
+// endRedirection ends the redirection which is in effect, if any.
+func (ci *commandInput) endRedirection() {
+
+	if !ci.redirected {
+		return
+	}
+	ci.redirected = false
+	ci.input = nil
+
+	if ci.output != nil {
+		ci.cpm.output.SwapDriver(ci.output)
+		ci.output = nil
+
+		ci.writer.Flush()
+		ci.file.Close()
+		ci.writer = nil
+		ci.file = nil
+	}
+}
+
+// endRedirection ends the redirection of the current command, if any, as
+// it has terminated.
+func (cpm *CPM) endRedirection() {
+	if ci, ok := cpm.input.GetDriver().(*commandInput); ok {
+		ci.endRedirection()
+	}
+}
+
+// noteCommandOpen is called as a file is opened, and notes the CCP failing
+// to open a program, which means the command wasn't found.
+func (cpm *CPM) noteCommandOpen(f fcb.FCB) {
+
+	ci, ok := cpm.input.GetDriver().(*commandInput)
+	if !ok || cpm.CPU.States.AF.Hi != 0xFF {
+		return
+	}
+	if string(f.Type[:]) == "COM" && cpm.calledByCCP() {
+		ci.notFound = true
+	}
+}
+
+// CommandFailed returns true if one of the commands given via WithCommands
+// failed, because the CCP couldn't find the program it named, or the
+// program set a return code which indicates failure, or if the emulation
+// ended before the CCP had read all of our commands, such as when a
+// program crashed, or read more input than it was given.
+func (cpm *CPM) CommandFailed() bool {
+
+	ci, ok := cpm.input.GetDriver().(*commandInput)
+	if !ok {
+		return false
+	}
+	return ci.failed || !ci.finished
+}
+
+// calledByCCP returns true if the CCP, rather than a program it launched,
+// made the syscall we're handling, which we tell from the address the
+// syscall will return to.
+func (cpm *CPM) calledByCCP() bool {
+
+	// A binary launched directly has no CCP.
+	if cpm.start <= 0x0100 {
+		return false
+	}
+
+	// Inspecting memory mustn't trigger our watchpoints.
+	muted := cpm.watchMuted
+	cpm.watchMuted = true
+	defer func() {
+		cpm.watchMuted = muted
+	}()
+
+	return cpm.Memory.GetU16(cpm.CPU.SP) >= cpm.start
+}
@@ -0,0 +1,257 @@
+package cpm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/skx/cpmulator/asm"
+)
+
+// TestParseRedirection tests the parsing of redirection operators from
+// the commands we're given.
+func TestParseRedirection(t *testing.T) {
+
+	type TestCase struct {
+		Cmd    string
+		Text   string
+		Input  string
+		Output string
+		Append bool
+	}
+
+	tests := []TestCase{
+		{Cmd: "DIR", Text: "DIR"},
+		{Cmd: "MBASIC PROG.BAS <in.txt >out.txt", Text: "MBASIC PROG.BAS", Input: "in.txt", Output: "out.txt"},
+		{Cmd: "DIR B: >> dir.log", Text: "DIR B:", Output: "dir.log", Append: true},
+		{Cmd: "< in.txt  PIP", Text: "PIP", Input: "in.txt"},
+	}
+
+	for _, test := range tests {
+		line, err := parseRedirection(test.Cmd)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %s", test.Cmd, err)
+		}
+		if line.text != test.Text {
+			t.Fatalf("%s: unexpected command '%s'", test.Cmd, line.text)
+		}
+
+		r := line.redirect
+		if test.Input == "" && test.Output == "" {
+			if r != nil {
+				t.Fatalf("%s: unexpected redirection %v", test.Cmd, r)
+			}
+			continue
+		}
+		if r == nil || r.input != test.Input || r.output != test.Output || r.appendOutput != test.Append {
+			t.Fatalf("%s: unexpected redirection %v", test.Cmd, r)
+		}
+	}
+
+	invalid := []string{"DIR >", "DIR <", "DIR >a >b", "DIR <a <b", ">out.txt", "DIR > <in"}
+	for _, cmd := range invalid {
+		_, err := New(WithCommands(cmd))
+		if err == nil {
+			t.Fatalf("%s: expected an error", cmd)
+		}
+	}
+}
+
+// TestRedirection runs commands, via the CCP, which redirect their input
+// and output.
+func TestRedirection(t *testing.T) {
+
+	// A program which reads a line, and writes it back.
+	echo := asm.MustAssemble(`
+        ORG 100H
+        LD C, 10
+        LD DE, BUF
+        CALL 5
+        LD HL, BUF+1
+        LD B, (HL)
+ECHO:
+        INC HL
+        LD E, (HL)
+        PUSH HL
+        PUSH BC
+        LD C, 2
+        CALL 5
+        POP BC
+        POP HL
+        DJNZ ECHO
+        LD C, 0
+        CALL 5
+BUF:
+        DB 80, 0
+        DS 80
+`)
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"ECHO.COM": string(echo),
+		"in.txt":   "first\n",
+		"out.txt":  "junk",
+	}
+	for name, data := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+		if err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	// Paths are relative to the host's working directory.
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get directory: %s", err)
+	}
+	defer os.Chdir(cwd)
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatalf("failed to change directory: %s", err)
+	}
+
+	cmds := "ECHO <in.txt >out.txt; ECHO >>out.txt; second; ECHO; third; DIR *.COM >dir.txt"
+
+	for _, ccp := range []string{"ccp", "ccpz"} {
+
+		obj, err := New(WithCCP(ccp), WithOutputDriver("buffer"), WithCommands(cmds))
+		if err != nil {
+			t.Fatalf("failed to create CPM: %s", err)
+		}
+		obj.SetDrives(false)
+
+		// Run the CCP until the commands are exhausted.
+		for {
+			err = obj.LoadCCP()
+			if err != nil {
+				t.Fatalf("failed to load CCP: %s", err)
+			}
+			err = obj.Execute([]string{})
+			if err != nil && err != ErrBoot {
+				break
+			}
+		}
+
+		// The first command reads its input from a file, and the
+		// second from the commands which follow it.
+		out, err := os.ReadFile("out.txt")
+		if err != nil {
+			t.Fatalf("failed to read output: %s", err)
+		}
+		if string(out) != "firstsecond" {
+			t.Fatalf("%s: unexpected output '%s'", ccp, out)
+		}
+
+		// The output of the CCP's built-in commands may be
+		// redirected too.
+		out, err = os.ReadFile("dir.txt")
+		if err != nil {
+			t.Fatalf("failed to read output: %s", err)
+		}
+		if !strings.Contains(string(out), "ECHO") {
+			t.Fatalf("%s: unexpected directory listing '%s'", ccp, out)
+		}
+
+		// Everything else is written to the console.
+		console, _ := obj.ReadOutput()
+		if !strings.Contains(console, "third") || strings.Contains(console, "first") || strings.Contains(console, "ECHO") {
+			t.Fatalf("%s: unexpected console output '%s'", ccp, console)
+		}
+	}
+}
+
+// TestCommandsCCP runs several commands through the CCP, and ensures each
+// runs in full, and that CommandFailed reports whether they succeeded.
+func TestCommandsCCP(t *testing.T) {
+
+	// Programs which succeed, fail via P_CODE, and read a key.
+	programs := map[string]string{
+		"OK.COM": `
+        ORG 100H
+        LD C, 0
+        CALL 5
+`,
+		"FAIL.COM": `
+        ORG 100H
+        LD C, 108
+        LD DE, 0FF00H
+        CALL 5
+        LD C, 0
+        CALL 5
+`,
+		"KEY.COM": `
+        ORG 100H
+        LD C, 1
+        CALL 5
+        LD C, 0
+        CALL 5
+`,
+	}
+
+	dir := t.TempDir()
+	for name, src := range programs {
+		err := os.WriteFile(filepath.Join(dir, name), asm.MustAssemble(src), 0644)
+		if err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+	err := os.WriteFile(filepath.Join(dir, "FOO.TXT"), []byte("hello\r\nworld\r\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write FOO.TXT: %s", err)
+	}
+
+	type TestCase struct {
+		CCP    string
+		Cmds   string
+		Output string
+		Failed bool
+	}
+
+	tests := []TestCase{
+		{CCP: "ccp", Cmds: "DIR A:;DIR A:", Output: "\r\nA>\r\nA: FAIL    .COM | FOO     .TXT | KEY     .COM | OK      .COM\r\nA>\r\nA: FAIL    .COM | FOO     .TXT | KEY     .COM | OK      .COM\r\nA>"},
+		{CCP: "ccp", Cmds: "TYPE FOO.TXT;OK", Output: "\r\nA>\r\nhello\r\nworld\r\n\r\nA>\r\n\r\nA>"},
+		{CCP: "ccp", Cmds: "TYPE FOO.TXT\nDIR A:\n", Output: "\r\nA>\r\nhello\r\nworld\r\n\r\nA>\r\nA: FAIL    .COM | FOO     .TXT | KEY     .COM | OK      .COM\r\nA>"},
+		{CCP: "ccp", Cmds: "NOSUCH", Output: "\r\nA>\r\nNOSUCH?\r\n\r\nA>", Failed: true},
+		{CCP: "ccp", Cmds: "NOSUCH;OK", Output: "\r\nA>\r\nNOSUCH?\r\n\r\nA>\r\n\r\nA>", Failed: true},
+		{CCP: "ccp", Cmds: "FAIL;OK", Output: "\r\nA>\r\n\r\nA>\r\n\r\nA>", Failed: true},
+		{CCP: "ccp", Cmds: "OK;KEY;OK", Output: "\r\nA>\r\n\r\nA>\r\n", Failed: true},
+		{CCP: "ccpz", Cmds: "DIR A:;DIR A:", Output: "\r\nA>\r\nFAIL    .COM  |  FOO     .TXT  |  KEY     .COM  |  OK      .COM\r\nA>\r\nFAIL    .COM  |  FOO     .TXT  |  KEY     .COM  |  OK      .COM\r\nA>"},
+		{CCP: "ccpz", Cmds: "TYPE FOO.TXT;OK", Output: "\r\nA>\r\nhello\r\nworld\r\n\r\nA>\r\n\r\nA>"},
+		{CCP: "ccpz", Cmds: "TYPE FOO.TXT\nDIR A:\n", Output: "\r\nA>\r\nhello\r\nworld\r\n\r\nA>\r\nFAIL    .COM  |  FOO     .TXT  |  KEY     .COM  |  OK      .COM\r\nA>"},
+		{CCP: "ccpz", Cmds: "NOSUCH", Output: "\r\nA>\r\nNOSUCH?\r\nA>", Failed: true},
+		{CCP: "ccpz", Cmds: "NOSUCH;OK", Output: "\r\nA>\r\nNOSUCH?\r\nA>\r\n\r\nA>", Failed: true},
+		{CCP: "ccpz", Cmds: "FAIL;OK", Output: "\r\nA>\r\n\r\nA>\r\n\r\nA>", Failed: true},
+		{CCP: "ccpz", Cmds: "OK;KEY;OK", Output: "\r\nA>\r\n\r\nA>\r\n", Failed: true},
+	}
+
+	for _, test := range tests {
+
+		obj, err := New(WithCCP(test.CCP), WithOutputDriver("buffer"), WithCommands(test.Cmds))
+		if err != nil {
+			t.Fatalf("failed to create CPM: %s", err)
+		}
+		obj.SetDrives(false)
+		obj.SetDrivePath("A", dir)
+
+		// Run the CCP until the commands are exhausted.
+		for {
+			err = obj.LoadCCP()
+			if err != nil {
+				t.Fatalf("failed to load CCP: %s", err)
+			}
+			err = obj.Execute([]string{})
+			if err != nil && err != ErrBoot {
+				break
+			}
+		}
+
+		out, _ := obj.ReadOutput()
+		if out != test.Output {
+			t.Fatalf("%s: %s: unexpected output %q", test.CCP, test.Cmds, out)
+		}
+		if obj.CommandFailed() != test.Failed {
+			t.Fatalf("%s: %s: expected failure %t", test.CCP, test.Cmds, test.Failed)
+		}
+	}
+}
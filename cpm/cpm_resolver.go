@@ -0,0 +1,192 @@
+// cpm_resolver.go contains the code which maps the upper-case filenames
+// used by CP/M to the names of files upon the host, which may be in any
+// case.
+//
+// All access to host directories, by the file-based syscalls, goes through
+// the functions here, so that the handling of host files which differ only
+// in case, or which have names too long for CP/M, is consistent.
+
+package cpm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/skx/cpmulator/fcb"
+)
+
+const (
+	// CaseExact prefers a host file whose name matches the CP/M name
+	// exactly, falling back to the first file which matches when case
+	// is ignored.  New files are created with upper-case names.
+	CaseExact = "exact"
+
+	// CaseFold prefers a host file with a lower-case name, falling back
+	// to the first file which matches when case is ignored.  New files
+	// are created with lower-case names.
+	CaseFold = "fold"
+
+	// CaseStrict behaves like CaseExact, but reports an error if more
+	// than one host file matches a CP/M name when case is ignored.
+	CaseStrict = "strict"
+)
+
+// ErrAmbiguous is returned when the CaseStrict policy is in use, and a
+// CP/M filename matches more than one file on the host.
+var ErrAmbiguous = errors.New("AMBIGUOUS FILENAME")
+
+// WithCasePolicy sets the policy used to map CP/M filenames to the names
+// of files upon the host.  The default is CaseExact.
+func WithCasePolicy(policy string) cpmoption {
+	return func(c *CPM) error {
+		switch policy {
+		case CaseExact, CaseFold, CaseStrict:
+			c.casePolicy = policy
+			return nil
+		}
+		return fmt.Errorf("unknown case policy '%s', valid choices are %s, %s, and %s", policy, CaseExact, CaseFold, CaseStrict)
+	}
+}
+
+// hostName returns the name which should be used for a new file, on the
+// host, given the CP/M name.
+func (cpm *CPM) hostName(name string) string {
+	if cpm.casePolicy == CaseFold {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// chooseName selects between the names of host files which all match the
+// given CP/M name when case is ignored, according to our policy.
+func (cpm *CPM) chooseName(name string, matches []string) (string, error) {
+
+	if len(matches) > 1 && cpm.casePolicy == CaseStrict {
+		return "", fmt.Errorf("%w: %s matches %s", ErrAmbiguous, name, strings.Join(matches, ", "))
+	}
+
+	preferred := name
+	if cpm.casePolicy == CaseFold {
+		preferred = strings.ToLower(name)
+	}
+	for _, m := range matches {
+		if m == preferred {
+			return m, nil
+		}
+	}
+	return matches[0], nil
+}
+
+// resolveName returns the path, on the host, of the file in the given
+// directory which has the given CP/M name.
+//
+// If there is no such file then the path at which it should be created
+// is returned.
+func (cpm *CPM) resolveName(dir string, name string) (string, error) {
+
+	var matches []string
+
+	files, err := os.ReadDir(dir)
+	if err == nil {
+		for _, n := range files {
+			if !n.IsDir() && strings.ToUpper(n.Name()) == name {
+				matches = append(matches, n.Name())
+			}
+		}
+	}
+
+	if len(matches) == 0 {
+
+		// Is this an alias for a file with a long name?
+		if cpm.longNames {
+			if host, ok := cpm.getAliases(dir)[name]; ok {
+				return filepath.Join(dir, host), nil
+			}
+		}
+		return filepath.Join(dir, cpm.hostName(name)), nil
+	}
+
+	found, err := cpm.chooseName(name, matches)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, found), nil
+}
+
+// getMatches returns the files, in the given directory, which match the
+// pattern in the given FCB.
+//
+// Host files which differ only in case would appear as duplicates to the
+// guest, so only one of each is returned, chosen according to our policy.
+func (cpm *CPM) getMatches(f fcb.FCB, dir string) ([]fcb.FCBFind, error) {
+
+	res, err := cpm.hostFiles(f, dir)
+	if err != nil {
+		return res, err
+	}
+
+	// Group the host names by the name the guest sees.
+	names := make(map[string][]string)
+	for _, ent := range res {
+		names[ent.Name] = append(names[ent.Name], filepath.Base(ent.Host))
+	}
+
+	var ret []fcb.FCBFind
+	for _, ent := range res {
+
+		matches := names[ent.Name]
+		if len(matches) == 1 {
+			ret = append(ret, ent)
+			continue
+		}
+
+		found, err := cpm.chooseName(ent.Name, matches)
+		if err != nil {
+			return nil, err
+		}
+		if found == filepath.Base(ent.Host) {
+			ret = append(ret, ent)
+		}
+	}
+
+	return ret, nil
+}
+
+// hostFiles returns the files, in the given directory, which match the
+// pattern in the given FCB, including any which differ only in case.
+func (cpm *CPM) hostFiles(f fcb.FCB, dir string) ([]fcb.FCBFind, error) {
+
+	res, err := f.GetMatches(dir)
+	if err != nil {
+		return res, err
+	}
+
+	// If we're mapping long filenames then we replace the entries
+	// which don't fit with their aliases.
+	if cpm.longNames {
+		var tmp []fcb.FCBFind
+		for _, ent := range res {
+			if isShortName(filepath.Base(ent.Host)) {
+				tmp = append(tmp, ent)
+			}
+		}
+
+		for alias, host := range cpm.getAliases(dir) {
+			if f.DoesMatch(alias) {
+				tmp = append(tmp, fcb.FCBFind{Host: filepath.Join(dir, host), Name: alias})
+			}
+		}
+
+		// Keep the results in a predictable order.
+		sort.Slice(tmp, func(i, j int) bool {
+			return tmp[i].Name < tmp[j].Name
+		})
+		res = tmp
+	}
+
+	return res, nil
+}
@@ -0,0 +1,171 @@
+package cpm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/skx/cpmulator/fcb"
+	"github.com/skx/cpmulator/memory"
+)
+
+// caseDir creates a temporary directory containing the named files,
+// skipping the test if the host filesystem is case-insensitive.
+func caseDir(t *testing.T, names ...string) string {
+
+	dir := t.TempDir()
+	for _, name := range names {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatalf("failed to create %s: %s", name, err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read directory: %s", err)
+	}
+	if len(entries) != len(names) {
+		t.Skip("host filesystem is case-insensitive")
+	}
+	return dir
+}
+
+// TestCasePolicy tests the resolution of filenames under each policy.
+func TestCasePolicy(t *testing.T) {
+
+	_, err := New(WithCasePolicy("steve"))
+	if err == nil {
+		t.Fatalf("expected error with bogus policy")
+	}
+
+	dir := caseDir(t, "FOO.TXT", "foo.txt", "Bar.txt")
+
+	type TestCase struct {
+		Policy   string
+		Name     string
+		Expected string
+		Err      bool
+	}
+
+	tests := []TestCase{
+		{CaseExact, "FOO.TXT", "FOO.TXT", false},
+		{CaseExact, "BAR.TXT", "Bar.txt", false},
+		{CaseExact, "NEW.TXT", "NEW.TXT", false},
+		{CaseFold, "FOO.TXT", "foo.txt", false},
+		{CaseFold, "BAR.TXT", "Bar.txt", false},
+		{CaseFold, "NEW.TXT", "new.txt", false},
+		{CaseStrict, "FOO.TXT", "", true},
+		{CaseStrict, "BAR.TXT", "Bar.txt", false},
+		{CaseStrict, "NEW.TXT", "NEW.TXT", false},
+	}
+
+	for _, test := range tests {
+		c, err := New(WithCasePolicy(test.Policy))
+		if err != nil {
+			t.Fatalf("failed to create CPM")
+		}
+
+		out, err := c.resolveName(dir, test.Name)
+		if test.Err {
+			if !errors.Is(err, ErrAmbiguous) {
+				t.Fatalf("%s:%s expected ambiguity, got %v", test.Policy, test.Name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s:%s unexpected error %s", test.Policy, test.Name, err)
+		}
+		if out != filepath.Join(dir, test.Expected) {
+			t.Fatalf("%s:%s got %s, expected %s", test.Policy, test.Name, out, test.Expected)
+		}
+	}
+}
+
+// TestCaseMatches tests that globs don't return duplicate names.
+func TestCaseMatches(t *testing.T) {
+
+	dir := caseDir(t, "FOO.TXT", "foo.txt", "Bar.txt")
+
+	for policy, expected := range map[string]string{CaseExact: "FOO.TXT", CaseFold: "foo.txt"} {
+		c, err := New(WithCasePolicy(policy))
+		if err != nil {
+			t.Fatalf("failed to create CPM")
+		}
+
+		res, err := c.getMatches(fcb.FromString("*.TXT"), dir)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if len(res) != 2 {
+			t.Fatalf("%s: expected two results, got %v", policy, res)
+		}
+		found := false
+		for _, ent := range res {
+			if ent.Host == filepath.Join(dir, expected) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("%s: expected %s in results %v", policy, expected, res)
+		}
+	}
+
+	c, err := New(WithCasePolicy(CaseStrict))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	_, err = c.getMatches(fcb.FromString("*.TXT"), dir)
+	if !errors.Is(err, ErrAmbiguous) {
+		t.Fatalf("expected ambiguity, got %v", err)
+	}
+}
+
+// TestRenameCase tests that renames which change case work, and don't
+// create files which differ only in case.
+func TestRenameCase(t *testing.T) {
+
+	dir := caseDir(t, "foo.txt", "Bar.txt")
+
+	c, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.Memory = new(memory.Memory)
+	c.SetDrives(false)
+	c.SetDrivePath("A", dir)
+
+	rename := func(src, dst string) {
+		s := fcb.FromString(src)
+		d := fcb.FromString(dst)
+		c.Memory.SetRange(0x0200, s.AsBytes()...)
+		c.Memory.SetRange(0x0200+16, d.AsBytes()...)
+		c.CPU.States.DE.SetU16(0x0200)
+		err = BdosSysCallRenameFile(c)
+		if err != nil || c.CPU.States.AF.Hi != 0x00 {
+			t.Fatalf("rename %s to %s failed", src, dst)
+		}
+	}
+
+	// Renaming to our own name changes the case.
+	rename("FOO.TXT", "FOO.TXT")
+	if _, err = os.Stat(filepath.Join(dir, "FOO.TXT")); err != nil {
+		t.Fatalf("case wasn't changed: %s", err)
+	}
+
+	// Renaming to an existing name replaces it.
+	rename("FOO.TXT", "BAR.TXT")
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read directory: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "Bar.txt" {
+		t.Fatalf("unexpected directory contents %v", entries)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "Bar.txt"))
+	if err != nil || string(data) != "foo.txt" {
+		t.Fatalf("file wasn't replaced: %s", data)
+	}
+}
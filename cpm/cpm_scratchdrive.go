@@ -0,0 +1,357 @@
+// cpm_scratchdrive.go contains the in-memory drive which is layered over
+// each of our drives when the filesystem is read-only.
+//
+// Programs which create, write, delete, or rename files see their changes
+// succeed, but they're held in memory and never reach the host, which
+// makes it safe to try unknown software.  The changes which were discarded
+// are reported when the emulator exits.
+
+package cpm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+)
+
+// WithReadOnlyFilesystem configures whether changes made by guests are
+// held in memory, rather than being written to the host.  The default is
+// to write to the host.
+func WithReadOnlyFilesystem(enabled bool) cpmoption {
+	return func(c *CPM) error {
+		c.readOnlyFS = enabled
+		return nil
+	}
+}
+
+// scratchState holds the changes made to a single drive.
+type scratchState struct {
+	// files holds the files which have been opened, or created, keyed
+	// by their CP/M name.
+	files map[string]*scratchFile
+
+	// deleted records the names of the files upon the lower drive which
+	// have been deleted, or renamed.
+	deleted map[string]bool
+}
+
+// scratchFor returns the changes made to the given drive.
+func (cpm *CPM) scratchFor(drive string) *scratchState {
+
+	if cpm.scratch == nil {
+		cpm.scratch = make(map[string]*scratchState)
+	}
+
+	s, ok := cpm.scratch[drive]
+	if !ok {
+		s = &scratchState{files: make(map[string]*scratchFile), deleted: make(map[string]bool)}
+		cpm.scratch[drive] = s
+	}
+	return s
+}
+
+// scratchDrive is a writable drive, held in memory, which is layered over
+// another drive.  Files are copied from the lower drive when they're first
+// opened, so that changes to them never reach it.
+type scratchDrive struct {
+	state *scratchState
+	drive string
+	lower Drive
+}
+
+// lowerHas returns true if the lower drive holds the given file.
+func (s scratchDrive) lowerHas(name string) bool {
+	_, err := s.lower.Stat(name)
+	return err == nil
+}
+
+// getFile returns our copy of the given file, copying it from the lower
+// drive if we don't yet have one.
+func (s scratchDrive) getFile(name string) (*scratchFile, error) {
+
+	if f, ok := s.state.files[name]; ok {
+		return f, nil
+	}
+	if s.state.deleted[name] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	file, err := s.lower.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, fi.Size())
+	n, err := file.ReadAt(data, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	f := &scratchFile{drive: s.drive, name: name, data: data[:n], modTime: fi.ModTime(), existed: true}
+	s.state.files[name] = f
+	return f, nil
+}
+
+// Open returns our copy of the file.
+func (s scratchDrive) Open(name string) (DriveFile, error) {
+	return s.getFile(name)
+}
+
+// Create returns our copy of the file, if it exists, and creates a new
+// empty file otherwise.
+func (s scratchDrive) Create(name string) (DriveFile, error) {
+
+	f, err := s.getFile(name)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+
+	f = &scratchFile{drive: s.drive, name: name, modTime: time.Now(), existed: s.state.deleted[name], dirty: true}
+	delete(s.state.deleted, name)
+	s.state.files[name] = f
+	return f, nil
+}
+
+// ReadDir returns our files, along with those upon the lower drive which
+// we haven't replaced or deleted.
+func (s scratchDrive) ReadDir() ([]fs.FileInfo, error) {
+
+	lower, err := s.lower.ReadDir()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []fs.FileInfo
+	for _, fi := range lower {
+		_, ours := s.state.files[fi.Name()]
+		if !ours && !s.state.deleted[fi.Name()] {
+			res = append(res, fi)
+		}
+	}
+	for _, f := range s.state.files {
+		fi, _ := f.Stat()
+		res = append(res, fi)
+	}
+	return res, nil
+}
+
+// Delete removes the file, hiding it if it is upon the lower drive.
+func (s scratchDrive) Delete(name string) error {
+
+	if f, ok := s.state.files[name]; ok {
+		delete(s.state.files, name)
+		if f.existed {
+			s.state.deleted[name] = true
+		}
+		return nil
+	}
+
+	if s.state.deleted[name] {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+
+	_, err := s.lower.Stat(name)
+	if err != nil {
+		return err
+	}
+	s.state.deleted[name] = true
+	return nil
+}
+
+// Rename changes the name of our copy of the file, hiding the original if
+// it is upon the lower drive.
+func (s scratchDrive) Rename(from string, to string) error {
+
+	f, err := s.getFile(from)
+	if err != nil {
+		return err
+	}
+
+	delete(s.state.files, from)
+	if f.existed {
+		s.state.deleted[from] = true
+	}
+
+	f.name = to
+	f.existed = s.lowerHas(to)
+	f.dirty = true
+	delete(s.state.deleted, to)
+	s.state.files[to] = f
+	return nil
+}
+
+// Stat returns the details of our copy of the file, if we have one, or
+// of the file upon the lower drive.
+func (s scratchDrive) Stat(name string) (fs.FileInfo, error) {
+
+	if f, ok := s.state.files[name]; ok {
+		return f.Stat()
+	}
+	if s.state.deleted[name] {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return s.lower.Stat(name)
+}
+
+// scratchFile is a writable file whose contents are held in memory.
+type scratchFile struct {
+	drive   string
+	name    string
+	data    []byte
+	modTime time.Time
+
+	// existed is true if a file with this name exists upon the lower
+	// drive, which we've replaced.
+	existed bool
+
+	// dirty is true if the file has been changed.
+	dirty bool
+}
+
+// ReadAt reads from the file at the given offset.
+func (f *scratchFile) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(f.data).ReadAt(p, off)
+}
+
+// WriteAt writes to the file at the given offset, filling any gap beyond
+// the end of the file with zeros.
+func (f *scratchFile) WriteAt(p []byte, off int64) (int, error) {
+
+	end := int(off) + len(p)
+	if end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+	copy(f.data[off:], p)
+
+	f.dirty = true
+	f.modTime = time.Now()
+	return len(p), nil
+}
+
+// Close does nothing, since there is no underlying resource.
+func (f *scratchFile) Close() error {
+	return nil
+}
+
+// Name returns the name of the file, including the drive.
+func (f *scratchFile) Name() string {
+	return f.drive + ":" + f.name
+}
+
+// Stat returns the details of the file.
+func (f *scratchFile) Stat() (fs.FileInfo, error) {
+	return scratchInfo{name: f.name, size: int64(len(f.data)), modTime: f.modTime}, nil
+}
+
+// Truncate changes the size of the file.
+func (f *scratchFile) Truncate(size int64) error {
+
+	if size < int64(len(f.data)) {
+		f.data = f.data[:size]
+	} else {
+		f.data = append(f.data, make([]byte, size-int64(len(f.data)))...)
+	}
+
+	f.dirty = true
+	f.modTime = time.Now()
+	return nil
+}
+
+// Sync does nothing, since the file is held in memory.
+func (f *scratchFile) Sync() error {
+	return nil
+}
+
+// ReadOnly returns false, since the file can always be written.
+func (f *scratchFile) ReadOnly() bool {
+	return false
+}
+
+// scratchInfo holds the details of a scratchFile.
+type scratchInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// Name returns the CP/M name of the file.
+func (i scratchInfo) Name() string { return i.name }
+
+// Size returns the size of the file.
+func (i scratchInfo) Size() int64 { return i.size }
+
+// Mode returns the permissions of the file.
+func (i scratchInfo) Mode() fs.FileMode { return 0644 }
+
+// ModTime returns the time the file was last changed.
+func (i scratchInfo) ModTime() time.Time { return i.modTime }
+
+// IsDir returns false, as we only hold files.
+func (i scratchInfo) IsDir() bool { return false }
+
+// Sys returns nil, as there is no underlying data source.
+func (i scratchInfo) Sys() any { return nil }
+
+// scratchChanges returns a description of each change which was held in
+// memory, rather than being written to the host, sorted by drive and name.
+func (cpm *CPM) scratchChanges() []string {
+
+	var res []string
+	for drive, s := range cpm.scratch {
+		for name, f := range s.files {
+			if !f.dirty {
+				continue
+			}
+			action := "created"
+			if f.existed {
+				action = "modified"
+			}
+			res = append(res, fmt.Sprintf("%s:%-12s %s (%d bytes)", drive, name, action, len(f.data)))
+		}
+		for name := range s.deleted {
+			if _, ok := s.files[name]; !ok {
+				res = append(res, fmt.Sprintf("%s:%-12s deleted", drive, name))
+			}
+		}
+	}
+
+	sort.Strings(res)
+	return res
+}
+
+// WriteReadOnlyReport writes the changes which were discarded, because
+// the filesystem is read-only, to STDERR.  Nothing is written if the
+// filesystem isn't read-only, or nothing was changed.
+func (cpm *CPM) WriteReadOnlyReport() {
+	cpm.writeReadOnlyReport(os.Stderr)
+}
+
+// writeReadOnlyReport writes the changes which were discarded, because
+// the filesystem is read-only, to the given writer.
+func (cpm *CPM) writeReadOnlyReport(out io.Writer) {
+
+	if !cpm.readOnlyFS {
+		return
+	}
+
+	changes := cpm.scratchChanges()
+	if len(changes) == 0 {
+		return
+	}
+
+	fmt.Fprintf(out, "The filesystem is read-only, so these changes were discarded:\n")
+	for _, c := range changes {
+		fmt.Fprintf(out, "  %s\n", c)
+	}
+}
@@ -0,0 +1,101 @@
+package cpm
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/skx/cpmulator/fcb"
+)
+
+// TestReadOnlyFilesystem tests that changes are held in memory, visible
+// to the guest, and reported, but never reach the host.
+func TestReadOnlyFilesystem(t *testing.T) {
+
+	c, dir := newFindTest(t, []cpmoption{WithReadOnlyFilesystem(true)}, "OLD.TXT", "KEEP.TXT", "MOVE.TXT")
+	defer c.IOTearDown()
+
+	// call invokes the given syscall with an FCB for the given name.
+	call := func(handler CPMHandlerType, name string) {
+		f := fcb.FromString(name)
+		c.Memory.SetRange(0x0200, f.AsBytes()...)
+		c.CPU.States.DE.SetU16(0x0200)
+		err := handler(c)
+		if err != nil || c.CPU.States.AF.Hi != 0x00 {
+			t.Fatalf("syscall failed for %s: %v %02X", name, err, c.CPU.States.AF.Hi)
+		}
+	}
+
+	// Create a file, and modify another.
+	c.Memory.FillRange(c.dma, 128, 'X')
+	call(BdosSysCallMakeFile, "NEW.TXT")
+	BdosSysCallWrite(c)
+	BdosSysCallFileClose(c)
+
+	call(BdosSysCallFileOpen, "OLD.TXT")
+	BdosSysCallWrite(c)
+	BdosSysCallFileClose(c)
+
+	// Delete one file, and rename another.
+	call(BdosSysCallDeleteFile, "KEEP.TXT")
+
+	src := fcb.FromString("MOVE.TXT")
+	dst := fcb.FromString("MOVED.TXT")
+	c.Memory.SetRange(0x0200, src.AsBytes()...)
+	c.Memory.SetRange(0x0210, dst.AsBytes()[:16]...)
+	c.CPU.States.DE.SetU16(0x0200)
+	err := BdosSysCallRenameFile(c)
+	if err != nil || c.CPU.States.AF.Hi != 0x00 {
+		t.Fatalf("failed to rename")
+	}
+
+	// The guest sees the changes.
+	all := fcb.FromString("*.*")
+	c.Memory.SetRange(0x0300, all.AsBytes()...)
+	found := []string{findCall(t, c, true, 0x0300)}
+	for {
+		name := findCall(t, c, false, 0x0300)
+		if name == "" {
+			break
+		}
+		found = append(found, name)
+	}
+	if strings.Join(found, ",") != "MOVED.TXT,NEW.TXT,OLD.TXT" {
+		t.Fatalf("wrong files seen by the guest: %v", found)
+	}
+
+	// The host does not.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read directory: %s", err)
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if strings.Join(names, ",") != "KEEP.TXT,MOVE.TXT,OLD.TXT" {
+		t.Fatalf("host directory was changed: %v", names)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "OLD.TXT"))
+	if string(data) != "data" {
+		t.Fatalf("host file was changed: %q", data)
+	}
+
+	// The changes are reported.
+	var out bytes.Buffer
+	c.writeReadOnlyReport(&out)
+
+	for _, expected := range []string{
+		"A:KEEP.TXT     deleted",
+		"A:MOVE.TXT     deleted",
+		"A:MOVED.TXT    created (4 bytes)",
+		"A:NEW.TXT      created (128 bytes)",
+		"A:OLD.TXT      modified (128 bytes)",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("report didn't contain %q:\n%s", expected, out.String())
+		}
+	}
+}
@@ -0,0 +1,312 @@
+// cpm_snapshot.go contains the export, and import, of the files upon our
+// drives as a gzipped tar archive, so that a session may be moved to
+// another machine, or attached to a bug report.
+//
+// The archive holds a directory for each drive, containing the files of
+// the host directory it is mapped to, along with state.json which records
+// the drives.  Drives which share a host directory, as they do by default,
+// are stored once, and state.json records the drive each was stored as.
+//
+// Only the files at the top of each directory are stored, as those are
+// all the guest can see, including our alias tables for long filenames.
+// Our user areas share the files upon each drive, so there is nothing
+// more to record for them.
+//
+// Drives mounted from ZIP archives only contain the files written to their
+// overlay directory, and changes held in memory, when the filesystem is
+// read-only, are not included.
+
+package cpm
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// snapshotState is the name of the file, within our archives, which
+// records the drives they contain.
+const snapshotState = "state.json"
+
+// snapshotVersion is the version of the archives we write.
+const snapshotVersion = 1
+
+// snapshotInfo is the contents of snapshotState.
+type snapshotInfo struct {
+
+	// Version is the version of the archive format.
+	Version int `json:"version"`
+
+	// Drives maps each drive letter to the directory, within the
+	// archive, which holds its files.
+	Drives map[string]string `json:"drives"`
+}
+
+// ExportState writes the files upon each of our drives to the given path,
+// as a gzipped tar archive.
+func (cpm *CPM) ExportState(dest string) error {
+
+	// Ensure the guest's writes have reached the host.
+	cpm.flushFiles()
+
+	info := snapshotInfo{Version: snapshotVersion, Drives: make(map[string]string)}
+
+	paths := cpm.GetDrivePaths()
+
+	// Find the distinct directories we're storing.
+	stored := make(map[string]string)
+	letters := []string{}
+	for i := 0; i < 16; i++ {
+		drive := string(rune('A' + i))
+		dir := paths[drive]
+		if dir == "" {
+			continue
+		}
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			continue
+		}
+
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		if prev, ok := stored[abs]; ok {
+			info.Drives[drive] = prev
+			continue
+		}
+		stored[abs] = drive
+		info.Drives[drive] = drive
+		letters = append(letters, drive)
+	}
+
+	file, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+
+	state, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeTarFile(tw, snapshotState, state, 0644)
+	if err != nil {
+		return err
+	}
+
+	for _, drive := range letters {
+		err = exportDirectory(tw, drive, paths[drive])
+		if err != nil {
+			return fmt.Errorf("failed to export drive %s: %w", drive, err)
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	err = gz.Close()
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// exportDirectory writes the files at the top of the given directory to
+// our archive, beneath the given prefix.
+func exportDirectory(tw *tar.Writer, prefix string, dir string) error {
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for _, ent := range entries {
+		if ent.Type().IsRegular() {
+			names = append(names, ent.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+
+		mode := int64(0644)
+		if fi, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			mode = int64(fi.Mode().Perm())
+		}
+
+		err = writeTarFile(tw, prefix+"/"+name, data, mode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTarFile adds a single file to the given archive.
+func writeTarFile(tw *tar.Writer, name string, data []byte, mode int64) error {
+
+	err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     mode,
+		Size:     int64(len(data)),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// ImportState restores the files, from an archive written by ExportState,
+// to the host directories our drives are mapped to.
+//
+// Existing files with the same names are replaced, others are untouched.
+func (cpm *CPM) ImportState(src string) error {
+
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", src, err)
+	}
+	defer gz.Close()
+
+	// Read everything before changing anything, so that a corrupt
+	// archive leaves our drives untouched.
+	var info *snapshotInfo
+	files := make(map[string][]byte)
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", src, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", hdr.Name, err)
+		}
+
+		if hdr.Name == snapshotState {
+			info = &snapshotInfo{}
+			err = json.Unmarshal(data, info)
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %w", snapshotState, err)
+			}
+			if info.Version != snapshotVersion {
+				return fmt.Errorf("unsupported archive version %d", info.Version)
+			}
+			continue
+		}
+
+		if !validSnapshotName(hdr.Name) {
+			return fmt.Errorf("invalid filename %s in archive", hdr.Name)
+		}
+		files[hdr.Name] = data
+	}
+
+	// Without our state each directory restores the drive it is named
+	// after.
+	targets := make(map[string][]string)
+	if info != nil {
+		for drive, dir := range info.Drives {
+			targets[dir] = append(targets[dir], drive)
+		}
+	}
+
+	// Each file is written once, even if several drives share the
+	// same host directory.
+	written := make(map[string]bool)
+	paths := cpm.GetDrivePaths()
+
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		dir, base := path.Split(name)
+		dir = strings.TrimSuffix(dir, "/")
+
+		drives := targets[dir]
+		if info == nil {
+			drives = []string{dir}
+		}
+
+		for _, drive := range drives {
+			hostDir := paths[drive]
+			if hostDir == "" {
+				continue
+			}
+
+			dest := filepath.Join(hostDir, base)
+			if abs, err := filepath.Abs(dest); err == nil {
+				dest = abs
+			}
+			if written[dest] {
+				continue
+			}
+			written[dest] = true
+
+			err = os.MkdirAll(hostDir, 0755)
+			if err != nil {
+				return err
+			}
+			err = os.WriteFile(dest, files[name], 0644)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Anything we had cached is now out of date.
+	for i := 0; i < 16; i++ {
+		cpm.invalidateDrive(string(rune('A' + i)))
+	}
+	cpm.invalidateDirCache()
+	return nil
+}
+
+// validSnapshotName returns true if the given name, from an archive, is a
+// file within the directory of a drive, A-P, rather than a path which
+// could escape it.
+func validSnapshotName(name string) bool {
+
+	dir, base, ok := strings.Cut(name, "/")
+	if !ok || len(dir) != 1 || dir[0] < 'A' || dir[0] > 'P' {
+		return false
+	}
+	if base == "" || base == "." || base == ".." || strings.ContainsAny(base, "/\\:") {
+		return false
+	}
+	return true
+}
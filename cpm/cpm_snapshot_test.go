@@ -0,0 +1,176 @@
+package cpm
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestExportImportState ensures that the files upon our drives survive a
+// round-trip through an archive.
+func TestExportImportState(t *testing.T) {
+
+	// Drives which aren't given a path use the current directory.
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get directory: %s", err)
+	}
+	defer os.Chdir(cwd)
+
+	setup := func() (*CPM, string, string) {
+		err := os.Chdir(t.TempDir())
+		if err != nil {
+			t.Fatalf("failed to change directory: %s", err)
+		}
+
+		a := t.TempDir()
+		b := t.TempDir()
+
+		obj, err := New()
+		if err != nil {
+			t.Fatalf("failed to create CPM: %s", err)
+		}
+		obj.SetDrives(false)
+		obj.SetDrivePath("A", a)
+		obj.SetDrivePath("B", b)
+		obj.SetDrivePath("C", a)
+		return obj, a, b
+	}
+
+	obj, a, b := setup()
+
+	files := map[string]string{
+		filepath.Join(a, "HELLO.TXT"):   "Hello, world\r\n",
+		filepath.Join(a, longNameTable): "README~1.TXT readme.txt\n",
+		filepath.Join(b, "DATA.BIN"):    "\x00\x01\x02",
+	}
+	for path, data := range files {
+		err = os.WriteFile(path, []byte(data), 0644)
+		if err != nil {
+			t.Fatalf("failed to write file: %s", err)
+		}
+	}
+
+	// Subdirectories can't be seen by the guest, so aren't stored.
+	err = os.Mkdir(filepath.Join(b, "SUB"), 0755)
+	if err != nil {
+		t.Fatalf("failed to create directory: %s", err)
+	}
+
+	archive := filepath.Join(t.TempDir(), "state.tar.gz")
+	err = obj.ExportState(archive)
+	if err != nil {
+		t.Fatalf("failed to export: %s", err)
+	}
+
+	// A: and C: share a directory, so it is stored once.
+	names := archiveNames(t, archive)
+	expected := []string{snapshotState, "A/" + longNameTable, "A/HELLO.TXT", "B/DATA.BIN"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected archive contents %v", names)
+	}
+
+	// Restore into a fresh set of directories.
+	obj, a2, b2 := setup()
+	err = obj.ImportState(archive)
+	if err != nil {
+		t.Fatalf("failed to import: %s", err)
+	}
+
+	for path, data := range files {
+		path = strings.Replace(path, a, a2, 1)
+		path = strings.Replace(path, b, b2, 1)
+
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", path, err)
+		}
+		if string(got) != data {
+			t.Fatalf("%s has contents %q, expected %q", path, got, data)
+		}
+	}
+
+	// The current directory, used by the other drives, is untouched.
+	entries, err := os.ReadDir(".")
+	if err != nil {
+		t.Fatalf("failed to read directory: %s", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("unexpected files restored to the current directory")
+	}
+}
+
+// TestImportStateInvalid ensures that archives which would write outside
+// our drives are rejected.
+func TestImportStateInvalid(t *testing.T) {
+
+	dir := t.TempDir()
+
+	obj, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	obj.SetDrives(false)
+	obj.SetDrivePath("A", dir)
+
+	for _, name := range []string{"A/../evil", "../evil", "Q/FILE", "A/SUB/FILE", "A/..", "FILE"} {
+
+		archive := filepath.Join(t.TempDir(), "bad.tar.gz")
+
+		f, err := os.Create(archive)
+		if err != nil {
+			t.Fatalf("failed to create archive: %s", err)
+		}
+		gz := gzip.NewWriter(f)
+		tw := tar.NewWriter(gz)
+		err = writeTarFile(tw, name, []byte("evil"), 0644)
+		if err != nil {
+			t.Fatalf("failed to write archive: %s", err)
+		}
+		tw.Close()
+		gz.Close()
+		f.Close()
+
+		err = obj.ImportState(archive)
+		if err == nil {
+			t.Fatalf("expected error importing %s", name)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read directory: %s", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("files were written from invalid archives")
+	}
+}
+
+// archiveNames returns the names of the files in the given archive.
+func archiveNames(t *testing.T, path string) []string {
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open archive: %s", err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("failed to read archive: %s", err)
+	}
+
+	var names []string
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	return names
+}
@@ -0,0 +1,249 @@
+// cpm_symbols.go contains the loading of symbol files, which allow the
+// addresses within a program to be shown as the labels of its source.
+//
+// When a binary is loaded via LoadBinary, or launched by the CCP, we look
+// for a .SYM file with the same name next to it, such as HELLO.SYM for
+// HELLO.COM, and if one is found its symbols are used by our monitor, in
+// crash reports, and when watchpoints trigger.
+//
+// Two formats are understood:
+//
+//   - That written by LINK, L80, and ZSID, which is a series of
+//     whitespace-separated pairs, each a hex address followed by a name,
+//     such as "0100 START  0103 LOOP", ending at the first Ctrl-Z.
+//
+//   - That written by more modern assemblers, which is a line for each
+//     symbol, such as "LOOP EQU 0103H", "LOOP: equ $0103", or
+//     "LOOP = 0x0103".
+//
+// Symbols are dropped when the next program is loaded.
+
+package cpm
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// symbolReach is the furthest an address may be beyond a symbol for it to
+// be described relative to it, as "NAME+0x12".
+const symbolReach = 0x0400
+
+// parseSymbols parses the contents of a symbol file, returning a map of
+// addresses to names.
+//
+// Where several symbols share an address the first is used.
+func parseSymbols(data []byte) (map[uint16]string, error) {
+
+	// The file ends at the first Ctrl-Z.
+	if i := bytes.IndexByte(data, 0x1A); i >= 0 {
+		data = data[:i]
+	}
+
+	symbols := make(map[uint16]string)
+	add := func(addr uint16, name string) {
+		name = strings.TrimSuffix(name, ":")
+		if name == "" {
+			return
+		}
+		if _, ok := symbols[addr]; !ok {
+			symbols[addr] = name
+		}
+	}
+
+	for n, line := range strings.Split(string(data), "\n") {
+
+		fields := strings.Fields(strings.ReplaceAll(line, "=", " = "))
+		if len(fields) == 0 {
+			continue
+		}
+
+		// "NAME EQU VALUE", or "NAME = VALUE".
+		if len(fields) == 3 && (strings.EqualFold(fields[1], "EQU") || fields[1] == "=") {
+			val, err := parseSymbolValue(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid value '%s'", n+1, fields[2])
+			}
+			add(val, fields[0])
+			continue
+		}
+
+		// "ADDR NAME" pairs.
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("line %d: expected address and name pairs", n+1)
+		}
+		for i := 0; i < len(fields); i += 2 {
+			val, err := strconv.ParseUint(fields[i], 16, 16)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid address '%s'", n+1, fields[i])
+			}
+			add(uint16(val), fields[i+1])
+		}
+	}
+
+	return symbols, nil
+}
+
+// parseSymbolValue parses the value of an EQU, which may be hex, written
+// as "0103H", "$0103", "#0103", or "0x0103", or decimal.
+func parseSymbolValue(str string) (uint16, error) {
+
+	base := 10
+	upper := strings.ToUpper(str)
+
+	switch {
+	case strings.HasPrefix(upper, "0X"):
+		str, base = str[2:], 16
+	case strings.HasPrefix(str, "$"), strings.HasPrefix(str, "#"):
+		str, base = str[1:], 16
+	case strings.HasSuffix(upper, "H"):
+		str, base = str[:len(str)-1], 16
+	}
+
+	val, err := strconv.ParseUint(str, base, 16)
+	return uint16(val), err
+}
+
+// symbolName returns the name of the symbol file for the given binary,
+// which has the same name, but a .SYM suffix.
+func symbolName(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".SYM"
+}
+
+// setSymbols replaces the symbols in use, logging where they came from.
+func (cpm *CPM) setSymbols(source string, data []byte) {
+
+	cpm.symbols = nil
+
+	symbols, err := parseSymbols(data)
+	if err != nil {
+		slog.Warn("failed to parse symbol file",
+			slog.String("path", source),
+			slog.String("error", err.Error()))
+		return
+	}
+
+	slog.Debug("loaded symbols",
+		slog.String("path", source),
+		slog.Int("count", len(symbols)))
+
+	cpm.symbols = symbols
+}
+
+// loadSymbols loads the symbols for the binary with the given host path,
+// from the .SYM file next to it, if there is one.
+func (cpm *CPM) loadSymbols(filename string) {
+
+	cpm.symbols = nil
+
+	// The suffix might be in either case.
+	dir := filepath.Dir(filename)
+	want := symbolName(filepath.Base(filename))
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !strings.EqualFold(entry.Name(), want) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err == nil {
+			cpm.setSymbols(path, data)
+		}
+		return
+	}
+}
+
+// loadCommandSymbols loads the symbols for the program the CCP launched,
+// named by the given command, such as "B:DUMP", from the .SYM file upon
+// the same drive, if there is one.
+//
+// Programs which aren't upon the current drive are also looked for upon
+// A:, as the CCP does.
+func (cpm *CPM) loadCommandSymbols(command string) {
+
+	cpm.symbols = nil
+
+	drives := []string{string(rune('A' + cpm.currentDrive)), "A"}
+	if drive, name, ok := strings.Cut(command, ":"); ok {
+		command = name
+		drives = drives[:0]
+		if len(drive) > 0 && drive[0] >= 'A' && drive[0] <= 'P' {
+			drives = append(drives, drive[:1])
+		} else {
+			drives = append(drives, string(rune('A'+cpm.currentDrive)))
+		}
+	}
+	if command == "" {
+		return
+	}
+
+	name := symbolName(command)
+	for _, drive := range drives {
+		if _, ok := cpm.drives[drive]; !ok {
+			continue
+		}
+		data, err := cpm.readDriveFile(drive, name)
+		if err == nil {
+			cpm.setSymbols(drive+":"+name, data)
+			return
+		}
+	}
+}
+
+// symbolFor describes the given address relative to the nearest symbol
+// at, or before, it, such as "LOOP" or "LOOP+0x12".
+//
+// The empty string is returned if there is no such symbol close enough.
+func (cpm *CPM) symbolFor(addr uint16) string {
+
+	best := -1
+	for val := range cpm.symbols {
+		if val <= addr && int(val) > best {
+			best = int(val)
+		}
+	}
+	if best < 0 || int(addr)-best > symbolReach {
+		return ""
+	}
+
+	name := cpm.symbols[uint16(best)]
+	if int(addr) == best {
+		return name
+	}
+	return fmt.Sprintf("%s+0x%02X", name, int(addr)-best)
+}
+
+// symbolAddress returns the address of the named symbol, which is matched
+// regardless of case.
+func (cpm *CPM) symbolAddress(name string) (uint16, bool) {
+
+	for val, sym := range cpm.symbols {
+		if strings.EqualFold(sym, name) {
+			return val, true
+		}
+	}
+	return 0, false
+}
+
+// sortedSymbols returns the addresses of our symbols, in order.
+func (cpm *CPM) sortedSymbols() []uint16 {
+
+	addrs := []uint16{}
+	for val := range cpm.symbols {
+		addrs = append(addrs, val)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i] < addrs[j]
+	})
+	return addrs
+}
@@ -0,0 +1,151 @@
+package cpm
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestParseSymbols tests the parsing of the symbol file formats we
+// understand.
+func TestParseSymbols(t *testing.T) {
+
+	type TestCase struct {
+		input   string
+		symbols map[uint16]string
+	}
+
+	tests := []TestCase{
+		{"0100 START\t0103 LOOP\r\n0110 MSG\r\n\x1a0200 JUNK", map[uint16]string{0x0100: "START", 0x0103: "LOOP", 0x0110: "MSG"}},
+		{"START EQU 0100H\nloop: equ $0103\nMSG = 0x0110\nCOUNT EQU 16\n", map[uint16]string{0x0100: "START", 0x0103: "loop", 0x0110: "MSG", 0x0010: "COUNT"}},
+		{"0100 FIRST 0100 SECOND", map[uint16]string{0x0100: "FIRST"}},
+		{"", map[uint16]string{}},
+	}
+
+	for _, test := range tests {
+		out, err := parseSymbols([]byte(test.input))
+		if err != nil {
+			t.Fatalf("failed to parse %q: %s", test.input, err)
+		}
+		if len(out) != len(test.symbols) {
+			t.Fatalf("%q: unexpected symbols %v", test.input, out)
+		}
+		for addr, name := range test.symbols {
+			if out[addr] != name {
+				t.Fatalf("%q: unexpected symbols %v", test.input, out)
+			}
+		}
+	}
+
+	for _, bad := range []string{"0100", "XYZ START", "START EQU FOO"} {
+		_, err := parseSymbols([]byte(bad))
+		if err == nil {
+			t.Fatalf("expected an error parsing %q", bad)
+		}
+	}
+}
+
+// TestSymbols ensures that symbols are loaded from the .SYM file next to a
+// binary, and are used by the monitor, and crash reports.
+func TestSymbols(t *testing.T) {
+
+	obj, err := New(WithOutputDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	defer obj.IOTearDown()
+
+	dir := t.TempDir()
+	err = os.WriteFile(filepath.Join(dir, "HALT.COM"), []byte{0x00, 0x00, 0x76}, 0644)
+	if err != nil {
+		t.Fatalf("failed to write program: %s", err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "halt.sym"), []byte("0100 START\r\n0102 STOP\r\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write symbols: %s", err)
+	}
+
+	err = obj.LoadBinary(filepath.Join(dir, "HALT.COM"))
+	if err != nil {
+		t.Fatalf("failed to load program: %s", err)
+	}
+	if len(obj.symbols) != 2 {
+		t.Fatalf("symbols weren't loaded: %v", obj.symbols)
+	}
+
+	if obj.symbolFor(0x0101) != "START+0x01" || obj.symbolFor(0x0102) != "STOP" || obj.symbolFor(0x00FF) != "" || obj.symbolFor(0x0800) != "" {
+		t.Fatalf("unexpected symbol lookups")
+	}
+
+	// Symbols may be used as addresses, and are shown as labels.
+	out := &bytes.Buffer{}
+	_, err = obj.monitorCommand(out, "disasm stop 1")
+	if err != nil || !strings.Contains(out.String(), "STOP:\n0102") {
+		t.Fatalf("unexpected disassembly %q %v", out.String(), err)
+	}
+	out.Reset()
+	_, err = obj.monitorCommand(out, "syms st")
+	if err != nil || out.String() != "0100  START\n0102  STOP\n" {
+		t.Fatalf("unexpected symbols %q %v", out.String(), err)
+	}
+
+	// The crash report shows where we stopped.
+	err = obj.Execute([]string{})
+	if err != ErrHalt {
+		t.Fatalf("unexpected error %v", err)
+	}
+	out.Reset()
+	obj.writeCrashReport(out, err)
+	if !strings.Contains(out.String(), "PC is at STOP") {
+		t.Fatalf("crash report doesn't name the symbol:\n%s", out.String())
+	}
+
+	// Binaries without a symbol file have no symbols.
+	err = os.Remove(filepath.Join(dir, "halt.sym"))
+	if err != nil {
+		t.Fatalf("failed to remove symbols: %s", err)
+	}
+	err = obj.LoadBinary(filepath.Join(dir, "HALT.COM"))
+	if err != nil || obj.symbols != nil {
+		t.Fatalf("symbols weren't dropped %v %v", obj.symbols, err)
+	}
+	out.Reset()
+	_, err = obj.monitorCommand(out, "syms")
+	if err != nil || out.String() != "No symbols are loaded\n" {
+		t.Fatalf("unexpected output %q %v", out.String(), err)
+	}
+}
+
+// TestCommandSymbols ensures that symbols are found for programs which
+// the CCP launches.
+func TestCommandSymbols(t *testing.T) {
+
+	obj, err := New(WithOutputDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	defer obj.IOTearDown()
+
+	dir := t.TempDir()
+	obj.SetDrives(false)
+	obj.SetDrivePath("A", dir)
+	obj.SetDrivePath("B", t.TempDir())
+
+	err = os.WriteFile(filepath.Join(dir, "DUMP.SYM"), []byte("0100 MAIN\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write symbols: %s", err)
+	}
+
+	for _, command := range []string{"DUMP", "A:DUMP", "B:DUMP", "A3:DUMP.COM", "MISSING", ""} {
+		obj.currentDrive = 1
+		obj.loadCommandSymbols(command)
+
+		found := obj.symbols[0x0100] == "MAIN"
+		expected := command == "DUMP" || command == "A:DUMP" || command == "A3:DUMP.COM"
+		if found != expected {
+			t.Fatalf("%s: unexpected symbols %v", command, obj.symbols)
+		}
+	}
+}
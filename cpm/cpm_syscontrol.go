@@ -0,0 +1,140 @@
+// cpm_syscontrol.go contains our emulation of the CP/M 3 System Control Block.
+//
+// The SCB is a small region of memory which contains system variables,
+// some CP/M 3 programs read it, via BDOS function 49, to discover
+// things like the console width, and the current drive.
+//
+// We keep the SCB in the (otherwise unused) memory above our fake BDOS,
+// and synchronize the fields which correspond to our emulator state
+// whenever it is accessed.
+//
+// The layout is documented here:
+//
+// * https://www.seasip.info/Cpm/scb.html
+
+package cpm
+
+import (
+	"time"
+)
+
+const (
+	// scbOffset is the offset of the SCB from the BDOS address.
+	scbOffset = 0x0100
+
+	// scbSize is the size of the SCB, in bytes.
+	scbSize = 0x64
+
+	// Offsets of the fields we maintain within the SCB.
+	scbVersion       = 0x05
+	scbReturnCode    = 0x10
+	scbConsoleWidth  = 0x1A
+	scbConsoleColumn = 0x1B
+	scbConsolePage   = 0x1C
+	scbConsoleMode   = 0x33
+	scbOutputDelim   = 0x37
+	scbListOutput    = 0x38
+	scbBaseAddress   = 0x3A
+	scbDMA           = 0x3C
+	scbCurrentDisk   = 0x3E
+	scbUserNumber    = 0x44
+	scbErrorMode     = 0x4B
+	scbDateDays      = 0x58
+	scbDateHour      = 0x5A
+	scbDateMinute    = 0x5B
+	scbDateSecond    = 0x5C
+	scbTopOfTPA      = 0x62
+)
+
+// scbAddress returns the address of the SCB in RAM.
+func (cpm *CPM) scbAddress() uint16 {
+	return cpm.bdosAddress + scbOffset
+}
+
+// scbSync updates the SCB in RAM to reflect our current state.
+func (cpm *CPM) scbSync() {
+
+	base := cpm.scbAddress()
+
+	set := func(offset uint16, val uint8) {
+		cpm.Memory.Set(base+offset, val)
+	}
+	setWord := func(offset uint16, val uint16) {
+		cpm.Memory.Set(base+offset, uint8(val&0xFF))
+		cpm.Memory.Set(base+offset+1, uint8(val>>8))
+	}
+	bcd := func(val int) uint8 {
+		return uint8((val/10)<<4 | (val % 10))
+	}
+
+	// Default to a typical terminal if we can't find the size.
+	width, height, err := cpm.getTerminalSize()
+	if err != nil || width < 1 || height < 1 {
+		width, height = 80, 24
+	}
+
+	set(scbVersion, 0x22)
+	setWord(scbReturnCode, cpm.returnCode)
+	set(scbConsoleWidth, uint8(width-1))
+	set(scbConsoleColumn, uint8(cpm.output.GetColumn()))
+	set(scbConsolePage, uint8(height))
+	setWord(scbConsoleMode, cpm.consoleMode)
+	set(scbOutputDelim, cpm.delimiter)
+
+	if cpm.printerEcho {
+		set(scbListOutput, 0x01)
+	} else {
+		set(scbListOutput, 0x00)
+	}
+
+	setWord(scbBaseAddress, base)
+	setWord(scbDMA, cpm.dma)
+	set(scbCurrentDisk, cpm.currentDrive)
+	set(scbUserNumber, cpm.userNumber)
+	set(scbErrorMode, cpm.errorMode)
+
+	// Date is days since 1978-01-01, which is day 1.
+	now := cpm.now()
+	epoch := time.Date(1978, 1, 1, 0, 0, 0, 0, now.Location())
+	days := int(now.Sub(epoch).Hours()/24) + 1
+	setWord(scbDateDays, uint16(days))
+	set(scbDateHour, bcd(now.Hour()))
+	set(scbDateMinute, bcd(now.Minute()))
+	set(scbDateSecond, bcd(now.Second()))
+
+	// The top of the TPA is the BDOS entry-point.
+	setWord(scbTopOfTPA, cpm.bdosAddress+6)
+}
+
+// scbApply updates our state after a guest has changed the value
+// at the given offset in the SCB.
+//
+// Only a small number of fields may be changed, changes to the others
+// are stored, but ignored.
+func (cpm *CPM) scbApply(offset uint16) {
+
+	base := cpm.scbAddress()
+
+	get := func(offset uint16) uint8 {
+		return cpm.Memory.Get(base + offset)
+	}
+
+	switch offset {
+	case scbReturnCode, scbReturnCode + 1:
+		cpm.returnCode = cpm.Memory.GetU16(base + scbReturnCode)
+	case scbConsoleMode, scbConsoleMode + 1:
+		cpm.consoleMode = cpm.Memory.GetU16(base + scbConsoleMode)
+	case scbOutputDelim:
+		cpm.delimiter = get(scbOutputDelim)
+	case scbListOutput:
+		cpm.printerEcho = get(scbListOutput) != 0
+	case scbDMA, scbDMA + 1:
+		cpm.dma = cpm.Memory.GetU16(base + scbDMA)
+	case scbCurrentDisk:
+		cpm.currentDrive = get(scbCurrentDisk) & 0x0F
+	case scbUserNumber:
+		cpm.userNumber = get(scbUserNumber) & 0x0F
+	case scbErrorMode:
+		cpm.errorMode = get(scbErrorMode)
+	}
+}
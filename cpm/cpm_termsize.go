@@ -0,0 +1,105 @@
+// cpm_termsize.go contains the code which tracks the size of the host
+// terminal, so that guests can query it, and learn about resizes.
+
+package cpm
+
+import (
+	"os"
+
+	"golang.org/x/term"
+)
+
+// hostTerminalSize returns the width and height of the host terminal.
+//
+// This is a variable so that it may be replaced by our tests.
+var hostTerminalSize = func() (int, int, error) {
+	return term.GetSize(int(os.Stdin.Fd()))
+}
+
+// getTerminalSize returns the width and height of the terminal which
+// should be reported to guests.
+//
+// If a fixed size has been configured that is returned, otherwise
+// we'll return the most recently seen size of the host terminal.
+func (cpm *CPM) getTerminalSize() (int, int, error) {
+
+	// A fixed size always wins.
+	if cpm.termWidth > 0 && cpm.termHeight > 0 {
+		return cpm.termWidth, cpm.termHeight, nil
+	}
+
+	cpm.sizeMutex.Lock()
+	defer cpm.sizeMutex.Unlock()
+
+	// If we've not yet seen the size, or we're not tracking
+	// resizes, then query it now.
+	if cpm.stopResize == nil || cpm.sizeWidth == 0 || cpm.sizeHeight == 0 {
+		width, height, err := hostTerminalSize()
+		if err != nil {
+			return width, height, err
+		}
+		cpm.sizeWidth = width
+		cpm.sizeHeight = height
+	}
+
+	return cpm.sizeWidth, cpm.sizeHeight, nil
+}
+
+// updateTerminalSize is called when the host terminal has been resized,
+// it records the new size, and notes that it has changed.
+//
+// It is also called when we start watching for resizes, to record the
+// initial size, which isn't a change.
+func (cpm *CPM) updateTerminalSize() {
+
+	width, height, err := hostTerminalSize()
+	if err != nil {
+		return
+	}
+
+	cpm.sizeMutex.Lock()
+	defer cpm.sizeMutex.Unlock()
+
+	// If we'd not seen the size before this isn't a change.
+	if cpm.sizeWidth != 0 && (width != cpm.sizeWidth || height != cpm.sizeHeight) {
+		cpm.sizeChanged = true
+	}
+	cpm.sizeWidth = width
+	cpm.sizeHeight = height
+}
+
+// terminalSizeChanged returns true if the terminal has been resized
+// since the last time this function was called.
+func (cpm *CPM) terminalSizeChanged() bool {
+
+	cpm.sizeMutex.Lock()
+	defer cpm.sizeMutex.Unlock()
+
+	changed := cpm.sizeChanged
+	cpm.sizeChanged = false
+	return changed
+}
+
+// syncScreenSize passes the size of the terminal to our output driver,
+// which uses it when tracking the position of the cursor.
+func (cpm *CPM) syncScreenSize() {
+	width, height, err := cpm.getTerminalSize()
+	if err == nil && width > 0 && height > 0 {
+		cpm.output.SetScreenSize(width, height)
+	}
+}
+
+// GetCursorPosition returns the row, and column, of the cursor, starting
+// from zero, as tracked by our output driver.
+//
+// If the driver doesn't track the cursor false is returned, along with
+// the column we track for TAB expansion.
+func (cpm *CPM) GetCursorPosition() (int, int, bool) {
+	cpm.syncScreenSize()
+
+	row, col, ok := cpm.output.GetCursor()
+	if !ok {
+		return 0, cpm.output.GetColumn(), false
+	}
+	return row, col, true
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package cpm
+
+// watchTerminalSize is a NOP on systems without SIGWINCH.
+//
+// Guests will still receive the terminal size, but it will not
+// be updated if the terminal is resized.
+func (cpm *CPM) watchTerminalSize() func() {
+	return func() {}
+}
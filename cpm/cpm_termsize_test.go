@@ -0,0 +1,53 @@
+package cpm
+
+import (
+	"testing"
+
+	"github.com/skx/cpmulator/consolein"
+)
+
+// TestTerminalResize ensures the first resize of the host terminal is
+// noticed, even if the guest hasn't yet asked for its size.
+func TestTerminalResize(t *testing.T) {
+
+	orig := hostTerminalSize
+	defer func() {
+		hostTerminalSize = orig
+	}()
+
+	width, height := 80, 24
+	hostTerminalSize = func() (int, int, error) {
+		return width, height, nil
+	}
+
+	obj, err := New(WithOutputDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	obj.input = consolein.NewFromDriver(&keyInput{})
+
+	obj.IOSetup()
+	defer obj.IOTearDown()
+
+	// Watching for resizes isn't a resize.
+	if obj.terminalSizeChanged() {
+		t.Fatalf("terminal size changed unexpectedly")
+	}
+
+	// A resize to the same size isn't a change either.
+	obj.updateTerminalSize()
+	if obj.terminalSizeChanged() {
+		t.Fatalf("terminal size changed unexpectedly")
+	}
+
+	// But the first real resize is.
+	width, height = 100, 30
+	obj.updateTerminalSize()
+	if !obj.terminalSizeChanged() {
+		t.Fatalf("the first resize was ignored")
+	}
+	w, h, err := obj.getTerminalSize()
+	if err != nil || w != 100 || h != 30 {
+		t.Fatalf("wrong terminal size %dx%d %v", w, h, err)
+	}
+}
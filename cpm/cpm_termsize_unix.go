@@ -0,0 +1,37 @@
+//go:build unix
+
+package cpm
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchTerminalSize launches a goroutine which will update our record
+// of the terminal size whenever SIGWINCH is received.
+//
+// The returned function should be called to stop watching.
+func (cpm *CPM) watchTerminalSize() func() {
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGWINCH)
+
+	done := make(chan bool)
+
+	go func() {
+		for {
+			select {
+			case <-ch:
+				cpm.updateTerminalSize()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
@@ -1,10 +1,22 @@
 package cpm
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/skx/cpmulator/consolein"
+	"github.com/skx/cpmulator/consoleout"
+	"github.com/skx/cpmulator/fcb"
 	"github.com/skx/cpmulator/memory"
+	"github.com/skx/cpmulator/rotate"
 )
 
 // TestSimple ensures the most basic program runs
@@ -190,16 +202,153 @@ func TestPrinterOutput(t *testing.T) {
 		t.Fatalf("failed to write character to printer-file")
 	}
 
-	// Read back the file.
+	// Output is buffered until the line is complete
 	var data []byte
 	data, err = os.ReadFile(file.Name())
 	if err != nil {
 		t.Fatalf("failed to read from file")
 	}
+	if len(data) != 0 {
+		t.Fatalf("printer output was written before it was flushed")
+	}
+
+	// Tearing down flushes the output.
+	obj.IOTearDown()
+
+	// Read back the file.
+	data, err = os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("failed to read from file")
+	}
 
 	if string(data) != "skx" {
 		t.Fatalf("printer output had the wrong content")
 	}
+
+	// A newline writes the output immediately.
+	for _, c := range "ok\r\n" {
+		err = obj.prnC(uint8(c))
+		if err != nil {
+			t.Fatalf("failed to write character to printer-file")
+		}
+	}
+	data, err = os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("failed to read from file")
+	}
+	if string(data) != "skxok\r\n" {
+		t.Fatalf("printer output had the wrong content: %q", data)
+	}
+}
+
+// TestPrinterRotation tests that the printer file is rotated once it would
+// exceed its limit.
+func TestPrinterRotation(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "print.log")
+
+	obj, err := New(WithPrinterPath(path), WithPrinterRotation(rotate.Limit{MaxSize: 10, Keep: 1}))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+
+	for _, c := range "first\nsecond\nthird\n" {
+		err = obj.prnC(uint8(c))
+		if err != nil {
+			t.Fatalf("failed to write character to printer-file")
+		}
+	}
+
+	for name, content := range map[string]string{path: "third\n", path + ".1": "second\n"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", name, err)
+		}
+		if string(data) != content {
+			t.Fatalf("%s contains %q, expected %q", name, data, content)
+		}
+	}
+}
+
+// TestListDevices tests that printer output is written to the device
+// selected by the IOByte.
+func TestListDevices(t *testing.T) {
+
+	dir := t.TempDir()
+	defPath := filepath.Join(dir, "default.prn")
+	lptPath := filepath.Join(dir, "lpt.prn")
+	pipePath := filepath.Join(dir, "pipe.prn")
+
+	// Invalid devices, and destinations, are rejected.
+	for _, invalid := range [][]string{
+		{"PUN", "null"},
+		{"LPT", "steve"},
+		{"LPT", "file:"},
+		{"LPT", "null:foo"},
+	} {
+		_, err := New(WithListDevice(invalid[0], invalid[1]))
+		if err == nil {
+			t.Fatalf("expected an error for %v", invalid)
+		}
+	}
+
+	opts := []cpmoption{
+		WithPrinterPath(defPath),
+		WithOutputDriver("buffer"),
+		WithListDevice("CRT:", "console"),
+		WithListDevice("lpt", "file:"+lptPath),
+		WithListDevice("UL1", "null"),
+	}
+	if runtime.GOOS != "windows" {
+		opts = append(opts, WithListDevice("TTY", "pipe:cat > "+pipePath))
+	}
+
+	c, err := New(opts...)
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	c.Memory = new(memory.Memory)
+
+	// list writes the given text with the given IOByte.
+	list := func(iobyte uint8, text string) {
+		c.CPU.States.DE.Lo = iobyte
+		BdosSysCallSetIOByte(c)
+		for _, ch := range text {
+			c.CPU.States.DE.Lo = uint8(ch)
+			err := BdosSysCallPrinterWrite(c)
+			if err != nil {
+				t.Fatalf("failed to print: %s", err)
+			}
+		}
+	}
+
+	list(0x00, "tty\n")
+	list(0x40, "crt")
+	list(0x80, "lpt\n")
+	list(0xC0, "ul1\n")
+
+	c.IOTearDown()
+
+	rec := c.GetOutputDriver().(consoleout.ConsoleRecorder)
+	out := rec.GetOutput()
+	if out != "crt" {
+		t.Fatalf("unexpected console output %q", out)
+	}
+
+	data, _ := os.ReadFile(lptPath)
+	if string(data) != "lpt\n" {
+		t.Fatalf("unexpected LPT: output %q", data)
+	}
+
+	data, _ = os.ReadFile(pipePath)
+	if runtime.GOOS != "windows" && string(data) != "tty\n" {
+		t.Fatalf("unexpected TTY: output %q", data)
+	}
+
+	// Nothing was written to the default printer.
+	if _, err := os.Stat(defPath); err == nil {
+		t.Fatalf("default printer was written to")
+	}
 }
 
 // TestLogNoisy tests that functions are updated appropriately.
@@ -280,6 +429,48 @@ func TestDrives(t *testing.T) {
 	}
 }
 
+// TestDriveUser ensures the current drive, and user number, may be
+// selected before launching.
+func TestDriveUser(t *testing.T) {
+
+	obj, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CP/M object")
+	}
+	obj.SetDrives(true)
+	obj.SetDrivePath("C", t.TempDir())
+	obj.SetDrivePath("D", filepath.Join(t.TempDir(), "missing"))
+
+	for _, bogus := range []string{"", "Q", "AB", "D"} {
+		err = obj.SetDriveUser(bogus, 0)
+		if err == nil {
+			t.Fatalf("expected error selecting drive %q", bogus)
+		}
+	}
+	for _, bogus := range []int{-1, 16} {
+		err = obj.SetDriveUser("C", bogus)
+		if err == nil {
+			t.Fatalf("expected error selecting user %d", bogus)
+		}
+	}
+
+	err = obj.LoadCCP()
+	if err != nil {
+		t.Fatalf("failed to load CCP: %s", err)
+	}
+
+	err = obj.SetDriveUser("c:", 3)
+	if err != nil {
+		t.Fatalf("failed to select C3: %s", err)
+	}
+	if obj.currentDrive != 2 || obj.userNumber != 3 {
+		t.Fatalf("wrong drive/user %d/%d", obj.currentDrive, obj.userNumber)
+	}
+	if obj.Memory.Get(0x0004) != 0x32 {
+		t.Fatalf("wrong value in RAM %02X", obj.Memory.Get(0x0004))
+	}
+}
+
 // TestCPMCoverage is just coverage messup
 func TestCPMCoverage(t *testing.T) {
 
@@ -378,6 +569,34 @@ func TestHostExec(t *testing.T) {
 	if obj.input.GetSystemCommandPrefix() != "!#!" {
 		t.Fatalf("WithHostExec didn't work as expected")
 	}
+
+	// Output from host commands goes via the output driver.
+	obj, err = New(WithOutputDriver("logger"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	obj.hostExec("echo hello")
+
+	l, ok := obj.GetOutputDriver().(*consoleout.OutputLoggingDriver)
+	if !ok {
+		t.Fatalf("failed to cast output driver")
+	}
+	if l.GetOutput() != "hello\r\n" {
+		t.Fatalf("unexpected output '%s'", l.GetOutput())
+	}
+
+	// The monitor can run host commands too.
+	l.Reset()
+	for _, cmd := range []string{"exec echo hello", "!echo hello"} {
+		out := &bytes.Buffer{}
+		_, err = obj.monitorCommand(out, cmd)
+		if err != nil || out.Len() != 0 {
+			t.Fatalf("unexpected result from '%s': %v %s", cmd, err, out.String())
+		}
+	}
+	if l.GetOutput() != "hello\r\nhello\r\n" {
+		t.Fatalf("unexpected output '%s'", l.GetOutput())
+	}
 }
 
 func TestAddressOveride(t *testing.T) {
@@ -414,3 +633,601 @@ func TestAddressOveride(t *testing.T) {
 	}
 
 }
+
+// TestRSX ensures that page-zero hooks are preserved across warm boots
+// in RSX-compatible mode, and reset otherwise.
+func TestRSX(t *testing.T) {
+
+	for _, rsx := range []bool{false, true} {
+
+		obj, err := New(WithRSX(rsx))
+		if err != nil {
+			t.Fatalf("failed to create CPM")
+		}
+
+		err = obj.LoadCCP()
+		if err != nil {
+			t.Fatalf("failed to load CCP")
+		}
+
+		// Default entry-point
+		entry := obj.bdosAddress + 6
+		if obj.Memory.GetU16(0x0006) != entry {
+			t.Fatalf("unexpected BDOS entry-point %04X", obj.Memory.GetU16(0x0006))
+		}
+
+		// Hook the BDOS, then warm boot.
+		obj.Memory.SetRange(0x0006, 0x00, 0xB0)
+		err = obj.LoadCCP()
+		if err != nil {
+			t.Fatalf("failed to load CCP")
+		}
+
+		expected := entry
+		if rsx {
+			expected = 0xB000
+		}
+		if obj.Memory.GetU16(0x0006) != expected {
+			t.Fatalf("rsx:%t expected entry-point %04X, got %04X", rsx, expected, obj.Memory.GetU16(0x0006))
+		}
+	}
+}
+
+// TestSerialNumber ensures the BDOS serial number is present, as
+// debuggers such as DDT expect.
+func TestSerialNumber(t *testing.T) {
+
+	obj, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+
+	err = obj.LoadCCP()
+	if err != nil {
+		t.Fatalf("failed to load CCP")
+	}
+
+	// The serial number precedes the entry-point.
+	entry := obj.Memory.GetU16(0x0006)
+	for i, b := range bdosSerial {
+		got := obj.Memory.Get(entry - 6 + uint16(i))
+		if got != b {
+			t.Fatalf("serial byte %d was %02X, expected %02X", i, got, b)
+		}
+	}
+}
+
+// TestCrashReport tests the contents of our crash reports.
+func TestCrashReport(t *testing.T) {
+
+	obj, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	obj.Memory = new(memory.Memory)
+
+	// LD C, 99 ; CALL 0x0005
+	obj.Memory.SetRange(0x0100, 0x0E, 0x63, 0xCD, 0x05, 0x00)
+	obj.CPU.States.PC = 0x0100
+	obj.CPU.States.SP = 0xFF00
+	obj.CPU.States.BC.Lo = 0x63
+	obj.Memory.SetRange(0xFF00, 0x34, 0x12)
+
+	// An open file, on B:
+	f := fcb.FromString("TEST.TXT")
+	f.Drive = 2
+	obj.Memory.SetRange(0x005C, f.AsBytes()...)
+	obj.files[0x005C] = FileCache{name: "b/test.txt", drive: "B"}
+
+	out := &bytes.Buffer{}
+	obj.writeCrashReport(out, ErrUnimplemented)
+
+	for _, expected := range []string{
+		"Reason: UNIMPLEMENTED",
+		"Syscall (C): 99 (0x63)",
+		"SP=FF00 PC=0100",
+		"0100  0E 63        LD C, 0x63",
+		"0102  CD 05 00     CALL 0x0005",
+		"FF00  1234",
+		"FCB 005C  B:TEST.TXT",
+		"host:b/test.txt",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("crash report didn't contain '%s':\n%s", expected, out.String())
+		}
+	}
+
+	// Disabled by default
+	obj.crashReport(ErrHalt)
+
+	// Written to a file
+	path := filepath.Join(t.TempDir(), "crash.txt")
+	obj.crashPath = path
+	obj.crashReport(ErrHalt)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("crash report wasn't written: %s", err)
+	}
+	if !strings.Contains(string(data), "Reason: HALT") {
+		t.Fatalf("crash report had the wrong contents")
+	}
+}
+
+// TestMonitor tests the commands of our interactive monitor.
+func TestMonitor(t *testing.T) {
+
+	obj, err := New(WithMonitorKey(0x1D))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	obj.Memory = new(memory.Memory)
+	obj.SetDrives(false)
+
+	// Changing the output driver keeps our observer, and buffering.
+	seen := []byte{}
+	obj.output.SetObserver(func(c byte) { seen = append(seen, c) })
+	obj.output.SetBufferDelay(time.Second)
+
+	key, handler := obj.input.GetEscapeHandler()
+	if key != 0x1D || handler == nil {
+		t.Fatalf("monitor key wasn't configured")
+	}
+
+	// LD C, 99 ; CALL 0x0005
+	obj.Memory.SetRange(0x0100, 0x0E, 0x63, 0xCD, 0x05, 0x00, 'H', 'i')
+	obj.CPU.States.PC = 0x0100
+
+	type TestCase struct {
+		Command  string
+		Resume   bool
+		Err      error
+		Expected string
+	}
+
+	tests := []TestCase{
+		{Command: "", Expected: ""},
+		{Command: "help", Expected: "Commands:"},
+		{Command: "c", Resume: true},
+		{Command: "continue", Resume: true},
+		{Command: "quit", Err: ErrHalt},
+		{Command: "regs", Expected: "PC=0100"},
+		{Command: "dump 0x100 8", Expected: "0100  0E 63 CD 05 00 48 69 00"},
+		{Command: "dump", Expected: "Usage"},
+		{Command: "dump steve", Expected: "invalid address"},
+		{Command: "disasm", Expected: "0102  CD 05 00     CALL 0x0005"},
+		{Command: "disasm 0x0100 2", Expected: "LD C, 0x63"},
+		{Command: "drives", Expected: "A: ."},
+		{Command: "mount Q: /", Expected: "mount failed"},
+		{Command: "mount B: " + t.TempDir(), Expected: ""},
+		{Command: "umount B:", Expected: ""},
+		{Command: "umount B:", Expected: "umount failed"},
+		{Command: "input steve", Expected: "failed to lookup driver"},
+		{Command: "output steve", Expected: "failed to lookup driver"},
+		{Command: "charset", Expected: "latin1"},
+		{Command: "output ansi", Expected: ""},
+		{Command: "charset cp437", Expected: ""},
+		{Command: "charset", Expected: "cp437"},
+		{Command: "charset steve", Expected: "unknown charset"},
+		{Command: "output logger", Expected: ""},
+		{Command: "charset cp437", Expected: "doesn't support"},
+		{Command: "input-charset", Expected: "ascii"},
+		{Command: "input-charset cp437", Expected: ""},
+		{Command: "input-charset", Expected: "cp437"},
+		{Command: "input-charset steve", Expected: "unknown charset"},
+		{Command: "bogus", Expected: "unknown command"},
+	}
+
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		resume, err := obj.monitorCommand(out, test.Command)
+
+		if resume != test.Resume {
+			t.Fatalf("%s: unexpected resume %v", test.Command, resume)
+		}
+		if err != test.Err {
+			t.Fatalf("%s: unexpected error %v", test.Command, err)
+		}
+		if !strings.Contains(out.String(), test.Expected) {
+			t.Fatalf("%s: output didn't contain '%s':\n%s", test.Command, test.Expected, out.String())
+		}
+		if test.Expected == "" && out.Len() != 0 {
+			t.Fatalf("%s: unexpected output:\n%s", test.Command, out.String())
+		}
+	}
+
+	if obj.GetOutputDriver().GetName() != "logger" {
+		t.Fatalf("output driver wasn't changed")
+	}
+	obj.output.PutCharacter('!')
+	if string(seen) != "!" {
+		t.Fatalf("the observer was lost when changing driver: %q", seen)
+	}
+	if obj.output.GetBufferDelay() != time.Second {
+		t.Fatalf("the buffering was lost when changing driver")
+	}
+
+	// Stuffed input is visible to the guest.
+	_, err = obj.monitorCommand(&bytes.Buffer{}, "stuff DIR\\r")
+	if err != nil {
+		t.Fatalf("unexpected error stuffing input")
+	}
+	for _, expected := range []byte("DIR\r") {
+		c, err := obj.input.BlockForCharacterNoEcho()
+		if err != nil || c != expected {
+			t.Fatalf("unexpected stuffed input %c %v", c, err)
+		}
+	}
+}
+
+// TestNamedDirectories tests the parsing of named directories, and the
+// use of DU prefixes in the default FCBs.
+func TestNamedDirectories(t *testing.T) {
+
+	for _, bogus := range []string{"WORK", "WORK=", "=B3", "WORK=Z", "B3=A0", "TOOLONGNAME=A0", "A*=B"} {
+		_, err := New(WithNamedDirectories(bogus))
+		if err == nil {
+			t.Fatalf("expected error with named directory %s", bogus)
+		}
+	}
+
+	c, err := New(WithNamedDirectories("root=A0, WORK=B3"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	c.userNumber = 5
+
+	type testcase struct {
+		arg   string
+		drive uint8
+		user  uint8
+		name  string
+	}
+
+	tests := []testcase{
+		{arg: "FOO.TXT", drive: 0, user: 5, name: "FOO.TXT"},
+		{arg: "B:FOO.TXT", drive: 2, user: 5, name: "FOO.TXT"},
+		{arg: "C7:FOO.TXT", drive: 3, user: 7, name: "FOO.TXT"},
+		{arg: "2:FOO.TXT", drive: 0, user: 2, name: "FOO.TXT"},
+		{arg: "WORK:FOO.TXT", drive: 2, user: 3, name: "FOO.TXT"},
+		{arg: "ROOT:BAR", drive: 1, user: 0, name: "BAR"},
+	}
+
+	for _, test := range tests {
+		x := c.argumentFCB(test.arg)
+		if x.Drive != test.drive || x.S1 != test.user || x.GetFileName() != test.name {
+			t.Fatalf("wrong FCB for %s: drive %d user %d name %s", test.arg, x.Drive, x.S1, x.GetFileName())
+		}
+	}
+}
+
+// TestCommands ensures the commands given via WithCommands are used as
+// lines of console input, and that the input ends once they're consumed.
+func TestCommands(t *testing.T) {
+
+	c, err := New(WithCommands(" DIR ; ;TYPE FOO.TXT;\n\nERA *.BAK\r\n"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	if c.GetInputDriver().GetName() != "file" {
+		t.Fatalf("wrong input driver %s", c.GetInputDriver().GetName())
+	}
+
+	// Commands aren't typeahead, so aren't seen by polls.
+	if c.input.PendingInput() {
+		t.Fatalf("commands were pending before a line was read")
+	}
+
+	c.readingLine = true
+	for _, expected := range []string{"DIR", "TYPE FOO.TXT", "ERA *.BAK"} {
+		line, err := c.input.ReadLine(80)
+		if err != nil {
+			t.Fatalf("failed to read line: %s", err)
+		}
+		if line != expected {
+			t.Fatalf("expected %q, got %q", expected, line)
+		}
+	}
+
+	_, err = c.input.ReadLine(80)
+	if err != consolein.ErrEOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	// No commands leaves the input driver alone.
+	c, err = New(WithInputDriver("stty"), WithCommands(" ; "))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	if c.GetInputDriver().GetName() != "stty" {
+		t.Fatalf("input driver was replaced")
+	}
+}
+
+// TestFileInputCCP runs commands through the CCP, read from a file, and
+// ensures the programs which poll the console while they work, such as DIR
+// and TYPE, don't consume the commands which follow them.
+func TestFileInputCCP(t *testing.T) {
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"FOO.TXT":  "hello\r\nworld\r\n",
+		"BAR.TXT":  "",
+		"BAZ.TXT":  "",
+		"QUUX.TXT": "",
+		"in.txt":   "DIR A:\nTYPE FOO.TXT\n",
+	}
+	for name, data := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+		if err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	type TestCase struct {
+		CCP      string
+		Expected string
+	}
+
+	tests := []TestCase{
+		{CCP: "ccp", Expected: "\r\nA>\r\nA: BAR     .TXT | BAZ     .TXT | FOO     .TXT | IN      .TXT\r\nA: QUUX    .TXT\r\nA>\r\nhello\r\nworld\r\n\r\nA>"},
+		{CCP: "ccpz", Expected: "\r\nA>\r\nBAR     .TXT  |  BAZ     .TXT  |  FOO     .TXT  |  IN      .TXT\r\nQUUX    .TXT\r\nA>\r\nhello\r\nworld\r\n\r\nA>"},
+	}
+
+	for _, test := range tests {
+
+		obj, err := New(WithCCP(test.CCP), WithOutputDriver("buffer"), WithInputDriver("file:path="+filepath.Join(dir, "in.txt")))
+		if err != nil {
+			t.Fatalf("failed to create CPM: %s", err)
+		}
+		obj.SetDrives(false)
+		obj.SetDrivePath("A", dir)
+
+		// Run the CCP until our input is exhausted.
+		for {
+			err = obj.LoadCCP()
+			if err != nil {
+				t.Fatalf("failed to load CCP: %s", err)
+			}
+			err = obj.Execute([]string{})
+			if err != nil && err != ErrBoot {
+				break
+			}
+		}
+		if err != ErrHalt {
+			t.Fatalf("%s: unexpected error %v", test.CCP, err)
+		}
+
+		out, _ := obj.ReadOutput()
+		if out != test.Expected {
+			t.Fatalf("%s: unexpected output %q", test.CCP, out)
+		}
+	}
+}
+
+// TestStuffPacing tests that the pacing of stuffed input is passed to our
+// console, and that invalid specifications are rejected.
+func TestStuffPacing(t *testing.T) {
+
+	_, err := New(WithStuffPacing("fast"))
+	if err == nil {
+		t.Fatalf("expected an error with invalid pacing")
+	}
+
+	c, err := New(WithStuffPacing("4/20ms,read"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	defer c.input.SetStuffPacing(consolein.StuffPacing{})
+
+	if c.input.GetStuffPacing().String() != "4/20ms,read" {
+		t.Fatalf("unexpected pacing %s", c.input.GetStuffPacing())
+	}
+}
+
+// TestOutputLimit ensures runaway output is paused, and may be resumed.
+func TestOutputLimit(t *testing.T) {
+
+	_, err := New(WithOutputLimit("lots"))
+	if err == nil {
+		t.Fatalf("expected an error with an invalid limit")
+	}
+
+	c, err := New(WithOutputLimit("10/1h"), WithOutputDriver("null"), WithMonitorKey(0x1D))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+
+	// Nothing happens unless output is paused
+	err = c.outputThrottle()
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		c.output.PutCharacter('x')
+	}
+	if !c.output.Paused() {
+		t.Fatalf("expected output to be paused")
+	}
+
+	// Ctrl-C aborts the program, and resumes output
+	c.StuffText("\x03")
+	err = c.outputThrottle()
+	if err != ErrBoot {
+		t.Fatalf("expected a reboot, got %v", err)
+	}
+	if c.output.Paused() {
+		t.Fatalf("expected output to be resumed")
+	}
+
+	// The monitor can resume output
+	for i := 0; i < 20; i++ {
+		c.output.PutCharacter('x')
+	}
+	out := &bytes.Buffer{}
+	resume, err := c.monitorCommand(out, "resume")
+	if err != nil || !resume {
+		t.Fatalf("unexpected result from resume %v %v", resume, err)
+	}
+	if !strings.Contains(out.String(), "10 characters were discarded") {
+		t.Fatalf("unexpected output %s", out.String())
+	}
+	if c.output.Paused() {
+		t.Fatalf("expected output to be resumed")
+	}
+
+	// Without a monitor output resumes after a delay
+	c, err = New(WithOutputLimit("5/1ms"), WithOutputDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	for i := 0; i < 10; i++ {
+		c.output.PutCharacter('x')
+	}
+	err = c.outputThrottle()
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if c.output.Paused() {
+		t.Fatalf("expected output to be resumed")
+	}
+}
+
+// benchmarkLogSyscall logs a console-output syscall, with the default
+// logger writing at the given level.
+func benchmarkLogSyscall(b *testing.B, level slog.Level) {
+
+	old := slog.Default()
+	defer slog.SetDefault(old)
+	slog.SetDefault(slog.New(slog.NewJSONHandler(io.Discard, &slog.HandlerOptions{Level: level})))
+
+	c, err := New()
+	if err != nil {
+		b.Fatalf("failed to create CPM")
+	}
+	handler := c.BDOSSyscalls[0x02]
+	handler.Noisy = false
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.logSyscall("BDOS", 0x02, handler)
+	}
+}
+
+// BenchmarkLogSyscallDisabled shows the per-syscall cost of our logging
+// when, as by default, only warnings are logged.
+func BenchmarkLogSyscallDisabled(b *testing.B) {
+	benchmarkLogSyscall(b, slog.LevelWarn)
+}
+
+// BenchmarkLogSyscallEnabled shows the per-syscall cost of our logging
+// when a log file is in use.
+func BenchmarkLogSyscallEnabled(b *testing.B) {
+	benchmarkLogSyscall(b, slog.LevelDebug)
+}
+
+// TestLogSyscall ensures syscalls are only logged when the level allows.
+func TestLogSyscall(t *testing.T) {
+
+	old := slog.Default()
+	defer slog.SetDefault(old)
+
+	c, err := New()
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	handler := c.BDOSSyscalls[0x02]
+	handler.Noisy = false
+
+	for _, level := range []slog.Level{slog.LevelWarn, slog.LevelInfo} {
+		out := &bytes.Buffer{}
+		slog.SetDefault(slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: level})))
+
+		c.CPU.States.DE.SetU16(0x1234)
+		c.logSyscall("BDOS", 0x02, handler)
+
+		logged := strings.Contains(out.String(), `"DE":"1234"`)
+		if logged != (level == slog.LevelInfo) {
+			t.Fatalf("unexpected logging at level %s: %s", level, out.String())
+		}
+	}
+}
+
+// TestOutputBuffer ensures buffered output is written before input is read.
+func TestOutputBuffer(t *testing.T) {
+
+	_, err := New(WithOutputBuffer(-time.Second))
+	if err == nil {
+		t.Fatalf("expected an error with a negative delay")
+	}
+
+	c, err := New(WithOutputBuffer(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+
+	// Buffer output to our own writer, rather than STDOUT.
+	out := &bytes.Buffer{}
+	c.output.SetBufferDelay(0)
+	c.output.GetDriver().SetWriter(out)
+	c.output.SetBufferDelay(c.bufferDelay)
+
+	for _, ch := range []byte("A>") {
+		c.output.PutCharacter(ch)
+	}
+	if out.String() != "" {
+		t.Fatalf("output wasn't buffered: %q", out.String())
+	}
+
+	c.StuffText("x")
+	_, err = c.input.BlockForCharacterNoEcho()
+	if err != nil {
+		t.Fatalf("failed to read input: %s", err)
+	}
+	if out.String() != "A>" {
+		t.Fatalf("output wasn't flushed before input was read: %q", out.String())
+	}
+}
+
+// waitInput is a console input driver which never receives a key.
+type waitInput struct {
+	keyInput
+}
+
+// BlockForCharacterNoEcho waits forever.
+func (w *waitInput) BlockForCharacterNoEcho() (byte, error) {
+	select {}
+}
+
+// TestExecuteCanceled ensures a program which is waiting for console input
+// terminates when its context is canceled.
+func TestExecuteCanceled(t *testing.T) {
+
+	// C_READ, then HALT.
+	dir := t.TempDir()
+	prog := filepath.Join(dir, "WAIT.COM")
+	err := os.WriteFile(prog, []byte{0x0E, 0x01, 0xCD, 0x05, 0x00, 0x76}, 0644)
+	if err != nil {
+		t.Fatalf("failed to write program: %s", err)
+	}
+
+	obj, err := New(WithOutputDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	obj.input = consolein.NewFromDriver(&waitInput{})
+
+	err = obj.LoadBinary(prog)
+	if err != nil {
+		t.Fatalf("failed to load program: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	err = obj.ExecuteContext(ctx, []string{})
+	if err != context.Canceled {
+		t.Fatalf("expected the program to be canceled, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+// cpm_throttle.go handles runaway output, such as a buggy program printing
+// in a tight loop.
+//
+// If an output limit has been configured, and a program exceeds it, our
+// console output driver pauses output.  Once the syscall which exceeded
+// the limit has completed we tell the user, and suspend the guest until
+// they resume output via the monitor, or press Ctrl-C to abort the
+// program.
+
+package cpm
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/skx/cpmulator/consolein"
+	"github.com/skx/cpmulator/consoleout"
+)
+
+// WithOutputLimit configures the rate of output above which output is
+// paused, such as "20000/1s".  The format is described in
+// consoleout/throttle.go.
+//
+// The empty string disables the limit, which is the default.
+func WithOutputLimit(spec string) cpmoption {
+	return func(c *CPM) error {
+		limit, err := consoleout.ParseOutputLimit(spec)
+		if err != nil {
+			return err
+		}
+		c.outputLimit = limit
+		return nil
+	}
+}
+
+// outputThrottle is called after each syscall, and if our output has
+// been paused it suspends the guest until the user resumes it.
+//
+// Without a monitor there's no way for the user to resume output, so the
+// guest is instead delayed for the period of our limit, and output then
+// resumes automatically.
+func (cpm *CPM) outputThrottle() error {
+
+	if !cpm.output.Paused() {
+		return nil
+	}
+
+	limit := cpm.output.GetOutputLimit()
+	slog.Warn("output limit exceeded, pausing output",
+		slog.String("limit", limit.String()))
+
+	if cpm.monitorKey == 0 {
+		time.Sleep(limit.Period)
+		cpm.output.Resume()
+		return nil
+	}
+
+	cpm.output.Notify(fmt.Sprintf("\r\n*** Output paused, more than %d characters were written in %s.\r\n*** Press %s, and type \"resume\", to continue, or Ctrl-C to abort the program.\r\n",
+		limit.Chars, limit.Period, keyName(cpm.monitorKey)))
+
+	for cpm.output.Paused() {
+		c, err := cpm.input.BlockForCharacterNoEcho()
+		if err != nil {
+			if errors.Is(err, consolein.ErrEOF) || errors.Is(err, consolein.ErrKilled) || errors.Is(err, ErrHalt) {
+				return err
+			}
+			continue
+		}
+
+		if c == 0x03 {
+			cpm.output.Resume()
+			return ErrBoot
+		}
+	}
+	return nil
+}
+
+// keyName returns the name of the given key, in ^X notation if it is a
+// control character.
+func keyName(key byte) string {
+	if key < ' ' {
+		return fmt.Sprintf("^%c", key+'@')
+	}
+	return string([]byte{key})
+}
@@ -0,0 +1,302 @@
+// cpm_transcript.go contains our session transcripts, which record the
+// console output, the lines of input, and the commands the CCP executed,
+// in order, to a single file, so that sessions can be replayed, or shown
+// in documentation.
+//
+// Two formats are supported, chosen by the suffix of the file:
+//
+//   - ".md", or ".markdown", writes a markdown document, in which each
+//     command the CCP executed is a heading, followed by its output.
+//
+//   - Anything else, typically ".cast", writes an asciinema (v2) recording,
+//     which may be replayed via "asciinema play".  Commands are recorded as
+//     markers.
+//
+// Lines of input are echoed by our console, rather than written via the
+// output driver, so the transcript records their echo itself.  Escape
+// sequences, and other control characters, are removed from markdown
+// transcripts, but kept in recordings.
+
+package cpm
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skx/cpmulator/consoleout"
+)
+
+// WithTranscript records our session to the given file, as markdown if it
+// has a ".md" suffix, otherwise as an asciinema recording.
+//
+// The empty string disables the transcript, which is the default.
+func WithTranscript(path string) cpmoption {
+	return func(c *CPM) error {
+
+		if path == "" {
+			return nil
+		}
+
+		file, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("failed to create transcript: %w", err)
+		}
+
+		ext := strings.ToLower(filepath.Ext(path))
+		t := &transcript{
+			file:     file,
+			w:        bufio.NewWriter(file),
+			markdown: ext == ".md" || ext == ".markdown",
+			start:    time.Now(),
+		}
+		if !t.markdown {
+			t.cast = consoleout.NewAsciinemaWriter(t.w, "cpmulator session")
+		}
+		c.transcript = t
+		return nil
+	}
+}
+
+// transcript holds the state of our session transcript.
+type transcript struct {
+
+	// mutex serializes our writes, since we're closed when the emulator
+	// is torn down, which might happen from a signal handler.
+	mutex sync.Mutex
+
+	// file is the transcript, and w buffers our writes to it.
+	file *os.File
+	w    *bufio.Writer
+
+	// markdown is true if we're writing markdown, rather than an
+	// asciinema recording, which cast encodes.
+	markdown bool
+	cast     *consoleout.AsciinemaWriter
+
+	// start is the time at which the session started.
+	start time.Time
+
+	// pending holds the current line of markdown, which has not yet
+	// been written.
+	pending []byte
+
+	// inBlock is true if we've started a markdown code-block.
+	inBlock bool
+
+	// escape holds the state of our parsing of escape sequences, so
+	// they may be removed from markdown.
+	escape escapeState
+}
+
+// escapeState is the state of our parsing of escape sequences.
+type escapeState struct {
+
+	// active is true within an escape sequence, and csi is true if it
+	// is an ANSI control sequence, which ends with a letter.
+	active bool
+	csi    bool
+
+	// skip is the number of characters of the sequence which remain.
+	skip int
+}
+
+// connectTranscript connects our console to our transcript, if it is
+// enabled, and writes its header, once all our options have been applied.
+func (cpm *CPM) connectTranscript() {
+
+	t := cpm.transcript
+	if t == nil {
+		return
+	}
+
+	width, height, err := cpm.getTerminalSize()
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.markdown {
+		fmt.Fprintf(t.w, "# cpmulator session\n\nRecorded %s.\n", t.start.Format(time.RFC1123))
+	} else {
+		t.cast.SetScreenSize(width, height)
+	}
+}
+
+// output records a character of console output.
+func (t *transcript) output(c byte) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.file == nil {
+		return
+	}
+
+	if !t.markdown {
+		t.cast.Output([]byte(string(rune(c))))
+		return
+	}
+
+	t.textLocked(c)
+}
+
+// input records a line of input, along with its echo, noting whether it
+// was a command read by the CCP.
+func (t *transcript) input(text string, command bool) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.file == nil {
+		return
+	}
+
+	if !t.markdown {
+		if command {
+			t.cast.Event("m", text)
+		}
+		t.cast.Event("i", text+"\r")
+		t.cast.Event("o", text+"\r\n")
+		return
+	}
+
+	// A command becomes a heading, along with its prompt, which is
+	// the line we've not yet written.
+	if command {
+		prompt := string(t.pending)
+		t.pending = t.pending[:0]
+		t.endBlockLocked()
+		fmt.Fprintf(t.w, "\n## `%s%s`\n", prompt, strings.ReplaceAll(text, "`", "'"))
+		return
+	}
+
+	for _, c := range []byte(text + "\n") {
+		t.textLocked(c)
+	}
+}
+
+// character records a single character of input, which our console has
+// echoed.
+func (t *transcript) character(c byte) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.file == nil {
+		return
+	}
+
+	if !t.markdown {
+		t.cast.Event("i", string(rune(c)))
+		t.cast.Event("o", string(rune(c)))
+		return
+	}
+	t.textLocked(c)
+}
+
+// textLocked adds a character to the markdown we're writing, removing
+// escape sequences and control characters, the caller must hold our
+// mutex.
+func (t *transcript) textLocked(c byte) {
+
+	e := &t.escape
+	if e.active {
+		switch {
+		case e.skip > 0:
+			e.skip--
+		case e.csi:
+			if c >= 0x40 && c <= 0x7E {
+				e.active = false
+			}
+			return
+		case c == '[':
+			e.csi = true
+			return
+		case c == '=' || c == 'Y':
+			// Cursor addressing, with a row and column.
+			e.skip = 2
+			return
+		}
+		if e.skip == 0 {
+			e.active = false
+		}
+		return
+	}
+
+	switch {
+	case c == 0x1B:
+		t.escape = escapeState{active: true}
+	case c == '\b':
+		if len(t.pending) > 0 {
+			t.pending = t.pending[:len(t.pending)-1]
+		}
+	case c == '\n':
+		// Blocks don't start with blank lines.
+		if !t.inBlock && len(t.pending) == 0 {
+			return
+		}
+		if !t.inBlock {
+			t.w.WriteString("\n```text\n")
+			t.inBlock = true
+		}
+		t.w.Write(t.pending)
+		t.w.WriteString("\n")
+		t.pending = t.pending[:0]
+	case c == '\t' || (c >= ' ' && c < 0x7F):
+		t.pending = append(t.pending, c)
+	}
+}
+
+// endBlockLocked ends the markdown code-block we're writing, if any, the
+// caller must hold our mutex.
+func (t *transcript) endBlockLocked() {
+	if t.inBlock {
+		t.w.WriteString("```\n")
+		t.inBlock = false
+	}
+}
+
+// closeTranscript writes anything pending to our transcript, and closes
+// it.
+func (cpm *CPM) closeTranscript() {
+
+	t := cpm.transcript
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.file == nil {
+		return
+	}
+
+	if t.markdown {
+		if len(t.pending) > 0 {
+			t.textLocked('\n')
+		}
+		t.endBlockLocked()
+	} else {
+		t.cast.Flush()
+	}
+
+	err := t.w.Flush()
+	if err == nil {
+		err = t.file.Close()
+	}
+	if err != nil {
+		slog.Error("failed to write transcript",
+			slog.String("path", t.file.Name()),
+			slog.String("error", err.Error()))
+	}
+	t.file = nil
+}
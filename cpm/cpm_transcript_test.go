@@ -0,0 +1,111 @@
+package cpm
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestTranscriptMarkdown ensures that markdown transcripts contain a
+// heading for each command, followed by its output.
+func TestTranscriptMarkdown(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "session.md")
+
+	obj, err := New(WithTranscript(path))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+
+	write := func(s string) {
+		for _, c := range []byte(s) {
+			obj.output.PutCharacter(c)
+		}
+	}
+
+	write("\r\nA>")
+	obj.transcript.input("TYPE HELLO.TXT", true)
+	write("\r\nHello, \x1b[1mworld\x1b[0m\r\n\x1b=  Bye!\bx\r\n")
+	write("Name? ")
+	obj.transcript.input("Steve", false)
+	obj.transcript.character('y')
+	write("\r\nA>")
+	obj.IOTearDown()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read transcript: %s", err)
+	}
+
+	// Skip the header, which contains the time.
+	_, body, _ := strings.Cut(string(data), ".\n")
+
+	expected := "\n## `A>TYPE HELLO.TXT`\n\n```text\nHello, world\nByex\nName? Steve\ny\nA>\n```\n"
+	if body != expected {
+		t.Fatalf("unexpected transcript %q", body)
+	}
+
+	// Closing again is harmless.
+	obj.closeTranscript()
+}
+
+// TestTranscriptCast ensures that asciinema recordings contain our output,
+// input, and commands.
+func TestTranscriptCast(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "session.cast")
+
+	obj, err := New(WithTranscript(path))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+
+	for _, c := range []byte("A>") {
+		obj.output.PutCharacter(c)
+	}
+	obj.transcript.input("DIR", true)
+	obj.IOTearDown()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read transcript: %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("unexpected recording %q", data)
+	}
+
+	var header map[string]any
+	err = json.Unmarshal([]byte(lines[0]), &header)
+	if err != nil || header["version"] != float64(2) {
+		t.Fatalf("invalid header %s", lines[0])
+	}
+
+	expected := [][2]string{{"o", "A>"}, {"m", "DIR"}, {"i", "DIR\r"}, {"o", "DIR\r\n"}}
+	for i, line := range lines[1:] {
+		var ev []any
+		err = json.Unmarshal([]byte(line), &ev)
+		if err != nil || len(ev) != 3 {
+			t.Fatalf("invalid event %s", line)
+		}
+		if _, ok := ev[0].(float64); !ok {
+			t.Fatalf("invalid time in event %s", line)
+		}
+		if ev[1] != expected[i][0] || ev[2] != expected[i][1] {
+			t.Fatalf("event %d is %s, expected %v", i, line, expected[i])
+		}
+	}
+}
+
+// TestTranscriptInvalid ensures that a transcript which can't be created is
+// reported.
+func TestTranscriptInvalid(t *testing.T) {
+
+	_, err := New(WithTranscript(filepath.Join(t.TempDir(), "missing", "session.cast")))
+	if err == nil {
+		t.Fatalf("expected error creating transcript")
+	}
+}
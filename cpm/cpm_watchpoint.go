@@ -0,0 +1,356 @@
+// cpm_watchpoint.go contains our memory watchpoints, which help track down
+// guest programs which corrupt their data, such as an FCB, or the DMA
+// buffer.
+//
+// A watchpoint covers a range of memory, and triggers when it is read,
+// written, or both.  When one triggers we log the access, along with the
+// addresses of the most recently executed instructions, and if the monitor
+// is enabled the user is dropped into it.
+//
+// Watchpoints are specified as "ADDR[+LEN][:MODE]", where the address and
+// length may be given in decimal, or hex with a "0x" prefix, and the mode
+// is one of "r", "w", or "rw".  The length defaults to one byte, and the
+// mode to "w", for example "0x5C+36" watches for writes to the first FCB.
+//
+// While watchpoints are present we execute the guest one instruction at a
+// time, so that we may record the addresses of recent instructions, which
+// is slower than usual.
+
+package cpm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/koron-go/z80"
+)
+
+// watchHistory is the number of recently executed instructions whose
+// addresses we record, and report, when a watchpoint triggers.
+const watchHistory = 16
+
+// watchpoint describes a range of memory which we're watching.
+type watchpoint struct {
+
+	// start is the first address which is watched.
+	start uint16
+
+	// size is the number of bytes which are watched.
+	size int
+
+	// read and write are true if reads, or writes, trigger us.
+	read  bool
+	write bool
+}
+
+// watchHit records the access which triggered a watchpoint.
+type watchHit struct {
+
+	// wp is the watchpoint which was triggered.
+	wp watchpoint
+
+	// addr is the first watched address which was accessed.
+	addr uint16
+
+	// write is true if memory was written.
+	write bool
+
+	// pc is the program counter at the time of the access.
+	pc uint16
+}
+
+// String returns the watchpoint in the format accepted by parseWatchpoint.
+func (wp watchpoint) String() string {
+	mode := "w"
+	switch {
+	case wp.read && wp.write:
+		mode = "rw"
+	case wp.read:
+		mode = "r"
+	}
+	return fmt.Sprintf("0x%04X+%d:%s", wp.start, wp.size, mode)
+}
+
+// overlaps returns the first watched address within the given range, if
+// the access is one which triggers us.
+func (wp watchpoint) overlaps(addr uint16, size int, write bool) (uint16, bool) {
+
+	if (write && !wp.write) || (!write && !wp.read) {
+		return 0, false
+	}
+
+	first := max(int(addr), int(wp.start))
+	last := min(int(addr)+size, int(wp.start)+wp.size)
+	if first >= last {
+		return 0, false
+	}
+	return uint16(first), true
+}
+
+// parseWatchpoint parses a watchpoint, as described at the top of this
+// file.
+func parseWatchpoint(spec string) (watchpoint, error) {
+
+	rng, mode, found := strings.Cut(strings.TrimSpace(spec), ":")
+	addr, length, hasLength := strings.Cut(rng, "+")
+
+	wp := watchpoint{size: 1, write: true}
+
+	start, err := strconv.ParseUint(addr, 0, 16)
+	if err != nil {
+		return wp, fmt.Errorf("invalid address '%s' in watchpoint '%s'", addr, spec)
+	}
+	wp.start = uint16(start)
+
+	if hasLength {
+		size, err := strconv.ParseUint(length, 0, 32)
+		if err != nil || size < 1 || start+size > 0x10000 {
+			return wp, fmt.Errorf("invalid length '%s' in watchpoint '%s'", length, spec)
+		}
+		wp.size = int(size)
+	}
+
+	if found {
+		switch strings.ToLower(mode) {
+		case "r":
+			wp.read, wp.write = true, false
+		case "w":
+			wp.read, wp.write = false, true
+		case "rw", "wr":
+			wp.read, wp.write = true, true
+		default:
+			return wp, fmt.Errorf("invalid mode '%s' in watchpoint '%s', expected r, w, or rw", mode, spec)
+		}
+	}
+
+	return wp, nil
+}
+
+// WithWatchpoints configures memory watchpoints, as a comma-separated list
+// in the format described at the top of this file.
+//
+// The empty string configures no watchpoints, which is the default.
+func WithWatchpoints(specs string) cpmoption {
+	return func(c *CPM) error {
+		for _, spec := range strings.Split(specs, ",") {
+			if strings.TrimSpace(spec) == "" {
+				continue
+			}
+			wp, err := parseWatchpoint(spec)
+			if err != nil {
+				return err
+			}
+			c.addWatchpoint(wp)
+		}
+		return nil
+	}
+}
+
+// addWatchpoint adds the given watchpoint.
+func (cpm *CPM) addWatchpoint(wp watchpoint) {
+	cpm.watchpoints = append(cpm.watchpoints, wp)
+	sort.SliceStable(cpm.watchpoints, func(i, j int) bool {
+		return cpm.watchpoints[i].start < cpm.watchpoints[j].start
+	})
+	cpm.watchMemory()
+}
+
+// removeWatchpoints removes the watchpoints which cover the given address,
+// returning the number which were removed.
+func (cpm *CPM) removeWatchpoints(addr uint16) int {
+	keep := []watchpoint{}
+	for _, wp := range cpm.watchpoints {
+		if _, ok := wp.overlaps(addr, 1, true); ok {
+			continue
+		}
+		if _, ok := wp.overlaps(addr, 1, false); ok {
+			continue
+		}
+		keep = append(keep, wp)
+	}
+
+	removed := len(cpm.watchpoints) - len(keep)
+	cpm.watchpoints = keep
+	cpm.watchMemory()
+	return removed
+}
+
+// watchMemory installs our hook into our memory, if we have watchpoints,
+// and removes it otherwise, so that there's no cost when none are set.
+func (cpm *CPM) watchMemory() {
+	if cpm.Memory == nil {
+		return
+	}
+	if len(cpm.watchpoints) > 0 {
+		cpm.Memory.SetHook(cpm.watchAccess)
+	} else {
+		cpm.Memory.SetHook(nil)
+	}
+}
+
+// watchAccess is invoked by our memory upon each access, and records the
+// first which triggers a watchpoint.
+//
+// The CPU is halted, so that the hit is reported before the guest executes
+// another instruction.  Accesses made by the emulator itself, such as when
+// a syscall reads an FCB, trigger watchpoints too.
+func (cpm *CPM) watchAccess(addr uint16, size int, write bool) {
+
+	if cpm.watchMuted || cpm.watchHit != nil {
+		return
+	}
+
+	// Mid-instruction the program counter has already advanced, so
+	// report the address of the instruction, if we know it.
+	pc := cpm.CPU.PC
+	if cpm.stepping {
+		pc = cpm.pcHistory[(cpm.pcCount-1)%watchHistory]
+	}
+
+	for _, wp := range cpm.watchpoints {
+		if first, ok := wp.overlaps(addr, size, write); ok {
+			cpm.watchHit = &watchHit{wp: wp, addr: first, write: write, pc: pc}
+			cpm.CPU.HALT = true
+			return
+		}
+	}
+}
+
+// runCPU executes the guest until it reaches a breakpoint, HALTs, or our
+// context is canceled, exactly as the CPU's own Run method does.
+//
+// If we have watchpoints we record the address of each instruction before
+// it is executed, so that we can report them when one triggers.  In 8080
+// mode each instruction is checked before it is executed, see
+// cpm_cpu8080.go, our keyboard interrupt is raised between them, see
+// cpm_keyinterrupt.go, and they're counted if we have an instruction
+// limit, see cpm_maxinstructions.go.  Either way we check for the escape
+// key of our monitor periodically, see cpm_escapepoll.go.
+func (cpm *CPM) runCPU(ctx context.Context) error {
+
+	if len(cpm.watchpoints) == 0 && !cpm.cpu8080 && cpm.kbdInterrupt == nil && cpm.maxInstructions == 0 {
+		return cpm.runFreely(ctx)
+	}
+
+	cpm.stepping = true
+	defer func() {
+		cpm.stepping = false
+	}()
+
+	cpm.CPU.HALT = false
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err := cpm.check8080()
+		if err != nil {
+			return err
+		}
+
+		err = cpm.countInstruction()
+		if err != nil {
+			return err
+		}
+
+		err = cpm.stepEscape()
+		if err != nil {
+			return err
+		}
+
+		cpm.raiseKeyboardInterrupt()
+
+		cpm.pcHistory[cpm.pcCount%watchHistory] = cpm.CPU.PC
+		cpm.pcCount++
+
+		cpm.CPU.Step()
+
+		if _, ok := cpm.CPU.BreakPoints[cpm.CPU.PC]; ok {
+			return z80.ErrBreakPoint
+		}
+		if cpm.CPU.HALT {
+			if cpm.awaitKeyboardInterrupt(ctx) {
+				continue
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// recentPCs returns the addresses of the most recently executed
+// instructions, the most recent first.
+func (cpm *CPM) recentPCs() []uint16 {
+	ret := []uint16{}
+	for i := 1; i <= min(cpm.pcCount, watchHistory); i++ {
+		ret = append(ret, cpm.pcHistory[(cpm.pcCount-i)%watchHistory])
+	}
+	return ret
+}
+
+// writeWatchHit describes the access which triggered a watchpoint.
+func (cpm *CPM) writeWatchHit(out io.Writer, hit *watchHit) {
+
+	access := "read"
+	if hit.write {
+		access = "write"
+	}
+
+	fmt.Fprintf(out, "Watchpoint %s triggered by a %s of %04X, value %02X, at PC %04X",
+		hit.wp, access, hit.addr, cpm.Memory.Get(hit.addr), hit.pc)
+	if sym := cpm.symbolFor(hit.pc); sym != "" {
+		fmt.Fprintf(out, " (%s)", sym)
+	}
+	fmt.Fprintf(out, "\n")
+
+	recent := cpm.recentPCs()
+	if len(recent) > 0 {
+		fmt.Fprintf(out, "Recent PCs:")
+		for _, pc := range recent {
+			fmt.Fprintf(out, " %04X", pc)
+			if sym := cpm.symbolFor(pc); sym != "" {
+				fmt.Fprintf(out, "(%s)", sym)
+			}
+		}
+		fmt.Fprintf(out, "\n")
+	}
+}
+
+// watchpointHit is called when a watchpoint has triggered, it logs the
+// access, and drops the user into our monitor, if it is enabled.
+func (cpm *CPM) watchpointHit() error {
+
+	hit := cpm.watchHit
+	if hit == nil {
+		return nil
+	}
+
+	cpm.watchMuted = true
+	defer func() {
+		cpm.watchMuted = false
+		cpm.watchHit = nil
+	}()
+
+	var report strings.Builder
+	cpm.writeWatchHit(&report, hit)
+
+	slog.Warn("watchpoint triggered",
+		slog.String("watchpoint", hit.wp.String()),
+		slog.String("address", fmt.Sprintf("%04X", hit.addr)),
+		slog.Bool("write", hit.write),
+		slog.String("pc", fmt.Sprintf("%04X", hit.pc)),
+		slog.String("symbol", cpm.symbolFor(hit.pc)),
+		slog.String("report", strings.TrimSpace(report.String())))
+
+	if cpm.monitorKey == 0 {
+		return nil
+	}
+
+	cpm.output.Flush()
+	fmt.Print(strings.ReplaceAll("\n"+report.String(), "\n", "\r\n"))
+	return cpm.monitor()
+}
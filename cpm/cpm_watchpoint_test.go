@@ -0,0 +1,154 @@
+package cpm
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestParseWatchpoint tests the parsing of watchpoints.
+func TestParseWatchpoint(t *testing.T) {
+
+	type TestCase struct {
+		Spec     string
+		Expected string
+	}
+
+	tests := []TestCase{
+		{Spec: "0x5C", Expected: "0x005C+1:w"},
+		{Spec: "92+36", Expected: "0x005C+36:w"},
+		{Spec: "0x80+0x80:r", Expected: "0x0080+128:r"},
+		{Spec: " 0xFFFF:RW ", Expected: "0xFFFF+1:rw"},
+	}
+
+	for _, test := range tests {
+		wp, err := parseWatchpoint(test.Spec)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %s", test.Spec, err)
+		}
+		if wp.String() != test.Expected {
+			t.Fatalf("%s: got %s, expected %s", test.Spec, wp, test.Expected)
+		}
+	}
+
+	for _, bogus := range []string{"", "steve", "0x10000", "0x5C+", "0x5C+0", "0xFFFF+2", "0x5C:x"} {
+		_, err := parseWatchpoint(bogus)
+		if err == nil {
+			t.Fatalf("expected an error parsing '%s'", bogus)
+		}
+	}
+
+	_, err := New(WithWatchpoints("0x5C,steve"))
+	if err == nil {
+		t.Fatalf("expected an error with a bogus watchpoint")
+	}
+}
+
+// TestWatchpoint runs a program which writes to a watched address, and
+// ensures the access is reported.
+func TestWatchpoint(t *testing.T) {
+
+	old := slog.Default()
+	defer slog.SetDefault(old)
+	logs := &bytes.Buffer{}
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	// LD A, 0x41 ; LD (0x005D), A ; LD C, 0 ; CALL 0x0005
+	path := filepath.Join(t.TempDir(), "POKE.COM")
+	err := os.WriteFile(path, []byte{0x3E, 0x41, 0x32, 0x5D, 0x00, 0x0E, 0x00, 0xCD, 0x05, 0x00}, 0644)
+	if err != nil {
+		t.Fatalf("failed to write program: %s", err)
+	}
+
+	obj, err := New(WithOutputDriver("null"), WithWatchpoints("0x80+128:rw,0x5C+36"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+
+	err = obj.LoadBinary(path)
+	if err != nil {
+		t.Fatalf("failed to load program: %s", err)
+	}
+
+	err = obj.Execute([]string{})
+	if err != nil {
+		t.Fatalf("unexpected error running program: %v", err)
+	}
+
+	for _, expected := range []string{
+		"watchpoint=0x005C+36:w",
+		"address=005D",
+		"write=true",
+		"pc=0102",
+		"Recent PCs: 0102 0100",
+	} {
+		if !strings.Contains(logs.String(), expected) {
+			t.Fatalf("log didn't contain '%s':\n%s", expected, logs.String())
+		}
+	}
+	if strings.Contains(logs.String(), "0x0080") {
+		t.Fatalf("unexpected watchpoint triggered:\n%s", logs.String())
+	}
+
+	// Without watchpoints memory isn't watched.
+	obj.watchpoints = nil
+	logs.Reset()
+	err = obj.LoadBinary(path)
+	if err != nil {
+		t.Fatalf("failed to load program: %s", err)
+	}
+	err = obj.Execute([]string{})
+	if err != nil {
+		t.Fatalf("unexpected error running program: %v", err)
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("unexpected log output:\n%s", logs.String())
+	}
+}
+
+// TestWatchpointMonitor tests the monitor commands which manage our
+// watchpoints.
+func TestWatchpointMonitor(t *testing.T) {
+
+	obj, err := New(WithMonitorKey(0x1D))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+
+	type TestCase struct {
+		Command  string
+		Expected string
+	}
+
+	tests := []TestCase{
+		{Command: "watch", Expected: "No watchpoints are set"},
+		{Command: "watch 0x5C 36", Expected: ""},
+		{Command: "watch 0x80 128 rw", Expected: ""},
+		{Command: "watch 0x10 1 x", Expected: "invalid mode"},
+		{Command: "watch", Expected: "0x005C+36:w\n0x0080+128:rw\n"},
+		{Command: "unwatch", Expected: "Usage"},
+		{Command: "unwatch steve", Expected: "invalid address"},
+		{Command: "unwatch 0x10", Expected: "No watchpoint covers 0010"},
+		{Command: "unwatch 0x60", Expected: ""},
+		{Command: "watch", Expected: "0x0080+128:rw\n"},
+		{Command: "unwatch all", Expected: ""},
+		{Command: "watch", Expected: "No watchpoints are set"},
+	}
+
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		_, err := obj.monitorCommand(out, test.Command)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", test.Command, err)
+		}
+		if !strings.Contains(out.String(), test.Expected) {
+			t.Fatalf("%s: output didn't contain '%s':\n%s", test.Command, test.Expected, out.String())
+		}
+		if test.Expected == "" && out.Len() != 0 {
+			t.Fatalf("%s: unexpected output:\n%s", test.Command, out.String())
+		}
+	}
+}
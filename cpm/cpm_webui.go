@@ -0,0 +1,188 @@
+// cpm_webui.go contains our web interface, which allows a running session
+// to be watched, and driven, from a browser.
+//
+// A single page is served which shows the terminal, the files upon each
+// of our drives, and a tail of the syscalls which have been made.  The
+// page receives our events as a stream of server-sent events, and posts
+// keystrokes back to us, so it needs no dependencies beyond the standard
+// library.
+
+package cpm
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// webPage holds the single page of our web interface.
+//
+//go:embed cpm_webui.html
+var webPage []byte
+
+// WithHTTP configures the address upon which our web interface will be
+// served, for example ":8080".
+//
+// The empty string disables the web interface, which is the default.
+func WithHTTP(addr string) cpmoption {
+	return func(c *CPM) error {
+		if addr == "" {
+			return nil
+		}
+
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen upon %s: %s", addr, err)
+		}
+
+		bus := c.eventBus()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", c.webIndex)
+		mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+			c.webEvents(w, r, bus)
+		})
+		mux.HandleFunc("/input", c.webInput)
+		mux.HandleFunc("/files", c.webFiles)
+
+		c.httpServer = &http.Server{Handler: mux}
+		go func() {
+			err := c.httpServer.Serve(listener)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("web interface failed",
+					slog.String("error", err.Error()))
+			}
+		}()
+		return nil
+	}
+}
+
+// webIndex serves our single page.
+func (cpm *CPM) webIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(webPage)
+}
+
+// webEvents streams our events, as server-sent events, until the client
+// disconnects or the event bus is closed.
+func (cpm *CPM) webEvents(w http.ResponseWriter, r *http.Request, bus *eventBus) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	queue := bus.subscribe()
+	defer bus.unsubscribe(queue)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case data, ok := <-queue:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(w, "data: %s\n\n", strings.TrimSuffix(string(data), "\n"))
+			flusher.Flush()
+		}
+	}
+}
+
+// webInput injects the body of the request as console input.
+func (cpm *CPM) webInput(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cpm.input.Inject(string(data))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// webFile describes a single file in the response of webFiles.
+type webFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// webDrive describes a single drive in the response of webFiles.
+type webDrive struct {
+	Drive string    `json:"drive"`
+	Path  string    `json:"path"`
+	Files []webFile `json:"files"`
+}
+
+// webFiles returns the files in the host directory of each of our drives,
+// as JSON.  Drives which share a directory are only listed once.
+func (cpm *CPM) webFiles(w http.ResponseWriter, r *http.Request) {
+
+	paths := cpm.GetDrivePaths()
+
+	drives := []string{}
+	for drive := range paths {
+		drives = append(drives, drive)
+	}
+	sort.Strings(drives)
+
+	seen := make(map[string]bool)
+	res := []webDrive{}
+	for _, drive := range drives {
+		path, err := filepath.Abs(paths[drive])
+		if err != nil || seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			continue
+		}
+
+		d := webDrive{Drive: drive, Path: path, Files: []webFile{}}
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			d.Files = append(d.Files, webFile{Name: e.Name(), Size: info.Size()})
+		}
+		res = append(res, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// closeHTTP shuts down our web interface, if it is enabled.
+func (cpm *CPM) closeHTTP() {
+	if cpm.httpServer != nil {
+		cpm.httpServer.Close()
+		cpm.httpServer = nil
+	}
+}
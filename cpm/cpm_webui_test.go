@@ -0,0 +1,112 @@
+package cpm
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWebInterface tests the handlers of our web interface.
+func TestWebInterface(t *testing.T) {
+
+	c, err := New(WithOutputDriver("null"))
+	if err != nil {
+		t.Fatalf("failed to create CPM: %s", err)
+	}
+	bus := c.eventBus()
+	c.connectEvents()
+	defer c.IOTearDown()
+
+	dir := t.TempDir()
+	c.SetDrives(false)
+	c.SetDrivePath("A", dir)
+	err = os.WriteFile(filepath.Join(dir, "HELLO.TXT"), []byte("hello"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", c.webIndex)
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		c.webEvents(w, r, bus)
+	})
+	mux.HandleFunc("/input", c.webInput)
+	mux.HandleFunc("/files", c.webFiles)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// The page is served.
+	res, err := http.Get(server.URL + "/")
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("failed to fetch page: %v", err)
+	}
+	res.Body.Close()
+
+	// The files are listed.
+	res, err = http.Get(server.URL + "/files")
+	if err != nil {
+		t.Fatalf("failed to fetch files: %s", err)
+	}
+	var drives []webDrive
+	err = json.NewDecoder(res.Body).Decode(&drives)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to decode files: %s", err)
+	}
+	found := false
+	for _, d := range drives {
+		for _, f := range d.Files {
+			if d.Drive == "A" && f.Name == "HELLO.TXT" && f.Size == 5 {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("file not listed: %v", drives)
+	}
+
+	// Input may be injected.
+	res, err = http.Post(server.URL+"/input", "text/plain", strings.NewReader("A"))
+	if err != nil || res.StatusCode != http.StatusNoContent {
+		t.Fatalf("failed to inject input: %v", err)
+	}
+	res.Body.Close()
+	got, err := c.input.BlockForCharacterNoEcho()
+	if err != nil || got != 'A' {
+		t.Fatalf("unexpected input %c %v", got, err)
+	}
+
+	// Events are streamed.
+	res, err = http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatalf("failed to fetch events: %s", err)
+	}
+	defer res.Body.Close()
+
+	// Wait until we've subscribed.
+	for i := 0; i < 500; i++ {
+		bus.mutex.Lock()
+		n := len(bus.queues)
+		bus.mutex.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.output.PutCharacter('Z')
+
+	reader := bufio.NewReader(res.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read event: %s", err)
+	}
+	if !strings.HasPrefix(line, "data: ") || !strings.Contains(line, `"text":"Z"`) {
+		t.Fatalf("unexpected event %q", line)
+	}
+}
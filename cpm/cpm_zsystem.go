@@ -0,0 +1,377 @@
+// cpm_zsystem.go contains the Z-System environment which we provide when
+// the selected CCP asks for one, such as via "-ccp ccpz-z3env".
+//
+// ZCPR3 utilities find the parts of the system they use via a descriptor,
+// the ENV, which records the addresses of the path, the message buffer,
+// the named directories, and so on, along with details of the system such
+// as the valid drives.  The terminal capabilities, the TCAP, follow it.
+//
+// Programs learn the address of the ENV either by having been installed
+// with Z3INS, or from their header: a program which begins with a jump,
+// followed by "Z3ENV" and a type byte of 1, has the address patched into
+// the word at 0x0109 as it is launched, as ZCPR 3.3 does.  The address is
+// also passed to every program in HL.
+//
+// The environment lives in the free memory above our CCP.  The ENV and
+// TCAP are refreshed whenever the CCP, or a binary, is loaded, so that
+// they describe the configured drives and the active output driver, while
+// the message buffer, path, shell stack, and the other areas survive warm
+// boots, as they would upon a real Z-System.
+
+package cpm
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/skx/cpmulator/ccp"
+	"github.com/skx/cpmulator/fcb"
+)
+
+// The addresses, and sizes, of the areas of our Z-System environment.
+const (
+	// z3ShellStack holds z3ShellEntries entries of z3ShellSize bytes.
+	z3ShellStack   = 0xE800
+	z3ShellEntries = 4
+	z3ShellSize    = 32
+
+	// z3Message is the message buffer, of 80 bytes.
+	z3Message = 0xE880
+
+	// z3ExtFCB is the external FCB, which holds the name of the
+	// running program.
+	z3ExtFCB = 0xE8D0
+
+	// z3Path holds z3PathEntries drive/user pairs, and a terminating
+	// NUL.
+	z3Path        = 0xE8F4
+	z3PathEntries = 5
+
+	// z3Wheel is the wheel byte, which grants privileges when set.
+	z3Wheel = 0xE8FF
+
+	// z3Env is the environment descriptor, which is followed by the
+	// terminal capabilities at z3TCAP.
+	z3Env  = 0xE900
+	z3TCAP = 0xE980
+
+	// z3NamedDirs holds z3NamedEntries entries of 18 bytes, and a
+	// terminating NUL.
+	z3NamedDirs    = 0xEA00
+	z3NamedEntries = 14
+
+	// z3CommandLine is the multiple command-line buffer.
+	z3CommandLine     = 0xEB00
+	z3CommandLineSize = 200
+
+	// z3ExtStack is the external stack, of 48 bytes.
+	z3ExtStack = 0xEBD0
+)
+
+// z3Terminal describes the terminal capabilities we report for a family
+// of output drivers.
+type z3Terminal struct {
+	// name is the name of the terminal.
+	name string
+
+	// arrows are the keys for up, down, right, and left.
+	arrows string
+
+	// clear, move, eol, standout, and standend are the strings which
+	// clear the screen, move the cursor, clear to the end of the line,
+	// and start and end highlighting.  The move string uses the TCAP
+	// format, where "%i" counts from one, "%d" outputs a number, and
+	// "%+ " outputs a number offset by a space.
+	clear    string
+	move     string
+	eol      string
+	standout string
+	standend string
+}
+
+// z3Terminals holds the capabilities of each of our output drivers which
+// understand escape sequences.  Others are described as a dumb terminal.
+var z3Terminals = map[string]z3Terminal{
+	"adm-3a": {
+		name:     "ADM-3A",
+		arrows:   "\x0B\x0A\x0C\x08",
+		clear:    "\x1A",
+		move:     "\x1B=%+ %+ ",
+		eol:      "\x18",
+		standout: "\x1BB0",
+		standend: "\x1BC0",
+	},
+	"ansi": {
+		name:     "ANSI",
+		arrows:   "\x05\x18\x04\x13",
+		clear:    "\x1B[H\x1B[2J",
+		move:     "\x1B[%i%d;%dH",
+		eol:      "\x1B[K",
+		standout: "\x1B[7m",
+		standend: "\x1B[0m",
+	},
+}
+
+// init shares the capabilities of the ANSI driver with the drivers which
+// behave the same way.
+func init() {
+	z3Terminals["asciinema"] = z3Terminals["ansi"]
+	z3Terminals["windows"] = z3Terminals["ansi"]
+}
+
+// zsystem returns true if the selected CCP should be given a Z-System
+// environment.
+func (cpm *CPM) zsystem() bool {
+	flavour, err := ccp.Get(cpm.ccp)
+	return err == nil && flavour.ZSystem
+}
+
+// setupZSystem creates our Z-System environment, if the selected CCP
+// wants one.
+//
+// The ENV and TCAP are always rewritten, but the other areas are only
+// initialized if the environment isn't already present in RAM.
+func (cpm *CPM) setupZSystem() {
+
+	if !cpm.zsystem() {
+		return
+	}
+
+	if string(cpm.Memory.GetRange(z3Env+3, 5)) != "Z3ENV" {
+		cpm.initZSystem()
+	}
+	cpm.writeZ3Env()
+	cpm.writeZ3TCAP()
+}
+
+// initZSystem initializes the areas of our environment which programs
+// may change, and which otherwise survive warm boots.
+func (cpm *CPM) initZSystem() {
+
+	cpm.Memory.FillRange(z3ShellStack, z3ShellEntries*z3ShellSize, 0x00)
+	cpm.Memory.FillRange(z3Message, 80, 0x00)
+	cpm.Memory.FillRange(z3ExtFCB, 36, 0x00)
+	cpm.Memory.FillRange(z3ExtStack, 48, 0x00)
+
+	// The path is the current drive and user, then A0:.
+	cpm.Memory.FillRange(z3Path, z3PathEntries*2+1, 0x00)
+	cpm.Memory.SetRange(z3Path, '$', '$', 0x01, 0x00)
+
+	// We're a single-user system, so everybody is privileged.
+	cpm.Memory.Set(z3Wheel, 0xFF)
+
+	// The command-line buffer is empty.
+	cpm.Memory.FillRange(z3CommandLine, z3CommandLineSize, 0x00)
+	cpm.z3Word(z3CommandLine, z3CommandLine+4)
+	cpm.Memory.Set(z3CommandLine+2, z3CommandLineSize-5)
+
+	cpm.writeZ3NamedDirs()
+}
+
+// writeZ3NamedDirs writes our named directories, in the order of their
+// names, as the named directory register.
+func (cpm *CPM) writeZ3NamedDirs() {
+
+	names := []string{}
+	for name := range cpm.namedDirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(names) > z3NamedEntries {
+		slog.Warn("too many named directories for the Z-System environment",
+			slog.Int("count", len(names)),
+			slog.Int("max", z3NamedEntries))
+		names = names[:z3NamedEntries]
+	}
+
+	cpm.Memory.FillRange(z3NamedDirs, z3NamedEntries*18+1, 0x00)
+
+	addr := uint16(z3NamedDirs)
+	for _, name := range names {
+		du := cpm.namedDirs[name]
+
+		// A name without a drive refers to the current one.
+		drive := du.Drive
+		if drive == 0 {
+			drive = cpm.currentDrive + 1
+		}
+		user := du.User
+		if user < 0 {
+			user = 0
+		}
+
+		cpm.Memory.Set(addr, drive)
+		cpm.Memory.Set(addr+1, uint8(user))
+		cpm.Memory.SetRange(addr+2, []byte(z3Pad(name, 8))...)
+		cpm.Memory.SetRange(addr+10, []byte(z3Pad("", 8))...)
+		addr += 18
+	}
+}
+
+// writeZ3Env writes our environment descriptor.
+func (cpm *CPM) writeZ3Env() {
+
+	env := make([]byte, 0x80)
+
+	setWord := func(offset int, val uint16) {
+		env[offset] = uint8(val & 0xFF)
+		env[offset+1] = uint8(val >> 8)
+	}
+
+	// The leading jump, the signature, and the type.
+	env[0x00] = 0xC3
+	copy(env[0x03:], "Z3ENV")
+	env[0x08] = 0x80
+
+	// The areas of the system, and their sizes.  We have no RCP, IOP,
+	// or FCP.
+	setWord(0x09, z3Path)
+	env[0x0B] = z3PathEntries
+	setWord(0x15, z3NamedDirs)
+	env[0x17] = z3NamedEntries
+	setWord(0x18, z3CommandLine)
+	env[0x1A] = z3CommandLineSize
+	setWord(0x1B, z3Env)
+	env[0x1D] = 2
+	setWord(0x1E, z3ShellStack)
+	env[0x20] = z3ShellEntries
+	env[0x21] = z3ShellSize
+	setWord(0x22, z3Message)
+	setWord(0x24, z3ExtFCB)
+	setWord(0x26, z3ExtStack)
+	setWord(0x29, z3Wheel)
+
+	// Processor speed, in MHz.
+	env[0x2B] = 4
+
+	// The drives, and users, which may be used, and whether DU:
+	// prefixes are accepted.
+	vector := uint16(0)
+	for drive := uint8(0); drive < 16; drive++ {
+		if cpm.driveExists(drive) {
+			vector |= 1 << drive
+			env[0x2C] = drive + 1
+		}
+	}
+	env[0x2D] = 15
+	env[0x2E] = 1
+	setWord(0x34, vector)
+
+	// The console.
+	width, height, err := cpm.getTerminalSize()
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+	env[0x31] = uint8(min(width, 255))
+	env[0x32] = uint8(min(height, 255))
+	env[0x33] = uint8(min(height, 255) - 2)
+
+	// The printer.
+	copy(env[0x37:], []byte{80, 66, 58, 1})
+	copy(env[0x3B:], []byte{96, 66, 58, 1})
+
+	// The addresses of the CCP, BDOS, and BIOS.
+	if flavour, err := ccp.Get(cpm.ccp); err == nil {
+		setWord(0x3F, flavour.Start)
+		env[0x41] = uint8((len(flavour.Bytes) + 127) / 128)
+	}
+	setWord(0x42, cpm.bdosAddress)
+	if cpm.biosAddress > cpm.bdosAddress {
+		env[0x44] = uint8((cpm.biosAddress - cpm.bdosAddress) / 128)
+	}
+	setWord(0x45, cpm.biosAddress)
+
+	// The file holding shell variables, and four blank filenames.
+	copy(env[0x47:], z3Pad("SH", 8)+"VAR")
+	copy(env[0x52:], strings.Repeat(" ", 44))
+
+	cpm.Memory.SetRange(z3Env, env...)
+}
+
+// writeZ3TCAP writes the capabilities of the terminal provided by our
+// output driver.
+func (cpm *CPM) writeZ3TCAP() {
+
+	tcap := make([]byte, 0x80)
+
+	term, ok := z3Terminals[cpm.output.GetName()]
+	if !ok {
+		term = z3Terminal{name: "DUMB"}
+	}
+
+	copy(tcap, z3Pad(term.name, 16))
+	copy(tcap[0x10:], term.arrows)
+
+	// There are no delays, and the strings are each terminated by a
+	// NUL.  We have no strings to initialize, or deinitialize, the
+	// terminal.
+	offset := 0x17
+	for _, str := range []string{term.clear, term.move, term.eol, term.standout, term.standend, "", ""} {
+		offset += copy(tcap[offset:], str) + 1
+	}
+
+	cpm.Memory.SetRange(z3TCAP, tcap...)
+}
+
+// zsystemProgram prepares a program which is about to start, if we're
+// providing a Z-System environment.
+//
+// The name of the program is stored in the external FCB, the address of
+// our environment is installed in its header, if it has one, and passed
+// in HL.
+func (cpm *CPM) zsystemProgram() {
+
+	if !cpm.zsystem() {
+		return
+	}
+
+	// The CCP records the name as typed, such as "B:DUMP", and binaries
+	// launched directly have their suffix.
+	name := cpm.exit.command
+	if name != "" {
+		f := fcb.FromString(name)
+		if strings.TrimSpace(string(f.Type[:])) == "" {
+			copy(f.Type[:], "COM")
+		}
+		cpm.Memory.SetRange(z3ExtFCB, f.AsBytes()[:36]...)
+	}
+
+	cpm.CPU.States.HL.SetU16(z3Env)
+
+	if string(cpm.Memory.GetRange(0x0103, 5)) != "Z3ENV" {
+		return
+	}
+
+	switch typ := cpm.Memory.Get(0x0108); typ {
+	case 1:
+		cpm.z3Word(0x0109, z3Env)
+	case 3:
+		// Type-3 programs name the address they're to be loaded
+		// at, which must be ours.
+		if load := cpm.Memory.GetU16(0x010B); load != 0x0100 {
+			slog.Warn("ZCPR3 program must be loaded elsewhere",
+				slog.String("program", name),
+				slog.String("address", fmt.Sprintf("%04X", load)))
+			return
+		}
+		cpm.z3Word(0x0109, z3Env)
+	default:
+		slog.Debug("ZCPR3 program doesn't need its environment installed",
+			slog.String("program", name),
+			slog.Int("type", int(typ)))
+	}
+}
+
+// z3Pad pads the given name with spaces, or truncates it, to the given
+// length.
+func z3Pad(name string, length int) string {
+	return (name + strings.Repeat(" ", length))[:length]
+}
+
+// z3Word writes a little-endian word to RAM.
+func (cpm *CPM) z3Word(addr uint16, val uint16) {
+	cpm.Memory.SetRange(addr, uint8(val&0xFF), uint8(val>>8))
+}
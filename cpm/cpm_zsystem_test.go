@@ -0,0 +1,115 @@
+package cpm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestZSystem tests the Z-System environment we provide for the ccpz-z3env CCP.
+func TestZSystem(t *testing.T) {
+
+	// Other CCPs don't get one.
+	c, err := New(WithCCP("ccpz"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	err = c.LoadCCP()
+	if err != nil {
+		t.Fatalf("failed to load CCP: %s", err)
+	}
+	if string(c.Memory.GetRange(z3Env+3, 5)) == "Z3ENV" {
+		t.Fatalf("the environment was created for CCPZ")
+	}
+
+	c, err = New(WithCCP("ccpz-z3env"), WithOutputDriver("adm-3a"), WithNamedDirectories("WORK=C3,ROOT=A0"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	dir := t.TempDir()
+	c.SetDrives(true)
+	c.SetDrivePath("A", dir)
+	c.SetDrivePath("C", dir)
+
+	err = c.LoadCCP()
+	if err != nil {
+		t.Fatalf("failed to load CCP: %s", err)
+	}
+
+	// The descriptor is present, and points to itself.
+	if string(c.Memory.GetRange(z3Env+3, 5)) != "Z3ENV" || c.Memory.GetU16(z3Env+0x1B) != z3Env {
+		t.Fatalf("the environment wasn't created")
+	}
+
+	// Only A: and C: exist.
+	if c.Memory.GetU16(z3Env+0x34) != 0x0005 || c.Memory.Get(z3Env+0x2C) != 3 {
+		t.Fatalf("wrong drive vector %04X", c.Memory.GetU16(z3Env+0x34))
+	}
+
+	// The terminal is that of our output driver.
+	tcap := string(c.Memory.GetRange(z3TCAP, 0x80))
+	if !strings.HasPrefix(tcap, "ADM-3A ") || !strings.Contains(tcap[0x17:], "\x1A\x00\x1B=%+ %+ \x00") {
+		t.Fatalf("wrong terminal capabilities %q", tcap)
+	}
+
+	// The named directories are sorted.
+	ndr := c.Memory.GetRange(z3NamedDirs, 37)
+	if string(ndr[0:10]) != "\x01\x00ROOT    " || string(ndr[18:28]) != "\x03\x03WORK    " || ndr[36] != 0x00 {
+		t.Fatalf("wrong named directories %q", ndr)
+	}
+
+	// The path, and the wheel byte.
+	if string(c.Memory.GetRange(z3Path, 5)) != "$$\x01\x00\x00" || c.Memory.Get(z3Wheel) != 0xFF {
+		t.Fatalf("wrong path, or wheel")
+	}
+
+	// The message buffer survives a warm boot, but the terminal is
+	// updated.
+	c.Memory.Set(z3Message, 0x42)
+	err = c.output.ChangeDriver("logger")
+	if err != nil {
+		t.Fatalf("failed to change driver: %s", err)
+	}
+	err = c.LoadCCP()
+	if err != nil {
+		t.Fatalf("failed to reload CCP: %s", err)
+	}
+	if c.Memory.Get(z3Message) != 0x42 {
+		t.Fatalf("the message buffer was reset")
+	}
+	if !strings.HasPrefix(string(c.Memory.GetRange(z3TCAP, 16)), "DUMB ") {
+		t.Fatalf("the terminal wasn't updated")
+	}
+
+	// A program with a Z3ENV header has the address installed as it
+	// starts, and is given it in HL.
+	c, err = New(WithCCP("ccpz-z3env"))
+	if err != nil {
+		t.Fatalf("failed to create CPM")
+	}
+	c.SetDrives(false)
+	c.SetDrivePath("A", dir)
+
+	prog := []byte{0xC3, 0x0D, 0x01, 'Z', '3', 'E', 'N', 'V', 0x01, 0x00, 0x00, 0x00, 0x00, 0x76}
+	bin := filepath.Join(dir, "Z3TEST.COM")
+	err = os.WriteFile(bin, prog, 0644)
+	if err != nil {
+		t.Fatalf("failed to write binary: %s", err)
+	}
+	err = c.LoadBinary(bin)
+	if err != nil {
+		t.Fatalf("failed to load binary: %s", err)
+	}
+	err = c.Execute(nil)
+	if err != ErrHalt {
+		t.Fatalf("unexpected error running binary: %v", err)
+	}
+
+	if c.Memory.GetU16(0x0109) != z3Env || c.CPU.States.HL.U16() != z3Env {
+		t.Fatalf("the environment wasn't installed")
+	}
+	if string(c.Memory.GetRange(z3ExtFCB+1, 11)) != "Z3TEST  COM" {
+		t.Fatalf("wrong external FCB %q", c.Memory.GetRange(z3ExtFCB, 12))
+	}
+}
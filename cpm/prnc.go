@@ -2,32 +2,411 @@ package cpm
 
 import (
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skx/cpmulator/rotate"
 )
 
+// printerBufferSize is the number of characters which are buffered before
+// they are written to the printer file, unless a line is completed first.
+const printerBufferSize = 128
+
+// printerMaxPending is the number of characters we'll hold while the
+// printer file cannot be written, after which output is discarded.
+const printerMaxPending = 64 * 1024
+
+// printerCloseTimeout is the longest we wait for a command we're piping
+// to to accept the last of our output, when the emulator terminates, before
+// it is killed.
+const printerCloseTimeout = 2 * time.Second
+
+// listDevices are the names of the devices which may be assigned to LST:,
+// indexed by the value of the top two bits of the IOByte.
+var listDevices = []string{"TTY", "CRT", "LPT", "UL1"}
+
+// printer holds the state of our printer, which is really a file.
+type printer struct {
+
+	// mutex protects our state, since we're flushed when the emulator
+	// is torn down, which might happen from a signal handler.
+	mutex sync.Mutex
+
+	// kind is the type of the printer, one of "file", "pipe", "null",
+	// or "console".  The empty string means a file at our prnPath.
+	kind string
+
+	// target is the path of the file, or the command to pipe to.
+	target string
+
+	// cmd is the command we're piping to, and stdin its input, once
+	// they've been started.
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	// pending holds the characters which have not yet been written.
+	pending []byte
+
+	// queue holds the characters which are being written to the
+	// command we're piping to, by a goroutine, so that a command which
+	// stops reading doesn't stall the emulator.  writing is true while
+	// that goroutine is running, and writers allows us to wait for it.
+	queue   []byte
+	writing bool
+	writers sync.WaitGroup
+
+	// pipeErr holds the error from the last write to the command we're
+	// piping to, which is restarted upon our next write.
+	pipeErr error
+
+	// err holds the error from our last attempt to write to the file,
+	// if that failed.  While this is set the printer is "not ready".
+	err error
+
+	// dropped is the count of characters discarded since we failed.
+	dropped int
+}
+
+// WithListDevice configures where the output sent to the given LST:
+// device is written, the device being one of TTY, CRT, LPT, or UL1, as
+// selected by the top two bits of the IOByte.
+//
+// The destination may be "null", "console", "file:/path/to/file", or
+// "pipe:command", and devices which aren't configured write to the file
+// set via WithPrinterPath.  The empty string leaves the device unchanged.
+func WithListDevice(device string, dest string) cpmoption {
+	return func(c *CPM) error {
+
+		if dest == "" {
+			return nil
+		}
+
+		index := -1
+		for i, name := range listDevices {
+			if strings.EqualFold(strings.TrimSuffix(device, ":"), name) {
+				index = i
+			}
+		}
+		if index < 0 {
+			return fmt.Errorf("unknown list device %s, valid choices are %s", device, strings.Join(listDevices, ", "))
+		}
+
+		kind, target, _ := strings.Cut(dest, ":")
+		switch kind {
+		case "null", "console":
+			if target != "" {
+				return fmt.Errorf("list device %s: %s takes no argument", device, kind)
+			}
+		case "file", "pipe":
+			if target == "" {
+				return fmt.Errorf("list device %s: %s requires an argument", device, kind)
+			}
+		default:
+			return fmt.Errorf("list device %s: unknown destination %s, valid choices are null, console, file:path, or pipe:command", device, dest)
+		}
+
+		c.listDevices[index] = &printer{kind: kind, target: target}
+		return nil
+	}
+}
+
+// listDevice returns the printer which is currently assigned to LST:, by
+// the IOByte.
+func (cpm *CPM) listDevice() *printer {
+
+	if cpm.Memory != nil {
+		if p := cpm.listDevices[cpm.Memory.Get(0x0003)>>6]; p != nil {
+			return p
+		}
+	}
+	return &cpm.printer
+}
+
 // prnC attempts to write the character specified to the "printer".
 //
 // We redirect printing to use a file, which defaults to "print.log", but
-// which can be changed via the CLI argument
+// which can be changed via the CLI argument.  If the device selected by
+// the IOByte has been configured, via WithListDevice, we use that instead.
+//
+// Output is buffered, and written when a line is completed, when the buffer
+// is full, or when the emulator terminates.  If the file cannot be written
+// the output is held and retried, and the printer reports "not ready" via
+// LISTST, rather than the emulator terminating.  So this never fails.
 func (cpm *CPM) prnC(char uint8) error {
 
-	// If the file doesn't exist, create it.
-	f, err := os.OpenFile(cpm.prnPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	p := cpm.listDevice()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.buffered() < printerMaxPending {
+		p.pending = append(p.pending, char)
+	} else {
+		p.dropped++
+	}
+
+	if char == '\n' || char == '\f' || len(p.pending) >= printerBufferSize || p.kind == "console" {
+		cpm.flushPrinterLocked(p)
+	}
+
+	return nil
+}
+
+// flushPrinter writes any pending printer output, for all our devices.
+func (cpm *CPM) flushPrinter() {
+
+	for _, p := range cpm.printers() {
+		p.mutex.Lock()
+		cpm.flushPrinterLocked(p)
+		p.mutex.Unlock()
+	}
+}
+
+// closePrinter flushes any pending printer output, and waits for any
+// commands we're piping to to finish.
+func (cpm *CPM) closePrinter() {
+
+	cpm.flushPrinter()
+
+	for _, p := range cpm.printers() {
+
+		// Give the command a chance to accept the last of our
+		// output, but don't wait forever for a stalled one.
+		done := make(chan struct{})
+		go func() {
+			p.writers.Wait()
+			close(done)
+		}()
+
+		stalled := false
+		select {
+		case <-done:
+		case <-time.After(printerCloseTimeout):
+			stalled = true
+		}
+
+		p.mutex.Lock()
+		if p.cmd != nil {
+			if stalled {
+				slog.Warn("printer command isn't reading its input, killing it",
+					slog.String("command", p.target),
+					slog.Int("dropped", p.buffered()))
+				p.cmd.Process.Kill()
+
+				// Our writer will fail, which isn't news.
+				p.err = os.ErrClosed
+			}
+			p.stdin.Close()
+			p.cmd.Wait()
+			p.cmd = nil
+			p.stdin = nil
+		}
+		p.mutex.Unlock()
+
+		p.writers.Wait()
+	}
+}
+
+// buffered returns the number of characters we hold which have not yet
+// been written, the caller must hold the mutex of the printer.
+func (p *printer) buffered() int {
+	return len(p.pending) + len(p.queue)
+}
+
+// printers returns all of our printers.
+func (cpm *CPM) printers() []*printer {
+
+	res := []*printer{&cpm.printer}
+	for _, p := range cpm.listDevices {
+		if p != nil {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// flushPrinterLocked writes any pending output to the given printer, the
+// caller must hold its mutex.
+func (cpm *CPM) flushPrinterLocked(p *printer) {
+
+	if len(p.pending) == 0 && p.pipeErr == nil {
+		return
+	}
+
+	name := cpm.prnPath
+	if p.target != "" {
+		name = p.target
+	}
+
+	err := cpm.writePrinter(p)
 	if err != nil {
-		return fmt.Errorf("prnC: Failed to open file %s:%s", cpm.prnPath, err)
+
+		// Only log the first failure, rather than every retry.
+		if p.err == nil {
+			slog.Warn("printer is not ready, output will be retried",
+				slog.String("path", name),
+				slog.String("error", err.Error()))
+		}
+		p.err = err
+		return
 	}
 
-	data := make([]byte, 1)
-	data[0] = char
-	_, err = f.Write(data)
+	if p.err != nil {
+		slog.Warn("printer is ready again",
+			slog.String("path", name),
+			slog.Int("dropped", p.dropped))
+	}
+
+	p.err = nil
+	p.dropped = 0
+	p.pending = p.pending[:0]
+}
+
+// writePrinter writes the pending output of the given printer to its
+// destination, the caller must hold its mutex.
+func (cpm *CPM) writePrinter(p *printer) error {
+
+	switch p.kind {
+	case "null":
+		return nil
+
+	case "console":
+		for _, c := range p.pending {
+			cpm.output.PutCharacter(c)
+		}
+		return nil
+
+	case "pipe":
+
+		// Restart the command if our last write failed, as it has
+		// gone away.
+		if p.pipeErr != nil && p.cmd != nil {
+			p.stdin.Close()
+			p.cmd.Wait()
+			p.cmd = nil
+			p.stdin = nil
+		}
+		p.pipeErr = nil
+
+		if p.cmd == nil {
+			shell := []string{"sh", "-c"}
+			if runtime.GOOS == "windows" {
+				shell = []string{"cmd", "/C"}
+			}
+
+			cmd := exec.Command(shell[0], shell[1], p.target)
+			cmd.Stderr = os.Stderr
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				return err
+			}
+			err = cmd.Start()
+			if err != nil {
+				return err
+			}
+			p.cmd = cmd
+			p.stdin = stdin
+		}
+
+		// Our output is written in the background, so that we
+		// don't stall if the command does.
+		p.queue = append(p.queue, p.pending...)
+		if !p.writing && len(p.queue) > 0 {
+			p.writing = true
+			p.writers.Add(1)
+			go p.drain(p.stdin)
+		}
+		return nil
+	}
+
+	path := cpm.prnPath
+	if p.kind == "file" {
+		path = p.target
+	}
+
+	// Start a new file if this one is too large.
+	err := rotate.BeforeAppend(path, len(p.pending), cpm.prnRotate)
 	if err != nil {
-		return fmt.Errorf("prnC: Failed to write to file %s:%s", cpm.prnPath, err)
+		return err
 	}
 
-	err = f.Close()
+	// If the file doesn't exist, create it.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		return fmt.Errorf("prnC: Failed to close file %s:%s", cpm.prnPath, err)
+		return err
 	}
+	_, err = f.Write(p.pending)
 
-	return nil
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// drain writes the output queued for the command we're piping to, via
+// the given pipe, until there is none left, or a write fails.
+//
+// This runs in a goroutine, so that a command which stops reading its
+// input only blocks us, rather than the emulator.
+func (p *printer) drain(stdin io.WriteCloser) {
+
+	defer p.writers.Done()
+
+	for {
+		p.mutex.Lock()
+		chunk := p.queue
+		p.queue = nil
+		if len(chunk) == 0 {
+			p.writing = false
+			p.mutex.Unlock()
+			return
+		}
+		p.mutex.Unlock()
+
+		_, err := stdin.Write(chunk)
+		if err != nil {
+
+			// Keep the output, to be written to the command
+			// once it has been restarted.
+			p.mutex.Lock()
+			if p.err == nil {
+				slog.Warn("printer is not ready, output will be retried",
+					slog.String("command", p.target),
+					slog.String("error", err.Error()))
+			}
+			p.queue = append(chunk, p.queue...)
+			p.err = err
+			p.pipeErr = err
+			p.writing = false
+			p.mutex.Unlock()
+			return
+		}
+	}
+}
+
+// printerReady returns true if the printer selected by the IOByte is able
+// to accept output.
+//
+// The printer isn't ready if its output couldn't be written, or if its
+// buffer is full because the command we're piping to has stopped reading.
+// If the printer has failed we retry writing the pending output, so
+// that a guest polling the status will see it recover.
+func (cpm *CPM) printerReady() bool {
+
+	p := cpm.listDevice()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.err != nil {
+		cpm.flushPrinterLocked(p)
+	}
+	return p.err == nil && p.buffered() < printerMaxPending
 }
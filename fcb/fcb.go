@@ -2,8 +2,10 @@
 package fcb
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"unicode"
 )
@@ -11,6 +13,14 @@ import (
 // SIZE contains the size of the FCB structure
 var SIZE = 36
 
+// ExtentRecords is the number of 128-byte records in each logical extent,
+// which is the most the RC field of an FCB may describe.
+const ExtentRecords = 128
+
+// S2Unmodified is the bit of S2 which the BDOS sets when a file is opened,
+// or created, and clears once it has been written to.
+const S2Unmodified = 0x80
+
 // FCB is a structure which is used to hold details about file entries, although
 // later versions of CP/M support directories we do not.
 //
@@ -26,17 +36,21 @@ type FCB struct {
 	// Type holds the suffix.
 	Type [3]uint8
 
-	// Ex holds the logical extent.
+	// Ex holds the logical extent, the 16K section of the file which
+	// the FCB currently refers to, modulo 32.
 	Ex uint8
 
-	// S1 is reserved, and ignored.
+	// S1 is reserved, and ignored, although a user number given with a
+	// ZCPR-style prefix is stored here by FromString.
 	S1 uint8
 
-	// S2 is reserved, and ignored.
+	// S2 holds the module number, the count of 32-extent (512K) sections
+	// which precede the extent, in its low bits, and the unmodified flag
+	// in its high bit.
 	S2 uint8
 
 	// RC holds the record count.
-	// (i.e. The size of the file in 128-byte records.)
+	// (i.e. The number of 128-byte records in the current extent.)
 	RC uint8
 
 	// Allocation map, ignored.
@@ -157,12 +171,15 @@ func (f *FCB) GetSequentialOffset() int64 {
 
 // IncreaseSequentialOffset updates the read/write offset which
 // would be used for the sequential read functions.
+//
+// As with CP/M the current record reaches 128 once the last record of an
+// extent has been read, or written, and the following extent is only
+// selected by the next increase.
 func (f *FCB) IncreaseSequentialOffset() {
 
 	MaxCR := 128
 	MaxEX := 31
 
-	f.S2 &= 0x7F // reset unmodified flag
 	f.Cr++
 	if int(f.Cr) > MaxCR {
 		f.Cr = 1
@@ -174,9 +191,117 @@ func (f *FCB) IncreaseSequentialOffset() {
 	}
 }
 
+// GetExtent returns the number of the extent the FCB refers to, which is
+// held in Ex, and the module number in S2.
+func (f *FCB) GetExtent() int {
+	return (int(f.S2)&0x0F)*32 + int(f.Ex)&0x1F
+}
+
+// SetExtent updates Ex, and the module number in S2, to refer to the given
+// extent, preserving the unmodified flag.
+func (f *FCB) SetExtent(extent int) {
+	f.Ex = uint8(extent % 32)
+	f.S2 = (f.S2 & S2Unmodified) | uint8((extent/32)&0x0F)
+}
+
+// SetRecord updates the extent, and the current record, to refer to the
+// given record of the file, as the random read and write functions do.
+func (f *FCB) SetRecord(record int) {
+	f.SetExtent(record / ExtentRecords)
+	f.Cr = uint8(record % ExtentRecords)
+}
+
+// RecordsInExtent returns the number of 128-byte records a file of the
+// given size has within the given extent, which is what RC should hold
+// when the extent is opened.
+//
+// A partial record at the end of the file is counted, and zero is
+// returned if the file doesn't reach the extent.
+func RecordsInExtent(size int64, extent int) uint8 {
+
+	records := (size + 127) / 128
+	records -= int64(extent) * ExtentRecords
+
+	if records <= 0 {
+		return 0
+	}
+	if records > ExtentRecords {
+		return ExtentRecords
+	}
+	return uint8(records)
+}
+
+// DU holds a drive and user number, as specified by a ZCPR-style prefix
+// such as "B3:".
+type DU struct {
+	// Drive holds the drive, 1 for A: through 16 for P:, or 0 if no
+	// drive was specified.
+	Drive uint8
+
+	// User holds the user number, or -1 if no user number was
+	// specified.
+	User int
+}
+
+// ParseDU parses a drive and user specification, without the trailing
+// colon, in the forms ZCPR accepts: "B" (a drive), "B3" (a drive and user
+// number), "3" (a user number), or "" (neither).
+func ParseDU(spec string) (DU, bool) {
+
+	du := DU{User: -1}
+
+	spec = strings.ToUpper(spec)
+	if len(spec) > 0 && spec[0] >= 'A' && spec[0] <= 'P' {
+		du.Drive = spec[0] - 'A' + 1
+		spec = spec[1:]
+	}
+
+	if spec == "" {
+		return du, true
+	}
+
+	user, err := strconv.Atoi(spec)
+	if err != nil || user < 0 || user > 15 || spec[0] == '-' || spec[0] == '+' {
+		return du, false
+	}
+	du.User = user
+	return du, true
+}
+
+// SplitPrefix splits a ZCPR-style prefix from the given filename, returning
+// the drive and user number it specifies along with the rest of the name.
+//
+// The prefix may be a drive ("B:"), a drive and user number ("B3:"), a user
+// number ("3:"), or the name of a named directory ("WORK:") which is looked
+// up in the given map, whose keys are upper-case.  A DU is preferred to a
+// named directory with the same name, as it is by ZCPR.
+//
+// If there is no prefix the returned DU specifies neither a drive nor a
+// user number, and an error is returned if the prefix is invalid or the
+// named directory is unknown.
+func SplitPrefix(str string, named map[string]DU) (DU, string, error) {
+
+	i := strings.Index(str, ":")
+	if i < 0 {
+		return DU{User: -1}, str, nil
+	}
+
+	prefix := strings.ToUpper(str[:i])
+	if du, ok := ParseDU(prefix); ok {
+		return du, str[i+1:], nil
+	}
+	if du, ok := named[prefix]; ok {
+		return du, str[i+1:], nil
+	}
+	return DU{User: -1}, str, fmt.Errorf("unknown drive or directory %s:", prefix)
+}
+
 // FromString returns an FCB entry from the given string.
 //
 // This is currently just used for processing command-line arguments.
+//
+// A drive prefix sets the drive, counting from 0 for A:, and a user
+// number, as in "B3:FILE.TXT", is stored in the S1 field, as ZCPR does.
 func FromString(str string) FCB {
 
 	// Return value
@@ -185,12 +310,16 @@ func FromString(str string) FCB {
 	// Filenames are always upper-case
 	str = strings.ToUpper(str)
 
-	// Does the string have a drive-prefix?
-	if len(str) > 2 && str[1] == ':' {
-		tmp.Drive = str[0] - 'A'
-		str = str[2:]
-	} else {
-		tmp.Drive = 0x00
+	// Does the string have a drive, or drive and user, prefix?
+	du, rest, err := SplitPrefix(str, nil)
+	if err == nil {
+		str = rest
+		if du.Drive > 0 {
+			tmp.Drive = du.Drive - 1
+		}
+		if du.User >= 0 {
+			tmp.S1 = uint8(du.User)
+		}
 	}
 
 	// Suffix defaults to "   "
@@ -333,6 +462,47 @@ func (f *FCB) DoesMatch(name string) bool {
 	return true
 }
 
+// HasWildcards returns true if the name, or type, in the FCB contain
+// any "?" characters, and so might match more than one file.
+func (f *FCB) HasWildcards() bool {
+	for _, c := range f.Name {
+		if c == '?' {
+			return true
+		}
+	}
+	for _, c := range f.Type {
+		if c == '?' {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpandWildcards returns the filename produced by using the FCB as the
+// destination of a rename, for the given source filename.
+//
+// Any "?" characters in our name, or type, are replaced by the character
+// at the same position in the source, so that "*.BAK" applied to
+// "FOO.TXT" produces "FOO.BAK".
+func (f *FCB) ExpandWildcards(name string) string {
+
+	src := FromString(name)
+
+	tmp := *f
+	for i, c := range tmp.Name {
+		if c == '?' {
+			tmp.Name[i] = src.Name[i]
+		}
+	}
+	for i, c := range tmp.Type {
+		if c == '?' {
+			tmp.Type[i] = src.Type[i]
+		}
+	}
+
+	return tmp.GetFileName()
+}
+
 // GetMatches returns the files matching the pattern in the given FCB record.
 //
 // We try to do this by converting the entries of the named directory into FCBs
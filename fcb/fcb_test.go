@@ -243,6 +243,67 @@ func TestOffset(t *testing.T) {
 
 }
 
+// TestExtent ensures that the extent, and module, are updated correctly.
+func TestExtent(t *testing.T) {
+
+	f := FromString("test")
+	f.S2 = S2Unmodified
+
+	f.SetExtent(70)
+	if f.Ex != 6 || f.S2 != S2Unmodified|2 || f.GetExtent() != 70 {
+		t.Fatalf("unexpected extent Ex:%d S2:%02X", f.Ex, f.S2)
+	}
+
+	f.SetRecord(300)
+	if f.GetExtent() != 2 || f.Cr != 44 {
+		t.Fatalf("unexpected position extent:%d Cr:%d", f.GetExtent(), f.Cr)
+	}
+	if f.GetSequentialOffset() != 300*128 {
+		t.Fatalf("unexpected offset %d", f.GetSequentialOffset())
+	}
+
+	// Reading the last record of an extent leaves the current record
+	// at 128, and the next moves to the following extent.
+	f.SetRecord(127)
+	f.IncreaseSequentialOffset()
+	if f.Ex != 0 || f.Cr != 128 || f.GetSequentialOffset() != 128*128 {
+		t.Fatalf("unexpected position Ex:%d Cr:%d", f.Ex, f.Cr)
+	}
+	f.IncreaseSequentialOffset()
+	if f.Ex != 1 || f.Cr != 1 || f.GetSequentialOffset() != 129*128 {
+		t.Fatalf("unexpected position Ex:%d Cr:%d", f.Ex, f.Cr)
+	}
+}
+
+// TestRecordsInExtent ensures the record count of each extent is correct.
+func TestRecordsInExtent(t *testing.T) {
+
+	type TestCase struct {
+		size    int64
+		extent  int
+		records uint8
+	}
+
+	tests := []TestCase{
+		{0, 0, 0},
+		{1, 0, 1},
+		{128, 0, 1},
+		{129, 0, 2},
+		{16384, 0, 128},
+		{16384, 1, 0},
+		{16385, 1, 1},
+		{40960 + 100, 2, 65},
+		{40960 + 100, 3, 0},
+	}
+
+	for _, test := range tests {
+		got := RecordsInExtent(test.size, test.extent)
+		if got != test.records {
+			t.Fatalf("size %d extent %d has %d records, expected %d", test.size, test.extent, got, test.records)
+		}
+	}
+}
+
 // TestSuffix ensures that the non-printable extensions are replaced with spaces, as expected.
 func TestSuffix(t *testing.T) {
 
@@ -254,3 +315,106 @@ func TestSuffix(t *testing.T) {
 		t.Fatalf("type was weird '%s'", typ)
 	}
 }
+
+// TestExpandWildcards tests the generation of destination names, when
+// renaming files with wildcards.
+func TestExpandWildcards(t *testing.T) {
+
+	type TestCase struct {
+		Pattern  string
+		Source   string
+		Expected string
+	}
+
+	tests := []TestCase{
+		{"*.BAK", "FOO.TXT", "FOO.BAK"},
+		{"NEW.*", "FOO.TXT", "NEW.TXT"},
+		{"*.*", "FOO.TXT", "FOO.TXT"},
+		{"X?Y.TXT", "ABC.COM", "XBY.TXT"},
+		{"AFTER", "BEFORE", "AFTER"},
+		{"*.BAK", "README", "README.BAK"},
+		{"?????????.TX?", "LONGNAME.TX", "LONGNAME.TX"},
+	}
+
+	for _, test := range tests {
+		f := FromString(test.Pattern)
+		out := f.ExpandWildcards(test.Source)
+		if out != test.Expected {
+			t.Fatalf("%s applied to %s gave %s, not %s", test.Pattern, test.Source, out, test.Expected)
+		}
+	}
+}
+
+// TestHasWildcards tests the detection of patterns.
+func TestHasWildcards(t *testing.T) {
+
+	tests := map[string]bool{
+		"*.*":      true,
+		"FOO.*":    true,
+		"*.COM":    true,
+		"F?O.TXT":  true,
+		"FOO.T?T":  true,
+		"FOO.TXT":  false,
+		"FOO":      false,
+		"B:FOO.BA": false,
+	}
+
+	for name, expected := range tests {
+		f := FromString(name)
+		if f.HasWildcards() != expected {
+			t.Fatalf("%s: expected %t", name, expected)
+		}
+	}
+}
+
+// TestSplitPrefix tests the ZCPR-style drive/user, and named directory,
+// prefixes.
+func TestSplitPrefix(t *testing.T) {
+
+	named := map[string]DU{"WORK": {Drive: 2, User: 3}}
+
+	type testcase struct {
+		input string
+		drive uint8
+		user  int
+		rest  string
+		err   bool
+	}
+
+	tests := []testcase{
+		{input: "FOO.TXT", drive: 0, user: -1, rest: "FOO.TXT"},
+		{input: "B:FOO.TXT", drive: 2, user: -1, rest: "FOO.TXT"},
+		{input: "b3:foo.txt", drive: 2, user: 3, rest: "foo.txt"},
+		{input: "P15:FOO", drive: 16, user: 15, rest: "FOO"},
+		{input: "7:FOO", drive: 0, user: 7, rest: "FOO"},
+		{input: ":FOO", drive: 0, user: -1, rest: "FOO"},
+		{input: "work:FOO", drive: 2, user: 3, rest: "FOO"},
+		{input: "B16:FOO", err: true},
+		{input: "Q:FOO", err: true},
+		{input: "B-1:FOO", err: true},
+		{input: "HOME:FOO", err: true},
+	}
+
+	for _, test := range tests {
+
+		du, rest, err := SplitPrefix(test.input, named)
+		if test.err {
+			if err == nil {
+				t.Fatalf("expected error parsing %s", test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s: %s", test.input, err)
+		}
+		if du.Drive != test.drive || du.User != test.user || rest != test.rest {
+			t.Fatalf("wrong result for %s: %v %s", test.input, du, rest)
+		}
+	}
+
+	// FromString stores the user number.
+	f := FromString("C4:FOO.TXT")
+	if f.Drive != 2 || f.S1 != 4 || f.GetFileName() != "FOO.TXT" {
+		t.Fatalf("wrong FCB for DU prefix: %d %d %s", f.Drive, f.S1, f.GetFileName())
+	}
+}
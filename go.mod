@@ -3,6 +3,7 @@ module github.com/skx/cpmulator
 go 1.21.5
 
 require (
+	github.com/fsnotify/fsnotify v1.8.0
 	github.com/koron-go/z80 v0.10.1
 	golang.org/x/term v0.27.0
 )
@@ -0,0 +1,386 @@
+// Package gsx contains a minimal implementation of the Graphics Device
+// Operating System (GDOS) of Digital Research's GSX, which draws upon an
+// in-memory canvas that is saved as a PNG image.
+//
+// Programs pass GSX requests to the BDOS, which hands them to us as an
+// opcode, along with arrays of integers and points.  We implement the
+// primitives needed to draw simple pictures:
+//
+//   - Opening, clearing, updating, and closing the workstation.
+//   - Lines, markers, and filled areas, along with their colours.
+//   - The "bar" drawing primitive.
+//
+// Text, and input, are accepted but ignored.  Coordinates are given in
+// normalized device coordinates, from 0 to 32767, with the origin at the
+// bottom-left of the canvas.
+//
+// The canvas is written to its file whenever the workstation is updated,
+// or closed.
+package gsx
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultWidth is the width of our canvas, unless configured.
+	DefaultWidth = 640
+
+	// DefaultHeight is the height of our canvas, unless configured.
+	DefaultHeight = 400
+
+	// maxNDC is the largest normalized device coordinate.
+	maxNDC = 32767
+)
+
+// The opcodes we implement.
+const (
+	opOpenWorkstation   = 1
+	opCloseWorkstation  = 2
+	opClearWorkstation  = 3
+	opUpdateWorkstation = 4
+	opPolyline          = 6
+	opPolymarker        = 7
+	opText              = 8
+	opFilledArea        = 9
+	opDrawing           = 11
+	opColorRep          = 14
+	opLineColor         = 17
+	opMarkerColor       = 20
+	opTextColor         = 22
+	opFillColor         = 25
+)
+
+// drawingBar is the identifier of the "bar" drawing primitive, which is
+// passed with opDrawing.
+const drawingBar = 1
+
+// defaultPalette holds the colours which are predefined.
+var defaultPalette = []color.RGBA{
+	{0x00, 0x00, 0x00, 0xFF}, // black
+	{0xFF, 0xFF, 0xFF, 0xFF}, // white
+	{0xFF, 0x00, 0x00, 0xFF}, // red
+	{0x00, 0xFF, 0x00, 0xFF}, // green
+	{0x00, 0x00, 0xFF, 0xFF}, // blue
+	{0x00, 0xFF, 0xFF, 0xFF}, // cyan
+	{0xFF, 0xFF, 0x00, 0xFF}, // yellow
+	{0xFF, 0x00, 0xFF, 0xFF}, // magenta
+}
+
+// Canvas holds our state.
+type Canvas struct {
+
+	// path is the file to which the canvas is written.
+	path string
+
+	// img is the image we draw upon.
+	img *image.RGBA
+
+	// palette holds the colours which may be selected, by index.
+	palette []color.RGBA
+
+	// lineColor, markerColor, and fillColor are the indexes of the
+	// colours used for each primitive.
+	lineColor   int
+	markerColor int
+	fillColor   int
+}
+
+// New creates a canvas which will be written to the given path.
+//
+// The path may be followed by "@", and a size, for example
+// "graphics.png@800x600".
+func New(spec string) (*Canvas, error) {
+
+	path, size, found := strings.Cut(spec, "@")
+	if path == "" {
+		return nil, fmt.Errorf("no path given for GSX canvas '%s'", spec)
+	}
+
+	width, height := DefaultWidth, DefaultHeight
+	if found {
+		w, h, ok := strings.Cut(strings.ToLower(size), "x")
+		var err1, err2 error
+		width, err1 = strconv.Atoi(w)
+		height, err2 = strconv.Atoi(h)
+		if !ok || err1 != nil || err2 != nil || width < 1 || height < 1 || width > maxNDC || height > maxNDC {
+			return nil, fmt.Errorf("invalid size '%s' for GSX canvas, expected WIDTHxHEIGHT", size)
+		}
+	}
+
+	c := &Canvas{
+		path: path,
+		img:  image.NewRGBA(image.Rect(0, 0, width, height)),
+	}
+	c.reset()
+	return c, nil
+}
+
+// reset restores our default colours, and clears the canvas.
+func (c *Canvas) reset() {
+	c.palette = append([]color.RGBA{}, defaultPalette...)
+	c.lineColor = 1
+	c.markerColor = 1
+	c.fillColor = 1
+	c.clear()
+}
+
+// clear fills the canvas with the background colour.
+func (c *Canvas) clear() {
+	bg := c.palette[0]
+	for i := 0; i < len(c.img.Pix); i += 4 {
+		c.img.Pix[i] = bg.R
+		c.img.Pix[i+1] = bg.G
+		c.img.Pix[i+2] = bg.B
+		c.img.Pix[i+3] = bg.A
+	}
+}
+
+// Save writes the canvas to its file.
+func (c *Canvas) Save() error {
+	f, err := os.Create(c.path)
+	if err != nil {
+		return err
+	}
+
+	err = png.Encode(f, c.img)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Call carries out a single GSX request.
+//
+// The opcode is the first entry of the CONTRL array, id is the sixth,
+// which identifies drawing primitives, intin holds the integer inputs,
+// and ptsin the points as x,y pairs.
+//
+// The integer, and point, outputs are returned.
+func (c *Canvas) Call(opcode int, id int, intin []int, ptsin []int) ([]int, []int, error) {
+
+	switch opcode {
+
+	case opOpenWorkstation:
+		c.reset()
+		return c.capabilities()
+
+	case opCloseWorkstation, opUpdateWorkstation:
+		return nil, nil, c.Save()
+
+	case opClearWorkstation:
+		c.clear()
+
+	case opPolyline:
+		for i := 0; i+3 < len(ptsin); i += 2 {
+			x1, y1 := c.device(ptsin[i], ptsin[i+1])
+			x2, y2 := c.device(ptsin[i+2], ptsin[i+3])
+			c.line(x1, y1, x2, y2, c.color(c.lineColor))
+		}
+
+	case opPolymarker:
+		for i := 0; i+1 < len(ptsin); i += 2 {
+			x, y := c.device(ptsin[i], ptsin[i+1])
+			col := c.color(c.markerColor)
+			c.line(x-2, y, x+2, y, col)
+			c.line(x, y-2, x, y+2, col)
+		}
+
+	case opFilledArea:
+		c.polygon(ptsin, c.color(c.fillColor))
+
+	case opDrawing:
+		if id == drawingBar && len(ptsin) >= 4 {
+			x1, y1, x2, y2 := ptsin[0], ptsin[1], ptsin[2], ptsin[3]
+			c.polygon([]int{x1, y1, x2, y1, x2, y2, x1, y2}, c.color(c.fillColor))
+		}
+
+	case opColorRep:
+		if len(intin) >= 4 && intin[0] >= 0 && intin[0] < 256 {
+			for len(c.palette) <= intin[0] {
+				c.palette = append(c.palette, color.RGBA{0, 0, 0, 0xFF})
+			}
+			scale := func(v int) uint8 {
+				return uint8(min(max(v, 0), 1000) * 255 / 1000)
+			}
+			c.palette[intin[0]] = color.RGBA{scale(intin[1]), scale(intin[2]), scale(intin[3]), 0xFF}
+		}
+
+	case opLineColor, opMarkerColor, opTextColor, opFillColor:
+		if len(intin) < 1 {
+			break
+		}
+		index := intin[0]
+		if index < 0 || index >= len(c.palette) {
+			index = 1
+		}
+		switch opcode {
+		case opLineColor:
+			c.lineColor = index
+		case opMarkerColor:
+			c.markerColor = index
+		case opFillColor:
+			c.fillColor = index
+		}
+
+		// The selected index is returned.
+		return []int{index}, nil, nil
+
+	case opText:
+		// Text is accepted, but not drawn.
+	}
+
+	return nil, nil, nil
+}
+
+// capabilities returns the description of our workstation, which is
+// returned when it is opened.
+func (c *Canvas) capabilities() ([]int, []int, error) {
+
+	bounds := c.img.Bounds()
+
+	intout := make([]int, 45)
+	intout[0] = bounds.Dx() - 1      // Addressable width
+	intout[1] = bounds.Dy() - 1      // Addressable height
+	intout[2] = 1                    // Not precisely scaled
+	intout[3] = 250                  // Pixel width, in micrometres
+	intout[4] = 250                  // Pixel height, in micrometres
+	intout[6] = 1                    // Line types
+	intout[7] = 1                    // Line widths
+	intout[8] = 1                    // Marker types
+	intout[9] = 1                    // Marker sizes
+	intout[10] = 1                   // Fonts
+	intout[13] = len(defaultPalette) // Predefined colours
+	intout[14] = 1                   // Drawing primitives
+	intout[15] = drawingBar          // .. which is the bar
+	for i := 16; i < 25; i++ {
+		intout[i] = -1
+	}
+	intout[25] = 3 // The bar uses the fill attributes
+	intout[35] = 1 // Colour is available
+	intout[37] = 1 // Filled areas are available
+	intout[39] = 0 // Continuous colours
+
+	ptsout := []int{0, 1, 0, 1, 1, 0, 1, 0, 0, 5, 0, 5}
+
+	return intout, ptsout, nil
+}
+
+// color returns the colour with the given index.
+func (c *Canvas) color(index int) color.RGBA {
+	if index < 0 || index >= len(c.palette) {
+		index = 1
+	}
+	return c.palette[index]
+}
+
+// device converts the given normalized device coordinates to those of
+// our canvas, which has its origin at the top-left.
+func (c *Canvas) device(x int, y int) (int, int) {
+	bounds := c.img.Bounds()
+
+	x = min(max(x, 0), maxNDC)
+	y = min(max(y, 0), maxNDC)
+
+	dx := x * (bounds.Dx() - 1) / maxNDC
+	dy := (bounds.Dy() - 1) - y*(bounds.Dy()-1)/maxNDC
+	return dx, dy
+}
+
+// line draws a line between the given points, with Bresenham's algorithm.
+func (c *Canvas) line(x1 int, y1 int, x2 int, y2 int, col color.RGBA) {
+
+	abs := func(v int) int {
+		if v < 0 {
+			return -v
+		}
+		return v
+	}
+
+	dx, dy := abs(x2-x1), -abs(y2-y1)
+	sx, sy := 1, 1
+	if x1 > x2 {
+		sx = -1
+	}
+	if y1 > y2 {
+		sy = -1
+	}
+
+	err := dx + dy
+	for {
+		c.img.SetRGBA(x1, y1, col)
+		if x1 == x2 && y1 == y2 {
+			return
+		}
+		e2 := 2 * err
+		if e2 >= dy {
+			err += dy
+			x1 += sx
+		}
+		if e2 <= dx {
+			err += dx
+			y1 += sy
+		}
+	}
+}
+
+// polygon fills the polygon with the given vertices, which are given in
+// normalized device coordinates, via the even-odd rule.
+func (c *Canvas) polygon(ptsin []int, col color.RGBA) {
+
+	if len(ptsin) < 6 {
+		return
+	}
+
+	xs := []int{}
+	ys := []int{}
+	for i := 0; i+1 < len(ptsin); i += 2 {
+		x, y := c.device(ptsin[i], ptsin[i+1])
+		xs = append(xs, x)
+		ys = append(ys, y)
+	}
+
+	top, bottom := ys[0], ys[0]
+	for _, y := range ys {
+		top = min(top, y)
+		bottom = max(bottom, y)
+	}
+
+	for y := top; y <= bottom; y++ {
+
+		// Find where each edge crosses the centre of this row.
+		crossings := []int{}
+		for i := range xs {
+			j := (i + 1) % len(xs)
+			y1, y2 := ys[i], ys[j]
+			if y1 == y2 || y < min(y1, y2) || y >= max(y1, y2) {
+				continue
+			}
+			x := xs[i] + (y-y1)*(xs[j]-xs[i])/(y2-y1)
+			crossings = append(crossings, x)
+		}
+
+		sort.Ints(crossings)
+
+		for i := 0; i+1 < len(crossings); i += 2 {
+			for x := crossings[i]; x <= crossings[i+1]; x++ {
+				c.img.SetRGBA(x, y, col)
+			}
+		}
+	}
+
+	// Draw the outline too, so that the edges, and degenerate shapes,
+	// are complete.
+	for i := range xs {
+		j := (i + 1) % len(xs)
+		c.line(xs[i], ys[i], xs[j], ys[j], col)
+	}
+}
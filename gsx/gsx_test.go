@@ -0,0 +1,105 @@
+package gsx
+
+import (
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestNew ensures we can parse the specification of a canvas.
+func TestNew(t *testing.T) {
+
+	valid := map[string][2]int{
+		"out.png":          {DefaultWidth, DefaultHeight},
+		"out.png@100x50":   {100, 50},
+		"out.png@320X200":  {320, 200},
+		"/tmp/x.png@1x1":   {1, 1},
+		"c:/tmp/x.png@8x8": {8, 8},
+	}
+	for spec, size := range valid {
+		c, err := New(spec)
+		if err != nil {
+			t.Fatalf("failed to create canvas %s: %s", spec, err)
+		}
+		if c.img.Bounds().Dx() != size[0] || c.img.Bounds().Dy() != size[1] {
+			t.Fatalf("wrong size for %s: %v", spec, c.img.Bounds())
+		}
+	}
+
+	invalid := []string{"", "@10x10", "out.png@", "out.png@10", "out.png@0x10", "out.png@axb"}
+	for _, spec := range invalid {
+		_, err := New(spec)
+		if err == nil {
+			t.Fatalf("expected an error creating canvas %s", spec)
+		}
+	}
+}
+
+// TestDrawing ensures we can draw, and save, a picture.
+func TestDrawing(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "out.png")
+	c, err := New(path + "@101x101")
+	if err != nil {
+		t.Fatalf("failed to create canvas: %s", err)
+	}
+
+	intout, ptsout, err := c.Call(opOpenWorkstation, 0, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to open workstation: %s", err)
+	}
+	if len(intout) != 45 || len(ptsout) != 12 {
+		t.Fatalf("wrong capabilities %d %d", len(intout), len(ptsout))
+	}
+	if intout[0] != 100 || intout[1] != 100 {
+		t.Fatalf("wrong size reported %d x %d", intout[0], intout[1])
+	}
+
+	// A red horizontal line across the bottom of the canvas.
+	intout, _, _ = c.Call(opLineColor, 0, []int{2}, nil)
+	if len(intout) != 1 || intout[0] != 2 {
+		t.Fatalf("wrong colour index returned %v", intout)
+	}
+	c.Call(opPolyline, 0, nil, []int{0, 0, maxNDC, 0})
+
+	// A custom colour, used to fill a bar in the top-right corner.
+	c.Call(opColorRep, 0, []int{9, 0, 1000, 1000}, nil)
+	c.Call(opFillColor, 0, []int{9}, nil)
+	c.Call(opDrawing, drawingBar, nil, []int{maxNDC / 2, maxNDC / 2, maxNDC, maxNDC})
+
+	_, _, err = c.Call(opCloseWorkstation, 0, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to close workstation: %s", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("canvas wasn't saved: %s", err)
+	}
+	defer f.Close()
+
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("failed to decode canvas: %s", err)
+	}
+
+	type point struct {
+		x, y int
+		col  color.RGBA
+	}
+	points := []point{
+		{0, 100, color.RGBA{0xFF, 0, 0, 0xFF}},
+		{100, 100, color.RGBA{0xFF, 0, 0, 0xFF}},
+		{75, 25, color.RGBA{0, 0xFF, 0xFF, 0xFF}},
+		{25, 25, color.RGBA{0, 0, 0, 0xFF}},
+		{25, 75, color.RGBA{0, 0, 0, 0xFF}},
+	}
+	for _, p := range points {
+		got := color.RGBAModel.Convert(img.At(p.x, p.y)).(color.RGBA)
+		if got != p.col {
+			t.Fatalf("wrong colour at %d,%d: %v != %v", p.x, p.y, got, p.col)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// listsyscalls.go contains the implementation of "-list-syscalls", which shows
+// the BDOS and BIOS syscalls we implement, in a choice of formats.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/skx/cpmulator/cpm"
+	cpmver "github.com/skx/cpmulator/version"
+)
+
+// syscallFormat is the flag.Value used for "-list-syscalls".
+//
+// It may be used as a boolean flag, for the default text output, or given
+// the name of a format, such as "-list-syscalls=json".
+type syscallFormat struct {
+	format string
+}
+
+// String returns the selected format, if any.
+func (s *syscallFormat) String() string {
+	return s.format
+}
+
+// Set selects the format, with "true" selecting text.
+func (s *syscallFormat) Set(val string) error {
+	switch strings.ToLower(val) {
+	case "true", "text":
+		s.format = "text"
+	case "false":
+		s.format = ""
+	case "json":
+		s.format = "json"
+	case "markdown", "md":
+		s.format = "markdown"
+	default:
+		return fmt.Errorf("unknown format '%s', valid choices are text, json, and markdown", val)
+	}
+	return nil
+}
+
+// IsBoolFlag allows the flag to be given without a value.
+func (s *syscallFormat) IsBoolFlag() bool {
+	return true
+}
+
+// syscallEntry holds the details of a single syscall, for export.
+type syscallEntry struct {
+	Number      int    `json:"number"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Fake        bool   `json:"fake"`
+	Noisy       bool   `json:"noisy"`
+}
+
+// syscallList holds the details of all our syscalls, for export.
+type syscallList struct {
+	Version string         `json:"version"`
+	BDOS    []syscallEntry `json:"bdos"`
+	BIOS    []syscallEntry `json:"bios"`
+}
+
+// syscallEntries returns the entries of the given table, sorted by number.
+func syscallEntries(table map[uint8]cpm.CPMHandler) []syscallEntry {
+
+	var res []syscallEntry
+	for id, ent := range table {
+		res = append(res, syscallEntry{
+			Number:      int(id),
+			Name:        ent.Desc,
+			Description: ent.Summary,
+			Fake:        ent.Fake,
+			Noisy:       ent.Noisy,
+		})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Number < res[j].Number
+	})
+	return res
+}
+
+// listSyscalls writes the details of the syscalls implemented by the
+// given emulator to the writer, in the given format.
+func listSyscalls(out io.Writer, obj *cpm.CPM, format string) error {
+
+	list := syscallList{
+		Version: cpmver.GetVersionString(),
+		BDOS:    syscallEntries(obj.BDOSSyscalls),
+		BIOS:    syscallEntries(obj.BIOSSyscalls),
+	}
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list)
+
+	case "markdown":
+		for i, tbl := range []struct {
+			name    string
+			entries []syscallEntry
+		}{{"BDOS", list.BDOS}, {"BIOS", list.BIOS}} {
+
+			if i > 0 {
+				fmt.Fprintf(out, "\n")
+			}
+			fmt.Fprintf(out, "## %s Syscalls\n\n", tbl.name)
+			fmt.Fprintf(out, "| Number | Name | Description | Fake | Noisy |\n")
+			fmt.Fprintf(out, "|-------:|------|-------------|------|-------|\n")
+			for _, ent := range tbl.entries {
+				fmt.Fprintf(out, "| %d | %s | %s | %s | %s |\n", ent.Number, ent.Name, ent.Description, yes(ent.Fake), yes(ent.Noisy))
+			}
+		}
+		return nil
+	}
+
+	// The default text output.
+	for _, tbl := range []struct {
+		name    string
+		entries []syscallEntry
+	}{{"BDOS", list.BDOS}, {"BIOS", list.BIOS}} {
+
+		fmt.Fprintf(out, "%s syscalls:\n", tbl.name)
+		for _, ent := range tbl.entries {
+			fake := ""
+			if ent.Fake {
+				fake = "FAKE"
+			}
+			fmt.Fprintf(out, "\t%03d %-20s %s\n", ent.Number, ent.Name, fake)
+		}
+	}
+	return nil
+}
+
+// yes returns "yes" if the value is true, and an empty string otherwise.
+func yes(val bool) string {
+	if val {
+		return "yes"
+	}
+	return ""
+}
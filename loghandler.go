@@ -0,0 +1,142 @@
+// loghandler.go contains the handler used for "-log-format text", which
+// writes each log record as a single, concise, line, so that the logfile
+// may be watched via "tail -f" during a session.
+//
+// A line contains the time, the level, the message, and the name of the
+// syscall or file the record concerns, followed by the remaining fields:
+//
+//	10:38:23.117 INFO  BDOS F_OPEN syscall=15 syscallHex=0x0F AF=0F00 BC=000F DE=005C HL=0000
+//
+// Groups are flattened, so "registers.AF" is shown as "AF".
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// textHandler is a slog.Handler which writes concise single-line records.
+type textHandler struct {
+
+	// w is where we write our records, and mu serializes writes to it.
+	w  io.Writer
+	mu *sync.Mutex
+
+	// level is the minimum level we write.
+	level slog.Leveler
+
+	// attrs holds the attributes added via WithAttrs.
+	attrs []slog.Attr
+}
+
+// newLogHandler returns the handler for the given log format, which is
+// either "json" or "text".
+func newLogHandler(format string, w io.Writer, opts *slog.HandlerOptions) (slog.Handler, error) {
+
+	switch format {
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	case "text":
+		return &textHandler{w: w, mu: &sync.Mutex{}, level: opts.Level}, nil
+	}
+	return nil, fmt.Errorf("unknown log format '%s', valid choices are json and text", format)
+}
+
+// Enabled returns true if we write records of the given level.
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	min := slog.LevelInfo
+	if h.level != nil {
+		min = h.level.Level()
+	}
+	return level >= min
+}
+
+// Handle writes the given record.
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+
+	var sb strings.Builder
+
+	if !r.Time.IsZero() {
+		sb.WriteString(r.Time.Format("15:04:05.000 "))
+	}
+	fmt.Fprintf(&sb, "%-5s %s", r.Level.String(), r.Message)
+
+	attrs := append([]slog.Attr{}, h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+
+	// The name of the syscall, or file, follows the message.
+	for i, a := range attrs {
+		if a.Key == "name" && a.Value.Kind() == slog.KindString {
+			sb.WriteString(" " + formatLogValue(a.Value))
+			attrs = append(attrs[:i:i], attrs[i+1:]...)
+			break
+		}
+	}
+
+	for _, a := range attrs {
+		writeLogAttr(&sb, a)
+	}
+	sb.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, sb.String())
+	return err
+}
+
+// WithAttrs returns a handler which includes the given attributes in each
+// record.
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	n := *h
+	n.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &n
+}
+
+// WithGroup returns the handler unchanged, as we flatten groups.
+func (h *textHandler) WithGroup(_ string) slog.Handler {
+	return h
+}
+
+// writeLogAttr writes the given attribute, as " key=value", flattening
+// any group.
+func writeLogAttr(sb *strings.Builder, a slog.Attr) {
+
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		for _, g := range a.Value.Group() {
+			writeLogAttr(sb, g)
+		}
+		return
+	}
+
+	sb.WriteString(" " + a.Key + "=" + formatLogValue(a.Value))
+}
+
+// formatLogValue returns the given value, quoted if it is empty, or would
+// otherwise be ambiguous.
+func formatLogValue(v slog.Value) string {
+
+	s := v.String()
+
+	ambiguous := strings.IndexFunc(s, func(r rune) bool {
+		return r == ' ' || r == '=' || r == '"' || !unicode.IsPrint(r)
+	})
+	if s == "" || ambiguous >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
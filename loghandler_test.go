@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// TestLogHandler ensures that the text log format writes concise lines.
+func TestLogHandler(t *testing.T) {
+
+	_, err := newLogHandler("xml", nil, &slog.HandlerOptions{})
+	if err == nil {
+		t.Fatalf("expected error with unknown format")
+	}
+
+	var buf bytes.Buffer
+	h, err := newLogHandler("text", &buf, &slog.HandlerOptions{Level: slog.LevelInfo})
+	if err != nil {
+		t.Fatalf("failed to create handler: %s", err)
+	}
+	l := slog.New(h)
+
+	// Below our level.
+	l.Debug("hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected output %q", buf.String())
+	}
+
+	l.Info("BDOS",
+		slog.String("name", "F_OPEN"),
+		slog.Int("syscall", 15),
+		slog.Group("registers",
+			slog.String("AF", "0F00"),
+			slog.String("DE", "005C")))
+
+	l.With(slog.String("name", "HELLO.TXT"), slog.String("drive", "A")).
+		Warn("failed to open", slog.String("error", "file not found"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected two lines, got %q", buf.String())
+	}
+
+	expected := []string{
+		`INFO  BDOS F_OPEN syscall=15 AF=0F00 DE=005C`,
+		`WARN  failed to open HELLO.TXT drive=A error="file not found"`,
+	}
+	for i, line := range lines {
+
+		// Skip the time.
+		_, rest, _ := strings.Cut(line, " ")
+		if rest != expected[i] {
+			t.Fatalf("line %d is %q, expected %q", i, rest, expected[i])
+		}
+	}
+}
@@ -3,18 +3,20 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
-	"slices"
-	"sort"
+	"path/filepath"
 	"strings"
 
 	cpmccp "github.com/skx/cpmulator/ccp"
 	"github.com/skx/cpmulator/consolein"
 	"github.com/skx/cpmulator/consoleout"
 	"github.com/skx/cpmulator/cpm"
+	"github.com/skx/cpmulator/rotate"
 	"github.com/skx/cpmulator/static"
 	cpmver "github.com/skx/cpmulator/version"
 )
@@ -43,8 +45,42 @@ func recoverPanic() {
 }
 
 // main is our entry point
+// parseKey converts a key described in "^X" notation, or a single
+// character, into the byte it produces.  "none" returns zero.
+func parseKey(str string) (byte, error) {
+
+	if str == "" || strings.ToLower(str) == "none" {
+		return 0, nil
+	}
+
+	if len(str) == 2 && str[0] == '^' {
+		c := strings.ToUpper(str)[1]
+		if c >= '@' && c <= '_' {
+			return c - '@', nil
+		}
+	}
+
+	if len(str) == 1 {
+		return str[0], nil
+	}
+
+	return 0, fmt.Errorf("invalid key '%s', expected ^X notation", str)
+}
+
 func main() {
 
+	// exitCode is the status we exit with, which is set to a non-zero
+	// value if running a program, or the CCP, fails.
+	//
+	// This is deferred first, so that it runs after all the other
+	// cleanup has taken place.
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
 	//
 	// Catch errors
 	//
@@ -53,113 +89,161 @@ func main() {
 	//
 	// Parse the command-line flags for this driver-application
 	//
-	ccp := flag.String("ccp", "ccpz", "The name of the CCP that we should run (ccp vs. ccpz).")
+	autoOutput := flag.Bool("auto-output", true, "Select the console output driver which suits programs listed in the compatibility database, such as WordStar, unless -output is given.")
+	batch := flag.Bool("batch", false, "Run non-interactively, reading console input from STDIN until EOF.")
+	batchSize := flag.String("batch-size", "80x24", "The terminal size to report to programs, as WIDTHxHEIGHT, in -batch mode.")
+	casePolicy := flag.String("case-policy", cpm.CaseExact, "How CP/M filenames are matched to host files which differ in case (exact, fold, or strict).")
+	ccp := flag.String("ccp", "ccpz", "The name of the CCP that we should run (ccp, ccpz, or ccpz-z3env).")
+	ccpFile := flag.String("ccp-file", "", "Load the CCP from the given file, specified as path@addr, where addr is the hex address it runs at, rather than using an embedded one.")
+	command := flag.String("command", "", "Run the given CCP command(s), separated by \";\" or newlines, then exit.  This replaces reading console input.  Each command may redirect its input, and output, to host files via \"<\", \">\", and \">>\".")
 	cd := flag.String("cd", "", "Change to this directory before launching")
+	compatDB := flag.String("compat-db", "", "Load compatibility quirks for specific binaries, which take precedence over those built in, from this JSON file.")
+	ctrlC := flag.String("ctrl-c", "", "How Ctrl-C is handled when a line is read: the count (0-9) of consecutive presses which reboot, or \"pass\" to deliver it to the program (default 2).")
+	crashReport := flag.String("crash-report", "", "Write a crash report to this file if a program HALTs or calls an unimplemented syscall (\"-\" for STDERR).")
+	deterministic := flag.Bool("deterministic", false, "Show programs a fixed launch time, a clock which advances with each syscall, and an 80x24 terminal, so that runs with the same input produce identical output.")
+	dirCache := flag.Duration("dir-cache", 0, "Reuse the directory listing of a drive, when searching for files, for up to this long (e.g. \"1s\").  Changes made by programs are always seen, but changes made upon the host may be missed until it expires.")
+	startDrive := flag.String("drive", "", "The drive to start upon (A-P), so that the CCP starts logged into it, rather than A:.")
+	cpuName := flag.String("cpu", cpm.DefaultCPU, "The CPU to emulate, z80 or 8080.  In 8080 mode programs which use Z80-only instructions are stopped, and the instruction reported.")
 	createDirectories := flag.Bool("create", false, "Create subdirectories on the host computer for each CP/M drive.")
 	embedBin := flag.Bool("embed", true, "Should we embed our utility commands into the A: filesystem.")
+	eventSocket := flag.String("event-socket", "", "Publish syscall, console, and file events, as JSON, to clients of a Unix domain socket at this path, which may also inject console input.")
+	exitReport := flag.Bool("exit-report", true, "Show a one-line summary when a program ends without calling P_TERMCPM, for example by returning to the CCP, jumping to 0x0000, or HALTing.")
+	exportState := flag.String("export-state", "", "Write the files upon each drive, as a gzipped tar archive, to this path when the emulator exits, so that a session may be moved to another machine or attached to a bug report.")
 	execPrefix := flag.String("exec-prefix", "", "Execute system commands, on the host, prefixed by this string.")
+	gsxCanvas := flag.String("gsx", "", "Enable the GSX graphics extension, saving the drawing to this PNG file (e.g. \"graphics.png\" or \"graphics.png@800x600\").")
+	httpAddr := flag.String("http", "", "Serve a web interface, showing the terminal, drives, and syscalls, upon this address (e.g. \":8080\").")
+	idleSleep := flag.Duration("idle-sleep", cpm.DefaultIdleSleep, "The longest time to sleep when a program polls the console status in a tight loop, waiting for input, so that it doesn't keep a host CPU busy (0 to disable).")
+	inputCharset := flag.String("input-charset", consolein.DefaultCharset, "The character set non-ASCII input, such as accented characters, is converted to (ascii, cp437, latin1, strip, or raw).")
+	importState := flag.String("import-state", "", "Restore the files upon each drive from a gzipped tar archive written via -export-state, before launching.")
 	input := flag.String("input", cpm.DefaultInputDriver, "The name of the console input driver to use (-list-input-drivers will show valid choices).")
 	output := flag.String("output", cpm.DefaultOutputDriver, "The name of the console output driver to use (-list-output-drivers will show valid choices).")
+	manifest := flag.String("manifest", "", "Write a JSON manifest of the host files which were created, modified, renamed, or deleted to this file when the emulator exits (\"-\" for STDERR).")
+	maxInstructions := flag.Int64("max-instructions", 0, "Terminate, with an error, once this many instructions have been executed, which detects runaway loops in CI without counting time spent waiting for input (0 for no limit).")
+	monitorKey := flag.String("monitor-key", "^]", "The key which drops to the emulator monitor, in ^X notation (\"none\" to disable).")
+	longNames := flag.Bool("long-names", false, "Make host files with names which don't fit the 8.3 format visible via aliases such as FILENA~1.TXT.")
+	legacyEditing := flag.Bool("legacy-line-editing", false, "Use the line-editing keys documented by Digital Research (Ctrl-E, Ctrl-R, Ctrl-U, Ctrl-X, and rubout echo) when programs read a line of input.")
+	keyboardInterrupt := flag.String("keyboard-interrupt", "", "Raise an interrupt when console input is pending, for programs which enable interrupts (im0[:OPCODE], im1, or im2:VECTOR).")
+	keepRAM := flag.Bool("keep-ram", false, "Keep the contents of RAM when running several programs, separated by \"--\", rather than clearing it as each is loaded, so that they may pass data to each other in memory.")
+	killKey := flag.String("kill-key", "none", "A key which terminates the emulator whenever it is read, in ^X notation (\"none\" to disable).")
 	logAll := flag.Bool("log-all", false, "Log all function invocations, including the noisy console I/O ones.")
+	logFormat := flag.String("log-format", "json", "The format of the debug logs, json, or text for a concise line per record which is easier to read via \"tail -f\".")
 	logPath := flag.String("log-path", "", "Specify the file to write debug logs to.")
+	logRotate := flag.String("log-rotate", "", "Rotate the debug log once it would exceed this size, keeping a number of previous files, as SIZE[/KEEP] (e.g. \"100M/5\").")
+	namedDirs := flag.String("named-dirs", "", "Comma-separated ZCPR-style named directories, as NAME=DU pairs, which may be used as prefixes in command-line arguments (e.g. \"WORK=B3\").")
+	profileSyscalls := flag.String("profile-syscalls", "", "Write the count, and time spent in, each BDOS/BIOS syscall to this file when the emulator exits (\"-\" for STDERR, a .json suffix for JSON).")
+	quiet := flag.Bool("quiet", false, "Suppress the startup banner, warnings, and the newline shown when the emulator exits, so that only the output of the guest is seen.")
+	lstTTY := flag.String("lst-tty", "", "Where to write output sent to the TTY: list device (null, console, file:path, or pipe:command), when selected by the IOByte.")
+	lstCRT := flag.String("lst-crt", "", "Where to write output sent to the CRT: list device (null, console, file:path, or pipe:command), when selected by the IOByte.")
+	lstLPT := flag.String("lst-lpt", "", "Where to write output sent to the LPT: list device (null, console, file:path, or pipe:command), when selected by the IOByte.")
+	lstUL1 := flag.String("lst-ul1", "", "Where to write output sent to the UL1: list device (null, console, file:path, or pipe:command), when selected by the IOByte.")
+	ptyMode := flag.Bool("pty", false, "Run the emulator upon a pseudo-terminal which we allocate, relaying STDIN and STDOUT to it, so that harnesses and CI jobs may drive it via pipes (Linux only).")
+	preserveTailCase := flag.Bool("preserve-tail-case", false, "Keep the case of the arguments given to a binary, in the command tail, rather than upper-casing them as the CCP does.")
 	prnPath := flag.String("prn-path", "print.log", "Specify the file to write printer-output to.")
+	prnRotate := flag.String("prn-rotate", "", "Rotate the printer-output files once they would exceed this size, keeping a number of previous files, as SIZE[/KEEP] (e.g. \"10M/3\").")
+	readOnlyFS := flag.Bool("read-only-fs", false, "Hold all changes made to files in memory, so the host is never modified, and report what would have changed on exit.")
+	rsx := flag.Bool("rsx", false, "Allow programs to hook the page-zero vectors, and keep those hooks across warm boots (RSX-compatible mode).")
+	outputBuffer := flag.Duration("output-buffer", consoleout.DefaultBufferDelay, "Buffer console output for up to this long before writing it, which makes large amounts of output faster over slow terminals (0 to disable).")
+	outputLimit := flag.String("output-limit", "", "Pause console output if a program writes more than this many characters in a period (e.g. \"20000/1s\"), until it is resumed via the monitor.")
+	stuffPacing := flag.String("stuff-pacing", "", "Pace stuffed input, such as that which runs AUTOEXEC.SUB, as a number of characters per tick (e.g. \"4\" or \"4/50ms\"), and/or \"read\" to hide each line from status polls until the guest reads it.")
+	wildcardProtect := flag.String("wildcard-protect", cpm.ProtectNone, "Protect against programs deleting, or renaming, files via wildcards (none, log, dry-run, confirm, or session).")
+	serial := flag.String("serial", "", "The serial number reported to programs, as six hex bytes (e.g. \"00-22-00-01-23-45\").")
 	showVersion := flag.Bool("version", false, "Report our version, and exit.")
+	verifyStatic := flag.Bool("verify-static", false, "Check the embedded binaries, and the copies the guest sees upon each drive, against the manifest of their checksums, and exit.")
+	transcript := flag.String("transcript", "", "Record the console output, input, and the commands the CCP executed, to this file, as markdown if it has a .md suffix, otherwise as an asciinema recording (e.g. \"session.cast\").")
+	startUser := flag.Int("user", 0, "The user number to start in (0-15), so that the CCP starts logged into it.")
 	useDirectories := flag.Bool("directories", false, "Use subdirectories on the host computer for CP/M drives.")
+	watchpoints := flag.String("watchpoints", "", "Comma-separated memory watchpoints, as ADDR[+LEN][:MODE] where MODE is r, w, or rw, which log accesses, and enter the monitor, to help find data corruption (e.g. \"0x5C+36:w\").")
+	watch := flag.String("watch", "", "Run the given binary, or SUBMIT file, and re-run it whenever files on the host change.")
+	watchPattern := flag.String("watch-pattern", "", "Comma-separated list of file-patterns which trigger a re-run in -watch mode (default: all files).")
 
 	// listing
 	listCcps := flag.Bool("list-ccp", false, "Dump the list of embedded CCPs, and exit.")
 	listOutput := flag.Bool("list-output-drivers", false, "Dump the list of valid console output drivers, and exit.")
 	listInput := flag.Bool("list-input-drivers", false, "Dump the list of valid console input drivers, and exit.")
-	listSyscalls := flag.Bool("list-syscalls", false, "Dump the list of implemented BIOS/BDOS syscall functions, and exit.")
+	syscallsFormat := &syscallFormat{}
+	flag.Var(syscallsFormat, "list-syscalls", "Dump the list of implemented BIOS/BDOS syscall functions, and exit.  Use -list-syscalls=json, or =markdown, to choose the format.")
 
 	// drives
 	drive := make(map[string]*string)
-	drive["A"] = flag.String("drive-a", "", "The path to the directory for A:")
-	drive["B"] = flag.String("drive-b", "", "The path to the directory for B:")
-	drive["C"] = flag.String("drive-c", "", "The path to the directory for C:")
-	drive["D"] = flag.String("drive-d", "", "The path to the directory for D:")
-	drive["E"] = flag.String("drive-e", "", "The path to the directory for E:")
-	drive["F"] = flag.String("drive-f", "", "The path to the directory for F:")
-	drive["G"] = flag.String("drive-g", "", "The path to the directory for G:")
-	drive["H"] = flag.String("drive-h", "", "The path to the directory for H:")
-	drive["I"] = flag.String("drive-i", "", "The path to the directory for I:")
-	drive["J"] = flag.String("drive-j", "", "The path to the directory for J:")
-	drive["K"] = flag.String("drive-k", "", "The path to the directory for K:")
-	drive["L"] = flag.String("drive-l", "", "The path to the directory for L:")
-	drive["M"] = flag.String("drive-m", "", "The path to the directory for M:")
-	drive["N"] = flag.String("drive-n", "", "The path to the directory for N:")
-	drive["O"] = flag.String("drive-o", "", "The path to the directory for O:")
-	drive["P"] = flag.String("drive-p", "", "The path to the directory for P:")
-
-	flag.Parse()
+	drive["A"] = flag.String("drive-a", "", "The path to the directory, ZIP archive, or :memory:, for A:")
+	drive["B"] = flag.String("drive-b", "", "The path to the directory, ZIP archive, or :memory:, for B:")
+	drive["C"] = flag.String("drive-c", "", "The path to the directory, ZIP archive, or :memory:, for C:")
+	drive["D"] = flag.String("drive-d", "", "The path to the directory, ZIP archive, or :memory:, for D:")
+	drive["E"] = flag.String("drive-e", "", "The path to the directory, ZIP archive, or :memory:, for E:")
+	drive["F"] = flag.String("drive-f", "", "The path to the directory, ZIP archive, or :memory:, for F:")
+	drive["G"] = flag.String("drive-g", "", "The path to the directory, ZIP archive, or :memory:, for G:")
+	drive["H"] = flag.String("drive-h", "", "The path to the directory, ZIP archive, or :memory:, for H:")
+	drive["I"] = flag.String("drive-i", "", "The path to the directory, ZIP archive, or :memory:, for I:")
+	drive["J"] = flag.String("drive-j", "", "The path to the directory, ZIP archive, or :memory:, for J:")
+	drive["K"] = flag.String("drive-k", "", "The path to the directory, ZIP archive, or :memory:, for K:")
+	drive["L"] = flag.String("drive-l", "", "The path to the directory, ZIP archive, or :memory:, for L:")
+	drive["M"] = flag.String("drive-m", "", "The path to the directory, ZIP archive, or :memory:, for M:")
+	drive["N"] = flag.String("drive-n", "", "The path to the directory, ZIP archive, or :memory:, for N:")
+	drive["O"] = flag.String("drive-o", "", "The path to the directory, ZIP archive, or :memory:, for O:")
+	drive["P"] = flag.String("drive-p", "", "The path to the directory, ZIP archive, or :memory:, for P:")
+
+	flag.Usage = usage
+
+	// Are we running a subcommand, rather than the emulator?  "run" is
+	// the default, so it may be omitted, and it accepts all our flags.
+	cmdline := os.Args[1:]
+	if len(cmdline) > 0 && cmdline[0] == "run" {
+		cmdline = cmdline[1:]
+	} else if ok, err := runSubcommand(cmdline); ok {
+		if err != nil {
+			exitCode = 1
+		}
+		return
+	}
+
+	_ = flag.CommandLine.Parse(cmdline)
+
+	// Expand environment variables, and "~", within host paths.
+	expandPathFlags(flag.CommandLine)
+
+	// Are we loading a CCP from disk?  This is done before listing
+	// CCPs, so that it appears there as "external".
+	if *ccpFile != "" {
+		_, err := cpmccp.LoadExternal(*ccpFile)
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			return
+		}
+		*ccp = cpmccp.External
+	}
+
+	// Subcommands may also follow our flags, so that they see the
+	// effect of them, for example "-ccp-file x.bin@DC00 list ccps".
+	positional := flag.Args()
+	if len(positional) > 0 && positional[0] == "run" {
+		positional = positional[1:]
+	} else if ok, err := runSubcommand(positional); ok {
+		if err != nil {
+			exitCode = 1
+		}
+		return
+	}
 
 	// Are we dumping CCPs?
 	if *listCcps {
-		x := cpmccp.GetAll()
-		for _, x := range x {
-			fmt.Printf("%5s %-10s %04X bytes, entry-point %04X\n", x.Name, x.Description, len(x.Bytes), x.Start)
-		}
+		listCCPs(os.Stdout)
 		return
 	}
 
 	// Are we dumping console input drivers?
 	if *listInput {
-		obj, _ := consolein.New("null")
-		valid := obj.GetDrivers()
-		slices.Sort(valid)
-
-		for _, name := range valid {
-			suffix := ""
-			if name == cpm.DefaultInputDriver {
-				suffix = "\t[default]"
-			}
-			fmt.Printf("%s%s\n", name, suffix)
-		}
+		listDrivers(os.Stdout, inputDrivers(), cpm.DefaultInputDriver)
 		return
 	}
 
 	// Are we dumping console output drivers?
 	if *listOutput {
-		obj, _ := consoleout.New("null")
-		valid := obj.GetDrivers()
-
-		slices.Sort(valid)
-
-		for _, name := range valid {
-			suffix := ""
-			if name == cpm.DefaultOutputDriver {
-				suffix = "\t[default]"
-			}
-			fmt.Printf("%s%s\n", name, suffix)
-		}
+		listDrivers(os.Stdout, outputDrivers(), cpm.DefaultOutputDriver)
 		return
 	}
 
 	// Are we dumping syscalls?
-	if *listSyscalls {
-
-		// dumper is a helper to dump the contents of
-		// the given map in a human readable fashion.
-		dumper := func(name string, arg map[uint8]cpm.CPMHandler) {
-
-			// Get the syscalls in sorted order
-			ids := []int{}
-			for i := range arg {
-				ids = append(ids, int(i))
-			}
-			sort.Ints(ids)
-
-			// Now show them.
-			fmt.Printf("%s syscalls:\n", name)
-			for _, id := range ids {
-				ent := arg[uint8(id)]
-				fake := ""
-				if ent.Fake {
-					fake = "FAKE"
-				}
-				fmt.Printf("\t%03d %-20s %s\n", int(id), ent.Desc, fake)
-			}
-		}
+	if syscallsFormat.format != "" {
 
 		// Create helper - with defaults.
 		c, err := cpm.New()
@@ -168,8 +252,10 @@ func main() {
 			return
 		}
 
-		dumper("BDOS", c.BDOSSyscalls)
-		dumper("BIOS", c.BIOSSyscalls)
+		err = listSyscalls(os.Stdout, c, syscallsFormat.format)
+		if err != nil {
+			fmt.Printf("error listing syscalls: %s\n", err)
+		}
 		return
 	}
 
@@ -179,15 +265,22 @@ func main() {
 		return
 	}
 
+	// In pty-mode we run a copy of ourselves upon a pseudo-terminal,
+	// and relay to it.
+	if *ptyMode && !ptyChild() {
+		exitCode = runUnderPTY()
+		return
+	}
+
 	// Default program to execute, and arguments to pass to program
 	program := ""
 	args := []string{}
 
 	// If we have a program
-	if len(flag.Args()) > 0 {
-		program = flag.Args()[0]
-		if len(flag.Args()) > 1 {
-			args = flag.Args()[1:]
+	if len(positional) > 0 {
+		program = positional[0]
+		if len(positional) > 1 {
+			args = positional[1:]
 		}
 	}
 
@@ -196,13 +289,19 @@ func main() {
 	lvl.Set(slog.LevelWarn)
 
 	// The default log behaviour is to show critical issues to STDERR
-	logFile := os.Stderr
+	var logFile io.Writer = os.Stderr
 
-	// But if we have a logfile, we'll write there
+	// But if we have a logfile, we'll write there, rotating it if
+	// it grows too large.
 	if *logPath != "" {
 
-		var err error
-		logFile, err = os.OpenFile(*logPath, os.O_CREATE|os.O_WRONLY, 0644)
+		limit, err := rotate.ParseLimit(*logRotate)
+		if err != nil {
+			fmt.Printf("invalid -log-rotate: %s\n", err)
+			return
+		}
+
+		w, err := rotate.Open(*logPath, limit)
 		if err != nil {
 			fmt.Printf("failed to open logfile for writing %s:%s\n", *logPath, err)
 			return
@@ -211,25 +310,126 @@ func main() {
 		// And that will trigger more verbose output
 		lvl.Set(slog.LevelDebug)
 
-		defer logFile.Close()
+		logFile = w
+		defer w.Close()
+	}
+
+	// Printer output may be rotated too.
+	printerRotation, err := rotate.ParseLimit(*prnRotate)
+	if err != nil {
+		fmt.Printf("invalid -prn-rotate: %s\n", err)
+		return
 	}
 
 	// Create our logging handler, using the level we've just setup.
-	log = slog.New(
-		slog.NewJSONHandler(
-			logFile,
-			&slog.HandlerOptions{
-				Level: lvl,
-			}))
+	handler, err := newLogHandler(*logFormat, logFile, &slog.HandlerOptions{
+		Level: lvl,
+	})
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return
+	}
+	log = slog.New(handler)
 
 	// Set the logger now we've updated as appropriate.
 	slog.SetDefault(log)
 
+	// In batch-mode we read input from STDIN, with no terminal setup,
+	// and report a fixed terminal size.
+	inputDriver := *input
+	width, height := 0, 0
+	if *batch {
+		_, err := fmt.Sscanf(strings.ToLower(*batchSize), "%dx%d", &width, &height)
+		if err != nil {
+			fmt.Printf("invalid terminal size '%s', expected WIDTHxHEIGHT\n", *batchSize)
+			return
+		}
+		inputDriver = "file"
+	}
+
+	// If STDIN isn't a terminal, because we're being run by CI, or via
+	// a pipe, drivers which configure the terminal won't work.
+	if !consolein.IsTerminal() {
+		if fallback, ok := consolein.Fallback(inputDriver); ok {
+			slog.Info("STDIN isn't a terminal, changing input driver",
+				slog.String("driver", inputDriver),
+				slog.String("fallback", fallback))
+			inputDriver = fallback
+		}
+	}
+
+	// If the user chose an output driver we always use it.
+	outputChosen := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "output" {
+			outputChosen = true
+		}
+	})
+
+	// Parse the key which will drop us into our monitor, which makes
+	// no sense in batch-mode.
+	monitor, err := parseKey(*monitorKey)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return
+	}
+
+	// Parse the key which will terminate the emulator.
+	kill, err := parseKey(*killKey)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return
+	}
+	if *batch || *command != "" {
+		monitor = 0
+	}
+
 	// Create a new emulator.
 	obj, err := cpm.New(cpm.WithPrinterPath(*prnPath),
+		cpm.WithPrinterRotation(printerRotation),
+		cpm.WithTranscript(*transcript),
+		cpm.WithListDevice("TTY", *lstTTY),
+		cpm.WithListDevice("CRT", *lstCRT),
+		cpm.WithListDevice("LPT", *lstLPT),
+		cpm.WithListDevice("UL1", *lstUL1),
 		cpm.WithOutputDriver(*output),
-		cpm.WithInputDriver(*input),
+		cpm.WithAutoOutput(*autoOutput && !outputChosen),
+		cpm.WithInputDriver(inputDriver),
 		cpm.WithHostExec(*execPrefix),
+		cpm.WithLegacyLineEditing(*legacyEditing),
+		cpm.WithInputCharset(*inputCharset),
+		cpm.WithStuffPacing(*stuffPacing),
+		cpm.WithOutputLimit(*outputLimit),
+		cpm.WithOutputBuffer(*outputBuffer),
+		cpm.WithSerialNumber(*serial),
+		cpm.WithGSX(*gsxCanvas),
+		cpm.WithTerminalSize(width, height),
+		cpm.WithDeterministic(*deterministic),
+		cpm.WithRSX(*rsx),
+		cpm.WithCPU(*cpuName),
+		cpm.WithKeyboardInterrupt(*keyboardInterrupt),
+		cpm.WithMaxInstructions(*maxInstructions),
+		cpm.WithIdleSleep(*idleSleep),
+		cpm.WithCaseSensitiveTail(*preserveTailCase),
+		cpm.WithCrashReport(*crashReport),
+		cpm.WithExitReport(*exitReport && !*quiet),
+		cpm.WithKeepMemory(*keepRAM),
+		cpm.WithWatchpoints(*watchpoints),
+		cpm.WithCompatDatabase(*compatDB),
+		cpm.WithSyscallProfile(*profileSyscalls),
+		cpm.WithManifest(*manifest),
+		cpm.WithEventSocket(*eventSocket),
+		cpm.WithHTTP(*httpAddr),
+		cpm.WithReadOnlyFilesystem(*readOnlyFS),
+		cpm.WithDirectoryCache(*dirCache),
+		cpm.WithMonitorKey(monitor),
+		cpm.WithKillKey(kill),
+		cpm.WithInterruptPolicy(*ctrlC),
+		cpm.WithCasePolicy(*casePolicy),
+		cpm.WithWildcardProtection(*wildcardProtect),
+		cpm.WithLongNames(*longNames),
+		cpm.WithNamedDirectories(*namedDirs),
+		cpm.WithCommands(*command),
 		cpm.WithCCP(*ccp))
 	if err != nil {
 		fmt.Printf("error creating CPM object: %s\n", err)
@@ -241,6 +441,29 @@ func main() {
 		obj.LogNoisy()
 	}
 
+	// If we're killed by a signal the emulator is stopped, via ctx, and
+	// we report it once everything else has been cleaned up.
+	//
+	// This is deferred before the I/O teardown, so that it runs
+	// after the console has been reset.
+	ctx, signals := handleSignals()
+	defer func() {
+		signals.Stop()
+		if sig := signals.Received(); sig != nil {
+			fmt.Printf("\r\nTerminated by signal: %s\r\n", sig)
+			exitCode = signalExitStatus(sig)
+		}
+	}()
+
+	// Write the syscall profile, manifest, and the changes discarded by
+	// a read-only filesystem, if enabled, when we're finishing.
+	//
+	// This is deferred before the I/O teardown, so that it runs
+	// after the console has been reset.
+	defer obj.WriteSyscallProfile()
+	defer obj.WriteManifest()
+	defer obj.WriteReadOnlyReport()
+
 	// I/O SETUP
 	obj.IOSetup()
 
@@ -294,7 +517,7 @@ func main() {
 				found++
 			}
 		}
-		if found == 0 {
+		if found == 0 && !*quiet {
 			fmt.Printf("WARNING: You've chosen to use subdirectories as drives.\r\n")
 			fmt.Printf("         i.e. A/ would be used for the contents of A:\r\n")
 			fmt.Printf("         i.e. B/ would be used for the contents of B:\r\n")
@@ -313,52 +536,100 @@ func main() {
 	}
 
 	// Do we have custom paths?  If so set them.
+	//
+	// ZIP archives are mounted, read-only, with an overlay directory
+	// for writes.
 	for d, pth := range drive {
-		if pth != nil && *pth != "" {
-			obj.SetDrivePath(d, *pth)
+		if pth == nil || *pth == "" {
+			continue
 		}
+		if strings.EqualFold(filepath.Ext(*pth), ".zip") {
+			err := obj.MountDrive(d, *pth)
+			if err != nil {
+				fmt.Printf("Error mounting %s as %s: %s\n", *pth, d, err)
+				return
+			}
+			continue
+		}
+		obj.SetDrivePath(d, *pth)
 	}
 
-	// Load the binary, if we were given one.
-	if program != "" {
-
-		err := obj.LoadBinary(program)
+	// Are we restoring the files of a previous session?
+	if *importState != "" {
+		err := obj.ImportState(*importState)
 		if err != nil {
-			fmt.Printf("Error loading program %s:%s\n", program, err)
+			fmt.Printf("Error importing state from %s: %s\n", *importState, err)
 			return
 		}
+	}
 
-		err = obj.Execute(args)
+	// Are we starting somewhere other than A0?
+	if *startDrive != "" || *startUser != 0 {
+		d := *startDrive
+		if d == "" {
+			d = "A"
+		}
+		err := obj.SetDriveUser(d, *startUser)
 		if err != nil {
+			fmt.Printf("Error selecting the starting drive: %s\n", err)
+			return
+		}
+	}
 
-			// Deliberate stop of execution
-			if err == cpm.ErrHalt {
-				fmt.Printf("\n")
-				return
+	// Are we saving the files of this session when we're finishing?
+	if *exportState != "" {
+		defer func() {
+			err := obj.ExportState(*exportState)
+			if err != nil {
+				fmt.Printf("Error exporting state to %s: %s\n", *exportState, err)
 			}
+		}()
+	}
 
-			// Reboot attempt, also fine
-			if err == cpm.ErrBoot {
-				fmt.Printf("\n")
-				return
-			}
+	// Are we checking the embedded binaries?
+	if *verifyStatic {
+		if !verifyStaticFiles(obj, *embedBin) {
+			exitCode = 1
+		}
+		return
+	}
 
-			// Deliberate stop of execution.
-			if err == cpm.ErrExit {
-				fmt.Printf("\n")
-				return
-			}
+	// Are we watching for changes?
+	if *watch != "" {
+
+		// We don't need a program, but any arguments we were
+		// given should be passed to the binary we're watching.
+		if program != "" {
+			args = positional
+		}
 
-			fmt.Printf("Error running %s [%s]: %s\n",
-				program, strings.Join(args, ","), err)
+		w := newWatcher(obj, *watch, *watchPattern)
+		err := w.Run(ctx, args)
+		if err != nil {
+			fmt.Printf("\nError in watch mode: %s\n", err)
+		}
+		return
+	}
+
+	// newline moves to a fresh line, after the guest's output, when we
+	// exit - unless we've been asked to be quiet.
+	newline := func() {
+		if !*quiet {
+			fmt.Printf("\n")
 		}
+	}
 
-		fmt.Printf("\n")
+	// Load the binary, or binaries, if we were given any.
+	if program != "" {
+		exitCode = runPrograms(ctx, obj, splitPrograms(positional))
+		newline()
 		return
 	}
 
-	// Show a startup-banner.
-	fmt.Printf("\ncpmulator %s\r\nConsole input:%s Console output:%s BIOS:0x%04X BDOS:0x%04X CCP:%s\n", cpmver.GetVersionString(), obj.GetInputDriver().GetName(), obj.GetOutputDriver().GetName(), obj.GetBIOSAddress(), obj.GetBDOSAddress(), obj.GetCCPName())
+	// Show a startup-banner, unless we're being driven by a script.
+	if !*batch && *command == "" && !*quiet {
+		fmt.Printf("\ncpmulator %s\r\nConsole input:%s Console output:%s BIOS:0x%04X BDOS:0x%04X CCP:%s\n", cpmver.GetVersionString(), obj.GetInputDriver().GetName(), obj.GetOutputDriver().GetName(), obj.GetBIOSAddress(), obj.GetBDOSAddress(), obj.GetCCPName())
+	}
 
 	// We will load AUTOEXEC.SUB, once, if it exists (*)
 	//
@@ -378,28 +649,46 @@ func main() {
 		err := obj.LoadCCP()
 		if err != nil {
 			fmt.Printf("error loading CCP: %s\n", err)
+			exitCode = 1
 			return
 		}
 
 		// Run the CCP, which will often load a child-binary.
 		// The child-binary will call "P_TERMCPM" which will cause
 		// the CCP to terminate.
-		err = obj.Execute(args)
+		err = obj.ExecuteContext(ctx, args)
 		if err != nil {
 
+			// Stopped by a signal?
+			if ctx.Err() != nil {
+				return
+			}
+
 			// Start the loop again, which will reload the CCP
 			// and jump to it.  Effectively rebooting.
 			if err == cpm.ErrBoot {
 				continue
 			}
 
-			// Deliberate stop of execution.
+			// A program which used a Z80-only instruction, in
+			// 8080 mode, is reported, and then we reboot.
+			if errors.Is(err, cpm.ErrZ80Instruction) {
+				fmt.Printf("\r\n%s\r\n", err)
+				continue
+			}
+
+			// Deliberate stop of execution, which is a failure
+			// if one of the commands we were given failed.
 			if err == cpm.ErrHalt {
-				fmt.Printf("\n")
+				if obj.CommandFailed() {
+					exitCode = 1
+				}
+				newline()
 				return
 			}
 
 			fmt.Printf("\nError running CCP: %s\n", err)
+			exitCode = 1
 			return
 		}
 	}
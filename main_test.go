@@ -3,11 +3,19 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/skx/cpmulator/asm"
 	"github.com/skx/cpmulator/consoleout"
 	"github.com/skx/cpmulator/cpm"
 )
@@ -58,6 +66,45 @@ func TestDriveChange(t *testing.T) {
 	}
 }
 
+// TestDriveSelectError ensures that the CCP reports an error, and stays
+// upon the current drive, when a drive which doesn't exist is selected.
+func TestDriveSelectError(t *testing.T) {
+
+	obj, err := cpm.New(cpm.WithOutputDriver("logger"))
+	if err != nil {
+		t.Fatalf("Create CP/M failed")
+	}
+
+	obj.SetDrives(false)
+	obj.SetDrivePath("E", filepath.Join(t.TempDir(), "missing"))
+	obj.StuffText("E:\r\nEXIT\r\n")
+
+	// The error causes a warm boot, which reloads the CCP.
+	for {
+		err = obj.LoadCCP()
+		if err != nil {
+			t.Fatalf("load CCP failed")
+		}
+
+		err = obj.Execute([]string{})
+		if err != cpm.ErrBoot {
+			break
+		}
+	}
+	if err != nil && err != cpm.ErrHalt {
+		t.Fatalf("failed to run: %s", err)
+	}
+
+	l := obj.GetOutputDriver().(*consoleout.OutputLoggingDriver)
+
+	out := l.GetOutput()
+	out = strings.ReplaceAll(out, "\n", "")
+	out = strings.ReplaceAll(out, "\r", "")
+	if out != `A>Bdos Err On E: SelectA>` {
+		t.Fatalf("unexpected output '%v'", out)
+	}
+}
+
 // TestReadWriteRand invokes our help-samples to read/write
 // records - via the external API.
 func TestReadWriteRand(t *testing.T) {
@@ -140,3 +187,503 @@ func TestCompleteLighthouse(t *testing.T) {
 		t.Fatalf("resetting our history didn't work")
 	}
 }
+
+// TestParseKey tests parsing the monitor key.
+func TestParseKey(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Result byte
+		Error  bool
+	}
+
+	tests := []TestCase{
+		{"^]", 0x1D, false},
+		{"^a", 0x01, false},
+		{"^@", 0x00, false},
+		{"none", 0x00, false},
+		{"", 0x00, false},
+		{"~", '~', false},
+		{"^1", 0x00, true},
+		{"steve", 0x00, true},
+	}
+
+	for _, test := range tests {
+		out, err := parseKey(test.Input)
+		if test.Error != (err != nil) {
+			t.Fatalf("%s: unexpected error result %v", test.Input, err)
+		}
+		if out != test.Result {
+			t.Fatalf("%s: got 0x%02X, expected 0x%02X", test.Input, out, test.Result)
+		}
+	}
+}
+
+// TestListSyscalls tests the formats supported by -list-syscalls.
+func TestListSyscalls(t *testing.T) {
+
+	var f syscallFormat
+	for in, out := range map[string]string{"true": "text", "JSON": "json", "md": "markdown", "false": ""} {
+		if err := f.Set(in); err != nil || f.String() != out {
+			t.Fatalf("wrong format for %s: %s %v", in, f.String(), err)
+		}
+	}
+	if err := f.Set("xml"); err == nil {
+		t.Fatalf("expected error for unknown format")
+	}
+
+	obj, err := cpm.New()
+	if err != nil {
+		t.Fatalf("Create CP/M failed")
+	}
+
+	// JSON can be decoded, and contains the details we expect.
+	var out bytes.Buffer
+	err = listSyscalls(&out, obj, "json")
+	if err != nil {
+		t.Fatalf("failed to list syscalls: %s", err)
+	}
+
+	var list syscallList
+	err = json.Unmarshal(out.Bytes(), &list)
+	if err != nil {
+		t.Fatalf("failed to decode JSON: %s", err)
+	}
+	if len(list.BDOS) != len(obj.BDOSSyscalls) || len(list.BIOS) != len(obj.BIOSSyscalls) {
+		t.Fatalf("wrong number of syscalls")
+	}
+	for _, ent := range append(list.BDOS, list.BIOS...) {
+		if ent.Name == "" || ent.Description == "" {
+			t.Fatalf("syscall %d is missing a name or description", ent.Number)
+		}
+	}
+	if list.BDOS[0].Name != "P_TERMCPM" || !list.BIOS[len(list.BIOS)-1].Fake {
+		t.Fatalf("unexpected syscall details")
+	}
+
+	// Markdown has a row for each syscall.
+	out.Reset()
+	err = listSyscalls(&out, obj, "markdown")
+	if err != nil {
+		t.Fatalf("failed to list syscalls: %s", err)
+	}
+	rows := strings.Count(out.String(), "\n| ")
+	if rows != len(obj.BDOSSyscalls)+len(obj.BIOSSyscalls)+2 {
+		t.Fatalf("wrong number of rows in markdown output: %d", rows)
+	}
+}
+
+// TestAnalysis tests the report of the syscalls a binary makes.
+func TestAnalysis(t *testing.T) {
+
+	obj, err := cpm.New()
+	if err != nil {
+		t.Fatalf("Create CP/M failed")
+	}
+
+	calls := []asm.Call{
+		{Kind: asm.CallBDOS, Function: 9, Addr: 0x0102},
+		{Kind: asm.CallBDOS, Function: 9, Addr: 0x0110},
+		{Kind: asm.CallBDOS, Function: 200, Addr: 0x0120},
+		{Kind: asm.CallBDOS, Function: -1, Addr: 0x0130},
+		{Kind: asm.CallBIOS, Function: 31, Addr: 0x0140},
+		{Kind: asm.CallBoot, Addr: 0x0150},
+	}
+
+	var out bytes.Buffer
+	writeAnalysis(&out, calls, obj)
+
+	for _, expected := range []string{
+		"C_WRITESTRING    implemented      0102 0110",
+		"200  -                NOT IMPLEMENTED  0120",
+		"?  -                unknown          0130",
+		"31  RESERVE1         fake             0140",
+		"warm boot                              0150",
+		"1 function(s) are not implemented, and 1 are only partially implemented",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("analysis didn't contain '%s':\n%s", expected, out.String())
+		}
+	}
+
+	out.Reset()
+	writeAnalysis(&out, nil, obj)
+	if !strings.Contains(out.String(), "None found") || !strings.Contains(out.String(), "are implemented") {
+		t.Fatalf("unexpected analysis:\n%s", out.String())
+	}
+}
+
+// TestCompletion tests the generation of completion scripts.
+func TestCompletion(t *testing.T) {
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Bool("quiet", false, "Be quiet.  Really.")
+	fs.String("output", "adm-3a", "The output driver's name.")
+	fs.String("log-path", "", "Write logs to [this] file.")
+
+	for shell, expected := range map[string][]string{
+		"bash": {"-log-path -output -quiet", "-output) COMPREPLY=($(compgen -W \"adm-3a ansi", "analyze completion disasm", "list) COMPREPLY"},
+		"zsh":  {"'-quiet[Be quiet]'", "'-output[The output driver'\\''s name]:output:(adm-3a", "'-log-path[Write logs to \\[this\\] file]:log-path:_files'", "'run:Run the given binary"},
+		"fish": {"-o 'quiet' -d 'Be quiet'\n", "-o 'output' -d 'The output driver\\'s name' -x -a 'adm-3a", "-o 'log-path' -d 'Write logs to [this] file' -r", "__fish_seen_subcommand_from list"},
+	} {
+		var out bytes.Buffer
+		err := writeCompletion(&out, shell, fs)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %s", shell, err)
+		}
+		for _, e := range expected {
+			if !strings.Contains(out.String(), e) {
+				t.Fatalf("%s: output didn't contain %q:\n%s", shell, e, out.String())
+			}
+		}
+	}
+
+	err := writeCompletion(&bytes.Buffer{}, "tcsh", fs)
+	if err == nil {
+		t.Fatalf("expected an error for an unknown shell")
+	}
+}
+
+// TestExpandPath ensures environment variables, and "~", are expanded
+// within the flags which name host paths.
+func TestExpandPath(t *testing.T) {
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip("no home directory")
+	}
+	t.Setenv("CPM_TEST_DIR", "/tmp/cpm")
+
+	tests := map[string]string{
+		"":                      "",
+		"A":                     "A",
+		"$CPM_TEST_DIR/A":       "/tmp/cpm/A",
+		"${CPM_TEST_DIR}/B":     "/tmp/cpm/B",
+		"~":                     home,
+		"~/cpm/A":               home + "/cpm/A",
+		"~steve/cpm":            "~steve/cpm",
+		"/tmp/~/x":              "/tmp/~/x",
+		"$CPM_TEST_UNSET_VAR/C": "/C",
+	}
+	for in, out := range tests {
+		if expandPath(in) != out {
+			t.Fatalf("%s expanded to %s, expected %s", in, expandPath(in), out)
+		}
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	driveA := fs.String("drive-a", "", "")
+	driveB := fs.String("drive-b", "", "")
+	lst := fs.String("lst-lpt", "", "")
+	pipe := fs.String("lst-tty", "", "")
+	command := fs.String("command", "", "")
+	err = fs.Parse([]string{"-drive-a", "$CPM_TEST_DIR/A", "-lst-lpt", "file:~/print.log", "-lst-tty", "pipe:lpr $CPM_TEST_DIR", "-command", "TYPE $CPM_TEST_DIR"})
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	expandPathFlags(fs)
+
+	if *driveA != "/tmp/cpm/A" || *driveB != "" {
+		t.Fatalf("drives expanded wrongly: %q %q", *driveA, *driveB)
+	}
+	if *lst != "file:"+home+"/print.log" || *pipe != "pipe:lpr $CPM_TEST_DIR" {
+		t.Fatalf("list devices expanded wrongly: %q %q", *lst, *pipe)
+	}
+	if *command != "TYPE $CPM_TEST_DIR" {
+		t.Fatalf("unexpected expansion %q", *command)
+	}
+}
+
+// TestPrograms ensures that several programs, separated by "--", are run
+// in sequence, optionally sharing RAM, and stop if one fails.
+func TestPrograms(t *testing.T) {
+
+	programs := splitPrograms([]string{"--", "M80.COM", "=HELLO", "--", "--", "L80.COM", "HELLO,HELLO/N/E", "--"})
+	if len(programs) != 2 || strings.Join(programs[0], " ") != "M80.COM =HELLO" || strings.Join(programs[1], " ") != "L80.COM HELLO,HELLO/N/E" {
+		t.Fatalf("unexpected programs %q", programs)
+	}
+
+	dir := t.TempDir()
+	binaries := map[string][]byte{
+		// Store 'B' at 9000H, and exit.
+		"STORE.COM": {0x3E, 0x42, 0x32, 0x00, 0x90, 0x0E, 0x00, 0xCD, 0x05, 0x00},
+		// Show the byte at 9000H, and exit.
+		"SHOW.COM": {0x3A, 0x00, 0x90, 0x5F, 0x0E, 0x02, 0xCD, 0x05, 0x00, 0x0E, 0x00, 0xCD, 0x05, 0x00},
+		// Set a return code of FF00H, failure, and exit.
+		"FAIL.COM": {0x11, 0x00, 0xFF, 0x0E, 0x6C, 0xCD, 0x05, 0x00, 0x0E, 0x00, 0xCD, 0x05, 0x00},
+	}
+	for name, code := range binaries {
+		err := os.WriteFile(filepath.Join(dir, name), code, 0644)
+		if err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	for _, keep := range []bool{true, false} {
+
+		obj, err := cpm.New(cpm.WithOutputDriver("logger"), cpm.WithKeepMemory(keep))
+		if err != nil {
+			t.Fatalf("Create CP/M failed")
+		}
+		defer obj.IOTearDown()
+
+		code := runPrograms(context.Background(), obj, [][]string{{path("STORE.COM")}, {path("SHOW.COM")}})
+		if code != 0 {
+			t.Fatalf("unexpected exit code %d", code)
+		}
+
+		out := obj.GetOutputDriver().(*consoleout.OutputLoggingDriver).GetOutput()
+		if strings.Contains(out, "B") != keep {
+			t.Fatalf("unexpected output %q, when keeping RAM is %t", out, keep)
+		}
+	}
+
+	// A failing program stops the sequence.
+	obj, err := cpm.New(cpm.WithOutputDriver("logger"), cpm.WithKeepMemory(true))
+	if err != nil {
+		t.Fatalf("Create CP/M failed")
+	}
+	defer obj.IOTearDown()
+
+	code := runPrograms(context.Background(), obj, [][]string{{path("STORE.COM")}, {path("FAIL.COM")}, {path("SHOW.COM")}})
+	if code != 1 || obj.ReturnCode() != 0xFF00 {
+		t.Fatalf("unexpected exit code %d, return code %04X", code, obj.ReturnCode())
+	}
+	if out := obj.GetOutputDriver().(*consoleout.OutputLoggingDriver).GetOutput(); out != "" {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	// Loading a binary resets the return code.
+	if obj.LoadBinary(path("SHOW.COM")) != nil || obj.ProgramFailed() {
+		t.Fatalf("the return code wasn't reset")
+	}
+}
+
+// TestWatchMonitor tests that watch-mode coalesces bursts of changes, and
+// ignores the files the guest writes itself.
+func TestWatchMonitor(t *testing.T) {
+
+	dir := t.TempDir()
+
+	// Create OUT.REL, write a record to it, and exit.
+	code := []byte{
+		0x11, 0x1D, 0x01, 0x0E, 0x16, 0xCD, 0x05, 0x00,
+		0x11, 0x1D, 0x01, 0x0E, 0x15, 0xCD, 0x05, 0x00,
+		0x11, 0x1D, 0x01, 0x0E, 0x10, 0xCD, 0x05, 0x00,
+		0x0E, 0x00, 0xCD, 0x05, 0x00,
+	}
+	code = append(code, 0x00)
+	code = append(code, []byte("OUT     REL")...)
+	code = append(code, make([]byte, 24)...)
+
+	bin := filepath.Join(dir, "MAKE.COM")
+	err := os.WriteFile(bin, code, 0644)
+	if err != nil {
+		t.Fatalf("failed to write binary: %s", err)
+	}
+
+	obj, err := cpm.New(cpm.WithOutputDriver("logger"))
+	if err != nil {
+		t.Fatalf("Create CP/M failed")
+	}
+	defer obj.IOTearDown()
+	obj.SetDrivePath("A", dir)
+
+	err = obj.LoadBinary(bin)
+	if err != nil {
+		t.Fatalf("failed to load binary: %s", err)
+	}
+	err = obj.Execute(nil)
+	if err != nil && err != cpm.ErrBoot {
+		t.Fatalf("failed to run binary: %s", err)
+	}
+
+	out := filepath.Join(dir, "OUT.REL")
+	if _, err = os.Stat(out); err != nil {
+		t.Fatalf("the binary didn't create its output: %s", err)
+	}
+
+	w := newWatcher(obj, bin, "")
+	if w.relevant(out) {
+		t.Fatalf("the output of the guest triggered a re-run")
+	}
+	if !w.relevant(filepath.Join(dir, "SOURCE.ASM")) {
+		t.Fatalf("a host change didn't trigger a re-run")
+	}
+
+	// A burst of changes results in a single notification, of the
+	// last relevant one.
+	fsw := &fsnotify.Watcher{Events: make(chan fsnotify.Event), Errors: make(chan error)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.monitor(ctx, fsw)
+
+	for _, name := range []string{"ONE.ASM", "TWO.ASM", "OUT.REL"} {
+		fsw.Events <- fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Write}
+	}
+
+	select {
+	case name := <-w.changed:
+		if filepath.Base(name) != "TWO.ASM" {
+			t.Fatalf("unexpected change reported: %s", name)
+		}
+	case <-time.After(10 * watchDelay):
+		t.Fatalf("no change was reported")
+	}
+
+	select {
+	case name := <-w.changed:
+		t.Fatalf("unexpected second change reported: %s", name)
+	case <-time.After(2 * watchDelay):
+	}
+}
+
+// TestSignals ensures a signal cancels our context, and is recorded, rather
+// than terminating us.
+func TestSignals(t *testing.T) {
+
+	ctx, signals := handleSignals()
+	defer signals.Stop()
+
+	if signals.Received() != nil {
+		t.Fatalf("unexpected signal")
+	}
+
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("failed to find ourselves: %s", err)
+	}
+	err = p.Signal(os.Interrupt)
+	if err != nil {
+		t.Skipf("failed to send a signal: %s", err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the signal didn't cancel our context")
+	}
+	if signals.Received() != os.Interrupt {
+		t.Fatalf("unexpected signal %v", signals.Received())
+	}
+	if signalExitStatus(signals.Received()) != 130 {
+		t.Fatalf("unexpected exit status %d", signalExitStatus(signals.Received()))
+	}
+}
+
+// TestFCBCommand tests the parsing of names, and patterns, by the "fcb"
+// subcommand.
+func TestFCBCommand(t *testing.T) {
+
+	type TestCase struct {
+		Input    string
+		Expected []string
+		Error    bool
+	}
+
+	tests := []TestCase{
+		{Input: "FOO.TXT", Expected: []string{"Drive:    A: (0)", "Name:     \"FOO     \"", "Type:     \"TXT\"", "Filename: FOO.TXT", "Wildcard: false", "Bytes:    00 46 4F 4F 20 20 20 20 20 54 58 54"}},
+		{Input: "b3:*.com", Expected: []string{"Drive:    B: (1)", "User:     3", "Name:     \"????????\"", "Filename: ????????.COM", "Wildcard: true", "Bytes:    01 3F 3F 3F 3F 3F 3F 3F 3F 43 4F 4D"}},
+		{Input: "5:x", Expected: []string{"Drive:    A: (0)", "User:     5", "Type:     \"   \"", "Filename: X", "Wildcard: false"}},
+		{Input: "foo?.c*", Expected: []string{"Name:     \"FOO?    \"", "Type:     \"C??\"", "Wildcard: true"}},
+		{Input: "Q:FOO", Error: true},
+		{Input: "99:FOO", Error: true},
+	}
+
+	for _, test := range tests {
+
+		var out bytes.Buffer
+		err := writeFCB(&out, test.Input)
+		if test.Error {
+			if err == nil {
+				t.Fatalf("%s: expected an error", test.Input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error %s", test.Input, err)
+		}
+
+		lines := strings.Split(out.String(), "\n")
+		if lines[0] != "Input:    "+test.Input {
+			t.Fatalf("%s: wrong first line '%s'", test.Input, lines[0])
+		}
+		for _, expected := range test.Expected {
+			found := false
+			for _, line := range lines {
+				if line == expected {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("%s: output didn't contain '%s':\n%s", test.Input, expected, out.String())
+			}
+		}
+	}
+
+	// Missing patterns, and invalid ones, are errors.
+	for _, args := range [][]string{{}, {"Q:FOO"}} {
+		if fcbCommand(args) == nil {
+			t.Fatalf("%v: expected an error", args)
+		}
+	}
+}
+
+// TestFCBMatchCommand tests the matching of files by the "fcb-match"
+// subcommand.
+func TestFCBMatchCommand(t *testing.T) {
+
+	dir := t.TempDir()
+	for _, name := range []string{"foo.txt", "bar.txt", "foo.com", "longfilename.txt"} {
+		err := os.WriteFile(filepath.Join(dir, name), nil, 0644)
+		if err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	type TestCase struct {
+		Pattern  string
+		Expected []string
+	}
+
+	tests := []TestCase{
+		{Pattern: "*.TXT", Expected: []string{"BAR.TXT", "FOO.TXT"}},
+		{Pattern: "foo.*", Expected: []string{"FOO.COM", "FOO.TXT"}},
+		{Pattern: "F?O.COM", Expected: []string{"FOO.COM"}},
+		{Pattern: "*.BAS", Expected: []string{}},
+	}
+
+	for _, test := range tests {
+
+		var out bytes.Buffer
+		err := writeMatches(&out, test.Pattern, dir)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %s", test.Pattern, err)
+		}
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != len(test.Expected)+1 {
+			t.Fatalf("%s: wrong number of matches:\n%s", test.Pattern, out.String())
+		}
+		for i, name := range test.Expected {
+			fields := strings.Fields(lines[i])
+			if fields[0] != name || fields[1] != filepath.Join(dir, strings.ToLower(name)) {
+				t.Fatalf("%s: wrong match '%s'", test.Pattern, lines[i])
+			}
+		}
+		if !strings.HasPrefix(lines[len(lines)-1], fmt.Sprintf("%d file(s) matched", len(test.Expected))) {
+			t.Fatalf("%s: wrong summary '%s'", test.Pattern, lines[len(lines)-1])
+		}
+	}
+
+	// Missing patterns, and directories, are errors.
+	if fcbMatchCommand(nil) == nil {
+		t.Fatalf("expected an error without a pattern")
+	}
+	if writeMatches(&bytes.Buffer{}, "*.*", filepath.Join(dir, "missing")) == nil {
+		t.Fatalf("expected an error for a missing directory")
+	}
+}
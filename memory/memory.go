@@ -4,28 +4,55 @@ package memory
 
 import "os"
 
+// Hook is a function which is invoked whenever memory is accessed, once
+// one has been configured via SetHook.
+//
+// It is given the address, and size, of the access, and write is true if
+// memory was modified.  Writes are reported after they have taken place.
+type Hook func(addr uint16, size int, write bool)
+
 // Memory is our structure for representing the 64k of RAM
 // that we run our programs within.
 type Memory struct {
 	buf [65536]uint8
+
+	// hook is invoked upon each access, if it is set.
+	hook Hook
+}
+
+// SetHook configures a function which is invoked whenever memory is
+// accessed, which allows watchpoints to be implemented.  A nil hook
+// removes any existing one.
+func (m *Memory) SetHook(hook Hook) {
+	m.hook = hook
 }
 
 // FillRange fills an area of memory with the given byte
 func (m *Memory) FillRange(addr uint16, size int, char uint8) {
+	start, count := addr, size
 	for size > 0 {
 		m.buf[addr] = char
 		addr++
 		size--
 	}
+	if m.hook != nil && count > 0 {
+		m.hook(start, count, true)
+	}
 }
 
 // Get returns a byte at addr of memory.
 func (m *Memory) Get(addr uint16) uint8 {
+	if m.hook != nil {
+		m.hook(addr, 1, false)
+	}
 	return m.buf[addr]
 }
 
 // GetRange returns the contents of a given range
 func (m *Memory) GetRange(addr uint16, size int) []uint8 {
+	if m.hook != nil && size > 0 {
+		m.hook(addr, size, false)
+	}
 	var ret []uint8
 	for size > 0 {
 		ret = append(ret, m.buf[addr])
@@ -35,6 +62,16 @@ func (m *Memory) GetRange(addr uint16, size int) []uint8 {
 	return ret
 }
 
+// Snapshot returns a copy of the whole of memory.
+//
+// Unlike GetRange this doesn't invoke our hook, as the copy is taken on
+// behalf of the host, rather than the program being executed.
+func (m *Memory) Snapshot() []uint8 {
+	ret := make([]uint8, len(m.buf))
+	copy(ret, m.buf[:])
+	return ret
+}
+
 // GetU16 returns a word from the given address of memory.
 func (m *Memory) GetU16(addr uint16) uint16 {
 	l := m.Get(addr)
@@ -67,10 +104,16 @@ func (m *Memory) LoadFile(offset uint16, name string) error {
 // Set sets a byte at addr of memory.
 func (m *Memory) Set(addr uint16, value uint8) {
 	m.buf[addr] = value
+	if m.hook != nil {
+		m.hook(addr, 1, true)
+	}
 }
 
 // SetRange copies bytes from the given data to the specified
 // starting address in RAM.
 func (m *Memory) SetRange(addr uint16, data ...uint8) {
 	copy(m.buf[int(addr):int(addr)+len(data)], data)
+	if m.hook != nil && len(data) > 0 {
+		m.hook(addr, len(data), true)
+	}
 }
@@ -107,3 +107,56 @@ func TestLoadFile(t *testing.T) {
 		}
 	}
 }
+
+// TestMemoryHook tests that our hook sees each access.
+func TestMemoryHook(t *testing.T) {
+
+	mem := new(Memory)
+
+	type access struct {
+		addr  uint16
+		size  int
+		write bool
+	}
+	var seen []access
+
+	mem.SetHook(func(addr uint16, size int, write bool) {
+		seen = append(seen, access{addr, size, write})
+	})
+
+	mem.Set(0x10, 0x01)
+	mem.Get(0x10)
+	mem.SetRange(0x20, 1, 2, 3)
+	mem.GetRange(0x20, 3)
+	mem.FillRange(0x30, 4, 0xFF)
+	mem.GetRange(0x40, 0)
+
+	// Snapshots are taken without invoking the hook.
+	snap := mem.Snapshot()
+	if len(snap) != 0x10000 || snap[0x21] != 2 || snap[0x33] != 0xFF {
+		t.Fatalf("unexpected snapshot")
+	}
+
+	expected := []access{
+		{0x10, 1, true},
+		{0x10, 1, false},
+		{0x20, 3, true},
+		{0x20, 3, false},
+		{0x30, 4, true},
+	}
+	if len(seen) != len(expected) {
+		t.Fatalf("unexpected accesses: %v", seen)
+	}
+	for i, a := range expected {
+		if seen[i] != a {
+			t.Fatalf("access %d was %v, expected %v", i, seen[i], a)
+		}
+	}
+
+	// Removing the hook stops it being called.
+	mem.SetHook(nil)
+	mem.Set(0x10, 0x02)
+	if len(seen) != len(expected) {
+		t.Fatalf("hook was called after removal")
+	}
+}
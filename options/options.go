@@ -0,0 +1,131 @@
+// Package options contains the parsing of the options which may be given
+// to our console input and output drivers.
+//
+// Options are specified after the name of a driver, separated from it by
+// a colon, and consist of comma-separated key=value pairs, for example:
+//
+//	tee:driver=term,log=keys.log
+//	adm-3a:color=green
+package options
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Options holds the options which have been specified for a driver,
+// indexed by (lower-cased) key.
+type Options map[string]string
+
+// Split splits a driver-specification into the name of the driver, and
+// any options which follow it.
+//
+// The name of the driver is lower-cased, for consistency.
+func Split(spec string) (string, Options, error) {
+
+	name := spec
+	opts := ""
+
+	if idx := strings.Index(spec, ":"); idx >= 0 {
+		name = spec[:idx]
+		opts = spec[idx+1:]
+	}
+
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	parsed, err := Parse(opts)
+	if err != nil {
+		return name, nil, fmt.Errorf("invalid options for driver '%s': %s", name, err)
+	}
+	return name, parsed, nil
+}
+
+// Parse parses a string of comma-separated key=value pairs.
+//
+// Empty strings are valid, and result in an empty set of options.
+func Parse(str string) (Options, error) {
+
+	ret := make(Options)
+
+	for _, ent := range strings.Split(str, ",") {
+
+		ent = strings.TrimSpace(ent)
+		if ent == "" {
+			continue
+		}
+
+		key, val, ok := strings.Cut(ent, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected key=value, got '%s'", ent)
+		}
+
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key == "" {
+			return nil, fmt.Errorf("missing key in '%s'", ent)
+		}
+
+		if _, dupe := ret[key]; dupe {
+			return nil, fmt.Errorf("option '%s' specified more than once", key)
+		}
+
+		ret[key] = strings.TrimSpace(val)
+	}
+
+	return ret, nil
+}
+
+// Validate returns an error if any option has been specified which
+// isn't in the list of those which are permitted.
+func (o Options) Validate(allowed ...string) error {
+
+	bogus := []string{}
+
+	for key := range o {
+		found := false
+		for _, a := range allowed {
+			if key == a {
+				found = true
+			}
+		}
+		if !found {
+			bogus = append(bogus, key)
+		}
+	}
+
+	if len(bogus) == 0 {
+		return nil
+	}
+
+	sort.Strings(bogus)
+	if len(allowed) == 0 {
+		return fmt.Errorf("unknown option(s) %s, this driver accepts no options", strings.Join(bogus, ","))
+	}
+	return fmt.Errorf("unknown option(s) %s, valid options are %s", strings.Join(bogus, ","), strings.Join(allowed, ","))
+}
+
+// Get returns the value of the given option, or the default if it
+// was not specified.
+func (o Options) Get(key string, def string) string {
+	if val, ok := o[key]; ok {
+		return val
+	}
+	return def
+}
+
+// String converts the options back to the key=value form, with the keys
+// sorted.
+func (o Options) String() string {
+
+	keys := []string{}
+	for k := range o {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := []string{}
+	for _, k := range keys {
+		out = append(out, k+"="+o[k])
+	}
+	return strings.Join(out, ",")
+}
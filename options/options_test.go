@@ -0,0 +1,74 @@
+package options
+
+import (
+	"testing"
+)
+
+// TestSplit ensures we can split a driver-specification.
+func TestSplit(t *testing.T) {
+
+	type TestCase struct {
+		input string
+		name  string
+		opts  string
+	}
+
+	tests := []TestCase{
+		{"term", "term", ""},
+		{"TERM", "term", ""},
+		{"term:", "term", ""},
+		{"adm-3a:color=green", "adm-3a", "color=green"},
+		{"tee:driver=term, LOG=keys.log", "tee", "driver=term,log=keys.log"},
+		{"file:path=/tmp/a:b", "file", "path=/tmp/a:b"},
+	}
+
+	for _, tst := range tests {
+		name, opts, err := Split(tst.input)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s: %s", tst.input, err)
+		}
+		if name != tst.name {
+			t.Fatalf("wrong name for %s: %s", tst.input, name)
+		}
+		if opts.String() != tst.opts {
+			t.Fatalf("wrong options for %s: %s", tst.input, opts.String())
+		}
+	}
+
+	// Bogus options
+	for _, bogus := range []string{"term:foo", "term:=bar", "tee:log=a,log=b"} {
+		_, _, err := Split(bogus)
+		if err == nil {
+			t.Fatalf("expected error parsing %s", bogus)
+		}
+	}
+}
+
+// TestValidate ensures that unknown options are rejected.
+func TestValidate(t *testing.T) {
+
+	o, err := Parse("path=foo")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	if o.Validate("path") != nil {
+		t.Fatalf("unexpected error validating")
+	}
+	if o.Validate("log", "path") != nil {
+		t.Fatalf("unexpected error validating")
+	}
+	if o.Validate("log") == nil {
+		t.Fatalf("expected error validating")
+	}
+	if o.Validate() == nil {
+		t.Fatalf("expected error validating")
+	}
+
+	if o.Get("path", "") != "foo" {
+		t.Fatalf("wrong value")
+	}
+	if o.Get("missing", "bar") != "bar" {
+		t.Fatalf("wrong default value")
+	}
+}
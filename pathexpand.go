@@ -0,0 +1,93 @@
+// pathexpand.go contains the expansion of environment variables, and "~",
+// within the flags which name host paths, such as "-drive-a $HOME/cpm/A",
+// so that the same command-lines, and scripts, work across machines.
+//
+// Shells usually perform this expansion themselves, but not when the
+// value is quoted, or when the emulator is launched by another program.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pathFlags are the names of the flags whose values are host paths, and
+// are expanded.
+var pathFlags = []string{
+	"cd",
+	"ccp-file",
+	"compat-db",
+	"crash-report",
+	"event-socket",
+	"export-state",
+	"gsx",
+	"import-state",
+	"log-path",
+	"manifest",
+	"prn-path",
+	"profile-syscalls",
+	"transcript",
+	"watch",
+}
+
+// prefixedPathFlags are the names of the flags whose values may be a host
+// path following a prefix, such as "file:~/print.log".
+var prefixedPathFlags = []string{"lst-tty", "lst-crt", "lst-lpt", "lst-ul1"}
+
+// expandPath expands environment variables, written as $NAME or ${NAME},
+// within the given path, along with a leading "~", which is the home
+// directory of the current user.
+//
+// Variables which aren't set expand to the empty string, as they do in the
+// shell.
+func expandPath(path string) string {
+
+	path = os.ExpandEnv(path)
+
+	if path == "~" || strings.HasPrefix(path, "~/") || strings.HasPrefix(path, "~"+string(filepath.Separator)) {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			path = home + path[1:]
+		}
+	}
+	return path
+}
+
+// expandPathFlags expands the values of the path flags which were given
+// upon the command-line, including those of the drives.
+func expandPathFlags(fs *flag.FlagSet) {
+
+	names := make(map[string]bool)
+	for _, name := range pathFlags {
+		names[name] = true
+	}
+	for _, drive := range "abcdefghijklmnop" {
+		names["drive-"+string(drive)] = true
+	}
+
+	prefixed := make(map[string]bool)
+	for _, name := range prefixedPathFlags {
+		prefixed[name] = true
+	}
+
+	expanded := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		val := f.Value.String()
+
+		switch {
+		case names[f.Name]:
+			expanded[f.Name] = expandPath(val)
+		case prefixed[f.Name]:
+			if rest, ok := strings.CutPrefix(val, "file:"); ok {
+				expanded[f.Name] = "file:" + expandPath(rest)
+			}
+		}
+	})
+
+	for name, val := range expanded {
+		fs.Set(name, val)
+	}
+}
@@ -0,0 +1,99 @@
+// programchain.go contains the running of several programs in sequence,
+// given upon the command-line separated by "--", such as:
+//
+//	cpmulator M80.COM =HELLO -- L80.COM HELLO,HELLO/N/E
+//
+// Each program runs to completion, in turn, within the same emulator
+// instance, so they share drives and files, and with "-keep-ram" their
+// memory too.  This suits assembler and linker flows which communicate
+// via temporary files, or memory.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/skx/cpmulator/cpm"
+)
+
+// programSeparator separates the programs given upon the command-line.
+const programSeparator = "--"
+
+// splitPrograms splits the positional arguments we were given into the
+// programs to run, each of which is a binary followed by its arguments.
+//
+// Empty programs, such as those following a trailing separator, are
+// ignored.
+func splitPrograms(positional []string) [][]string {
+
+	var programs [][]string
+	var current []string
+
+	for _, arg := range positional {
+		if arg == programSeparator {
+			if len(current) > 0 {
+				programs = append(programs, current)
+			}
+			current = nil
+			continue
+		}
+		current = append(current, arg)
+	}
+	if len(current) > 0 {
+		programs = append(programs, current)
+	}
+	return programs
+}
+
+// runPrograms runs the given programs in sequence, and returns the exit
+// code we should use.
+//
+// A program which HALTs, or which is stopped via the monitor, stops the
+// sequence, as does one which reports failure via P_CODE, or fails to
+// run.  Canceling the given context stops it too.
+func runPrograms(ctx context.Context, obj *cpm.CPM, programs [][]string) int {
+
+	for i, program := range programs {
+
+		name := program[0]
+		args := program[1:]
+
+		err := obj.LoadBinary(name)
+		if err != nil {
+			fmt.Printf("Error loading program %s:%s\n", name, err)
+			return 1
+		}
+
+		err = obj.ExecuteContext(ctx, args)
+		if err != nil {
+
+			// Stopped by a signal, which our caller reports.
+			if ctx.Err() != nil {
+				return 0
+			}
+
+			// Deliberate stop of execution
+			if err == cpm.ErrHalt || err == cpm.ErrExit {
+				return 0
+			}
+
+			// Reboot attempt, which is the usual way for a
+			// program to end - so move on to the next.
+			if err != cpm.ErrBoot {
+				fmt.Printf("Error running %s [%s]: %s\n",
+					name, strings.Join(args, ","), err)
+				return 1
+			}
+		}
+
+		// Skip the remaining programs if this one failed.
+		if obj.ProgramFailed() && i < len(programs)-1 {
+			fmt.Printf("%s failed, with return code %04XH, skipping the remaining programs\n", name, obj.ReturnCode())
+			return 1
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,141 @@
+//go:build linux
+
+// ptyharness.go contains the implementation of our "-pty" mode, which
+// makes it possible for harnesses, such as expect-style test-scripts, or
+// CI jobs, to drive the emulator reliably via pipes.
+//
+// Our terminal-based input drivers need a real terminal, so in this mode
+// we allocate a pseudo-terminal, and run a copy of ourselves upon it, with
+// the same arguments.  Input read from STDIN is relayed to the emulator,
+// and its output is relayed to STDOUT, exactly as the "script" command
+// does.  When the emulator exits so do we, with the same exit-code.
+//
+// If STDOUT is a terminal the pseudo-terminal has the same size, otherwise
+// it is 80x24.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// ptyChildEnv is set in the environment of the copy of ourselves which we
+// run upon the pseudo-terminal, so that it doesn't allocate another.
+const ptyChildEnv = "CPMULATOR_PTY_CHILD"
+
+// ptyChild returns true if we're running upon a pseudo-terminal which
+// was allocated by our parent.
+func ptyChild() bool {
+	return os.Getenv(ptyChildEnv) != ""
+}
+
+// openPTY allocates a pseudo-terminal, returning the master side, which
+// we read and write, and the slave side, which is the terminal.
+func openPTY() (*os.File, *os.File, error) {
+
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open /dev/ptmx: %s", err)
+	}
+
+	// Unlock the slave, and find its name.
+	fd := int(master.Fd())
+	err = unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to unlock pseudo-terminal: %s", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to find pseudo-terminal: %s", err)
+	}
+
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to open pseudo-terminal: %s", err)
+	}
+	return master, slave, nil
+}
+
+// runUnderPTY runs a copy of ourselves upon a pseudo-terminal, relaying
+// our input and output to it, and returns its exit-code.
+func runUnderPTY() int {
+
+	master, slave, err := openPTY()
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return 1
+	}
+	defer master.Close()
+
+	size := &unix.Winsize{Col: 80, Row: 24}
+	if w, h, err := term.GetSize(int(os.Stdout.Fd())); err == nil {
+		size = &unix.Winsize{Col: uint16(w), Row: uint16(h)}
+	}
+	err = unix.IoctlSetWinsize(int(slave.Fd()), unix.TIOCSWINSZ, size)
+	if err != nil {
+		fmt.Printf("failed to set the size of the pseudo-terminal: %s\n", err)
+		return 1
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Printf("failed to find our executable: %s\n", err)
+		return 1
+	}
+
+	// The pseudo-terminal becomes the controlling terminal of the
+	// emulator, which is run in a new session.  Logs still go to
+	// STDERR, so they're not mixed with the output.
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), ptyChildEnv+"=1")
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+
+	err = cmd.Start()
+	slave.Close()
+	if err != nil {
+		fmt.Printf("failed to launch the emulator: %s\n", err)
+		return 1
+	}
+
+	// If we're being run interactively keys are passed through as they
+	// are pressed, and the emulator echoes them.
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+		if err == nil {
+			defer term.Restore(int(os.Stdin.Fd()), oldState)
+		}
+	}
+
+	go func() {
+		_, _ = io.Copy(master, os.Stdin)
+	}()
+
+	// Reading the master fails, with EIO, once the emulator has exited
+	// and its output has been consumed.
+	_, _ = io.Copy(os.Stdout, master)
+
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		fmt.Printf("error running the emulator: %s\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+// ptyharness_stub.go contains the implementation of our "-pty" mode upon
+// platforms where it isn't supported, see ptyharness.go.
+
+package main
+
+import "fmt"
+
+// ptyChild returns true if we're running upon a pseudo-terminal which
+// was allocated by our parent, which never happens here.
+func ptyChild() bool {
+	return false
+}
+
+// runUnderPTY reports that pseudo-terminals aren't supported.
+func runUnderPTY() int {
+	fmt.Printf("-pty is only supported upon Linux\n")
+	return 1
+}
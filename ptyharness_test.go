@@ -0,0 +1,39 @@
+//go:build linux
+
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/term"
+)
+
+// TestOpenPTY ensures we can allocate a pseudo-terminal, and that data
+// written to the master is read from the terminal.
+func TestOpenPTY(t *testing.T) {
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Skipf("pseudo-terminals are unavailable: %s", err)
+	}
+	defer master.Close()
+	defer slave.Close()
+
+	if !term.IsTerminal(int(slave.Fd())) {
+		t.Fatalf("the pseudo-terminal isn't a terminal")
+	}
+
+	_, err = master.Write([]byte("DIR\n"))
+	if err != nil {
+		t.Fatalf("failed to write to the master: %s", err)
+	}
+
+	buf := make([]byte, 16)
+	n, err := slave.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read from the terminal: %s", err)
+	}
+	if string(buf[:n]) != "DIR\n" {
+		t.Fatalf("unexpected input %q", buf[:n])
+	}
+}
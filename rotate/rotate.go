@@ -0,0 +1,250 @@
+// Package rotate contains the size-based rotation of files which grow
+// forever, such as our debug logs and printer output.
+//
+// Once a file would exceed its maximum size it is renamed with a ".1"
+// suffix, any previous ".1" file becoming ".2", and so on, and a new file
+// is started.  Only the given number of previous files are kept.
+package rotate
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultKeep is the number of previous files which are kept, when a limit
+// doesn't specify it.
+const DefaultKeep = 5
+
+// Limit describes when a file is rotated, and how many previous files are
+// kept.
+//
+// The zero value means the file is never rotated.
+type Limit struct {
+
+	// MaxSize is the size, in bytes, a file may grow to before it is
+	// rotated, or zero for no limit.
+	MaxSize int64
+
+	// Keep is the number of previous files which are kept, zero
+	// meaning the file is simply truncated.
+	Keep int
+}
+
+// ParseLimit parses a limit given as SIZE[/KEEP], where the size may have
+// a K, M, or G suffix, such as "100M" or "512K/2".
+//
+// The empty string means there is no limit.
+func ParseLimit(spec string) (Limit, error) {
+
+	l := Limit{}
+
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return l, nil
+	}
+
+	size, keep, found := strings.Cut(spec, "/")
+
+	l.Keep = DefaultKeep
+	if found {
+		n, err := strconv.Atoi(keep)
+		if err != nil || n < 0 {
+			return l, fmt.Errorf("invalid count of files to keep '%s' in '%s'", keep, spec)
+		}
+		l.Keep = n
+	}
+
+	size = strings.TrimSuffix(strings.ToUpper(size), "B")
+
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(size, "K"):
+		mult = 1024
+	case strings.HasSuffix(size, "M"):
+		mult = 1024 * 1024
+	case strings.HasSuffix(size, "G"):
+		mult = 1024 * 1024 * 1024
+	}
+	if mult > 1 {
+		size = size[:len(size)-1]
+	}
+
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n <= 0 {
+		return l, fmt.Errorf("invalid size in '%s', expected a number with an optional K, M, or G suffix", spec)
+	}
+	l.MaxSize = n * mult
+
+	return l, nil
+}
+
+// Rotate renames the file at the given path, and its previous files, so
+// that a new file may be started, removing the oldest.
+//
+// It isn't an error if the file doesn't exist.
+func Rotate(path string, keep int) error {
+
+	// Without previous files we start again.
+	if keep == 0 {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	err := os.Remove(fmt.Sprintf("%s.%d", path, keep))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	for i := keep - 1; i >= 0; i-- {
+		src := path
+		if i > 0 {
+			src = fmt.Sprintf("%s.%d", path, i)
+		}
+
+		err := os.Rename(src, fmt.Sprintf("%s.%d", path, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// BeforeAppend rotates the file at the given path if appending the given
+// number of bytes to it would exceed the limit, for files which are opened
+// each time they're written to.
+//
+// A file is never rotated while it is empty, so a single large write is
+// kept, rather than lost.
+func BeforeAppend(path string, count int, limit Limit) error {
+
+	if limit.MaxSize == 0 {
+		return nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	if fi.Size() == 0 || fi.Size()+int64(count) <= limit.MaxSize {
+		return nil
+	}
+	return Rotate(path, limit.Keep)
+}
+
+// Writer appends to a file, rotating it once it would exceed its limit.
+type Writer struct {
+
+	// mutex serializes our writes, and rotation.
+	mutex sync.Mutex
+
+	// path is the path of our file, and limit its limit.
+	path  string
+	limit Limit
+
+	// file is the open file, and size its current size.
+	file *os.File
+	size int64
+}
+
+// Open opens the given file for appending, creating it if necessary, and
+// returns a Writer which rotates it according to the given limit.
+func Open(path string, limit Limit) (*Writer, error) {
+
+	w := &Writer{path: path, limit: limit}
+
+	err := w.open()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open opens our file, and finds its current size.
+func (w *Writer) open() error {
+
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.file = f
+	w.size = fi.Size()
+	return nil
+}
+
+// Write appends the given data to our file, rotating it first if the data
+// would take it beyond its limit.
+func (w *Writer) Write(p []byte) (int, error) {
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if w.limit.MaxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.limit.MaxSize {
+		err := w.file.Close()
+		if err != nil {
+			return 0, err
+		}
+		w.file = nil
+
+		err = Rotate(w.path, w.limit.Keep)
+		if err != nil {
+			return 0, err
+		}
+		err = w.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Sync commits the contents of our file to storage.
+func (w *Writer) Sync() error {
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file == nil {
+		return os.ErrClosed
+	}
+	return w.file.Sync()
+}
+
+// Close closes our file.
+func (w *Writer) Close() error {
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
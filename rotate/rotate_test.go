@@ -0,0 +1,139 @@
+package rotate
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestParseLimit ensures that limits are parsed correctly.
+func TestParseLimit(t *testing.T) {
+
+	type TestCase struct {
+		input string
+		limit Limit
+	}
+
+	tests := []TestCase{
+		{"", Limit{}},
+		{"100", Limit{MaxSize: 100, Keep: DefaultKeep}},
+		{"512k/2", Limit{MaxSize: 512 * 1024, Keep: 2}},
+		{"100M", Limit{MaxSize: 100 * 1024 * 1024, Keep: DefaultKeep}},
+		{"100MB/0", Limit{MaxSize: 100 * 1024 * 1024, Keep: 0}},
+		{"2G/10", Limit{MaxSize: 2 * 1024 * 1024 * 1024, Keep: 10}},
+	}
+
+	for _, test := range tests {
+		l, err := ParseLimit(test.input)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s: %s", test.input, err)
+		}
+		if l != test.limit {
+			t.Fatalf("%s parsed as %v, expected %v", test.input, l, test.limit)
+		}
+	}
+
+	for _, bogus := range []string{"M", "0", "-1M", "10X", "10M/", "10M/-1", "10M/x"} {
+		_, err := ParseLimit(bogus)
+		if err == nil {
+			t.Fatalf("expected error parsing %s", bogus)
+		}
+	}
+}
+
+// TestWriter ensures that files are rotated, and only the given number of
+// previous files are kept.
+func TestWriter(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "debug.log")
+
+	w, err := Open(path, Limit{MaxSize: 10, Keep: 2})
+	if err != nil {
+		t.Fatalf("failed to open: %s", err)
+	}
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n", "six\n"} {
+		_, err = w.Write([]byte(line))
+		if err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("failed to close: %s", err)
+	}
+
+	expected := map[string]string{
+		path:        "six\n",
+		path + ".1": "four\nfive\n",
+		path + ".2": "three\n",
+	}
+	for name, content := range expected {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", name, err)
+		}
+		if string(data) != content {
+			t.Fatalf("%s contains %q, expected %q", name, data, content)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Fatalf("too many files were kept")
+	}
+
+	// Writing after closing fails.
+	_, err = w.Write([]byte("x"))
+	if err == nil {
+		t.Fatalf("expected error writing to closed file")
+	}
+}
+
+// TestBeforeAppend ensures files which are reopened for each write are
+// rotated, or truncated when no previous files are kept.
+func TestBeforeAppend(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "print.log")
+
+	write := func(data string, limit Limit) {
+		err := BeforeAppend(path, len(data), limit)
+		if err != nil {
+			t.Fatalf("failed to rotate: %s", err)
+		}
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("failed to open: %s", err)
+		}
+		f.WriteString(data)
+		f.Close()
+	}
+	read := func(name string) string {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", name, err)
+		}
+		return string(data)
+	}
+
+	// A single write larger than the limit is kept.
+	limit := Limit{MaxSize: 8, Keep: 1}
+	write(strings.Repeat("x", 20), limit)
+	write("abc", limit)
+	write("def", limit)
+	if read(path) != "abcdef" || read(path+".1") != strings.Repeat("x", 20) {
+		t.Fatalf("unexpected contents %q %q", read(path), read(path+".1"))
+	}
+
+	// Without a limit nothing happens.
+	write("ghi", Limit{})
+	if read(path) != "abcdefghi" {
+		t.Fatalf("unexpected contents %q", read(path))
+	}
+
+	// Keeping nothing truncates.
+	write("jkl", Limit{MaxSize: 10})
+	if read(path) != "jkl" || read(path+".1") != strings.Repeat("x", 20) {
+		t.Fatalf("unexpected contents %q", read(path))
+	}
+}
@@ -0,0 +1,95 @@
+// signalhandler.go contains the code which handles the emulator being
+// terminated by a signal, such as SIGINT or SIGTERM.
+//
+// The signal is received upon another goroutine, while the emulator is
+// still using the console, so nothing is done there beyond canceling a
+// context.  The emulator notices that, and stops, and then main restores
+// the console, and exits, from its own goroutine.
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// signalExitBase is added to the number of the signal which terminated us,
+// to give our exit status, following the usual shell convention.
+const signalExitBase = 128
+
+// signalHandler waits for SIGINT or SIGTERM, and cancels a context when
+// one is received.
+type signalHandler struct {
+
+	// ch receives our signals, and done is closed when we're stopped.
+	ch   chan os.Signal
+	done chan struct{}
+	once sync.Once
+
+	// mu protects sig, which is the signal we received, if any.
+	mu  sync.Mutex
+	sig os.Signal
+}
+
+// handleSignals launches a goroutine which waits for SIGINT or SIGTERM,
+// and returns a context which is canceled when one is received.
+//
+// Only the first signal is handled, a second one terminates us in the
+// usual way, in case the emulator fails to stop.
+func handleSignals() (context.Context, *signalHandler) {
+
+	s := &signalHandler{
+		ch:   make(chan os.Signal, 1),
+		done: make(chan struct{}),
+	}
+	signal.Notify(s.ch, os.Interrupt, syscall.SIGTERM)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		select {
+		case sig := <-s.ch:
+			signal.Stop(s.ch)
+
+			s.mu.Lock()
+			s.sig = sig
+			s.mu.Unlock()
+
+			cancel()
+
+		case <-s.done:
+			cancel()
+		}
+	}()
+
+	return ctx, s
+}
+
+// Stop stops the handler, after which signals are handled in the usual
+// way.
+func (s *signalHandler) Stop() {
+	s.once.Do(func() {
+		signal.Stop(s.ch)
+		close(s.done)
+	})
+}
+
+// Received returns the signal which we received, or nil if there was none.
+func (s *signalHandler) Received() os.Signal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sig
+}
+
+// signalExitStatus returns the status we should exit with, having
+// received the given signal, which is 128 plus the signal number.
+func signalExitStatus(sig os.Signal) int {
+	status := signalExitBase
+	if s, ok := sig.(syscall.Signal); ok {
+		status += int(s)
+	}
+	return status
+}
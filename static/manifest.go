@@ -0,0 +1,116 @@
+// manifest.go contains the manifest of the files we embed, which records
+// the size, and SHA-256 sum, of each of them.
+//
+// The manifest is generated, via "go generate", whenever the binaries are
+// rebuilt, and allows the embedded copies, or those a guest sees, to be
+// checked for corruption.
+
+package static
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"sort"
+)
+
+//go:generate go run manifest_gen.go
+
+//go:embed manifest.json
+var manifestJSON []byte
+
+// ManifestEntry holds the details of a single embedded file.
+type ManifestEntry struct {
+
+	// Name is the path of the file, such as "A/!CCP.COM".
+	Name string `json:"name"`
+
+	// Size is the size of the file, in bytes.
+	Size int64 `json:"size"`
+
+	// SHA256 is the hex-encoded SHA-256 sum of the contents.
+	SHA256 string `json:"sha256"`
+}
+
+// Matches returns true if the given contents are those of this entry.
+func (m ManifestEntry) Matches(data []byte) bool {
+	return int64(len(data)) == m.Size && Checksum(data) == m.SHA256
+}
+
+// Checksum returns the hex-encoded SHA-256 sum of the given contents, as
+// recorded in the manifest.
+func Checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// GetManifest returns the entries of our manifest, sorted by name.
+func GetManifest() ([]ManifestEntry, error) {
+
+	var manifest []ManifestEntry
+	err := json.Unmarshal(manifestJSON, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	sort.Slice(manifest, func(i, j int) bool {
+		return manifest[i].Name < manifest[j].Name
+	})
+	return manifest, nil
+}
+
+// FindManifestEntry returns the entry of our manifest for the given path,
+// such as "A/!CCP.COM".
+func FindManifestEntry(name string) (ManifestEntry, bool) {
+
+	manifest, err := GetManifest()
+	if err != nil {
+		return ManifestEntry{}, false
+	}
+
+	for _, ent := range manifest {
+		if ent.Name == name {
+			return ent, true
+		}
+	}
+	return ManifestEntry{}, false
+}
+
+// Verify checks that the files we embed match our manifest, returning an
+// error describing each which doesn't.
+func Verify() []error {
+
+	manifest, err := GetManifest()
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	known := make(map[string]bool)
+
+	for _, ent := range manifest {
+		known[ent.Name] = true
+
+		data, err := fs.ReadFile(content, ent.Name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", ent.Name, err))
+			continue
+		}
+		if !ent.Matches(data) {
+			errs = append(errs, fmt.Errorf("%s: expected %d bytes with SHA-256 %s, found %d bytes with SHA-256 %s",
+				ent.Name, ent.Size, ent.SHA256, len(data), Checksum(data)))
+		}
+	}
+
+	// Every embedded file should be listed.
+	files, _ := fs.Glob(content, "*/*")
+	for _, name := range files {
+		if !known[name] {
+			errs = append(errs, fmt.Errorf("%s: missing from the manifest", name))
+		}
+	}
+	return errs
+}
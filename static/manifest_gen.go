@@ -0,0 +1,63 @@
+//go:build ignore
+
+// manifest_gen.go generates manifest.json, which records the size, and
+// SHA-256 sum, of each file we embed.  It is run via "go generate", and
+// by the Makefile once the binaries have been assembled.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// entry is the same as static.ManifestEntry, which we can't import as
+// we're run to generate part of that package.
+type entry struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func main() {
+
+	files, err := filepath.Glob("*/*")
+	if err != nil {
+		fmt.Printf("failed to find files: %s\n", err)
+		os.Exit(1)
+	}
+	sort.Strings(files)
+
+	manifest := []entry{}
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Printf("failed to read %s: %s\n", path, err)
+			os.Exit(1)
+		}
+
+		sum := sha256.Sum256(data)
+		manifest = append(manifest, entry{
+			Name:   filepath.ToSlash(path),
+			Size:   int64(len(data)),
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+	}
+
+	out, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		fmt.Printf("failed to encode manifest: %s\n", err)
+		os.Exit(1)
+	}
+
+	err = os.WriteFile("manifest.json", append(out, '\n'), 0644)
+	if err != nil {
+		fmt.Printf("failed to write manifest: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -36,3 +36,36 @@ func TestEmpty(t *testing.T) {
 		t.Fatalf("got files, but expected none")
 	}
 }
+
+// TestManifest ensures our manifest matches the files we embed, so that
+// it is regenerated when they change.
+func TestManifest(t *testing.T) {
+
+	errs := Verify()
+	for _, err := range errs {
+		t.Errorf("%s", err)
+	}
+	if len(errs) > 0 {
+		t.Fatalf("the manifest is out of date, run 'go generate' in static/")
+	}
+
+	ent, ok := FindManifestEntry("A/!CCP.COM")
+	if !ok {
+		t.Fatalf("failed to find !CCP.COM in the manifest")
+	}
+	data, err := GetContent().ReadFile("A/!CCP.COM")
+	if err != nil {
+		t.Fatalf("failed to read !CCP.COM: %s", err)
+	}
+	if !ent.Matches(data) {
+		t.Fatalf("!CCP.COM doesn't match the manifest")
+	}
+	if ent.Matches(append(data, 0x00)) {
+		t.Fatalf("modified !CCP.COM matches the manifest")
+	}
+
+	_, ok = FindManifestEntry("A/STEVE.COM")
+	if ok {
+		t.Fatalf("found a file which isn't embedded")
+	}
+}
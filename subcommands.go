@@ -0,0 +1,449 @@
+// subcommands.go contains the implementation of our subcommands, which
+// are small tools that don't involve running the emulator.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/skx/cpmulator/asm"
+	cpmccp "github.com/skx/cpmulator/ccp"
+	"github.com/skx/cpmulator/consolein"
+	"github.com/skx/cpmulator/consoleout"
+	"github.com/skx/cpmulator/cpm"
+	"github.com/skx/cpmulator/fcb"
+)
+
+// subcommand holds the details of a single subcommand.
+type subcommand struct {
+
+	// usage is a short summary of the arguments the subcommand expects.
+	usage string
+
+	// desc is a description of the subcommand.
+	desc string
+
+	// handler is the function which implements the subcommand, it
+	// receives the arguments which follow the subcommand name.
+	handler func(args []string) error
+}
+
+// subcommands holds our known subcommands, indexed by name.
+var subcommands = map[string]subcommand{
+	"analyze": {
+		usage:   "FILE [ADDR]",
+		desc:    "Report the BDOS and BIOS functions a binary appears to call, and whether we implement them.",
+		handler: analyzeCommand,
+	},
+	"disasm": {
+		usage:   "FILE [ADDR]",
+		desc:    "Disassemble a binary, which is loaded at 0x0100 unless an address is given, naming the BDOS functions it calls.",
+		handler: disasmCommand,
+	},
+	"fcb": {
+		usage:   "PATTERN [PATTERN..]",
+		desc:    "Show how the given names, or patterns, are parsed into an FCB.",
+		handler: fcbCommand,
+	},
+	"fcb-match": {
+		usage:   "PATTERN [DIRECTORY]",
+		desc:    "Show which files in the given directory match the pattern.",
+		handler: fcbMatchCommand,
+	},
+	"list": {
+		usage:   "ccps|input|output|syscalls [FORMAT]",
+		desc:    "List the embedded CCPs, console drivers, or syscalls, the latter as text, json, or markdown.",
+		handler: listCommand,
+	},
+	"run": {
+		usage: "[FLAGS] [FILE [ARGS..]]",
+		desc:  "Run the given binary, or the CCP, which is the default if no command is given.",
+	},
+}
+
+// init registers the subcommands which refer to our table of subcommands
+// themselves, which can't be done in its declaration.
+func init() {
+	subcommands["completion"] = subcommand{
+		usage:   "bash|zsh|fish",
+		desc:    "Generate a completion script for the given shell.",
+		handler: completionCommand,
+	}
+	subcommands["help"] = subcommand{
+		desc: "Show this help.",
+		handler: func(args []string) error {
+			usage()
+			return nil
+		},
+	}
+}
+
+// usage shows our subcommands, and flags, and is used as flag.Usage.
+func usage() {
+
+	out := flag.CommandLine.Output()
+
+	fmt.Fprintf(out, "Usage:\n")
+	fmt.Fprintf(out, "  cpmulator [FLAGS] [FILE [ARGS..]]\n")
+	fmt.Fprintf(out, "  cpmulator [FLAGS] FILE [ARGS..] -- FILE [ARGS..] ..\n")
+	fmt.Fprintf(out, "  cpmulator COMMAND [ARGS..]\n")
+	fmt.Fprintf(out, "\nCommands:\n")
+
+	names := []string{}
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-10s %s\n", name, subcommands[name].desc)
+	}
+
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// runSubcommand executes the named subcommand, if it exists.
+//
+// The return value will be true if a subcommand was found, and executed,
+// along with the error it returned, if any, which has been reported.
+func runSubcommand(args []string) (bool, error) {
+
+	if len(args) < 1 {
+		return false, nil
+	}
+
+	// "run" has no handler, as it is the emulator itself.
+	cmd, ok := subcommands[args[0]]
+	if !ok || cmd.handler == nil {
+		return false, nil
+	}
+
+	err := cmd.handler(args[1:])
+	if err != nil {
+		fmt.Printf("Error running %s: %s\n", args[0], err)
+		fmt.Printf("Usage: cpmulator %s %s\n", args[0], cmd.usage)
+	}
+	return true, err
+}
+
+// fcbCommand shows how the given strings are parsed into FCBs.
+func fcbCommand(args []string) error {
+
+	if len(args) < 1 {
+		return fmt.Errorf("no pattern specified")
+	}
+
+	for i, arg := range args {
+
+		if i > 0 {
+			fmt.Printf("\n")
+		}
+
+		err := writeFCB(os.Stdout, arg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFCB writes the FCB the given string is parsed into, returning an
+// error if its drive, or user number, prefix is invalid.
+func writeFCB(out io.Writer, arg string) error {
+
+	du, _, err := fcb.SplitPrefix(arg, nil)
+	if err != nil {
+		return err
+	}
+
+	f := fcb.FromString(arg)
+
+	// Is this a wildcard?
+	wild := strings.Contains(string(f.Name[:])+string(f.Type[:]), "?")
+
+	fmt.Fprintf(out, "Input:    %s\n", arg)
+	fmt.Fprintf(out, "Drive:    %c: (%d)\n", f.Drive+'A', f.Drive)
+	if du.User >= 0 {
+		fmt.Fprintf(out, "User:     %d\n", du.User)
+	}
+	fmt.Fprintf(out, "Name:     \"%s\"\n", string(f.Name[:]))
+	fmt.Fprintf(out, "Type:     \"%s\"\n", string(f.Type[:]))
+	fmt.Fprintf(out, "Filename: %s\n", f.GetFileName())
+	fmt.Fprintf(out, "Wildcard: %t\n", wild)
+	fmt.Fprintf(out, "Bytes:   ")
+	for _, b := range f.AsBytes()[0:12] {
+		fmt.Fprintf(out, " %02X", b)
+	}
+	fmt.Fprintf(out, "\n")
+	return nil
+}
+
+// fcbMatchCommand shows which files in a directory would match a pattern.
+func fcbMatchCommand(args []string) error {
+
+	if len(args) < 1 {
+		return fmt.Errorf("no pattern specified")
+	}
+
+	dir := "."
+	if len(args) > 1 {
+		dir = args[1]
+	}
+	return writeMatches(os.Stdout, args[0], dir)
+}
+
+// writeMatches writes the files in the given directory which match the
+// given pattern.
+func writeMatches(out io.Writer, pattern string, dir string) error {
+
+	f := fcb.FromString(pattern)
+
+	matches, err := f.GetMatches(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range matches {
+		fmt.Fprintf(out, "%-12s %s\n", m.Name, m.Host)
+	}
+	fmt.Fprintf(out, "%d file(s) matched %s in %s\n", len(matches), f.GetFileName(), dir)
+	return nil
+}
+
+// loadBinary reads the binary named by the first argument, and the address
+// at which it is loaded, which is the second argument, or 0x0100.
+func loadBinary(args []string) ([]byte, uint16, error) {
+
+	if len(args) < 1 {
+		return nil, 0, fmt.Errorf("no file specified")
+	}
+
+	addr := uint64(0x0100)
+	if len(args) > 1 {
+		var err error
+		addr, err = strconv.ParseUint(args[1], 0, 16)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid address '%s'", args[1])
+		}
+	}
+
+	code, err := os.ReadFile(args[0])
+	if err != nil {
+		return nil, 0, err
+	}
+	if int(addr)+len(code) > 0x10000 {
+		return nil, 0, fmt.Errorf("%s is too large to load at %04X", args[0], addr)
+	}
+	return code, uint16(addr), nil
+}
+
+// disasmCommand shows an annotated disassembly of the given binary.
+func disasmCommand(args []string) error {
+
+	code, addr, err := loadBinary(args)
+	if err != nil {
+		return err
+	}
+
+	// Our BDOS functions are named in the listing.
+	obj, err := cpm.New(cpm.WithOutputDriver("null"))
+	if err != nil {
+		return err
+	}
+	names := make(map[uint8]string)
+	for num, handler := range obj.BDOSSyscalls {
+		names[num] = handler.Desc
+	}
+
+	fmt.Printf("; %s, %d bytes loaded at %04X\n", args[0], len(code), addr)
+	for _, line := range asm.DisassembleAnnotated(code, addr, names) {
+		fmt.Printf("%s\n", line)
+	}
+	return nil
+}
+
+// analyzeCommand reports the syscalls the given binary appears to make.
+func analyzeCommand(args []string) error {
+
+	code, addr, err := loadBinary(args)
+	if err != nil {
+		return err
+	}
+
+	obj, err := cpm.New(cpm.WithOutputDriver("null"))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s, %d bytes loaded at %04X\n\n", args[0], len(code), addr)
+	writeAnalysis(os.Stdout, asm.FindCalls(code, addr), obj)
+	return nil
+}
+
+// writeAnalysis writes a table of the given calls, grouped by function,
+// showing whether each is implemented by the given emulator.
+func writeAnalysis(out io.Writer, calls []asm.Call, obj *cpm.CPM) {
+
+	// callers holds the addresses each function is called from,
+	// indexed by the kind of call, and then the function.
+	callers := make(map[string]map[int][]uint16)
+	for _, call := range calls {
+		if callers[call.Kind] == nil {
+			callers[call.Kind] = make(map[int][]uint16)
+		}
+		callers[call.Kind][call.Function] = append(callers[call.Kind][call.Function], call.Addr)
+	}
+
+	// where lists the addresses a function is called from.
+	where := func(addrs []uint16) string {
+		str := ""
+		for i, a := range addrs {
+			if i == 8 {
+				return str + fmt.Sprintf(" (+%d more)", len(addrs)-i)
+			}
+			str += fmt.Sprintf(" %04X", a)
+		}
+		return strings.TrimSpace(str)
+	}
+
+	// sorted returns the functions in the given map, in order.
+	sorted := func(m map[int][]uint16) []int {
+		keys := []int{}
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Ints(keys)
+		return keys
+	}
+
+	missing, fake := 0, 0
+
+	for _, tbl := range []struct {
+		kind     string
+		handlers map[uint8]cpm.CPMHandler
+	}{{asm.CallBDOS, obj.BDOSSyscalls}, {asm.CallBIOS, obj.BIOSSyscalls}} {
+
+		fmt.Fprintf(out, "%s functions:\n", tbl.kind)
+		if len(callers[tbl.kind]) == 0 {
+			fmt.Fprintf(out, "  None found.\n\n")
+			continue
+		}
+
+		for _, num := range sorted(callers[tbl.kind]) {
+			name, status := "-", "unknown"
+			if num >= 0 {
+				handler, ok := tbl.handlers[uint8(num)]
+				switch {
+				case !ok || num > 0xFF:
+					status = "NOT IMPLEMENTED"
+					missing++
+				case handler.Fake:
+					name, status = handler.Desc, "fake"
+					fake++
+				default:
+					name, status = handler.Desc, "implemented"
+				}
+			}
+
+			number := "?"
+			if num >= 0 {
+				number = fmt.Sprintf("%d", num)
+			}
+			fmt.Fprintf(out, "  %3s  %-16s %-16s %s\n", number, name, status, where(callers[tbl.kind][num]))
+		}
+		fmt.Fprintf(out, "\n")
+	}
+
+	if len(callers[asm.CallBoot]) > 0 || len(callers[asm.CallRST]) > 0 {
+		fmt.Fprintf(out, "Other:\n")
+		for _, a := range callers[asm.CallBoot] {
+			fmt.Fprintf(out, "  %-38s %s\n", "warm boot", where(a))
+		}
+		for _, num := range sorted(callers[asm.CallRST]) {
+			fmt.Fprintf(out, "  %-38s %s\n", fmt.Sprintf("RST 0x%02X", num), where(callers[asm.CallRST][num]))
+		}
+		fmt.Fprintf(out, "\n")
+	}
+
+	if missing == 0 && fake == 0 {
+		fmt.Fprintf(out, "All of the functions which were found are implemented.\n")
+		return
+	}
+	fmt.Fprintf(out, "%d function(s) are not implemented, and %d are only partially implemented, so the program may not work correctly.\n", missing, fake)
+}
+
+// listCommand lists the things which may be selected by our flags.
+func listCommand(args []string) error {
+
+	if len(args) < 1 {
+		return fmt.Errorf("nothing to list")
+	}
+
+	switch args[0] {
+	case "ccps", "ccp":
+		listCCPs(os.Stdout)
+	case "input", "input-drivers":
+		listDrivers(os.Stdout, inputDrivers(), cpm.DefaultInputDriver)
+	case "output", "output-drivers":
+		listDrivers(os.Stdout, outputDrivers(), cpm.DefaultOutputDriver)
+	case "syscalls":
+		var format syscallFormat
+		err := format.Set("text")
+		if len(args) > 1 {
+			err = format.Set(args[1])
+		}
+		if err != nil {
+			return err
+		}
+
+		// Create helper - with defaults.
+		obj, err := cpm.New(cpm.WithOutputDriver("null"))
+		if err != nil {
+			return err
+		}
+		return listSyscalls(os.Stdout, obj, format.format)
+	default:
+		return fmt.Errorf("unknown list '%s'", args[0])
+	}
+	return nil
+}
+
+// listCCPs shows our CCPs, including one loaded via -ccp-file.
+func listCCPs(out io.Writer) {
+	for _, x := range cpmccp.GetAll() {
+		fmt.Fprintf(out, "%8s %-10s %04X bytes, entry-point %04X\n", x.Name, x.Description, len(x.Bytes), x.Start)
+	}
+}
+
+// inputDrivers returns the names of our console input drivers, sorted.
+func inputDrivers() []string {
+	obj, _ := consolein.New("null")
+	valid := obj.GetDrivers()
+	sort.Strings(valid)
+	return valid
+}
+
+// outputDrivers returns the names of our console output drivers, sorted.
+func outputDrivers() []string {
+	obj, _ := consoleout.New("null")
+	valid := obj.GetDrivers()
+	sort.Strings(valid)
+	return valid
+}
+
+// listDrivers shows the given drivers, marking the default.
+func listDrivers(out io.Writer, names []string, def string) {
+	for _, name := range names {
+		suffix := ""
+		if name == def {
+			suffix = "\t[default]"
+		}
+		fmt.Fprintf(out, "%s%s\n", name, suffix)
+	}
+}
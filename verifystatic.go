@@ -0,0 +1,52 @@
+// verifystatic.go contains the implementation of the -verify-static flag,
+// which checks the binaries we embed against the manifest of their sizes,
+// and checksums, recorded when they were built.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/skx/cpmulator/cpm"
+	"github.com/skx/cpmulator/static"
+)
+
+// verifyStaticFiles checks the embedded binaries, and the copies of them
+// the guest would see, reporting the result of each check.
+//
+// The return value is true if there were no problems.
+func verifyStaticFiles(obj *cpm.CPM, embedded bool) bool {
+
+	ok := true
+
+	// The embedded copies should always match.
+	for _, err := range static.Verify() {
+		fmt.Printf("embedded %s\r\n", err)
+		ok = false
+	}
+
+	if !embedded {
+		fmt.Printf("The embedded binaries are disabled, so the guest can't see them.\r\n")
+		return ok
+	}
+
+	checks, err := obj.VerifyStatic()
+	if err != nil {
+		fmt.Printf("error verifying embedded binaries: %s\r\n", err)
+		return false
+	}
+
+	for _, c := range checks {
+		switch c.Status {
+		case cpm.StaticOK:
+			fmt.Printf("%-16s %s\r\n", c.Name, c.Status)
+		case cpm.StaticModified:
+			fmt.Printf("%-16s %s, hidden by a file with SHA-256 %s\r\n", c.Name, c.Status, c.SHA256)
+			ok = false
+		default:
+			fmt.Printf("%-16s %s\r\n", c.Name, c.Status)
+			ok = false
+		}
+	}
+	return ok
+}
@@ -0,0 +1,326 @@
+// watchmode.go contains the implementation of our "-watch" mode, which
+// re-runs a binary, or a SUBMIT file, when files on the host change.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/skx/cpmulator/cpm"
+)
+
+// watchDelay is the time we wait for a burst of filesystem events to
+// settle down before we consider the change complete.
+//
+// Editors, and compilers, tend to generate several events for a
+// single save so we need to coalesce them.
+const watchDelay = 250 * time.Millisecond
+
+// guestDelay is how long after the guest changes a host file a change to
+// it is assumed to be the guest's own, rather than the user's.
+//
+// Without this a program which writes files, such as a compiler writing
+// its output, would keep restarting itself.
+const guestDelay = time.Second
+
+// watcher holds the state for our watch-mode.
+type watcher struct {
+
+	// obj is the emulator instance.
+	obj *cpm.CPM
+
+	// target is the binary, or SUBMIT file, we're running.
+	target string
+
+	// patterns contains the glob-patterns that a changed file must
+	// match to trigger a re-run.
+	patterns []string
+
+	// changed receives a value every time a relevant change is seen.
+	changed chan string
+}
+
+// newWatcher creates a watcher for the given target.
+//
+// The patterns are a comma-separated list of globs, which are matched
+// against the basename of each changed file, case-insensitively.
+func newWatcher(obj *cpm.CPM, target string, patterns string) *watcher {
+
+	w := &watcher{
+		obj:     obj,
+		target:  target,
+		changed: make(chan string, 1),
+	}
+
+	for _, p := range strings.Split(patterns, ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			w.patterns = append(w.patterns, strings.ToUpper(p))
+		}
+	}
+	return w
+}
+
+// isSubmit returns true if our target is a SUBMIT file, rather than a
+// binary.
+func (w *watcher) isSubmit() bool {
+	return strings.ToUpper(filepath.Ext(w.target)) == ".SUB"
+}
+
+// relevant returns true if a change to the given file should trigger
+// a re-run.
+func (w *watcher) relevant(path string) bool {
+
+	name := strings.ToUpper(filepath.Base(path))
+
+	// SUBMIT writes "$$$.SUB" as it runs, and we don't want to
+	// trigger ourselves.
+	if strings.Contains(name, "$") {
+		return false
+	}
+
+	// Nor do we want to trigger upon the files the guest writes.
+	if w.obj.GuestChanged(path, guestDelay) {
+		return false
+	}
+
+	// No patterns?  Then everything is relevant.
+	if len(w.patterns) == 0 {
+		return true
+	}
+
+	for _, p := range w.patterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// directories returns the distinct host directories we should monitor.
+//
+// These are the directories which back each drive, along with the
+// directory containing a binary we've been asked to run.
+func (w *watcher) directories() []string {
+
+	seen := make(map[string]bool)
+	var dirs []string
+
+	add := func(dir string) {
+		if dir == "" {
+			dir = "."
+		}
+		dir = filepath.Clean(dir)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	for _, path := range w.obj.GetDrivePaths() {
+		if path != cpm.MemoryDrive {
+			add(path)
+		}
+	}
+	if !w.isSubmit() {
+		add(filepath.Dir(w.target))
+	}
+	return dirs
+}
+
+// monitor receives events from fsnotify and forwards the relevant ones,
+// after they've settled down, to our changed channel.
+func (w *watcher) monitor(ctx context.Context, fsw *fsnotify.Watcher) {
+
+	var timer *time.Timer
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case ev, ok := <-fsw.Events:
+			if !ok {
+				return
+			}
+
+			// We don't care about chmod-only events
+			if ev.Op == fsnotify.Chmod {
+				continue
+			}
+
+			if !w.relevant(ev.Name) {
+				continue
+			}
+
+			// (Re)start the timer, so that we wait for
+			// things to settle down.
+			//
+			// Each timer reports its own event, as it runs
+			// upon a different goroutine.
+			name := ev.Name
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.AfterFunc(watchDelay, func() {
+				// Don't block if there is already a pending
+				// notification, one is enough.
+				select {
+				case w.changed <- name:
+				default:
+				}
+			})
+
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return
+			}
+			log.Warn("error watching files",
+				slog.String("error", err.Error()))
+		}
+	}
+}
+
+// Run launches the target, and re-launches it whenever a change is seen.
+//
+// This function only returns if there is a fatal error, or the given
+// context is canceled.
+func (w *watcher) Run(ctx context.Context, args []string) error {
+
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create filesystem watcher: %s", err)
+	}
+	defer fsw.Close()
+
+	for _, dir := range w.directories() {
+		err = fsw.Add(dir)
+		if err != nil {
+			return fmt.Errorf("failed to watch directory %s: %s", dir, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go w.monitor(ctx, fsw)
+
+	if w.isSubmit() {
+		return w.runSubmit(ctx, args)
+	}
+	return w.runBinary(ctx, args)
+}
+
+// runBinary handles the case where we're running a binary.
+//
+// The binary is executed until it terminates, and if a change is seen
+// while it is running it is terminated and re-launched.
+func (w *watcher) runBinary(ctx context.Context, args []string) error {
+
+	for {
+		err := w.obj.LoadBinary(w.target)
+		if err != nil {
+			return fmt.Errorf("error loading program %s: %s", w.target, err)
+		}
+
+		// Allow the run to be canceled if something changes.
+		run, cancel := context.WithCancel(ctx)
+		restart := make(chan bool, 1)
+		go func() {
+			select {
+			case name := <-w.changed:
+				fmt.Printf("\r\n[watch] %s changed, restarting\r\n", name)
+				restart <- true
+				cancel()
+			case <-run.Done():
+			}
+		}()
+
+		err = w.obj.ExecuteContext(run, args)
+		cancel()
+
+		// Have we been stopped?
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		switch err {
+		case nil, cpm.ErrHalt, cpm.ErrBoot, cpm.ErrExit, context.Canceled:
+			// Expected ways for a program to end.
+		default:
+			fmt.Printf("\r\nError running %s [%s]: %s\r\n",
+				w.target, strings.Join(args, ","), err)
+		}
+
+		// If we were restarted because of a change we loop
+		// immediately, otherwise we wait for one.
+		select {
+		case <-restart:
+		default:
+			fmt.Printf("\r\n[watch] %s finished, waiting for changes\r\n", w.target)
+			select {
+			case name := <-w.changed:
+				fmt.Printf("\r\n[watch] %s changed, restarting\r\n", name)
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+// runSubmit handles the case where we're processing a SUBMIT file.
+//
+// Here we run the CCP, as normal, and stuff "SUBMIT NAME" into the
+// console input when the run should happen.  This keeps the console
+// session alive between runs.
+func (w *watcher) runSubmit(ctx context.Context, args []string) error {
+
+	name := strings.TrimSuffix(filepath.Base(w.target), filepath.Ext(w.target))
+	cmd := fmt.Sprintf("SUBMIT %s\n", strings.ToUpper(name))
+
+	// Run the submit-file once, at startup.
+	w.obj.StuffText(cmd)
+
+	// And again each time a change is seen.
+	go func() {
+		for name := range w.changed {
+			fmt.Printf("\r\n[watch] %s changed, queuing %s\r\n", name, strings.TrimSpace(cmd))
+			w.obj.StuffText(cmd)
+		}
+	}()
+
+	for {
+		err := w.obj.LoadCCP()
+		if err != nil {
+			return fmt.Errorf("error loading CCP: %s", err)
+		}
+
+		err = w.obj.ExecuteContext(ctx, args)
+		if err != nil {
+
+			// Have we been stopped?
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			// Start the loop again, which will reload the CCP
+			// and jump to it.  Effectively rebooting.
+			if err == cpm.ErrBoot {
+				continue
+			}
+
+			// Deliberate stop of execution.
+			if err == cpm.ErrHalt {
+				return nil
+			}
+
+			return fmt.Errorf("error running CCP: %s", err)
+		}
+	}
+}